@@ -0,0 +1,25 @@
+package main
+
+import (
+    "net/http"
+    "net/http/pprof"
+)
+
+// registerDebug 在mux上挂载/debug/pprof/，提供堆、goroutine等运行时剖析
+func registerDebug(mux *http.ServeMux) {
+    mux.HandleFunc("/debug/pprof/", pprof.Index)
+    mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+    mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+    mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+    mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+// newDebugServer 返回只监听本机回环地址的调试服务器，剖析接口不经过主端口暴露
+func newDebugServer(port string) *http.Server {
+    mux := http.NewServeMux()
+    registerDebug(mux)
+    return &http.Server{
+        Addr:    "127.0.0.1:" + port,
+        Handler: mux,
+    }
+}
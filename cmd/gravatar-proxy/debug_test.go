@@ -0,0 +1,67 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+
+    "gravatar-proxy/internal/cache"
+    "gravatar-proxy/internal/config"
+    "gravatar-proxy/internal/proxy"
+)
+
+func newTestMux(t *testing.T, cfg *config.Config) *http.ServeMux {
+    t.Helper()
+    cfg.CacheTTL = time.Hour
+    c, err := cache.New(t.TempDir(), cfg.CacheTTL, 1024*1024)
+    if err != nil {
+        t.Fatal(err)
+    }
+    handler, err := proxy.NewHandler(cfg, c)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return newMux(cfg, handler)
+}
+
+// routed 返回mux为path选中的路由模式，没有匹配的路由时为空
+func routed(mux *http.ServeMux, path string) string {
+    _, pattern := mux.Handler(httptest.NewRequest("GET", path, nil))
+    return pattern
+}
+
+func TestDebugEndpointsOffMainMux(t *testing.T) {
+    // 未开启DEBUG_ENDPOINTS，或设置了DEBUG_PORT时，主端口上都没有剖析接口
+    for _, cfg := range []*config.Config{
+        {},
+        {DebugEndpoints: true, DebugPort: "6060"},
+    } {
+        mux := newTestMux(t, cfg)
+        for _, path := range []string{"/debug/pprof/", "/debug/pprof/heap", "/debug/pprof/profile"} {
+            if pattern := routed(mux, path); pattern != "" {
+                t.Errorf("expected %s not to be routed with DebugEndpoints=%v DebugPort=%q, got %q", path, cfg.DebugEndpoints, cfg.DebugPort, pattern)
+            }
+        }
+        if pattern := routed(mux, "/avatar/abc"); pattern != "/avatar/" {
+            t.Errorf("expected the avatar route to stay, got %q", pattern)
+        }
+    }
+
+    mux := newTestMux(t, &config.Config{DebugEndpoints: true})
+    if pattern := routed(mux, "/debug/pprof/heap"); pattern != "/debug/pprof/" {
+        t.Errorf("expected profiles on the main port without DEBUG_PORT, got %q", pattern)
+    }
+}
+
+func TestDebugServerLoopbackOnly(t *testing.T) {
+    server := newDebugServer("6060")
+    if server.Addr != "127.0.0.1:6060" {
+        t.Errorf("expected the debug server to bind to 127.0.0.1 only, got %q", server.Addr)
+    }
+    rec := httptest.NewRecorder()
+    server.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/pprof/", nil))
+    if rec.Code != http.StatusOK {
+        t.Errorf("expected the debug server to serve the pprof index, got %d", rec.Code)
+    }
+}
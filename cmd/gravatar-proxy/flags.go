@@ -0,0 +1,189 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "os"
+    "strings"
+)
+
+// envFlag 是与环境变量对应的命令行参数，只有在命令行上出现时才覆盖环境变量
+type envFlag struct {
+    env     string
+    usage   string
+    isBool  bool
+    aliases []string
+}
+
+// envFlags 列出所有配置项，参数名由环境变量名转换而来（CACHE_DIR → --cache-dir）
+var envFlags = []envFlag{
+    {env: "CONFIG_FILE", usage: "JSON config file", aliases: []string{"config"}},
+    {env: "PORT", usage: "server port"},
+    {env: "TLS_CERT_FILE", usage: "TLS certificate file, serves HTTPS together with TLS_KEY_FILE"},
+    {env: "TLS_KEY_FILE", usage: "TLS private key file"},
+    {env: "HTTP2", usage: "serve HTTP/2 over TLS", isBool: true},
+    {env: "H2C", usage: "serve HTTP/2 without TLS (h2c)", isBool: true},
+    {env: "CACHE_DIR", usage: "directory for cache storage"},
+    {env: "CACHE_TTL", usage: "cache time-to-live, e.g. 24h"},
+    {env: "MAX_CACHE_BYTES", usage: "maximum cache size in bytes"},
+    {env: "MEMORY_CACHE_MB", usage: "in-memory hot tier size in MB"},
+    {env: "CACHE_KEY_SCHEME", usage: "cache file name derivation: sha256, sha256-128, sha512-256 or blake3"},
+    {env: "CACHE_REPORT_INTERVAL", usage: "how often to log the cache age/size report (0 disables)"},
+    {env: "CACHE_JANITOR_INTERVAL", usage: "how often to delete expired cache entries from disk (0 disables)"},
+    {env: "CACHE_EXPIRY_GRACE", usage: "how long expired cache entries are kept for stale responses and revalidation"},
+    {env: "CACHE_EVICTION_RATE", usage: "entries per second evicted in the background while the cache exceeds MAX_CACHE_BYTES"},
+    {env: "UPSTREAM_BASE", usage: "upstream base URL, or a comma-separated fallback chain", aliases: []string{"upstream"}},
+    {env: "STALE_WHILE_REVALIDATE", usage: "window after CACHE_TTL in which stale entries are served while revalidating"},
+    {env: "NEGATIVE_TTL", usage: "how long upstream 404/403 responses are remembered"},
+    {env: "SUSPECT_AFTER_FAILURES", usage: "failed revalidations before an entry is no longer served stale first (0 disables)"},
+    {env: "LOCAL_IDENTICON", usage: "render d=identicon locally", isBool: true},
+    {env: "SHADOW_UPSTREAM", usage: "upstream receiving a copy of miss traffic"},
+    {env: "SHADOW_PERCENT", usage: "percentage of upstream fetches mirrored to the shadow upstream"},
+    {env: "SHADOW_MODE", usage: "mirror or compare"},
+    {env: "LOCAL_RESIZE", usage: "derive smaller sizes locally from one original", isBool: true},
+    {env: "FOLLOW_REDIRECTS", usage: "follow upstream redirects and cache their targets", isBool: true},
+    {env: "RESIZE_SOURCE_SIZE", usage: "size of the original fetched for local resizing"},
+    {env: "RESIZE_FILTER", usage: "lanczos or bilinear"},
+    {env: "UPSTREAM_REGION", usage: "value substituted for {region} in the upstream URL"},
+    {env: "TRUSTED_NETWORKS", usage: "comma-separated CIDRs of trusted internal callers"},
+    {env: "UPSTREAM_OVERRIDES", usage: "comma-separated name=url alternate upstreams that admin-authenticated requests can select with X-Upstream-Override"},
+    {env: "RATE_LIMIT_RPS", usage: "avatar requests per second per client IP, 0 disables"},
+    {env: "RATE_LIMIT_BURST", usage: "requests a client can burst before being limited"},
+    {env: "MAX_URL_LENGTH", usage: "longest accepted avatar request URL in bytes"},
+    {env: "MAX_HEADER_BYTES", usage: "largest accepted request line and headers in bytes"},
+    {env: "API_KEYS", usage: "comma-separated name=key pairs required on avatar requests"},
+    {env: "TRUSTED_PROXIES", usage: "comma-separated CIDRs whose X-Forwarded-For is trusted"},
+    {env: "REQUEST_ID_HEADER", usage: "header carrying request IDs, echoed in responses and sent upstream"},
+    {env: "REQUEST_ID_TRUST", usage: "whose inbound request IDs are reused: none, proxies (TRUSTED_PROXIES and TRUSTED_NETWORKS) or all"},
+    {env: "UPSTREAM_SOURCE_ADDR", usage: "local address for upstream connections"},
+    {env: "UPSTREAM_INTERFACE", usage: "network interface for upstream connections"},
+    {env: "UPSTREAM_PROXY", usage: "outbound proxy URL for upstream requests (http, https, socks5, socks5h), or direct to ignore HTTP_PROXY/HTTPS_PROXY"},
+    {env: "UPSTREAM_PIN_SHA256", usage: "comma-separated base64 SHA-256 digests of upstream certificate public keys; one must appear in the verified chain"},
+    {env: "UPSTREAM_DNS_SERVER", usage: "DNS server (ip[:port]) used to resolve upstream hosts instead of the system resolver"},
+    {env: "UPSTREAM_HOSTS", usage: "comma-separated host=ip pairs resolved without DNS"},
+    {env: "UPSTREAM_DNS_CACHE_TTL", usage: "how long successful upstream DNS lookups are cached (0 = not cached)"},
+    {env: "UPSTREAM_IP_FAMILY", usage: "address family for upstream connections: auto, ipv4, ipv6, prefer-ipv4 or prefer-ipv6"},
+    {env: "UPSTREAM_MAX_IDLE_CONNS_PER_HOST", usage: "idle keep-alive connections per upstream host"},
+    {env: "UPSTREAM_MAX_IDLE_CONNS", usage: "idle keep-alive connections across all upstream hosts"},
+    {env: "UPSTREAM_IDLE_CONN_TIMEOUT", usage: "how long an idle upstream connection is kept"},
+    {env: "UPSTREAM_KEEPALIVE", usage: "TCP keep-alive probe interval for upstream connections (0 = disabled)"},
+    {env: "UPSTREAM_DIAL_TIMEOUT", usage: "timeout for connecting to an upstream"},
+    {env: "UPSTREAM_TLS_TIMEOUT", usage: "timeout for the upstream TLS handshake"},
+    {env: "UPSTREAM_HEADER_TIMEOUT", usage: "timeout for upstream response headers after the request is sent"},
+    {env: "UPSTREAM_BODY_TIMEOUT", usage: "timeout for reading an upstream response body"},
+    {env: "UPSTREAM_TIMEOUT", usage: "overall timeout for an upstream request including its body (0 = only the per-phase timeouts)"},
+    {env: "UPSTREAM_RETRIES", usage: "retries of an upstream request after a connection reset, timeout, 502 or 503 (0 = disabled)"},
+    {env: "UPSTREAM_RETRY_BACKOFF", usage: "base delay before the first upstream retry, doubled with jitter for each further retry"},
+    {env: "UPSTREAM_RETRY_BUDGET", usage: "upstream retries per second shared by all requests (0 = unlimited)"},
+    {env: "UPSTREAM_RETRY_HEADER_TIMEOUTS", usage: "also retry requests whose upstream response headers timed out"},
+    {env: "CIRCUIT_BREAKER_THRESHOLD", usage: "consecutive upstream failures that open the circuit breaker (0 = disabled)"},
+    {env: "CIRCUIT_BREAKER_COOLDOWN", usage: "how long an open circuit breaker waits before letting a probe request through"},
+    {env: "UPSTREAM_MAX_HEADER_BYTES", usage: "largest accepted upstream response header block in bytes"},
+    {env: "UPSTREAM_CONTENT_CHECK", usage: "how upstream responses are confirmed to be images before caching: header, sniff or off"},
+    {env: "MAX_UPSTREAM_BYTES", usage: "largest accepted upstream response body in bytes; larger responses are aborted and not cached (0 = unlimited)"},
+    {env: "UPSTREAM_MONTHLY_CAP_BYTES", usage: "upstream bytes downloaded per calendar month before upstream fetches stop (0 = unlimited)"},
+    {env: "UPSTREAM_ACCEPT", usage: "Accept header sent on upstream requests"},
+    {env: "AVATAR_PARAMS", usage: "comma-separated query parameters forwarded upstream and part of the cache key (default s,d,r,f,name)"},
+    {env: "PASSTHROUGH_PARAMS", usage: "extra query parameters forwarded upstream and included in the cache key (* for all)"},
+    {env: "TRANSCODE_FORMATS", usage: "formats cached avatars may be transcoded to (webp, avif)"},
+    {env: "AVIF_ENCODER", usage: "external AVIF encoder command used for avif transcoding, e.g. avifenc"},
+    {env: "COMPRESS_ENCODINGS", usage: "content encodings offered for SVG and other text responses (br, gzip, or none; preferred first)"},
+    {env: "FALLBACK_LADDER", usage: "steps tried when the primary upstream fails"},
+    {env: "RETRY_AFTER", usage: "comma-separated cause=duration Retry-After overrides"},
+    {env: "READY_CHECK_UPSTREAM", usage: "also require an upstream to respond for /readyz", isBool: true},
+    {env: "ADMIN_TOKEN", usage: "bearer token for the admin API"},
+    {env: "TOMBSTONE_TTL", usage: "how long purged keys refuse to be re-cached"},
+    {env: "PURGE_PEERS", usage: "comma-separated peer URLs purges are forwarded to"},
+    {env: "FOLLOW_PRIMARY", usage: "primary proxy URL to keep this instance's cache in sync with (warm standby)"},
+    {env: "FOLLOW_INTERVAL", usage: "how often to pull new cache entries from FOLLOW_PRIMARY"},
+    {env: "WARMUP_SEED", usage: "file or http(s) URL listing avatar hashes (and sizes) to prefetch on startup"},
+    {env: "FEATURE_FLAGS", usage: "comma-separated feature=true|false pairs to switch transformations, batch or local_defaults off (all on by default)"},
+    {env: "SHARD_PEERS", usage: "comma-separated URLs of all instances for sharding"},
+    {env: "SHARD_SELF", usage: "this instance's URL in SHARD_PEERS"},
+    {env: "PEER_DISCOVERY_SRV", usage: "DNS SRV record listing proxy instances"},
+    {env: "PEER_DISCOVERY_SCHEME", usage: "scheme for discovered instances"},
+    {env: "PEER_DISCOVERY_INTERVAL", usage: "how often peers are rediscovered and health-checked"},
+    {env: "ALLOWED_ORIGINS", usage: "comma-separated allowed origins"},
+    {env: "CORS_MAX_AGE", usage: "how long browsers may cache preflight responses (0 omits Access-Control-Max-Age)"},
+    {env: "PREFLIGHT_CACHE_TTL", usage: "how long CDNs and other shared caches may cache successful preflight responses (0 = not cacheable)"},
+    {env: "INSTANCE_NAME", usage: "instance name for logs, metrics and peers (default POD_NAME or hostname)"},
+    {env: "POD_NAME", usage: "pod name set by the Kubernetes downward API, used when INSTANCE_NAME is not set"},
+    {env: "INSTANCE_ZONE", usage: "availability zone for logs, metrics and peers"},
+    {env: "PODINFO_LABELS", usage: "downward API labels file read for the zone label"},
+    {env: "LOG_LEVEL", usage: "debug, info, warn or error"},
+    {env: "LOG_FORMAT", usage: "json or text"},
+    {env: "LOG_QUIET_PATHS", usage: "comma-separated paths whose request logs are demoted to debug"},
+    {env: "ACCESS_LOG_FILE", usage: "write request logs to this file instead of stdout"},
+    {env: "AUDIT_LOG_FILE", usage: "write denied-request audit logs to this file instead of stdout"},
+    {env: "ACCESS_LOG_MAX_SIZE_MB", usage: "rotate the access and audit log files at this size"},
+    {env: "ACCESS_LOG_MAX_AGE", usage: "rotate the access and audit log files after this long (0 disables)"},
+    {env: "ACCESS_LOG_MAX_BACKUPS", usage: "number of rotated access and audit log files to keep (0 keeps all)"},
+    {env: "DEBUG_ENDPOINTS", usage: "serve /debug/pprof/ profiles", isBool: true},
+    {env: "SOCKET_STATS", usage: "export connection counts and listen queue metrics for the main port", isBool: true},
+    {env: "GRPC_PORT", usage: "serve the cache admin gRPC API on this port (requires an admin credential option)"},
+    {env: "ADMIN_JWT_ISSUER", usage: "OIDC issuer whose JWTs are accepted by the admin and gRPC APIs"},
+    {env: "ADMIN_JWT_JWKS_URL", usage: "JWKS URL for ADMIN_JWT_ISSUER (default: from its discovery document)"},
+    {env: "ADMIN_JWT_AUDIENCE", usage: "audience admin JWTs must be issued for"},
+    {env: "ADMIN_JWT_ROLE_CLAIM", usage: "claim holding roles in admin JWTs, dotted for nested claims"},
+    {env: "ADMIN_JWT_ROLES", usage: "comma-separated roles, one of which admin JWTs must carry"},
+    {env: "ADMIN_BASIC_AUTH", usage: "user:password accepted by the admin APIs via HTTP basic auth"},
+    {env: "ADMIN_CLIENT_CA_FILE", usage: "CA bundle for client certificates granting admin access (requires TLS_CERT_FILE)"},
+    {env: "DEBUG_PORT", usage: "serve debug endpoints on 127.0.0.1 at this port instead of PORT"},
+    {env: "OTEL_EXPORTER_OTLP_ENDPOINT", usage: "OTLP/HTTP collector base URL, enables tracing"},
+    {env: "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", usage: "full OTLP/HTTP traces URL, overrides OTEL_EXPORTER_OTLP_ENDPOINT"},
+    {env: "OTEL_EXPORTER_OTLP_HEADERS", usage: "comma-separated key=value headers sent to the collector"},
+    {env: "OTEL_EXPORTER_OTLP_TRACES_HEADERS", usage: "headers sent with traces, take precedence over OTEL_EXPORTER_OTLP_HEADERS"},
+    {env: "OTEL_EXPORTER_OTLP_PROTOCOL", usage: "OTLP protocol, only http/json is supported"},
+    {env: "OTEL_EXPORTER_OTLP_TRACES_PROTOCOL", usage: "OTLP protocol for traces, overrides OTEL_EXPORTER_OTLP_PROTOCOL"},
+    {env: "OTEL_TRACES_EXPORTER", usage: "traces exporter, none turns tracing off"},
+    {env: "OTEL_SDK_DISABLED", usage: "turn tracing off", isBool: true},
+    {env: "OTEL_SERVICE_NAME", usage: "service.name of exported spans"},
+}
+
+// flagValue 记录参数值；实现IsBoolFlag，使布尔项可以只写 --local-resize
+type flagValue struct {
+    value  string
+    isBool bool
+}
+
+func (v *flagValue) String() string   { return v.value }
+func (v *flagValue) Set(s string) error { v.value = s; return nil }
+func (v *flagValue) IsBoolFlag() bool { return v.isBool }
+
+func flagName(env string) string {
+    return strings.ToLower(strings.ReplaceAll(env, "_", "-"))
+}
+
+// applyFlags 解析命令行参数，并把出现的参数写入对应的环境变量，使其优先于已有的环境变量
+// 取值的校验与环境变量相同，由config.Load完成
+func applyFlags(args []string) error {
+    fs := flag.NewFlagSet("gravatar-proxy", flag.ContinueOnError)
+    fs.Usage = func() {
+        fmt.Fprintf(fs.Output(), "Usage: gravatar-proxy [flags]\n\nEvery flag overrides the environment variable in brackets.\n\n")
+        fs.PrintDefaults()
+    }
+
+    envs := make(map[string]string)
+    for _, f := range envFlags {
+        value := &flagValue{isBool: f.isBool}
+        name := flagName(f.env)
+        fs.Var(value, name, f.usage+" ["+f.env+"]")
+        envs[name] = f.env
+        for _, alias := range f.aliases {
+            fs.Var(value, alias, "alias for --"+name)
+            envs[alias] = f.env
+        }
+    }
+
+    if err := fs.Parse(args); err != nil {
+        return err
+    }
+    if fs.NArg() > 0 {
+        return fmt.Errorf("unexpected argument %q", fs.Arg(0))
+    }
+
+    fs.Visit(func(f *flag.Flag) {
+        os.Setenv(envs[f.Name], f.Value.String())
+    })
+    return nil
+}
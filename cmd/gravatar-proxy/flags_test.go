@@ -0,0 +1,147 @@
+package main
+
+import (
+    "go/ast"
+    "go/parser"
+    "go/token"
+    "os"
+    "path/filepath"
+    "regexp"
+    "strconv"
+    "strings"
+    "testing"
+)
+
+// setEnvs 设置环境变量，测试结束后恢复；applyFlags直接修改环境变量，用到的都要先经过t.Setenv
+func setEnvs(t *testing.T, envs map[string]string) {
+    t.Helper()
+    for name, value := range envs {
+        t.Setenv(name, value)
+    }
+}
+
+func TestApplyFlagsOverridesEnv(t *testing.T) {
+    setEnvs(t, map[string]string{"CACHE_DIR": "/env/cache", "PORT": "9000", "CACHE_TTL": ""})
+
+    if err := applyFlags([]string{"--cache-dir", "/flag/cache", "--cache-ttl=2h"}); err != nil {
+        t.Fatal(err)
+    }
+    if got := os.Getenv("CACHE_DIR"); got != "/flag/cache" {
+        t.Errorf("expected the flag to override CACHE_DIR, got %q", got)
+    }
+    if got := os.Getenv("CACHE_TTL"); got != "2h" {
+        t.Errorf("expected the flag to set CACHE_TTL, got %q", got)
+    }
+    if got := os.Getenv("PORT"); got != "9000" {
+        t.Errorf("expected an absent flag to leave PORT alone, got %q", got)
+    }
+}
+
+func TestApplyFlagsAliases(t *testing.T) {
+    setEnvs(t, map[string]string{"CONFIG_FILE": "/env/config.json", "UPSTREAM_BASE": "https://env.example.com"})
+
+    if err := applyFlags([]string{"--config", "/flag/config.json", "--upstream", "https://flag.example.com"}); err != nil {
+        t.Fatal(err)
+    }
+    if got := os.Getenv("CONFIG_FILE"); got != "/flag/config.json" {
+        t.Errorf("expected --config to set CONFIG_FILE, got %q", got)
+    }
+    if got := os.Getenv("UPSTREAM_BASE"); got != "https://flag.example.com" {
+        t.Errorf("expected --upstream to set UPSTREAM_BASE, got %q", got)
+    }
+}
+
+func TestApplyFlagsBool(t *testing.T) {
+    setEnvs(t, map[string]string{"LOCAL_IDENTICON": "", "HTTP2": "true", "PORT": ""})
+
+    // 布尔项可以只写参数名，也可以显式关闭；非布尔项不能省略取值
+    if err := applyFlags([]string{"--local-identicon", "--http2=false"}); err != nil {
+        t.Fatal(err)
+    }
+    if got := os.Getenv("LOCAL_IDENTICON"); got != "true" {
+        t.Errorf("expected a bare bool flag to set true, got %q", got)
+    }
+    if got := os.Getenv("HTTP2"); got != "false" {
+        t.Errorf("expected --http2=false to override the environment, got %q", got)
+    }
+    if err := applyFlags([]string{"--port"}); err == nil {
+        t.Error("expected a non-bool flag without a value to be rejected")
+    }
+}
+
+func TestApplyFlagsErrors(t *testing.T) {
+    setEnvs(t, map[string]string{"PORT": "9000"})
+
+    for _, args := range [][]string{{"--no-such-flag", "x"}, {"--port", "8080", "extra"}} {
+        if err := applyFlags(args); err == nil {
+            t.Errorf("expected %v to be rejected", args)
+        }
+    }
+    if got := os.Getenv("PORT"); got != "9000" {
+        t.Errorf("expected rejected arguments not to change the environment, got %q", got)
+    }
+}
+
+// TestEnvFlagsCoverConfig 检查config包读取的每个环境变量都有对应的参数；envFlags是手工维护的，新增配置时容易漏掉
+func TestEnvFlagsCoverConfig(t *testing.T) {
+    flags := make(map[string]bool, len(envFlags))
+    names := make(map[string]bool)
+    for _, f := range envFlags {
+        if flags[f.env] {
+            t.Errorf("duplicate flag for %s", f.env)
+        }
+        flags[f.env] = true
+        for _, name := range append([]string{flagName(f.env)}, f.aliases...) {
+            if names[name] {
+                t.Errorf("duplicate flag name --%s", name)
+            }
+            names[name] = true
+        }
+    }
+
+    // 以环境变量名作为第一个参数的调用：getEnv、os.Getenv、parseTimeout等
+    envName := regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+    files, err := filepath.Glob(filepath.Join("..", "..", "internal", "config", "*.go"))
+    if err != nil || len(files) == 0 {
+        t.Fatalf("failed to find config sources: %v", err)
+    }
+    fset := token.NewFileSet()
+    read := make(map[string]bool)
+    for _, file := range files {
+        if strings.HasSuffix(file, "_test.go") {
+            continue
+        }
+        f, err := parser.ParseFile(fset, file, nil, 0)
+        if err != nil {
+            t.Fatal(err)
+        }
+        ast.Inspect(f, func(n ast.Node) bool {
+            call, ok := n.(*ast.CallExpr)
+            if !ok || len(call.Args) == 0 {
+                return true
+            }
+            lit, ok := call.Args[0].(*ast.BasicLit)
+            if !ok || lit.Kind != token.STRING {
+                return true
+            }
+            if name, err := strconv.Unquote(lit.Value); err == nil && envName.MatchString(name) {
+                read[name] = true
+            }
+            return true
+        })
+    }
+
+    if !read["CACHE_DIR"] || !read["CIRCUIT_BREAKER_COOLDOWN"] || !read["POD_NAME"] {
+        t.Fatalf("expected to find the environment variables read by config, got %d", len(read))
+    }
+    for name := range read {
+        if !flags[name] {
+            t.Errorf("%s is read by config.Load but has no flag in envFlags", name)
+        }
+    }
+    for name := range flags {
+        if !read[name] {
+            t.Errorf("envFlags has %s, which config.Load does not read", name)
+        }
+    }
+}
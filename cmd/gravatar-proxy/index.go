@@ -0,0 +1,36 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+
+    "gravatar-proxy/internal/cache"
+    "gravatar-proxy/internal/config"
+    "gravatar-proxy/internal/log"
+)
+
+var errIndexUsage = errors.New("usage: gravatar-proxy index rebuild [flags]")
+
+// runIndex 执行 gravatar-proxy index <command>；rebuild 忽略现有索引，从.meta文件重建
+// 参数与启动服务器时相同，只用到CACHE_DIR；须在服务器停止后运行
+func runIndex(args []string) error {
+    if len(args) == 0 || args[0] != "rebuild" {
+        return errIndexUsage
+    }
+    if err := applyFlags(args[1:]); err != nil {
+        return err
+    }
+
+    cfg, err := config.Load()
+    if err != nil {
+        return fmt.Errorf("failed to load config: %w", err)
+    }
+    log.Configure(log.Options{Level: cfg.LogLevel, Format: cfg.LogFormat})
+
+    stats, err := cache.RebuildIndex(cfg.CacheDir)
+    if err != nil {
+        return err
+    }
+    log.Info("rebuilt cache index", "cache_dir", cfg.CacheDir, "entries", stats.Entries, "bytes", stats.Bytes, "skipped", stats.Skipped)
+    return nil
+}
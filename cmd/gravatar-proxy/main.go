@@ -2,6 +2,11 @@ package main
 
 import (
     "context"
+    "crypto/tls"
+    "crypto/x509"
+    "errors"
+    "fmt"
+    "flag"
     "net/http"
     "os"
     "os/signal"
@@ -11,10 +16,42 @@ import (
     "gravatar-proxy/internal/cache"
     "gravatar-proxy/internal/config"
     "gravatar-proxy/internal/log"
+    "gravatar-proxy/internal/metrics"
     "gravatar-proxy/internal/proxy"
+    "gravatar-proxy/internal/sockstats"
+    "gravatar-proxy/internal/tracing"
 )
 
+// subcommands 是不启动服务器的维护命令
+var subcommands = map[string]func(args []string) error{
+    "index": runIndex,
+    "purge": runPurge,
+    "selftest": runSelftest,
+    "support-bundle": runSupportBundle,
+}
+
 func main() {
+    if len(os.Args) > 1 {
+        if run, ok := subcommands[os.Args[1]]; ok {
+            if err := run(os.Args[2:]); err != nil {
+                if errors.Is(err, flag.ErrHelp) {
+                    os.Exit(0)
+                }
+                log.Error(os.Args[1]+" command failed", "error", err)
+                os.Exit(1)
+            }
+            return
+        }
+    }
+
+    if err := applyFlags(os.Args[1:]); err != nil {
+        if errors.Is(err, flag.ErrHelp) {
+            os.Exit(0)
+        }
+        log.Error("invalid command-line flags", "error", err)
+        os.Exit(2)
+    }
+
     log.Info("starting gravatar-proxy")
 
     cfg, err := config.Load()
@@ -23,47 +60,161 @@ func main() {
         os.Exit(1)
     }
 
+    logOpts := log.Options{Level: cfg.LogLevel, Format: cfg.LogFormat, QuietPaths: cfg.LogQuietPaths}
+    var logFiles []*log.RotatingFile
+    if cfg.AccessLogFile != "" {
+        accessLog, err := log.OpenRotatingFile(cfg.AccessLogFile, cfg.AccessLogMaxBytes, cfg.AccessLogMaxAge, cfg.AccessLogMaxBackups)
+        if err != nil {
+            log.Error("failed to open access log", "error", err)
+            os.Exit(1)
+        }
+        logOpts.AccessLog = accessLog
+        logFiles = append(logFiles, accessLog)
+    }
+    if cfg.AuditLogFile != "" {
+        auditLog, err := log.OpenRotatingFile(cfg.AuditLogFile, cfg.AccessLogMaxBytes, cfg.AccessLogMaxAge, cfg.AccessLogMaxBackups)
+        if err != nil {
+            log.Error("failed to open audit log", "error", err)
+            os.Exit(1)
+        }
+        logOpts.AuditLog = auditLog
+        logFiles = append(logFiles, auditLog)
+    }
+    log.Configure(logOpts)
+    identity := []any{"instance", cfg.Instance.Name}
+    if cfg.Instance.Zone != "" {
+        identity = append(identity, "zone", cfg.Instance.Zone)
+    }
+    log.SetDefaultAttrs(identity...)
+    metrics.SetConstLabels(map[string]string{"pod": cfg.Instance.Name, "zone": cfg.Instance.Zone})
+
     log.Info("loaded configuration",
         "port", cfg.Port,
         "cache_dir", cfg.CacheDir,
         "cache_ttl", cfg.CacheTTL,
         "max_cache_bytes", cfg.MaxCacheBytes,
-        "upstream_base", cfg.UpstreamBase,
+        "memory_cache_bytes", cfg.MemoryCacheBytes,
+        "upstream_bases", cfg.UpstreamBases,
         "allowed_origins", cfg.AllowedOrigins,
     )
 
+    if cfg.TracesEndpoint != "" {
+        tracing.Init(cfg.TracesEndpoint, cfg.TracesHeaders, cfg.ServiceName)
+        log.Info("tracing enabled", "endpoint", cfg.TracesEndpoint, "service_name", cfg.ServiceName)
+    }
+
     c, err := cache.New(cfg.CacheDir, cfg.CacheTTL, cfg.MaxCacheBytes)
     if err != nil {
         log.Error("failed to initialize cache", "error", err)
         os.Exit(1)
     }
 
+    if err := c.SetKeyScheme(cfg.CacheKeyScheme); err != nil {
+        log.Error("failed to set cache key scheme", "error", err)
+        os.Exit(1)
+    }
+    c.SetTombstoneTTL(cfg.TombstoneTTL)
+    c.SetMemoryLimit(cfg.MemoryCacheBytes)
+
     handler, err := proxy.NewHandler(cfg, c)
     if err != nil {
         log.Error("failed to create proxy handler", "error", err)
         os.Exit(1)
     }
 
-    mux := http.NewServeMux()
-    mux.Handle("/avatar/", handler)
-    mux.HandleFunc("/healthz", proxy.HealthHandler)
+    backgroundCtx, stopBackground := context.WithCancel(context.Background())
+    defer stopBackground()
+    handler.StartPeerDiscovery(backgroundCtx)
+    handler.StartPrefetch(backgroundCtx)
+    handler.StartWarmup(backgroundCtx)
+    handler.StartFollower(backgroundCtx)
+    handler.StartCacheReport(backgroundCtx)
+    handler.StartCacheJanitor(backgroundCtx)
+    handler.StartCacheEviction(backgroundCtx)
+    handler.StartBandwidthAccounting(backgroundCtx)
+
+    mux := newMux(cfg, handler)
+
+    var debugServer *http.Server
+    if cfg.DebugEndpoints && cfg.DebugPort != "" {
+        debugServer = newDebugServer(cfg.DebugPort)
+        go func() {
+            log.Info("debug server listening", "addr", debugServer.Addr)
+            if err := debugServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+                log.Error("debug server error", "error", err)
+            }
+        }()
+    }
+
+    tlsConfig, err := newTLSConfig(cfg)
+    if err != nil {
+        log.Error("failed to load admin client CA", "error", err)
+        os.Exit(1)
+    }
+
+    var grpcServer *http.Server
+    if cfg.GRPCPort != "" {
+        grpcServer = newGRPCServer(cfg, handler.HardenRequests(handler.GRPCHandler()))
+        grpcServer.TLSConfig = tlsConfig
+        go func() {
+            log.Info("grpc server listening", "addr", grpcServer.Addr, "tls", cfg.TLSCertFile != "")
+            var err error
+            if cfg.TLSCertFile != "" {
+                err = grpcServer.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+            } else {
+                err = grpcServer.ListenAndServe()
+            }
+            if err != nil && err != http.ErrServerClosed {
+                log.Error("grpc server error", "error", err)
+                os.Exit(1)
+            }
+        }()
+    }
 
     server := &http.Server{
-        Addr:         ":" + cfg.Port,
-        Handler:      mux,
-        ReadTimeout:  15 * time.Second,
-        WriteTimeout: 15 * time.Second,
-        IdleTimeout:  60 * time.Second,
+        Addr:           ":" + cfg.Port,
+        Handler:        handler.HardenRequests(mux),
+        ReadTimeout:    15 * time.Second,
+        WriteTimeout:   15 * time.Second,
+        IdleTimeout:    60 * time.Second,
+        MaxHeaderBytes: cfg.MaxHeaderBytes,
+        Protocols:      serverProtocols(cfg),
+        TLSConfig:      tlsConfig,
+    }
+    if cfg.SocketStats {
+        if err := sockstats.Register(server, cfg.Port); err != nil {
+            log.Error("failed to enable socket stats", "error", err)
+            os.Exit(1)
+        }
     }
 
     go func() {
-        log.Info("server listening", "addr", server.Addr)
-        if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+        log.Info("server listening", "addr", server.Addr, "tls", cfg.TLSCertFile != "", "http2", cfg.HTTP2 && cfg.TLSCertFile != "", "h2c", cfg.H2C)
+        var err error
+        if cfg.TLSCertFile != "" {
+            err = server.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+        } else {
+            err = server.ListenAndServe()
+        }
+        if err != nil && err != http.ErrServerClosed {
             log.Error("server error", "error", err)
             os.Exit(1)
         }
     }()
 
+    // SIGHUP重新读取环境变量和配置文件，热加载允许来源、缓存有效期、限流和上游列表
+    reload := make(chan os.Signal, 1)
+    signal.Notify(reload, syscall.SIGHUP)
+    go func() {
+        for range reload {
+            reloadConfig(handler)
+        }
+    }()
+
+    if len(logFiles) > 0 {
+        reopenOnSignal(logFiles)
+    }
+
     quit := make(chan os.Signal, 1)
     signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
     <-quit
@@ -78,5 +229,113 @@ func main() {
         os.Exit(1)
     }
 
+    if debugServer != nil {
+        debugServer.Close()
+    }
+
+    if grpcServer != nil {
+        grpcServer.Shutdown(ctx)
+    }
+
+    if err := tracing.Shutdown(ctx); err != nil {
+        log.Warn("failed to flush traces", "error", err)
+    }
+
+    if err := handler.SaveBandwidthUsage(); err != nil {
+        log.Warn("failed to save upstream bandwidth usage", "error", err)
+    }
+
+    if err := c.Close(); err != nil {
+        log.Warn("failed to close cache index", "error", err)
+    }
+
+    for _, f := range logFiles {
+        f.Close()
+    }
+
     log.Info("server stopped gracefully")
 }
+
+// reloadConfig 重新加载配置并应用到handler，配置无效时保留当前设置
+func reloadConfig(handler *proxy.Handler) {
+    log.Info("reloading configuration")
+    cfg, err := config.Load()
+    if err != nil {
+        log.Error("failed to reload config, keeping current settings", "error", err)
+        return
+    }
+    handler.Reload(cfg)
+}
+
+// newGRPCServer 返回提供gRPC管理接口的服务器：配置了证书时使用TLS上的HTTP/2，否则使用明文HTTP/2（h2c）
+func newGRPCServer(cfg *config.Config, handler http.Handler) *http.Server {
+    protocols := new(http.Protocols)
+    if cfg.TLSCertFile != "" {
+        protocols.SetHTTP2(true)
+    } else {
+        protocols.SetUnencryptedHTTP2(true)
+    }
+    return &http.Server{
+        Addr:              ":" + cfg.GRPCPort,
+        Handler:           handler,
+        ReadHeaderTimeout: 10 * time.Second,
+        IdleTimeout:       60 * time.Second,
+        MaxHeaderBytes:    cfg.MaxHeaderBytes,
+        Protocols:         protocols,
+    }
+}
+
+// newTLSConfig 在配置了ADMIN_CLIENT_CA_FILE时返回请求客户端证书的TLS配置，否则返回nil使用默认配置
+// 证书是可选的：头像请求不需要证书，只有验证通过的证书才能访问管理接口
+func newTLSConfig(cfg *config.Config) (*tls.Config, error) {
+    if cfg.AdminClientCAFile == "" {
+        return nil, nil
+    }
+    pem, err := os.ReadFile(cfg.AdminClientCAFile)
+    if err != nil {
+        return nil, err
+    }
+    pool := x509.NewCertPool()
+    if !pool.AppendCertsFromPEM(pem) {
+        return nil, fmt.Errorf("no certificates found in %s", cfg.AdminClientCAFile)
+    }
+    return &tls.Config{
+        ClientCAs:  pool,
+        ClientAuth: tls.VerifyClientCertIfGiven,
+    }, nil
+}
+
+// serverProtocols 返回监听器接受的协议：HTTP/1.1始终可用，TLS上按HTTP2协商h2，明文上按H2C接受h2c
+// 浏览器在一个HTTP/2连接上多路复用同一页面的所有头像请求
+func serverProtocols(cfg *config.Config) *http.Protocols {
+    protocols := new(http.Protocols)
+    protocols.SetHTTP1(true)
+    protocols.SetHTTP2(cfg.HTTP2)
+    protocols.SetUnencryptedHTTP2(cfg.H2C)
+    return protocols
+}
+
+// newMux 构造主端口的路由；只有开启DEBUG_ENDPOINTS且没有设置DEBUG_PORT时才在主端口挂载/debug/pprof/
+func newMux(cfg *config.Config, handler *proxy.Handler) *http.ServeMux {
+    mux := http.NewServeMux()
+    mux.Handle("/avatar/", handler)
+    mux.HandleFunc("/testavatar/", handler.TestAvatarHandler)
+    mux.HandleFunc("/healthz", handler.HealthHandler)
+    mux.HandleFunc("/readyz", handler.ReadyHandler)
+    mux.Handle("/metrics", metrics.Handler())
+    mux.HandleFunc("/defaults", handler.DefaultsHandler)
+    mux.HandleFunc("/defaults/", handler.DefaultsHandler)
+    if admin := handler.AdminHandler(); admin != nil {
+        mux.Handle("/admin/", admin)
+        log.Info("admin API enabled")
+    }
+    if prefetch := handler.PrefetchHandler(); prefetch != nil {
+        mux.Handle("/prefetch", prefetch)
+    }
+
+    if cfg.DebugEndpoints && cfg.DebugPort == "" {
+        registerDebug(mux)
+        log.Warn("debug endpoints enabled on the main port", "path", "/debug/pprof/")
+    }
+    return mux
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "strings"
+
+    "gravatar-proxy/internal/cache"
+    "gravatar-proxy/internal/config"
+    "gravatar-proxy/internal/log"
+)
+
+var errPurgeUsage = errors.New("usage: gravatar-proxy purge all | prefix <hash-prefix> | hash <hash> | key <key> [flags]")
+
+// runPurge 执行 gravatar-proxy purge <target>；直接修改CACHE_DIR中的缓存文件和索引，须在服务器停止后运行
+// 服务器运行时使用 POST /admin/purge，参数与启动服务器时相同
+func runPurge(args []string) error {
+    if len(args) == 0 {
+        return errPurgeUsage
+    }
+    target, args := args[0], args[1:]
+    var value string
+    if target != "all" {
+        if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+            return errPurgeUsage
+        }
+        value, args = args[0], args[1:]
+    }
+    if target == "prefix" || target == "hash" {
+        value = strings.ToLower(value)
+        if strings.Trim(value, "0123456789abcdef") != "" {
+            return fmt.Errorf("%s must be hexadecimal", target)
+        }
+    }
+    if err := applyFlags(args); err != nil {
+        return err
+    }
+
+    cfg, err := config.Load()
+    if err != nil {
+        return fmt.Errorf("failed to load config: %w", err)
+    }
+    log.Configure(log.Options{Level: cfg.LogLevel, Format: cfg.LogFormat})
+
+    c, err := cache.New(cfg.CacheDir, cfg.CacheTTL, cfg.MaxCacheBytes)
+    if err != nil {
+        return err
+    }
+    // 索引无法读取时不清除，避免把未加载的条目当作不存在
+    if err := c.Ready(); err != nil {
+        return err
+    }
+
+    purged := 0
+    switch target {
+    case "all":
+        purged, err = c.PurgeAll()
+    case "prefix":
+        purged = c.PurgePrefix(value)
+    case "hash":
+        purged = c.PurgeHash(value)
+    case "key":
+        if c.Delete(value) {
+            purged = 1
+        }
+    default:
+        return errPurgeUsage
+    }
+    if err != nil {
+        return err
+    }
+    if err := c.Close(); err != nil {
+        return fmt.Errorf("failed to save cache index: %w", err)
+    }
+    log.Info("purged cache entries", "cache_dir", cfg.CacheDir, "target", target, "value", value, "entries", purged)
+    return nil
+}
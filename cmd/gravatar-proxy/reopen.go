@@ -0,0 +1,27 @@
+//go:build !windows
+
+package main
+
+import (
+    "os"
+    "os/signal"
+    "syscall"
+
+    "gravatar-proxy/internal/log"
+)
+
+// reopenOnSignal 收到SIGUSR1时重新打开访问日志和审计日志文件，供外部轮转工具移走文件后使用
+func reopenOnSignal(files []*log.RotatingFile) {
+    reopen := make(chan os.Signal, 1)
+    signal.Notify(reopen, syscall.SIGUSR1)
+    go func() {
+        for range reopen {
+            for _, f := range files {
+                if err := f.Reopen(); err != nil {
+                    log.Error("failed to reopen log file", "error", err)
+                }
+            }
+            log.Info("log files reopened")
+        }
+    }()
+}
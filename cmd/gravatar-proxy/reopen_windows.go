@@ -0,0 +1,6 @@
+package main
+
+import "gravatar-proxy/internal/log"
+
+// reopenOnSignal 在Windows上没有SIGUSR1，日志文件只按大小和时长自行轮转
+func reopenOnSignal([]*log.RotatingFile) {}
@@ -0,0 +1,342 @@
+package main
+
+import (
+    "context"
+    "crypto/md5"
+    "encoding/hex"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "log/slog"
+    "math/rand/v2"
+    "net"
+    "net/http"
+    "os"
+    "runtime"
+    "slices"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "gravatar-proxy/internal/avatargen"
+    "gravatar-proxy/internal/cache"
+    "gravatar-proxy/internal/config"
+    "gravatar-proxy/internal/log"
+    "gravatar-proxy/internal/proxy"
+)
+
+// selftestSizes 是生成请求时使用的常见尺寸
+var selftestSizes = []string{"", "40", "64", "80", "128", "200", "512"}
+
+// selftestDefaults 是生成请求时使用的默认头像参数
+var selftestDefaults = []string{"", "", "", "404", "mp", "identicon", "initials"}
+
+// selftestResult 是一个工作协程的统计结果
+type selftestResult struct {
+    latencies []time.Duration
+    statuses  map[int]int
+    errors    int
+}
+
+// runSelftest 执行 gravatar-proxy selftest：在本进程中启动假上游和使用当前配置的代理实例，
+// 用随机的真实流量压测指定时间，报告命中率、延迟分位数和内存增长；出现请求失败或2xx和404以外的状态时返回错误
+// 缓存写入临时目录，上游、分片、同步和限流相关的设置被替换或关闭，不会访问外部服务
+func runSelftest(args []string) error {
+    return selftest(os.Stdout, args)
+}
+
+// selftest 为runSelftest的实现，报告写入out
+func selftest(out io.Writer, args []string) error {
+    fs := flag.NewFlagSet("gravatar-proxy selftest", flag.ContinueOnError)
+    duration := fs.Duration("duration", time.Minute, "how long to generate traffic")
+    concurrency := fs.Int("concurrency", 16, "number of concurrent clients")
+    hashes := fs.Int("hashes", 2000, "number of distinct avatar hashes; popularity follows a Zipf distribution")
+    missRate := fs.Float64("missing", 0.1, "fraction of hashes the fake upstream answers with 404")
+    latency := fs.Duration("upstream-latency", 20*time.Millisecond, "average latency of the fake upstream")
+    fs.Usage = func() {
+        fmt.Fprintf(fs.Output(), "Usage: gravatar-proxy selftest [flags]\n\nOther settings come from the environment and CONFIG_FILE as for the server.\n\n")
+        fs.PrintDefaults()
+    }
+    if err := fs.Parse(args); err != nil {
+        return err
+    }
+    if *duration <= 0 || *concurrency <= 0 || *hashes <= 0 || *missRate < 0 || *missRate > 1 || *latency < 0 {
+        return errors.New("duration, concurrency and hashes must be positive, missing between 0 and 1")
+    }
+
+    cfg, err := config.Load()
+    if err != nil {
+        return fmt.Errorf("failed to load config: %w", err)
+    }
+    // 每个请求一条日志会淹没报告，只输出警告和错误
+    log.Configure(log.Options{Level: max(cfg.LogLevel, slog.LevelWarn), Format: cfg.LogFormat})
+
+    upstream, err := startFakeUpstream(*missRate, *latency)
+    if err != nil {
+        return err
+    }
+    defer upstream.Close()
+
+    cacheDir, err := os.MkdirTemp("", "gravatar-proxy-selftest-")
+    if err != nil {
+        return fmt.Errorf("failed to create cache directory: %w", err)
+    }
+    defer os.RemoveAll(cacheDir)
+    isolateSelftest(cfg, cacheDir, "http://"+upstream.Addr)
+
+    c, err := cache.New(cfg.CacheDir, cfg.CacheTTL, cfg.MaxCacheBytes)
+    if err != nil {
+        return err
+    }
+    if err := c.SetKeyScheme(cfg.CacheKeyScheme); err != nil {
+        return err
+    }
+    c.SetMemoryLimit(cfg.MemoryCacheBytes)
+    handler, err := proxy.NewHandler(cfg, c)
+    if err != nil {
+        return fmt.Errorf("failed to create proxy handler: %w", err)
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    handler.StartPrefetch(ctx)
+    handler.StartCacheJanitor(ctx)
+    handler.StartCacheEviction(ctx)
+
+    mux := http.NewServeMux()
+    mux.Handle("/avatar/", handler)
+    server, err := listenLocal(handler.HardenRequests(mux))
+    if err != nil {
+        return err
+    }
+    defer server.Close()
+
+    fmt.Fprintf(out, "generating traffic for %v with %d clients over %d hashes\n", *duration, *concurrency, *hashes)
+    heapBefore := heapInUse()
+
+    client := &http.Client{
+        Timeout:   30 * time.Second,
+        Transport: &http.Transport{MaxIdleConnsPerHost: *concurrency},
+    }
+    base := "http://" + server.Addr
+    deadline := time.Now().Add(*duration)
+    results := make([]selftestResult, *concurrency)
+    peakHeap := heapBefore
+    stopSampling := sampleHeap(out, &peakHeap, deadline)
+    var wg sync.WaitGroup
+    for i := range results {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            results[i] = generateTraffic(client, base, *hashes, deadline)
+        }()
+    }
+    wg.Wait()
+    stopSampling()
+    elapsed := *duration + time.Since(deadline)
+
+    cancel()
+    heapAfter := heapInUse()
+    stats := c.Stats()
+    if err := c.Close(); err != nil {
+        log.Warn("failed to close cache index", "error", err)
+    }
+
+    var total selftestResult
+    total.statuses = make(map[int]int)
+    for _, r := range results {
+        total.latencies = append(total.latencies, r.latencies...)
+        total.errors += r.errors
+        for status, n := range r.statuses {
+            total.statuses[status] += n
+        }
+    }
+    slices.Sort(total.latencies)
+    // 假上游只返回头像或404，其他状态（403、429、5xx等）说明有设置拒绝了自测流量或代理出错
+    failed := total.errors
+    for status, n := range total.statuses {
+        if !expectedSelftestStatus(status) {
+            failed += n
+        }
+    }
+
+    fmt.Fprintf(out, "requests:     %d (%.0f/s), failed: %d\n", len(total.latencies), float64(len(total.latencies))/elapsed.Seconds(), failed)
+    fmt.Fprintf(out, "status codes: %s\n", formatStatuses(total.statuses))
+    fmt.Fprintf(out, "cache:        hit ratio %.3f, %d hits, %d misses, %d entries, %d bytes\n", stats.HitRatio, stats.Hits, stats.Misses, stats.Entries, stats.Bytes)
+    fmt.Fprintf(out, "latency:      p50 %v, p90 %v, p99 %v, max %v\n",
+        percentile(total.latencies, 0.5), percentile(total.latencies, 0.9), percentile(total.latencies, 0.99), percentile(total.latencies, 1))
+    fmt.Fprintf(out, "heap:         %s before, %s after, %s peak, growth %s\n",
+        formatBytes(heapBefore), formatBytes(heapAfter), formatBytes(peakHeap), formatBytes(int64(heapAfter)-int64(heapBefore)))
+
+    if failed > 0 {
+        return fmt.Errorf("%d of %d requests failed", failed, len(total.latencies))
+    }
+    return nil
+}
+
+// expectedSelftestStatus 判断状态码是否为自测流量应得的结果
+func expectedSelftestStatus(status int) bool {
+    return (status >= 200 && status < 300) || status == http.StatusNotFound
+}
+
+// isolateSelftest 让实例只使用临时缓存目录和假上游，关闭会访问其他服务或拒绝生成流量的设置
+func isolateSelftest(cfg *config.Config, cacheDir, upstream string) {
+    cfg.CacheDir = cacheDir
+    cfg.UpstreamBases = []string{upstream}
+    cfg.UpstreamRegion = ""
+    cfg.UpstreamProxy = ""
+    cfg.UpstreamDNSServer = ""
+    cfg.UpstreamHosts = nil
+    cfg.UpstreamSourceAddr = ""
+    cfg.UpstreamInterface = ""
+    cfg.UpstreamIPFamily = ""
+    cfg.UpstreamMonthlyCap = 0
+    cfg.ShadowUpstream = ""
+    cfg.ShardPeers = nil
+    cfg.ShardSelf = ""
+    cfg.PeerDiscoverySRV = ""
+    cfg.PurgePeers = nil
+    cfg.FollowPrimary = ""
+    cfg.WarmupSeed = ""
+    cfg.RateLimitRPS = 0
+    cfg.AllowedOrigins = nil
+    cfg.APIKeys = nil
+    cfg.APIKeyTiers = nil
+}
+
+// startFakeUpstream 启动模拟Gravatar的上游：按哈希确定性地返回生成的头像，部分哈希返回404
+func startFakeUpstream(missRate float64, latency time.Duration) (*http.Server, error) {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/avatar/", func(w http.ResponseWriter, r *http.Request) {
+        if latency > 0 {
+            time.Sleep(latency/2 + rand.N(latency))
+        }
+        hash := strings.TrimPrefix(r.URL.Path, "/avatar/")
+        sum := md5.Sum([]byte(hash))
+        if float64(sum[0])/256 < missRate && r.URL.Query().Get("d") == "404" {
+            http.NotFound(w, r)
+            return
+        }
+        size, _ := strconv.Atoi(r.URL.Query().Get("s"))
+        data, err := avatargen.Generate("identicon", hash, size, avatargen.Options{})
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        w.Header().Set("Content-Type", "image/png")
+        w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+        w.Write(data)
+    })
+    return listenLocal(mux)
+}
+
+// listenLocal 在127.0.0.1的随机端口上启动服务器，Addr为实际监听的地址
+func listenLocal(handler http.Handler) (*http.Server, error) {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        return nil, fmt.Errorf("failed to listen: %w", err)
+    }
+    server := &http.Server{Addr: listener.Addr().String(), Handler: handler}
+    go server.Serve(listener)
+    return server, nil
+}
+
+// generateTraffic 持续发送请求直到deadline；哈希按Zipf分布选取，少数热门头像占大部分流量
+func generateTraffic(client *http.Client, base string, hashes int, deadline time.Time) selftestResult {
+    rng := rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+    zipf := rand.NewZipf(rng, 1.1, 1, uint64(hashes-1))
+    result := selftestResult{statuses: make(map[int]int)}
+    for time.Now().Before(deadline) {
+        sum := md5.Sum([]byte("selftest-" + strconv.FormatUint(zipf.Uint64(), 10)))
+        url := base + "/avatar/" + hex.EncodeToString(sum[:])
+        var params []string
+        if size := selftestSizes[rng.IntN(len(selftestSizes))]; size != "" {
+            params = append(params, "s="+size)
+        }
+        if d := selftestDefaults[rng.IntN(len(selftestDefaults))]; d != "" {
+            params = append(params, "d="+d)
+        }
+        if len(params) > 0 {
+            url += "?" + strings.Join(params, "&")
+        }
+
+        start := time.Now()
+        resp, err := client.Get(url)
+        if err == nil {
+            _, err = io.Copy(io.Discard, resp.Body)
+            resp.Body.Close()
+        }
+        result.latencies = append(result.latencies, time.Since(start))
+        if err != nil {
+            result.errors++
+            log.Warn("selftest request failed", "url", url, "error", err)
+            continue
+        }
+        result.statuses[resp.StatusCode]++
+    }
+    return result
+}
+
+// sampleHeap 每秒记录一次堆内存峰值，直到deadline或调用返回的停止函数
+func sampleHeap(out io.Writer, peak *uint64, deadline time.Time) func() {
+    done := make(chan struct{})
+    stopped := make(chan struct{})
+    go func() {
+        defer close(stopped)
+        ticker := time.NewTicker(time.Second)
+        defer ticker.Stop()
+        var m runtime.MemStats
+        for {
+            select {
+            case <-done:
+                return
+            case now := <-ticker.C:
+                runtime.ReadMemStats(&m)
+                *peak = max(*peak, m.HeapInuse)
+                if now.Before(deadline) && now.Second()%10 == 0 {
+                    fmt.Fprintf(out, "%v remaining, heap %s\n", deadline.Sub(now).Round(time.Second), formatBytes(m.HeapInuse))
+                }
+            }
+        }
+    }()
+    return func() {
+        close(done)
+        <-stopped
+    }
+}
+
+// heapInUse 在垃圾回收后读取堆内存用量，排除尚未回收的对象
+func heapInUse() uint64 {
+    runtime.GC()
+    var m runtime.MemStats
+    runtime.ReadMemStats(&m)
+    return m.HeapInuse
+}
+
+// percentile 返回已排序延迟的分位数
+func percentile(sorted []time.Duration, p float64) time.Duration {
+    if len(sorted) == 0 {
+        return 0
+    }
+    i := int(p * float64(len(sorted)-1))
+    return sorted[i].Round(10 * time.Microsecond)
+}
+
+func formatStatuses(statuses map[int]int) string {
+    codes := make([]int, 0, len(statuses))
+    for code := range statuses {
+        codes = append(codes, code)
+    }
+    slices.Sort(codes)
+    parts := make([]string, 0, len(codes))
+    for _, code := range codes {
+        parts = append(parts, fmt.Sprintf("%d=%d", code, statuses[code]))
+    }
+    return strings.Join(parts, " ")
+}
+
+func formatBytes[T int64 | uint64](n T) string {
+    return fmt.Sprintf("%.1fMB", float64(n)/(1<<20))
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+    "bytes"
+    "io"
+    "net/http"
+    "regexp"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+
+    "gravatar-proxy/internal/config"
+)
+
+func TestExpectedSelftestStatus(t *testing.T) {
+    tests := []struct {
+        status int
+        want   bool
+    }{
+        {http.StatusOK, true},
+        {http.StatusNoContent, true},
+        {http.StatusNotFound, true},
+        {http.StatusNotModified, false},
+        {http.StatusForbidden, false},
+        {http.StatusRequestURITooLong, false},
+        {http.StatusTooManyRequests, false},
+        {http.StatusBadGateway, false},
+    }
+    for _, tt := range tests {
+        if got := expectedSelftestStatus(tt.status); got != tt.want {
+            t.Errorf("expectedSelftestStatus(%d) = %v, want %v", tt.status, got, tt.want)
+        }
+    }
+}
+
+func TestIsolateSelftest(t *testing.T) {
+    cfg := &config.Config{
+        CacheDir:           "/var/cache/gravatar-proxy",
+        UpstreamBases:      []string{"https://www.gravatar.com"},
+        UpstreamRegion:     "eu",
+        UpstreamProxy:      "http://proxy:3128",
+        UpstreamDNSServer:  "10.0.0.53:53",
+        UpstreamHosts:      map[string][]string{"www.gravatar.com": {"192.0.2.1"}},
+        UpstreamSourceAddr: "192.0.2.10",
+        UpstreamInterface:  "eth1",
+        UpstreamIPFamily:   "ipv6",
+        UpstreamMonthlyCap: 1 << 30,
+        ShadowUpstream:     "https://shadow.example.com",
+        ShardPeers:         []string{"http://peer:8080"},
+        ShardSelf:          "http://self:8080",
+        PeerDiscoverySRV:   "_gravatar._tcp.example.com",
+        PurgePeers:         []string{"http://peer:8080"},
+        FollowPrimary:      "http://primary:8080",
+        WarmupSeed:         "https://seed.example.com/hashes.txt",
+        RateLimitRPS:       1,
+        AllowedOrigins:     []string{"example.com"},
+        APIKeys:            []string{"web=key"},
+        APIKeyTiers:        map[string]config.APIKeyTier{"partner": {Keys: []string{"key"}}},
+        CacheTTL:           time.Hour,
+    }
+    isolateSelftest(cfg, "/tmp/selftest", "http://127.0.0.1:1234")
+
+    if cfg.CacheDir != "/tmp/selftest" || len(cfg.UpstreamBases) != 1 || cfg.UpstreamBases[0] != "http://127.0.0.1:1234" {
+        t.Errorf("expected the temporary cache and fake upstream, got %q and %v", cfg.CacheDir, cfg.UpstreamBases)
+    }
+    cleared := []struct {
+        name  string
+        empty bool
+    }{
+        {"UpstreamRegion", cfg.UpstreamRegion == ""},
+        {"UpstreamProxy", cfg.UpstreamProxy == ""},
+        {"UpstreamDNSServer", cfg.UpstreamDNSServer == ""},
+        {"UpstreamHosts", cfg.UpstreamHosts == nil},
+        {"UpstreamSourceAddr", cfg.UpstreamSourceAddr == ""},
+        {"UpstreamInterface", cfg.UpstreamInterface == ""},
+        {"UpstreamIPFamily", cfg.UpstreamIPFamily == ""},
+        {"UpstreamMonthlyCap", cfg.UpstreamMonthlyCap == 0},
+        {"ShadowUpstream", cfg.ShadowUpstream == ""},
+        {"ShardPeers", cfg.ShardPeers == nil},
+        {"ShardSelf", cfg.ShardSelf == ""},
+        {"PeerDiscoverySRV", cfg.PeerDiscoverySRV == ""},
+        {"PurgePeers", cfg.PurgePeers == nil},
+        {"FollowPrimary", cfg.FollowPrimary == ""},
+        {"WarmupSeed", cfg.WarmupSeed == ""},
+        {"RateLimitRPS", cfg.RateLimitRPS == 0},
+        {"AllowedOrigins", cfg.AllowedOrigins == nil},
+        {"APIKeys", cfg.APIKeys == nil},
+        {"APIKeyTiers", cfg.APIKeyTiers == nil},
+    }
+    for _, c := range cleared {
+        if !c.empty {
+            t.Errorf("expected %s to be cleared", c.name)
+        }
+    }
+    if cfg.CacheTTL != time.Hour {
+        t.Errorf("expected unrelated settings to be kept, got CacheTTL %v", cfg.CacheTTL)
+    }
+}
+
+func TestPercentile(t *testing.T) {
+    sorted := []time.Duration{
+        1 * time.Millisecond, 2 * time.Millisecond, 3 * time.Millisecond, 4 * time.Millisecond, 5 * time.Millisecond,
+        6 * time.Millisecond, 7 * time.Millisecond, 8 * time.Millisecond, 9 * time.Millisecond, 10 * time.Millisecond,
+    }
+    tests := []struct {
+        latencies []time.Duration
+        p         float64
+        want      time.Duration
+    }{
+        {nil, 0.5, 0},
+        {[]time.Duration{1234567 * time.Nanosecond}, 0.99, 1230 * time.Microsecond},
+        {sorted, 0, time.Millisecond},
+        {sorted, 0.5, 5 * time.Millisecond},
+        {sorted, 0.9, 9 * time.Millisecond},
+        {sorted, 0.99, 9 * time.Millisecond},
+        {sorted, 1, 10 * time.Millisecond},
+    }
+    for _, tt := range tests {
+        if got := percentile(tt.latencies, tt.p); got != tt.want {
+            t.Errorf("percentile(%d latencies, %v) = %v, want %v", len(tt.latencies), tt.p, got, tt.want)
+        }
+    }
+}
+
+func TestFormatBytes(t *testing.T) {
+    tests := []struct {
+        n    int64
+        want string
+    }{
+        {0, "0.0MB"},
+        {1 << 20, "1.0MB"},
+        {3 << 19, "1.5MB"},
+        {-(1 << 20), "-1.0MB"},
+    }
+    for _, tt := range tests {
+        if got := formatBytes(tt.n); got != tt.want {
+            t.Errorf("formatBytes(%d) = %q, want %q", tt.n, got, tt.want)
+        }
+    }
+    if got := formatBytes(uint64(5 << 20)); got != "5.0MB" {
+        t.Errorf("formatBytes(uint64) = %q, want 5.0MB", got)
+    }
+}
+
+func TestFakeUpstream(t *testing.T) {
+    upstream, err := startFakeUpstream(1, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer upstream.Close()
+
+    get := func(query string) (int, []byte) {
+        t.Helper()
+        resp, err := http.Get("http://" + upstream.Addr + "/avatar/00000000000000000000000000000000" + query)
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer resp.Body.Close()
+        data, _ := io.ReadAll(resp.Body)
+        return resp.StatusCode, data
+    }
+    // 缺失率为1时所有哈希在d=404下都返回404，其他请求仍返回头像
+    if status, _ := get("?d=404"); status != http.StatusNotFound {
+        t.Errorf("expected 404 for d=404, got %d", status)
+    }
+    status, first := get("?s=80")
+    if status != http.StatusOK || len(first) == 0 {
+        t.Fatalf("expected an avatar, got %d with %d bytes", status, len(first))
+    }
+    if _, again := get("?s=80"); !bytes.Equal(first, again) {
+        t.Error("expected the same avatar for the same hash")
+    }
+}
+
+func TestSelftestRun(t *testing.T) {
+    args := []string{"--duration", "300ms", "--concurrency", "2", "--hashes", "20", "--upstream-latency", "0"}
+
+    var out bytes.Buffer
+    if err := selftest(&out, args); err != nil {
+        t.Fatalf("expected the selftest to pass, got %v\n%s", err, out.String())
+    }
+    // 20个哈希在300ms内必然被重复请求
+    m := regexp.MustCompile(`hit ratio (\d\.\d{3}),`).FindStringSubmatch(out.String())
+    if m == nil {
+        t.Fatalf("expected the hit ratio to be reported, got %s", out.String())
+    }
+    if ratio, _ := strconv.ParseFloat(m[1], 64); ratio <= 0 {
+        t.Errorf("expected a positive hit ratio, got %s", m[1])
+    }
+    if !strings.Contains(out.String(), "failed: 0") {
+        t.Errorf("expected no failed requests, got %s", out.String())
+    }
+
+    // 过短的MAX_URL_LENGTH让每个请求得到414，不属于自测流量应得的状态
+    t.Setenv("MAX_URL_LENGTH", "20")
+    out.Reset()
+    err := selftest(&out, args)
+    if err == nil || !strings.Contains(err.Error(), "requests failed") {
+        t.Fatalf("expected the selftest to fail, got %v\n%s", err, out.String())
+    }
+    if !strings.Contains(out.String(), "414=") {
+        t.Errorf("expected the 414 responses to be reported, got %s", out.String())
+    }
+}
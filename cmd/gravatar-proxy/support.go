@@ -0,0 +1,316 @@
+package main
+
+import (
+    "archive/tar"
+    "compress/gzip"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "os"
+    "path/filepath"
+    "regexp"
+    "runtime"
+    "runtime/debug"
+    "strings"
+    "time"
+
+    "gravatar-proxy/internal/cache"
+    "gravatar-proxy/internal/config"
+    "gravatar-proxy/internal/log"
+    "gravatar-proxy/internal/proxy"
+)
+
+// redacted 替换配置中的密钥和密码
+const redacted = "REDACTED"
+
+// supportBundle 按顺序写入tar.gz；收集失败的部分记在errors中，最后写入errors.txt，不中断其他部分
+type supportBundle struct {
+    tw     *tar.Writer
+    now    time.Time
+    errors []string
+}
+
+// runSupportBundle 执行 gravatar-proxy support-bundle：把脱敏后的配置、最近的日志、运行中实例的统计、
+// 索引概况和版本信息打包为tar.gz，附在问题报告中。只读取CACHE_DIR，可在服务器运行时执行
+func runSupportBundle(args []string) error {
+    fs := flag.NewFlagSet("gravatar-proxy support-bundle", flag.ContinueOnError)
+    output := fs.String("output", "", "bundle file to write (default gravatar-proxy-support-<time>.tar.gz)")
+    target := fs.String("url", "", "base URL of the running instance (default http://127.0.0.1:PORT)")
+    var logFiles []string
+    fs.Func("log", "additional log file to include, e.g. captured stdout (repeatable)", func(path string) error {
+        logFiles = append(logFiles, path)
+        return nil
+    })
+    logBytes := fs.Int64("log-bytes", 1<<20, "how many bytes from the end of each log file to include")
+    fs.Usage = func() {
+        fmt.Fprintf(fs.Output(), "Usage: gravatar-proxy support-bundle [flags]\n\nSettings come from the environment and CONFIG_FILE as for the server.\n\n")
+        fs.PrintDefaults()
+    }
+    if err := fs.Parse(args); err != nil {
+        return err
+    }
+    if fs.NArg() > 0 {
+        return fmt.Errorf("unexpected argument %q", fs.Arg(0))
+    }
+
+    cfg, err := config.Load()
+    if err != nil {
+        return fmt.Errorf("failed to load config: %w", err)
+    }
+    log.Configure(log.Options{Level: cfg.LogLevel, Format: cfg.LogFormat})
+
+    now := time.Now().UTC()
+    if *output == "" {
+        *output = "gravatar-proxy-support-" + now.Format("20060102-150405") + ".tar.gz"
+    }
+    if *target == "" {
+        scheme := "http"
+        if cfg.TLSCertFile != "" {
+            scheme = "https"
+        }
+        *target = scheme + "://127.0.0.1:" + cfg.Port
+    }
+
+    f, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    gz := gzip.NewWriter(f)
+    b := &supportBundle{tw: tar.NewWriter(gz), now: now}
+
+    b.addJSON("version.json", versionInfo())
+    b.addJSON("config.json", redactConfig(cfg))
+    if summary, err := cache.SummarizeIndex(cfg.CacheDir); err != nil {
+        b.fail("index.json", err)
+    } else {
+        b.addJSON("index.json", summary)
+    }
+
+    client := &http.Client{Timeout: 10 * time.Second}
+    base := strings.TrimSuffix(*target, "/")
+    b.addURL(client, "stats.json", base+"/admin/stats", cfg.AdminToken)
+    b.addURL(client, "health.json", base+"/healthz?verbose=1", cfg.AdminToken)
+    b.addURL(client, "ready.txt", base+"/readyz", "")
+    b.addURL(client, "metrics.txt", base+"/metrics", "")
+
+    for name, path := range map[string]string{"access.log": cfg.AccessLogFile, "audit.log": cfg.AuditLogFile} {
+        if path != "" {
+            b.addLogTail("logs/"+name, path, *logBytes)
+        }
+    }
+    for _, path := range logFiles {
+        b.addLogTail("logs/"+filepath.Base(path), path, *logBytes)
+    }
+
+    if len(b.errors) > 0 {
+        b.add("errors.txt", []byte(strings.Join(b.errors, "\n")+"\n"))
+    }
+    err = errors.Join(b.tw.Close(), gz.Close(), f.Close())
+    if err != nil {
+        os.Remove(*output)
+        return fmt.Errorf("failed to write support bundle: %w", err)
+    }
+    log.Info("wrote support bundle", "path", *output, "missing_parts", len(b.errors))
+    return nil
+}
+
+func (b *supportBundle) add(name string, data []byte) {
+    header := &tar.Header{Name: name, Mode: 0600, Size: int64(len(data)), ModTime: b.now}
+    if err := b.tw.WriteHeader(header); err != nil {
+        b.fail(name, err)
+        return
+    }
+    if _, err := b.tw.Write(data); err != nil {
+        b.fail(name, err)
+    }
+}
+
+func (b *supportBundle) addJSON(name string, v any) {
+    data, err := json.MarshalIndent(v, "", "  ")
+    if err != nil {
+        b.fail(name, err)
+        return
+    }
+    b.add(name, append(data, '\n'))
+}
+
+func (b *supportBundle) fail(name string, err error) {
+    b.errors = append(b.errors, name+": "+err.Error())
+    log.Warn("failed to collect support bundle part", "part", name, "error", err)
+}
+
+// addURL 从运行中的实例获取一个接口的响应；实例未运行时记为缺失
+func (b *supportBundle) addURL(client *http.Client, name, target, token string) {
+    req, err := http.NewRequest(http.MethodGet, target, nil)
+    if err != nil {
+        b.fail(name, err)
+        return
+    }
+    if token != "" {
+        req.Header.Set("Authorization", "Bearer "+token)
+    }
+    resp, err := client.Do(req)
+    if err != nil {
+        b.fail(name, err)
+        return
+    }
+    defer resp.Body.Close()
+    data, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+    if err != nil {
+        b.fail(name, err)
+        return
+    }
+    if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusServiceUnavailable {
+        b.fail(name, fmt.Errorf("GET %s returned %s", req.URL.Path, resp.Status))
+        return
+    }
+    b.add(name, data)
+}
+
+// 日志中可能带凭据的部分：URL（如referer）的密码和查询参数，以及名称像凭据的字段；JSON和text两种日志格式都适用
+var (
+    logURLPattern    = regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9+.-]*://[^\s"\\]+`)
+    logSecretPattern = regexp.MustCompile(`(?i)("?[a-z_]*(?:token|password|secret|api_key|authorization)"?[=:])("(?:[^"\\]|\\.)*"|[^\s,}]+)`)
+)
+
+// redactLog 对日志内容脱敏，逐处替换而不解析，格式不完整的行同样处理
+func redactLog(data []byte) []byte {
+    data = logURLPattern.ReplaceAllFunc(data, func(m []byte) []byte {
+        return []byte(redactURL(string(m)))
+    })
+    return logSecretPattern.ReplaceAll(data, []byte(`${1}"`+redacted+`"`))
+}
+
+// addLogTail 加入日志文件最后limit字节，从第一个完整行开始，内容经过脱敏
+func (b *supportBundle) addLogTail(name, path string, limit int64) {
+    f, err := os.Open(path)
+    if err != nil {
+        b.fail(name, err)
+        return
+    }
+    defer f.Close()
+    info, err := f.Stat()
+    if err != nil {
+        b.fail(name, err)
+        return
+    }
+    offset := max(info.Size()-limit, 0)
+    data, err := io.ReadAll(io.NewSectionReader(f, offset, info.Size()-offset))
+    if err != nil {
+        b.fail(name, err)
+        return
+    }
+    if offset > 0 {
+        if i := strings.IndexByte(string(data), '\n'); i >= 0 {
+            data = data[i+1:]
+        }
+    }
+    b.add(name, redactLog(data))
+}
+
+// versionInfo 返回构建版本、Go版本、平台和构建设置（VCS修订、构建标签等）
+func versionInfo() map[string]any {
+    info := map[string]any{
+        "version": proxy.BuildVersion(),
+        "go_version": runtime.Version(),
+        "os": runtime.GOOS,
+        "arch": runtime.GOARCH,
+        "cpus": runtime.NumCPU(),
+    }
+    if build, ok := debug.ReadBuildInfo(); ok {
+        settings := make(map[string]string, len(build.Settings))
+        for _, s := range build.Settings {
+            settings[s.Key] = s.Value
+        }
+        info["build_settings"] = settings
+    }
+    return info
+}
+
+// redactConfig 返回去掉密钥、密码和URL中凭据的配置副本；列表保留条目数和name=key中的名称，便于确认配置是否生效
+func redactConfig(cfg *config.Config) *config.Config {
+    c := *cfg
+    secret := func(s string) string {
+        if s == "" {
+            return ""
+        }
+        return redacted
+    }
+    keys := func(list []string) []string {
+        out := make([]string, len(list))
+        for i, key := range list {
+            if name, _, ok := strings.Cut(key, "="); ok {
+                out[i] = name + "=" + redacted
+            } else {
+                out[i] = redacted
+            }
+        }
+        return out
+    }
+
+    c.AdminToken = secret(c.AdminToken)
+    c.AdminBasicPassword = secret(c.AdminBasicPassword)
+    c.APIKeys = keys(c.APIKeys)
+    if c.APIKeyTiers != nil {
+        c.APIKeyTiers = make(map[string]config.APIKeyTier, len(cfg.APIKeyTiers))
+        for name, tier := range cfg.APIKeyTiers {
+            tier.Keys = keys(tier.Keys)
+            c.APIKeyTiers[name] = tier
+        }
+    }
+    if c.TracesHeaders != nil {
+        c.TracesHeaders = make(map[string]string, len(cfg.TracesHeaders))
+        for name := range cfg.TracesHeaders {
+            c.TracesHeaders[name] = redacted
+        }
+    }
+    if c.UpstreamOverrides != nil {
+        c.UpstreamOverrides = make(map[string]string, len(cfg.UpstreamOverrides))
+        for name, base := range cfg.UpstreamOverrides {
+            c.UpstreamOverrides[name] = redactURL(base)
+        }
+    }
+    c.UpstreamProxy = redactURL(c.UpstreamProxy)
+    c.ShadowUpstream = redactURL(c.ShadowUpstream)
+    c.FollowPrimary = redactURL(c.FollowPrimary)
+    c.WarmupSeed = redactURL(c.WarmupSeed)
+    c.AdminJWTIssuer = redactURL(c.AdminJWTIssuer)
+    c.AdminJWTJWKSURL = redactURL(c.AdminJWTJWKSURL)
+    c.TracesEndpoint = redactURL(c.TracesEndpoint)
+    c.UpstreamBases = redactURLs(c.UpstreamBases)
+    c.PurgePeers = redactURLs(c.PurgePeers)
+    c.ShardPeers = redactURLs(c.ShardPeers)
+    return &c
+}
+
+// redactURL 去掉URL中的密码和查询参数的值，保留参数名；不是URL或两者都没有时原样返回
+func redactURL(s string) string {
+    u, err := url.Parse(s)
+    if err != nil || (u.User == nil && u.RawQuery == "") {
+        return s
+    }
+    if u.RawQuery != "" {
+        query, _ := url.ParseQuery(u.RawQuery)
+        for name := range query {
+            query[name] = []string{redacted}
+        }
+        u.RawQuery = query.Encode()
+    }
+    return u.Redacted()
+}
+
+func redactURLs(list []string) []string {
+    if list == nil {
+        return nil
+    }
+    out := make([]string, len(list))
+    for i, s := range list {
+        out[i] = redactURL(s)
+    }
+    return out
+}
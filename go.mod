@@ -1,3 +1,7 @@
 module gravatar-proxy
 
-go 1.22.2
+go 1.24
+
+require golang.org/x/image v0.25.0
+
+require github.com/andybalholm/brotli v1.2.0
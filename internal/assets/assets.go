@@ -0,0 +1,76 @@
+package assets
+
+import (
+	"io/fs"
+	"mime"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Default 描述一个内置默认头像资源
+type Default struct {
+	Name        string `json:"name"`
+	File        string `json:"file"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+}
+
+// List 返回当前构建中可用的内置默认头像，按文件名排序
+func List() []Default {
+	entries, err := fs.ReadDir(files, "defaults")
+	if err != nil {
+		return nil
+	}
+
+	defaults := make([]Default, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		defaults = append(defaults, Default{
+			Name:        strings.TrimSuffix(e.Name(), path.Ext(e.Name())),
+			File:        e.Name(),
+			ContentType: contentType(e.Name()),
+			Size:        info.Size(),
+		})
+	}
+
+	sort.Slice(defaults, func(i, j int) bool {
+		return defaults[i].File < defaults[j].File
+	})
+	return defaults
+}
+
+// Get 按文件名（如 mp.png）或名称（如 mp）读取内置资源
+// 仅给出名称时优先返回PNG版本
+func Get(name string) ([]byte, string, bool) {
+	name = path.Base(name)
+	if name == "" || name == "." || name == "/" {
+		return nil, "", false
+	}
+
+	candidates := []string{name}
+	if path.Ext(name) == "" {
+		candidates = []string{name + ".png", name + ".svg"}
+	}
+
+	for _, file := range candidates {
+		data, err := fs.ReadFile(files, path.Join("defaults", file))
+		if err == nil {
+			return data, contentType(file), true
+		}
+	}
+	return nil, "", false
+}
+
+func contentType(file string) string {
+	if ct := mime.TypeByExtension(path.Ext(file)); ct != "" {
+		return ct
+	}
+	return "application/octet-stream"
+}
@@ -0,0 +1,8 @@
+//go:build !assets_minimal
+
+package assets
+
+import "embed"
+
+//go:embed defaults
+var files embed.FS
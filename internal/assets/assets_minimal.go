@@ -0,0 +1,10 @@
+//go:build assets_minimal
+
+package assets
+
+import "embed"
+
+// 精简构建仅包含最常用的默认头像，减小二进制体积
+//
+//go:embed defaults/mp.png defaults/blank.png
+var files embed.FS
@@ -0,0 +1,25 @@
+//go:build assets_minimal
+
+package assets
+
+import "testing"
+
+func TestMinimalAssets(t *testing.T) {
+	list := List()
+	if len(list) != 2 || list[0].File != "blank.png" || list[1].File != "mp.png" {
+		t.Fatalf("expected only blank.png and mp.png, got %+v", list)
+	}
+	for _, d := range list {
+		if d.ContentType != "image/png" || d.Size == 0 {
+			t.Errorf("expected a non-empty PNG for %s, got %s of %d bytes", d.File, d.ContentType, d.Size)
+		}
+	}
+
+	if _, _, ok := Get("mp.svg"); ok {
+		t.Error("expected mp.svg to be left out of the minimal build")
+	}
+	// 只给名称时SVG版本不存在，仍返回PNG版本
+	if _, contentType, ok := Get("mp"); !ok || contentType != "image/png" {
+		t.Errorf("expected mp to resolve to the PNG, got %q, %v", contentType, ok)
+	}
+}
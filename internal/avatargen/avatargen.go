@@ -0,0 +1,157 @@
+package avatargen
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"sort"
+	"sync"
+)
+
+const (
+	DefaultSize = 80
+	MaxSize     = 2048
+)
+
+var ErrUnknownStyle = errors.New("unknown avatar style")
+
+// Options 携带渲染时除哈希以外的可选输入
+type Options struct {
+	Hash    string
+	Text    string
+	Palette *Palette
+}
+
+// RenderFunc 根据种子在size×size的画布上绘制头像，相同输入必须产生相同输出
+type RenderFunc func(seed Seed, size int, opts Options) image.Image
+
+var (
+	mu       sync.RWMutex
+	registry = make(map[string]RenderFunc)
+)
+
+// Register 注册一个头像风格，同名风格会被覆盖
+func Register(name string, render RenderFunc) {
+	mu.Lock()
+	defer mu.Unlock()
+	registry[name] = render
+}
+
+func Lookup(name string) (RenderFunc, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	render, ok := registry[name]
+	return render, ok
+}
+
+// Styles 返回已注册的风格名，按字母排序
+func Styles() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Generate 渲染指定风格的头像并编码为PNG
+func Generate(style, hash string, size int, opts Options) ([]byte, error) {
+	render, ok := Lookup(style)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownStyle, style)
+	}
+
+	opts.Hash = hash
+	if opts.Palette == nil {
+		opts.Palette = DefaultPalette
+	}
+	img := render(NewSeed(style, hash), ClampSize(size), opts)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("failed to encode avatar: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func ClampSize(size int) int {
+	if size <= 0 {
+		return DefaultSize
+	}
+	if size > MaxSize {
+		return MaxSize
+	}
+	return size
+}
+
+// Seed 是由风格名和哈希派生的确定性随机源，不同风格对同一哈希得到不同的种子
+type Seed [sha256.Size]byte
+
+func NewSeed(style, hash string) Seed {
+	return Seed(sha256.Sum256([]byte(style + ":" + hash)))
+}
+
+// Byte 返回第i个字节，超出长度时循环
+func (s Seed) Byte(i int) byte {
+	return s[i%len(s)]
+}
+
+// Bit 返回第i个比特
+func (s Seed) Bit(i int) bool {
+	return s.Byte(i/8)&(1<<(uint(i)%8)) != 0
+}
+
+// Color 从种子的第i个位置派生一个饱和度适中的颜色
+func (s Seed) Color(i int) color.RGBA {
+	hue := float64(uint16(s.Byte(i))<<8|uint16(s.Byte(i+1))) / 65535 * 360
+	sat := 0.45 + float64(s.Byte(i+2))/255*0.2
+	light := 0.45 + float64(s.Byte(i+3))/255*0.15
+	return hsl(hue, sat, light)
+}
+
+func hsl(h, s, l float64) color.RGBA {
+	c := (1 - math.Abs(2*l-1)) * s
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	m := l - c/2
+
+	var r, g, b float64
+	switch {
+	case h < 60:
+		r, g, b = c, x, 0
+	case h < 120:
+		r, g, b = x, c, 0
+	case h < 180:
+		r, g, b = 0, c, x
+	case h < 240:
+		r, g, b = 0, x, c
+	case h < 300:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+
+	return color.RGBA{
+		R: uint8(math.Round((r + m) * 255)),
+		G: uint8(math.Round((g + m) * 255)),
+		B: uint8(math.Round((b + m) * 255)),
+		A: 0xff,
+	}
+}
+
+func fill(img draw.Image, r image.Rectangle, c color.Color) {
+	draw.Draw(img, r, image.NewUniform(c), image.Point{}, draw.Src)
+}
+
+// cellRect 计算n×n网格中第(col,row)个格子的像素区域，保证格子铺满画布
+func cellRect(size, n, col, row int) image.Rectangle {
+	return image.Rect(col*size/n, row*size/n, (col+1)*size/n, (row+1)*size/n)
+}
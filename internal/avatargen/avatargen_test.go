@@ -0,0 +1,99 @@
+package avatargen
+
+import (
+	"bytes"
+	"errors"
+	"image/png"
+	"testing"
+)
+
+func TestGenerateDeterministic(t *testing.T) {
+	for _, style := range Styles() {
+		t.Run(style, func(t *testing.T) {
+			a, err := Generate(style, "0123456789abcdef0123456789abcdef", 64, Options{})
+			if err != nil {
+				t.Fatalf("failed to generate: %v", err)
+			}
+			b, err := Generate(style, "0123456789abcdef0123456789abcdef", 64, Options{})
+			if err != nil {
+				t.Fatalf("failed to generate: %v", err)
+			}
+			if !bytes.Equal(a, b) {
+				t.Error("expected identical output for identical input")
+			}
+
+			other, err := Generate(style, "fedcba9876543210fedcba9876543210", 64, Options{})
+			if err != nil {
+				t.Fatalf("failed to generate: %v", err)
+			}
+			if bytes.Equal(a, other) {
+				t.Error("expected different hashes to produce different images")
+			}
+
+			img, err := png.Decode(bytes.NewReader(a))
+			if err != nil {
+				t.Fatalf("failed to decode png: %v", err)
+			}
+			if img.Bounds().Dx() != 64 || img.Bounds().Dy() != 64 {
+				t.Errorf("expected 64x64 image, got %v", img.Bounds())
+			}
+		})
+	}
+}
+
+func TestGenerateUnknownStyle(t *testing.T) {
+	_, err := Generate("nope", "abc", 80, Options{})
+	if !errors.Is(err, ErrUnknownStyle) {
+		t.Errorf("expected ErrUnknownStyle, got %v", err)
+	}
+}
+
+func TestInitialsOf(t *testing.T) {
+	tests := map[string]string{
+		"John Doe":       "JD",
+		"ada":            "A",
+		"Mary Ann Smith": "MA",
+		"  ":             "",
+		"élan 42":        "L4",
+	}
+	for in, want := range tests {
+		if got := Initials(in); got != want {
+			t.Errorf("Initials(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestParsePalette(t *testing.T) {
+	p, err := ParsePalette([]string{"#1abc9c", "#333"}, "#fff", "auto")
+	if err != nil {
+		t.Fatalf("failed to parse palette: %v", err)
+	}
+	if len(p.Colors) != 2 {
+		t.Fatalf("expected 2 colors, got %d", len(p.Colors))
+	}
+	if c := p.Colors[1]; c.R != 0x33 || c.G != 0x33 || c.B != 0x33 {
+		t.Errorf("expected short form #333 to expand, got %v", c)
+	}
+	if p.Foreground != nil {
+		t.Error("expected auto foreground to leave Foreground unset")
+	}
+
+	seed := NewSeed("identicon", "abc")
+	picked := p.Pick(seed, 0)
+	if picked != p.Colors[0] && picked != p.Colors[1] {
+		t.Errorf("expected picked color to come from palette, got %v", picked)
+	}
+
+	if _, err := ParsePalette([]string{"blue"}, "", ""); err == nil {
+		t.Error("expected error for non-hex color")
+	}
+}
+
+func TestEmbeddedFont(t *testing.T) {
+	if len(glyphs) != 37 {
+		t.Errorf("expected 37 glyphs, got %d", len(glyphs))
+	}
+	if glyphs['A'][3] != "#####" {
+		t.Errorf("unexpected glyph row for A: %q", glyphs['A'][3])
+	}
+}
@@ -0,0 +1,93 @@
+package avatargen
+
+import (
+	_ "embed"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"strings"
+)
+
+const (
+	glyphWidth  = 5
+	glyphHeight = 7
+)
+
+// glyphs 是内嵌的5×7点阵字体，覆盖大写字母和数字
+var glyphs = parseFont(bitmapFont)
+
+//go:embed fonts/bitmap5x7.txt
+var bitmapFont string
+
+// parseFont 解析点阵字体文件：每个字形由一行字符和glyphHeight行点阵组成，空行分隔，#开头为注释
+func parseFont(src string) map[rune][glyphHeight]string {
+	font := make(map[rune][glyphHeight]string)
+
+	var lines []string
+	for _, line := range strings.Split(src, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" || strings.HasPrefix(line, "# ") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	for i := 0; i+glyphHeight < len(lines); i += glyphHeight + 1 {
+		r := []rune(lines[i])
+		if len(r) != 1 {
+			panic(fmt.Sprintf("avatargen: invalid glyph header %q", lines[i]))
+		}
+
+		var glyph [glyphHeight]string
+		for row := 0; row < glyphHeight; row++ {
+			line := lines[i+1+row]
+			if len(line) != glyphWidth {
+				panic(fmt.Sprintf("avatargen: glyph %q row %d has width %d", lines[i], row, len(line)))
+			}
+			glyph[row] = line
+		}
+		font[r[0]] = glyph
+	}
+	return font
+}
+
+// drawText 将文字按画布大小等比放大后居中绘制，字间距为一个点
+func drawText(img draw.Image, text string, c color.Color) {
+	runes := []rune(text)
+	if len(runes) == 0 {
+		return
+	}
+
+	bounds := img.Bounds()
+	cols := len(runes)*(glyphWidth+1) - 1
+	scale := bounds.Dx() / 2 / glyphHeight
+	if byWidth := bounds.Dx() * 3 / 4 / cols; byWidth < scale {
+		scale = byWidth
+	}
+	if scale < 1 {
+		scale = 1
+	}
+
+	originX := bounds.Min.X + (bounds.Dx()-cols*scale)/2
+	originY := bounds.Min.Y + (bounds.Dy()-glyphHeight*scale)/2
+	src := image.NewUniform(c)
+
+	for i, r := range runes {
+		glyph, ok := glyphs[r]
+		if !ok {
+			glyph = glyphs['?']
+		}
+		offsetX := originX + i*(glyphWidth+1)*scale
+		for row, line := range glyph {
+			for col, dot := range line {
+				if dot != '#' {
+					continue
+				}
+				x := offsetX + col*scale
+				y := originY + row*scale
+				draw.Draw(img, image.Rect(x, y, x+scale, y+scale), src, image.Point{}, draw.Src)
+			}
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package avatargen
+
+import (
+	"fmt"
+	"image/color"
+	"strconv"
+	"strings"
+)
+
+// Palette 控制生成头像的配色
+// Colors为空时从种子派生任意色相；Foreground为nil时按背景亮度自动选择黑或白
+type Palette struct {
+	Colors     []color.RGBA
+	Background color.RGBA
+	Foreground *color.RGBA
+}
+
+var DefaultPalette = &Palette{
+	Background: color.RGBA{0xf0, 0xf0, 0xf0, 0xff},
+}
+
+// ParsePalette 解析配置中的十六进制颜色，空字符串表示使用默认值，"auto"表示自动前景色
+func ParsePalette(colors []string, background, foreground string) (*Palette, error) {
+	p := &Palette{Background: DefaultPalette.Background}
+
+	for _, s := range colors {
+		c, err := ParseColor(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid palette color: %w", err)
+		}
+		p.Colors = append(p.Colors, c)
+	}
+
+	if background != "" {
+		c, err := ParseColor(background)
+		if err != nil {
+			return nil, fmt.Errorf("invalid background color: %w", err)
+		}
+		p.Background = c
+	}
+
+	if foreground != "" && foreground != "auto" {
+		c, err := ParseColor(foreground)
+		if err != nil {
+			return nil, fmt.Errorf("invalid foreground color: %w", err)
+		}
+		p.Foreground = &c
+	}
+
+	return p, nil
+}
+
+// ParseColor 解析 #rgb 或 #rrggbb 格式的颜色
+func ParseColor(s string) (color.RGBA, error) {
+	hex := strings.TrimPrefix(strings.TrimSpace(s), "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) != 6 {
+		return color.RGBA{}, fmt.Errorf("%q is not a #rgb or #rrggbb color", s)
+	}
+
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("%q is not a #rgb or #rrggbb color", s)
+	}
+	return color.RGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 0xff}, nil
+}
+
+// Pick 用种子的第i个位置选择一个主色
+func (p *Palette) Pick(seed Seed, i int) color.RGBA {
+	if len(p.Colors) == 0 {
+		return seed.Color(i)
+	}
+	return p.Colors[int(seed.Byte(i))%len(p.Colors)]
+}
+
+// TextColor 返回绘制在bg上的文字颜色
+func (p *Palette) TextColor(bg color.RGBA) color.RGBA {
+	if p.Foreground != nil {
+		return *p.Foreground
+	}
+	luminance := 0.299*float64(bg.R) + 0.587*float64(bg.G) + 0.114*float64(bg.B)
+	if luminance > 160 {
+		return color.RGBA{0x22, 0x22, 0x22, 0xff}
+	}
+	return color.RGBA{0xff, 0xff, 0xff, 0xff}
+}
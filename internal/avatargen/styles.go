@@ -0,0 +1,111 @@
+package avatargen
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"strings"
+)
+
+func init() {
+	Register("identicon", renderIdenticon)
+	Register("rings", renderRings)
+	Register("pixel-art", renderPixelArt)
+	Register("initials", renderInitials)
+}
+
+// renderIdenticon 绘制左右对称的5×5色块图案
+func renderIdenticon(seed Seed, size int, opts Options) image.Image {
+	const n = 5
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	fill(img, img.Bounds(), opts.Palette.Background)
+
+	fg := opts.Palette.Pick(seed, 0)
+	for row := 0; row < n; row++ {
+		for col := 0; col < (n+1)/2; col++ {
+			if !seed.Bit(64 + row*n + col) {
+				continue
+			}
+			fill(img, cellRect(size, n, col, row), fg)
+			fill(img, cellRect(size, n, n-1-col, row), fg)
+		}
+	}
+	return img
+}
+
+// renderRings 绘制宽度和颜色由种子决定的同心圆环
+func renderRings(seed Seed, size int, opts Options) image.Image {
+	const rings = 4
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+
+	colors := make([]color.RGBA, rings)
+	for i := range colors {
+		colors[i] = opts.Palette.Pick(seed, i*4)
+	}
+
+	center := float64(size) / 2
+	radius := center * math.Sqrt2
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			d := math.Hypot(float64(x)+0.5-center, float64(y)+0.5-center)
+			ring := int(d / radius * rings)
+			if ring >= rings {
+				ring = rings - 1
+			}
+			img.SetRGBA(x, y, colors[ring])
+		}
+	}
+	return img
+}
+
+// renderPixelArt 绘制左右对称的8×8双色像素小人
+func renderPixelArt(seed Seed, size int, opts Options) image.Image {
+	const n = 8
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	fill(img, img.Bounds(), opts.Palette.Background)
+
+	palette := []color.Color{nil, opts.Palette.Pick(seed, 0), opts.Palette.Pick(seed, 8)}
+	for row := 0; row < n; row++ {
+		for col := 0; col < n/2; col++ {
+			pick := int(seed.Byte(12+row*n/2+col)) % len(palette)
+			if palette[pick] == nil {
+				continue
+			}
+			fill(img, cellRect(size, n, col, row), palette[pick])
+			fill(img, cellRect(size, n, n-1-col, row), palette[pick])
+		}
+	}
+	return img
+}
+
+// renderInitials 在种子决定的背景色上绘制最多两个字符的缩写
+// 未提供文字时使用哈希的前两个字符
+func renderInitials(seed Seed, size int, opts Options) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	bg := opts.Palette.Pick(seed, 0)
+	fill(img, img.Bounds(), bg)
+
+	text := Initials(opts.Text)
+	if text == "" && len(opts.Hash) >= 2 {
+		text = strings.ToUpper(opts.Hash[:2])
+	}
+	drawText(img, text, opts.Palette.TextColor(bg))
+	return img
+}
+
+// Initials 提取每个单词的首字母（最多两个），只保留字体支持的字符
+func Initials(text string) string {
+	var b strings.Builder
+	for _, word := range strings.Fields(strings.ToUpper(text)) {
+		for _, r := range word {
+			if _, ok := glyphs[r]; ok {
+				b.WriteRune(r)
+				break
+			}
+		}
+		if b.Len() == 2 {
+			break
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,241 @@
+package blake3
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+// 纯Go实现的BLAKE3哈希模式，输出32字节；不支持带密钥哈希、密钥派生和扩展输出
+// 按参考实现逐块压缩，不使用SIMD，对缓存键这样的短输入已足够快
+
+const (
+	// Size 为输出的字节数
+	Size      = 32
+	blockLen  = 64
+	chunkLen  = 1024
+	numRounds = 7
+)
+
+// 压缩函数的标志位
+const (
+	flagChunkStart = 1 << 0
+	flagChunkEnd   = 1 << 1
+	flagParent     = 1 << 2
+	flagRoot       = 1 << 3
+)
+
+var iv = [8]uint32{0x6A09E667, 0xBB67AE85, 0x3C6EF372, 0xA54FF53A, 0x510E527F, 0x9B05688C, 0x1F83D9AB, 0x5BE0CD19}
+
+var msgPermutation = [16]int{2, 6, 3, 10, 7, 0, 4, 13, 1, 11, 12, 5, 9, 14, 15, 8}
+
+func g(s *[16]uint32, a, b, c, d int, mx, my uint32) {
+	s[a] = s[a] + s[b] + mx
+	s[d] = bits.RotateLeft32(s[d]^s[a], -16)
+	s[c] = s[c] + s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], -12)
+	s[a] = s[a] + s[b] + my
+	s[d] = bits.RotateLeft32(s[d]^s[a], -8)
+	s[c] = s[c] + s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], -7)
+}
+
+func round(s *[16]uint32, m *[16]uint32) {
+	// 先混合各列，再混合各对角线
+	g(s, 0, 4, 8, 12, m[0], m[1])
+	g(s, 1, 5, 9, 13, m[2], m[3])
+	g(s, 2, 6, 10, 14, m[4], m[5])
+	g(s, 3, 7, 11, 15, m[6], m[7])
+	g(s, 0, 5, 10, 15, m[8], m[9])
+	g(s, 1, 6, 11, 12, m[10], m[11])
+	g(s, 2, 7, 8, 13, m[12], m[13])
+	g(s, 3, 4, 9, 14, m[14], m[15])
+}
+
+// compress 为BLAKE3的压缩函数，返回完整的16个字；前8个字即新的链值
+func compress(cv *[8]uint32, block *[16]uint32, counter uint64, blockLen, flags uint32) [16]uint32 {
+	s := [16]uint32{
+		cv[0], cv[1], cv[2], cv[3], cv[4], cv[5], cv[6], cv[7],
+		iv[0], iv[1], iv[2], iv[3],
+		uint32(counter), uint32(counter >> 32), blockLen, flags,
+	}
+	m := *block
+	for r := 0; r < numRounds; r++ {
+		round(&s, &m)
+		if r < numRounds-1 {
+			var permuted [16]uint32
+			for i, j := range msgPermutation {
+				permuted[i] = m[j]
+			}
+			m = permuted
+		}
+	}
+	for i := 0; i < 8; i++ {
+		s[i] ^= s[i+8]
+		s[i+8] ^= cv[i]
+	}
+	return s
+}
+
+func first8(words [16]uint32) [8]uint32 {
+	var cv [8]uint32
+	copy(cv[:], words[:8])
+	return cv
+}
+
+func blockWords(block []byte) [16]uint32 {
+	var padded [blockLen]byte
+	copy(padded[:], block)
+	var words [16]uint32
+	for i := range words {
+		words[i] = binary.LittleEndian.Uint32(padded[4*i:])
+	}
+	return words
+}
+
+// output 为一个节点最后一次压缩的输入，作为根节点时带上flagRoot压缩得到哈希值，否则得到链值
+type output struct {
+	cv       [8]uint32
+	block    [16]uint32
+	counter  uint64
+	blockLen uint32
+	flags    uint32
+}
+
+func (o *output) chainingValue() [8]uint32 {
+	return first8(compress(&o.cv, &o.block, o.counter, o.blockLen, o.flags))
+}
+
+func (o *output) rootBytes() [Size]byte {
+	words := compress(&o.cv, &o.block, 0, o.blockLen, o.flags|flagRoot)
+	var out [Size]byte
+	for i := 0; i < Size/4; i++ {
+		binary.LittleEndian.PutUint32(out[4*i:], words[i])
+	}
+	return out
+}
+
+func parentOutput(left, right [8]uint32) output {
+	var block [16]uint32
+	copy(block[:8], left[:])
+	copy(block[8:], right[:])
+	return output{cv: iv, block: block, blockLen: blockLen, flags: flagParent}
+}
+
+// chunkState 记录当前1KB块的压缩进度，最后一个64字节分组留到输出时再压缩
+type chunkState struct {
+	cv               [8]uint32
+	counter          uint64
+	block            [blockLen]byte
+	blockLen         int
+	blocksCompressed int
+}
+
+func newChunkState(counter uint64) chunkState {
+	return chunkState{cv: iv, counter: counter}
+}
+
+func (c *chunkState) len() int {
+	return blockLen*c.blocksCompressed + c.blockLen
+}
+
+func (c *chunkState) startFlag() uint32 {
+	if c.blocksCompressed == 0 {
+		return flagChunkStart
+	}
+	return 0
+}
+
+func (c *chunkState) update(p []byte) {
+	for len(p) > 0 {
+		if c.blockLen == blockLen {
+			words := blockWords(c.block[:])
+			c.cv = first8(compress(&c.cv, &words, c.counter, blockLen, c.startFlag()))
+			c.blocksCompressed++
+			c.block = [blockLen]byte{}
+			c.blockLen = 0
+		}
+		n := copy(c.block[c.blockLen:], p)
+		c.blockLen += n
+		p = p[n:]
+	}
+}
+
+func (c *chunkState) output() output {
+	return output{
+		cv:       c.cv,
+		block:    blockWords(c.block[:c.blockLen]),
+		counter:  c.counter,
+		blockLen: uint32(c.blockLen),
+		flags:    c.startFlag() | flagChunkEnd,
+	}
+}
+
+// digest 实现hash.Hash；已完成的块的链值保存在栈中，块数的二进制表示决定何时合并为父节点
+type digest struct {
+	chunk   chunkState
+	cvStack [][8]uint32
+}
+
+// New 返回BLAKE3哈希模式的hash.Hash
+func New() hash.Hash {
+	return &digest{chunk: newChunkState(0)}
+}
+
+// Sum256 返回data的BLAKE3哈希值
+func Sum256(data []byte) [Size]byte {
+	d := &digest{chunk: newChunkState(0)}
+	d.Write(data)
+	return d.sum()
+}
+
+func (d *digest) Size() int      { return Size }
+func (d *digest) BlockSize() int { return blockLen }
+
+func (d *digest) Reset() {
+	d.chunk = newChunkState(0)
+	d.cvStack = d.cvStack[:0]
+}
+
+// addChunk 压入已完成块的链值；totalChunks末尾有几个0，就与栈顶合并几次
+func (d *digest) addChunk(cv [8]uint32, totalChunks uint64) {
+	for totalChunks&1 == 0 {
+		left := d.cvStack[len(d.cvStack)-1]
+		d.cvStack = d.cvStack[:len(d.cvStack)-1]
+		parent := parentOutput(left, cv)
+		cv = parent.chainingValue()
+		totalChunks >>= 1
+	}
+	d.cvStack = append(d.cvStack, cv)
+}
+
+func (d *digest) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		// 确认后面还有数据时才结束当前块，最后一个块要留给根节点
+		if d.chunk.len() == chunkLen {
+			out := d.chunk.output()
+			totalChunks := d.chunk.counter + 1
+			d.addChunk(out.chainingValue(), totalChunks)
+			d.chunk = newChunkState(totalChunks)
+		}
+		take := min(chunkLen-d.chunk.len(), len(p))
+		d.chunk.update(p[:take])
+		p = p[take:]
+	}
+	return n, nil
+}
+
+func (d *digest) sum() [Size]byte {
+	out := d.chunk.output()
+	for i := len(d.cvStack) - 1; i >= 0; i-- {
+		out = parentOutput(d.cvStack[i], out.chainingValue())
+	}
+	return out.rootBytes()
+}
+
+// Sum 把哈希值追加到b后返回，不改变已写入的状态
+func (d *digest) Sum(b []byte) []byte {
+	sum := d.sum()
+	return append(b, sum[:]...)
+}
@@ -0,0 +1,549 @@
+package brotli
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"math/bits"
+	"sort"
+)
+
+// 纯Go实现的Brotli（RFC 7932）压缩器，只用到格式中的一部分特性：
+// 哈希链查找的LZ77和每个元块一套前缀码，不使用块切分、上下文建模和内置字典
+// 压缩率与gzip最高级别相当，用于压缩SVG等小型文本响应
+
+const (
+	// windowBits 为滑动窗口大小（WBITS），向后引用的距离不超过1<<windowBits-16
+	windowBits  = 22
+	maxDistance = 1<<windowBits - 16
+
+	minMatch = 4
+	hashBits = 15
+	// maxChain 为每个位置沿哈希链比较的候选数上限
+	maxChain = 64
+
+	numLiteralSymbols  = 256
+	numCommandSymbols  = 704
+	numDistanceSymbols = 64
+
+	maxCodeLength           = 15
+	maxCodeLengthCodeLength = 5
+
+	// repeatZeroCode 为码长码中表示重复0的符号
+	repeatZeroCode = 17
+)
+
+// metaBlockBytes 为每个元块的最大长度（MLEN上限）
+var metaBlockBytes = 1 << 24
+
+var codeLengthCodeOrder = [18]int{1, 2, 3, 4, 0, 5, 17, 6, 16, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// staticCodeLengthCodes 为写出码长码码长（0到5）所用的固定前缀码，已按低位优先的写出顺序给出
+var staticCodeLengthCodes = [6]struct {
+	code uint32
+	bits uint
+}{{0, 2}, {7, 4}, {3, 3}, {2, 2}, {1, 2}, {15, 4}}
+
+// 插入长度和复制长度码的起始值和额外位数
+var (
+	insertBase  = [24]int{0, 1, 2, 3, 4, 5, 6, 8, 10, 14, 18, 26, 34, 50, 66, 98, 130, 194, 322, 578, 1090, 2114, 6210, 22594}
+	insertExtra = [24]uint{0, 0, 0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 7, 8, 9, 10, 12, 14, 24}
+	copyBase    = [24]int{2, 3, 4, 5, 6, 7, 8, 9, 10, 12, 14, 18, 22, 30, 38, 54, 70, 102, 134, 198, 326, 582, 1094, 2118}
+	copyExtra   = [24]uint{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 7, 8, 9, 10, 24}
+)
+
+// commandCells 为插入与复制码的分组起点，按[插入码/8][复制码/8]索引；只使用需要显式距离的分组
+var commandCells = [3][3]int{{128, 192, 384}, {256, 320, 512}, {448, 576, 640}}
+
+// Encode 压缩data，返回完整的Brotli流
+func Encode(data []byte) []byte {
+	bw := &bitWriter{}
+	// WBITS：1后跟3位的windowBits-17
+	bw.writeBits(1, 1)
+	bw.writeBits(windowBits-17, 3)
+
+	if len(data) == 0 {
+		// ISLAST和ISLASTEMPTY
+		bw.writeBits(1, 1)
+		bw.writeBits(1, 1)
+		return bw.bytes()
+	}
+
+	m := newMatcher(data)
+	for start := 0; start < len(data); start += metaBlockBytes {
+		end := min(start+metaBlockBytes, len(data))
+		writeMetaBlock(bw, data, start, end, m)
+	}
+	return bw.bytes()
+}
+
+// command 是一条插入与复制命令：先写出data[literals:literals+insert]，再从distance之前复制copy个字节
+// copy为0的命令只出现在元块末尾，写完字面量时元块已结束，复制部分不会被解码
+type command struct {
+	literals int
+	insert   int
+	copy     int
+	distance int
+}
+
+// parse 用哈希链查找[start,end)中的重复串，一步懒惰匹配：下一个位置的匹配更长时先输出当前字节
+func parse(data []byte, start, end int, m *matcher) []command {
+	var commands []command
+	literals := start
+	for pos := start; pos < end; {
+		length, distance := m.find(pos, end)
+		m.insert(pos)
+		if length == 0 {
+			pos++
+			continue
+		}
+		if next, _ := m.find(pos+1, end); next > length {
+			pos++
+			continue
+		}
+		commands = append(commands, command{literals: literals, insert: pos - literals, copy: length, distance: distance})
+		for i := pos + 1; i < pos+length; i++ {
+			m.insert(i)
+		}
+		pos += length
+		literals = pos
+	}
+	if literals < end {
+		commands = append(commands, command{literals: literals, insert: end - literals})
+	}
+	return commands
+}
+
+// writeMetaBlock 写出[start,end)对应的压缩元块：只有一种块类型、一套前缀码，NPOSTFIX和NDIRECT都为0
+func writeMetaBlock(bw *bitWriter, data []byte, start, end int, m *matcher) {
+	commands := parse(data, start, end, m)
+
+	literalHistogram := make([]int, numLiteralSymbols)
+	commandHistogram := make([]int, numCommandSymbols)
+	distanceHistogram := make([]int, numDistanceSymbols)
+	for _, c := range commands {
+		for _, b := range data[c.literals : c.literals+c.insert] {
+			literalHistogram[b]++
+		}
+		commandHistogram[c.code()]++
+		if c.copy > 0 {
+			code, _, _ := distanceCodeFor(c.distance)
+			distanceHistogram[code]++
+		}
+	}
+
+	isLast := end == len(data)
+	if isLast {
+		bw.writeBits(1, 1)
+		bw.writeBits(0, 1)
+	} else {
+		bw.writeBits(0, 1)
+	}
+	mlen := uint32(end - start - 1)
+	nibbles := uint(4)
+	for nibbles < 6 && mlen>>(4*nibbles) != 0 {
+		nibbles++
+	}
+	bw.writeBits(uint32(nibbles-4), 2)
+	bw.writeBits(mlen, 4*nibbles)
+	if !isLast {
+		// ISUNCOMPRESSED
+		bw.writeBits(0, 1)
+	}
+
+	// 字面量、插入与复制、距离各只有一种块类型
+	bw.writeBits(0, 1)
+	bw.writeBits(0, 1)
+	bw.writeBits(0, 1)
+	// NPOSTFIX、NDIRECT和字面量的上下文模式
+	bw.writeBits(0, 2)
+	bw.writeBits(0, 4)
+	bw.writeBits(0, 2)
+	// NTREESL和NTREESD都为1，不需要上下文映射
+	bw.writeBits(0, 1)
+	bw.writeBits(0, 1)
+
+	literalCode := buildPrefixCode(literalHistogram, maxCodeLength)
+	commandCode := buildPrefixCode(commandHistogram, maxCodeLength)
+	distanceCode := buildPrefixCode(distanceHistogram, maxCodeLength)
+	literalCode.write(bw, 8)
+	commandCode.write(bw, 10)
+	distanceCode.write(bw, 6)
+
+	for _, c := range commands {
+		commandCode.writeSymbol(bw, c.code())
+		insertCode, copyCode := c.lengthCodes()
+		bw.writeBits(uint32(c.insert-insertBase[insertCode]), insertExtra[insertCode])
+		bw.writeBits(uint32(c.copyLength()-copyBase[copyCode]), copyExtra[copyCode])
+		for _, b := range data[c.literals : c.literals+c.insert] {
+			literalCode.writeSymbol(bw, int(b))
+		}
+		if c.copy > 0 {
+			code, extra, n := distanceCodeFor(c.distance)
+			distanceCode.writeSymbol(bw, code)
+			bw.writeBits(extra, n)
+		}
+	}
+}
+
+// code 返回命令的插入与复制码
+func (c command) code() int {
+	insertCode, copyCode := c.lengthCodes()
+	return commandCells[insertCode>>3][copyCode>>3] + (insertCode&7)<<3 | copyCode&7
+}
+
+// copyLength 返回写出的复制长度；末尾只有插入的命令用最短的复制长度2占位
+func (c command) copyLength() int {
+	return max(c.copy, 2)
+}
+
+func (c command) lengthCodes() (insertCode, copyCode int) {
+	return lengthCode(insertBase[:], c.insert), lengthCode(copyBase[:], c.copyLength())
+}
+
+// lengthCode 返回起始值不大于n的最后一个长度码
+func lengthCode(base []int, n int) int {
+	code := 0
+	for code+1 < len(base) && base[code+1] <= n {
+		code++
+	}
+	return code
+}
+
+// distanceCodeFor 返回距离d（d>=1）的距离码和额外位；NPOSTFIX和NDIRECT为0时距离码从16开始
+func distanceCodeFor(d int) (code int, extra uint32, n uint) {
+	x := uint32(d + 3)
+	n = uint(bits.Len32(x) - 2)
+	code = 16 + 2*int(n-1) + int(x>>n)&1
+	return code, x & (1<<n - 1), n
+}
+
+// matcher 用哈希链记录每个4字节序列出现过的位置
+type matcher struct {
+	data []byte
+	head []int32
+	prev []int32
+}
+
+func newMatcher(data []byte) *matcher {
+	m := &matcher{data: data, head: make([]int32, 1<<hashBits), prev: make([]int32, len(data))}
+	for i := range m.head {
+		m.head[i] = -1
+	}
+	return m
+}
+
+func (m *matcher) hash(pos int) uint32 {
+	return binary.LittleEndian.Uint32(m.data[pos:]) * 0x1e35a7bd >> (32 - hashBits)
+}
+
+func (m *matcher) insert(pos int) {
+	if pos+minMatch > len(m.data) {
+		return
+	}
+	h := m.hash(pos)
+	m.prev[pos] = m.head[h]
+	m.head[h] = int32(pos)
+}
+
+// find 返回pos处不越过end的最长匹配，没有至少minMatch字节的匹配时返回0
+func (m *matcher) find(pos, end int) (length, distance int) {
+	if pos+minMatch > end {
+		return 0, 0
+	}
+	target := m.data[pos:end]
+	for cand, n := m.head[m.hash(pos)], 0; cand >= 0 && n < maxChain; cand, n = m.prev[cand], n+1 {
+		d := pos - int(cand)
+		if d > maxDistance {
+			break
+		}
+		l := 0
+		for l < len(target) && m.data[int(cand)+l] == target[l] {
+			l++
+		}
+		if l > length {
+			length, distance = l, d
+			if l == len(target) {
+				break
+			}
+		}
+	}
+	if length < minMatch {
+		return 0, 0
+	}
+	return length, distance
+}
+
+type bitWriter struct {
+	buf   []byte
+	acc   uint64
+	nbits uint
+}
+
+func (w *bitWriter) writeBits(v uint32, n uint) {
+	w.acc |= uint64(v) << w.nbits
+	w.nbits += n
+	for w.nbits >= 8 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc >>= 8
+		w.nbits -= 8
+	}
+}
+
+func (w *bitWriter) bytes() []byte {
+	if w.nbits > 0 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc, w.nbits = 0, 0
+	}
+	return w.buf
+}
+
+// prefixCode 是规范哈夫曼码，codes中保存按位反转后的码字以便低位优先写出
+type prefixCode struct {
+	lengths []int
+	codes   []uint32
+	used    []int
+}
+
+func buildPrefixCode(histogram []int, limit int) *prefixCode {
+	pc := &prefixCode{lengths: huffmanLengths(histogram, limit)}
+	for symbol, n := range histogram {
+		if n > 0 {
+			pc.used = append(pc.used, symbol)
+		}
+	}
+	pc.codes = canonicalCodes(pc.lengths)
+	return pc
+}
+
+// writeSymbol 写出符号；只有一个符号的码在解码端不消耗任何比特
+func (pc *prefixCode) writeSymbol(bw *bitWriter, symbol int) {
+	if len(pc.used) <= 1 {
+		return
+	}
+	bw.writeBits(pc.codes[symbol], uint(pc.lengths[symbol]))
+}
+
+// write 写出前缀码；最多4个符号时用简单前缀码，alphabetBits为简单前缀码中每个符号的位数
+func (pc *prefixCode) write(bw *bitWriter, alphabetBits uint) {
+	if len(pc.used) <= 4 {
+		pc.writeSimple(bw, alphabetBits)
+		return
+	}
+	pc.writeComplex(bw)
+}
+
+// writeSimple 写出简单前缀码：符号按(码长, 符号)排列，解码端据此还原出相同的规范码
+// 4个符号时树选择位区分码长2,2,2,2和1,2,3,3
+func (pc *prefixCode) writeSimple(bw *bitWriter, alphabetBits uint) {
+	symbols := append([]int(nil), pc.used...)
+	if len(symbols) == 0 {
+		symbols = []int{0}
+	}
+	sort.SliceStable(symbols, func(i, j int) bool {
+		return pc.lengths[symbols[i]] < pc.lengths[symbols[j]]
+	})
+
+	// HSKIP为1表示简单前缀码
+	bw.writeBits(1, 2)
+	bw.writeBits(uint32(len(symbols)-1), 2)
+	for _, symbol := range symbols {
+		bw.writeBits(uint32(symbol), alphabetBits)
+	}
+	if len(symbols) == 4 {
+		if pc.lengths[symbols[0]] == 1 {
+			bw.writeBits(1, 1)
+		} else {
+			bw.writeBits(0, 1)
+		}
+	}
+}
+
+// writeComplex 用码长码写出每个符号的码长，连续的0用17压缩，最后一个非0码长之后的0省略
+func (pc *prefixCode) writeComplex(bw *bitWriter) {
+	type token struct {
+		code  int
+		extra uint32
+	}
+	var tokens []token
+
+	lengths := pc.lengths
+	last := len(lengths) - 1
+	for lengths[last] == 0 {
+		last--
+	}
+	for i := 0; i <= last; {
+		if lengths[i] != 0 {
+			tokens = append(tokens, token{code: lengths[i]})
+			i++
+			continue
+		}
+
+		run := 0
+		for lengths[i+run] == 0 {
+			run++
+		}
+		i += run
+		// 连续的17按(前一次重复数-2)*8+extra+3累加，从高位到低位写出重复数
+		if run == 11 {
+			tokens = append(tokens, token{code: 0})
+			run--
+		}
+		if run < 3 {
+			for ; run > 0; run-- {
+				tokens = append(tokens, token{code: 0})
+			}
+			continue
+		}
+		first := len(tokens)
+		for run -= 3; ; run-- {
+			tokens = append(tokens, token{code: repeatZeroCode, extra: uint32(run & 7)})
+			run >>= 3
+			if run == 0 {
+				break
+			}
+		}
+		for a, b := first, len(tokens)-1; a < b; a, b = a+1, b-1 {
+			tokens[a], tokens[b] = tokens[b], tokens[a]
+		}
+	}
+
+	histogram := make([]int, len(codeLengthCodeOrder))
+	for _, t := range tokens {
+		histogram[t.code]++
+	}
+	lengthCode := buildPrefixCode(histogram, maxCodeLengthCodeLength)
+	codeLengths := lengthCode.lengths
+	numCodes := len(codeLengthCodeOrder)
+	if len(lengthCode.used) == 1 {
+		// 只有一个码长码时解码端读完全部18个码长，之后每个码长都不消耗比特
+		codeLengths = make([]int, len(codeLengthCodeOrder))
+		codeLengths[lengthCode.used[0]] = 1
+	} else {
+		for codeLengths[codeLengthCodeOrder[numCodes-1]] == 0 {
+			numCodes--
+		}
+	}
+
+	// HSKIP为0，从第一个码长码开始写
+	bw.writeBits(0, 2)
+	for _, symbol := range codeLengthCodeOrder[:numCodes] {
+		static := staticCodeLengthCodes[codeLengths[symbol]]
+		bw.writeBits(static.code, static.bits)
+	}
+
+	for _, t := range tokens {
+		lengthCode.writeSymbol(bw, t.code)
+		if t.code == repeatZeroCode {
+			bw.writeBits(t.extra, 3)
+		}
+	}
+}
+
+type huffmanNode struct {
+	count  int
+	symbol int
+	left   *huffmanNode
+	right  *huffmanNode
+}
+
+type nodeHeap []*huffmanNode
+
+func (h nodeHeap) Len() int { return len(h) }
+func (h nodeHeap) Less(i, j int) bool {
+	if h[i].count != h[j].count {
+		return h[i].count < h[j].count
+	}
+	return h[i].symbol < h[j].symbol
+}
+func (h nodeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *nodeHeap) Push(x any)   { *h = append(*h, x.(*huffmanNode)) }
+func (h *nodeHeap) Pop() any {
+	old := *h
+	n := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return n
+}
+
+// huffmanLengths 计算不超过limit的哈夫曼码长；只有一个符号时码长为0
+// 超长时提高低频符号的计数下限后重建
+func huffmanLengths(histogram []int, limit int) []int {
+	lengths := make([]int, len(histogram))
+
+	used := 0
+	for _, n := range histogram {
+		if n > 0 {
+			used++
+		}
+	}
+	if used <= 1 {
+		return lengths
+	}
+
+	for floor := 1; ; floor *= 2 {
+		h := make(nodeHeap, 0, used)
+		for symbol, n := range histogram {
+			if n > 0 {
+				h = append(h, &huffmanNode{count: max(n, floor), symbol: symbol})
+			}
+		}
+		heap.Init(&h)
+		next := len(histogram)
+		for h.Len() > 1 {
+			a := heap.Pop(&h).(*huffmanNode)
+			b := heap.Pop(&h).(*huffmanNode)
+			heap.Push(&h, &huffmanNode{count: a.count + b.count, symbol: next, left: a, right: b})
+			next++
+		}
+
+		for i := range lengths {
+			lengths[i] = 0
+		}
+		if assignLengths(h[0], 0, lengths) <= limit {
+			return lengths
+		}
+	}
+}
+
+func assignLengths(n *huffmanNode, depth int, lengths []int) int {
+	if n.left == nil {
+		lengths[n.symbol] = depth
+		return depth
+	}
+	return max(assignLengths(n.left, depth+1, lengths), assignLengths(n.right, depth+1, lengths))
+}
+
+// canonicalCodes 按(码长, 符号)顺序分配规范码并按位反转
+func canonicalCodes(lengths []int) []uint32 {
+	symbols := make([]int, 0, len(lengths))
+	for symbol, l := range lengths {
+		if l > 0 {
+			symbols = append(symbols, symbol)
+		}
+	}
+	sort.Slice(symbols, func(i, j int) bool {
+		if lengths[symbols[i]] != lengths[symbols[j]] {
+			return lengths[symbols[i]] < lengths[symbols[j]]
+		}
+		return symbols[i] < symbols[j]
+	})
+
+	codes := make([]uint32, len(lengths))
+	code, prevLen := uint32(0), 0
+	for i, symbol := range symbols {
+		l := lengths[symbol]
+		if i > 0 {
+			code = (code + 1) << uint(l-prevLen)
+		}
+		prevLen = l
+		codes[symbol] = reverseBits(code, l)
+	}
+	return codes
+}
+
+func reverseBits(v uint32, n int) uint32 {
+	var r uint32
+	for i := 0; i < n; i++ {
+		r = r<<1 | (v>>uint(i))&1
+	}
+	return r
+}
@@ -0,0 +1,81 @@
+package brotli
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+// 用github.com/andybalholm/brotli这个独立的解码器校验编码结果
+func decode(t *testing.T, data []byte) []byte {
+	t.Helper()
+	out, err := io.ReadAll(brotli.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	return out
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	random := make([]byte, 100000)
+	rng.Read(random)
+	// 只用到少数几个字节值，字面量走简单前缀码
+	few := make([]byte, 5000)
+	for i := range few {
+		few[i] = "abcd"[rng.Intn(4)]
+	}
+	// 所有字节值都出现的文本
+	var all []byte
+	for i := 0; i < 20; i++ {
+		all = append(all, random[:256]...)
+		for b := 0; b < 256; b++ {
+			all = append(all, byte(b))
+		}
+	}
+	svg := strings.Repeat(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 80 80"><rect width="80" height="80" fill="#f0a"/><text x="40" y="52">AB</text></svg>`, 50)
+
+	cases := map[string][]byte{
+		"empty":     nil,
+		"single":    []byte("x"),
+		"short":     []byte("hello"),
+		"run":       bytes.Repeat([]byte{'a'}, 100000),
+		"two":       bytes.Repeat([]byte("ab"), 3),
+		"few":       few,
+		"all bytes": all,
+		"random":    random,
+		"svg":       []byte(svg),
+	}
+	for name, data := range cases {
+		t.Run(name, func(t *testing.T) {
+			encoded := Encode(data)
+			if got := decode(t, encoded); !bytes.Equal(got, data) {
+				t.Fatalf("round trip mismatch: got %d bytes, want %d", len(got), len(data))
+			}
+		})
+	}
+
+	if encoded := Encode([]byte(svg)); len(encoded) > len(svg)/20 {
+		t.Errorf("expected repetitive SVG to compress well, got %d of %d bytes", len(encoded), len(svg))
+	}
+}
+
+func TestEncodeMultipleMetaBlocks(t *testing.T) {
+	defer func(n int) { metaBlockBytes = n }(metaBlockBytes)
+	metaBlockBytes = 1000
+
+	// 匹配可以引用之前元块中的数据，但不会跨越元块边界
+	rng := rand.New(rand.NewSource(2))
+	chunk := make([]byte, 700)
+	rng.Read(chunk)
+	data := bytes.Repeat(chunk, 10)
+	data = append(data, []byte(strings.Repeat("tail", 100))...)
+
+	if got := decode(t, Encode(data)); !bytes.Equal(got, data) {
+		t.Fatalf("round trip mismatch across meta-blocks: got %d bytes, want %d", len(got), len(data))
+	}
+}
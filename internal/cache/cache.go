@@ -1,6 +1,7 @@
 package cache
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
@@ -18,17 +19,67 @@ import (
 )
 
 type Metadata struct {
+	// Version 为写入时的元数据结构版本，见MetadataVersion
+	Version        int               `json:"version,omitempty"`
 	CreatedAt      time.Time         `json:"created_at"`
 	LastAccessedAt time.Time         `json:"last_accessed_at"`
 	Headers        map[string]string `json:"headers"`
 	StatusCode     int               `json:"status_code"`
 	Size           int64             `json:"size"`
+	Upstream       string            `json:"upstream,omitempty"`
+	SourceKey      string            `json:"source_key,omitempty"`
+	Hash           string            `json:"hash,omitempty"`
+	Path           string            `json:"path,omitempty"`
+	Params         map[string]string `json:"params,omitempty"`
+	Hits           int64             `json:"hits,omitempty"`
+	// RevalidationFailures 为连续失败的重新验证次数，Suspect表示失败次数已达到阈值，不应再优先返回过期内容
+	RevalidationFailures int  `json:"revalidation_failures,omitempty"`
+	Suspect              bool `json:"suspect,omitempty"`
+	// ETag 为200响应按内容生成的强ETag，用于客户端的条件请求和响应，不发给上游
+	// 不同实例、从不同上游取得的相同内容得到相同的ETag；上游的ETag保存在Headers中，只用于向上游的条件请求
+	ETag string `json:"etag,omitempty"`
+}
+
+// ResponseETag 返回发给客户端的ETag，即按内容生成的ETag
+// 早于内容ETag写入、只有上游ETag的条目退回使用上游的ETag，刷新后即改为内容ETag
+func (m *Metadata) ResponseETag() string {
+	if m.ETag != "" {
+		return m.ETag
+	}
+	return m.Headers["ETag"]
+}
+
+// setContentETag 为200响应用内容的SHA-256生成强ETag
+func (m *Metadata) setContentETag(sum []byte) {
+	m.ETag = ""
+	if m.StatusCode == http.StatusOK {
+		m.ETag = sumETag(sum)
+	}
+}
+
+// ContentETag 返回按内容的SHA-256生成的强ETag，与缓存条目的ETag算法相同
+func ContentETag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return sumETag(sum[:])
+}
+
+func sumETag(sum []byte) string {
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// Revalidated 在上游确认内容未变化（304）后重置创建时间，并清除重新验证失败的记录
+func (m *Metadata) Revalidated(now time.Time) {
+	m.CreatedAt = now
+	m.RevalidationFailures = 0
+	m.Suspect = false
 }
 
 type CacheEntry struct {
 	Key      string
 	FilePath string
 	Metadata Metadata
+	// Seq 为条目最近一次写入或更新的变更序号，只保存在内存中，见ChangedSince
+	Seq uint64 `json:"-"`
 }
 
 type Cache struct {
@@ -39,6 +90,17 @@ type Cache struct {
 	index         map[string]*CacheEntry
 	accessList    []string
 	currentBytes  int64
+	hashIndex     map[string]map[string]struct{}
+	stats         counters
+	tombstones    tombstones
+	memory        *memoryTier
+	store         *indexStore
+	// keyScheme 为缓存键的派生方式，与索引中记录的一致
+	keyScheme     string
+	// indexErr 为启动时加载索引的错误，非nil时缓存以空索引运行且不再就绪
+	indexErr      error
+	// seq 为最近分配的变更序号
+	seq           uint64
 }
 
 func New(dir string, ttl time.Duration, maxBytes int64) (*Cache, error) {
@@ -52,15 +114,27 @@ func New(dir string, ttl time.Duration, maxBytes int64) (*Cache, error) {
 		maxBytes:   maxBytes,
 		index:      make(map[string]*CacheEntry),
 		accessList: make([]string, 0),
+		hashIndex:  make(map[string]map[string]struct{}),
+		stats:      counters{startedAt: time.Now()},
+		tombstones: newTombstones(DefaultTombstoneTTL),
+		memory:     newMemoryTier(),
+		store:      openIndexStore(dir),
+		keyScheme:  KeySchemeSHA256,
 	}
 
 	if err := c.loadIndex(); err != nil {
 		log.Warn("failed to load cache index, starting fresh", "error", err)
+		c.indexErr = err
 	}
 
 	return c, nil
 }
 
+// Dir 返回缓存目录，其他需要跨重启保存的少量状态也放在这里
+func (c *Cache) Dir() string {
+	return c.dir
+}
+
 func (c *Cache) GenerateKey(path string, query map[string]string) string {
 	keys := make([]string, 0, len(query))
 	for k := range query {
@@ -74,11 +148,21 @@ func (c *Cache) GenerateKey(path string, query map[string]string) string {
 	}
 
 	fullURL := strings.Join(parts, "?")
-	hash := sha256.Sum256([]byte(fullURL))
-	return hex.EncodeToString(hash[:])
+	return deriveKey(c.KeyScheme(), fullURL)
 }
 
 func (c *Cache) Get(key string) (*CacheEntry, bool) {
+	entry, valid := c.Peek(key)
+	if valid {
+		c.stats.hits.Add(1)
+	} else {
+		c.stats.misses.Add(1)
+	}
+	return entry, valid
+}
+
+// Peek 与Get相同，但不计入命中统计
+func (c *Cache) Peek(key string) (*CacheEntry, bool) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
@@ -94,27 +178,87 @@ func (c *Cache) Get(key string) (*CacheEntry, bool) {
 	return entry, true
 }
 
+// SetTTL 修改缓存有效期，用于配置热加载；已有条目按新的有效期判断是否过期
+func (c *Cache) SetTTL(ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ttl = ttl
+}
+
 func (c *Cache) Set(key string, data []byte, metadata Metadata) error {
+	if c.tombstones.has(key, metadata.Hash) {
+		return ErrPurged
+	}
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	filePath := filepath.Join(c.dir, key)
-	metaPath := filepath.Join(c.dir, key+".meta")
 
+	// 数据文件可能是与其他条目共用的硬链接，先删除再写，不改动共用的内容
+	os.Remove(filePath)
 	if err := os.WriteFile(filePath, data, 0644); err != nil {
 		return fmt.Errorf("failed to write cache file: %w", err)
 	}
 
 	metadata.Size = int64(len(data))
-	metaBytes, err := json.Marshal(metadata)
-	if err != nil {
-		return fmt.Errorf("failed to marshal metadata: %w", err)
+	sum := sha256.Sum256(data)
+	metadata.setContentETag(sum[:])
+	if err := c.saveMetadata(key, &metadata); err != nil {
+		return fmt.Errorf("failed to write metadata file: %w", err)
 	}
 
-	if err := os.WriteFile(metaPath, metaBytes, 0644); err != nil {
+	c.memory.replace(key, data)
+	c.addLocked(key, filePath, metadata)
+
+	return nil
+}
+
+// Link 让key与sourceKey共用同一个数据文件（硬链接），key只写入自己的元数据
+// 文件系统不支持硬链接时退回复制一份数据
+func (c *Cache) Link(key, sourceKey string, metadata Metadata) error {
+	if c.tombstones.has(key, metadata.Hash) {
+		return ErrPurged
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	source, exists := c.index[sourceKey]
+	if !exists {
+		return fmt.Errorf("source entry not found")
+	}
+
+	filePath := filepath.Join(c.dir, key)
+	os.Remove(filePath)
+	if err := os.Link(source.FilePath, filePath); err != nil {
+		data, readErr := os.ReadFile(source.FilePath)
+		if readErr != nil {
+			return fmt.Errorf("failed to link cache file: %w", err)
+		}
+		if err := os.WriteFile(filePath, data, 0644); err != nil {
+			return fmt.Errorf("failed to write cache file: %w", err)
+		}
+	}
+
+	metadata.Size = source.Metadata.Size
+	// 内容与源条目相同，沿用源条目发给客户端的ETag
+	metadata.ETag = ""
+	if metadata.StatusCode == http.StatusOK {
+		metadata.ETag = source.Metadata.ResponseETag()
+	}
+	if err := c.saveMetadata(key, &metadata); err != nil {
 		return fmt.Errorf("failed to write metadata file: %w", err)
 	}
 
+	c.memory.remove(key)
+	c.addLocked(key, filePath, metadata)
+	return nil
+}
+
+// addLocked 将已写入磁盘的条目加入索引，必要时触发淘汰
+func (c *Cache) addLocked(key, filePath string, metadata Metadata) {
+	before := c.currentBytes
 	entry := &CacheEntry{
 		Key:      key,
 		FilePath: filePath,
@@ -123,19 +267,19 @@ func (c *Cache) Set(key string, data []byte, metadata Metadata) error {
 
 	if existing, exists := c.index[key]; exists {
 		c.currentBytes -= existing.Metadata.Size
+		c.unindexHashLocked(existing)
 	}
 
+	c.nextSeqLocked(entry)
 	c.index[key] = entry
+	c.indexHashLocked(entry)
 	c.currentBytes += metadata.Size
+	c.stats.written.Add(metadata.Size)
 	c.updateAccessList(key)
+	c.putIndexLocked(entry)
 
-	c.evictIfNeeded()
-
-	if err := c.saveIndex(); err != nil {
-		log.Error("failed to save cache index", "error", err)
-	}
-
-	return nil
+	// MAX_CACHE_BYTES调小后占用可能远超上限，写入只淘汰自己新增的部分，超出的存量由EvictOverLimit在后台逐步淘汰
+	c.evictLocked(max(c.maxBytes, before), 0, true)
 }
 
 func (c *Cache) ReadData(key string) ([]byte, error) {
@@ -148,20 +292,44 @@ func (c *Cache) ReadData(key string) ([]byte, error) {
 	}
 
 	entry.Metadata.LastAccessedAt = time.Now()
+	entry.Metadata.Hits++
 	c.updateAccessList(key)
 
-	if err := c.saveMetadata(key, entry.Metadata); err != nil {
+	// 内存层命中时不触碰磁盘，访问时间在索引日志压缩或Close时持久化
+	if data, ok := c.memory.get(key); ok {
+		tierReads.Inc("memory")
+		return data, nil
+	}
+
+	if err := c.saveMetadata(key, &entry.Metadata); err != nil {
 		log.Warn("failed to update metadata", "error", err)
 	}
+	c.putIndexLocked(entry)
 
 	data, err := os.ReadFile(entry.FilePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read cache file: %w", err)
 	}
+	tierReads.Inc("disk")
+
+	if c.memory.enabled() {
+		c.memory.put(key, data)
+	}
 
 	return data, nil
 }
 
+// Open 打开条目的数据文件用于只读检查，不更新访问时间和命中次数
+func (c *Cache) Open(key string) (*os.File, error) {
+	c.mu.RLock()
+	entry, exists := c.index[key]
+	c.mu.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("cache entry not found")
+	}
+	return os.Open(entry.FilePath)
+}
+
 func (c *Cache) UpdateMetadata(key string, metadata Metadata) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -171,11 +339,40 @@ func (c *Cache) UpdateMetadata(key string, metadata Metadata) error {
 		return fmt.Errorf("cache entry not found")
 	}
 
+	err := c.saveMetadata(key, &metadata)
+	entry.Metadata = metadata
+	c.nextSeqLocked(entry)
+	c.putIndexLocked(entry)
+	return err
+}
+
+// RecordRevalidationFailure 记录条目的一次重新验证失败，连续失败达到limit次时将条目标记为可疑
+// limit为0时只计数不标记；返回更新后的失败次数和是否可疑，条目不存在时返回0和false
+func (c *Cache) RecordRevalidationFailure(key string, limit int) (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, exists := c.index[key]
+	if !exists {
+		return 0, false
+	}
+
+	metadata := entry.Metadata
+	metadata.RevalidationFailures++
+	if limit > 0 && metadata.RevalidationFailures >= limit {
+		metadata.Suspect = true
+	}
+	if err := c.saveMetadata(key, &metadata); err != nil {
+		log.Warn("failed to save cache metadata", "key", key, "error", err)
+	}
 	entry.Metadata = metadata
-	return c.saveMetadata(key, metadata)
+	c.putIndexLocked(entry)
+	return metadata.RevalidationFailures, metadata.Suspect
 }
 
-func (c *Cache) saveMetadata(key string, metadata Metadata) error {
+// saveMetadata 写入条目的.meta文件，并将metadata标记为当前结构版本
+func (c *Cache) saveMetadata(key string, metadata *Metadata) error {
+	metadata.Version = MetadataVersion
 	metaPath := filepath.Join(c.dir, key+".meta")
 	metaBytes, err := json.Marshal(metadata)
 	if err != nil {
@@ -194,8 +391,10 @@ func (c *Cache) updateAccessList(key string) {
 	c.accessList = append(c.accessList, key)
 }
 
-func (c *Cache) evictIfNeeded() {
-	for c.currentBytes > c.maxBytes && len(c.accessList) > 0 {
+// evictLocked 按LRU顺序淘汰条目直到占用不超过limit，maxEntries大于0时最多淘汰这么多个，返回淘汰的条目数
+func (c *Cache) evictLocked(limit int64, maxEntries int, logEach bool) int {
+	evicted := 0
+	for c.currentBytes > limit && len(c.accessList) > 0 && (maxEntries <= 0 || evicted < maxEntries) {
 		lruKey := c.accessList[0]
 		c.accessList = c.accessList[1:]
 
@@ -209,56 +408,126 @@ func (c *Cache) evictIfNeeded() {
 
 		c.currentBytes -= entry.Metadata.Size
 		delete(c.index, lruKey)
-
-		log.Info("evicted cache entry", "key", lruKey, "size", entry.Metadata.Size)
+		c.unindexHashLocked(entry)
+		c.memory.remove(lruKey)
+		c.deleteIndexLocked(lruKey)
+		c.stats.evictions.Add(1)
+		evicted++
+
+		if logEach {
+			log.Info("evicted cache entry", "key", lruKey, "size", entry.Metadata.Size)
+		}
 	}
+	return evicted
 }
 
+// loadIndex 加载索引；索引损坏时从.meta文件重建，不因此丢弃整个缓存
+// 正常加载的索引再与目录中的文件核对，条目大小以实际文件为准，不信任索引中记录的数字
 func (c *Cache) loadIndex() error {
-	indexPath := filepath.Join(c.dir, "index.json")
-	data, err := os.ReadFile(indexPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
+	entries, needCompact, err := c.store.load()
+	rebuilt := err != nil
+	if rebuilt {
+		log.Warn("cache index is unreadable, rebuilding from metadata files", "error", err)
+		var stats RebuildStats
+		entries, stats, err = scanMetadata(c.dir)
+		if err != nil {
+			return err
 		}
-		return err
+		log.Info("rebuilt cache index", "entries", stats.Entries, "bytes", stats.Bytes, "skipped", stats.Skipped)
+		needCompact = true
 	}
 
-	var index struct {
-		Entries    map[string]*CacheEntry `json:"entries"`
-		AccessList []string               `json:"access_list"`
+	c.keyScheme = c.store.keyScheme
+	if c.keyScheme == "" {
+		c.keyScheme = schemeForKeys(entries)
+		c.store.keyScheme = c.keyScheme
 	}
 
-	if err := json.Unmarshal(data, &index); err != nil {
-		return err
+	// 重建的索引本身就来自目录扫描，无需再核对
+	if !rebuilt {
+		stats, err := reconcile(c.dir, entries, c.ValidKey, time.Now())
+		if err != nil {
+			return err
+		}
+		if stats.changed() {
+			log.Info("reconciled cache index with disk", "missing", stats.Missing, "adopted", stats.Adopted, "removed", stats.Removed, "resized", stats.Resized)
+			needCompact = true
+		}
+	}
+	if migrated := migrateEntries(entries); migrated > 0 {
+		log.Info("migrated cache metadata", "entries", migrated, "version", MetadataVersion)
+		needCompact = true
 	}
 
-	c.index = index.Entries
-	c.accessList = index.AccessList
+	c.index = entries
+	c.accessList = accessOrder(entries)
+	c.numberEntries()
 
 	for _, entry := range c.index {
 		c.currentBytes += entry.Metadata.Size
+		c.indexHashLocked(entry)
 	}
 
+	if needCompact {
+		return c.store.compact(c.index, c.accessList)
+	}
 	return nil
 }
 
-func (c *Cache) saveIndex() error {
-	indexPath := filepath.Join(c.dir, "index.json")
-	index := struct {
-		Entries    map[string]*CacheEntry `json:"entries"`
-		AccessList []string               `json:"access_list"`
-	}{
-		Entries:    c.index,
-		AccessList: c.accessList,
+// putIndexLocked 在索引日志中记录条目的写入或更新
+func (c *Cache) putIndexLocked(entry *CacheEntry) {
+	if err := c.store.put(entry); err != nil {
+		log.Error("failed to save cache index", "error", err)
 	}
+	c.compactIfNeededLocked()
+}
 
-	data, err := json.Marshal(index)
-	if err != nil {
+func (c *Cache) deleteIndexLocked(key string) {
+	if err := c.store.delete(key); err != nil {
+		log.Error("failed to save cache index", "error", err)
+	}
+	c.compactIfNeededLocked()
+}
+
+func (c *Cache) compactIfNeededLocked() {
+	if !c.store.shouldCompact(len(c.index)) {
+		return
+	}
+	if err := c.store.compact(c.index, c.accessList); err != nil {
+		log.Error("failed to compact cache index", "error", err)
+	}
+}
+
+// Close 压缩索引日志并关闭，保存只在内存层命中期间更新的访问时间
+func (c *Cache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.store.compact(c.index, c.accessList); err != nil {
 		return err
 	}
+	return c.store.close()
+}
 
-	return os.WriteFile(indexPath, data, 0644)
+// Ready 检查缓存能否正常工作：启动时索引已成功加载，且缓存目录仍然可写
+func (c *Cache) Ready() error {
+	if c.indexErr != nil {
+		return fmt.Errorf("cache index not loaded: %w", c.indexErr)
+	}
+
+	f, err := os.CreateTemp(c.dir, ".ready-*")
+	if err != nil {
+		return fmt.Errorf("cache directory not writable: %w", err)
+	}
+	_, err = f.Write([]byte("ok"))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	os.Remove(f.Name())
+	if err != nil {
+		return fmt.Errorf("cache directory not writable: %w", err)
+	}
+	return nil
 }
 
 func (c *Cache) CheckConditional(key string, req *http.Request) bool {
@@ -274,9 +543,10 @@ func (c *Cache) CheckConditional(key string, req *http.Request) bool {
 		return false
 	}
 
+	// 带有If-None-Match时忽略If-Modified-Since（RFC 9110），Last-Modified可能因实例取自不同上游而不同
 	ifNoneMatch := req.Header.Get("If-None-Match")
-	if ifNoneMatch != "" && entry.Metadata.Headers["ETag"] == ifNoneMatch {
-		return true
+	if ifNoneMatch != "" {
+		return entry.Metadata.ResponseETag() == ifNoneMatch
 	}
 
 	ifModifiedSince := req.Header.Get("If-Modified-Since")
@@ -309,7 +579,9 @@ func (c *Cache) GetMetadata(key string) (*Metadata, error) {
 	return &metadata, nil
 }
 
-func (c *Cache) WriteResponse(w http.ResponseWriter, key string, ttlSeconds int) error {
+// WriteResponse 写出缓存条目；200条目经http.ServeContent返回，支持Range、If-Range和多段请求（206）
+// r为nil或条目不是200时总是写出完整内容和原状态码
+func (c *Cache) WriteResponse(w http.ResponseWriter, r *http.Request, key string, ttlSeconds int) error {
 	data, err := c.ReadData(key)
 	if err != nil {
 		return err
@@ -321,20 +593,44 @@ func (c *Cache) WriteResponse(w http.ResponseWriter, key string, ttlSeconds int)
 	}
 
 	for k, v := range metadata.Headers {
-		w.Header().Set(k, v)
+		if k != "ETag" {
+			w.Header().Set(k, v)
+		}
+	}
+	if etag := metadata.ResponseETag(); etag != "" {
+		w.Header().Set("ETag", etag)
 	}
 
 	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", ttlSeconds))
+	if r != nil && metadata.StatusCode == http.StatusOK {
+		// Content-Length由ServeContent按实际返回的范围设置；If-Range按ETag或Last-Modified判断
+		w.Header().Del("Content-Length")
+		var modTime time.Time
+		if lastModified := metadata.Headers["Last-Modified"]; lastModified != "" {
+			modTime, _ = http.ParseTime(lastModified)
+		}
+		http.ServeContent(w, r, "", modTime, bytes.NewReader(data))
+		return nil
+	}
 	w.WriteHeader(metadata.StatusCode)
 
 	_, err = w.Write(data)
 	return err
 }
 
+// MaxHeaderValueBytes 单个响应头写入元数据的最大长度，超出的值不保存
+const MaxHeaderValueBytes = 4096
+
+// ExtractHeaders 提取需要随缓存条目保存的响应头；异常长的值（如镜像上游伪造的ETag或Location）被丢弃
 func ExtractHeaders(resp *http.Response) map[string]string {
 	headers := make(map[string]string)
-	for _, key := range []string{"Content-Type", "ETag", "Last-Modified", "Cache-Control", "Content-Length"} {
-		if val := resp.Header.Get(key); val != "" {
+	for _, key := range []string{"Content-Type", "ETag", "Last-Modified", "Cache-Control", "Content-Length", "Retry-After", "Location"} {
+		val := resp.Header.Get(key)
+		if len(val) > MaxHeaderValueBytes {
+			log.Warn("dropped oversized response header", "header", key, "bytes", len(val))
+			continue
+		}
+		if val != "" {
 			headers[key] = val
 		}
 	}
@@ -1,11 +1,18 @@
 package cache
 
 import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
+
+	"gravatar-proxy/internal/blake3"
 )
 
 func TestGenerateKey(t *testing.T) {
@@ -236,9 +243,15 @@ func TestCheckConditional(t *testing.T) {
 		{
 			name:     "matching ETag",
 			header:   "If-None-Match",
-			value:    etag,
+			value:    ContentETag(data),
 			expected: true,
 		},
+		{
+			name:     "upstream ETag",
+			header:   "If-None-Match",
+			value:    etag,
+			expected: false,
+		},
 		{
 			name:     "non-matching ETag",
 			header:   "If-None-Match",
@@ -264,6 +277,14 @@ func TestCheckConditional(t *testing.T) {
 			}
 		})
 	}
+
+	// If-None-Match不匹配时不再看If-Modified-Since
+	req := httptest.NewRequest("GET", "/test", nil)
+	req.Header.Set("If-None-Match", `"xyz789"`)
+	req.Header.Set("If-Modified-Since", lastModified)
+	if c.CheckConditional(key, req) {
+		t.Error("expected If-Modified-Since to be ignored when If-None-Match is present")
+	}
 }
 
 func TestCachePersistence(t *testing.T) {
@@ -327,3 +348,1115 @@ func TestNew(t *testing.T) {
 		t.Error("expected cache directory to be created")
 	}
 }
+
+func TestNegativeCache(t *testing.T) {
+	n := NewNegativeCache(100 * time.Millisecond)
+
+	n.Set("missing", "abc", 404, map[string]string{"Content-Type": "text/html"}, []byte("not found"))
+
+	entry, ok := n.Get("missing")
+	if !ok {
+		t.Fatal("expected negative entry to be present")
+	}
+	if entry.StatusCode != 404 {
+		t.Errorf("expected status 404, got %d", entry.StatusCode)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	if _, ok := n.Get("missing"); ok {
+		t.Error("expected negative entry to expire after TTL")
+	}
+	if n.Len() != 0 {
+		t.Errorf("expected expired entry to be removed, got %d entries", n.Len())
+	}
+
+	disabled := NewNegativeCache(0)
+	disabled.Set("missing", "abc", 404, nil, nil)
+	if _, ok := disabled.Get("missing"); ok {
+		t.Error("expected disabled negative cache to never return entries")
+	}
+}
+
+func TestPurgeHash(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	c1, err := New(tmpDir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+
+	for key, hash := range map[string]string{"s80": "abc", "s200": "abc", "other": "def"} {
+		metadata := Metadata{CreatedAt: time.Now(), StatusCode: 200, Hash: hash}
+		if err := c1.Set(key, []byte(key), metadata); err != nil {
+			t.Fatalf("failed to set cache: %v", err)
+		}
+	}
+
+	// 反向索引需要在重新加载后恢复
+	c2, err := New(tmpDir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatalf("failed to reload cache: %v", err)
+	}
+
+	if keys := c2.KeysForHash("abc"); len(keys) != 2 {
+		t.Fatalf("expected 2 keys for hash, got %v", keys)
+	}
+	if purged := c2.PurgeHash("abc"); purged != 2 {
+		t.Errorf("expected 2 entries purged, got %d", purged)
+	}
+	if _, exists := c2.Get("s80"); exists {
+		t.Error("expected purged entry to be gone")
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "s200")); !os.IsNotExist(err) {
+		t.Error("expected purged cache file to be removed")
+	}
+	if _, valid := c2.Get("other"); !valid {
+		t.Error("expected entries of other hashes to be kept")
+	}
+	if c2.currentBytes != int64(len("other")) {
+		t.Errorf("expected size accounting to drop purged entries, got %d", c2.currentBytes)
+	}
+}
+
+func TestStats(t *testing.T) {
+	c, err := New(t.TempDir(), time.Hour, 10)
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+
+	oldest := time.Now().Add(-time.Minute)
+	c.Set("old", []byte("12345"), Metadata{CreatedAt: oldest, StatusCode: 200})
+	c.Set("new", []byte("12345"), Metadata{CreatedAt: time.Now(), StatusCode: 200})
+	// 超出10字节上限，淘汰最早写入的条目
+	c.Set("newer", []byte("12345"), Metadata{CreatedAt: time.Now(), StatusCode: 200})
+
+	c.Get("new")
+	c.Get("old")
+	c.Peek("new")
+
+	s := c.Stats()
+	if s.Entries != 2 || s.Bytes != 10 {
+		t.Errorf("expected 2 entries and 10 bytes, got %d and %d", s.Entries, s.Bytes)
+	}
+	if s.Hits != 1 || s.Misses != 1 || s.HitRatio != 0.5 {
+		t.Errorf("expected 1 hit and 1 miss, got %d/%d (%v)", s.Hits, s.Misses, s.HitRatio)
+	}
+	if s.Evictions != 1 {
+		t.Errorf("expected 1 eviction, got %d", s.Evictions)
+	}
+	if s.OldestEntry == nil || s.NewestEntry == nil || !s.OldestEntry.Before(*s.NewestEntry) && !s.OldestEntry.Equal(*s.NewestEntry) {
+		t.Errorf("expected oldest and newest entry times, got %v and %v", s.OldestEntry, s.NewestEntry)
+	}
+}
+
+func TestSummarizeIndex(t *testing.T) {
+	dir := t.TempDir()
+	c, err := New(dir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+
+	oldest := time.Now().Add(-time.Hour).UTC()
+	newest := time.Now().UTC()
+	c.Set("s80", []byte("12345"), Metadata{CreatedAt: oldest, StatusCode: 200, Hash: "abc"})
+	c.Set("s200", []byte("123"), Metadata{CreatedAt: newest, StatusCode: 200, Hash: "abc"})
+	c.Set("missing", []byte("1"), Metadata{CreatedAt: newest, StatusCode: 404})
+	c.Set("gone", []byte("1"), Metadata{CreatedAt: newest, StatusCode: 200, Hash: "def"})
+	c.Delete("gone")
+
+	logBefore, _ := os.ReadFile(filepath.Join(dir, "index.log"))
+	summary, err := SummarizeIndex(dir)
+	if err != nil {
+		t.Fatalf("failed to summarize index: %v", err)
+	}
+
+	if summary.KeyScheme != KeySchemeSHA256 {
+		t.Errorf("expected key scheme %s, got %s", KeySchemeSHA256, summary.KeyScheme)
+	}
+	if summary.Entries != 3 || summary.Bytes != 9 {
+		t.Errorf("expected 3 entries of 9 bytes, got %d entries of %d bytes", summary.Entries, summary.Bytes)
+	}
+	if summary.Hashes != 1 || summary.Unhashed != 1 {
+		t.Errorf("expected 1 hash and 1 unhashed entry, got %d and %d", summary.Hashes, summary.Unhashed)
+	}
+	if summary.StatusCodes[200] != 2 || summary.StatusCodes[404] != 1 {
+		t.Errorf("expected 2 entries with 200 and 1 with 404, got %v", summary.StatusCodes)
+	}
+	if summary.Versions[MetadataVersion] != 3 {
+		t.Errorf("expected 3 entries at metadata version %d, got %v", MetadataVersion, summary.Versions)
+	}
+	if summary.Oldest == nil || !summary.Oldest.Equal(oldest) || summary.Newest == nil || !summary.Newest.Equal(newest) {
+		t.Errorf("expected oldest %v and newest %v, got %v and %v", oldest, newest, summary.Oldest, summary.Newest)
+	}
+	// 删除记录也留在日志中，记录数多于条目数
+	if summary.Records <= summary.Entries || summary.LogBytes != int64(len(logBefore)) {
+		t.Errorf("expected %d log bytes and more records than entries, got %d bytes and %d records", len(logBefore), summary.LogBytes, summary.Records)
+	}
+	dirEntries, _ := os.ReadDir(dir)
+	if summary.Files != len(dirEntries) || summary.FileBytes < summary.Bytes {
+		t.Errorf("expected %d files holding at least %d bytes, got %d files of %d bytes", len(dirEntries), summary.Bytes, summary.Files, summary.FileBytes)
+	}
+	if logAfter, _ := os.ReadFile(filepath.Join(dir, "index.log")); !bytes.Equal(logBefore, logAfter) {
+		t.Error("expected summarizing not to modify the index log")
+	}
+
+	if _, err := SummarizeIndex(filepath.Join(dir, "missing")); err == nil {
+		t.Error("expected an error for a missing cache directory")
+	}
+}
+
+func TestPurgeTombstone(t *testing.T) {
+	c, err := New(t.TempDir(), time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+
+	metadata := Metadata{CreatedAt: time.Now(), StatusCode: 200, Hash: "abc"}
+	c.Set("s80", []byte("data"), metadata)
+	c.PurgeHash("abc")
+
+	// 清除前已发出的请求在墓碑有效期内不能写回
+	if err := c.Set("s200", []byte("data"), metadata); err != ErrPurged {
+		t.Errorf("expected ErrPurged for a purged hash, got %v", err)
+	}
+	if err := c.Set("other", []byte("data"), Metadata{CreatedAt: time.Now(), Hash: "def"}); err != nil {
+		t.Errorf("expected other hashes to be writable, got %v", err)
+	}
+
+	c.Delete("other")
+	if !c.Tombstoned("other", "") {
+		t.Error("expected deleted key to be tombstoned")
+	}
+	if s := c.Stats(); s.Tombstones != 2 {
+		t.Errorf("expected 2 tombstones, got %d", s.Tombstones)
+	}
+
+	// 精确的键和哈希墓碑按map查找，不进入逐个比较的前缀列表
+	for i := range 1000 {
+		c.Delete(fmt.Sprintf("k%d", i))
+	}
+	c.PurgePrefix("fe")
+	if len(c.tombstones.prefixes) != 1 || len(c.tombstones.keys) != 1001 {
+		t.Errorf("expected 1 prefix and 1001 key tombstones, got %d and %d", len(c.tombstones.prefixes), len(c.tombstones.keys))
+	}
+	if !c.Tombstoned("k999", "") || !c.Tombstoned("new", "fe01") || c.Tombstoned("new", "ff01") {
+		t.Error("expected key and prefix tombstones to match exactly their keys and hashes")
+	}
+
+	c.SetTombstoneTTL(0)
+	c.PurgeHash("ghi")
+	if err := c.Set("ghi", []byte("data"), Metadata{CreatedAt: time.Now(), Hash: "ghi"}); err != nil {
+		t.Errorf("expected writes to be allowed without tombstones, got %v", err)
+	}
+}
+
+func TestMemoryTier(t *testing.T) {
+	tmpDir := t.TempDir()
+	c, err := New(tmpDir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	c.SetMemoryLimit(10)
+
+	for _, key := range []string{"a", "b", "c"} {
+		c.Set(key, []byte("abcd"), Metadata{CreatedAt: time.Now(), StatusCode: 200})
+	}
+
+	// 首次读取从磁盘提升到内存，之后不再读取文件
+	c.ReadData("a")
+	os.Remove(filepath.Join(tmpDir, "a"))
+	data, err := c.ReadData("a")
+	if err != nil || string(data) != "abcd" {
+		t.Fatalf("expected memory tier to serve a promoted entry, got %q, %v", data, err)
+	}
+
+	// 10字节只能容纳两个条目，a最久未读，被淘汰
+	c.ReadData("b")
+	c.ReadData("c")
+	if _, err := c.ReadData("a"); err == nil {
+		t.Error("expected the least recently read entry to be demoted")
+	}
+
+	s := c.Stats()
+	if s.MemoryEntries != 2 || s.MemoryBytes != 8 {
+		t.Errorf("expected 2 entries and 8 bytes in memory, got %d and %d", s.MemoryEntries, s.MemoryBytes)
+	}
+
+	c.Set("b", []byte("xy"), Metadata{CreatedAt: time.Now(), StatusCode: 200})
+	if data, _ := c.ReadData("b"); string(data) != "xy" {
+		t.Errorf("expected memory copy to be refreshed on write, got %q", data)
+	}
+
+	c.SetMemoryLimit(0)
+	if s := c.Stats(); s.MemoryEntries != 0 {
+		t.Errorf("expected memory tier to be emptied, got %d entries", s.MemoryEntries)
+	}
+}
+
+func TestIndexLog(t *testing.T) {
+	tmpDir := t.TempDir()
+	metadata := Metadata{CreatedAt: time.Now(), LastAccessedAt: time.Now(), StatusCode: 200}
+
+	c1, err := New(tmpDir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	c1.Set("a", []byte("aaa"), metadata)
+	c1.Set("b", []byte("bbb"), metadata)
+	c1.Delete("a")
+
+	// 模拟崩溃时写了一半的记录
+	f, err := os.OpenFile(filepath.Join(tmpDir, "index.log"), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("expected index log to exist: %v", err)
+	}
+	f.WriteString(`{"put":{"Key":"c","Fil`)
+	f.Close()
+
+	c2, err := New(tmpDir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatalf("failed to reopen cache: %v", err)
+	}
+	if _, valid := c2.Get("a"); valid {
+		t.Error("expected deleted entry to stay deleted after reload")
+	}
+	if _, valid := c2.Get("b"); !valid {
+		t.Error("expected entry to survive reload")
+	}
+	if stats := c2.Stats(); stats.Entries != 1 || stats.Bytes != 3 {
+		t.Errorf("expected 1 entry of 3 bytes, got %d entries of %d bytes", stats.Entries, stats.Bytes)
+	}
+	// 只截掉写了一半的末尾记录，之前的记录照常回放，不整体重建（重建会重写出带version的日志）
+	logData, _ := os.ReadFile(filepath.Join(tmpDir, "index.log"))
+	if strings.Contains(string(logData), `"Key":"c"`) || strings.HasPrefix(string(logData), `{"version"`) {
+		t.Errorf("expected only the torn record to be truncated, got %q", logData)
+	}
+
+	c2.Set("d", []byte("ddd"), metadata)
+	if err := c2.Close(); err != nil {
+		t.Fatalf("failed to close cache: %v", err)
+	}
+	c3, err := New(tmpDir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatalf("failed to reopen cache: %v", err)
+	}
+	if _, valid := c3.Get("d"); !valid {
+		t.Error("expected entry written after recovery to survive reload")
+	}
+	c3.Close()
+
+	// 日志中间的记录损坏不是崩溃残留，从.meta文件重建
+	logData, _ = os.ReadFile(filepath.Join(tmpDir, "index.log"))
+	os.WriteFile(filepath.Join(tmpDir, "index.log"), append([]byte("not json\n"), logData...), 0644)
+	c4, err := New(tmpDir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatalf("failed to reopen cache: %v", err)
+	}
+	if stats := c4.Stats(); stats.Entries != 2 {
+		t.Errorf("expected 2 entries rebuilt from metadata, got %d", stats.Entries)
+	}
+}
+
+func TestLegacyIndexImport(t *testing.T) {
+	tmpDir := t.TempDir()
+	os.WriteFile(filepath.Join(tmpDir, "legacy"), []byte("old"), 0644)
+	index := `{"entries":{"legacy":{"Key":"legacy","FilePath":"` + filepath.Join(tmpDir, "legacy") +
+		`","Metadata":{"created_at":"` + time.Now().Format(time.RFC3339) + `","status_code":200,"size":3}}},"access_list":["legacy"]}`
+	os.WriteFile(filepath.Join(tmpDir, "index.json"), []byte(index), 0644)
+
+	c, err := New(tmpDir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	data, err := c.ReadData("legacy")
+	if err != nil || string(data) != "old" {
+		t.Fatalf("expected legacy entry to be imported, got %q, %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "index.json")); !os.IsNotExist(err) {
+		t.Error("expected legacy index to be removed after import")
+	}
+}
+
+func TestStreamWriter(t *testing.T) {
+	c, err := New(t.TempDir(), time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	metadata := Metadata{CreatedAt: time.Now(), StatusCode: 200, Hash: "abc"}
+
+	w, err := c.Create("key1", "abc")
+	if err != nil {
+		t.Fatalf("failed to create writer: %v", err)
+	}
+	w.Write([]byte("hello "))
+	if _, exists := c.Peek("key1"); exists {
+		t.Error("expected entry to be invisible before commit")
+	}
+	w.Write([]byte("world"))
+	if err := w.Commit(metadata); err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+	data, err := c.ReadData("key1")
+	if err != nil || string(data) != "hello world" {
+		t.Fatalf("expected committed data, got %q, %v", data, err)
+	}
+	if meta, _ := c.GetMetadata("key1"); meta.Size != 11 {
+		t.Errorf("expected size 11, got %d", meta.Size)
+	}
+
+	w, _ = c.Create("key2", "abc")
+	w.Write([]byte("partial"))
+	w.Abort()
+	if _, err := c.GetMetadata("key2"); err == nil {
+		t.Error("expected aborted entry not to exist")
+	}
+
+	w, _ = c.Create("key3", "abc")
+	w.Write([]byte("racing"))
+	c.PurgeHash("abc")
+	if err := w.Commit(metadata); err != ErrPurged {
+		t.Errorf("expected commit after purge to be refused, got %v", err)
+	}
+
+	// 元数据写入失败时不留下没有元数据的数据文件
+	os.Mkdir(filepath.Join(c.dir, "key4.meta"), 0755)
+	os.WriteFile(filepath.Join(c.dir, "key4.meta", "block"), nil, 0644)
+	w, _ = c.Create("key4", "def")
+	w.Write([]byte("orphan"))
+	if err := w.Commit(Metadata{CreatedAt: time.Now(), StatusCode: 200, Hash: "def"}); err == nil {
+		t.Error("expected commit to fail when metadata can't be written")
+	}
+	if _, err := os.Stat(filepath.Join(c.dir, "key4")); !os.IsNotExist(err) {
+		t.Errorf("expected the data file to be removed after a metadata failure, got %v", err)
+	}
+	if _, exists := c.Peek("key4"); exists {
+		t.Error("expected no index entry after a metadata failure")
+	}
+
+	files, _ := filepath.Glob(filepath.Join(c.dir, "*.tmp"))
+	if len(files) != 0 {
+		t.Errorf("expected no temporary files left, got %v", files)
+	}
+}
+
+func TestLink(t *testing.T) {
+	dir := t.TempDir()
+	c, err := New(dir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+
+	if err := c.Set("target", []byte("default"), Metadata{CreatedAt: time.Now(), StatusCode: http.StatusOK}); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := c.Link("a", "target", Metadata{CreatedAt: time.Now(), StatusCode: http.StatusOK, Hash: "a", SourceKey: "target"}); err != nil {
+		t.Fatalf("Link failed: %v", err)
+	}
+
+	data, err := c.ReadData("a")
+	if err != nil || string(data) != "default" {
+		t.Fatalf("expected linked entry to read the target's data, got %q, %v", data, err)
+	}
+	metadata, _ := c.GetMetadata("a")
+	if metadata.Size != 7 || metadata.Hash != "a" {
+		t.Errorf("expected linked entry to keep its own metadata with the target's size, got %+v", metadata)
+	}
+
+	targetInfo, _ := os.Stat(filepath.Join(dir, "target"))
+	linkInfo, _ := os.Stat(filepath.Join(dir, "a"))
+	if !os.SameFile(targetInfo, linkInfo) {
+		t.Error("expected linked entry to share the target's data file")
+	}
+
+	// 重新写入目标不能改动已链接条目的内容
+	if err := c.Set("target", []byte("changed"), Metadata{CreatedAt: time.Now(), StatusCode: http.StatusOK}); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if data, _ := c.ReadData("a"); string(data) != "default" {
+		t.Errorf("expected rewriting the target to leave the linked entry intact, got %q", data)
+	}
+
+	if err := c.Link("b", "missing", Metadata{CreatedAt: time.Now()}); err == nil {
+		t.Error("expected linking to a missing entry to fail")
+	}
+}
+
+func TestExtractHeadersDropsOversizedValues(t *testing.T) {
+	resp := &http.Response{Header: http.Header{}}
+	resp.Header.Set("Content-Type", "image/png")
+	resp.Header.Set("ETag", `"`+strings.Repeat("a", MaxHeaderValueBytes)+`"`)
+	resp.Header.Set("X-Mirror-Junk", "ignored")
+
+	headers := ExtractHeaders(resp)
+	if headers["Content-Type"] != "image/png" {
+		t.Errorf("expected Content-Type to be kept, got %q", headers["Content-Type"])
+	}
+	if _, ok := headers["ETag"]; ok {
+		t.Error("expected oversized ETag to be dropped")
+	}
+	if len(headers) != 1 {
+		t.Errorf("expected only Content-Type to be stored, got %v", headers)
+	}
+}
+
+func TestIndexRebuild(t *testing.T) {
+	tmpDir := t.TempDir()
+	metadata := Metadata{CreatedAt: time.Now(), LastAccessedAt: time.Now(), StatusCode: 200}
+
+	c1, err := New(tmpDir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	c1.Set("a", []byte("aaa"), metadata)
+	c1.Set("b", []byte("bbbb"), metadata)
+	c1.Close()
+
+	// 缺少数据文件和无法解析的元数据被跳过
+	os.WriteFile(filepath.Join(tmpDir, "orphan.meta"), []byte(`{"status_code":200}`), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "broken"), []byte("x"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "broken.meta"), []byte(`{"status_`), 0644)
+
+	// 旧版index.json损坏时自动从.meta文件重建，而不是丢弃整个缓存
+	os.Remove(filepath.Join(tmpDir, "index.log"))
+	os.WriteFile(filepath.Join(tmpDir, "index.json"), []byte(`{"entries":`), 0644)
+	c2, err := New(tmpDir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatalf("failed to reopen cache: %v", err)
+	}
+	if stats := c2.Stats(); stats.Entries != 2 || stats.Bytes != 7 {
+		t.Errorf("expected 2 entries of 7 bytes after automatic rebuild, got %d entries of %d bytes", stats.Entries, stats.Bytes)
+	}
+	if data, err := c2.ReadData("b"); err != nil || string(data) != "bbbb" {
+		t.Errorf("expected rebuilt entry to be readable, got %q, %v", data, err)
+	}
+	c2.Close()
+
+	os.WriteFile(filepath.Join(tmpDir, "index.log"), []byte("not json\n"), 0644)
+	stats, err := RebuildIndex(tmpDir)
+	if err != nil {
+		t.Fatalf("rebuild failed: %v", err)
+	}
+	if stats.Entries != 2 || stats.Bytes != 7 || stats.Skipped != 2 {
+		t.Errorf("expected 2 entries, 7 bytes and 2 skipped, got %+v", stats)
+	}
+	c3, err := New(tmpDir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatalf("failed to reopen cache: %v", err)
+	}
+	if _, valid := c3.Get("a"); !valid {
+		t.Error("expected entry to load from the rebuilt index")
+	}
+}
+
+func TestMetadataMigration(t *testing.T) {
+	if len(metadataMigrations) != MetadataVersion {
+		t.Fatalf("expected %d migrations, got %d", MetadataVersion, len(metadataMigrations))
+	}
+
+	tmpDir := t.TempDir()
+	// 引入版本号之前写入的索引和元数据
+	os.WriteFile(filepath.Join(tmpDir, "old"), []byte("old"), 0644)
+	meta := `{"created_at":"` + time.Now().Format(time.RFC3339) + `","status_code":200,"size":3}`
+	os.WriteFile(filepath.Join(tmpDir, "old.meta"), []byte(meta), 0644)
+	record := `{"put":{"Key":"old","FilePath":"` + filepath.Join(tmpDir, "old") + `","Metadata":` + meta + `}}`
+	os.WriteFile(filepath.Join(tmpDir, "index.log"), []byte(record+"\n"), 0644)
+
+	c1, err := New(tmpDir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	entry, valid := c1.Get("old")
+	if !valid {
+		t.Fatal("expected unversioned entry to load")
+	}
+	if entry.Metadata.Version != MetadataVersion {
+		t.Errorf("expected entry to be migrated to version %d, got %d", MetadataVersion, entry.Metadata.Version)
+	}
+	c1.Close()
+
+	logData, err := os.ReadFile(filepath.Join(tmpDir, "index.log"))
+	if err != nil || !strings.HasPrefix(string(logData), `{"version":1,`) {
+		t.Errorf("expected migrated index log to start with a version record, got %q", logData)
+	}
+
+	// 更新版本的索引日志无法可靠回放，从.meta文件重建
+	os.WriteFile(filepath.Join(tmpDir, "index.log"), []byte(`{"version":99}`+"\n"), 0644)
+	c2, err := New(tmpDir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatalf("failed to reopen cache: %v", err)
+	}
+	if entry, valid := c2.Get("old"); !valid || entry.Metadata.Version != MetadataVersion {
+		t.Error("expected entry to be rebuilt and migrated from its metadata file")
+	}
+}
+
+func TestContentETag(t *testing.T) {
+	c, err := New(t.TempDir(), time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	ok := func() Metadata {
+		return Metadata{CreatedAt: time.Now(), StatusCode: http.StatusOK, Headers: map[string]string{}}
+	}
+
+	if err := c.Set("plain", []byte("hello world"), ok()); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	plain, _ := c.GetMetadata("plain")
+	if !strings.HasPrefix(plain.ETag, `"`) || len(plain.ETag) != 34 || plain.ResponseETag() != plain.ETag {
+		t.Fatalf("expected a quoted content ETag, got %q", plain.ETag)
+	}
+
+	// 流式写入相同内容得到相同的ETag
+	w, _ := c.Create("streamed", "")
+	w.Write([]byte("hello "))
+	w.Write([]byte("world"))
+	if err := w.Commit(ok()); err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+	if streamed, _ := c.GetMetadata("streamed"); streamed.ETag != plain.ETag {
+		t.Errorf("expected streamed entry to get the same ETag, got %q and %q", streamed.ETag, plain.ETag)
+	}
+	if err := c.Link("linked", "plain", ok()); err != nil {
+		t.Fatalf("Link failed: %v", err)
+	}
+	if linked, _ := c.GetMetadata("linked"); linked.ETag != plain.ETag {
+		t.Errorf("expected linked entry to reuse the source ETag, got %q", linked.ETag)
+	}
+
+	// 上游的ETag只保留给向上游的条件请求，客户端看到的ETag只取决于内容
+	upstream := ok()
+	upstream.Headers["ETag"] = `"upstream"`
+	upstream.ETag = `"stale"`
+	c.Set("upstream", []byte("hello world"), upstream)
+	if meta, _ := c.GetMetadata("upstream"); meta.ETag != plain.ETag || meta.ResponseETag() != plain.ETag || meta.Headers["ETag"] != `"upstream"` {
+		t.Errorf("expected the content ETag next to the upstream ETag, got %q / %q", meta.ETag, meta.Headers["ETag"])
+	}
+	legacy := Metadata{StatusCode: http.StatusOK, Headers: map[string]string{"ETag": `"upstream"`}}
+	if legacy.ResponseETag() != `"upstream"` {
+		t.Errorf("expected entries without a content ETag to fall back to the upstream ETag, got %q", legacy.ResponseETag())
+	}
+	if ContentETag([]byte("hello world")) != plain.ETag {
+		t.Errorf("expected ContentETag to match the cache's ETag")
+	}
+	c.Set("missing", []byte("not found"), Metadata{CreatedAt: time.Now(), StatusCode: http.StatusNotFound})
+	if meta, _ := c.GetMetadata("missing"); meta.ETag != "" {
+		t.Errorf("expected no ETag for a non-200 entry, got %q", meta.ETag)
+	}
+
+	req := httptest.NewRequest("GET", "/avatar/abc", nil)
+	req.Header.Set("If-None-Match", plain.ETag)
+	if !c.CheckConditional("plain", req) {
+		t.Error("expected the generated ETag to satisfy If-None-Match")
+	}
+	rec := httptest.NewRecorder()
+	c.WriteResponse(rec, nil, "plain", 60)
+	if rec.Header().Get("ETag") != plain.ETag {
+		t.Errorf("expected the generated ETag on cached responses, got %q", rec.Header().Get("ETag"))
+	}
+}
+
+func TestChangedSince(t *testing.T) {
+	dir := t.TempDir()
+	c, err := New(dir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	base := time.Now().Add(-time.Minute)
+	for i, key := range []string{"a", "b", "c"} {
+		c.Set(key, []byte(key), Metadata{CreatedAt: base.Add(time.Duration(i) * time.Second), StatusCode: http.StatusOK})
+	}
+
+	keys := func(entries []CacheEntry) string {
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Key)
+		}
+		return strings.Join(names, ",")
+	}
+
+	entries, next, more := c.ChangedSince("", 2)
+	if keys(entries) != "a,b" || !more {
+		t.Fatalf("expected the first page to hold a,b, got %s (more=%v)", keys(entries), more)
+	}
+	// 分页之后才写入、但CreatedAt更早的条目（如请求开始时间早于分页的慢响应）不会被跳过
+	c.Set("d", []byte("d"), Metadata{CreatedAt: base.Add(-time.Hour), StatusCode: http.StatusOK})
+	entries, next, more = c.ChangedSince(next, 2)
+	if keys(entries) != "c,d" || more {
+		t.Fatalf("expected c,d after the cursor, got %s (more=%v)", keys(entries), more)
+	}
+	if entries, _, _ := c.ChangedSince(next, 2); len(entries) != 0 {
+		t.Errorf("expected nothing after the newest entry, got %s", keys(entries))
+	}
+
+	// 更新元数据（重新验证）使条目重新出现
+	metadata, _ := c.GetMetadata("a")
+	c.UpdateMetadata("a", *metadata)
+	if entries, _, _ := c.ChangedSince(next, 0); keys(entries) != "a" {
+		t.Errorf("expected the revalidated entry after the cursor, got %s", keys(entries))
+	}
+
+	// 另一次启动的cursor从头开始
+	if entries, _, _ := c.ChangedSince("other-7", 0); len(entries) != 4 {
+		t.Errorf("expected a cursor from another run to list every entry, got %s", keys(entries))
+	}
+	c.Close()
+	reopened, err := New(dir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatalf("failed to reopen cache: %v", err)
+	}
+	if entries, _, _ := reopened.ChangedSince("", 0); keys(entries) != "d,a,b,c" {
+		t.Errorf("expected entries loaded from the index to be numbered by CreatedAt, got %s", keys(entries))
+	}
+}
+
+func TestReport(t *testing.T) {
+	c, err := New(t.TempDir(), 24*time.Hour, 1000)
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	now := time.Now()
+	put := func(key string, size int, age time.Duration, s string) {
+		params := map[string]string{"d": "mp"}
+		if s != "" {
+			params["s"] = s
+		}
+		c.Set(key, make([]byte, size), Metadata{CreatedAt: now.Add(-age), StatusCode: http.StatusOK, Params: params})
+	}
+	put("a", 100, time.Minute, "80")
+	put("b", 100, 2*time.Hour, "80")
+	put("c", 200, 48*time.Hour, "200")
+	put("d", 50, 90*24*time.Hour, "")
+
+	r := c.Report(now)
+	if r.Entries != 4 || r.Bytes != 450 || r.MaxBytes != 1000 || r.TTLSeconds != 86400 {
+		t.Fatalf("unexpected totals: %+v", r)
+	}
+	if r.Expired != (ReportBucket{Entries: 2, Bytes: 250}) {
+		t.Errorf("expected the two entries older than the TTL to be expired, got %+v", r.Expired)
+	}
+	want := map[string]ReportBucket{"1h": {1, 100}, "6h": {1, 100}, "1d": {}, "7d": {1, 200}, "30d": {}, "older": {1, 50}}
+	for _, b := range r.Age {
+		if b.ReportBucket != want[b.Le] {
+			t.Errorf("age bucket %s: expected %+v, got %+v", b.Le, want[b.Le], b.ReportBucket)
+		}
+	}
+	if s := r.ByParam["s"]; s["80"] != (ReportBucket{2, 200}) || s["200"] != (ReportBucket{1, 200}) || s["(unset)"] != (ReportBucket{1, 50}) {
+		t.Errorf("unexpected size distribution by s: %+v", s)
+	}
+	if d := r.ByParam["d"]; len(d) != 1 || d["mp"] != (ReportBucket{4, 450}) {
+		t.Errorf("unexpected distribution by d: %+v", d)
+	}
+	if r.WriteBytesPerSecond <= 0 || r.EvictionHorizonSeconds == nil || r.FullInSeconds == nil {
+		t.Fatalf("expected a write rate and projections, got %+v", r)
+	}
+	if got := *r.EvictionHorizonSeconds * r.WriteBytesPerSecond; got < 999 || got > 1001 {
+		t.Errorf("expected the horizon to be MAX_CACHE_BYTES over the write rate, got %v bytes", got)
+	}
+
+	// 取值过多的参数只保留字节数最多的，其余合并
+	for i := 0; i < reportParamValues+5; i++ {
+		c.Set(fmt.Sprintf("many%d", i), []byte("x"), Metadata{CreatedAt: now, StatusCode: http.StatusOK, Params: map[string]string{"name": fmt.Sprint(i)}})
+	}
+	names := c.Report(now).ByParam["name"]
+	if len(names) != reportParamValues+2 || names["(other)"].Entries != 5 {
+		t.Errorf("expected %d values plus (other) and (unset), got %d (other=%+v)", reportParamValues, len(names), names["(other)"])
+	}
+}
+
+func TestDeleteExpired(t *testing.T) {
+	dir := t.TempDir()
+	c, err := New(dir, time.Hour, 1000)
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	now := time.Now()
+	put := func(key string, size int, age time.Duration) {
+		if err := c.Set(key, make([]byte, size), Metadata{CreatedAt: now.Add(-age), StatusCode: http.StatusOK}); err != nil {
+			t.Fatalf("failed to set %s: %v", key, err)
+		}
+	}
+	put("fresh", 100, time.Minute)
+	put("grace", 100, 90*time.Minute)
+	put("old", 200, 3*time.Hour)
+	put("older", 50, 48*time.Hour)
+
+	stats := c.DeleteExpired(now, time.Hour)
+	if stats != (ExpireStats{Entries: 2, Bytes: 250}) {
+		t.Fatalf("expected the two entries past TTL plus grace to be deleted, got %+v", stats)
+	}
+	for _, key := range []string{"old", "older"} {
+		if _, err := os.Stat(filepath.Join(dir, key)); !os.IsNotExist(err) {
+			t.Errorf("expected the data file of %s to be removed, got %v", key, err)
+		}
+		if entry, _ := c.Peek(key); entry != nil {
+			t.Errorf("expected %s to be removed from the index", key)
+		}
+	}
+	if entry, valid := c.Peek("grace"); entry == nil || valid {
+		t.Error("expected the expired entry within the grace period to be kept")
+	}
+	if s := c.Stats(); s.Entries != 2 || s.Bytes != 200 {
+		t.Errorf("expected 2 entries and 200 bytes left, got %d and %d", s.Entries, s.Bytes)
+	}
+	if len(c.accessList) != 2 {
+		t.Errorf("expected the access list to drop deleted keys, got %v", c.accessList)
+	}
+	if stats := c.DeleteExpired(now, time.Hour); stats.Entries != 0 {
+		t.Errorf("expected nothing left to delete, got %+v", stats)
+	}
+
+	// 删除写入了索引日志，重启后不会重新出现
+	c.Close()
+	reopened, err := New(dir, time.Hour, 1000)
+	if err != nil {
+		t.Fatalf("failed to reopen cache: %v", err)
+	}
+	if s := reopened.Stats(); s.Entries != 2 {
+		t.Errorf("expected 2 entries after reopening, got %d", s.Entries)
+	}
+}
+
+func TestKeyScheme(t *testing.T) {
+	dir := t.TempDir()
+	c, err := New(dir, time.Hour, 1000)
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	params := map[string]string{"s": "80"}
+	sha256Key := c.GenerateKey("/avatar/abc", params)
+	if c.KeyScheme() != KeySchemeSHA256 || len(sha256Key) != 64 {
+		t.Fatalf("expected sha256 keys by default, got %s %q", c.KeyScheme(), sha256Key)
+	}
+	if err := c.SetKeyScheme("md5"); err == nil {
+		t.Error("expected an error for an unsupported scheme")
+	}
+
+	// 空缓存可以切换，方式记录在索引中
+	if err := c.SetKeyScheme(KeySchemeSHA256Truncated); err != nil {
+		t.Fatal(err)
+	}
+	key := c.GenerateKey("/avatar/abc", params)
+	if key != sha256Key[:32] {
+		t.Errorf("expected the truncated key to be the sha256 prefix, got %q", key)
+	}
+	if !c.ValidKey(key) || c.ValidKey(sha256Key) || c.ValidKey("../"+key[3:]) {
+		t.Error("expected only 32-character hex keys to be valid")
+	}
+	if err := c.Set(key, []byte("data"), Metadata{CreatedAt: time.Now(), StatusCode: http.StatusOK}); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	// 重启后沿用索引中的方式，已有条目时不按配置切换
+	reopened, err := New(dir, time.Hour, 1000)
+	if err != nil {
+		t.Fatalf("failed to reopen cache: %v", err)
+	}
+	if err := reopened.SetKeyScheme(KeySchemeSHA512_256); err != nil {
+		t.Fatal(err)
+	}
+	if reopened.KeyScheme() != KeySchemeSHA256Truncated {
+		t.Fatalf("expected the recorded scheme to be kept, got %s", reopened.KeyScheme())
+	}
+	if _, valid := reopened.Get(reopened.GenerateKey("/avatar/abc", params)); !valid {
+		t.Error("expected the entry to be found after reopening")
+	}
+	reopened.Close()
+
+	// 从.meta文件重建时按键的长度推断
+	if err := os.Remove(filepath.Join(dir, indexLogFile)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RebuildIndex(dir); err != nil {
+		t.Fatal(err)
+	}
+	rebuilt, err := New(dir, time.Hour, 1000)
+	if err != nil {
+		t.Fatalf("failed to reopen cache: %v", err)
+	}
+	if rebuilt.KeyScheme() != KeySchemeSHA256Truncated {
+		t.Errorf("expected the scheme to be inferred from key length, got %s", rebuilt.KeyScheme())
+	}
+
+	other, err := New(t.TempDir(), time.Hour, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.SetKeyScheme(KeySchemeSHA512_256); err != nil {
+		t.Fatal(err)
+	}
+	if key := other.GenerateKey("/avatar/abc", params); len(key) != 64 || key == sha256Key {
+		t.Errorf("expected a distinct 64-character sha512-256 key, got %q", key)
+	}
+
+	blake, err := New(t.TempDir(), time.Hour, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := blake.SetKeyScheme(KeySchemeBLAKE3); err != nil {
+		t.Fatal(err)
+	}
+	want := blake3.Sum256([]byte("/avatar/abc?s=80"))
+	if key := blake.GenerateKey("/avatar/abc", params); key != hex.EncodeToString(want[:]) || !blake.ValidKey(key) {
+		t.Errorf("expected a 64-character blake3 key, got %q", key)
+	}
+}
+
+func TestList(t *testing.T) {
+	c, err := New(t.TempDir(), time.Hour, 1<<20)
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	now := time.Now()
+	for i, key := range []string{"d", "b", "e", "a", "c"} {
+		metadata := Metadata{CreatedAt: now.Add(-time.Duration(i) * time.Minute), StatusCode: http.StatusOK, Hits: int64(i % 2)}
+		if err := c.Set(key, make([]byte, 10*(i+1)), metadata); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 逐页取完，拼接结果与一次取完相同
+	listAll := func(order string, limit int) []string {
+		var keys []string
+		var after *ListCursor
+		for pages := 0; ; pages++ {
+			if pages > 10 {
+				t.Fatal("pagination did not terminate")
+			}
+			entries, next := c.List(order, after, limit)
+			for _, e := range entries {
+				keys = append(keys, e.Key)
+			}
+			if next == nil {
+				return keys
+			}
+			after = next
+		}
+	}
+	for order, want := range map[string]string{
+		ListByKey:  "a,b,c,d,e",
+		ListByAge:  "c,a,e,b,d",
+		ListBySize: "c,a,e,b,d",
+		ListByHits: "a,b,c,d,e",
+	} {
+		for _, limit := range []int{1, 2, 5, 10} {
+			if got := strings.Join(listAll(order, limit), ","); got != want {
+				t.Errorf("sort %s limit %d: expected %s, got %s", order, limit, want, got)
+			}
+		}
+	}
+
+	if entries, next := c.List(ListByKey, nil, 5); len(entries) != 5 || next != nil {
+		t.Errorf("expected a single full page without a cursor, got %d entries and %+v", len(entries), next)
+	}
+	if !ValidListOrder(ListByHits) || ValidListOrder("name") {
+		t.Error("unexpected ValidListOrder result")
+	}
+}
+
+func TestPurgePrefixAndAll(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	c, err := New(tmpDir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	c.SetMemoryLimit(1024)
+
+	for key, hash := range map[string]string{"s80": "ab12", "s200": "ab34", "other": "cd56", "legacy": ""} {
+		metadata := Metadata{CreatedAt: time.Now(), StatusCode: 200, Hash: hash}
+		if err := c.Set(key, []byte(key), metadata); err != nil {
+			t.Fatalf("failed to set cache: %v", err)
+		}
+	}
+
+	if purged := c.PurgePrefix("ab"); purged != 2 {
+		t.Errorf("expected 2 entries purged by prefix, got %d", purged)
+	}
+	if _, exists := c.Get("s200"); exists {
+		t.Error("expected entry matching the prefix to be gone")
+	}
+	if _, valid := c.Get("other"); !valid {
+		t.Error("expected entries of other prefixes to be kept")
+	}
+	if err := c.Set("s40", []byte("late"), Metadata{CreatedAt: time.Now(), StatusCode: 200, Hash: "ab78"}); err != ErrPurged {
+		t.Errorf("expected write under a purged prefix to be rejected, got %v", err)
+	}
+	if len(c.accessList) != 2 {
+		t.Errorf("expected access list to drop purged entries, got %v", c.accessList)
+	}
+
+	purged, err := c.PurgeAll()
+	if err != nil {
+		t.Fatalf("PurgeAll failed: %v", err)
+	}
+	if purged != 2 {
+		t.Errorf("expected 2 entries purged, got %d", purged)
+	}
+	if c.currentBytes != 0 || len(c.index) != 0 || len(c.hashIndex) != 0 || len(c.accessList) != 0 {
+		t.Errorf("expected empty cache, got %d bytes, %d entries", c.currentBytes, len(c.index))
+	}
+	if entries, _, _ := c.memory.usage(); entries != 0 {
+		t.Errorf("expected memory tier to be cleared, got %d entries", entries)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "legacy")); !os.IsNotExist(err) {
+		t.Error("expected cache files to be removed")
+	}
+	if err := c.Set("legacy", []byte("late"), Metadata{CreatedAt: time.Now(), StatusCode: 200}); err != ErrPurged {
+		t.Errorf("expected writes right after purging everything to be rejected, got %v", err)
+	}
+
+	// 清空后的索引在重新加载后仍为空
+	c2, err := New(tmpDir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatalf("failed to reload cache: %v", err)
+	}
+	if len(c2.index) != 0 {
+		t.Errorf("expected reloaded index to be empty, got %d entries", len(c2.index))
+	}
+
+	// 文件分批删除；墓碑关闭时清空后立即写入的条目保留自己的文件
+	c2.SetTombstoneTTL(0)
+	for i := range 2*purgeBatchSize + 1 {
+		if err := c2.Set(fmt.Sprintf("k%d", i), []byte("data"), Metadata{CreatedAt: time.Now(), StatusCode: 200}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if purged, err := c2.PurgeAll(); err != nil || purged != 2*purgeBatchSize+1 {
+		t.Fatalf("expected every entry to be purged, got %d (%v)", purged, err)
+	}
+	if err := c2.Set("k0", []byte("new"), Metadata{CreatedAt: time.Now(), StatusCode: 200}); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(filepath.Join(tmpDir, "k*"))
+	if len(files) != 2 {
+		t.Errorf("expected only the rewritten entry's files to remain, got %d files", len(files))
+	}
+	if data, err := c2.ReadData("k0"); err != nil || string(data) != "new" {
+		t.Errorf("expected the rewritten entry to be readable, got %q (%v)", data, err)
+	}
+}
+
+func TestEvictOverLimit(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	c1, err := New(tmpDir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	for i := range 10 {
+		if err := c1.Set(fmt.Sprintf("k%d", i), make([]byte, 10), Metadata{CreatedAt: time.Now(), StatusCode: 200}); err != nil {
+			t.Fatalf("failed to set cache: %v", err)
+		}
+	}
+	if err := c1.Close(); err != nil {
+		t.Fatalf("failed to close cache: %v", err)
+	}
+
+	// 上限调小后重新打开，加载索引时不淘汰
+	c2, err := New(tmpDir, time.Hour, 30)
+	if err != nil {
+		t.Fatalf("failed to reload cache: %v", err)
+	}
+	if overage := c2.Overage(); overage != 70 {
+		t.Fatalf("expected 70 bytes over the limit, got %d", overage)
+	}
+
+	// 写入只淘汰为新条目腾出的空间，不承担存量淘汰
+	if err := c2.Set("new", make([]byte, 10), Metadata{CreatedAt: time.Now(), StatusCode: 200}); err != nil {
+		t.Fatalf("failed to set cache: %v", err)
+	}
+	if c2.currentBytes != 100 || len(c2.index) != 10 {
+		t.Errorf("expected a write to keep usage at 100 bytes and 10 entries, got %d bytes, %d entries", c2.currentBytes, len(c2.index))
+	}
+	if _, exists := c2.Get("k0"); exists {
+		t.Error("expected the least recently used entry to make room for the write")
+	}
+
+	evicted, overage := c2.EvictOverLimit(3)
+	if evicted != 3 || overage != 40 {
+		t.Errorf("expected 3 entries evicted and 40 bytes left over, got %d and %d", evicted, overage)
+	}
+	if evicted, overage = c2.EvictOverLimit(100); evicted != 4 || overage != 0 {
+		t.Errorf("expected to stop at the limit after 4 more entries, got %d and %d", evicted, overage)
+	}
+	if _, valid := c2.Get("new"); !valid {
+		t.Error("expected the most recently written entry to be kept")
+	}
+}
+
+func TestReconcileOnStartup(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	c1, err := New(tmpDir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	for _, key := range []string{"kept", "resized", "missing", "unindexed"} {
+		if err := c1.Set(key, []byte("data"), Metadata{CreatedAt: time.Now(), StatusCode: 200, Hash: "abc"}); err != nil {
+			t.Fatalf("failed to set cache: %v", err)
+		}
+	}
+	if err := c1.Close(); err != nil {
+		t.Fatalf("failed to close cache: %v", err)
+	}
+
+	// 模拟崩溃或手工操作留下的不一致：文件被删除、被替换、写入了但未进索引
+	os.Remove(filepath.Join(tmpDir, "missing"))
+	os.WriteFile(filepath.Join(tmpDir, "resized"), []byte("much longer data"), 0644)
+	c2, err := New(tmpDir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatalf("failed to reopen cache: %v", err)
+	}
+	c2.mu.Lock()
+	c2.deleteIndexLocked("unindexed")
+	c2.mu.Unlock()
+	c2.store.close()
+
+	old := time.Now().Add(-2 * orphanMinAge)
+	orphan := strings.Repeat("a", 64)
+	os.WriteFile(filepath.Join(tmpDir, orphan), []byte("orphan"), 0644)
+	os.Chtimes(filepath.Join(tmpDir, orphan), old, old)
+	fresh := strings.Repeat("b", 64)
+	os.WriteFile(filepath.Join(tmpDir, fresh), []byte("being written"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "gone.meta"), []byte(`{"status_code":200}`), 0644)
+	os.Chtimes(filepath.Join(tmpDir, "gone.meta"), old, old)
+	os.WriteFile(filepath.Join(tmpDir, "state.json"), []byte("{}"), 0644)
+	os.Chtimes(filepath.Join(tmpDir, "state.json"), old, old)
+
+	c3, err := New(tmpDir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatalf("failed to reopen cache: %v", err)
+	}
+	if _, exists := c3.index["missing"]; exists {
+		t.Error("expected the entry without a data file to be dropped")
+	}
+	if entry := c3.index["resized"]; entry == nil || entry.Metadata.Size != int64(len("much longer data")) {
+		t.Errorf("expected the size to be taken from the file, got %+v", entry)
+	}
+	if _, valid := c3.Get("unindexed"); !valid {
+		t.Error("expected the file with metadata missing from the index to be adopted")
+	}
+	if keys := c3.KeysForHash("abc"); len(keys) != 3 {
+		t.Errorf("expected adopted entries in the hash index, got %v", keys)
+	}
+	if want := int64(2*len("data") + len("much longer data")); c3.currentBytes != want {
+		t.Errorf("expected %d bytes from real file sizes, got %d", want, c3.currentBytes)
+	}
+	for name, want := range map[string]bool{orphan: false, "gone.meta": false, fresh: true, "state.json": true} {
+		if _, err := os.Stat(filepath.Join(tmpDir, name)); (err == nil) != want {
+			t.Errorf("%s: expected kept=%v, stat error %v", name, want, err)
+		}
+	}
+
+	// 核对结果已写回索引，再次打开时无需更正
+	c4, err := New(tmpDir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatalf("failed to reopen cache: %v", err)
+	}
+	if len(c4.index) != 3 || c4.currentBytes != c3.currentBytes {
+		t.Errorf("expected the reconciled index to persist, got %d entries, %d bytes", len(c4.index), c4.currentBytes)
+	}
+}
@@ -0,0 +1,71 @@
+package cache
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// changeEpoch 标识本次启动的变更序号空间；序号只保存在内存中，重启后按CreatedAt重新编排
+// 进程启动时间足以区分同一缓存目录的先后两次启动
+var changeEpoch = strconv.FormatInt(time.Now().UnixNano(), 36)
+
+// nextSeqLocked 为新写入或更新的条目分配变更序号，序号单调递增，与条目的时间戳和系统时钟无关
+func (c *Cache) nextSeqLocked(entry *CacheEntry) {
+	c.seq++
+	entry.Seq = c.seq
+}
+
+// numberEntries 按CreatedAt为加载的条目编排初始变更序号
+func (c *Cache) numberEntries() {
+	entries := make([]*CacheEntry, 0, len(c.index))
+	for _, entry := range c.index {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Metadata.CreatedAt.Before(entries[j].Metadata.CreatedAt)
+	})
+	for _, entry := range entries {
+		c.nextSeqLocked(entry)
+	}
+}
+
+// ChangedSince 返回cursor之后新写入或更新过元数据的条目副本，按变更顺序排列，最多limit个；next作为下一次的cursor，more表示还有更多
+// 变更序号在写入索引时分配，写入晚于分页的条目总在cursor之后，不会因CreatedAt早于已同步的条目而漏掉；删除不会出现
+// cursor为空、格式不对或来自缓存的另一次启动时从头开始
+func (c *Cache) ChangedSince(cursor string, limit int) (entries []CacheEntry, next string, more bool) {
+	after := parseChangeCursor(cursor)
+
+	c.mu.RLock()
+	for _, entry := range c.index {
+		if entry.Seq > after {
+			entries = append(entries, *entry)
+		}
+	}
+	c.mu.RUnlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Seq < entries[j].Seq
+	})
+	if limit > 0 && len(entries) > limit {
+		entries, more = entries[:limit], true
+	}
+	if len(entries) > 0 {
+		after = entries[len(entries)-1].Seq
+	}
+	return entries, changeEpoch + "-" + strconv.FormatUint(after, 10), more
+}
+
+// parseChangeCursor 返回cursor中的变更序号，不属于本次启动的cursor返回0
+func parseChangeCursor(cursor string) uint64 {
+	epoch, seq, ok := strings.Cut(cursor, "-")
+	if !ok || epoch != changeEpoch {
+		return 0
+	}
+	n, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
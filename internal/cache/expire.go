@@ -0,0 +1,81 @@
+package cache
+
+import (
+	"time"
+)
+
+// expireBatch 每次持有写锁时最多删除的过期条目数，清理大量条目时不长时间阻塞读写
+const expireBatch = 256
+
+// ExpireStats 是一次过期清理删除的条目数和字节数
+type ExpireStats struct {
+	Entries int
+	Bytes   int64
+}
+
+// DeleteExpired 删除CreatedAt早于now减去TTL和grace的条目及其文件
+// grace内的过期条目保留，上游不可用时仍可作为过期内容返回，或用条件请求重新验证
+// 字节数按元数据中的大小统计；与其他条目共用硬链接数据文件的条目，要等最后一个链接删除后空间才真正释放
+func (c *Cache) DeleteExpired(now time.Time, grace time.Duration) ExpireStats {
+	c.mu.RLock()
+	cutoff := now.Add(-c.ttl - grace)
+	var keys []string
+	for key, entry := range c.index {
+		if entry.Metadata.CreatedAt.Before(cutoff) {
+			keys = append(keys, key)
+		}
+	}
+	c.mu.RUnlock()
+
+	var stats ExpireStats
+	for len(keys) > 0 {
+		n := min(len(keys), expireBatch)
+		stats.add(c.deleteExpiredBatch(keys[:n], now, grace))
+		keys = keys[n:]
+	}
+	return stats
+}
+
+func (s *ExpireStats) add(other ExpireStats) {
+	s.Entries += other.Entries
+	s.Bytes += other.Bytes
+}
+
+// deleteExpiredBatch 在写锁下重新检查并删除一批条目；扫描之后被重新验证或覆盖写入的条目不再过期，跳过
+func (c *Cache) deleteExpiredBatch(keys []string, now time.Time, grace time.Duration) ExpireStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cutoff := now.Add(-c.ttl - grace)
+	removed := make(map[string]struct{}, len(keys))
+	var stats ExpireStats
+	for _, key := range keys {
+		entry, exists := c.index[key]
+		if !exists || !entry.Metadata.CreatedAt.Before(cutoff) {
+			continue
+		}
+		c.removeEntryLocked(entry)
+		removed[key] = struct{}{}
+		stats.Entries++
+		stats.Bytes += entry.Metadata.Size
+	}
+	c.removeAccessLocked(removed)
+	return stats
+}
+
+// Overage 返回缓存占用超出上限的字节数，未超出时为0
+func (c *Cache) Overage() int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return max(c.currentBytes-c.maxBytes, 0)
+}
+
+// EvictOverLimit 按LRU顺序最多淘汰n个条目，使超出上限的占用逐步回到上限以内，返回淘汰的条目数和仍超出的字节数
+// 每次调用只持有一次写锁，调用方控制频率，避免上限调小后启动时一次性淘汰大量条目
+func (c *Cache) EvictOverLimit(n int) (evicted int, overage int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	evicted = c.evictLocked(c.maxBytes, n, false)
+	return evicted, max(c.currentBytes-c.maxBytes, 0)
+}
@@ -0,0 +1,105 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+
+	"gravatar-proxy/internal/blake3"
+	"gravatar-proxy/internal/log"
+)
+
+// 缓存键（即磁盘上的文件名）的派生方式
+const (
+	// KeySchemeSHA256 为SHA-256的64位十六进制，是引入该选项之前唯一的方式
+	KeySchemeSHA256 = "sha256"
+	// KeySchemeSHA256Truncated 取SHA-256的前128位，文件名和索引更短，对缓存键的数量仍远不会碰撞
+	KeySchemeSHA256Truncated = "sha256-128"
+	// KeySchemeSHA512_256 为SHA-512/256，在没有SHA扩展指令的64位CPU上比SHA-256快
+	KeySchemeSHA512_256 = "sha512-256"
+	// KeySchemeBLAKE3 为BLAKE3的256位输出，纯Go实现，没有SHA扩展指令时同样比SHA-256快
+	KeySchemeBLAKE3 = "blake3"
+)
+
+// keySchemes 为各方式的哈希函数和取用的字节数
+var keySchemes = map[string]struct {
+	newHash func() hash.Hash
+	size    int
+}{
+	KeySchemeSHA256:          {sha256.New, sha256.Size},
+	KeySchemeSHA256Truncated: {sha256.New, 16},
+	KeySchemeSHA512_256:      {sha512.New512_256, sha512.Size256},
+	KeySchemeBLAKE3:          {blake3.New, blake3.Size},
+}
+
+// ValidKeyScheme 检查name是否为支持的缓存键派生方式
+func ValidKeyScheme(name string) bool {
+	_, ok := keySchemes[name]
+	return ok
+}
+
+// deriveKey 按scheme将完整的请求标识派生为缓存键
+func deriveKey(scheme, fullURL string) string {
+	s := keySchemes[scheme]
+	h := s.newHash()
+	h.Write([]byte(fullURL))
+	return hex.EncodeToString(h.Sum(nil)[:s.size])
+}
+
+// schemeForKeys 在索引没有记录派生方式时（引入该选项之前的索引，或从.meta文件重建的索引）按键的长度推断
+// 长度相同的SHA-256、SHA-512/256和BLAKE3无法区分，按SHA-256处理
+func schemeForKeys(entries map[string]*CacheEntry) string {
+	for key := range entries {
+		if len(key) == 2*keySchemes[KeySchemeSHA256Truncated].size {
+			return KeySchemeSHA256Truncated
+		}
+		break
+	}
+	return KeySchemeSHA256
+}
+
+// KeyScheme 返回缓存当前使用的键派生方式，未设置时为SHA-256
+func (c *Cache) KeyScheme() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.keyScheme == "" {
+		return KeySchemeSHA256
+	}
+	return c.keyScheme
+}
+
+// SetKeyScheme 设置缓存键的派生方式并记录在索引中
+// 缓存中已有条目且派生方式不同时保留原有方式并记录警告，否则已有条目都无法再被查到；清空缓存后才会切换
+func (c *Cache) SetKeyScheme(scheme string) error {
+	if !ValidKeyScheme(scheme) {
+		return fmt.Errorf("unknown cache key scheme %q", scheme)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if scheme == c.keyScheme {
+		return nil
+	}
+	if len(c.index) > 0 {
+		log.Warn("cache directory uses a different key scheme, keeping it until the cache is emptied",
+			"dir", c.dir, "key_scheme", c.keyScheme, "configured", scheme)
+		return nil
+	}
+	c.keyScheme = scheme
+	c.store.keyScheme = scheme
+	return c.store.compact(c.index, c.accessList)
+}
+
+// ValidKey 检查key是否为当前派生方式生成的形式（固定长度的小写十六进制），避免外部传入的key指向缓存目录之外
+func (c *Cache) ValidKey(key string) bool {
+	if len(key) != 2*keySchemes[c.KeyScheme()].size {
+		return false
+	}
+	return strings.IndexFunc(key, func(r rune) bool {
+		return (r < '0' || r > '9') && (r < 'a' || r > 'f')
+	}) < 0
+}
@@ -0,0 +1,117 @@
+package cache
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// 分页列出条目时的排序方式
+const (
+	// ListByKey 按缓存键升序，默认方式
+	ListByKey = "key"
+	// ListByAge 按CreatedAt从早到晚，最久未刷新的条目在前
+	ListByAge = "age"
+	// ListBySize 按大小从大到小
+	ListBySize = "size"
+	// ListByHits 按命中次数从多到少
+	ListByHits = "hits"
+)
+
+// ValidListOrder 检查order是否为支持的排序方式
+func ValidListOrder(order string) bool {
+	switch order {
+	case ListByKey, ListByAge, ListBySize, ListByHits:
+		return true
+	}
+	return false
+}
+
+// ListCursor 标识上一页的最后一个条目：排序值和缓存键，键用于区分排序值相同的条目
+// 翻页期间条目的排序值变化（如被重新验证或命中）时，该条目可能被跳过或重复出现
+type ListCursor struct {
+	Value int64
+	Key   string
+}
+
+type listItem struct {
+	value int64
+	entry *CacheEntry
+}
+
+// listValue 返回条目在order下的排序值；降序的方式取相反数，统一按升序比较
+func listValue(order string, entry *CacheEntry) int64 {
+	switch order {
+	case ListByAge:
+		return entry.Metadata.CreatedAt.UnixNano()
+	case ListBySize:
+		return -entry.Metadata.Size
+	case ListByHits:
+		return -entry.Metadata.Hits
+	}
+	return 0
+}
+
+func (a listItem) before(b listItem) bool {
+	if a.value != b.value {
+		return a.value < b.value
+	}
+	return a.entry.Key < b.entry.Key
+}
+
+// listHeap 是以最靠后的条目为堆顶的最大堆，保留至多limit个最靠前的条目
+type listHeap []listItem
+
+func (h listHeap) Len() int           { return len(h) }
+func (h listHeap) Less(i, j int) bool { return h[j].before(h[i]) }
+func (h listHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *listHeap) Push(x any)        { *h = append(*h, x.(listItem)) }
+func (h *listHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// List 按order返回after之后的至多limit个条目副本，after为nil时从头开始；next为nil表示没有更多条目
+// 每页遍历一次索引但只保留limit个条目，内存占用与总条目数无关，适合逐页导出数十万条目
+func (c *Cache) List(order string, after *ListCursor, limit int) (entries []CacheEntry, next *ListCursor) {
+	if limit <= 0 {
+		return nil, nil
+	}
+
+	var cursor listItem
+	if after != nil {
+		cursor = listItem{value: after.Value, entry: &CacheEntry{Key: after.Key}}
+	}
+
+	c.mu.RLock()
+	h := make(listHeap, 0, limit)
+	more := false
+	for _, entry := range c.index {
+		item := listItem{value: listValue(order, entry), entry: entry}
+		if after != nil && !cursor.before(item) {
+			continue
+		}
+		if len(h) < limit {
+			heap.Push(&h, item)
+			continue
+		}
+		more = true
+		if item.before(h[0]) {
+			h[0] = item
+			heap.Fix(&h, 0)
+		}
+	}
+	sort.Slice(h, func(i, j int) bool { return h[i].before(h[j]) })
+	entries = make([]CacheEntry, len(h))
+	for i, item := range h {
+		entries[i] = *item.entry
+	}
+	c.mu.RUnlock()
+
+	if more {
+		last := h[len(h)-1]
+		next = &ListCursor{Value: last.value, Key: last.entry.Key}
+	}
+	return entries, next
+}
@@ -0,0 +1,144 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+
+	"gravatar-proxy/internal/metrics"
+)
+
+var (
+	tierReads = metrics.NewCounter("cache_tier_reads_total",
+		"Cache data reads by the tier that served them (memory, disk).", "tier")
+	memoryEvictions = metrics.NewCounter("cache_memory_evictions_total",
+		"Entries demoted from the memory tier to make room for hotter ones.")
+)
+
+// memoryTier 是磁盘缓存前的内存LRU层，只保存数据，元数据始终在索引中
+// 读取时提升到内存，超过容量时淘汰最久未读的条目，磁盘上的数据不受影响
+type memoryTier struct {
+	mu       sync.Mutex
+	maxBytes int64
+	bytes    int64
+	order    *list.List
+	items    map[string]*list.Element
+}
+
+type memoryItem struct {
+	key  string
+	data []byte
+}
+
+func newMemoryTier() *memoryTier {
+	return &memoryTier{
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+func (m *memoryTier) get(key string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	elem, ok := m.items[key]
+	if !ok {
+		return nil, false
+	}
+	m.order.MoveToFront(elem)
+	return elem.Value.(*memoryItem).data, true
+}
+
+// put 提升条目到内存；超过整个内存层容量的条目不提升
+func (m *memoryTier) put(key string, data []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if int64(len(data)) > m.maxBytes {
+		m.removeLocked(key)
+		return
+	}
+
+	if elem, ok := m.items[key]; ok {
+		item := elem.Value.(*memoryItem)
+		m.bytes += int64(len(data) - len(item.data))
+		item.data = data
+		m.order.MoveToFront(elem)
+	} else {
+		m.items[key] = m.order.PushFront(&memoryItem{key: key, data: data})
+		m.bytes += int64(len(data))
+	}
+
+	m.shrinkLocked()
+}
+
+// shrinkLocked 淘汰最久未读的条目直到不超过容量
+func (m *memoryTier) shrinkLocked() {
+	for m.bytes > m.maxBytes && m.order.Len() > 0 {
+		oldest := m.order.Back()
+		m.removeLocked(oldest.Value.(*memoryItem).key)
+		memoryEvictions.Inc()
+	}
+}
+
+// replace 只更新已在内存中的条目，避免写入的新条目挤掉热点
+func (m *memoryTier) replace(key string, data []byte) {
+	m.mu.Lock()
+	_, ok := m.items[key]
+	m.mu.Unlock()
+	if ok {
+		m.put(key, data)
+	}
+}
+
+func (m *memoryTier) remove(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.removeLocked(key)
+}
+
+func (m *memoryTier) removeLocked(key string) {
+	elem, ok := m.items[key]
+	if !ok {
+		return
+	}
+	m.bytes -= int64(len(elem.Value.(*memoryItem).data))
+	m.order.Remove(elem)
+	delete(m.items, key)
+}
+
+// clear 丢弃内存层中的所有数据
+func (m *memoryTier) clear() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.order.Init()
+	clear(m.items)
+	m.bytes = 0
+}
+
+func (m *memoryTier) enabled() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.maxBytes > 0
+}
+
+func (m *memoryTier) usage() (entries int, bytes, maxBytes int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.items), m.bytes, m.maxBytes
+}
+
+// SetMemoryLimit 设置内存层容量（字节），0表示不使用内存层；缩容时立即淘汰多出的条目
+func (c *Cache) SetMemoryLimit(maxBytes int64) {
+	c.memory.mu.Lock()
+	defer c.memory.mu.Unlock()
+	c.memory.maxBytes = max(maxBytes, 0)
+	c.memory.shrinkLocked()
+}
+
+// InMemory 判断条目的数据是否在内存层中
+func (c *Cache) InMemory(key string) bool {
+	c.memory.mu.Lock()
+	defer c.memory.mu.Unlock()
+	_, ok := c.memory.items[key]
+	return ok
+}
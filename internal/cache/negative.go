@@ -0,0 +1,161 @@
+package cache
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxNegativeEntries = 10000
+
+// NegativeEntry 记录一次上游404/403响应
+type NegativeEntry struct {
+	Hash       string
+	StatusCode int
+	Headers    map[string]string
+	Body       []byte
+	ExpiresAt  time.Time
+}
+
+// NegativeCache 在内存中短期记住上游的"不存在"响应，避免每次请求都回源
+type NegativeCache struct {
+	ttl     time.Duration
+	mu      sync.RWMutex
+	entries map[string]*NegativeEntry
+}
+
+func NewNegativeCache(ttl time.Duration) *NegativeCache {
+	return &NegativeCache{
+		ttl:     ttl,
+		entries: make(map[string]*NegativeEntry),
+	}
+}
+
+// IsNegativeStatus 判断状态码是否应进入负缓存
+func IsNegativeStatus(statusCode int) bool {
+	return statusCode == 404 || statusCode == 403
+}
+
+func (n *NegativeCache) Enabled() bool {
+	return n != nil && n.ttl > 0
+}
+
+func (n *NegativeCache) Get(key string) (*NegativeEntry, bool) {
+	if !n.Enabled() {
+		return nil, false
+	}
+
+	n.mu.RLock()
+	entry, exists := n.entries[key]
+	n.mu.RUnlock()
+	if !exists {
+		return nil, false
+	}
+
+	if time.Now().After(entry.ExpiresAt) {
+		n.mu.Lock()
+		if current, ok := n.entries[key]; ok && current == entry {
+			delete(n.entries, key)
+		}
+		n.mu.Unlock()
+		return nil, false
+	}
+
+	return entry, true
+}
+
+func (n *NegativeCache) Set(key, hash string, statusCode int, headers map[string]string, body []byte) {
+	if !n.Enabled() {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if len(n.entries) >= maxNegativeEntries {
+		n.pruneLocked()
+	}
+
+	n.entries[key] = &NegativeEntry{
+		Hash:       hash,
+		StatusCode: statusCode,
+		Headers:    headers,
+		Body:       body,
+		ExpiresAt:  time.Now().Add(n.ttl),
+	}
+}
+
+func (n *NegativeCache) Delete(key string) {
+	if n == nil {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.entries, key)
+}
+
+// PurgeHash 删除某个头像哈希的所有负缓存条目，返回删除的数量
+func (n *NegativeCache) PurgeHash(hash string) int {
+	if n == nil {
+		return 0
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	purged := 0
+	for key, entry := range n.entries {
+		if entry.Hash == hash {
+			delete(n.entries, key)
+			purged++
+		}
+	}
+	return purged
+}
+
+// PurgePrefix 删除头像哈希以prefix开头的所有负缓存条目，返回删除的数量；空前缀删除全部条目
+func (n *NegativeCache) PurgePrefix(prefix string) int {
+	if n == nil {
+		return 0
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	purged := 0
+	for key, entry := range n.entries {
+		if strings.HasPrefix(entry.Hash, prefix) {
+			delete(n.entries, key)
+			purged++
+		}
+	}
+	return purged
+}
+
+func (n *NegativeCache) Len() int {
+	if n == nil {
+		return 0
+	}
+
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return len(n.entries)
+}
+
+// pruneLocked 清理过期条目，仍然超限时随机淘汰一半
+func (n *NegativeCache) pruneLocked() {
+	now := time.Now()
+	for key, entry := range n.entries {
+		if now.After(entry.ExpiresAt) {
+			delete(n.entries, key)
+		}
+	}
+
+	for key := range n.entries {
+		if len(n.entries) < maxNegativeEntries/2 {
+			break
+		}
+		delete(n.entries, key)
+	}
+}
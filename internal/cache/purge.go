@@ -0,0 +1,188 @@
+package cache
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// indexHashLocked 将条目加入头像哈希到缓存键的反向索引；未记录哈希的旧条目不参与索引
+func (c *Cache) indexHashLocked(entry *CacheEntry) {
+	hash := entry.Metadata.Hash
+	if hash == "" {
+		return
+	}
+	keys, ok := c.hashIndex[hash]
+	if !ok {
+		keys = make(map[string]struct{})
+		c.hashIndex[hash] = keys
+	}
+	keys[entry.Key] = struct{}{}
+}
+
+func (c *Cache) unindexHashLocked(entry *CacheEntry) {
+	hash := entry.Metadata.Hash
+	keys, ok := c.hashIndex[hash]
+	if !ok {
+		return
+	}
+	delete(keys, entry.Key)
+	if len(keys) == 0 {
+		delete(c.hashIndex, hash)
+	}
+}
+
+// KeysForHash 返回某个头像哈希的所有缓存键（各尺寸、默认图和格式变体）
+func (c *Cache) KeysForHash(hash string) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	keys := make([]string, 0, len(c.hashIndex[hash]))
+	for key := range c.hashIndex[hash] {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Delete 删除一个缓存条目及其文件，返回条目是否存在
+func (c *Cache) Delete(key string) bool {
+	c.tombstones.addKey(key)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.deleteLocked(key)
+}
+
+// Invalidate 删除一个缓存条目及其文件，但不留墓碑，返回条目是否存在
+// 用于条目只是过时、应当可以立即由新内容重新写入的情况
+func (c *Cache) Invalidate(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.deleteLocked(key)
+}
+
+// PurgeHash 删除某个头像哈希的所有缓存条目，返回删除的数量
+func (c *Cache) PurgeHash(hash string) int {
+	c.tombstones.addHash(hash)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	purged := 0
+	for key := range c.hashIndex[hash] {
+		if c.deleteLocked(key) {
+			purged++
+		}
+	}
+	return purged
+}
+
+// PurgePrefix 删除头像哈希以prefix开头的所有缓存条目，返回删除的数量；未记录哈希的旧条目不会匹配
+// 所有匹配的条目在一次写锁内删除，其他请求不会看到只删除了一部分的结果
+func (c *Cache) PurgePrefix(prefix string) int {
+	c.tombstones.addPrefix(prefix)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	removed := make(map[string]struct{})
+	for hash, keys := range c.hashIndex {
+		if strings.HasPrefix(hash, prefix) {
+			for key := range keys {
+				removed[key] = struct{}{}
+			}
+		}
+	}
+	for key := range removed {
+		if entry, exists := c.index[key]; exists {
+			c.removeEntryLocked(entry)
+		}
+	}
+	c.removeAccessLocked(removed)
+	return len(removed)
+}
+
+// purgeBatchSize 为PurgeAll每次持有写锁时删除的文件数
+const purgeBatchSize = 256
+
+// PurgeAll 清空缓存，返回删除的条目数
+// 先以一次原子替换写入空索引，再删除文件；索引写入失败时缓存保持不变。中途崩溃只会留下索引之外的孤立文件
+// 索引在一次写锁内清空，文件随后分批删除，批与批之间释放锁，清空大缓存时不会长时间阻塞其他请求
+func (c *Cache) PurgeAll() (int, error) {
+	c.tombstones.addPrefix("")
+
+	c.mu.Lock()
+	if err := c.store.compact(nil, nil); err != nil {
+		c.mu.Unlock()
+		return 0, fmt.Errorf("failed to clear cache index: %w", err)
+	}
+	removed := make([]*CacheEntry, 0, len(c.index))
+	for _, entry := range c.index {
+		removed = append(removed, entry)
+	}
+	c.index = make(map[string]*CacheEntry)
+	c.hashIndex = make(map[string]map[string]struct{})
+	c.accessList = nil
+	c.currentBytes = 0
+	c.memory.clear()
+	c.mu.Unlock()
+
+	for start := 0; start < len(removed); start += purgeBatchSize {
+		c.mu.Lock()
+		for _, entry := range removed[start:min(start+purgeBatchSize, len(removed))] {
+			// 墓碑关闭时同名条目可能已经重新写入，文件属于新条目
+			if _, rewritten := c.index[entry.Key]; rewritten {
+				continue
+			}
+			os.Remove(entry.FilePath)
+			os.Remove(entry.FilePath + ".meta")
+		}
+		c.mu.Unlock()
+	}
+	return len(removed), nil
+}
+
+func (c *Cache) deleteLocked(key string) bool {
+	entry, exists := c.index[key]
+	if !exists {
+		return false
+	}
+
+	c.removeEntryLocked(entry)
+
+	for i, k := range c.accessList {
+		if k == key {
+			c.accessList = append(c.accessList[:i], c.accessList[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// removeAccessLocked 从访问列表中一次移除多个键
+func (c *Cache) removeAccessLocked(removed map[string]struct{}) {
+	if len(removed) == 0 {
+		return
+	}
+	accessList := c.accessList[:0]
+	for _, key := range c.accessList {
+		if _, ok := removed[key]; !ok {
+			accessList = append(accessList, key)
+		}
+	}
+	c.accessList = accessList
+}
+
+// removeEntryLocked 删除条目的文件和索引，访问列表由调用方更新
+func (c *Cache) removeEntryLocked(entry *CacheEntry) {
+	os.Remove(entry.FilePath)
+	os.Remove(entry.FilePath + ".meta")
+
+	c.currentBytes -= entry.Metadata.Size
+	delete(c.index, entry.Key)
+	c.unindexHashLocked(entry)
+	c.memory.remove(entry.Key)
+	c.deleteIndexLocked(entry.Key)
+}
@@ -0,0 +1,86 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gravatar-proxy/internal/log"
+)
+
+// RebuildStats 汇总一次索引重建的结果
+type RebuildStats struct {
+	Entries int   `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+	// Skipped 为无法解析或缺少数据文件的.meta文件数
+	Skipped int `json:"skipped"`
+}
+
+// scanMetadata 只根据磁盘上的.meta文件和数据文件重建索引条目，不读取索引日志
+// 元数据无法解析或数据文件缺失的条目跳过；条目大小以数据文件的实际大小为准
+func scanMetadata(dir string) (map[string]*CacheEntry, RebuildStats, error) {
+	var stats RebuildStats
+	entries := make(map[string]*CacheEntry)
+
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, stats, fmt.Errorf("failed to read cache directory: %w", err)
+	}
+	for _, de := range dirEntries {
+		key, ok := strings.CutSuffix(de.Name(), ".meta")
+		if !ok || de.IsDir() || key == "" {
+			continue
+		}
+
+		metadata, err := readMetadata(filepath.Join(dir, de.Name()))
+		if err != nil {
+			log.Warn("skipped unreadable cache metadata", "key", key, "error", err)
+			stats.Skipped++
+			continue
+		}
+		filePath := filepath.Join(dir, key)
+		info, err := os.Stat(filePath)
+		if err != nil || !info.Mode().IsRegular() {
+			log.Warn("skipped cache metadata without data file", "key", key)
+			stats.Skipped++
+			continue
+		}
+
+		metadata.Size = info.Size()
+		entries[key] = &CacheEntry{Key: key, FilePath: filePath, Metadata: metadata}
+		stats.Entries++
+		stats.Bytes += metadata.Size
+	}
+	return entries, stats, nil
+}
+
+// readMetadata 读取并解析一个.meta文件
+func readMetadata(path string) (Metadata, error) {
+	var metadata Metadata
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return metadata, err
+	}
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return metadata, fmt.Errorf("corrupt metadata: %w", err)
+	}
+	return metadata, nil
+}
+
+// RebuildIndex 忽略现有索引，从dir中的.meta文件重建并写入新的索引日志
+// 不能与使用同一目录的运行中实例同时执行，否则其后续写入会追加到被替换的日志上
+func RebuildIndex(dir string) (RebuildStats, error) {
+	entries, stats, err := scanMetadata(dir)
+	if err != nil {
+		return stats, err
+	}
+	migrateEntries(entries)
+	store := openIndexStore(dir)
+	store.keyScheme = schemeForKeys(entries)
+	if err := store.compact(entries, accessOrder(entries)); err != nil {
+		return stats, err
+	}
+	return stats, store.close()
+}
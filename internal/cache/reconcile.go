@@ -0,0 +1,103 @@
+package cache
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// orphanMinAge 为删除孤立文件前要求的最小年龄，避免删除共用目录的其他实例正在写入的文件
+const orphanMinAge = time.Minute
+
+// ReconcileStats 汇总启动时索引与缓存目录的核对结果
+type ReconcileStats struct {
+	// Missing 为数据文件缺失、从索引中删除的条目数
+	Missing int
+	// Adopted 为有数据文件和.meta文件但不在索引中、重新加入索引的条目数
+	Adopted int
+	// Removed 为无法恢复而删除的孤立文件数（没有.meta的数据文件、没有数据文件或无法解析的.meta）
+	Removed int
+	// Resized 为记录的大小与实际文件大小不符、已按实际大小更正的条目数
+	Resized int
+}
+
+func (s ReconcileStats) changed() bool {
+	return s != ReconcileStats{}
+}
+
+// reconcile 以缓存目录中的实际文件核对索引条目：删除文件缺失的条目，收养有元数据的孤立文件，
+// 删除无法恢复的孤立文件，并按实际文件大小更正条目大小
+// 没有元数据的文件只有名称符合缓存键格式时才删除，目录中的索引日志和其他状态文件不受影响
+func reconcile(dir string, entries map[string]*CacheEntry, validKey func(string) bool, now time.Time) (ReconcileStats, error) {
+	var stats ReconcileStats
+
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return stats, fmt.Errorf("failed to read cache directory: %w", err)
+	}
+	files := make(map[string]fs.FileInfo, len(dirEntries))
+	for _, de := range dirEntries {
+		if !de.Type().IsRegular() {
+			continue
+		}
+		if info, err := de.Info(); err == nil {
+			files[de.Name()] = info
+		}
+	}
+
+	for key, entry := range entries {
+		info, ok := files[key]
+		if !ok {
+			delete(entries, key)
+			stats.Missing++
+			continue
+		}
+		// 缓存目录被移动后，索引中记录的路径已失效
+		entry.FilePath = filepath.Join(dir, key)
+		if info.Size() != entry.Metadata.Size {
+			entry.Metadata.Size = info.Size()
+			stats.Resized++
+		}
+	}
+
+	remove := func(name string, info fs.FileInfo) {
+		if now.Sub(info.ModTime()) < orphanMinAge {
+			return
+		}
+		if err := os.Remove(filepath.Join(dir, name)); err == nil {
+			stats.Removed++
+		}
+	}
+	for name, info := range files {
+		key, isMeta := strings.CutSuffix(name, ".meta")
+		if _, indexed := entries[key]; indexed || key == "" {
+			continue
+		}
+		dataInfo, hasData := files[key]
+		switch {
+		case !isMeta:
+			// 有.meta的数据文件在处理其.meta时收养或删除
+			if _, hasMeta := files[key+".meta"]; !hasMeta && validKey(key) {
+				remove(name, info)
+			}
+		case !hasData:
+			remove(name, info)
+		default:
+			metadata, err := readMetadata(filepath.Join(dir, name))
+			if err != nil {
+				if validKey(key) {
+					remove(name, info)
+					remove(key, dataInfo)
+				}
+				continue
+			}
+			metadata.Size = dataInfo.Size()
+			entries[key] = &CacheEntry{Key: key, FilePath: filepath.Join(dir, key), Metadata: metadata}
+			stats.Adopted++
+		}
+	}
+	return stats, nil
+}
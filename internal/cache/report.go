@@ -0,0 +1,153 @@
+package cache
+
+import (
+	"sort"
+	"time"
+)
+
+// reportParamValues 报告中每个参数最多列出的取值数，其余合并为"(other)"
+const reportParamValues = 20
+
+// reportAgeBuckets 是报告中条目年龄分布的上界，最后一档收纳更老的条目
+var reportAgeBuckets = []struct {
+	label string
+	max   time.Duration
+}{
+	{"1h", time.Hour},
+	{"6h", 6 * time.Hour},
+	{"1d", 24 * time.Hour},
+	{"7d", 7 * 24 * time.Hour},
+	{"30d", 30 * 24 * time.Hour},
+	{"older", 0},
+}
+
+// ReportBucket 是报告中一组条目的数量和字节数
+type ReportBucket struct {
+	Entries int   `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+}
+
+func (b *ReportBucket) add(size int64) {
+	b.Entries++
+	b.Bytes += size
+}
+
+// AgeBucket 是年龄不超过Le（以CreatedAt计）的条目，Le为"older"时是超过最后一档的条目
+type AgeBucket struct {
+	Le string `json:"le"`
+	ReportBucket
+}
+
+// Report 是全量缓存的审计报告，帮助运维按实际数据选择CACHE_TTL和MAX_CACHE_BYTES
+type Report struct {
+	GeneratedAt time.Time `json:"generated_at"`
+	Entries     int       `json:"entries"`
+	Bytes       int64     `json:"bytes"`
+	MaxBytes    int64     `json:"max_bytes"`
+	TTLSeconds  float64   `json:"ttl_seconds"`
+
+	// Expired 为已超过TTL、仍占用空间的条目
+	Expired ReportBucket `json:"expired"`
+	Age     []AgeBucket  `json:"age"`
+	// ByParam 按参数名和取值统计条目，未带该参数的条目计入"(unset)"
+	ByParam map[string]map[string]ReportBucket `json:"by_param"`
+
+	// WriteBytesPerSecond 为进程启动以来平均每秒写入缓存的字节数
+	WriteBytesPerSecond float64 `json:"write_bytes_per_second"`
+	// EvictionHorizonSeconds 为缓存写满后，一个不再被读取的条目按当前写入速率被LRU淘汰前能保留的时间
+	// 小于TTL说明条目往往在过期前就被淘汰，MAX_CACHE_BYTES偏小；没有写入时省略
+	EvictionHorizonSeconds *float64 `json:"eviction_horizon_seconds,omitempty"`
+	// FullInSeconds 为按当前写入速率缓存写满前的时间，已写满时为0
+	FullInSeconds *float64 `json:"full_in_seconds,omitempty"`
+}
+
+// Report 遍历全部条目，统计年龄分布、按参数的大小分布，并按写入速率估算淘汰周期
+func (c *Cache) Report(now time.Time) Report {
+	c.mu.RLock()
+	r := Report{
+		GeneratedAt: now,
+		Entries:     len(c.index),
+		Bytes:       c.currentBytes,
+		MaxBytes:    c.maxBytes,
+		TTLSeconds:  c.ttl.Seconds(),
+		Age:         make([]AgeBucket, len(reportAgeBuckets)),
+	}
+	byParam := make(map[string]map[string]*ReportBucket)
+	for _, entry := range c.index {
+		size := entry.Metadata.Size
+		age := now.Sub(entry.Metadata.CreatedAt)
+		if age > c.ttl {
+			r.Expired.add(size)
+		}
+		for i, b := range reportAgeBuckets {
+			if b.max == 0 || age <= b.max {
+				r.Age[i].add(size)
+				break
+			}
+		}
+		for name, value := range entry.Metadata.Params {
+			if byParam[name] == nil {
+				byParam[name] = make(map[string]*ReportBucket)
+			}
+			if byParam[name][value] == nil {
+				byParam[name][value] = &ReportBucket{}
+			}
+			byParam[name][value].add(size)
+		}
+	}
+	c.mu.RUnlock()
+
+	for i, b := range reportAgeBuckets {
+		r.Age[i].Le = b.label
+	}
+	r.ByParam = make(map[string]map[string]ReportBucket, len(byParam))
+	for name, values := range byParam {
+		r.ByParam[name] = topParamValues(values, r.Entries, r.Bytes)
+	}
+
+	if elapsed := now.Sub(c.stats.startedAt).Seconds(); elapsed > 0 {
+		r.WriteBytesPerSecond = float64(c.stats.written.Load()) / elapsed
+	}
+	if r.WriteBytesPerSecond > 0 {
+		horizon := float64(r.MaxBytes) / r.WriteBytesPerSecond
+		full := max(0, float64(r.MaxBytes-r.Bytes)/r.WriteBytesPerSecond)
+		r.EvictionHorizonSeconds = &horizon
+		r.FullInSeconds = &full
+	}
+	return r
+}
+
+// topParamValues 保留字节数最多的reportParamValues个取值，其余合并为"(other)"，未带该参数的条目计入"(unset)"
+func topParamValues(values map[string]*ReportBucket, entries int, bytes int64) map[string]ReportBucket {
+	names := make([]string, 0, len(values))
+	unset := ReportBucket{Entries: entries, Bytes: bytes}
+	for value, b := range values {
+		names = append(names, value)
+		unset.Entries -= b.Entries
+		unset.Bytes -= b.Bytes
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if values[names[i]].Bytes != values[names[j]].Bytes {
+			return values[names[i]].Bytes > values[names[j]].Bytes
+		}
+		return names[i] < names[j]
+	})
+
+	top := make(map[string]ReportBucket, min(len(names), reportParamValues)+2)
+	var other ReportBucket
+	for i, value := range names {
+		if i < reportParamValues {
+			top[value] = *values[value]
+			continue
+		}
+		other.Entries += values[value].Entries
+		other.Bytes += values[value].Bytes
+	}
+	if other.Entries > 0 {
+		top["(other)"] = other
+	}
+	if unset.Entries > 0 {
+		top["(unset)"] = unset
+	}
+	return top
+}
@@ -0,0 +1,39 @@
+package cache
+
+// MetadataVersion 是当前的元数据结构版本，写入时记录在每个条目的元数据中
+// 新增字段需要从旧数据推导时，提高版本号并在metadataMigrations末尾追加对应的迁移
+const MetadataVersion = 1
+
+// indexLogVersion 是索引日志的格式版本，记录在压缩后日志的第一行
+const indexLogVersion = 1
+
+// metadataMigrations[i] 将版本i的元数据升级到版本i+1，长度必须等于MetadataVersion
+var metadataMigrations = []func(*Metadata){
+	// 0 → 1：引入版本号之前写入的条目，字段与版本1相同
+	func(*Metadata) {},
+}
+
+// migrateMetadata 将旧版本的元数据依次升级到当前版本，返回是否有变化
+// 更新版本写入的元数据保持原样，其中不认识的字段在解码时已被忽略
+func migrateMetadata(m *Metadata) bool {
+	if m.Version >= MetadataVersion {
+		return false
+	}
+	for v := m.Version; v < MetadataVersion; v++ {
+		metadataMigrations[v](m)
+	}
+	m.Version = MetadataVersion
+	return true
+}
+
+// migrateEntries 升级索引中所有旧版本的元数据，返回升级的条目数
+// 只改写索引；条目的.meta文件在下次保存元数据时按新版本重写，读取时也会再次迁移
+func migrateEntries(entries map[string]*CacheEntry) int {
+	migrated := 0
+	for _, entry := range entries {
+		if migrateMetadata(&entry.Metadata) {
+			migrated++
+		}
+	}
+	return migrated
+}
@@ -0,0 +1,78 @@
+package cache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// counters 记录进程启动以来的缓存访问情况
+type counters struct {
+	startedAt time.Time
+	hits      atomic.Int64
+	misses    atomic.Int64
+	evictions atomic.Int64
+	// written 为写入条目的累计字节数，用于估算写入速率
+	written atomic.Int64
+}
+
+// Stats 是缓存的快照统计
+type Stats struct {
+	Entries  int   `json:"entries"`
+	Bytes    int64 `json:"bytes"`
+	MaxBytes int64 `json:"max_bytes"`
+
+	// 以下计数自进程启动起累计；过期条目的查找计为未命中
+	StartedAt time.Time `json:"started_at"`
+	Hits      int64     `json:"hits"`
+	Misses    int64     `json:"misses"`
+	HitRatio  float64   `json:"hit_ratio"`
+	Evictions int64     `json:"evictions"`
+
+	MemoryEntries  int   `json:"memory_entries"`
+	MemoryBytes    int64 `json:"memory_bytes"`
+	MemoryMaxBytes int64 `json:"memory_max_bytes"`
+
+	// Tombstones 为仍在有效期内的清除记录数
+	Tombstones int `json:"tombstones"`
+	// Suspect 为重新验证连续失败次数达到阈值的条目数
+	Suspect int `json:"suspect"`
+
+	OldestEntry *time.Time `json:"oldest_entry,omitempty"`
+	NewestEntry *time.Time `json:"newest_entry,omitempty"`
+}
+
+// Stats 返回当前条目数、占用字节、命中率、淘汰次数以及最早和最新条目的创建时间
+func (c *Cache) Stats() Stats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	s := Stats{
+		Entries:   len(c.index),
+		Bytes:     c.currentBytes,
+		MaxBytes:  c.maxBytes,
+		StartedAt: c.stats.startedAt,
+		Hits:      c.stats.hits.Load(),
+		Misses:    c.stats.misses.Load(),
+		Evictions: c.stats.evictions.Load(),
+
+		Tombstones: c.tombstones.len(),
+	}
+	s.MemoryEntries, s.MemoryBytes, s.MemoryMaxBytes = c.memory.usage()
+	if total := s.Hits + s.Misses; total > 0 {
+		s.HitRatio = float64(s.Hits) / float64(total)
+	}
+
+	for _, entry := range c.index {
+		if entry.Metadata.Suspect {
+			s.Suspect++
+		}
+		created := entry.Metadata.CreatedAt
+		if s.OldestEntry == nil || created.Before(*s.OldestEntry) {
+			s.OldestEntry = &created
+		}
+		if s.NewestEntry == nil || created.After(*s.NewestEntry) {
+			s.NewestEntry = &created
+		}
+	}
+	return s
+}
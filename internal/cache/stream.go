@@ -0,0 +1,92 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+)
+
+// Writer 将响应体边接收边写入缓存的临时文件，Commit之前条目对读取不可见
+// 磁盘写入失败不会中断调用方的复制（例如TeeReader另一端的客户端响应），错误在Commit时返回
+type Writer struct {
+	c    *Cache
+	key  string
+	hash string
+	file *os.File
+	size int64
+	sum  hash.Hash
+	err  error
+}
+
+// Create 开始流式写入一个缓存条目；键或头像哈希处于清除墓碑期内时返回ErrPurged
+func (c *Cache) Create(key, hash string) (*Writer, error) {
+	if c.tombstones.has(key, hash) {
+		return nil, ErrPurged
+	}
+	file, err := os.CreateTemp(c.dir, key+".*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cache file: %w", err)
+	}
+	return &Writer{c: c, key: key, hash: hash, file: file, sum: sha256.New()}, nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.err == nil {
+		var n int
+		n, w.err = w.file.Write(p)
+		w.size += int64(n)
+		w.sum.Write(p[:n])
+	}
+	return len(p), nil
+}
+
+// Commit 将临时文件替换为正式条目并写入元数据，Size取实际写入的字节数，上游没有ETag时按写入的内容生成
+func (w *Writer) Commit(metadata Metadata) error {
+	if w.err != nil {
+		w.Abort()
+		return fmt.Errorf("failed to write cache file: %w", w.err)
+	}
+	if err := w.file.Close(); err != nil {
+		os.Remove(w.file.Name())
+		return fmt.Errorf("failed to write cache file: %w", err)
+	}
+	// 写入期间可能发生了清除
+	if w.c.tombstones.has(w.key, w.hash) {
+		os.Remove(w.file.Name())
+		return ErrPurged
+	}
+
+	c := w.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	filePath := filepath.Join(c.dir, w.key)
+	if err := os.Rename(w.file.Name(), filePath); err != nil {
+		os.Remove(w.file.Name())
+		return fmt.Errorf("failed to write cache file: %w", err)
+	}
+
+	metadata.Size = w.size
+	metadata.setContentETag(w.sum.Sum(nil))
+	if err := c.saveMetadata(w.key, &metadata); err != nil {
+		// 数据文件已替换了旧条目的文件，没有元数据的文件只会成为孤立文件，连同旧条目一起删除
+		if !c.deleteLocked(w.key) {
+			os.Remove(filePath)
+			os.Remove(filePath + ".meta")
+		}
+		return fmt.Errorf("failed to write metadata file: %w", err)
+	}
+
+	// 内存层中的旧数据已失效，下次读取时再从磁盘提升
+	c.memory.remove(w.key)
+	c.addLocked(w.key, filePath, metadata)
+	return nil
+}
+
+// Abort 丢弃已写入的数据，可在Commit失败后重复调用
+func (w *Writer) Abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
@@ -0,0 +1,79 @@
+package cache
+
+import (
+	"os"
+	"time"
+)
+
+// IndexSummary 概括缓存目录中的索引，用于诊断；不包含缓存键以外的请求信息
+type IndexSummary struct {
+	KeyScheme string `json:"key_scheme"`
+	// Records 为索引日志的记录数，远多于Entries时说明日志尚未压缩
+	Records  int   `json:"records"`
+	LogBytes int64 `json:"log_bytes"`
+	Entries  int   `json:"entries"`
+	Bytes    int64 `json:"bytes"`
+	Hashes   int   `json:"hashes"`
+	// Unhashed 为未记录头像哈希的旧条目数
+	Unhashed    int         `json:"unhashed"`
+	StatusCodes map[int]int `json:"status_codes"`
+	Versions    map[int]int `json:"metadata_versions"`
+	Oldest      *time.Time  `json:"oldest,omitempty"`
+	Newest      *time.Time  `json:"newest,omitempty"`
+	Files       int         `json:"files"`
+	FileBytes   int64       `json:"file_bytes"`
+}
+
+// SummarizeIndex 只读地回放dir中的索引日志并统计目录中的文件，不修改任何文件，可在服务器运行时执行
+func SummarizeIndex(dir string) (IndexSummary, error) {
+	summary := IndexSummary{StatusCodes: make(map[int]int), Versions: make(map[int]int)}
+
+	store := openIndexStore(dir)
+	entries, _, err := store.load()
+	if err != nil {
+		return summary, err
+	}
+	summary.KeyScheme = store.keyScheme
+	if summary.KeyScheme == "" {
+		summary.KeyScheme = schemeForKeys(entries)
+	}
+	summary.Records = store.records
+	if info, err := os.Stat(store.path); err == nil {
+		summary.LogBytes = info.Size()
+	}
+
+	hashes := make(map[string]struct{})
+	for _, entry := range entries {
+		m := entry.Metadata
+		summary.Entries++
+		summary.Bytes += m.Size
+		summary.StatusCodes[m.StatusCode]++
+		summary.Versions[m.Version]++
+		if m.Hash == "" {
+			summary.Unhashed++
+		} else {
+			hashes[m.Hash] = struct{}{}
+		}
+		if created := m.CreatedAt; summary.Oldest == nil || created.Before(*summary.Oldest) {
+			summary.Oldest = &created
+		}
+		if created := m.CreatedAt; summary.Newest == nil || created.After(*summary.Newest) {
+			summary.Newest = &created
+		}
+	}
+	summary.Hashes = len(hashes)
+
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return summary, err
+	}
+	for _, de := range dirEntries {
+		info, err := de.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		summary.Files++
+		summary.FileBytes += info.Size()
+	}
+	return summary, nil
+}
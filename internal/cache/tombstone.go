@@ -0,0 +1,148 @@
+package cache
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultTombstoneTTL 覆盖上游请求超时，使清除前已发出的请求无法写回缓存
+const DefaultTombstoneTTL = 30 * time.Second
+
+// ErrPurged 表示条目刚被清除，在墓碑有效期内拒绝写入
+var ErrPurged = errors.New("cache entry was purged recently")
+
+// tombstones 记录最近清除的缓存键、头像哈希和哈希前缀
+// 每次写入都要检查，缓存键和哈希用map精确查找；按前缀清除很少见，单独放在一个短列表中逐个比较
+type tombstones struct {
+	ttl       time.Duration
+	mu        sync.Mutex
+	keys      map[string]time.Time
+	hashes    map[string]time.Time
+	prefixes  []prefixTombstone
+	lastSweep time.Time
+}
+
+// prefixTombstone 覆盖头像哈希以prefix开头的所有条目；空前缀覆盖全部条目，包括未记录哈希的条目
+type prefixTombstone struct {
+	prefix    string
+	expiresAt time.Time
+}
+
+func newTombstones(ttl time.Duration) tombstones {
+	return tombstones{ttl: ttl, keys: make(map[string]time.Time), hashes: make(map[string]time.Time)}
+}
+
+func (t *tombstones) addKey(key string) {
+	t.add(func(expiresAt time.Time) { t.keys[key] = expiresAt })
+}
+
+func (t *tombstones) addHash(hash string) {
+	t.add(func(expiresAt time.Time) { t.hashes[hash] = expiresAt })
+}
+
+func (t *tombstones) addPrefix(prefix string) {
+	t.add(func(expiresAt time.Time) {
+		for i := range t.prefixes {
+			if t.prefixes[i].prefix == prefix {
+				t.prefixes[i].expiresAt = expiresAt
+				return
+			}
+		}
+		t.prefixes = append(t.prefixes, prefixTombstone{prefix: prefix, expiresAt: expiresAt})
+	})
+}
+
+// add 在锁内记录一个墓碑；过期的墓碑每个有效期清理一次，不在每次清除时遍历全部墓碑
+func (t *tombstones) add(record func(expiresAt time.Time)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.ttl <= 0 {
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(t.lastSweep) >= t.ttl {
+		t.sweepLocked(now)
+	}
+	record(now.Add(t.ttl))
+}
+
+func (t *tombstones) sweepLocked(now time.Time) {
+	for key, expiresAt := range t.keys {
+		if now.After(expiresAt) {
+			delete(t.keys, key)
+		}
+	}
+	for hash, expiresAt := range t.hashes {
+		if now.After(expiresAt) {
+			delete(t.hashes, hash)
+		}
+	}
+	prefixes := t.prefixes[:0]
+	for _, p := range t.prefixes {
+		if !now.After(p.expiresAt) {
+			prefixes = append(prefixes, p)
+		}
+	}
+	t.prefixes = prefixes
+	t.lastSweep = now
+}
+
+// has 判断缓存键或其头像哈希是否处于墓碑有效期内
+func (t *tombstones) has(key, hash string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if expiresAt, ok := t.keys[key]; ok && now.Before(expiresAt) {
+		return true
+	}
+	if expiresAt, ok := t.hashes[hash]; ok && hash != "" && now.Before(expiresAt) {
+		return true
+	}
+	for _, p := range t.prefixes {
+		if strings.HasPrefix(hash, p.prefix) && now.Before(p.expiresAt) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *tombstones) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := 0
+	now := time.Now()
+	for _, expiresAt := range t.keys {
+		if now.Before(expiresAt) {
+			n++
+		}
+	}
+	for _, expiresAt := range t.hashes {
+		if now.Before(expiresAt) {
+			n++
+		}
+	}
+	for _, p := range t.prefixes {
+		if now.Before(p.expiresAt) {
+			n++
+		}
+	}
+	return n
+}
+
+// SetTombstoneTTL 设置清除后拒绝写回的时长，0表示不使用墓碑
+func (c *Cache) SetTombstoneTTL(ttl time.Duration) {
+	c.tombstones.mu.Lock()
+	defer c.tombstones.mu.Unlock()
+	c.tombstones.ttl = ttl
+}
+
+// Tombstoned 判断缓存键或头像哈希是否刚被清除，用于内存中的负缓存等其他写入路径
+func (c *Cache) Tombstoned(key, hash string) bool {
+	return c.tombstones.has(key, hash)
+}
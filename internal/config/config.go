@@ -1,7 +1,16 @@
 package config
 
 import (
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"math"
+	"mime"
+	"net"
+	"net/url"
 	"os"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -12,37 +21,904 @@ type Config struct {
 	CacheDir       string
 	CacheTTL       time.Duration
 	MaxCacheBytes  int64
-	UpstreamBase   string
+	UpstreamBases  []string
 	AllowedOrigins []string
+
+	// CORSMaxAge 为预检响应的Access-Control-Max-Age，浏览器在此期间复用预检结果；为0时不发送
+	CORSMaxAge time.Duration
+	// PreflightCacheTTL 为成功的预检响应在CDN等共享缓存中的有效期，为0时不标记为可缓存
+	PreflightCacheTTL time.Duration
+
+	// TLSCertFile和TLSKeyFile同时设置时以HTTPS监听，HTTP2控制TLS上的HTTP/2，H2C在明文监听上启用HTTP/2
+	TLSCertFile string
+	TLSKeyFile  string
+	HTTP2       bool
+	H2C         bool
+
+	// MemoryCacheBytes 为磁盘缓存前内存热点层的容量，0表示关闭
+	MemoryCacheBytes int64
+
+	// CacheKeyScheme 为缓存键（磁盘文件名）的派生方式：sha256、sha256-128、sha512-256或blake3
+	// 记录在缓存索引中，已有条目的缓存目录沿用原有方式
+	CacheKeyScheme string
+
+	// CacheReportInterval 为定期生成缓存审计报告的间隔，0表示只在管理接口请求时生成
+	CacheReportInterval time.Duration
+
+	// CacheJanitorInterval 为删除过期条目的间隔，0表示过期条目只在LRU淘汰时删除
+	// CacheExpiryGrace 为条目过期后仍保留的时间，供上游故障时返回过期内容和条件请求重新验证
+	CacheJanitorInterval time.Duration
+	CacheExpiryGrace     time.Duration
+	// CacheEvictionRate 为缓存超出MAX_CACHE_BYTES（如上限调小后重启）时后台每秒最多淘汰的条目数
+	CacheEvictionRate int
+
+	StaleWhileRevalidate time.Duration
+	NegativeTTL          time.Duration
+	// SuspectAfterFailures 为条目被标记为可疑前允许的连续重新验证失败次数，0表示不标记
+	SuspectAfterFailures int
+
+	Avatars        AvatarConfig
+	LocalIdenticon bool
+
+	ShadowUpstream string
+	ShadowPercent  float64
+	ShadowMode     string
+
+	LocalResize      bool
+	ResizeSourceSize int
+	ResizeFilter     string
+
+	UpstreamRegion  string
+	TrustedNetworks []string
+
+	// UpstreamOverrides 为按名称配置的备选上游，带管理凭据的请求可用X-Upstream-Override为单个请求选用，结果单独缓存
+	UpstreamOverrides map[string]string
+
+	// RateLimitRPS 为每个客户端IP每秒允许的请求数，0表示不限流
+	RateLimitRPS   float64
+	RateLimitBurst int
+	// TrustedProxies 为前置代理的网段，来自这些地址的请求按X-Forwarded-For识别客户端
+	TrustedProxies []string
+
+	// RequestIDHeader 为携带请求ID的请求头，入站请求按RequestIDTrust决定是否沿用，并在响应和上游请求中回传
+	RequestIDHeader string
+	// RequestIDTrust 决定何时沿用入站请求头中的请求ID，见RequestIDTrustProxies等
+	RequestIDTrust string
+
+	// MaxURLLength 为头像请求URL（路径加查询参数）的最大长度，超出时返回414
+	MaxURLLength int
+
+	// MaxHeaderBytes 为请求行和请求头的总大小上限，超出时由服务器返回431
+	MaxHeaderBytes int
+
+	// APIKeys 为name=key列表，非空时头像请求必须携带其中一个密钥
+	APIKeys []string
+	// APIKeyTiers 按等级名称配置密钥的限流、尺寸和功能限制，只能在配置文件中设置
+	APIKeyTiers map[string]APIKeyTier
+
+	UpstreamSourceAddr string
+	UpstreamInterface  string
+	// UpstreamProxy 为访问上游使用的出站代理（http、https或socks5），UpstreamProxyDirect表示直连，为空时按HTTP_PROXY等环境变量
+	UpstreamProxy string
+	// UpstreamPins 为上游证书公钥（SPKI）的SHA-256摘要（base64），非空时上游证书链中须有一张证书匹配其中之一
+	UpstreamPins []string
+
+	// UpstreamDNSServer 为解析上游主机名使用的DNS服务器（host:port），为空时使用系统解析
+	UpstreamDNSServer string
+	// UpstreamHosts 为静态的主机名到IP映射，优先于DNS解析
+	UpstreamHosts map[string][]string
+	// UpstreamDNSCacheTTL 为上游主机名解析成功结果的缓存时间，0表示不缓存
+	UpstreamDNSCacheTTL time.Duration
+	// UpstreamIPFamily 决定连接上游时使用或优先使用的地址族，见IPFamilyAuto等
+	UpstreamIPFamily string
+
+	UpstreamMaxIdleConnsPerHost int
+	// UpstreamMaxIdleConns 为所有上游合计保留的空闲连接数，0表示使用Go的默认值
+	UpstreamMaxIdleConns int
+	// UpstreamIdleConnTimeout 为空闲连接保留的时间，0表示使用Go的默认值
+	UpstreamIdleConnTimeout time.Duration
+	// UpstreamKeepAlive 为上游连接TCP keep-alive探测的间隔，负数表示不发送探测，0表示使用默认值
+	UpstreamKeepAlive time.Duration
+
+	// 上游请求分阶段的超时：建连、TLS握手、等待响应头，以及从收到响应头起读完响应体
+	UpstreamDialTimeout   time.Duration
+	UpstreamTLSTimeout    time.Duration
+	UpstreamHeaderTimeout time.Duration
+	UpstreamBodyTimeout   time.Duration
+	// UpstreamTimeout 为单次上游请求从发出到读完响应体的总时间上限，0表示只按分阶段的超时限制
+	UpstreamTimeout time.Duration
+
+	// UpstreamRetries 为连接被重置、超时或上游返回502/503时对同一上游的重试次数，0表示不重试
+	UpstreamRetries int
+	// UpstreamRetryBackoff 为第一次重试前的基础等待时间，之后每次翻倍并加入随机抖动
+	UpstreamRetryBackoff time.Duration
+	// UpstreamRetryBudget 为所有请求共享的每秒重试次数上限，0表示不限制
+	UpstreamRetryBudget float64
+	// UpstreamRetryHeaderTimeouts 为true时等待上游响应头超时也重试
+	UpstreamRetryHeaderTimeouts bool
+
+	// UpstreamMaxHeaderBytes 为上游响应头的总大小上限，超出时按请求失败处理
+	UpstreamMaxHeaderBytes int64
+
+	// CircuitBreakerThreshold 为上游连续失败多少次后熔断，0表示不启用熔断器
+	CircuitBreakerThreshold int
+	// CircuitBreakerCooldown 为熔断后等待多久放行一个探测请求
+	CircuitBreakerCooldown time.Duration
+
+	// UpstreamMonthlyCap 为每个自然月（UTC）从上游下载的字节上限，达到后不再请求上游，0表示不限制
+	UpstreamMonthlyCap int64
+
+	// MaxUpstreamBytes 为单个上游响应体的大小上限，超出时中止读取且不缓存，0表示不限制
+	MaxUpstreamBytes int64
+
+	// UpstreamAccept 为上游请求的Accept头，声明处理管道能解码的图片格式，供支持内容协商的上游选择格式
+	UpstreamAccept string
+
+	// UpstreamContentCheck 决定如何确认上游成功响应确实是图片，见ContentCheckHeader等
+	UpstreamContentCheck string
+
+	// FeatureFlags 为启动时各功能开关的状态，未列出的功能默认开启；运行时可通过管理接口修改
+	// 开关只能关闭已配置的功能，例如transformations开启时仍需LOCAL_RESIZE或TRANSCODE_FORMATS
+	FeatureFlags map[string]bool
+
+	// FollowRedirects 为true时跟随上游重定向（如d=指定的默认图片），目标内容按地址单独缓存
+	FollowRedirects bool
+
+	// AvatarParams 为参与缓存键并转发给上游的查询参数名，其余参数除PassthroughParams外丢弃
+	AvatarParams []string
+	// PassthroughParams 为头像参数之外也转发给上游并参与缓存键的查询参数名，"*"表示所有未知参数
+	PassthroughParams []string
+
+	TranscodeFormats []string
+	// AVIFEncoder 为转码AVIF使用的外部编码命令（如avifenc），可带参数；为空时不支持avif
+	AVIFEncoder string
+
+	// CompressEncodings 为SVG等文本类响应可协商的Content-Encoding，空表示不压缩
+	CompressEncodings []string
+
+	AdminToken   string
+	TombstoneTTL time.Duration
+	PurgePeers   []string
+	// FollowPrimary 非空时本节点作为热备：每隔FollowInterval从该主节点拉取索引增量，并从主节点下载新的条目
+	FollowPrimary  string
+	FollowInterval time.Duration
+	// WarmupSeed 为启动时预热缓存的头像列表，本地文件路径或http(s) URL，每行一个哈希，可跟逗号分隔的尺寸
+	WarmupSeed string
+	// GRPCPort 非空时在该端口以gRPC提供缓存管理接口，需要配置至少一种管理接口认证方式
+	GRPCPort string
+
+	// AdminJWTIssuer 非空时管理接口也接受该签发方（OIDC）的JWT，公钥取自AdminJWTJWKSURL或签发方的发现文档
+	// 令牌的aud须包含AdminJWTAudience；AdminJWTRoles非空时AdminJWTRoleClaim中须至少有其中一个角色
+	AdminJWTIssuer    string
+	AdminJWTJWKSURL   string
+	AdminJWTAudience  string
+	AdminJWTRoleClaim string
+	AdminJWTRoles     []string
+
+	// AdminBasicUser和AdminBasicPassword非空时管理接口也接受HTTP基本认证
+	// AdminClientCAFile 非空时TLS监听器请求客户端证书，由该CA签发并验证通过的证书可访问管理接口
+	AdminBasicUser     string
+	AdminBasicPassword string
+	AdminClientCAFile  string
+
+	// ShardPeers 非空时按头像哈希一致性哈希路由到各节点，ShardSelf为本节点在列表中的地址
+	ShardPeers []string
+	ShardSelf  string
+
+	// PeerDiscoverySRV 为DNS SRV记录名，解析出的节点与ShardPeers合并，按PeerDiscoveryInterval刷新并做健康检查
+	PeerDiscoverySRV      string
+	PeerDiscoveryScheme   string
+	PeerDiscoveryInterval time.Duration
+
+	FallbackLadder []string
+
+	// RetryAfter 为cause=duration列表，覆盖429/503各原因的Retry-After默认值
+	RetryAfter []string
+
+	// ReadyCheckUpstream 为true时/readyz还要求上游能响应一次轻量的探测请求
+	ReadyCheckUpstream bool
+
+	// DebugEndpoints 为true时提供/debug/pprof/；DebugPort非空时只在127.0.0.1的该端口上提供，否则挂在主端口
+	DebugEndpoints bool
+	DebugPort      string
+
+	// SocketStats 为true时导出主端口的连接数，以及Linux上内核监听队列的长度和溢出次数
+	SocketStats bool
+
+	// LogQuietPaths 中路径的请求日志降为Debug级别，默认只有存活和就绪检查
+	LogLevel      slog.Level
+	LogFormat     string
+	LogQuietPaths []string
+
+	// AccessLogFile 非空时请求日志写入该文件而不是标准输出，超过AccessLogMaxBytes或打开时间超过AccessLogMaxAge时轮转
+	// AccessLogMaxAge为0表示不按时间轮转；最多保留AccessLogMaxBackups个轮转出的旧文件，为0时全部保留
+	// AuditLogFile 非空时被拒绝请求的审计日志写入该文件，按同样的设置轮转
+	AccessLogFile       string
+	AuditLogFile        string
+	AccessLogMaxBytes   int64
+	AccessLogMaxAge     time.Duration
+	AccessLogMaxBackups int
+
+	// 追踪使用OpenTelemetry标准环境变量配置，TracesEndpoint为空表示关闭
+	TracesEndpoint string
+	TracesHeaders  map[string]string
+	ServiceName    string
+
+	Instance Identity
 }
 
+const (
+	// ShadowModeMirror 只镜像请求并比较状态码和延迟
+	ShadowModeMirror = "mirror"
+	// ShadowModeCompare 额外比较ETag和内容哈希，用于切换上游前验证镜像
+	ShadowModeCompare = "compare"
+)
+
+const (
+	// ContentCheckHeader 要求上游成功响应的Content-Type为image/*
+	ContentCheckHeader = "header"
+	// ContentCheckSniff 另外检查响应体开头是否为已知图片格式的签名
+	ContentCheckSniff = "sniff"
+	// ContentCheckOff 不检查
+	ContentCheckOff = "off"
+)
+
+// 可在运行时开关的功能，见FeatureFlags
+const (
+	// FeatureTransformations 为本地缩放和图片格式转码
+	FeatureTransformations = "transformations"
+	// FeatureBatch 为批量接口：/prefetch和/admin/prefetch
+	FeatureBatch = "batch"
+	// FeatureLocalDefaults 为将identicon和initials默认头像改写为本地生成
+	FeatureLocalDefaults = "local_defaults"
+)
+
+// Features 列出所有功能开关，顺序即管理接口中的顺序
+var Features = []string{FeatureTransformations, FeatureBatch, FeatureLocalDefaults}
+
+// DefaultAvatarParams 是AVATAR_PARAMS的默认值，即Gravatar的头像参数，name用于d=initials的缩写
+var DefaultAvatarParams = []string{"s", "d", "r", "f", "name"}
+
+// reservedParams 不能出现在AVATAR_PARAMS中：fmt和enc是转码、压缩变体在缓存键中附加的参数，
+// region记录受信任调用方覆盖的上游区域，api_key携带API密钥
+var reservedParams = []string{"fmt", "enc", "region", "api_key"}
+
+const (
+	// RequestIDTrustNone 总是生成新的请求ID
+	RequestIDTrustNone = "none"
+	// RequestIDTrustProxies 只沿用来自TRUSTED_PROXIES或TRUSTED_NETWORKS的请求ID
+	RequestIDTrustProxies = "proxies"
+	// RequestIDTrustAll 沿用任何调用方的请求ID
+	RequestIDTrustAll = "all"
+)
+
+const (
+	// IPFamilyAuto 沿用Go的默认行为，两个地址族并行尝试（Happy Eyeballs）
+	IPFamilyAuto = "auto"
+	// IPFamilyIPv4和IPFamilyIPv6 只使用对应地址族的地址
+	IPFamilyIPv4 = "ipv4"
+	IPFamilyIPv6 = "ipv6"
+	// IPFamilyPreferIPv4和IPFamilyPreferIPv6 先依次尝试对应地址族的地址，都失败后再尝试另一族
+	IPFamilyPreferIPv4 = "prefer-ipv4"
+	IPFamilyPreferIPv6 = "prefer-ipv6"
+)
+
+// UpstreamProxyDirect 表示不使用出站代理，忽略HTTP_PROXY等环境变量
+const UpstreamProxyDirect = "direct"
+
+// DefaultRequestIDHeader 默认的请求ID请求头
+const DefaultRequestIDHeader = "X-Request-ID"
+
+// DefaultFallbackLadder 主上游失败后的默认降级顺序：先试其余上游，再本地生成
+const DefaultFallbackLadder = "secondary,local"
+
+// DefaultMaxURLLength 头像请求URL的默认长度上限
+const DefaultMaxURLLength = 4096
+
+// DefaultMaxHeaderBytes 请求行和请求头的默认大小上限，远小于标准库默认的1MB
+const DefaultMaxHeaderBytes = 16 * 1024
+
+// 上游请求各阶段的默认超时：建连和握手应很快完成，响应体留足时间给慢速链路上的大尺寸动图
+const (
+	DefaultUpstreamDialTimeout   = 5 * time.Second
+	DefaultUpstreamTLSTimeout    = 5 * time.Second
+	DefaultUpstreamHeaderTimeout = 10 * time.Second
+	DefaultUpstreamBodyTimeout   = 60 * time.Second
+)
+
+// DefaultUpstreamKeepAlive 上游连接TCP keep-alive探测的默认间隔
+const DefaultUpstreamKeepAlive = 30 * time.Second
+
+// 上游瞬时失败的默认重试次数和基础退避时间；重试次数设有上限，避免上游故障时成倍放大请求量
+const (
+	DefaultUpstreamRetries      = 2
+	MaxUpstreamRetries          = 5
+	DefaultUpstreamRetryBackoff = 100 * time.Millisecond
+	DefaultUpstreamRetryBudget  = 10
+)
+
+// 上游熔断器的默认阈值和冷却时间
+const (
+	DefaultCircuitBreakerThreshold = 5
+	DefaultCircuitBreakerCooldown  = 30 * time.Second
+)
+
+// DefaultUpstreamMaxHeaderBytes 上游响应头的默认大小上限，远大于正常头像响应所需
+const DefaultUpstreamMaxHeaderBytes = 32 * 1024
+
+// DefaultMaxUpstreamBytes 上游响应体的默认大小上限，远大于最大尺寸的头像
+const DefaultMaxUpstreamBytes = 10 << 20
+
+// DefaultUpstreamAccept 默认只接受本地缩放和转码能解码的格式，其他格式无法进入处理管道
+const DefaultUpstreamAccept = "image/png, image/jpeg, image/gif;q=0.8"
+
 func Load() (*Config, error) {
+	fc, err := loadFile(getEnv("CONFIG_FILE", ""))
+	if err != nil {
+		return nil, err
+	}
+
 	port := getEnv("PORT", "8080")
+	tlsCertFile := getEnv("TLS_CERT_FILE", "")
+	tlsKeyFile := getEnv("TLS_KEY_FILE", "")
+	if (tlsCertFile == "") != (tlsKeyFile == "") {
+		return nil, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
 	cacheDir := getEnv("CACHE_DIR", "./cache")
-	cacheTTLStr := getEnv("CACHE_TTL", "24h")
+	cacheTTLStr := getEnv("CACHE_TTL", orDefault(fc.CacheTTL, "24h"))
 	maxCacheBytesStr := getEnv("MAX_CACHE_BYTES", "268435456")
-	upstreamBase := getEnv("UPSTREAM_BASE", "https://www.gravatar.com")
+	upstreamBases := splitList(getEnv("UPSTREAM_BASE", orDefault(strings.Join(fc.UpstreamBase, ","), "https://www.gravatar.com")))
 
 	cacheTTL, err := time.ParseDuration(cacheTTLStr)
 	if err != nil {
 		return nil, err
 	}
 
-	maxCacheBytes, err := strconv.ParseInt(maxCacheBytesStr, 10, 64)
+	cacheKeyScheme := getEnv("CACHE_KEY_SCHEME", "sha256")
+	switch cacheKeyScheme {
+	case "sha256", "sha256-128", "sha512-256", "blake3":
+	default:
+		return nil, fmt.Errorf("CACHE_KEY_SCHEME must be sha256, sha256-128, sha512-256 or blake3, got %q", cacheKeyScheme)
+	}
+
+	cacheReportInterval, err := time.ParseDuration(getEnv("CACHE_REPORT_INTERVAL", "1h"))
 	if err != nil {
 		return nil, err
 	}
+	if cacheReportInterval < 0 {
+		return nil, fmt.Errorf("CACHE_REPORT_INTERVAL must not be negative, got %s", cacheReportInterval)
+	}
 
-	allowedOriginsStr := getEnv("ALLOWED_ORIGINS", "")
-	var allowedOrigins []string
-	if allowedOriginsStr != "" {
-		origins := strings.Split(allowedOriginsStr, ",")
-		for _, origin := range origins {
-			origin = strings.TrimSpace(origin)
-			if origin != "" {
-				allowedOrigins = append(allowedOrigins, origin)
-			}
+	staleWhileRevalidate, err := time.ParseDuration(getEnv("STALE_WHILE_REVALIDATE", "0s"))
+	if err != nil {
+		return nil, err
+	}
+
+	cacheJanitorInterval, err := time.ParseDuration(getEnv("CACHE_JANITOR_INTERVAL", "1h"))
+	if err != nil {
+		return nil, err
+	}
+	if cacheJanitorInterval < 0 {
+		return nil, fmt.Errorf("CACHE_JANITOR_INTERVAL must not be negative, got %s", cacheJanitorInterval)
+	}
+	cacheExpiryGrace, err := time.ParseDuration(getEnv("CACHE_EXPIRY_GRACE", "24h"))
+	if err != nil {
+		return nil, err
+	}
+	if cacheExpiryGrace < 0 {
+		return nil, fmt.Errorf("CACHE_EXPIRY_GRACE must not be negative, got %s", cacheExpiryGrace)
+	}
+	if cacheJanitorInterval > 0 && cacheExpiryGrace < staleWhileRevalidate {
+		return nil, fmt.Errorf("CACHE_EXPIRY_GRACE must not be shorter than STALE_WHILE_REVALIDATE")
+	}
+	cacheEvictionRate, err := strconv.Atoi(getEnv("CACHE_EVICTION_RATE", "1000"))
+	if err != nil {
+		return nil, err
+	}
+	if cacheEvictionRate <= 0 {
+		return nil, fmt.Errorf("CACHE_EVICTION_RATE must be positive, got %d", cacheEvictionRate)
+	}
+
+	negativeTTL, err := time.ParseDuration(getEnv("NEGATIVE_TTL", "5m"))
+	if err != nil {
+		return nil, err
+	}
+
+	suspectAfterFailures, err := strconv.Atoi(getEnv("SUSPECT_AFTER_FAILURES", "3"))
+	if err != nil {
+		return nil, err
+	}
+	if suspectAfterFailures < 0 {
+		return nil, fmt.Errorf("SUSPECT_AFTER_FAILURES must not be negative, got %d", suspectAfterFailures)
+	}
+
+	http2, err := strconv.ParseBool(getEnv("HTTP2", "true"))
+	if err != nil {
+		return nil, err
+	}
+
+	h2c, err := strconv.ParseBool(getEnv("H2C", "false"))
+	if err != nil {
+		return nil, err
+	}
+	if h2c && tlsCertFile != "" {
+		return nil, fmt.Errorf("H2C only applies to plaintext listeners, unset it or TLS_CERT_FILE")
+	}
+
+	localIdenticon, err := strconv.ParseBool(getEnv("LOCAL_IDENTICON", "false"))
+	if err != nil {
+		return nil, err
+	}
+
+	shadowPercent, err := strconv.ParseFloat(getEnv("SHADOW_PERCENT", "0"), 64)
+	if err != nil {
+		return nil, err
+	}
+	if shadowPercent < 0 || shadowPercent > 100 {
+		return nil, fmt.Errorf("SHADOW_PERCENT must be between 0 and 100, got %v", shadowPercent)
+	}
+
+	rateLimitRPSDefault := "0"
+	if fc.RateLimitRPS != nil {
+		rateLimitRPSDefault = strconv.FormatFloat(*fc.RateLimitRPS, 'g', -1, 64)
+	}
+	rateLimitRPS, err := strconv.ParseFloat(getEnv("RATE_LIMIT_RPS", rateLimitRPSDefault), 64)
+	if err != nil {
+		return nil, err
+	}
+	if rateLimitRPS < 0 {
+		return nil, fmt.Errorf("RATE_LIMIT_RPS must not be negative, got %v", rateLimitRPS)
+	}
+	// 默认允许一秒的突发
+	rateLimitBurstDefault := int(math.Ceil(rateLimitRPS))
+	if fc.RateLimitBurst != nil {
+		rateLimitBurstDefault = *fc.RateLimitBurst
+	}
+	rateLimitBurst, err := strconv.Atoi(getEnv("RATE_LIMIT_BURST", strconv.Itoa(rateLimitBurstDefault)))
+	if err != nil {
+		return nil, err
+	}
+	if rateLimitBurst < 0 {
+		return nil, fmt.Errorf("RATE_LIMIT_BURST must not be negative, got %d", rateLimitBurst)
+	}
+
+	if err := validateAPIKeyTiers(fc.APIKeyTiers); err != nil {
+		return nil, err
+	}
+
+	maxURLLength, err := strconv.Atoi(getEnv("MAX_URL_LENGTH", strconv.Itoa(DefaultMaxURLLength)))
+	if err != nil {
+		return nil, err
+	}
+	if maxURLLength < 1 {
+		return nil, fmt.Errorf("MAX_URL_LENGTH must be positive, got %d", maxURLLength)
+	}
+
+	maxHeaderBytes, err := strconv.Atoi(getEnv("MAX_HEADER_BYTES", strconv.Itoa(DefaultMaxHeaderBytes)))
+	if err != nil {
+		return nil, err
+	}
+	// 请求行也计入MaxHeaderBytes，上限不能小于允许的URL长度
+	if maxHeaderBytes <= maxURLLength {
+		return nil, fmt.Errorf("MAX_HEADER_BYTES must be larger than MAX_URL_LENGTH (%d), got %d", maxURLLength, maxHeaderBytes)
+	}
+
+	shadowMode := getEnv("SHADOW_MODE", ShadowModeMirror)
+	if shadowMode != ShadowModeMirror && shadowMode != ShadowModeCompare {
+		return nil, fmt.Errorf("SHADOW_MODE must be %q or %q, got %q", ShadowModeMirror, ShadowModeCompare, shadowMode)
+	}
+
+	upstreamContentCheck := getEnv("UPSTREAM_CONTENT_CHECK", ContentCheckHeader)
+	if upstreamContentCheck != ContentCheckHeader && upstreamContentCheck != ContentCheckSniff && upstreamContentCheck != ContentCheckOff {
+		return nil, fmt.Errorf("UPSTREAM_CONTENT_CHECK must be %q, %q or %q, got %q", ContentCheckHeader, ContentCheckSniff, ContentCheckOff, upstreamContentCheck)
+	}
+
+	featureFlags, err := parseFeatureFlags(getEnv("FEATURE_FLAGS", ""))
+	if err != nil {
+		return nil, err
+	}
+
+	requestIDHeader := getEnv("REQUEST_ID_HEADER", DefaultRequestIDHeader)
+	if !headerNamePattern.MatchString(requestIDHeader) {
+		return nil, fmt.Errorf("invalid REQUEST_ID_HEADER %q", requestIDHeader)
+	}
+	requestIDTrust := getEnv("REQUEST_ID_TRUST", RequestIDTrustProxies)
+	if requestIDTrust != RequestIDTrustNone && requestIDTrust != RequestIDTrustProxies && requestIDTrust != RequestIDTrustAll {
+		return nil, fmt.Errorf("REQUEST_ID_TRUST must be %q, %q or %q, got %q", RequestIDTrustNone, RequestIDTrustProxies, RequestIDTrustAll, requestIDTrust)
+	}
+
+	// 代理地址可能带有凭据，错误信息中不包含原值
+	upstreamProxy := getEnv("UPSTREAM_PROXY", "")
+	if upstreamProxy != "" && upstreamProxy != UpstreamProxyDirect {
+		u, err := url.Parse(upstreamProxy)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("UPSTREAM_PROXY must be a proxy URL or %q", UpstreamProxyDirect)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("UPSTREAM_PROXY scheme must be http, https, socks5 or socks5h, got %q", u.Scheme)
+		}
+	}
+
+	avatarParams := splitList(getEnv("AVATAR_PARAMS", strings.Join(DefaultAvatarParams, ",")))
+	for _, name := range avatarParams {
+		if slices.Contains(reservedParams, name) {
+			return nil, fmt.Errorf("AVATAR_PARAMS must not contain %q", name)
+		}
+	}
+
+	upstreamPins, err := parseUpstreamPins(getEnv("UPSTREAM_PIN_SHA256", ""))
+	if err != nil {
+		return nil, err
+	}
+	// 与HTTPS代理的握手按服务器名排除在公钥固定之外，而IP地址不作为服务器名发送，无法与上游区分
+	if len(upstreamPins) > 0 && upstreamProxy != "" && upstreamProxy != UpstreamProxyDirect {
+		if u, _ := url.Parse(upstreamProxy); u.Scheme == "https" && net.ParseIP(u.Hostname()) != nil {
+			return nil, fmt.Errorf("UPSTREAM_PIN_SHA256 requires an https UPSTREAM_PROXY to be given by host name, not IP address")
+		}
+	}
+
+	upstreamDNSServer := getEnv("UPSTREAM_DNS_SERVER", "")
+	if upstreamDNSServer != "" {
+		if _, _, err := net.SplitHostPort(upstreamDNSServer); err != nil {
+			upstreamDNSServer = net.JoinHostPort(upstreamDNSServer, "53")
 		}
+		if host, _, _ := net.SplitHostPort(upstreamDNSServer); net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("UPSTREAM_DNS_SERVER must be an IP address with an optional port, got %q", getEnv("UPSTREAM_DNS_SERVER", ""))
+		}
+	}
+	upstreamHosts, err := parseUpstreamHosts(getEnv("UPSTREAM_HOSTS", ""))
+	if err != nil {
+		return nil, err
+	}
+	upstreamDNSCacheTTL, err := time.ParseDuration(getEnv("UPSTREAM_DNS_CACHE_TTL", "0s"))
+	if err != nil {
+		return nil, err
+	}
+	if upstreamDNSCacheTTL < 0 {
+		return nil, fmt.Errorf("UPSTREAM_DNS_CACHE_TTL must not be negative, got %v", upstreamDNSCacheTTL)
+	}
+
+	upstreamIPFamily := getEnv("UPSTREAM_IP_FAMILY", IPFamilyAuto)
+	switch upstreamIPFamily {
+	case IPFamilyAuto, IPFamilyIPv4, IPFamilyIPv6, IPFamilyPreferIPv4, IPFamilyPreferIPv6:
+	default:
+		return nil, fmt.Errorf("UPSTREAM_IP_FAMILY must be %q, %q, %q, %q or %q, got %q",
+			IPFamilyAuto, IPFamilyIPv4, IPFamilyIPv6, IPFamilyPreferIPv4, IPFamilyPreferIPv6, upstreamIPFamily)
+	}
+
+	upstreamRegion := getEnv("UPSTREAM_REGION", "")
+	for _, base := range upstreamBases {
+		if strings.Contains(base, "{region}") && upstreamRegion == "" {
+			return nil, fmt.Errorf("UPSTREAM_BASE %s uses {region} but UPSTREAM_REGION is not set", base)
+		}
+	}
+
+	localResize, err := strconv.ParseBool(getEnv("LOCAL_RESIZE", "false"))
+	if err != nil {
+		return nil, err
+	}
+
+	followRedirects, err := strconv.ParseBool(getEnv("FOLLOW_REDIRECTS", "true"))
+	if err != nil {
+		return nil, err
+	}
+
+	resizeSourceSize, err := strconv.Atoi(getEnv("RESIZE_SOURCE_SIZE", "512"))
+	if err != nil {
+		return nil, err
+	}
+	if resizeSourceSize < 1 || resizeSourceSize > 2048 {
+		return nil, fmt.Errorf("RESIZE_SOURCE_SIZE must be between 1 and 2048, got %d", resizeSourceSize)
+	}
+
+	maxIdleConnsPerHost, err := strconv.Atoi(getEnv("UPSTREAM_MAX_IDLE_CONNS_PER_HOST", "0"))
+	if err != nil {
+		return nil, err
+	}
+	if maxIdleConnsPerHost < 0 {
+		return nil, fmt.Errorf("UPSTREAM_MAX_IDLE_CONNS_PER_HOST must not be negative, got %d", maxIdleConnsPerHost)
+	}
+
+	maxIdleConns, err := strconv.Atoi(getEnv("UPSTREAM_MAX_IDLE_CONNS", "0"))
+	if err != nil {
+		return nil, err
+	}
+	if maxIdleConns < 0 {
+		return nil, fmt.Errorf("UPSTREAM_MAX_IDLE_CONNS must not be negative, got %d", maxIdleConns)
+	}
+	idleConnTimeout, err := parseTimeout("UPSTREAM_IDLE_CONN_TIMEOUT", 90*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	// 0表示关闭keep-alive探测，在Config中用负数表示，与net.Dialer一致
+	upstreamKeepAlive, err := time.ParseDuration(getEnv("UPSTREAM_KEEPALIVE", DefaultUpstreamKeepAlive.String()))
+	if err != nil {
+		return nil, err
+	}
+	if upstreamKeepAlive <= 0 {
+		upstreamKeepAlive = -1
+	}
+
+	upstreamDialTimeout, err := parseTimeout("UPSTREAM_DIAL_TIMEOUT", DefaultUpstreamDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	upstreamTLSTimeout, err := parseTimeout("UPSTREAM_TLS_TIMEOUT", DefaultUpstreamTLSTimeout)
+	if err != nil {
+		return nil, err
+	}
+	upstreamHeaderTimeout, err := parseTimeout("UPSTREAM_HEADER_TIMEOUT", DefaultUpstreamHeaderTimeout)
+	if err != nil {
+		return nil, err
+	}
+	upstreamBodyTimeout, err := parseTimeout("UPSTREAM_BODY_TIMEOUT", DefaultUpstreamBodyTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	upstreamTimeout, err := time.ParseDuration(getEnv("UPSTREAM_TIMEOUT", "0s"))
+	if err != nil {
+		return nil, err
+	}
+	if upstreamTimeout < 0 {
+		return nil, fmt.Errorf("UPSTREAM_TIMEOUT must not be negative, got %v", upstreamTimeout)
+	}
+
+	upstreamRetries, err := strconv.Atoi(getEnv("UPSTREAM_RETRIES", strconv.Itoa(DefaultUpstreamRetries)))
+	if err != nil {
+		return nil, err
+	}
+	if upstreamRetries < 0 || upstreamRetries > MaxUpstreamRetries {
+		return nil, fmt.Errorf("UPSTREAM_RETRIES must be between 0 and %d, got %d", MaxUpstreamRetries, upstreamRetries)
+	}
+	upstreamRetryBackoff, err := parseTimeout("UPSTREAM_RETRY_BACKOFF", DefaultUpstreamRetryBackoff)
+	if err != nil {
+		return nil, err
+	}
+	upstreamRetryBudget, err := strconv.ParseFloat(getEnv("UPSTREAM_RETRY_BUDGET", strconv.Itoa(DefaultUpstreamRetryBudget)), 64)
+	if err != nil {
+		return nil, err
+	}
+	if upstreamRetryBudget < 0 {
+		return nil, fmt.Errorf("UPSTREAM_RETRY_BUDGET must not be negative, got %v", upstreamRetryBudget)
+	}
+	upstreamRetryHeaderTimeouts, err := strconv.ParseBool(getEnv("UPSTREAM_RETRY_HEADER_TIMEOUTS", "false"))
+	if err != nil {
+		return nil, err
+	}
+
+	circuitBreakerThreshold, err := strconv.Atoi(getEnv("CIRCUIT_BREAKER_THRESHOLD", strconv.Itoa(DefaultCircuitBreakerThreshold)))
+	if err != nil {
+		return nil, err
+	}
+	if circuitBreakerThreshold < 0 {
+		return nil, fmt.Errorf("CIRCUIT_BREAKER_THRESHOLD must not be negative, got %d", circuitBreakerThreshold)
+	}
+	circuitBreakerCooldown, err := parseTimeout("CIRCUIT_BREAKER_COOLDOWN", DefaultCircuitBreakerCooldown)
+	if err != nil {
+		return nil, err
+	}
+
+	upstreamMaxHeaderBytes, err := strconv.ParseInt(getEnv("UPSTREAM_MAX_HEADER_BYTES", strconv.Itoa(DefaultUpstreamMaxHeaderBytes)), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	if upstreamMaxHeaderBytes < 1 {
+		return nil, fmt.Errorf("UPSTREAM_MAX_HEADER_BYTES must be positive, got %d", upstreamMaxHeaderBytes)
+	}
+
+	upstreamMonthlyCap, err := strconv.ParseInt(getEnv("UPSTREAM_MONTHLY_CAP_BYTES", "0"), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	if upstreamMonthlyCap < 0 {
+		return nil, fmt.Errorf("UPSTREAM_MONTHLY_CAP_BYTES must not be negative, got %d", upstreamMonthlyCap)
+	}
+
+	maxUpstreamBytes, err := strconv.ParseInt(getEnv("MAX_UPSTREAM_BYTES", strconv.Itoa(DefaultMaxUpstreamBytes)), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	if maxUpstreamBytes < 0 {
+		return nil, fmt.Errorf("MAX_UPSTREAM_BYTES must not be negative, got %d", maxUpstreamBytes)
+	}
+
+	upstreamAccept := getEnv("UPSTREAM_ACCEPT", DefaultUpstreamAccept)
+	for _, mediaRange := range splitList(upstreamAccept) {
+		if _, _, err := mime.ParseMediaType(mediaRange); err != nil {
+			return nil, fmt.Errorf("invalid UPSTREAM_ACCEPT media range %q: %w", mediaRange, err)
+		}
+	}
+
+	memoryCacheMB, err := strconv.ParseInt(getEnv("MEMORY_CACHE_MB", "0"), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	if memoryCacheMB < 0 {
+		return nil, fmt.Errorf("MEMORY_CACHE_MB must not be negative, got %d", memoryCacheMB)
+	}
+
+	peerDiscoveryInterval, err := time.ParseDuration(getEnv("PEER_DISCOVERY_INTERVAL", "30s"))
+	if err != nil {
+		return nil, err
+	}
+
+	tombstoneTTL, err := time.ParseDuration(getEnv("TOMBSTONE_TTL", "30s"))
+	if err != nil {
+		return nil, err
+	}
+
+	readyCheckUpstream, err := strconv.ParseBool(getEnv("READY_CHECK_UPSTREAM", "false"))
+	if err != nil {
+		return nil, err
+	}
+
+	debugEndpoints, err := strconv.ParseBool(getEnv("DEBUG_ENDPOINTS", "false"))
+	if err != nil {
+		return nil, err
+	}
+	debugPort := getEnv("DEBUG_PORT", "")
+	if debugPort != "" {
+		if n, err := strconv.Atoi(debugPort); err != nil || n < 1 || n > 65535 {
+			return nil, fmt.Errorf("DEBUG_PORT must be a port number, got %q", debugPort)
+		}
+		if debugPort == port {
+			return nil, fmt.Errorf("DEBUG_PORT must differ from PORT")
+		}
+	}
+
+	socketStats, err := strconv.ParseBool(getEnv("SOCKET_STATS", "false"))
+	if err != nil {
+		return nil, err
+	}
+
+	adminJWTIssuer := getEnv("ADMIN_JWT_ISSUER", "")
+	adminJWTJWKSURL := getEnv("ADMIN_JWT_JWKS_URL", "")
+	adminJWTAudience := getEnv("ADMIN_JWT_AUDIENCE", "")
+	if adminJWTIssuer != "" {
+		if u, err := url.Parse(adminJWTIssuer); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return nil, fmt.Errorf("ADMIN_JWT_ISSUER must be an http(s) URL, got %q", adminJWTIssuer)
+		}
+		if adminJWTAudience == "" {
+			return nil, fmt.Errorf("ADMIN_JWT_ISSUER requires ADMIN_JWT_AUDIENCE")
+		}
+	} else if adminJWTJWKSURL != "" || adminJWTAudience != "" {
+		return nil, fmt.Errorf("ADMIN_JWT_JWKS_URL and ADMIN_JWT_AUDIENCE require ADMIN_JWT_ISSUER")
+	}
+	// 转发给其他节点的清除请求使用共享的ADMIN_TOKEN认证，其他管理认证方式的凭据不能转发
+	if getEnv("PURGE_PEERS", "") != "" && getEnv("ADMIN_TOKEN", "") == "" {
+		return nil, fmt.Errorf("PURGE_PEERS requires ADMIN_TOKEN, which forwarded purges authenticate with")
+	}
+
+	compressEncodings := splitList(getEnv("COMPRESS_ENCODINGS", "br,gzip"))
+	if len(compressEncodings) == 1 && compressEncodings[0] == "none" {
+		compressEncodings = nil
+	}
+
+	followPrimary := strings.TrimSuffix(getEnv("FOLLOW_PRIMARY", ""), "/")
+	followInterval, err := time.ParseDuration(getEnv("FOLLOW_INTERVAL", "30s"))
+	if err != nil {
+		return nil, err
+	}
+	if followPrimary != "" {
+		if u, err := url.Parse(followPrimary); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return nil, fmt.Errorf("FOLLOW_PRIMARY must be an http(s) URL, got %q", followPrimary)
+		}
+		// 从主节点的管理接口同步，使用共享的ADMIN_TOKEN认证
+		if getEnv("ADMIN_TOKEN", "") == "" {
+			return nil, fmt.Errorf("FOLLOW_PRIMARY requires ADMIN_TOKEN, which sync requests authenticate with")
+		}
+		if followInterval <= 0 {
+			return nil, fmt.Errorf("FOLLOW_INTERVAL must be positive, got %s", followInterval)
+		}
+	}
+
+	warmupSeed := getEnv("WARMUP_SEED", "")
+	if strings.HasPrefix(warmupSeed, "http://") || strings.HasPrefix(warmupSeed, "https://") {
+		if u, err := url.Parse(warmupSeed); err != nil || u.Host == "" {
+			return nil, fmt.Errorf("WARMUP_SEED must be a file path or an http(s) URL, got %q", warmupSeed)
+		}
+	}
+
+	var adminBasicUser, adminBasicPassword string
+	if basic := getEnv("ADMIN_BASIC_AUTH", ""); basic != "" {
+		var ok bool
+		adminBasicUser, adminBasicPassword, ok = strings.Cut(basic, ":")
+		if !ok || adminBasicUser == "" || adminBasicPassword == "" {
+			return nil, fmt.Errorf("ADMIN_BASIC_AUTH must be user:password")
+		}
+	}
+
+	adminClientCAFile := getEnv("ADMIN_CLIENT_CA_FILE", "")
+	if adminClientCAFile != "" && tlsCertFile == "" {
+		return nil, fmt.Errorf("ADMIN_CLIENT_CA_FILE requires TLS_CERT_FILE")
+	}
+	adminConfigured := getEnv("ADMIN_TOKEN", "") != "" || adminJWTIssuer != "" || adminBasicUser != "" || adminClientCAFile != ""
+
+	upstreamOverrides, err := parseUpstreamOverrides(getEnv("UPSTREAM_OVERRIDES", ""))
+	if err != nil {
+		return nil, err
+	}
+	if len(upstreamOverrides) > 0 && !adminConfigured {
+		return nil, fmt.Errorf("UPSTREAM_OVERRIDES requires ADMIN_TOKEN, ADMIN_JWT_ISSUER, ADMIN_BASIC_AUTH or ADMIN_CLIENT_CA_FILE, which override requests authenticate with")
+	}
+
+	grpcPort := getEnv("GRPC_PORT", "")
+	if grpcPort != "" {
+		if n, err := strconv.Atoi(grpcPort); err != nil || n < 1 || n > 65535 {
+			return nil, fmt.Errorf("GRPC_PORT must be a port number, got %q", grpcPort)
+		}
+		if grpcPort == port || grpcPort == debugPort {
+			return nil, fmt.Errorf("GRPC_PORT must differ from PORT and DEBUG_PORT")
+		}
+		if !adminConfigured {
+			return nil, fmt.Errorf("GRPC_PORT requires ADMIN_TOKEN, ADMIN_JWT_ISSUER, ADMIN_BASIC_AUTH or ADMIN_CLIENT_CA_FILE")
+		}
+	}
+
+	var logLevel slog.Level
+	if err := logLevel.UnmarshalText([]byte(getEnv("LOG_LEVEL", "info"))); err != nil {
+		return nil, fmt.Errorf("invalid LOG_LEVEL: %w", err)
+	}
+	logFormat := getEnv("LOG_FORMAT", "json")
+	if logFormat != "json" && logFormat != "text" {
+		return nil, fmt.Errorf("LOG_FORMAT must be %q or %q, got %q", "json", "text", logFormat)
+	}
+
+	accessLogMaxSizeMB, err := strconv.Atoi(getEnv("ACCESS_LOG_MAX_SIZE_MB", "100"))
+	if err != nil {
+		return nil, err
+	}
+	if accessLogMaxSizeMB < 1 {
+		return nil, fmt.Errorf("ACCESS_LOG_MAX_SIZE_MB must be positive, got %d", accessLogMaxSizeMB)
+	}
+	accessLogMaxAge, err := time.ParseDuration(getEnv("ACCESS_LOG_MAX_AGE", "24h"))
+	if err != nil {
+		return nil, err
+	}
+	if accessLogMaxAge < 0 {
+		return nil, fmt.Errorf("ACCESS_LOG_MAX_AGE must not be negative, got %v", accessLogMaxAge)
+	}
+	accessLogMaxBackups, err := strconv.Atoi(getEnv("ACCESS_LOG_MAX_BACKUPS", "7"))
+	if err != nil {
+		return nil, err
+	}
+	if accessLogMaxBackups < 0 {
+		return nil, fmt.Errorf("ACCESS_LOG_MAX_BACKUPS must not be negative, got %d", accessLogMaxBackups)
+	}
+
+	tracesEndpoint, tracesHeaders, err := loadOTLP()
+	if err != nil {
+		return nil, err
+	}
+
+	instance, err := loadIdentity()
+	if err != nil {
+		return nil, err
+	}
+
+	maxCacheBytes, err := strconv.ParseInt(maxCacheBytesStr, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	allowedOrigins := splitList(getEnv("ALLOWED_ORIGINS", strings.Join(fc.AllowedOrigins, ",")))
+
+	corsMaxAge, err := time.ParseDuration(getEnv("CORS_MAX_AGE", "10m"))
+	if err != nil {
+		return nil, err
+	}
+	if corsMaxAge < 0 {
+		return nil, fmt.Errorf("CORS_MAX_AGE must not be negative, got %s", corsMaxAge)
+	}
+	preflightCacheTTL, err := time.ParseDuration(getEnv("PREFLIGHT_CACHE_TTL", "0s"))
+	if err != nil {
+		return nil, err
+	}
+	if preflightCacheTTL < 0 {
+		return nil, fmt.Errorf("PREFLIGHT_CACHE_TTL must not be negative, got %s", preflightCacheTTL)
 	}
 
 	return &Config{
@@ -50,14 +926,320 @@ func Load() (*Config, error) {
 		CacheDir:       cacheDir,
 		CacheTTL:       cacheTTL,
 		MaxCacheBytes:  maxCacheBytes,
-		UpstreamBase:   upstreamBase,
+		UpstreamBases:  upstreamBases,
 		AllowedOrigins: allowedOrigins,
+
+		CORSMaxAge:        corsMaxAge,
+		PreflightCacheTTL: preflightCacheTTL,
+
+		CacheKeyScheme: cacheKeyScheme,
+
+		CacheReportInterval: cacheReportInterval,
+
+		CacheJanitorInterval: cacheJanitorInterval,
+		CacheExpiryGrace:     cacheExpiryGrace,
+		CacheEvictionRate:    cacheEvictionRate,
+
+		TLSCertFile: tlsCertFile,
+		TLSKeyFile:  tlsKeyFile,
+		HTTP2:       http2,
+		H2C:         h2c,
+
+		MemoryCacheBytes: memoryCacheMB * 1024 * 1024,
+
+		StaleWhileRevalidate: staleWhileRevalidate,
+		NegativeTTL:          negativeTTL,
+		SuspectAfterFailures: suspectAfterFailures,
+
+		Avatars:        fc.Avatars,
+		LocalIdenticon: localIdenticon,
+
+		ShadowUpstream: getEnv("SHADOW_UPSTREAM", ""),
+		ShadowPercent:  shadowPercent,
+		ShadowMode:     shadowMode,
+
+		LocalResize:      localResize,
+		ResizeSourceSize: resizeSourceSize,
+		ResizeFilter:     getEnv("RESIZE_FILTER", "lanczos"),
+
+		UpstreamRegion:  upstreamRegion,
+		TrustedNetworks: splitList(getEnv("TRUSTED_NETWORKS", "")),
+
+		UpstreamOverrides: upstreamOverrides,
+
+		RateLimitRPS:   rateLimitRPS,
+		RateLimitBurst: rateLimitBurst,
+		TrustedProxies: splitList(getEnv("TRUSTED_PROXIES", "")),
+
+		RequestIDHeader: requestIDHeader,
+		RequestIDTrust:  requestIDTrust,
+
+		MaxURLLength: maxURLLength,
+
+		MaxHeaderBytes: maxHeaderBytes,
+
+		APIKeys:     splitList(getEnv("API_KEYS", "")),
+		APIKeyTiers: fc.APIKeyTiers,
+
+		UpstreamSourceAddr: getEnv("UPSTREAM_SOURCE_ADDR", ""),
+		UpstreamInterface:  getEnv("UPSTREAM_INTERFACE", ""),
+		UpstreamProxy:      upstreamProxy,
+		UpstreamPins:       upstreamPins,
+
+		UpstreamDNSServer:   upstreamDNSServer,
+		UpstreamHosts:       upstreamHosts,
+		UpstreamDNSCacheTTL: upstreamDNSCacheTTL,
+		UpstreamIPFamily:    upstreamIPFamily,
+
+		UpstreamMaxIdleConnsPerHost: maxIdleConnsPerHost,
+		UpstreamMaxIdleConns:        maxIdleConns,
+		UpstreamIdleConnTimeout:     idleConnTimeout,
+		UpstreamKeepAlive:           upstreamKeepAlive,
+		UpstreamAccept:              upstreamAccept,
+		UpstreamMaxHeaderBytes:      upstreamMaxHeaderBytes,
+		UpstreamMonthlyCap:          upstreamMonthlyCap,
+		MaxUpstreamBytes:            maxUpstreamBytes,
+		UpstreamContentCheck:        upstreamContentCheck,
+		FeatureFlags:                featureFlags,
+
+		UpstreamDialTimeout:   upstreamDialTimeout,
+		UpstreamTLSTimeout:    upstreamTLSTimeout,
+		UpstreamHeaderTimeout: upstreamHeaderTimeout,
+		UpstreamBodyTimeout:   upstreamBodyTimeout,
+		UpstreamTimeout:       upstreamTimeout,
+
+		UpstreamRetries:             upstreamRetries,
+		UpstreamRetryBackoff:        upstreamRetryBackoff,
+		UpstreamRetryBudget:         upstreamRetryBudget,
+		UpstreamRetryHeaderTimeouts: upstreamRetryHeaderTimeouts,
+
+		CircuitBreakerThreshold: circuitBreakerThreshold,
+		CircuitBreakerCooldown:  circuitBreakerCooldown,
+
+		FollowRedirects: followRedirects,
+
+		AvatarParams:      avatarParams,
+		PassthroughParams: splitList(getEnv("PASSTHROUGH_PARAMS", "")),
+
+		TranscodeFormats: splitList(getEnv("TRANSCODE_FORMATS", "")),
+		AVIFEncoder:      getEnv("AVIF_ENCODER", ""),
+
+		CompressEncodings: compressEncodings,
+
+		AdminToken:   getEnv("ADMIN_TOKEN", ""),
+		TombstoneTTL: tombstoneTTL,
+		PurgePeers:   splitList(getEnv("PURGE_PEERS", "")),
+		GRPCPort:     grpcPort,
+
+		FollowPrimary:  followPrimary,
+		FollowInterval: followInterval,
+		WarmupSeed:     warmupSeed,
+
+		AdminJWTIssuer:    adminJWTIssuer,
+		AdminJWTJWKSURL:   adminJWTJWKSURL,
+		AdminJWTAudience:  adminJWTAudience,
+		AdminJWTRoleClaim: getEnv("ADMIN_JWT_ROLE_CLAIM", "roles"),
+		AdminJWTRoles:     splitList(getEnv("ADMIN_JWT_ROLES", "")),
+
+		AdminBasicUser:     adminBasicUser,
+		AdminBasicPassword: adminBasicPassword,
+		AdminClientCAFile:  adminClientCAFile,
+
+		ShardPeers: splitList(getEnv("SHARD_PEERS", "")),
+		ShardSelf:  getEnv("SHARD_SELF", ""),
+
+		PeerDiscoverySRV:      getEnv("PEER_DISCOVERY_SRV", ""),
+		PeerDiscoveryScheme:   getEnv("PEER_DISCOVERY_SCHEME", "http"),
+		PeerDiscoveryInterval: peerDiscoveryInterval,
+
+		FallbackLadder: splitList(getEnv("FALLBACK_LADDER", DefaultFallbackLadder)),
+
+		RetryAfter: splitList(getEnv("RETRY_AFTER", "")),
+
+		ReadyCheckUpstream: readyCheckUpstream,
+
+		DebugEndpoints: debugEndpoints,
+		DebugPort:      debugPort,
+
+		SocketStats: socketStats,
+
+		LogLevel:      logLevel,
+		LogFormat:     logFormat,
+		LogQuietPaths: splitList(getEnv("LOG_QUIET_PATHS", "/healthz,/readyz")),
+
+		AccessLogFile:       getEnv("ACCESS_LOG_FILE", ""),
+		AuditLogFile:        getEnv("AUDIT_LOG_FILE", ""),
+		AccessLogMaxBytes:   int64(accessLogMaxSizeMB) << 20,
+		AccessLogMaxAge:     accessLogMaxAge,
+		AccessLogMaxBackups: accessLogMaxBackups,
+
+		TracesEndpoint: tracesEndpoint,
+		TracesHeaders:  tracesHeaders,
+		ServiceName:    getEnv("OTEL_SERVICE_NAME", "gravatar-proxy"),
+
+		Instance: instance,
 	}, nil
 }
 
+// validateAPIKeyTiers 检查等级的限制取值，且每个密钥名称最多属于一个等级
+func validateAPIKeyTiers(tiers map[string]APIKeyTier) error {
+	tierOf := make(map[string]string)
+	for name, tier := range tiers {
+		if tier.RateLimitRPS < 0 || tier.RateLimitBurst < 0 {
+			return fmt.Errorf("api_key_tiers.%s: rate limits must not be negative", name)
+		}
+		if tier.MaxSize < 0 {
+			return fmt.Errorf("api_key_tiers.%s: max_size must not be negative, got %d", name, tier.MaxSize)
+		}
+		for _, key := range tier.Keys {
+			if other, ok := tierOf[key]; ok {
+				return fmt.Errorf("API key %q is in both tier %q and tier %q", key, other, name)
+			}
+			tierOf[key] = name
+		}
+	}
+	return nil
+}
+
+// loadOTLP 按OpenTelemetry规范解析OTLP导出端点和请求头
+// 只支持http/json协议；OTEL_EXPORTER_OTLP_ENDPOINT为基础地址，会追加/v1/traces
+func loadOTLP() (string, map[string]string, error) {
+	disabled, err := strconv.ParseBool(getEnv("OTEL_SDK_DISABLED", "false"))
+	if err != nil {
+		return "", nil, err
+	}
+	if disabled || getEnv("OTEL_TRACES_EXPORTER", "otlp") == "none" {
+		return "", nil, nil
+	}
+
+	protocol := getEnv("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL", getEnv("OTEL_EXPORTER_OTLP_PROTOCOL", "http/json"))
+	endpoint := getEnv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	if endpoint == "" {
+		if base := getEnv("OTEL_EXPORTER_OTLP_ENDPOINT", ""); base != "" {
+			endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+		}
+	}
+	if endpoint == "" {
+		return "", nil, nil
+	}
+	if protocol != "http/json" {
+		return "", nil, fmt.Errorf("OTLP protocol %q is not supported, use http/json", protocol)
+	}
+
+	headers := make(map[string]string)
+	headerList := getEnv("OTEL_EXPORTER_OTLP_TRACES_HEADERS", getEnv("OTEL_EXPORTER_OTLP_HEADERS", ""))
+	for _, pair := range splitList(headerList) {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return "", nil, fmt.Errorf("invalid OTLP header %q, expected key=value", pair)
+		}
+		value, err := url.QueryUnescape(strings.TrimSpace(value))
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid OTLP header %q: %w", pair, err)
+		}
+		headers[strings.TrimSpace(key)] = value
+	}
+	return endpoint, headers, nil
+}
+
+// headerNamePattern 匹配HTTP请求头名称
+var headerNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9-]*$`)
+
+// upstreamOverridePattern 限制备选上游的名称，名称会出现在请求头、缓存键和日志中
+var upstreamOverridePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// parseUpstreamOverrides 解析name=url形式的备选上游列表
+func parseUpstreamOverrides(value string) (map[string]string, error) {
+	overrides := make(map[string]string)
+	for _, pair := range splitList(value) {
+		name, base, ok := strings.Cut(pair, "=")
+		name, base = strings.TrimSpace(name), strings.TrimSuffix(strings.TrimSpace(base), "/")
+		if !ok || !upstreamOverridePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid UPSTREAM_OVERRIDES entry %q, expected name=url with a lowercase name", pair)
+		}
+		if u, err := url.Parse(base); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return nil, fmt.Errorf("UPSTREAM_OVERRIDES entry %q must be an http(s) URL", name)
+		}
+		if _, dup := overrides[name]; dup {
+			return nil, fmt.Errorf("duplicate UPSTREAM_OVERRIDES name %q", name)
+		}
+		overrides[name] = base
+	}
+	return overrides, nil
+}
+
+// parseUpstreamPins 解析以逗号分隔的SPKI摘要，接受可选的"sha256/"前缀（与HPKP和curl --pinnedpubkey的写法相同）
+func parseUpstreamPins(value string) ([]string, error) {
+	var pins []string
+	for _, pin := range splitList(value) {
+		pin = strings.TrimPrefix(pin, "sha256/")
+		if digest, err := base64.StdEncoding.DecodeString(pin); err != nil || len(digest) != 32 {
+			return nil, fmt.Errorf("UPSTREAM_PIN_SHA256 entries must be base64-encoded SHA-256 digests, got %q", pin)
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+// parseUpstreamHosts 解析host=ip形式的静态映射，同一主机名可以出现多次以配置多个地址
+func parseUpstreamHosts(value string) (map[string][]string, error) {
+	hosts := make(map[string][]string)
+	for _, pair := range splitList(value) {
+		host, ip, ok := strings.Cut(pair, "=")
+		host, ip = strings.ToLower(strings.TrimSpace(host)), strings.TrimSpace(ip)
+		if !ok || host == "" || net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("invalid UPSTREAM_HOSTS entry %q, expected host=ip", pair)
+		}
+		hosts[host] = append(hosts[host], ip)
+	}
+	return hosts, nil
+}
+
+// parseTimeout 解析必须为正数的时长
+func parseTimeout(key string, defaultValue time.Duration) (time.Duration, error) {
+	d, err := time.ParseDuration(getEnv(key, defaultValue.String()))
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("%s must be positive, got %v", key, d)
+	}
+	return d, nil
+}
+
+// splitList 解析逗号分隔的列表，忽略空白项
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
 	}
 	return defaultValue
 }
+
+// parseFeatureFlags 解析FEATURE_FLAGS：逗号分隔的name=true|false，name须为Features之一
+func parseFeatureFlags(value string) (map[string]bool, error) {
+	flags := make(map[string]bool)
+	for _, item := range splitList(value) {
+		name, v, ok := strings.Cut(item, "=")
+		name = strings.TrimSpace(name)
+		if !ok || !slices.Contains(Features, name) {
+			return nil, fmt.Errorf("FEATURE_FLAGS entries must be name=true|false with name one of %s, got %q", strings.Join(Features, ", "), item)
+		}
+		enabled, err := strconv.ParseBool(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for feature %q in FEATURE_FLAGS: %q", name, v)
+		}
+		flags[name] = enabled
+	}
+	return flags, nil
+}
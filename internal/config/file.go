@@ -0,0 +1,68 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// AvatarConfig 配置本地生成头像的配色，颜色使用 #rgb 或 #rrggbb 格式
+type AvatarConfig struct {
+	Palette    []string `json:"palette"`
+	Background string   `json:"background"`
+	Foreground string   `json:"foreground"`
+}
+
+// APIKeyTier 为一组API密钥（按API_KEYS中的名称列在Keys中）的限制
+// RateLimitRPS大于0时每个密钥按自己的令牌桶限流，MaxSize大于0时限制请求的头像尺寸
+// Batch控制能否调用/prefetch，Transformations控制能否得到转码后的格式；未设置时都允许
+type APIKeyTier struct {
+	Keys            []string `json:"keys"`
+	RateLimitRPS    float64  `json:"rate_limit_rps"`
+	RateLimitBurst  int      `json:"rate_limit_burst"`
+	MaxSize         int      `json:"max_size"`
+	Batch           *bool    `json:"batch"`
+	Transformations *bool    `json:"transformations"`
+}
+
+// fileConfig 是 CONFIG_FILE 指向的JSON配置文件结构，承载不便用环境变量表达的设置
+// 以及可在运行时重新加载的设置；后者是同名环境变量未设置时的默认值
+type fileConfig struct {
+	Avatars AvatarConfig `json:"avatars"`
+
+	AllowedOrigins []string `json:"allowed_origins"`
+	CacheTTL       string   `json:"cache_ttl"`
+	UpstreamBase   []string `json:"upstream_base"`
+	RateLimitRPS   *float64 `json:"rate_limit_rps"`
+	RateLimitBurst *int     `json:"rate_limit_burst"`
+
+	APIKeyTiers map[string]APIKeyTier `json:"api_key_tiers"`
+}
+
+// orDefault 在配置文件未设置该项时返回defaultValue
+func orDefault(value, defaultValue string) string {
+	if value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func loadFile(path string) (*fileConfig, error) {
+	fc := &fileConfig{}
+	if path == "" {
+		return fc, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(fc); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return fc, nil
+}
@@ -0,0 +1,72 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// zoneLabel 是Kubernetes节点和Pod上表示可用区的标准标签
+const zoneLabel = "topology.kubernetes.io/zone"
+
+// Identity 标识集群中的一个实例，附加到日志、指标标签和节点发现的健康检查响应中
+type Identity struct {
+	Name string `json:"instance"`
+	Zone string `json:"zone,omitempty"`
+}
+
+// loadIdentity 依次从INSTANCE_NAME、POD_NAME（downward API的metadata.name）和主机名取得实例名
+// 可用区取自INSTANCE_ZONE，未设置时读取downward API挂载的标签文件中的topology.kubernetes.io/zone
+func loadIdentity() (Identity, error) {
+	name := getEnv("INSTANCE_NAME", os.Getenv("POD_NAME"))
+	if name == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return Identity{}, fmt.Errorf("failed to determine instance name: %w", err)
+		}
+		name = hostname
+	}
+
+	zone := os.Getenv("INSTANCE_ZONE")
+	if zone == "" {
+		labels, err := readLabelsFile(getEnv("PODINFO_LABELS", "/etc/podinfo/labels"))
+		if err != nil {
+			return Identity{}, err
+		}
+		zone = labels[zoneLabel]
+	}
+
+	return Identity{Name: name, Zone: zone}, nil
+}
+
+// readLabelsFile 解析downward API的标签文件（每行 key="value"），文件不存在时返回空
+func readLabelsFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open labels file: %w", err)
+	}
+	defer f.Close()
+
+	labels := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, quoted, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok {
+			continue
+		}
+		value, err := strconv.Unquote(quoted)
+		if err != nil {
+			return nil, fmt.Errorf("invalid label %q in %s: %w", key, path, err)
+		}
+		labels[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read labels file: %w", err)
+	}
+	return labels, nil
+}
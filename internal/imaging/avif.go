@@ -0,0 +1,76 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// avifTimeout 限制一次外部AVIF编码的耗时
+const avifTimeout = 10 * time.Second
+
+// AVIFEncoder 返回调用外部命令（如libavif的avifenc）编码AVIF的编码器
+// AVIF没有纯Go编码器；command可带参数，如 "avifenc -s 8"，调用时在末尾追加输入PNG和输出文件路径
+func AVIFEncoder(command string) (Encoder, error) {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty AVIF encoder command")
+	}
+	path, err := exec.LookPath(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("AVIF encoder %q not found: %w", fields[0], err)
+	}
+	args := fields[1:]
+
+	return func(w io.Writer, img image.Image) error {
+		dir, err := os.MkdirTemp("", "avif-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+
+		input := filepath.Join(dir, "input.png")
+		output := filepath.Join(dir, "output.avif")
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			return err
+		}
+		if err := os.WriteFile(input, buf.Bytes(), 0600); err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), avifTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, path, append(append([]string{}, args...), input, output)...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("AVIF encoder failed: %w: %s", err, bytes.TrimSpace(out))
+		}
+
+		data, err := os.ReadFile(output)
+		if err != nil {
+			return err
+		}
+		if !isAVIF(data) {
+			return fmt.Errorf("AVIF encoder did not produce an AVIF file")
+		}
+		_, err = w.Write(data)
+		return err
+	}, nil
+}
+
+// isAVIF 检查ISOBMFF的ftyp box是否声明avif品牌
+func isAVIF(data []byte) bool {
+	if len(data) < 12 || string(data[4:8]) != "ftyp" {
+		return false
+	}
+	brand := string(data[8:12])
+	return brand == "avif" || brand == "avis"
+}
@@ -0,0 +1,214 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+
+	_ "image/gif"
+)
+
+var ErrUnknownFilter = errors.New("unknown resize filter")
+
+// Filter 是可分离的重采样核，Support为核半径（以源像素为单位）
+type Filter struct {
+	Name    string
+	Support float64
+	Kernel  func(x float64) float64
+}
+
+var (
+	Bilinear = Filter{Name: "bilinear", Support: 1, Kernel: func(x float64) float64 {
+		x = math.Abs(x)
+		if x < 1 {
+			return 1 - x
+		}
+		return 0
+	}}
+
+	Lanczos = Filter{Name: "lanczos", Support: 3, Kernel: func(x float64) float64 {
+		x = math.Abs(x)
+		if x == 0 {
+			return 1
+		}
+		if x < 3 {
+			return sinc(x) * sinc(x/3)
+		}
+		return 0
+	}}
+)
+
+func ParseFilter(name string) (Filter, error) {
+	switch name {
+	case "bilinear":
+		return Bilinear, nil
+	case "lanczos", "":
+		return Lanczos, nil
+	}
+	return Filter{}, fmt.Errorf("%w: %s", ErrUnknownFilter, name)
+}
+
+func sinc(x float64) float64 {
+	x *= math.Pi
+	return math.Sin(x) / x
+}
+
+// Resize 将图片缩放到width×height，先横向再纵向两次一维卷积
+// 缩小时按比例放大核半径，相当于先低通再采样，避免锯齿
+func Resize(src image.Image, width, height int, f Filter) *image.NRGBA {
+	b := src.Bounds()
+	in := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			in.Set(x, y, src.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+
+	tmp := resample(in, width, b.Dy(), f, true)
+	return resample(tmp, width, height, f, false)
+}
+
+// resample 沿一个方向重采样，horizontal为true时改变宽度，否则改变高度
+func resample(src *image.NRGBA, width, height int, f Filter, horizontal bool) *image.NRGBA {
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+
+	srcLen, dstLen := src.Bounds().Dy(), height
+	if horizontal {
+		srcLen, dstLen = src.Bounds().Dx(), width
+	}
+
+	scale := float64(srcLen) / float64(dstLen)
+	filterScale := math.Max(scale, 1)
+	support := f.Support * filterScale
+
+	weights := make([][]float64, dstLen)
+	starts := make([]int, dstLen)
+	for i := 0; i < dstLen; i++ {
+		center := (float64(i)+0.5)*scale - 0.5
+		start := int(math.Ceil(center - support))
+		end := int(math.Floor(center + support))
+		if start < 0 {
+			start = 0
+		}
+		if end > srcLen-1 {
+			end = srcLen - 1
+		}
+
+		w := make([]float64, end-start+1)
+		var sum float64
+		for j := range w {
+			w[j] = f.Kernel((float64(start+j) - center) / filterScale)
+			sum += w[j]
+		}
+		if sum != 0 {
+			for j := range w {
+				w[j] /= sum
+			}
+		}
+		weights[i], starts[i] = w, start
+	}
+
+	other := width
+	if horizontal {
+		other = height
+	}
+
+	for o := 0; o < other; o++ {
+		for i := 0; i < dstLen; i++ {
+			var r, g, bl, a float64
+			for j, w := range weights[i] {
+				var off int
+				if horizontal {
+					off = src.PixOffset(starts[i]+j, o)
+				} else {
+					off = src.PixOffset(o, starts[i]+j)
+				}
+				pa := float64(src.Pix[off+3])
+				// 按alpha预乘后再加权，避免透明像素的颜色渗入
+				r += w * float64(src.Pix[off]) * pa
+				g += w * float64(src.Pix[off+1]) * pa
+				bl += w * float64(src.Pix[off+2]) * pa
+				a += w * pa
+			}
+
+			var c color.NRGBA
+			if a > 0 {
+				c = color.NRGBA{R: clamp(r / a), G: clamp(g / a), B: clamp(bl / a), A: clamp(a)}
+			}
+			if horizontal {
+				dst.SetNRGBA(i, o, c)
+			} else {
+				dst.SetNRGBA(o, i, c)
+			}
+		}
+	}
+	return dst
+}
+
+func clamp(v float64) uint8 {
+	v = math.Round(v)
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return uint8(v)
+}
+
+// ResizeBytes 解码图片并缩放为size×size，JPEG保持JPEG，其他格式输出PNG
+func ResizeBytes(data []byte, size int, f Filter) ([]byte, string, error) {
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	resized := Resize(img, size, size, f)
+
+	var buf bytes.Buffer
+	if format == "jpeg" {
+		if err := jpeg.Encode(&buf, resized, &jpeg.Options{Quality: 90}); err != nil {
+			return nil, "", fmt.Errorf("failed to encode jpeg: %w", err)
+		}
+		return buf.Bytes(), "image/jpeg", nil
+	}
+
+	if err := png.Encode(&buf, resized); err != nil {
+		return nil, "", fmt.Errorf("failed to encode png: %w", err)
+	}
+	return buf.Bytes(), "image/png", nil
+}
+
+// Encoder 将图片编码为某种输出格式
+type Encoder func(io.Writer, image.Image) error
+
+// encoders 是内置的转码输出格式，目前只有纯Go实现的无损WebP；AVIF需要外部编码器，见AVIFEncoder
+var encoders = map[string]Encoder{
+	"image/webp": EncodeWebP,
+}
+
+// BuiltinEncoder 返回指定MIME类型的内置编码器
+func BuiltinEncoder(mimeType string) (Encoder, bool) {
+	encode, ok := encoders[mimeType]
+	return encode, ok
+}
+
+// Transcode 解码图片并用encode重新编码
+func Transcode(data []byte, encode Encoder) ([]byte, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	var buf bytes.Buffer
+	if err := encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("failed to encode: %w", err)
+	}
+	return buf.Bytes(), nil
+}
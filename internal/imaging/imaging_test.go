@@ -0,0 +1,118 @@
+package imaging
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestResizeSolidColor(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			src.Set(x, y, color.NRGBA{R: 200, G: 100, B: 50, A: 255})
+		}
+	}
+
+	for _, f := range []Filter{Bilinear, Lanczos} {
+		t.Run(f.Name, func(t *testing.T) {
+			for _, size := range []int{16, 100} {
+				dst := Resize(src, size, size, f)
+				if dst.Bounds().Dx() != size || dst.Bounds().Dy() != size {
+					t.Fatalf("expected %dx%d, got %v", size, size, dst.Bounds())
+				}
+				if c := dst.NRGBAAt(size/2, size/2); c != (color.NRGBA{R: 200, G: 100, B: 50, A: 255}) {
+					t.Errorf("expected solid color preserved at size %d, got %v", size, c)
+				}
+			}
+		})
+	}
+}
+
+func TestResizeBytes(t *testing.T) {
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 32, 32)))
+
+	out, contentType, err := ResizeBytes(buf.Bytes(), 8, Lanczos)
+	if err != nil {
+		t.Fatalf("failed to resize: %v", err)
+	}
+	if contentType != "image/png" {
+		t.Errorf("expected image/png, got %s", contentType)
+	}
+
+	img, err := png.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("failed to decode output: %v", err)
+	}
+	if img.Bounds().Dx() != 8 {
+		t.Errorf("expected width 8, got %d", img.Bounds().Dx())
+	}
+
+	if _, _, err := ResizeBytes([]byte("not an image"), 8, Lanczos); err == nil {
+		t.Error("expected error for invalid image data")
+	}
+}
+
+// fakeAVIFEncoder 写出一个模拟avifenc的shell脚本，返回其路径
+func fakeAVIFEncoder(t *testing.T, script string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake encoder is a shell script")
+	}
+	path := filepath.Join(t.TempDir(), "avifenc")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAVIFEncoder(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	src.SetNRGBA(3, 4, color.NRGBA{R: 10, G: 20, B: 30, A: 255})
+
+	command := fakeAVIFEncoder(t, `[ "$1" = "-s" ] || exit 2; { printf '\000\000\000\024ftypavif\000\000\000\000mif1'; cat "$3"; } > "$4"`)
+	encode, err := AVIFEncoder(command + " -s 8")
+	if err != nil {
+		t.Fatalf("failed to create encoder: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := encode(&buf, src); err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	out := buf.Bytes()
+	if !isAVIF(out) {
+		t.Fatalf("expected an AVIF ftyp header, got %q", out[:min(len(out), 12)])
+	}
+	decoded, err := png.Decode(bytes.NewReader(out[20:]))
+	if err != nil {
+		t.Fatalf("expected the encoder to receive a PNG: %v", err)
+	}
+	if c := color.NRGBAModel.Convert(decoded.At(3, 4)); c != (color.NRGBA{R: 10, G: 20, B: 30, A: 255}) {
+		t.Errorf("expected the source pixels to reach the encoder, got %v", c)
+	}
+
+	failing, err := AVIFEncoder(fakeAVIFEncoder(t, `echo broken >&2; exit 1`))
+	if err != nil {
+		t.Fatalf("failed to create encoder: %v", err)
+	}
+	if err := failing(&bytes.Buffer{}, src); err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("expected the encoder's failure output in the error, got %v", err)
+	}
+
+	notAVIF, _ := AVIFEncoder(fakeAVIFEncoder(t, `cp "$1" "$2"`))
+	if err := notAVIF(&bytes.Buffer{}, src); err == nil {
+		t.Error("expected output without an AVIF header to be rejected")
+	}
+
+	if _, err := AVIFEncoder(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected a missing encoder command to be rejected")
+	}
+}
@@ -0,0 +1,488 @@
+package imaging
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io"
+	"sort"
+)
+
+// 纯Go实现的无损WebP（VP8L）编码器，只用到格式中的一部分特性：
+// 减绿变换、按块选择的预测变换和每通道一套前缀码，不使用颜色缓存和向后引用
+
+const (
+	vp8lSignature = 0x2f
+
+	transformPredictor     = 0
+	transformSubtractGreen = 2
+
+	predictorBits = 4
+
+	numLiteralCodes  = 256
+	numLengthCodes   = 24
+	numDistanceCodes = 40
+
+	maxCodeLength           = 15
+	maxCodeLengthCodeLength = 7
+)
+
+var codeLengthCodeOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// 候选预测模式：1=左，2=上，7=左和上的平均
+var predictorModes = []int{1, 2, 7}
+
+// EncodeWebP 将图片编码为无损WebP
+func EncodeWebP(w io.Writer, img image.Image) error {
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+
+	argb := make([]uint32, width*height)
+	hasAlpha := false
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.NRGBAModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.NRGBA)
+			if c.A != 0xff {
+				hasAlpha = true
+			}
+			argb[y*width+x] = uint32(c.A)<<24 | uint32(c.R)<<16 | uint32(c.G)<<8 | uint32(c.B)
+		}
+	}
+
+	bw := &bitWriter{}
+	bw.writeBits(vp8lSignature, 8)
+	bw.writeBits(uint32(width-1), 14)
+	bw.writeBits(uint32(height-1), 14)
+	if hasAlpha {
+		bw.writeBits(1, 1)
+	} else {
+		bw.writeBits(0, 1)
+	}
+	bw.writeBits(0, 3)
+
+	// 变换按写入顺序正向应用，解码器逆序还原
+	bw.writeBits(1, 1)
+	bw.writeBits(transformSubtractGreen, 2)
+	subtractGreen(argb)
+
+	bw.writeBits(1, 1)
+	bw.writeBits(transformPredictor, 2)
+	bw.writeBits(predictorBits-2, 3)
+	modes, tilesX := choosePredictors(argb, width, height)
+	residuals := applyPredictors(argb, width, height, modes, tilesX)
+	writeEntropyImage(bw, modeImage(modes), false)
+
+	bw.writeBits(0, 1)
+	writeEntropyImage(bw, residuals, true)
+
+	data := bw.bytes()
+	chunkSize := len(data)
+	padded := chunkSize + chunkSize&1
+
+	var out bytes.Buffer
+	out.WriteString("RIFF")
+	binary.Write(&out, binary.LittleEndian, uint32(4+8+padded))
+	out.WriteString("WEBPVP8L")
+	binary.Write(&out, binary.LittleEndian, uint32(chunkSize))
+	out.Write(data)
+	if chunkSize&1 == 1 {
+		out.WriteByte(0)
+	}
+
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+func subtractGreen(argb []uint32) {
+	for i, p := range argb {
+		g := (p >> 8) & 0xff
+		r := ((p >> 16) - g) & 0xff
+		bl := (p - g) & 0xff
+		argb[i] = p&0xff00ff00 | r<<16 | bl
+	}
+}
+
+func subPixels(a, b uint32) uint32 {
+	ag := 0x00ff00ff + (a & 0xff00ff00) - (b & 0xff00ff00)
+	rb := 0xff00ff00 + (a & 0x00ff00ff) - (b & 0x00ff00ff)
+	return (ag & 0xff00ff00) | (rb & 0x00ff00ff)
+}
+
+func average2(a, b uint32) uint32 {
+	return (((a ^ b) & 0xfefefefe) >> 1) + (a & b)
+}
+
+// predict 计算(x,y)处的预测值，首行首列的规则与模式无关
+func predict(argb []uint32, width, x, y, mode int) uint32 {
+	switch {
+	case x == 0 && y == 0:
+		return 0xff000000
+	case y == 0:
+		return argb[x-1]
+	case x == 0:
+		return argb[(y-1)*width]
+	}
+
+	left := argb[y*width+x-1]
+	top := argb[(y-1)*width+x]
+	switch mode {
+	case 1:
+		return left
+	case 2:
+		return top
+	default:
+		return average2(left, top)
+	}
+}
+
+func residualCost(r uint32) int {
+	cost := 0
+	for shift := 0; shift < 32; shift += 8 {
+		v := int((r >> shift) & 0xff)
+		if v > 128 {
+			v = 256 - v
+		}
+		cost += v
+	}
+	return cost
+}
+
+// choosePredictors 为每个块选择残差绝对值之和最小的预测模式
+func choosePredictors(argb []uint32, width, height int) ([]int, int) {
+	tile := 1 << predictorBits
+	tilesX := (width + tile - 1) / tile
+	tilesY := (height + tile - 1) / tile
+	modes := make([]int, tilesX*tilesY)
+
+	for ty := 0; ty < tilesY; ty++ {
+		for tx := 0; tx < tilesX; tx++ {
+			best, bestCost := predictorModes[0], -1
+			for _, mode := range predictorModes {
+				cost := 0
+				for y := ty * tile; y < (ty+1)*tile && y < height; y++ {
+					for x := tx * tile; x < (tx+1)*tile && x < width; x++ {
+						cost += residualCost(subPixels(argb[y*width+x], predict(argb, width, x, y, mode)))
+					}
+				}
+				if bestCost < 0 || cost < bestCost {
+					best, bestCost = mode, cost
+				}
+			}
+			modes[ty*tilesX+tx] = best
+		}
+	}
+	return modes, tilesX
+}
+
+func applyPredictors(argb []uint32, width, height int, modes []int, tilesX int) []uint32 {
+	residuals := make([]uint32, len(argb))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			mode := modes[(y>>predictorBits)*tilesX+(x>>predictorBits)]
+			residuals[y*width+x] = subPixels(argb[y*width+x], predict(argb, width, x, y, mode))
+		}
+	}
+	return residuals
+}
+
+// modeImage 将预测模式存入子图像的绿色通道
+func modeImage(modes []int) []uint32 {
+	pixels := make([]uint32, len(modes))
+	for i, mode := range modes {
+		pixels[i] = 0xff000000 | uint32(mode)<<8
+	}
+	return pixels
+}
+
+// writeEntropyImage 写出熵编码图像：颜色缓存标志、（主图像的）元前缀码标志、5套前缀码和像素
+func writeEntropyImage(bw *bitWriter, pixels []uint32, mainImage bool) {
+	bw.writeBits(0, 1)
+	if mainImage {
+		bw.writeBits(0, 1)
+	}
+
+	green := make([]int, numLiteralCodes+numLengthCodes)
+	red := make([]int, numLiteralCodes)
+	blue := make([]int, numLiteralCodes)
+	alpha := make([]int, numLiteralCodes)
+	distance := make([]int, numDistanceCodes)
+	for _, p := range pixels {
+		alpha[p>>24]++
+		red[(p>>16)&0xff]++
+		green[(p>>8)&0xff]++
+		blue[p&0xff]++
+	}
+
+	codes := make([]*prefixCode, 0, 5)
+	for _, histogram := range [][]int{green, red, blue, alpha, distance} {
+		code := buildPrefixCode(histogram, maxCodeLength)
+		code.write(bw)
+		codes = append(codes, code)
+	}
+
+	for _, p := range pixels {
+		codes[0].writeSymbol(bw, int((p>>8)&0xff))
+		codes[1].writeSymbol(bw, int((p>>16)&0xff))
+		codes[2].writeSymbol(bw, int(p&0xff))
+		codes[3].writeSymbol(bw, int(p>>24))
+	}
+}
+
+type bitWriter struct {
+	buf   []byte
+	acc   uint64
+	nbits uint
+}
+
+func (w *bitWriter) writeBits(v uint32, n uint) {
+	w.acc |= uint64(v) << w.nbits
+	w.nbits += n
+	for w.nbits >= 8 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc >>= 8
+		w.nbits -= 8
+	}
+}
+
+func (w *bitWriter) bytes() []byte {
+	if w.nbits > 0 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc, w.nbits = 0, 0
+	}
+	return w.buf
+}
+
+// prefixCode 是规范哈夫曼码，codes中保存按位反转后的码字以便低位优先写出
+type prefixCode struct {
+	lengths []int
+	codes   []uint32
+	used    []int
+}
+
+func buildPrefixCode(histogram []int, limit int) *prefixCode {
+	pc := &prefixCode{lengths: huffmanLengths(histogram, limit)}
+	for symbol, n := range histogram {
+		if n > 0 {
+			pc.used = append(pc.used, symbol)
+		}
+	}
+	pc.codes = canonicalCodes(pc.lengths)
+	return pc
+}
+
+// writeSymbol 写出符号；只有一个符号的码在解码端不消耗任何比特
+func (pc *prefixCode) writeSymbol(bw *bitWriter, symbol int) {
+	if len(pc.used) <= 1 {
+		return
+	}
+	bw.writeBits(pc.codes[symbol], uint(pc.lengths[symbol]))
+}
+
+func (pc *prefixCode) write(bw *bitWriter) {
+	if len(pc.used) <= 2 && (len(pc.used) == 0 || pc.used[len(pc.used)-1] < numLiteralCodes) {
+		pc.writeSimple(bw)
+		return
+	}
+	pc.writeNormal(bw)
+}
+
+// writeSimple 直接写出最多两个符号，每个符号码长为1
+func (pc *prefixCode) writeSimple(bw *bitWriter) {
+	symbols := pc.used
+	if len(symbols) == 0 {
+		symbols = []int{0}
+	}
+
+	bw.writeBits(1, 1)
+	bw.writeBits(uint32(len(symbols)-1), 1)
+	if symbols[0] < 2 {
+		bw.writeBits(0, 1)
+		bw.writeBits(uint32(symbols[0]), 1)
+	} else {
+		bw.writeBits(1, 1)
+		bw.writeBits(uint32(symbols[0]), 8)
+	}
+	if len(symbols) == 2 {
+		bw.writeBits(uint32(symbols[1]), 8)
+	}
+}
+
+// writeNormal 用码长码写出每个符号的码长，连续的0用17/18压缩
+func (pc *prefixCode) writeNormal(bw *bitWriter) {
+	type token struct{ code, extra, extraBits int }
+	var tokens []token
+
+	lengths := pc.lengths
+	for i := 0; i < len(lengths); {
+		if lengths[i] != 0 {
+			tokens = append(tokens, token{code: lengths[i]})
+			i++
+			continue
+		}
+
+		run := 0
+		for i+run < len(lengths) && lengths[i+run] == 0 {
+			run++
+		}
+		i += run
+		for run > 0 {
+			switch {
+			case run >= 11:
+				n := min(run, 138)
+				tokens = append(tokens, token{code: 18, extra: n - 11, extraBits: 7})
+				run -= n
+			case run >= 3:
+				tokens = append(tokens, token{code: 17, extra: run - 3, extraBits: 3})
+				run = 0
+			default:
+				tokens = append(tokens, token{code: 0})
+				run--
+			}
+		}
+	}
+
+	histogram := make([]int, len(codeLengthCodeOrder))
+	for _, t := range tokens {
+		histogram[t.code]++
+	}
+	lengthCode := buildPrefixCode(histogram, maxCodeLengthCodeLength)
+
+	numCodes := len(codeLengthCodeOrder)
+	for numCodes > 4 && lengthCode.lengths[codeLengthCodeOrder[numCodes-1]] == 0 {
+		numCodes--
+	}
+
+	bw.writeBits(0, 1)
+	bw.writeBits(uint32(numCodes-4), 4)
+	for i := 0; i < numCodes; i++ {
+		bw.writeBits(uint32(lengthCode.lengths[codeLengthCodeOrder[i]]), 3)
+	}
+	bw.writeBits(0, 1)
+
+	for _, t := range tokens {
+		lengthCode.writeSymbol(bw, t.code)
+		if t.extraBits > 0 {
+			bw.writeBits(uint32(t.extra), uint(t.extraBits))
+		}
+	}
+}
+
+type huffmanNode struct {
+	count  int
+	symbol int
+	left   *huffmanNode
+	right  *huffmanNode
+}
+
+type nodeHeap []*huffmanNode
+
+func (h nodeHeap) Len() int { return len(h) }
+func (h nodeHeap) Less(i, j int) bool {
+	if h[i].count != h[j].count {
+		return h[i].count < h[j].count
+	}
+	return h[i].symbol < h[j].symbol
+}
+func (h nodeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *nodeHeap) Push(x any)   { *h = append(*h, x.(*huffmanNode)) }
+func (h *nodeHeap) Pop() any {
+	old := *h
+	n := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return n
+}
+
+// huffmanLengths 计算不超过limit的哈夫曼码长
+// 超长时提高低频符号的计数下限后重建，与libwebp的做法相同
+func huffmanLengths(histogram []int, limit int) []int {
+	lengths := make([]int, len(histogram))
+
+	used := 0
+	for _, n := range histogram {
+		if n > 0 {
+			used++
+		}
+	}
+	if used == 0 {
+		return lengths
+	}
+	if used == 1 {
+		for symbol, n := range histogram {
+			if n > 0 {
+				lengths[symbol] = 1
+			}
+		}
+		return lengths
+	}
+
+	for floor := 1; ; floor *= 2 {
+		h := make(nodeHeap, 0, used)
+		for symbol, n := range histogram {
+			if n > 0 {
+				h = append(h, &huffmanNode{count: max(n, floor), symbol: symbol})
+			}
+		}
+		heap.Init(&h)
+		next := len(histogram)
+		for h.Len() > 1 {
+			a := heap.Pop(&h).(*huffmanNode)
+			b := heap.Pop(&h).(*huffmanNode)
+			heap.Push(&h, &huffmanNode{count: a.count + b.count, symbol: next, left: a, right: b})
+			next++
+		}
+
+		for i := range lengths {
+			lengths[i] = 0
+		}
+		maxLen := assignLengths(h[0], 0, lengths)
+		if maxLen <= limit {
+			return lengths
+		}
+	}
+}
+
+func assignLengths(n *huffmanNode, depth int, lengths []int) int {
+	if n.left == nil {
+		lengths[n.symbol] = depth
+		return depth
+	}
+	return max(assignLengths(n.left, depth+1, lengths), assignLengths(n.right, depth+1, lengths))
+}
+
+// canonicalCodes 按(码长, 符号)顺序分配规范码并按位反转
+func canonicalCodes(lengths []int) []uint32 {
+	symbols := make([]int, 0, len(lengths))
+	for symbol, l := range lengths {
+		if l > 0 {
+			symbols = append(symbols, symbol)
+		}
+	}
+	sort.Slice(symbols, func(i, j int) bool {
+		if lengths[symbols[i]] != lengths[symbols[j]] {
+			return lengths[symbols[i]] < lengths[symbols[j]]
+		}
+		return symbols[i] < symbols[j]
+	})
+
+	codes := make([]uint32, len(lengths))
+	code, prevLen := uint32(0), 0
+	for i, symbol := range symbols {
+		l := lengths[symbol]
+		if i > 0 {
+			code = (code + 1) << uint(l-prevLen)
+		}
+		prevLen = l
+		codes[symbol] = reverseBits(code, l)
+	}
+	return codes
+}
+
+func reverseBits(v uint32, n int) uint32 {
+	var r uint32
+	for i := 0; i < n; i++ {
+		r = r<<1 | (v>>uint(i))&1
+	}
+	return r
+}
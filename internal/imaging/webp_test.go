@@ -0,0 +1,63 @@
+package imaging
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+// 用golang.org/x/image/webp这个独立的解码器校验编码结果
+func TestEncodeWebPRoundTrip(t *testing.T) {
+	gradient := image.NewNRGBA(image.Rect(0, 0, 37, 29))
+	for y := 0; y < 29; y++ {
+		for x := 0; x < 37; x++ {
+			gradient.SetNRGBA(x, y, color.NRGBA{R: uint8(x * 7), G: uint8(y * 9), B: uint8((x * y) % 251), A: uint8(255 - x)})
+		}
+	}
+
+	noise := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	seed := uint32(1)
+	for i := range noise.Pix {
+		seed = seed*1664525 + 1013904223
+		noise.Pix[i] = uint8(seed >> 24)
+	}
+
+	solid := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	for i := range solid.Pix {
+		solid.Pix[i] = 0xff
+	}
+
+	tests := map[string]*image.NRGBA{
+		"gradient": gradient,
+		"noise":    noise,
+		"solid":    solid,
+		"1x1":      image.NewNRGBA(image.Rect(0, 0, 1, 1)),
+	}
+
+	for name, src := range tests {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := EncodeWebP(&buf, src); err != nil {
+				t.Fatalf("failed to encode: %v", err)
+			}
+
+			decoded, err := webp.Decode(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("failed to decode: %v", err)
+			}
+			got, ok := decoded.(*image.NRGBA)
+			if !ok {
+				t.Fatalf("expected an NRGBA image, got %T", decoded)
+			}
+			if got.Bounds() != src.Bounds() {
+				t.Fatalf("expected bounds %v, got %v", src.Bounds(), got.Bounds())
+			}
+			if !bytes.Equal(got.Pix, src.Pix) {
+				t.Error("decoded pixels differ from source")
+			}
+		})
+	}
+}
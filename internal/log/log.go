@@ -2,17 +2,80 @@ package log
 
 import (
 	"context"
+	"io"
 	"log/slog"
 	"os"
 	"time"
 )
 
-var logger *slog.Logger
+// 日志输出格式
+const (
+	FormatJSON = "json"
+	FormatText = "text"
+)
+
+// Options 配置日志级别、输出格式，以及请求日志降为Debug级别的路径（如健康检查）
+// AccessLog非nil时请求日志单独写入其中，AuditLog非nil时审计日志单独写入其中，其余诊断日志仍写标准输出
+type Options struct {
+	Level      slog.Level
+	Format     string
+	QuietPaths []string
+	AccessLog  io.Writer
+	AuditLog   io.Writer
+}
+
+// 加载配置前使用Info级别的JSON日志；accessLogger为nil时请求日志与诊断日志一起输出
+var (
+	logger       = New(os.Stdout, Options{Level: slog.LevelInfo, Format: FormatJSON})
+	accessLogger *slog.Logger
+	auditLogger  = newAuditLogger(os.Stdout, FormatJSON)
+	quietPaths   map[string]bool
+)
+
+// New 按opts构造写入w的日志记录器，未知的格式按JSON处理
+func New(w io.Writer, opts Options) *slog.Logger {
+	handlerOpts := &slog.HandlerOptions{Level: opts.Level}
+	if opts.Format == FormatText {
+		return slog.New(slog.NewTextHandler(w, handlerOpts))
+	}
+	return slog.New(slog.NewJSONHandler(w, handlerOpts))
+}
+
+// Configure 用opts替换全局日志记录器，应在SetDefaultAttrs之前、开始处理请求前调用
+func Configure(opts Options) {
+	logger = New(os.Stdout, opts)
+	accessLogger = nil
+	if opts.AccessLog != nil {
+		accessLogger = New(opts.AccessLog, opts)
+	}
+	auditWriter := opts.AuditLog
+	if auditWriter == nil {
+		auditWriter = os.Stdout
+	}
+	auditLogger = newAuditLogger(auditWriter, opts.Format)
+	quietPaths = make(map[string]bool, len(opts.QuietPaths))
+	for _, path := range opts.QuietPaths {
+		quietPaths[path] = true
+	}
+}
+
+// SetDefaultAttrs 为之后的所有日志附加固定属性（如实例名），应在启动时、开始处理请求前调用
+func SetDefaultAttrs(args ...any) {
+	logger = logger.With(args...)
+	if accessLogger != nil {
+		accessLogger = accessLogger.With(args...)
+	}
+	auditLogger = auditLogger.With(args...)
+}
+
+// newAuditLogger 构造审计日志记录器：每条记录带log=audit以便与其他日志区分，不受LOG_LEVEL影响
+func newAuditLogger(w io.Writer, format string) *slog.Logger {
+	return New(w, Options{Level: slog.LevelInfo, Format: format}).With("log", "audit")
+}
 
-func init() {
-	logger = slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
-		Level: slog.LevelInfo,
-	}))
+// Audit 记录一次被拒绝的请求，reason为拒绝原因，args为请求的来源信息
+func Audit(reason string, args ...any) {
+	auditLogger.Info("request denied", append([]any{"reason", reason}, args...)...)
 }
 
 func Info(msg string, args ...any) {
@@ -35,14 +98,23 @@ func With(args ...any) *slog.Logger {
 	return logger.With(args...)
 }
 
-func LogRequest(method, path string, statusCode int, duration time.Duration, requestID string) {
-	logger.Info("request",
+// LogRequest 记录一次请求；QuietPaths中的路径按Debug级别记录，默认不输出。args为附加在固定字段之后的字段
+func LogRequest(method, path string, statusCode int, duration time.Duration, requestID string, args ...any) {
+	level := slog.LevelInfo
+	if quietPaths[path] {
+		level = slog.LevelDebug
+	}
+	l := logger
+	if accessLogger != nil {
+		l = accessLogger
+	}
+	l.Log(context.Background(), level, "request", append([]any{
 		"request_id", requestID,
 		"method", method,
 		"path", path,
 		"status", statusCode,
 		"duration_ms", duration.Milliseconds(),
-	)
+	}, args...)...)
 }
 
 func FromContext(ctx context.Context) *slog.Logger {
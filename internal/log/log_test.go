@@ -0,0 +1,92 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewLevel(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, Options{Level: slog.LevelWarn, Format: FormatJSON})
+	l.Debug("debug message")
+	l.Info("info message")
+	l.Warn("warn message")
+	l.Error("error message")
+
+	out := buf.String()
+	if strings.Contains(out, "debug message") || strings.Contains(out, "info message") {
+		t.Errorf("expected records below warn to be dropped, got %q", out)
+	}
+	if !strings.Contains(out, "warn message") || !strings.Contains(out, "error message") {
+		t.Errorf("expected warn and error records, got %q", out)
+	}
+}
+
+func TestNewFormat(t *testing.T) {
+	var buf bytes.Buffer
+	New(&buf, Options{Level: slog.LevelInfo, Format: FormatJSON}).Info("hello", "key", "value")
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("expected a JSON record, got %q: %v", buf.String(), err)
+	}
+	if record["msg"] != "hello" || record["key"] != "value" || record["level"] != "INFO" {
+		t.Errorf("unexpected JSON record %v", record)
+	}
+
+	buf.Reset()
+	New(&buf, Options{Level: slog.LevelInfo, Format: FormatText}).Info("hello", "key", "value")
+	if out := buf.String(); !strings.Contains(out, "level=INFO msg=hello key=value") {
+		t.Errorf("expected a text record, got %q", out)
+	}
+
+	// 未知的格式按JSON处理
+	buf.Reset()
+	New(&buf, Options{Level: slog.LevelInfo, Format: "xml"}).Info("hello")
+	if !json.Valid(bytes.TrimSpace(buf.Bytes())) {
+		t.Errorf("expected an unknown format to fall back to JSON, got %q", buf.String())
+	}
+}
+
+func TestQuietPaths(t *testing.T) {
+	t.Cleanup(func() { Configure(Options{Level: slog.LevelInfo, Format: FormatJSON}) })
+
+	var buf bytes.Buffer
+	Configure(Options{Level: slog.LevelInfo, Format: FormatJSON, QuietPaths: []string{"/healthz"}, AccessLog: &buf})
+	LogRequest("GET", "/healthz", 200, time.Millisecond, "req-1")
+	LogRequest("GET", "/avatar/abc", 200, time.Millisecond, "req-2")
+
+	out := buf.String()
+	if strings.Contains(out, "req-1") {
+		t.Errorf("expected the quiet path to be dropped at info level, got %q", out)
+	}
+	if !strings.Contains(out, "req-2") {
+		t.Errorf("expected other request logs to be kept, got %q", out)
+	}
+
+	// 降为Debug级别而不是丢弃，LOG_LEVEL=debug时仍能看到
+	buf.Reset()
+	Configure(Options{Level: slog.LevelDebug, Format: FormatJSON, QuietPaths: []string{"/healthz"}, AccessLog: &buf})
+	LogRequest("GET", "/healthz", 200, time.Millisecond, "req-3")
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("expected the quiet path to be logged at debug level, got %q: %v", buf.String(), err)
+	}
+	if record["level"] != "DEBUG" || record["path"] != "/healthz" {
+		t.Errorf("expected a debug record for /healthz, got %v", record)
+	}
+}
+
+func TestAuditIgnoresLevel(t *testing.T) {
+	t.Cleanup(func() { Configure(Options{Level: slog.LevelInfo, Format: FormatJSON}) })
+
+	var buf bytes.Buffer
+	Configure(Options{Level: slog.LevelError, Format: FormatText, AuditLog: &buf})
+	Audit("rate_limited", "status", 429)
+	if out := buf.String(); !strings.Contains(out, "log=audit") || !strings.Contains(out, "reason=rate_limited") {
+		t.Errorf("expected audit records regardless of LOG_LEVEL, got %q", out)
+	}
+}
@@ -0,0 +1,148 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat 是轮转出的旧文件名后缀，按字典序排列即按时间排列
+const backupTimeFormat = "20060102-150405.000"
+
+// RotatingFile 是按大小和打开时长轮转的日志文件，可以并发写入
+// 轮转时当前文件重命名为path.<时间>，再新建path继续写入，超出保留数量的旧文件被删除
+type RotatingFile struct {
+	path       string
+	maxBytes   int64
+	maxAge     time.Duration
+	maxBackups int
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+// OpenRotatingFile 以追加方式打开path；maxAge为0表示不按时间轮转，maxBackups为0表示保留所有旧文件
+func OpenRotatingFile(path string, maxBytes int64, maxAge time.Duration, maxBackups int) (*RotatingFile, error) {
+	f := &RotatingFile{path: path, maxBytes: maxBytes, maxAge: maxAge, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	f.file = file
+	f.size = info.Size()
+	f.openedAt = time.Now()
+	return nil
+}
+
+// Write 写入一条日志；写入后超出大小或文件打开时间超过maxAge时先轮转
+// 轮转失败时继续写入当前文件，不丢弃日志
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if f.size > 0 && (f.size+int64(len(p)) > f.maxBytes || (f.maxAge > 0 && time.Since(f.openedAt) >= f.maxAge)) {
+		if err := f.rotate(); err != nil {
+			Warn("failed to rotate log file", "path", f.path, "error", err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *RotatingFile) rotate() error {
+	backup := f.path + "." + time.Now().Format(backupTimeFormat)
+	if err := os.Rename(f.path, backup); err != nil {
+		return err
+	}
+	f.file.Close()
+	f.file = nil
+	if err := f.open(); err != nil {
+		// 无法新建文件时写回刚重命名的文件
+		file, reopenErr := os.OpenFile(backup, os.O_WRONLY|os.O_APPEND, 0644)
+		if reopenErr == nil {
+			f.file = file
+		}
+		return err
+	}
+	f.prune()
+	return nil
+}
+
+// prune 删除超出maxBackups的最旧的轮转文件
+func (f *RotatingFile) prune() {
+	if f.maxBackups == 0 {
+		return
+	}
+	dir, base := filepath.Split(f.path)
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	var backups []string
+	for _, entry := range entries {
+		suffix, ok := strings.CutPrefix(entry.Name(), base+".")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		if _, err := time.Parse(backupTimeFormat, suffix); err == nil {
+			backups = append(backups, entry.Name())
+		}
+	}
+	sort.Strings(backups)
+	for len(backups) > f.maxBackups {
+		if err := os.Remove(filepath.Join(dir, backups[0])); err != nil {
+			Warn("failed to remove rotated log file", "path", backups[0], "error", err)
+		}
+		backups = backups[1:]
+	}
+}
+
+// Reopen 关闭并重新打开path，配合外部日志轮转工具（如logrotate）在其移走文件后使用
+func (f *RotatingFile) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	return f.open()
+}
+
+// Close 关闭文件，之后的写入返回os.ErrClosed
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -0,0 +1,134 @@
+package log
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// backups 返回path的轮转文件名，按时间从旧到新
+func backups(t *testing.T, path string) []string {
+	t.Helper()
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return matches
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRotatingFileRotatesBySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := OpenRotatingFile(path, 10, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	f.Write([]byte("first\n"))
+	f.Write([]byte("second\n"))
+	if got := backups(t, path); len(got) != 1 {
+		t.Fatalf("expected one rotated file after exceeding the size, got %v", got)
+	}
+	if got := readFile(t, backups(t, path)[0]); got != "first\n" {
+		t.Errorf("expected the rotated file to hold the earlier line, got %q", got)
+	}
+	if got := readFile(t, path); got != "second\n" {
+		t.Errorf("expected the new file to hold the latest line, got %q", got)
+	}
+
+	// 单条超出大小的日志写入空文件，不会产生空的轮转文件
+	big := strings.Repeat("x", 20) + "\n"
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	f.Reopen()
+	f.Write([]byte(big))
+	if got := backups(t, path); len(got) != 1 {
+		t.Errorf("expected no rotation for a line written to an empty file, got %v", got)
+	}
+}
+
+func TestRotatingFilePrunesBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	f, err := OpenRotatingFile(path, 1, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// 与轮转文件名同前缀但不是轮转文件的文件不会被删除
+	other := path + ".keep"
+	if err := os.WriteFile(other, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{"1\n", "2\n", "3\n", "4\n", "5\n"} {
+		f.Write([]byte(line))
+		// 轮转文件名精确到毫秒
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	rotated := backups(t, path)
+	var kept []string
+	for _, name := range rotated {
+		if name != other {
+			kept = append(kept, readFile(t, name))
+		}
+	}
+	if len(kept) != 2 || kept[0] != "3\n" || kept[1] != "4\n" {
+		t.Errorf("expected only the two newest rotated files to be kept, got %q", kept)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("expected unrelated files to be left alone: %v", err)
+	}
+	if got := readFile(t, path); got != "5\n" {
+		t.Errorf("expected the current file to hold the latest line, got %q", got)
+	}
+}
+
+func TestRotatingFileReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	f, err := OpenRotatingFile(path, 1<<20, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.Write([]byte("before\n"))
+	// 模拟logrotate移走文件：重新打开前的写入仍进入被移走的文件
+	moved := filepath.Join(dir, "access.log.1")
+	if err := os.Rename(path, moved); err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("moved\n"))
+	if err := f.Reopen(); err != nil {
+		t.Fatalf("failed to reopen: %v", err)
+	}
+	f.Write([]byte("after\n"))
+
+	if got := readFile(t, moved); got != "before\nmoved\n" {
+		t.Errorf("expected writes before reopening to reach the moved file, got %q", got)
+	}
+	if got := readFile(t, path); got != "after\n" {
+		t.Errorf("expected writes after reopening to reach a new file, got %q", got)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("closed\n")); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("expected writes after close to fail with os.ErrClosed, got %v", err)
+	}
+}
@@ -0,0 +1,276 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 一个最小的Prometheus文本格式指标实现，避免引入外部依赖
+
+const namespace = "gravatar_proxy"
+
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+type collector interface {
+	write(b *strings.Builder, constLabels []labelPair)
+}
+
+type labelPair struct {
+	name  string
+	value string
+}
+
+var (
+	registryMu  sync.Mutex
+	registry    = make(map[string]collector)
+	constLabels []labelPair
+)
+
+// SetConstLabels 为所有指标的每个序列附加固定标签（如实例名和可用区），空值的标签被忽略
+func SetConstLabels(labels map[string]string) {
+	pairs := make([]labelPair, 0, len(labels))
+	for name, value := range labels {
+		if value != "" {
+			pairs = append(pairs, labelPair{name: name, value: value})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].name < pairs[j].name })
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	constLabels = pairs
+}
+
+func register(name string, c collector) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, exists := registry[name]; exists {
+		panic(fmt.Sprintf("metrics: duplicate metric %s", name))
+	}
+	registry[name] = c
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	buckets     []uint64
+	count       uint64
+}
+
+type vec struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+func newVec(name, help, kind string, buckets []float64, labelNames []string) *vec {
+	v := &vec{
+		name:       namespace + "_" + name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		buckets:    buckets,
+		series:     make(map[string]*series),
+	}
+	register(v.name, v)
+	return v
+}
+
+// with 返回标签值对应的序列，调用方必须持有锁
+func (v *vec) with(labelValues []string) *series {
+	if len(labelValues) != len(v.labelNames) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.name, len(v.labelNames), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		if v.kind == "histogram" {
+			s.buckets = make([]uint64, len(v.buckets))
+		}
+		v.series[key] = s
+	}
+	return s
+}
+
+func (v *vec) write(b *strings.Builder, constLabels []labelPair) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	fmt.Fprintf(b, "# HELP %s %s\n", v.name, v.help)
+	fmt.Fprintf(b, "# TYPE %s %s\n", v.name, v.kind)
+
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := v.series[k]
+		if v.kind != "histogram" {
+			fmt.Fprintf(b, "%s%s %s\n", v.name, formatLabels(constLabels, v.labelNames, s.labelValues, "", ""), formatValue(s.value))
+			continue
+		}
+
+		for i, upper := range v.buckets {
+			fmt.Fprintf(b, "%s_bucket%s %d\n", v.name, formatLabels(constLabels, v.labelNames, s.labelValues, "le", formatValue(upper)), s.buckets[i])
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", v.name, formatLabels(constLabels, v.labelNames, s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", v.name, formatLabels(constLabels, v.labelNames, s.labelValues, "", ""), formatValue(s.value))
+		fmt.Fprintf(b, "%s_count%s %d\n", v.name, formatLabels(constLabels, v.labelNames, s.labelValues, "", ""), s.count)
+	}
+}
+
+// Counter 是只增不减的计数器
+type Counter struct{ v *vec }
+
+func NewCounter(name, help string, labelNames ...string) *Counter {
+	return &Counter{v: newVec(name, help, "counter", nil, labelNames)}
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	c.v.mu.Lock()
+	defer c.v.mu.Unlock()
+	c.v.with(labelValues).value += delta
+}
+
+// Value 返回当前计数，主要用于统计接口和测试
+func (c *Counter) Value(labelValues ...string) float64 {
+	c.v.mu.Lock()
+	defer c.v.mu.Unlock()
+	return c.v.with(labelValues).value
+}
+
+// Gauge 是可任意设置的瞬时值
+type Gauge struct{ v *vec }
+
+func NewGauge(name, help string, labelNames ...string) *Gauge {
+	return &Gauge{v: newVec(name, help, "gauge", nil, labelNames)}
+}
+
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.v.mu.Lock()
+	defer g.v.mu.Unlock()
+	g.v.with(labelValues).value = value
+}
+
+func (g *Gauge) Add(delta float64, labelValues ...string) {
+	g.v.mu.Lock()
+	defer g.v.mu.Unlock()
+	g.v.with(labelValues).value += delta
+}
+
+func (g *Gauge) Value(labelValues ...string) float64 {
+	g.v.mu.Lock()
+	defer g.v.mu.Unlock()
+	return g.v.with(labelValues).value
+}
+
+// Histogram 记录观测值的分布
+type Histogram struct{ v *vec }
+
+func NewHistogram(name, help string, buckets []float64, labelNames ...string) *Histogram {
+	return &Histogram{v: newVec(name, help, "histogram", buckets, labelNames)}
+}
+
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.v.mu.Lock()
+	defer h.v.mu.Unlock()
+
+	s := h.v.with(labelValues)
+	for i, upper := range h.v.buckets {
+		if value <= upper {
+			s.buckets[i]++
+		}
+	}
+	s.count++
+	s.value += value
+}
+
+// gaugeFunc 在抓取时调用函数取值
+type gaugeFunc struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+// NewGaugeFunc 注册一个抓取时计算的gauge
+func NewGaugeFunc(name, help string, fn func() float64) {
+	g := &gaugeFunc{name: namespace + "_" + name, help: help, fn: fn}
+	register(g.name, g)
+}
+
+func (g *gaugeFunc) write(b *strings.Builder, constLabels []labelPair) {
+	fmt.Fprintf(b, "# HELP %s %s\n", g.name, g.help)
+	fmt.Fprintf(b, "# TYPE %s gauge\n", g.name)
+	fmt.Fprintf(b, "%s%s %s\n", g.name, formatLabels(constLabels, nil, nil, "", ""), formatValue(g.fn()))
+}
+
+// Handler 以Prometheus文本格式输出所有指标
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		registryMu.Lock()
+		names := make([]string, 0, len(registry))
+		for name := range registry {
+			names = append(names, name)
+		}
+		collectors := make([]collector, 0, len(names))
+		sort.Strings(names)
+		for _, name := range names {
+			collectors = append(collectors, registry[name])
+		}
+		labels := constLabels
+		registryMu.Unlock()
+
+		var b strings.Builder
+		for _, c := range collectors {
+			c.write(&b, labels)
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(b.String()))
+	})
+}
+
+func formatLabels(constLabels []labelPair, names, values []string, extraName, extraValue string) string {
+	if len(constLabels) == 0 && len(names) == 0 && extraName == "" {
+		return ""
+	}
+
+	parts := make([]string, 0, len(constLabels)+len(names)+1)
+	for _, label := range constLabels {
+		parts = append(parts, fmt.Sprintf("%s=%s", label.name, strconv.Quote(label.value)))
+	}
+	for i, name := range names {
+		parts = append(parts, fmt.Sprintf("%s=%s", name, strconv.Quote(values[i])))
+	}
+	if extraName != "" {
+		parts = append(parts, fmt.Sprintf("%s=%s", extraName, strconv.Quote(extraValue)))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandlerOutput(t *testing.T) {
+	c := NewCounter("test_requests_total", "Test requests.", "result")
+	c.Inc("ok")
+	c.Add(2, "ok")
+	c.Inc("error")
+
+	h := NewHistogram("test_duration_seconds", "Test durations.", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+
+	NewGaugeFunc("test_entries", "Test entries.", func() float64 { return 7 })
+
+	if got := c.Value("ok"); got != 3 {
+		t.Errorf("expected counter value 3, got %v", got)
+	}
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	for _, want := range []string{
+		`gravatar_proxy_test_requests_total{result="ok"} 3`,
+		`gravatar_proxy_test_requests_total{result="error"} 1`,
+		`gravatar_proxy_test_duration_seconds_bucket{le="0.1"} 1`,
+		`gravatar_proxy_test_duration_seconds_bucket{le="+Inf"} 2`,
+		`gravatar_proxy_test_duration_seconds_count 2`,
+		`gravatar_proxy_test_entries 7`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected output to contain %q\n%s", want, body)
+		}
+	}
+}
+
+func TestConstLabels(t *testing.T) {
+	c := NewCounter("test_labelled_total", "Test labelled.", "result")
+	c.Inc("ok")
+	NewGaugeFunc("test_labelled_entries", "Test labelled entries.", func() float64 { return 1 })
+
+	SetConstLabels(map[string]string{"zone": "eu-west-1a", "pod": "proxy-0", "empty": ""})
+	defer SetConstLabels(nil)
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	for _, want := range []string{
+		`gravatar_proxy_test_labelled_total{pod="proxy-0",zone="eu-west-1a",result="ok"} 1`,
+		`gravatar_proxy_test_labelled_entries{pod="proxy-0",zone="eu-west-1a"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected output to contain %q\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "empty=") {
+		t.Error("expected labels with empty values to be omitted")
+	}
+}
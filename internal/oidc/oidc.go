@@ -0,0 +1,312 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gravatar-proxy/internal/metrics"
+)
+
+// 只验证签名和标准声明的最小OIDC/JWT实现，供管理接口接受运维单点登录签发的令牌
+
+const (
+	// keysRefreshInterval 为定期重新下载JWKS的间隔，使签发方轮换的密钥生效
+	keysRefreshInterval = time.Hour
+	// keysMinRefresh 为遇到未知kid时重新下载JWKS的最短间隔，防止伪造的kid导致频繁请求签发方
+	keysMinRefresh = time.Minute
+	// clockSkew 为exp和nbf允许的时钟偏差
+	clockSkew    = time.Minute
+	fetchTimeout = 10 * time.Second
+)
+
+var validations = metrics.NewCounter("oidc_token_validations_total",
+	"JWT validations by result (valid, invalid, expired, keys_unavailable).", "result")
+
+var (
+	errMalformed = errors.New("oidc: malformed token")
+	// ErrExpired 表示令牌已过期或尚未生效
+	ErrExpired = errors.New("oidc: token expired or not yet valid")
+)
+
+// Claims 是令牌载荷中的声明
+type Claims map[string]any
+
+// Subject 返回sub声明
+func (c Claims) Subject() string {
+	s, _ := c["sub"].(string)
+	return s
+}
+
+// Strings 返回点分路径（如realm_access.roles）指向的声明：字符串数组原样返回，字符串按空格拆分（如scope）
+func (c Claims) Strings(path string) []string {
+	var v any = map[string]any(c)
+	for _, part := range strings.Split(path, ".") {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		v = m[part]
+	}
+
+	switch v := v.(type) {
+	case string:
+		return strings.Fields(v)
+	case []any:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// Verifier 验证issuer签发的JWT：按JWKS中的公钥验证签名，并检查iss、aud、exp和nbf
+// jwksURL为空时从签发方的/.well-known/openid-configuration发现
+type Verifier struct {
+	issuer   string
+	audience string
+	client   *http.Client
+
+	mu        sync.Mutex
+	jwksURL   string
+	keys      []publicKey
+	fetchedAt time.Time
+	// fetchErr 为最近一次下载JWKS失败的原因，还没有任何公钥时在重试间隔内返回
+	fetchErr error
+}
+
+// NewVerifier 创建验证器；公钥在第一次验证时才下载，签发方暂时不可用不影响启动
+func NewVerifier(issuer, jwksURL, audience string) *Verifier {
+	return &Verifier{
+		issuer:   issuer,
+		audience: audience,
+		jwksURL:  jwksURL,
+		client:   &http.Client{Timeout: fetchTimeout},
+	}
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Verify 验证令牌并返回其中的声明
+func (v *Verifier) Verify(ctx context.Context, token string) (Claims, error) {
+	claims, err := v.verify(ctx, token)
+	switch {
+	case err == nil:
+		validations.Inc("valid")
+	case errors.Is(err, ErrExpired):
+		validations.Inc("expired")
+	case errors.Is(err, errKeysUnavailable):
+		validations.Inc("keys_unavailable")
+	default:
+		validations.Inc("invalid")
+	}
+	return claims, err
+}
+
+func (v *Verifier) verify(ctx context.Context, token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errMalformed
+	}
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, errMalformed
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errMalformed
+	}
+	hash, ok := algHash[h.Alg]
+	if !ok {
+		// 包括none和HS*：对称算法需要共享密钥，不能用公开的JWKS验证
+		return nil, fmt.Errorf("oidc: unsupported algorithm %q", h.Alg)
+	}
+
+	keys, err := v.keysFor(ctx, h.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, key := range keys {
+		if key.alg != "" && key.alg != h.Alg {
+			continue
+		}
+		if verifySignature(h.Alg, hash, key.key, signed, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("oidc: invalid signature")
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errMalformed
+	}
+	if err := v.checkClaims(claims, time.Now()); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// checkClaims 检查签发方、受众和有效期；exp为必需声明
+func (v *Verifier) checkClaims(claims Claims, now time.Time) error {
+	if iss, _ := claims["iss"].(string); iss != v.issuer {
+		return fmt.Errorf("oidc: token issued by %q, expected %q", iss, v.issuer)
+	}
+	if v.audience != "" && !containsAudience(claims["aud"], v.audience) {
+		return fmt.Errorf("oidc: token audience does not include %q", v.audience)
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("oidc: token has no exp")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(clockSkew)) {
+		return ErrExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(clockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return ErrExpired
+	}
+	return nil
+}
+
+func containsAudience(aud any, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []any:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var errKeysUnavailable = errors.New("oidc: signing keys unavailable")
+
+// keysFor 返回可能签发了该令牌的公钥：有kid时只返回同kid的公钥，没有kid时返回全部
+// 公钥过期或kid未知时重新下载JWKS，下载失败时沿用已有的公钥
+func (v *Verifier) keysFor(ctx context.Context, kid string) ([]publicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	now := time.Now()
+	stale := now.Sub(v.fetchedAt) >= keysRefreshInterval
+	unknown := len(matchKeys(v.keys, kid)) == 0 && now.Sub(v.fetchedAt) >= keysMinRefresh
+	if stale || unknown {
+		// 失败时也记录时间，避免签发方故障期间每个请求都重试
+		v.fetchErr = v.refreshLocked(ctx)
+		v.fetchedAt = now
+	}
+	if len(v.keys) == 0 {
+		return nil, fmt.Errorf("%w: %v", errKeysUnavailable, v.fetchErr)
+	}
+
+	keys := matchKeys(v.keys, kid)
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("oidc: no signing key with kid %q", kid)
+	}
+	return keys, nil
+}
+
+func (v *Verifier) refreshLocked(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), fetchTimeout)
+	defer cancel()
+
+	if v.jwksURL == "" {
+		url, err := discoverJWKS(ctx, v.client, v.issuer)
+		if err != nil {
+			return err
+		}
+		v.jwksURL = url
+	}
+	keys, err := fetchKeys(ctx, v.client, v.jwksURL)
+	if err != nil {
+		return err
+	}
+	v.keys = keys
+	return nil
+}
+
+func matchKeys(keys []publicKey, kid string) []publicKey {
+	if kid == "" {
+		return keys
+	}
+	var matched []publicKey
+	for _, key := range keys {
+		if key.kid == kid {
+			matched = append(matched, key)
+		}
+	}
+	return matched
+}
+
+// algHash 为支持的签名算法及其摘要算法；EdDSA不预先计算摘要
+var algHash = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"PS256": crypto.SHA256, "PS384": crypto.SHA384, "PS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+	"EdDSA": 0,
+}
+
+func verifySignature(alg string, hash crypto.Hash, key crypto.PublicKey, signed, sig []byte) bool {
+	if alg == "EdDSA" {
+		k, ok := key.(ed25519.PublicKey)
+		return ok && ed25519.Verify(k, signed, sig)
+	}
+
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch alg[:2] {
+	case "RS":
+		k, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(k, hash, digest, sig) == nil
+	case "PS":
+		k, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPSS(k, hash, digest, sig, nil) == nil
+	case "ES":
+		// JWS中的ECDSA签名是定长的r||s，而不是ASN.1编码
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(sig) != 2*((k.Curve.Params().BitSize+7)/8) {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:len(sig)/2])
+		s := new(big.Int).SetBytes(sig[len(sig)/2:])
+		return ecdsa.Verify(k, digest, r, s)
+	}
+	return false
+}
+
+func decodeSegment(segment string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
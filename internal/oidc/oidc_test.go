@@ -0,0 +1,207 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testIssuer 提供发现文档和JWKS，并用其中的私钥签发令牌
+type testIssuer struct {
+	server  *httptest.Server
+	fetches atomic.Int32
+
+	mu   sync.Mutex
+	jwks []map[string]string
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	ti := &testIssuer{}
+	ti.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"issuer": ti.server.URL, "jwks_uri": ti.server.URL + "/keys"})
+		case "/keys":
+			ti.fetches.Add(1)
+			ti.mu.Lock()
+			defer ti.mu.Unlock()
+			json.NewEncoder(w).Encode(map[string]any{"keys": ti.jwks})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(ti.server.Close)
+	return ti
+}
+
+func (ti *testIssuer) publish(jwk map[string]string) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	ti.jwks = append(ti.jwks, jwk)
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func rsaJWK(kid string, key *rsa.PrivateKey) map[string]string {
+	return map[string]string{"kty": "RSA", "kid": kid, "use": "sig", "n": b64(key.N.Bytes()), "e": b64(big.NewInt(int64(key.E)).Bytes())}
+}
+
+func ecJWK(kid string, key *ecdsa.PrivateKey) map[string]string {
+	return map[string]string{"kty": "EC", "kid": kid, "crv": "P-256", "x": b64(key.X.FillBytes(make([]byte, 32))), "y": b64(key.Y.FillBytes(make([]byte, 32)))}
+}
+
+func sign(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	var err error
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, digest[:])
+		if err == nil {
+			sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	}
+	if err != nil {
+		t.Fatalf("signing failed: %v", err)
+	}
+	return signed + "." + b64(sig)
+}
+
+func TestVerify(t *testing.T) {
+	ti := newTestIssuer(t)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ti.publish(rsaJWK("rsa-1", rsaKey))
+	ti.publish(ecJWK("ec-1", ecKey))
+
+	v := NewVerifier(ti.server.URL, "", "gravatar-proxy")
+	ctx := context.Background()
+	claims := func(overrides map[string]any) map[string]any {
+		c := map[string]any{
+			"iss": ti.server.URL,
+			"aud": []string{"other", "gravatar-proxy"},
+			"sub": "alice",
+			"exp": time.Now().Add(time.Hour).Unix(),
+			"realm_access": map[string]any{
+				"roles": []string{"cache-admin"},
+			},
+			"scope": "openid cache:purge",
+		}
+		for k, val := range overrides {
+			c[k] = val
+		}
+		return c
+	}
+
+	got, err := v.Verify(ctx, sign(t, "RS256", "rsa-1", rsaKey, claims(nil)))
+	if err != nil {
+		t.Fatalf("expected valid RS256 token, got %v", err)
+	}
+	if got.Subject() != "alice" {
+		t.Errorf("expected subject alice, got %q", got.Subject())
+	}
+	if roles := got.Strings("realm_access.roles"); len(roles) != 1 || roles[0] != "cache-admin" {
+		t.Errorf("expected nested roles claim, got %v", roles)
+	}
+	if scopes := got.Strings("scope"); len(scopes) != 2 || scopes[1] != "cache:purge" {
+		t.Errorf("expected space-separated scope claim, got %v", scopes)
+	}
+	if _, err := v.Verify(ctx, sign(t, "ES256", "ec-1", ecKey, claims(nil))); err != nil {
+		t.Errorf("expected valid ES256 token, got %v", err)
+	}
+
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	tampered := strings.Split(sign(t, "RS256", "rsa-1", rsaKey, claims(nil)), ".")
+	forged, _ := json.Marshal(claims(map[string]any{"sub": "mallory"}))
+	tampered[1] = b64(forged)
+
+	for name, token := range map[string]string{
+		"wrong audience":  sign(t, "RS256", "rsa-1", rsaKey, claims(map[string]any{"aud": "other"})),
+		"wrong issuer":    sign(t, "RS256", "rsa-1", rsaKey, claims(map[string]any{"iss": "https://evil.example"})),
+		"no exp":          sign(t, "RS256", "rsa-1", rsaKey, claims(map[string]any{"exp": nil})),
+		"wrong key":       sign(t, "RS256", "rsa-1", otherKey, claims(nil)),
+		"key type":        sign(t, "RS256", "ec-1", rsaKey, claims(nil)),
+		"tampered":        strings.Join(tampered, "."),
+		"alg none":        b64([]byte(`{"alg":"none"}`)) + "." + tampered[1] + ".",
+		"not a jwt":       "secret",
+		"not yet valid":   sign(t, "RS256", "rsa-1", rsaKey, claims(map[string]any{"nbf": time.Now().Add(time.Hour).Unix()})),
+		"expired":         sign(t, "RS256", "rsa-1", rsaKey, claims(map[string]any{"exp": time.Now().Add(-time.Hour).Unix()})),
+		"unknown kid":     sign(t, "RS256", "rsa-2", otherKey, claims(nil)),
+		"HS256 confusion": b64([]byte(`{"alg":"HS256","kid":"rsa-1"}`)) + "." + tampered[1] + "." + b64([]byte("sig")),
+	} {
+		if _, err := v.Verify(ctx, token); err == nil {
+			t.Errorf("%s: expected token to be rejected", name)
+		}
+	}
+	if _, err := v.Verify(ctx, sign(t, "RS256", "rsa-1", rsaKey, claims(map[string]any{"exp": time.Now().Add(-time.Hour).Unix()}))); !errors.Is(err, ErrExpired) {
+		t.Errorf("expected ErrExpired, got %v", err)
+	}
+
+	// 未知kid在最短间隔内不会再次下载JWKS
+	if n := ti.fetches.Load(); n != 1 {
+		t.Errorf("expected JWKS to be fetched once, got %d", n)
+	}
+
+	// 签发方轮换密钥后，超过最短间隔的未知kid触发重新下载
+	ti.publish(rsaJWK("rsa-2", otherKey))
+	v.mu.Lock()
+	v.fetchedAt = time.Now().Add(-keysMinRefresh)
+	v.mu.Unlock()
+	if _, err := v.Verify(ctx, sign(t, "RS256", "rsa-2", otherKey, claims(nil))); err != nil {
+		t.Errorf("expected rotated key to be picked up, got %v", err)
+	}
+	if n := ti.fetches.Load(); n != 2 {
+		t.Errorf("expected JWKS to be fetched again for the rotated key, got %d fetches", n)
+	}
+}
+
+func TestVerifyKeysUnavailable(t *testing.T) {
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	v := NewVerifier(server.URL, "", "")
+	token := sign(t, "RS256", "k", key, map[string]any{"iss": server.URL, "exp": time.Now().Add(time.Hour).Unix()})
+	if _, err := v.Verify(context.Background(), token); !errors.Is(err, errKeysUnavailable) {
+		t.Errorf("expected keys to be unavailable without a discovery document, got %v", err)
+	}
+
+	// 下载失败后在最短间隔内不再请求签发方
+	for range 3 {
+		if _, err := v.Verify(context.Background(), token); !errors.Is(err, errKeysUnavailable) {
+			t.Errorf("expected keys to stay unavailable, got %v", err)
+		}
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("expected failed refreshes to be rate limited, got %d requests to the issuer", n)
+	}
+}
@@ -0,0 +1,582 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gravatar-proxy/internal/cache"
+	"gravatar-proxy/internal/log"
+)
+
+// AdminHandler 返回管理接口路由，所有请求需携带 Authorization: Bearer <ADMIN_TOKEN或管理JWT>、基本认证或客户端证书
+// 未配置任何认证方式时返回nil，管理接口不应被挂载
+func (h *Handler) AdminHandler() http.Handler {
+	if !h.adminEnabled() {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/purge", h.purgeHandler)
+	mux.HandleFunc("/admin/debug/key", h.debugKeyHandler)
+	mux.HandleFunc("/admin/stats", h.statsHandler)
+	mux.HandleFunc("/admin/sync", h.syncHandler)
+	mux.HandleFunc("/admin/cache", h.cacheSearchHandler)
+	mux.HandleFunc("/admin/cache/", h.cacheEntryHandler)
+	mux.HandleFunc("/admin/cache/report", h.cacheReportHandler)
+	mux.HandleFunc("/admin/warmup", h.warmupHandler)
+	mux.HandleFunc("/admin/prefetch", h.batchPrefetchHandler)
+	mux.HandleFunc("/admin/cluster", h.clusterHandler)
+	mux.HandleFunc("/admin/features", h.featuresHandler)
+	return h.requireAdmin(mux)
+}
+
+// adminEnabled 判断是否配置了管理接口的认证方式
+func (h *Handler) adminEnabled() bool {
+	return h.adminToken != "" || h.adminJWT != nil || h.adminBasicUser != "" || h.adminClientCerts
+}
+
+// adminAuthorized 检查请求的管理凭据：由ADMIN_CLIENT_CA_FILE签发的客户端证书、ADMIN_BASIC_AUTH基本认证，
+// 或Authorization: Bearer中等于ADMIN_TOKEN、或由ADMIN_JWT_ISSUER签发且带有所需角色的有效JWT
+func (h *Handler) adminAuthorized(r *http.Request) bool {
+	if h.adminClientCerts && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		log.Debug("admin client certificate accepted", "subject", r.TLS.VerifiedChains[0][0].Subject.String(), "path", r.URL.Path)
+		return true
+	}
+	if user, password, ok := r.BasicAuth(); ok {
+		return h.adminBasicUser != "" &&
+			subtle.ConstantTimeCompare([]byte(user), []byte(h.adminBasicUser))&
+				subtle.ConstantTimeCompare([]byte(password), []byte(h.adminBasicPassword)) == 1
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return false
+	}
+	if h.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(h.adminToken)) == 1 {
+		return true
+	}
+	if h.adminJWT == nil {
+		return false
+	}
+
+	claims, err := h.adminJWT.Verify(r.Context(), token)
+	if err != nil {
+		log.Warn("admin JWT rejected", "error", err, "path", r.URL.Path)
+		return false
+	}
+	if len(h.adminRoles) > 0 && !slices.ContainsFunc(claims.Strings(h.adminRoleClaim), func(role string) bool {
+		return slices.Contains(h.adminRoles, role)
+	}) {
+		log.Warn("admin JWT lacks a required role", "subject", claims.Subject(), "claim", h.adminRoleClaim, "path", r.URL.Path)
+		return false
+	}
+	log.Debug("admin JWT accepted", "subject", claims.Subject(), "path", r.URL.Path)
+	return true
+}
+
+func (h *Handler) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !h.adminAuthorized(r) {
+			h.auditDenied(r, denyAdminUnauthorized, http.StatusUnauthorized, "")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			if h.adminBasicUser != "" {
+				w.Header().Add("WWW-Authenticate", `Basic realm="admin"`)
+			}
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// forwardedPurgeHeader 标记由其他节点转发的清除请求
+const forwardedPurgeHeader = "X-Purge-Forwarded"
+
+// forwardPurge 将清除请求同时转发给PURGE_PEERS和发现的每个节点，使用相同的管理令牌，返回接受了清除的节点
+// 没有可转发的节点，或没有ADMIN_TOKEN这一可以转发的共享凭据时返回nil
+func (h *Handler) forwardPurge(rawQuery string) []string {
+	targets := h.purgeTargets()
+	if h.adminToken == "" || len(targets) == 0 {
+		return nil
+	}
+
+	accepted := make([]bool, len(targets))
+	var wg sync.WaitGroup
+	for i, peer := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			accepted[i] = h.forwardPurgeTo(peer, rawQuery)
+		}()
+	}
+	wg.Wait()
+
+	forwarded := []string{}
+	for i, peer := range targets {
+		if accepted[i] {
+			forwarded = append(forwarded, peer)
+		}
+	}
+	return forwarded
+}
+
+// forwardPurgeTo 向一个节点转发清除请求，节点返回200时返回true
+func (h *Handler) forwardPurgeTo(peer, rawQuery string) bool {
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(peer, "/")+"/admin/purge?"+rawQuery, nil)
+	if err != nil {
+		log.Warn("failed to create peer purge request", "error", err, "peer", peer)
+		return false
+	}
+	req.Header.Set("Authorization", "Bearer "+h.adminToken)
+	req.Header.Set(forwardedPurgeHeader, "1")
+
+	resp, err := h.peerClient.Do(req)
+	if err != nil {
+		log.Warn("failed to forward purge to peer", "error", err, "peer", peer)
+		return false
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Warn("peer rejected forwarded purge", "status", resp.StatusCode, "peer", peer)
+		return false
+	}
+	log.Info("forwarded purge to peer", "peer", peer, "query", rawQuery)
+	return true
+}
+
+// purgeTargets 返回PURGE_PEERS与分片节点发现得到的节点的并集
+func (h *Handler) purgeTargets() []string {
+	if h.peers == nil {
+		return h.purgePeers
+	}
+	seen := make(map[string]bool)
+	var targets []string
+	for _, peer := range append(h.purgePeers, h.peers.members()...) {
+		peer = strings.TrimSuffix(peer, "/")
+		if !seen[peer] {
+			seen[peer] = true
+			targets = append(targets, peer)
+		}
+	}
+	return targets
+}
+
+// purgeHash 删除头像哈希的所有缓存变体和负缓存条目，返回删除的条目数
+func (h *Handler) purgeHash(hash string) (purged, negativePurged int) {
+	purged = h.cache.PurgeHash(hash)
+	negativePurged = h.negative.PurgeHash(hash)
+	h.forgetTranscodeResults()
+	log.Info("purged cache entries", "hash", hash, "entries", purged, "negative_entries", negativePurged)
+	return purged, negativePurged
+}
+
+// purgePrefix 删除头像哈希以prefix开头的所有缓存变体和负缓存条目，返回删除的条目数
+func (h *Handler) purgePrefix(prefix string) (purged, negativePurged int) {
+	purged = h.cache.PurgePrefix(prefix)
+	negativePurged = h.negative.PurgePrefix(prefix)
+	h.forgetTranscodeResults()
+	log.Info("purged cache entries by prefix", "prefix", prefix, "entries", purged, "negative_entries", negativePurged)
+	return purged, negativePurged
+}
+
+// purgeAll 清空缓存和负缓存，返回删除的条目数
+func (h *Handler) purgeAll() (purged, negativePurged int, err error) {
+	purged, err = h.cache.PurgeAll()
+	if err != nil {
+		return 0, 0, err
+	}
+	negativePurged = h.negative.PurgePrefix("")
+	h.forgetTranscodeResults()
+	log.Warn("purged entire cache", "entries", purged, "negative_entries", negativePurged)
+	return purged, negativePurged, nil
+}
+
+// isHashPrefix 判断是否为小写十六进制的头像哈希前缀
+func isHashPrefix(prefix string) bool {
+	return prefix != "" && len(prefix) <= 64 && isLowerHex(prefix)
+}
+
+// purgeKey 按缓存键删除单个条目及其负缓存条目，返回删除的条目数
+func (h *Handler) purgeKey(key string) int {
+	purged := 0
+	if h.cache.Delete(key) {
+		purged = 1
+	}
+	h.negative.Delete(key)
+	h.forgetTranscodeResults()
+	log.Info("purged cache entry", "key", key, "entries", purged)
+	return purged
+}
+
+// purgeHandler 按头像哈希删除所有缓存变体（POST /admin/purge?hash=...），或按缓存键删除单个条目（?key=...）
+// ?prefix=... 删除头像哈希以该前缀开头的所有条目，?all=true 清空整个缓存
+func (h *Handler) purgeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "POST, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	result := map[string]any{}
+	switch {
+	case query.Get("hash") != "":
+		hash := normalizeHash(query.Get("hash"))
+		purged, negativePurged := h.purgeHash(hash)
+		result["hash"] = hash
+		result["purged"] = purged
+		result["negative_purged"] = negativePurged
+	case query.Get("key") != "":
+		key := query.Get("key")
+		result["key"] = key
+		result["purged"] = h.purgeKey(key)
+	case query.Get("prefix") != "":
+		prefix := normalizeHash(query.Get("prefix"))
+		if !isHashPrefix(prefix) {
+			http.Error(w, "prefix must be hexadecimal", http.StatusBadRequest)
+			return
+		}
+		purged, negativePurged := h.purgePrefix(prefix)
+		result["prefix"] = prefix
+		result["purged"] = purged
+		result["negative_purged"] = negativePurged
+	case query.Get("all") != "":
+		if all, err := strconv.ParseBool(query.Get("all")); err != nil || !all {
+			http.Error(w, "all must be true", http.StatusBadRequest)
+			return
+		}
+		purged, negativePurged, err := h.purgeAll()
+		if err != nil {
+			log.Error("failed to purge cache", "error", err)
+			http.Error(w, "Failed to purge cache", http.StatusInternalServerError)
+			return
+		}
+		result["all"] = true
+		result["purged"] = purged
+		result["negative_purged"] = negativePurged
+	default:
+		http.Error(w, "Missing hash, key, prefix or all parameter", http.StatusBadRequest)
+		return
+	}
+
+	// 转发来的清除请求不再继续转发，避免节点间循环
+	if r.Header.Get(forwardedPurgeHeader) == "" {
+		if forwarded := h.forwardPurge(r.URL.RawQuery); forwarded != nil {
+			result["forwarded_to"] = forwarded
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(result)
+}
+
+type debugKeyInfo struct {
+	Path   string            `json:"path"`
+	Hash   string            `json:"hash"`
+	Params map[string]string `json:"params"`
+	Key    string            `json:"key"`
+	Exists bool              `json:"exists"`
+	Valid  bool              `json:"valid"`
+
+	Metadata            *cache.Metadata `json:"metadata,omitempty"`
+	AgeSeconds          *float64        `json:"age_seconds,omitempty"`
+	TTLRemainingSeconds *float64        `json:"ttl_remaining_seconds,omitempty"`
+	// StaleRemainingSeconds 为过期后仍可按stale-while-revalidate返回的剩余时间
+	StaleRemainingSeconds *float64 `json:"stale_remaining_seconds,omitempty"`
+
+	Negative *debugNegativeInfo `json:"negative,omitempty"`
+}
+
+type debugNegativeInfo struct {
+	StatusCode       int     `json:"status_code"`
+	ExpiresInSeconds float64 `json:"expires_in_seconds"`
+}
+
+// debugKeyHandler 返回请求对应的缓存键及其状态（GET /admin/debug/key?path=/avatar/<hash>&s=80）
+// path之外的查询参数按头像请求的规则参与缓存键计算
+func (h *Handler) debugKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	path := query.Get("path")
+	hash := normalizeHash(strings.TrimPrefix(path, "/avatar/"))
+	if !strings.HasPrefix(path, "/avatar/") || hash == "" {
+		http.Error(w, "path must be /avatar/<hash>", http.StatusBadRequest)
+		return
+	}
+	query.Del("path")
+	if name := conflictingParam(query, h.avatarParams, h.passthrough); name != "" {
+		http.Error(w, "Conflicting values for query parameter "+name, http.StatusBadRequest)
+		return
+	}
+
+	params := h.requestParams(query)
+	key := h.cache.GenerateKey("/avatar/"+hash, params)
+	info := debugKeyInfo{Path: path, Hash: hash, Params: params, Key: key}
+
+	if entry, valid := h.cache.Peek(key); entry != nil {
+		metadata := entry.Metadata
+		age := time.Since(metadata.CreatedAt)
+		info.Exists = true
+		info.Valid = valid
+		info.Metadata = &metadata
+		info.AgeSeconds = seconds(age)
+		ttl := h.current().ttl
+		info.TTLRemainingSeconds = seconds(max(ttl-age, 0))
+		if h.staleWhileRevalidate > 0 {
+			info.StaleRemainingSeconds = seconds(max(ttl+h.staleWhileRevalidate-age, 0))
+		}
+	}
+
+	if neg, ok := h.negative.Get(key); ok {
+		info.Negative = &debugNegativeInfo{
+			StatusCode:       neg.StatusCode,
+			ExpiresInSeconds: time.Until(neg.ExpiresAt).Seconds(),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(info)
+}
+
+func seconds(d time.Duration) *float64 {
+	s := d.Seconds()
+	return &s
+}
+
+// statsHandler 返回缓存统计、各API密钥的请求数、实例标识和分片节点状态（GET /admin/stats）
+func (h *Handler) statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	month, bytes := h.bandwidth.usage()
+	bandwidth := map[string]any{"month": month, "bytes": bytes}
+	if h.bandwidth.capBytes > 0 {
+		bandwidth["cap_bytes"] = h.bandwidth.capBytes
+	}
+	stats := map[string]any{
+		"cache":              h.cache.Stats(),
+		"negative_entries":   h.negative.Len(),
+		"upstream_bandwidth": bandwidth,
+		"bytes_saved":        h.bytesSaved.Load(),
+	}
+	if len(h.apiKeys) > 0 {
+		stats["api_keys"] = h.apiKeyStats()
+	}
+	if h.instance.Name != "" {
+		stats["instance"] = h.instance
+	}
+	if h.peers != nil {
+		stats["peers"] = h.peers.status()
+	}
+	if h.breaker != nil {
+		stats["circuit_breakers"] = h.breaker.status()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(stats)
+}
+
+// cacheEntryHandler 返回缓存条目的元数据（GET /admin/cache/{key}），
+// 或原样返回缓存的数据（GET /admin/cache/{key}/body），不影响LRU顺序和命中次数
+// POST /admin/cache/{key}/revalidate 交给revalidateHandler
+func (h *Handler) cacheEntryHandler(w http.ResponseWriter, r *http.Request) {
+	key, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/admin/cache/"), "/")
+	if key == "" || (rest != "" && rest != "body" && rest != "revalidate") {
+		http.NotFound(w, r)
+		return
+	}
+
+	if rest == "revalidate" {
+		h.revalidateHandler(w, r, key)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	metadata, err := h.cache.GetMetadata(key)
+	if err != nil {
+		http.Error(w, "Cache entry not found", http.StatusNotFound)
+		return
+	}
+
+	if rest == "body" {
+		f, err := h.cache.Open(key)
+		if err != nil {
+			log.Warn("failed to open cache file", "error", err, "key", key)
+			http.Error(w, "Failed to open cache file", http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+
+		// 缓存的可能是上游错误页，以下载形式返回，避免在管理端浏览器中渲染
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+key+`"`)
+		w.Header().Set("X-Cached-Content-Type", metadata.Headers["Content-Type"])
+		w.WriteHeader(http.StatusOK)
+		io.Copy(w, f)
+		return
+	}
+
+	_, valid := h.cache.Peek(key)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"key":         key,
+		"valid":       valid,
+		"age_seconds": time.Since(metadata.CreatedAt).Seconds(),
+		"metadata":    metadata,
+	})
+}
+
+// revalidateHandler 不论TTL立即以条件请求向上游刷新条目（POST /admin/cache/{key}/revalidate）
+// 缩放或转码得到的变体刷新其原图，并删除该变体，下次请求时由新的原图重新生成
+// 来自重定向的条目重新请求头像本身，上游可能已不再重定向到默认图片
+func (h *Handler) revalidateHandler(w http.ResponseWriter, r *http.Request, key string) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	entry, _ := h.cache.Peek(key)
+	if entry == nil {
+		http.Error(w, "Cache entry not found", http.StatusNotFound)
+		return
+	}
+
+	result := map[string]any{"key": key}
+	target := key
+	// 重定向目标条目不属于某个头像，此时刷新头像本身
+	if source, _ := h.cache.Peek(entry.Metadata.SourceKey); source != nil && source.Metadata.Hash != "" {
+		entry = source
+		target = source.Key
+		result["source_key"] = target
+	}
+
+	metadata := entry.Metadata
+	// 旧版本缓存的条目没有记录哈希和参数，无法重建上游请求
+	if metadata.Hash == "" {
+		http.Error(w, "Cache entry has no recorded hash, purge it instead", http.StatusConflict)
+		return
+	}
+	if style, ok := localStyle(metadata.Params); ok && metadata.Params["f"] == "y" {
+		http.Error(w, "Cache entry is a locally generated "+style+" avatar", http.StatusConflict)
+		return
+	}
+
+	requestID := h.requestID(w, r)
+	status, err := h.revalidate(r.Context(), target, metadata.Hash, metadata.Params, entry, requestID)
+	if err != nil {
+		log.Warn("admin revalidation failed", "error", err, "error_class", errorClass(err), "upstream", errorUpstream(err), "request_id", requestID, "key", target)
+		http.Error(w, "Upstream request failed", http.StatusBadGateway)
+		return
+	}
+	if status >= http.StatusInternalServerError {
+		log.Warn("admin revalidation got upstream error, keeping entry", "status", status, "request_id", requestID, "key", target)
+		http.Error(w, "Upstream returned "+http.StatusText(status), http.StatusBadGateway)
+		return
+	}
+
+	// 变体只是过时，不是被清除，不留墓碑，下次请求立即由新的原图重新生成
+	if target != key {
+		h.cache.Invalidate(key)
+	}
+	h.forgetTranscodeResults()
+
+	refreshed := "replaced"
+	if status == http.StatusNotModified {
+		refreshed = "not_modified"
+	}
+	log.Info("admin revalidation", "request_id", requestID, "key", target, "result", refreshed, "upstream_status", status)
+	result["result"] = refreshed
+	result["upstream_status"] = status
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(result)
+}
+
+type cacheVariant struct {
+	Key        string            `json:"key"`
+	Path       string            `json:"path"`
+	Params     map[string]string `json:"params"`
+	StatusCode int               `json:"status_code"`
+	Size       int64             `json:"size"`
+	CreatedAt  time.Time         `json:"created_at"`
+	Valid      bool              `json:"valid"`
+	Hits       int64             `json:"hits"`
+	SourceKey  string            `json:"source_key,omitempty"`
+}
+
+// cacheSearchHandler 列出某个头像哈希的所有缓存变体（GET /admin/cache?hash=...）
+// 不带hash时分页列出全部条目（GET /admin/cache?limit=&cursor=&sort=key|age|size|hits）
+func (h *Handler) cacheSearchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	hash := normalizeHash(r.URL.Query().Get("hash"))
+	if hash == "" {
+		h.cacheListHandler(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"hash":     hash,
+		"variants": h.cacheVariants(hash),
+	})
+}
+
+// cacheVariants 返回头像哈希的所有缓存变体，按创建时间排序
+func (h *Handler) cacheVariants(hash string) []cacheVariant {
+	variants := make([]cacheVariant, 0)
+	for _, key := range h.cache.KeysForHash(hash) {
+		entry, valid := h.cache.Peek(key)
+		if entry == nil {
+			continue
+		}
+		metadata := entry.Metadata
+		variants = append(variants, cacheVariant{
+			Key:        key,
+			Path:       metadata.Path,
+			Params:     metadata.Params,
+			StatusCode: metadata.StatusCode,
+			Size:       metadata.Size,
+			CreatedAt:  metadata.CreatedAt,
+			Valid:      valid,
+			Hits:       metadata.Hits,
+			SourceKey:  metadata.SourceKey,
+		})
+	}
+	sort.Slice(variants, func(i, j int) bool {
+		return variants[i].CreatedAt.Before(variants[j].CreatedAt)
+	})
+	return variants
+}
@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"gravatar-proxy/internal/config"
+)
+
+const (
+	// apiKeyHeader 携带API密钥的请求头，无法设置请求头的场景（如img标签）可改用api_key查询参数
+	apiKeyHeader = "X-API-Key"
+	apiKeyParam  = "api_key"
+)
+
+// apiKey 是一个已配置的密钥，name只用于统计和日志，不暴露密钥本身；tier为nil时不受等级限制
+type apiKey struct {
+	name     string
+	secret   []byte
+	tier     *keyTier
+	requests atomic.Int64
+}
+
+// keyTier 是API密钥等级的限制，见config.APIKeyTier；limiter按密钥名称分桶，为nil时不限流
+type keyTier struct {
+	name            string
+	limiter         *rateLimiter
+	maxSize         int
+	batch           bool
+	transformations bool
+}
+
+// parseAPIKeys 解析name=key列表并关联所属等级；列表为空时返回nil，表示不要求API密钥
+func parseAPIKeys(pairs []string, tiers map[string]config.APIKeyTier) ([]*apiKey, error) {
+	var keys []*apiKey
+	names := make(map[string]bool, len(pairs))
+	for i, pair := range pairs {
+		name, secret, ok := strings.Cut(pair, "=")
+		name, secret = strings.TrimSpace(name), strings.TrimSpace(secret)
+		if !ok || name == "" || secret == "" {
+			// 不在错误中回显内容，其中可能包含密钥
+			return nil, fmt.Errorf("invalid API key entry %d, expected name=key", i+1)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("duplicate API key name %q", name)
+		}
+		names[name] = true
+		keys = append(keys, &apiKey{name: name, secret: []byte(secret)})
+	}
+
+	byName := make(map[string]*apiKey, len(keys))
+	for _, key := range keys {
+		byName[key.name] = key
+	}
+	for name, tier := range tiers {
+		// 与全局限流相同，默认允许一秒的突发
+		burst := tier.RateLimitBurst
+		if burst == 0 {
+			burst = int(math.Ceil(tier.RateLimitRPS))
+		}
+		t := &keyTier{
+			name:            name,
+			limiter:         newRateLimiter(tier.RateLimitRPS, burst),
+			maxSize:         tier.MaxSize,
+			batch:           tier.Batch == nil || *tier.Batch,
+			transformations: tier.Transformations == nil || *tier.Transformations,
+		}
+		for _, keyName := range tier.Keys {
+			key, ok := byName[keyName]
+			if !ok {
+				return nil, fmt.Errorf("API key tier %q lists unknown key name %q", name, keyName)
+			}
+			key.tier = t
+		}
+	}
+	return keys, nil
+}
+
+// allowsBatch 判断密钥能否调用/prefetch；nil表示未使用API密钥（如管理令牌），不受限制
+func (k *apiKey) allowsBatch() bool {
+	return k == nil || k.tier == nil || k.tier.batch
+}
+
+// allowsTransformations 判断密钥能否得到转码后的格式
+func (k *apiKey) allowsTransformations() bool {
+	return k == nil || k.tier == nil || k.tier.transformations
+}
+
+// exceedsMaxSize 判断请求的头像尺寸（s参数，默认80）是否超过密钥等级的上限
+// 无法解析的尺寸交给上游处理
+func (k *apiKey) exceedsMaxSize(params map[string]string) bool {
+	if k == nil || k.tier == nil || k.tier.maxSize == 0 {
+		return false
+	}
+	size := 80
+	if s, ok := params["s"]; ok {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return false
+		}
+		size = n
+	}
+	return size > k.tier.maxSize
+}
+
+// tierName 返回密钥所属等级的名称，不属于任何等级时为空字符串
+func (k *apiKey) tierName() string {
+	if k == nil || k.tier == nil {
+		return ""
+	}
+	return k.tier.name
+}
+
+// lookupAPIKey 按常量时间比较所有密钥，避免通过响应时间猜测密钥
+func (h *Handler) lookupAPIKey(secret string) *apiKey {
+	var found *apiKey
+	for _, key := range h.apiKeys {
+		if subtle.ConstantTimeCompare([]byte(secret), key.secret) == 1 {
+			found = key
+		}
+	}
+	return found
+}
+
+// checkAPIKey 配置了API_KEYS时要求请求携带有效密钥，否则写出401；密钥所属等级配置了限流时按密钥限流，超出时写出429
+// 返回请求使用的密钥（未配置API_KEYS时为nil）和状态码，状态码不是200时已写出响应
+func (h *Handler) checkAPIKey(w http.ResponseWriter, r *http.Request, requestID string) (*apiKey, int) {
+	if len(h.apiKeys) == 0 {
+		return nil, http.StatusOK
+	}
+
+	secret := r.Header.Get(apiKeyHeader)
+	if secret == "" {
+		secret = r.URL.Query().Get(apiKeyParam)
+	}
+	if secret == "" {
+		apiKeyRejected.Inc("missing")
+		h.auditDenied(r, denyAPIKeyMissing, http.StatusUnauthorized, requestID)
+		w.Header().Set("WWW-Authenticate", `ApiKey realm="avatar"`)
+		http.Error(w, "API key required", http.StatusUnauthorized)
+		return nil, http.StatusUnauthorized
+	}
+
+	key := h.lookupAPIKey(secret)
+	if key == nil {
+		apiKeyRejected.Inc("invalid")
+		h.auditDenied(r, denyAPIKeyInvalid, http.StatusUnauthorized, requestID)
+		w.Header().Set("WWW-Authenticate", `ApiKey realm="avatar"`)
+		http.Error(w, "Invalid API key", http.StatusUnauthorized)
+		return nil, http.StatusUnauthorized
+	}
+
+	// 分片转发的请求已由前端节点计数和限流
+	if r.Header.Get(forwardedShardHeader) != "" {
+		return key, http.StatusOK
+	}
+	if key.tier != nil && key.tier.limiter != nil && !key.tier.limiter.allow(key.name) {
+		apiKeyTierRejected.Inc(key.tier.name, "rate_limited")
+		h.auditDenied(r, denyRateLimited, http.StatusTooManyRequests, requestID)
+		h.setRetryAfter(w, retryRateLimit)
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		return nil, http.StatusTooManyRequests
+	}
+	key.requests.Add(1)
+	apiKeyRequests.Inc(key.name)
+	return key, http.StatusOK
+}
+
+// apiKeyStats 返回每个密钥名称自启动以来的请求数
+func (h *Handler) apiKeyStats() map[string]int64 {
+	counts := make(map[string]int64, len(h.apiKeys))
+	for _, key := range h.apiKeys {
+		counts[key.name] = key.requests.Load()
+	}
+	return counts
+}
@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"net/http"
+
+	"gravatar-proxy/internal/log"
+)
+
+// 审计日志中的拒绝原因
+const (
+	denyOriginDenied      = "origin_denied"
+	denyRateLimited       = "rate_limited"
+	denyInvalidHash       = "invalid_hash"
+	denyAPIKeyMissing     = "api_key_missing"
+	denyAPIKeyInvalid     = "api_key_invalid"
+	denyTierMaxSize       = "tier_max_size"
+	denyTierBatch         = "tier_batch"
+	denyUnauthorized      = "unauthorized"
+	denyURLTooLong        = "url_too_long"
+	denyBodyNotAllowed    = "body_not_allowed"
+	denyBodyTooLarge      = "body_too_large"
+	denyConflictingParam  = "conflicting_param"
+	denyTransferEncoding  = "transfer_encoding_not_allowed"
+	denyDuplicateHeader   = "duplicate_header"
+	denyHeaderTooLarge    = "header_too_large"
+	denyAdminUnauthorized = "admin_unauthorized"
+	denyOverrideDenied    = "upstream_override_denied"
+)
+
+// auditDenied 将被拒绝的请求及其来源写入审计日志，用于排查滥用
+// 只记录路径不记录查询串，避免api_key等凭据进入日志；requestID为空时省略
+func (h *Handler) auditDenied(r *http.Request, reason string, status int, requestID string) {
+	args := []any{
+		"status", status,
+		"method", r.Method,
+		"path", r.URL.Path,
+		"client_ip", h.clientIP(r),
+		"origin", r.Header.Get("Origin"),
+		"referer", r.Referer(),
+		"user_agent", r.UserAgent(),
+	}
+	if requestID != "" {
+		args = append(args, "request_id", requestID)
+	}
+	log.Audit(reason, args...)
+}
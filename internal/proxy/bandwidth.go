@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gravatar-proxy/internal/log"
+)
+
+// bandwidthFile 保存当月上游下载量的文件名，位于缓存目录中，重启后继续累计
+const bandwidthFile = "upstream-bandwidth.json"
+
+// bandwidthSaveInterval 为定期保存下载量的间隔
+const bandwidthSaveInterval = time.Minute
+
+// errBandwidthCap 在当月上游下载量达到UPSTREAM_MONTHLY_CAP_BYTES后代替上游请求返回，由降级阶梯处理
+var errBandwidthCap = errors.New("upstream monthly bandwidth cap reached")
+
+// bandwidthMeter 按自然月（UTC）累计从上游下载的响应体字节数
+type bandwidthMeter struct {
+	capBytes int64
+	path     string
+	now      func() time.Time
+	saveMu   sync.Mutex
+
+	mu     sync.Mutex
+	month  string
+	bytes  int64
+	dirty  bool
+	capped bool
+}
+
+type bandwidthState struct {
+	Month string `json:"month"`
+	Bytes int64  `json:"bytes"`
+}
+
+// newBandwidthMeter 创建计量器并读取dir中保存的当月下载量；dir为空时不保存
+func newBandwidthMeter(capBytes int64, dir string) *bandwidthMeter {
+	m := &bandwidthMeter{capBytes: capBytes, now: time.Now}
+	if dir != "" {
+		m.path = filepath.Join(dir, bandwidthFile)
+	}
+	m.month = m.currentMonth()
+
+	if m.path == "" {
+		return m
+	}
+	data, err := os.ReadFile(m.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warn("failed to read upstream bandwidth usage", "error", err, "path", m.path)
+		}
+		return m
+	}
+	var state bandwidthState
+	if err := json.Unmarshal(data, &state); err != nil {
+		log.Warn("failed to parse upstream bandwidth usage, starting from zero", "error", err, "path", m.path)
+		return m
+	}
+	if state.Month == m.month {
+		m.bytes = state.Bytes
+	}
+	upstreamBandwidthMonthBytes.Set(float64(m.bytes))
+	return m
+}
+
+func (m *bandwidthMeter) currentMonth() string {
+	return m.now().UTC().Format("2006-01")
+}
+
+// rollLocked 进入新的月份时清零
+func (m *bandwidthMeter) rollLocked() {
+	if month := m.currentMonth(); month != m.month {
+		if m.capped {
+			log.Info("new month started, upstream fetches resume", "month", month, "previous_bytes", m.bytes)
+		}
+		m.month, m.bytes, m.dirty, m.capped = month, 0, true, false
+		upstreamBandwidthMonthBytes.Set(0)
+	}
+}
+
+func (m *bandwidthMeter) add(n int64) {
+	upstreamDownloadBytes.Add(float64(n))
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rollLocked()
+	m.bytes += n
+	m.dirty = true
+	upstreamBandwidthMonthBytes.Set(float64(m.bytes))
+}
+
+// exhausted 报告当月下载量是否已达到上限，首次达到时记录警告
+func (m *bandwidthMeter) exhausted() bool {
+	if m.capBytes <= 0 {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rollLocked()
+	if m.bytes < m.capBytes {
+		return false
+	}
+	if !m.capped {
+		m.capped = true
+		log.Warn("upstream monthly bandwidth cap reached, no longer fetching from upstream until next month",
+			"month", m.month, "bytes", m.bytes, "cap_bytes", m.capBytes)
+	}
+	return true
+}
+
+// usage 返回当前月份和当月下载量
+func (m *bandwidthMeter) usage() (string, int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rollLocked()
+	return m.month, m.bytes
+}
+
+// save 在下载量变化后写入文件，先写临时文件再改名，避免崩溃时留下不完整的文件
+func (m *bandwidthMeter) save() error {
+	m.saveMu.Lock()
+	defer m.saveMu.Unlock()
+
+	m.mu.Lock()
+	if m.path == "" || !m.dirty {
+		m.mu.Unlock()
+		return nil
+	}
+	data, _ := json.Marshal(bandwidthState{Month: m.month, Bytes: m.bytes})
+	m.dirty = false
+	m.mu.Unlock()
+
+	tmp := m.path + ".tmp"
+	err := os.WriteFile(tmp, data, 0644)
+	if err == nil {
+		err = os.Rename(tmp, m.path)
+	}
+	if err != nil {
+		m.mu.Lock()
+		m.dirty = true
+		m.mu.Unlock()
+	}
+	return err
+}
+
+// bandwidthTransport 累计上游响应体的字节数，当月达到上限后不再发出请求
+// HEAD请求（就绪检查的探测）没有响应体，不受上限影响
+type bandwidthTransport struct {
+	base  http.RoundTripper
+	meter *bandwidthMeter
+}
+
+func (t *bandwidthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodHead && t.meter.exhausted() {
+		return nil, errBandwidthCap
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &meteredBody{ReadCloser: resp.Body, meter: t.meter}
+	return resp, nil
+}
+
+type meteredBody struct {
+	io.ReadCloser
+	meter *bandwidthMeter
+}
+
+func (b *meteredBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.meter.add(int64(n))
+	}
+	return n, err
+}
+
+// StartBandwidthAccounting 定期保存当月上游下载量，直到ctx结束
+func (h *Handler) StartBandwidthAccounting(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(bandwidthSaveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := h.bandwidth.save(); err != nil {
+					log.Warn("failed to save upstream bandwidth usage", "error", err)
+				}
+			}
+		}
+	}()
+}
+
+// SaveBandwidthUsage 立即保存当月上游下载量，关闭时调用
+func (h *Handler) SaveBandwidthUsage() error {
+	return h.bandwidth.save()
+}
+
+// saved 记录一次由缓存返回、无需从上游下载n字节的响应，返回附加到请求日志的字段
+func (h *Handler) saved(n int64) []any {
+	if n <= 0 {
+		return nil
+	}
+	h.bytesSaved.Add(n)
+	cacheBytesSaved.Add(float64(n))
+	return []any{"bytes_saved", n}
+}
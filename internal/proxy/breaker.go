@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"gravatar-proxy/internal/log"
+)
+
+// 熔断器状态，同时作为upstream_circuit_transitions_total的state标签
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+// breakerStateValue 为upstream_circuit_state指标中各状态对应的值
+var breakerStateValue = map[string]float64{
+	breakerClosed:   0,
+	breakerOpen:     1,
+	breakerHalfOpen: 2,
+}
+
+// errCircuitOpen 在上游熔断期间代替上游请求返回，由降级阶梯处理
+var errCircuitOpen = errors.New("upstream circuit breaker is open")
+
+// circuitBreaker 按上游记录连续失败次数，达到阈值后熔断
+// 熔断期间不再请求该上游；冷却时间过后放行一个探测请求，成功则恢复，失败则重新熔断
+// 为nil时不启用，始终放行
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu        sync.Mutex
+	upstreams map[string]*breakerState
+}
+
+type breakerState struct {
+	state    string
+	failures int
+	openedAt time.Time
+	// probeAt 为半开状态下放行探测请求的时间；探测请求没有结果（如客户端断开）时，冷却时间后再放行一个
+	probeAt time.Time
+}
+
+// breakerStatus 为/admin/stats中单个上游的熔断器状态
+type breakerStatus struct {
+	Upstream            string     `json:"upstream"`
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	OpenedAt            *time.Time `json:"opened_at,omitempty"`
+}
+
+// newCircuitBreaker 创建熔断器，threshold不为正时返回nil
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+		upstreams: make(map[string]*breakerState),
+	}
+}
+
+func (b *circuitBreaker) stateLocked(upstream string) *breakerState {
+	s, ok := b.upstreams[upstream]
+	if !ok {
+		s = &breakerState{state: breakerClosed}
+		b.upstreams[upstream] = s
+	}
+	return s
+}
+
+// allow 判断是否可以请求该上游；熔断的冷却时间过后转为半开并放行一个探测请求
+func (b *circuitBreaker) allow(upstream string) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := b.stateLocked(upstream)
+	now := b.now()
+	switch s.state {
+	case breakerOpen:
+		if now.Sub(s.openedAt) < b.cooldown {
+			return false
+		}
+		b.transitionLocked(upstream, s, breakerHalfOpen)
+		s.probeAt = now
+		log.Info("upstream circuit breaker half-open, sending probe", "upstream", upstream)
+		return true
+	case breakerHalfOpen:
+		if now.Sub(s.probeAt) < b.cooldown {
+			return false
+		}
+		s.probeAt = now
+		return true
+	}
+	return true
+}
+
+// record 记录一次请求的结果：成功时清零失败次数并关闭熔断器，失败达到阈值或探测失败时熔断
+func (b *circuitBreaker) record(upstream string, success bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := b.stateLocked(upstream)
+	if success {
+		s.failures = 0
+		if s.state != breakerClosed {
+			b.transitionLocked(upstream, s, breakerClosed)
+			log.Info("upstream circuit breaker closed", "upstream", upstream)
+		}
+		return
+	}
+
+	s.failures++
+	if s.state == breakerHalfOpen || (s.state == breakerClosed && s.failures >= b.threshold) {
+		s.openedAt = b.now()
+		b.transitionLocked(upstream, s, breakerOpen)
+		log.Warn("upstream circuit breaker opened", "upstream", upstream, "consecutive_failures", s.failures, "cooldown_ms", b.cooldown.Milliseconds())
+	}
+}
+
+func (b *circuitBreaker) transitionLocked(upstream string, s *breakerState, state string) {
+	s.state = state
+	upstreamCircuitState.Set(breakerStateValue[state], upstream)
+	upstreamCircuitTransitions.Inc(upstream, state)
+}
+
+// recordBreaker 按上游请求的结果更新熔断器：网络错误和5xx算作失败
+// 客户端断开导致的取消和达到带宽上限时没有发出的请求不反映上游状态，不计入
+func (h *Handler) recordBreaker(ctx context.Context, upstream string, resp *http.Response, err error) {
+	if err != nil {
+		if ctx.Err() != nil || errors.Is(err, errBandwidthCap) {
+			return
+		}
+		h.breaker.record(upstream, false)
+		return
+	}
+	h.breaker.record(upstream, resp.StatusCode < http.StatusInternalServerError)
+}
+
+// status 返回各上游的熔断器状态，按上游地址排序
+func (b *circuitBreaker) status() []breakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	status := make([]breakerStatus, 0, len(b.upstreams))
+	for upstream, s := range b.upstreams {
+		entry := breakerStatus{Upstream: upstream, State: s.state, ConsecutiveFailures: s.failures}
+		if s.state != breakerClosed {
+			openedAt := s.openedAt
+			entry.OpenedAt = &openedAt
+		}
+		status = append(status, entry)
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Upstream < status[j].Upstream })
+	return status
+}
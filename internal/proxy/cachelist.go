@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gravatar-proxy/internal/cache"
+)
+
+const (
+	// cacheListDefaultLimit 和 cacheListMaxLimit 为分页列出缓存条目时每页的默认和最大条目数
+	cacheListDefaultLimit = 100
+	cacheListMaxLimit     = 1000
+)
+
+// cacheListPage 是分页列出缓存条目的一页；NextCursor为空表示已是最后一页
+type cacheListPage struct {
+	Sort       string         `json:"sort"`
+	Total      int            `json:"total"`
+	Entries    []cacheVariant `json:"entries"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+// cacheListHandler 按sort顺序分页列出全部缓存条目，用上一页的next_cursor作为cursor取下一页
+func (h *Handler) cacheListHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	order := query.Get("sort")
+	if order == "" {
+		order = cache.ListByKey
+	}
+	if !cache.ValidListOrder(order) {
+		http.Error(w, "sort must be key, age, size or hits", http.StatusBadRequest)
+		return
+	}
+	limit := cacheListDefaultLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, cacheListMaxLimit)
+	}
+	var after *cache.ListCursor
+	if v := query.Get("cursor"); v != "" {
+		cursor, ok := decodeListCursor(v, order)
+		if !ok {
+			http.Error(w, "Invalid cursor for this sort order", http.StatusBadRequest)
+			return
+		}
+		after = cursor
+	}
+
+	entries, next := h.cache.List(order, after, limit)
+	ttl := h.current().ttl
+	now := time.Now()
+	page := cacheListPage{Sort: order, Total: h.cache.Stats().Entries, Entries: make([]cacheVariant, 0, len(entries))}
+	for _, entry := range entries {
+		metadata := entry.Metadata
+		page.Entries = append(page.Entries, cacheVariant{
+			Key:        entry.Key,
+			Path:       metadata.Path,
+			Params:     metadata.Params,
+			StatusCode: metadata.StatusCode,
+			Size:       metadata.Size,
+			CreatedAt:  metadata.CreatedAt,
+			Valid:      now.Sub(metadata.CreatedAt) <= ttl,
+			Hits:       metadata.Hits,
+			SourceKey:  metadata.SourceKey,
+		})
+	}
+	if next != nil {
+		page.NextCursor = encodeListCursor(order, next)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(page)
+}
+
+// encodeListCursor 将排序方式和最后一个条目编码为不透明的游标，防止与其他排序方式混用
+func encodeListCursor(order string, cursor *cache.ListCursor) string {
+	raw := order + ":" + strconv.FormatInt(cursor.Value, 10) + ":" + cursor.Key
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeListCursor(s, order string) (*cache.ListCursor, bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, false
+	}
+	parts := strings.SplitN(string(raw), ":", 3)
+	if len(parts) != 3 || parts[0] != order {
+		return nil, false
+	}
+	value, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	return &cache.ListCursor{Value: value, Key: parts[2]}, true
+}
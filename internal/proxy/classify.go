@@ -0,0 +1,216 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"gravatar-proxy/internal/cache"
+)
+
+// 上游失败的分类，用作upstream_errors_total的class标签和日志的error_class字段
+const (
+	errorClassDNS            = "dns"
+	errorClassConnectTimeout = "connect_timeout"
+	errorClassConnectRefused = "connect_refused"
+	errorClassTLS            = "tls"
+	errorClassTimeout        = "timeout"
+	errorClassHeaderTooLarge = "header_too_large"
+	errorClassStatus4xx      = "status_4xx"
+	errorClassStatus5xx      = "status_5xx"
+	errorClassBodyRead       = "body_read"
+	errorClassBodyTooLarge   = "body_too_large"
+	errorClassBandwidthCap   = "bandwidth_cap"
+	errorClassCircuitOpen    = "circuit_open"
+	errorClassContentType    = "content_type"
+	errorClassOther          = "other"
+)
+
+// upstreamError 记录失败的上游及其分类
+type upstreamError struct {
+	upstream string
+	class    string
+	err      error
+}
+
+func (e *upstreamError) Error() string {
+	return e.err.Error()
+}
+
+func (e *upstreamError) Unwrap() error {
+	return e.err
+}
+
+// errorClass 返回错误的分类；未经分类的错误现场判断
+func errorClass(err error) string {
+	var ue *upstreamError
+	if errors.As(err, &ue) {
+		return ue.class
+	}
+	return classifyError(err)
+}
+
+// errorUpstream 返回失败的上游地址，未知时返回空字符串
+func errorUpstream(err error) string {
+	var ue *upstreamError
+	if errors.As(err, &ue) {
+		return ue.upstream
+	}
+	return ""
+}
+
+// classifyError 区分请求阶段的失败：DNS解析、建连超时、建连被拒、TLS握手和其余超时
+func classifyError(err error) string {
+	if errors.Is(err, errBandwidthCap) {
+		return errorClassBandwidthCap
+	}
+	if errors.Is(err, errCircuitOpen) {
+		return errorClassCircuitOpen
+	}
+	if errors.Is(err, errNotAnImage) {
+		return errorClassContentType
+	}
+	if errors.Is(err, errUpstreamTooLarge) {
+		return errorClassBodyTooLarge
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return errorClassDNS
+	}
+
+	if isTLSError(err) {
+		return errorClassTLS
+	}
+
+	if errors.Is(err, errHeaderTooLarge) {
+		return errorClassHeaderTooLarge
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		if opErr.Timeout() {
+			return errorClassConnectTimeout
+		}
+		return errorClassConnectRefused
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return errorClassTimeout
+	}
+	return errorClassOther
+}
+
+func isTLSError(err error) bool {
+	var (
+		handshake   *tlsHandshakeError
+		recordErr   tls.RecordHeaderError
+		verifyErr   *tls.CertificateVerificationError
+		alertErr    tls.AlertError
+		authority   x509.UnknownAuthorityError
+		hostname    x509.HostnameError
+		invalidCert x509.CertificateInvalidError
+	)
+	if errors.Is(err, errPinMismatch) {
+		return true
+	}
+	return errors.As(err, &handshake) || errors.As(err, &recordErr) || errors.As(err, &verifyErr) || errors.As(err, &alertErr) ||
+		errors.As(err, &authority) || errors.As(err, &hostname) || errors.As(err, &invalidCert)
+}
+
+// tlsHandshakeError 标记TLS握手阶段的失败；握手错误大多没有导出类型，由poolTransport根据握手回调包装
+type tlsHandshakeError struct {
+	err error
+}
+
+func (e *tlsHandshakeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *tlsHandshakeError) Unwrap() error {
+	return e.err
+}
+
+// headerTimeoutError 标记UPSTREAM_HEADER_TIMEOUT内没有收到上游响应头；请求已到达上游，仍按超时分类
+type headerTimeoutError struct {
+	err error
+}
+
+func (e *headerTimeoutError) Error() string {
+	return e.err.Error()
+}
+
+func (e *headerTimeoutError) Unwrap() error {
+	return e.err
+}
+
+// Timeout 让外层的url.Error仍报告为超时
+func (e *headerTimeoutError) Timeout() bool {
+	return true
+}
+
+func (e *headerTimeoutError) Temporary() bool {
+	return true
+}
+
+// errHeaderTooLarge 在上游响应头超出UPSTREAM_MAX_HEADER_BYTES时返回
+var errHeaderTooLarge = errors.New("upstream response headers too large")
+
+// Transport超出MaxResponseHeaderBytes和ResponseHeaderTimeout时的错误前缀；这些错误没有导出类型，在poolTransport中转换为可判断的错误
+const (
+	headerLimitPrefix   = "net/http: server response headers exceeded"
+	headerTimeoutPrefix = "net/http: timeout awaiting response headers"
+)
+
+// typedTransportError 把Transport返回的无类型错误包装成可以用errors.Is和errors.As判断的错误
+// handshakeErr为本次请求TLS握手失败时回调收到的错误；握手超时保留原错误，按超时分类
+func typedTransportError(err, handshakeErr error) error {
+	var netErr net.Error
+	switch {
+	case handshakeErr != nil && !(errors.As(handshakeErr, &netErr) && netErr.Timeout()):
+		return &tlsHandshakeError{err: err}
+	case hasTransportError(err, headerLimitPrefix):
+		return fmt.Errorf("%w: %w", errHeaderTooLarge, err)
+	case hasTransportError(err, headerTimeoutPrefix):
+		return &headerTimeoutError{err: err}
+	}
+	return err
+}
+
+// hasTransportError 沿包装链查找以prefix开头的Transport错误
+func hasTransportError(err error, prefix string) bool {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if strings.HasPrefix(err.Error(), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// statusClass 返回上游响应状态码的错误分类，非错误状态返回空字符串
+func statusClass(status int) string {
+	switch {
+	case status >= http.StatusInternalServerError:
+		return errorClassStatus5xx
+	case status >= http.StatusBadRequest:
+		return errorClassStatus4xx
+	default:
+		return ""
+	}
+}
+
+// readUpstreamBody 读取上游响应体，失败时记为body_read，超出MAX_UPSTREAM_BYTES时记为body_too_large
+func readUpstreamBody(resp *http.Response, upstream string) ([]byte, error) {
+	data, err := cache.ReadResponseBody(resp)
+	if err != nil {
+		class := bodyErrorClass(err)
+		upstreamErrors.Inc(upstream, class)
+		return nil, &upstreamError{upstream: upstream, class: class, err: err}
+	}
+	return data, nil
+}
@@ -0,0 +1,281 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gravatar-proxy/internal/config"
+	"gravatar-proxy/internal/log"
+)
+
+// newUpstreamClient 构造访问上游使用的HTTP客户端
+// 分别限制建连、TLS握手、等待响应头和读取响应体的时间；配置了UPSTREAM_TIMEOUT时另有整体超时
+func newUpstreamClient(cfg *config.Config, meter *bandwidthMeter) (*http.Client, error) {
+	keepAlive := cfg.UpstreamKeepAlive
+	if keepAlive == 0 {
+		keepAlive = config.DefaultUpstreamKeepAlive
+	}
+	dialer := &net.Dialer{
+		Timeout:   timeoutOr(cfg.UpstreamDialTimeout, config.DefaultUpstreamDialTimeout),
+		KeepAlive: keepAlive,
+	}
+
+	localIP, err := sourceAddress(cfg.UpstreamSourceAddr, cfg.UpstreamInterface)
+	if err != nil {
+		return nil, err
+	}
+	if localIP != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: localIP}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// 默认按HTTP_PROXY、HTTPS_PROXY和NO_PROXY选择代理；SOCKS5代理同样经由DialContext建连
+	switch cfg.UpstreamProxy {
+	case "":
+	case config.UpstreamProxyDirect:
+		transport.Proxy = nil
+	default:
+		// 解析错误中带有原值，可能包含代理凭据
+		proxyURL, err := url.Parse(cfg.UpstreamProxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream proxy URL")
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+		log.Info("sending upstream requests through proxy", "proxy", proxyURL.Redacted())
+	}
+	dial := dialer.DialContext
+	if resolver := newUpstreamResolver(cfg); resolver != nil {
+		dial = resolver.dialContext(dial)
+	}
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		openConns.Add(1)
+		return &trackedConn{Conn: conn}, nil
+	}
+	if cfg.UpstreamMaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = cfg.UpstreamMaxIdleConnsPerHost
+	}
+	if cfg.UpstreamMaxIdleConns > 0 {
+		transport.MaxIdleConns = cfg.UpstreamMaxIdleConns
+	}
+	if cfg.UpstreamIdleConnTimeout > 0 {
+		transport.IdleConnTimeout = cfg.UpstreamIdleConnTimeout
+	}
+	transport.TLSHandshakeTimeout = timeoutOr(cfg.UpstreamTLSTimeout, config.DefaultUpstreamTLSTimeout)
+	// 固定公钥在系统根证书校验之外额外检查，防止被信任的中间人证书（如企业TLS拦截）静默替换上游证书
+	// 只检查与上游的握手，与HTTPS代理的握手按代理自己的证书常规校验
+	if len(cfg.UpstreamPins) > 0 {
+		proxies := &proxyHosts{}
+		if transport.Proxy != nil {
+			transport.Proxy = proxies.track(transport.Proxy)
+		}
+		transport.TLSClientConfig = &tls.Config{VerifyConnection: verifyPins(cfg.UpstreamPins, proxies.has)}
+	}
+	transport.ResponseHeaderTimeout = timeoutOr(cfg.UpstreamHeaderTimeout, config.DefaultUpstreamHeaderTimeout)
+	// Go默认允许1MB的响应头，头像响应不需要这么多
+	transport.MaxResponseHeaderBytes = config.DefaultUpstreamMaxHeaderBytes
+	if cfg.UpstreamMaxHeaderBytes > 0 {
+		transport.MaxResponseHeaderBytes = cfg.UpstreamMaxHeaderBytes
+	}
+
+	return &http.Client{
+		Transport: &bandwidthTransport{
+			base: &bodyTimeoutTransport{
+				base:    &poolTransport{base: transport},
+				timeout: timeoutOr(cfg.UpstreamBodyTimeout, config.DefaultUpstreamBodyTimeout),
+			},
+			meter: meter,
+		},
+		Timeout: cfg.UpstreamTimeout,
+		// 重定向由followRedirect处理，以便按目标地址缓存
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}, nil
+}
+
+// 连接池状态：openConns为已建立的连接数，activeConns为正在承载请求的连接数，其余为空闲连接
+var (
+	openConns   atomic.Int64
+	activeConns atomic.Int64
+)
+
+// trackedConn 在连接关闭时更新已建立连接数
+type trackedConn struct {
+	net.Conn
+	closeOnce sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.closeOnce.Do(func() { openConns.Add(-1) })
+	return c.Conn.Close()
+}
+
+// poolTransport 记录每个请求拿到的是复用连接还是新建连接，并跟踪连接占用
+// 连接从拿到开始算作活跃，直到响应体被关闭
+type poolTransport struct {
+	base http.RoundTripper
+}
+
+func (t *poolTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Transport在复用连接失败时可能重试，因此一个请求可能拿到多次连接
+	acquired := 0
+	var handshakeErr error
+	trace := &httptrace.ClientTrace{
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err != nil {
+				handshakeErr = err
+			}
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			acquired++
+			activeConns.Add(1)
+			if info.Reused {
+				upstreamConnections.Inc("reused")
+			} else {
+				upstreamConnections.Inc("new")
+			}
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		activeConns.Add(int64(-acquired))
+		return nil, typedTransportError(err, handshakeErr)
+	}
+	if acquired > 1 {
+		activeConns.Add(int64(1 - acquired))
+	}
+	if acquired > 0 {
+		resp.Body = &trackedBody{ReadCloser: resp.Body}
+	}
+	return resp, nil
+}
+
+// trackedBody 在响应体关闭时将连接标记为不再活跃
+type trackedBody struct {
+	io.ReadCloser
+	closeOnce sync.Once
+}
+
+func (b *trackedBody) Close() error {
+	b.closeOnce.Do(func() { activeConns.Add(-1) })
+	return b.ReadCloser.Close()
+}
+
+func timeoutOr(d, defaultValue time.Duration) time.Duration {
+	if d > 0 {
+		return d
+	}
+	return defaultValue
+}
+
+// errBodyTimeout 在读取响应体超过UPSTREAM_BODY_TIMEOUT时返回，按超时分类
+var errBodyTimeout error = &timeoutError{"upstream response body read timed out"}
+
+type timeoutError struct{ msg string }
+
+func (e *timeoutError) Error() string   { return e.msg }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+// bodyTimeoutTransport 从收到响应头开始计时，超时后取消请求，未读完的响应体返回errBodyTimeout
+type bodyTimeoutTransport struct {
+	base    http.RoundTripper
+	timeout time.Duration
+}
+
+func (t *bodyTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancelCause(req.Context())
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel(nil)
+		return nil, err
+	}
+	timer := time.AfterFunc(t.timeout, func() { cancel(errBodyTimeout) })
+	resp.Body = &timedBody{ReadCloser: resp.Body, ctx: ctx, stop: func() {
+		timer.Stop()
+		cancel(nil)
+	}}
+	return resp, nil
+}
+
+// timedBody 在超时取消后把读取错误替换为errBodyTimeout，关闭时停止计时
+type timedBody struct {
+	io.ReadCloser
+	ctx  context.Context
+	stop func()
+}
+
+func (b *timedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && context.Cause(b.ctx) == errBodyTimeout {
+		err = errBodyTimeout
+	}
+	return n, err
+}
+
+func (b *timedBody) Close() error {
+	b.stop()
+	return b.ReadCloser.Close()
+}
+
+// sourceAddress 解析出站连接的本地源地址；指定网卡时优先使用其第一个IPv4地址
+func sourceAddress(addr, iface string) (net.IP, error) {
+	if addr != "" {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid upstream source address %q", addr)
+		}
+		return ip, nil
+	}
+
+	if iface == "" {
+		return nil, nil
+	}
+
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up interface %s: %w", iface, err)
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list addresses of interface %s: %w", iface, err)
+	}
+	ip := interfaceSourceIP(addrs)
+	if ip == nil {
+		return nil, fmt.Errorf("interface %s has no usable address", iface)
+	}
+	return ip, nil
+}
+
+// interfaceSourceIP 从网卡地址中选出源地址：跳过链路本地地址，优先第一个IPv4地址，没有时用第一个IPv6地址
+func interfaceSourceIP(addrs []net.Addr) net.IP {
+	var fallback net.IP
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipnet.IP.To4() != nil {
+			return ipnet.IP
+		}
+		if fallback == nil {
+			fallback = ipnet.IP
+		}
+	}
+	return fallback
+}
@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gravatar-proxy/internal/cache"
+	"gravatar-proxy/internal/config"
+)
+
+// clusterStatsTimeout 为向每个节点请求统计的超时，超时的节点标记为不可达
+const clusterStatsTimeout = 5 * time.Second
+
+// clusterMember 是集群概览中的一个节点
+type clusterMember struct {
+	URL      string `json:"url,omitempty"`
+	Self     bool   `json:"self,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	Zone     string `json:"zone,omitempty"`
+	// Roles 为本节点与该节点的关系：shard、purge或primary
+	Roles     []string `json:"roles,omitempty"`
+	Reachable bool     `json:"reachable"`
+	// Healthy 为分片节点最近一次健康检查的结果，非分片节点省略
+	Healthy *bool        `json:"healthy,omitempty"`
+	Error   string       `json:"error,omitempty"`
+	Cache   *cache.Stats `json:"cache,omitempty"`
+}
+
+// clusterTotals 汇总可达节点的缓存统计，命中率按合计的命中和未命中次数计算
+type clusterTotals struct {
+	Members   int     `json:"members"`
+	Reachable int     `json:"reachable"`
+	Entries   int     `json:"entries"`
+	Bytes     int64   `json:"bytes"`
+	MaxBytes  int64   `json:"max_bytes"`
+	Hits      int64   `json:"hits"`
+	Misses    int64   `json:"misses"`
+	HitRatio  float64 `json:"hit_ratio"`
+}
+
+// clusterHandler 返回本节点和所有已知节点的健康状态与缓存统计（GET /admin/cluster）
+// 已知节点为分片节点、PURGE_PEERS和FOLLOW_PRIMARY，各节点的统计通过其/admin/stats以ADMIN_TOKEN获取
+func (h *Handler) clusterHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	members := h.clusterMembers()
+	var wg sync.WaitGroup
+	for i := range members {
+		if members[i].Self {
+			continue
+		}
+		wg.Add(1)
+		go func(m *clusterMember) {
+			defer wg.Done()
+			h.fetchMemberStats(r.Context(), m)
+		}(&members[i])
+	}
+	wg.Wait()
+
+	var totals clusterTotals
+	for _, m := range members {
+		totals.Members++
+		if !m.Reachable || m.Cache == nil {
+			continue
+		}
+		totals.Reachable++
+		totals.Entries += m.Cache.Entries
+		totals.Bytes += m.Cache.Bytes
+		totals.MaxBytes += m.Cache.MaxBytes
+		totals.Hits += m.Cache.Hits
+		totals.Misses += m.Cache.Misses
+	}
+	if total := totals.Hits + totals.Misses; total > 0 {
+		totals.HitRatio = float64(totals.Hits) / float64(total)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"members": members,
+		"totals":  totals,
+	})
+}
+
+// clusterMembers 返回本节点和去重后的其他节点，本节点的统计直接读取
+func (h *Handler) clusterMembers() []clusterMember {
+	stats := h.cache.Stats()
+	self := clusterMember{Self: true, Instance: h.instance.Name, Zone: h.instance.Zone, Reachable: true, Cache: &stats}
+	if h.peers != nil {
+		self.URL = h.peers.self
+	}
+
+	others := make(map[string]*clusterMember)
+	add := func(url, role string) *clusterMember {
+		if url == self.URL {
+			return nil
+		}
+		m, ok := others[url]
+		if !ok {
+			m = &clusterMember{URL: url}
+			others[url] = m
+		}
+		m.Roles = append(m.Roles, role)
+		return m
+	}
+	if h.peers != nil {
+		for _, peer := range h.peers.status() {
+			if m := add(peer.URL, "shard"); m != nil {
+				healthy := peer.Healthy
+				m.Healthy = &healthy
+				m.Instance, m.Zone = peer.Instance, peer.Zone
+			}
+		}
+	}
+	for _, peer := range h.purgePeers {
+		add(strings.TrimSuffix(peer, "/"), "purge")
+	}
+	if h.followPrimary != "" {
+		add(h.followPrimary, "primary")
+	}
+
+	members := []clusterMember{self}
+	for _, m := range others {
+		members = append(members, *m)
+	}
+	sort.Slice(members[1:], func(i, j int) bool { return members[i+1].URL < members[j+1].URL })
+	return members
+}
+
+// fetchMemberStats 请求节点的/admin/stats，填入实例标识和缓存统计；失败时记录原因
+func (h *Handler) fetchMemberStats(ctx context.Context, m *clusterMember) {
+	if h.adminToken == "" {
+		m.Error = "ADMIN_TOKEN is required to query peers"
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, clusterStatsTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.URL+"/admin/stats", nil)
+	if err != nil {
+		m.Error = err.Error()
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+h.adminToken)
+	resp, err := h.peerClient.Do(req)
+	if err != nil {
+		m.Error = err.Error()
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		m.Error = fmt.Sprintf("peer returned status %d", resp.StatusCode)
+		return
+	}
+
+	var stats struct {
+		Cache    cache.Stats      `json:"cache"`
+		Instance *config.Identity `json:"instance"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&stats); err != nil {
+		m.Error = fmt.Sprintf("invalid stats response: %v", err)
+		return
+	}
+	m.Reachable = true
+	m.Cache = &stats.Cache
+	if stats.Instance != nil {
+		m.Instance, m.Zone = stats.Instance.Name, stats.Instance.Zone
+	}
+}
@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gravatar-proxy/internal/brotli"
+	"gravatar-proxy/internal/cache"
+	"gravatar-proxy/internal/log"
+)
+
+// compressMinBytes 小于此大小的响应不压缩，gzip头部的开销抵消了收益
+const compressMinBytes = 256
+
+// compressors 为支持的Content-Encoding及其编码器
+var compressors = map[string]func([]byte) []byte{
+	"br":   brotli.Encode,
+	"gzip": gzipBytes,
+}
+
+// parseCompressEncodings 规范化配置的压缩编码，并确认有可用的编码器
+func parseCompressEncodings(encodings []string) ([]string, error) {
+	parsed := make([]string, 0, len(encodings))
+	for _, e := range encodings {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if _, ok := compressors[e]; !ok {
+			return nil, fmt.Errorf("compressing with %s is not supported by this build", e)
+		}
+		parsed = append(parsed, e)
+	}
+	return parsed, nil
+}
+
+// isCompressible 判断内容类型是否值得压缩：SVG等文本格式可以，JPEG/PNG/WebP/GIF本身已压缩
+func isCompressible(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	switch {
+	case strings.HasPrefix(mediaType, "text/"):
+		return true
+	case strings.HasSuffix(mediaType, "+xml"), strings.HasSuffix(mediaType, "+json"):
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript", "image/bmp":
+		return true
+	}
+	return false
+}
+
+// varyOnEncoding 可压缩的响应内容取决于Accept-Encoding，无论这次是否压缩
+func (h *Handler) varyOnEncoding(w http.ResponseWriter, contentType string) {
+	if len(h.compressEncodings) > 0 && isCompressible(contentType) {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+}
+
+// negotiateEncoding 按配置顺序返回客户端Accept-Encoding接受的第一个编码
+// "*"接受所有未单独列出的编码，q=0表示拒绝
+func (h *Handler) negotiateEncoding(r *http.Request) string {
+	if len(h.compressEncodings) == 0 {
+		return ""
+	}
+
+	qualities := make(map[string]float64)
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		qualities[coding] = q
+	}
+
+	for _, encoding := range h.compressEncodings {
+		q, ok := qualities[encoding]
+		if !ok {
+			q, ok = qualities["*"]
+		}
+		if ok && q > 0 {
+			return encoding
+		}
+	}
+	return ""
+}
+
+func gzipBytes(data []byte) []byte {
+	var buf bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	zw.Write(data)
+	zw.Close()
+	return buf.Bytes()
+}
+
+// serveCompressed 尝试返回缓存条目的压缩版本；压缩版本作为独立缓存条目保存，与转码变体相同
+// 条目不可压缩、太小或压缩后不更小时返回false，由调用方返回原样内容
+func (h *Handler) serveCompressed(w http.ResponseWriter, r *http.Request, s *settings, cacheKey, hash string, queryParams map[string]string, encoding, requestID string) bool {
+	original, err := h.cache.GetMetadata(cacheKey)
+	if err != nil || original.StatusCode != http.StatusOK || original.Size < compressMinBytes ||
+		!isCompressible(original.Headers["Content-Type"]) || original.Headers["Content-Encoding"] != "" {
+		return false
+	}
+
+	variantParams := withParam(queryParams, "enc", encoding)
+	variantKey := h.cache.GenerateKey("/avatar/"+hash, variantParams)
+	if h.noTranscodeGain.has(variantKey) {
+		return false
+	}
+
+	// 原始条目刷新后，早于它的压缩版本视为过期
+	if variant, valid := h.cache.Peek(variantKey); valid && !variant.Metadata.CreatedAt.Before(original.CreatedAt) {
+		h.varyOnEncoding(w, original.Headers["Content-Type"])
+		if err := h.cache.WriteResponse(w, r, variantKey, int(s.ttl.Seconds())); err != nil {
+			log.Warn("failed to write compressed response", "error", err, "request_id", requestID)
+			return false
+		}
+		return true
+	}
+
+	data, err := h.cache.ReadData(cacheKey)
+	if err != nil {
+		return false
+	}
+	compressed := compressors[encoding](data)
+	if len(compressed) >= len(data) {
+		h.noTranscodeGain.add(variantKey)
+		return false
+	}
+
+	headers := make(map[string]string, len(original.Headers)+1)
+	for k, v := range original.Headers {
+		if k == "ETag" {
+			continue
+		}
+		headers[k] = v
+	}
+	headers["Content-Encoding"] = encoding
+	headers["Content-Length"] = strconv.Itoa(len(compressed))
+
+	metadata := cache.Metadata{
+		CreatedAt:      time.Now(),
+		LastAccessedAt: time.Now(),
+		Headers:        headers,
+		StatusCode:     http.StatusOK,
+		Upstream:       original.Upstream,
+		SourceKey:      cacheKey,
+		Hash:           hash,
+		Path:           "/avatar/" + hash,
+		Params:         variantParams,
+	}
+	if err := h.cache.Set(variantKey, compressed, metadata); err != nil {
+		log.Warn("failed to cache compressed variant", "error", err, "request_id", requestID)
+	}
+
+	log.Info("served compressed variant", "request_id", requestID, "key", variantKey, "encoding", encoding,
+		"original_bytes", len(data), "compressed_bytes", len(compressed))
+	h.writeResponse(w, s, metadata, compressed)
+	return true
+}
+
+// compressedAsset 返回内置资源按encoding压缩的版本，首次请求时压缩并保存在内存中，不值得压缩时也记住该结论
+func (h *Handler) compressedAsset(name, encoding string, data []byte) ([]byte, bool) {
+	key := name + "\x00" + encoding
+	if v, ok := h.compressedAssets.Load(key); ok {
+		compressed, _ := v.([]byte)
+		return compressed, compressed != nil
+	}
+	compressed := compressors[encoding](data)
+	if len(data) < compressMinBytes || len(compressed) >= len(data) {
+		compressed = nil
+	}
+	h.compressedAssets.Store(key, compressed)
+	return compressed, compressed != nil
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"gravatar-proxy/internal/config"
+	"gravatar-proxy/internal/log"
+)
+
+// sniffBytes 为判断图片格式读取的响应体开头字节数，与http.DetectContentType一致
+const sniffBytes = 512
+
+// errNotAnImage 在上游成功响应不是图片时返回（如CDN或上游的HTML错误页），该响应不缓存也不返回给客户端
+var errNotAnImage = errors.New("upstream response is not an image")
+
+// errUpstreamTooLarge 在上游响应体超过MAX_UPSTREAM_BYTES时返回，已读取的部分不缓存
+var errUpstreamTooLarge = errors.New("upstream response body exceeds MAX_UPSTREAM_BYTES")
+
+// checkContent 确认上游的成功响应是图片：Content-Type须为image/*，sniff模式下响应体开头还须是已知图片格式的签名
+// 读取的开头字节放回响应体，调用方照常读取；其余状态码不检查
+func (h *Handler) checkContent(resp *http.Response) error {
+	if h.contentCheck == config.ContentCheckOff || resp.StatusCode < 200 || resp.StatusCode >= 300 ||
+		resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !strings.HasPrefix(mediaType, "image/") {
+		return fmt.Errorf("%w: Content-Type %q", errNotAnImage, resp.Header.Get("Content-Type"))
+	}
+	if h.contentCheck != config.ContentCheckSniff {
+		return nil
+	}
+
+	br := bufio.NewReaderSize(resp.Body, sniffBytes)
+	head, err := br.Peek(sniffBytes)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return err
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{br, resp.Body}
+	if !isImageData(head) {
+		return fmt.Errorf("%w: %s body does not look like an image", errNotAnImage, mediaType)
+	}
+	return nil
+}
+
+// isImageData 按开头字节判断是否为图片：http.DetectContentType识别的格式，以及它不识别的AVIF/HEIF和SVG
+func isImageData(head []byte) bool {
+	if strings.HasPrefix(http.DetectContentType(head), "image/") {
+		return true
+	}
+	// ISO BMFF：第4到8字节为ftyp，之后是主品牌
+	if len(head) >= 12 && string(head[4:8]) == "ftyp" {
+		switch string(head[8:12]) {
+		case "avif", "avis", "heic", "heix", "mif1", "msf1":
+			return true
+		}
+	}
+	// SVG是XML文本，须以标记开头并含有<svg元素，内嵌SVG的HTML页面不算
+	text := bytes.ToLower(bytes.TrimLeft(bytes.TrimPrefix(head, []byte("\xEF\xBB\xBF")), " \t\r\n"))
+	return bytes.HasPrefix(text, []byte("<")) && bytes.Contains(text, []byte("<svg")) && !bytes.Contains(text, []byte("<html"))
+}
+
+// limitBody 限制上游响应体的大小：Content-Length已超出上限时直接拒绝，
+// 否则读取到超出上限的字节时返回errUpstreamTooLarge，流式写入缓存的调用方据此放弃条目
+func (h *Handler) limitBody(resp *http.Response) error {
+	if h.maxUpstreamBytes <= 0 {
+		return nil
+	}
+	if resp.ContentLength > h.maxUpstreamBytes {
+		return fmt.Errorf("%w: Content-Length %d", errUpstreamTooLarge, resp.ContentLength)
+	}
+	resp.Body = &limitedBody{
+		ReadCloser: resp.Body,
+		r:          io.LimitReader(resp.Body, h.maxUpstreamBytes+1),
+		remaining:  h.maxUpstreamBytes,
+	}
+	return nil
+}
+
+// limitedBody 多读一个字节来发现超出上限的响应体，超出的字节不交给调用方
+type limitedBody struct {
+	io.ReadCloser
+	r         io.Reader
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n + int(b.remaining), errUpstreamTooLarge
+	}
+	return n, err
+}
+
+// bodyErrorClass 返回读取上游响应体失败的分类
+func bodyErrorClass(err error) string {
+	if errors.Is(err, errUpstreamTooLarge) {
+		return errorClassBodyTooLarge
+	}
+	return errorClassBodyRead
+}
+
+// discardInvalid 丢弃未通过检查的上游响应并按class记录
+func discardInvalid(resp *http.Response, upstream, class string, err error, requestID string) {
+	if class != errorClassBodyTooLarge {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+	}
+	resp.Body.Close()
+	upstreamErrors.Inc(upstream, class)
+	log.Warn("upstream response rejected", "error", err, "error_class", class, "request_id", requestID, "upstream", upstream)
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// debugHeader 受信任调用方设置为1时，响应附带缓存决策和耗时的调试头
+const debugHeader = "X-Proxy-Debug"
+
+// debugInfo 收集单个请求的缓存决策；nil debugInfo的所有方法都是空操作
+type debugInfo struct {
+	start time.Time
+
+	mu           sync.Mutex
+	key          string
+	cache        string
+	tier         string
+	age          time.Duration
+	hasAge       bool
+	upstream     string
+	upstreamTime time.Duration
+	fallback     string
+}
+
+type debugContextKey struct{}
+
+// withDebug 为受信任且请求了调试信息的请求附加debugInfo
+func (h *Handler) withDebug(ctx context.Context, r *http.Request) (context.Context, *debugInfo) {
+	if r.Header.Get(debugHeader) != "1" || !h.isTrusted(r) {
+		return ctx, nil
+	}
+	d := &debugInfo{start: time.Now()}
+	return context.WithValue(ctx, debugContextKey{}, d), d
+}
+
+func debugFrom(ctx context.Context) *debugInfo {
+	d, _ := ctx.Value(debugContextKey{}).(*debugInfo)
+	return d
+}
+
+func (d *debugInfo) setKey(key string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.key = key
+	d.mu.Unlock()
+}
+
+// setCache 记录缓存决策，如hit、stale、miss、negative、resized、transcoded
+func (d *debugInfo) setCache(decision string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.cache = decision
+	d.mu.Unlock()
+}
+
+func (d *debugInfo) setEntry(tier string, createdAt time.Time) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.tier = tier
+	d.age = time.Since(createdAt)
+	d.hasAge = true
+	d.mu.Unlock()
+}
+
+func (d *debugInfo) setUpstream(upstream string, elapsed time.Duration) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.upstream = upstream
+	d.upstreamTime = elapsed
+	d.mu.Unlock()
+}
+
+func (d *debugInfo) setFallback(step string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.fallback = step
+	d.mu.Unlock()
+}
+
+// writeHeaders 在写出响应头之前附加调试头；调试响应不允许被下游缓存
+func (d *debugInfo) writeHeaders(header http.Header) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	set := func(name, value string) {
+		if value != "" {
+			header.Set(name, value)
+		}
+	}
+	set("X-Proxy-Cache-Key", d.key)
+	set("X-Proxy-Cache", d.cache)
+	set("X-Proxy-Cache-Tier", d.tier)
+	if d.hasAge {
+		header.Set("X-Proxy-Age", strconv.FormatFloat(d.age.Seconds(), 'f', 3, 64))
+	}
+	if d.upstream != "" {
+		header.Set("X-Proxy-Upstream", d.upstream)
+		header.Set("X-Proxy-Upstream-Time", strconv.FormatInt(d.upstreamTime.Milliseconds(), 10)+"ms")
+	}
+	set("X-Proxy-Fallback", d.fallback)
+	header.Set("X-Proxy-Time", strconv.FormatInt(time.Since(d.start).Milliseconds(), 10)+"ms")
+	header.Set("Cache-Control", "no-store")
+}
+
+// cacheTier 返回缓存数据当前所在的层
+func (h *Handler) cacheTier(key string) string {
+	if h.cache.InMemory(key) {
+		return "memory"
+	}
+	return "disk"
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gravatar-proxy/internal/assets"
+	"gravatar-proxy/internal/avatargen"
+	"gravatar-proxy/internal/cache"
+)
+
+type defaultInfo struct {
+	assets.Default
+	URL string `json:"url"`
+}
+
+// DefaultsHandler 列出内置默认头像（GET /defaults），或返回单个资源（GET /defaults/{name}）
+// SVG等可压缩的资源按Accept-Encoding返回压缩版本
+func (h *Handler) DefaultsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/defaults"), "/")
+	if name == "" {
+		list := assets.List()
+		infos := make([]defaultInfo, 0, len(list))
+		for _, d := range list {
+			infos = append(infos, defaultInfo{Default: d, URL: "/defaults/" + d.File})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]any{
+			"defaults":     infos,
+			"local_styles": avatargen.Styles(),
+		})
+		return
+	}
+
+	data, contentType, ok := assets.Get(name)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	h.varyOnEncoding(w, contentType)
+	if encoding := h.negotiateEncoding(r); encoding != "" && isCompressible(contentType) {
+		if compressed, ok := h.compressedAsset(name, encoding, data); ok {
+			w.Header().Set("Content-Encoding", encoding)
+			data = compressed
+		}
+	}
+	// 压缩版本与原始内容的ETag不同，按实际返回的内容计算
+	etag := cache.ContentETag(data)
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"context"
+	"time"
+
+	"gravatar-proxy/internal/log"
+)
+
+// evictTick 为后台淘汰的间隔，每次淘汰evictionRate的十分之一，使写锁每次只被短暂持有
+const evictTick = 100 * time.Millisecond
+
+// StartCacheEviction 在缓存超出MAX_CACHE_BYTES时按CACHE_EVICTION_RATE在后台逐步淘汰，直到ctx结束
+// 上限调小后重启时占用可能远超上限，一次性淘汰会阻塞启动后的第一次写入和所有读取
+func (h *Handler) StartCacheEviction(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(evictTick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				h.evictOverLimit()
+			}
+		}
+	}()
+}
+
+// evictOverLimit 淘汰一批超出上限的条目；开始和结束一轮淘汰时记录日志
+func (h *Handler) evictOverLimit() {
+	if h.cache.Overage() == 0 {
+		return
+	}
+	if h.evicting.CompareAndSwap(false, true) {
+		log.Warn("cache exceeds MAX_CACHE_BYTES, evicting in the background",
+			"overage_bytes", h.cache.Overage(), "entries_per_second", h.evictionRate)
+	}
+
+	evicted, overage := h.cache.EvictOverLimit(max(h.evictionRate/int(time.Second/evictTick), 1))
+	cacheBackgroundEvictions.Add(float64(evicted))
+	cacheOverLimitBytes.Set(float64(overage))
+	if overage == 0 && h.evicting.CompareAndSwap(true, false) {
+		log.Info("cache is back within MAX_CACHE_BYTES", "entries", h.cache.Stats().Entries)
+	}
+}
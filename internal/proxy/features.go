@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"gravatar-proxy/internal/config"
+	"gravatar-proxy/internal/log"
+)
+
+// featureFlags 保存各功能的开关状态，请求路径上无锁读取；集合在启动时确定，之后只修改状态
+// 状态只保存在内存中，重启后恢复为FEATURE_FLAGS的配置，配置热加载不改变运行时的修改
+type featureFlags map[string]*atomic.Bool
+
+func newFeatureFlags(configured map[string]bool) featureFlags {
+	f := make(featureFlags, len(config.Features))
+	for _, name := range config.Features {
+		enabled, ok := configured[name]
+		f[name] = &atomic.Bool{}
+		f.set(name, !ok || enabled)
+	}
+	return f
+}
+
+// enabled 返回功能是否开启；未知的功能视为开启
+func (f featureFlags) enabled(name string) bool {
+	flag, ok := f[name]
+	return !ok || flag.Load()
+}
+
+// set 修改功能的开关状态，返回之前的状态
+func (f featureFlags) set(name string, enabled bool) bool {
+	previous := f[name].Swap(enabled)
+	value := 0.0
+	if enabled {
+		value = 1
+	}
+	featureEnabled.Set(value, name)
+	return previous
+}
+
+// snapshot 返回所有功能的当前状态
+func (f featureFlags) snapshot() map[string]bool {
+	flags := make(map[string]bool, len(f))
+	for name, flag := range f {
+		flags[name] = flag.Load()
+	}
+	return flags
+}
+
+// featuresHandler 返回各功能的开关状态（GET /admin/features），
+// 或在运行时开关一个功能（POST /admin/features?name=...&enabled=true|false），修改立即生效
+func (h *Handler) featuresHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		query := r.URL.Query()
+		name := query.Get("name")
+		if _, ok := h.features[name]; !ok {
+			http.Error(w, "Unknown feature", http.StatusBadRequest)
+			return
+		}
+		enabled, err := strconv.ParseBool(query.Get("enabled"))
+		if err != nil {
+			http.Error(w, "enabled must be true or false", http.StatusBadRequest)
+			return
+		}
+		if previous := h.features.set(name, enabled); previous != enabled {
+			log.Warn("feature flag changed", "feature", name, "enabled", enabled)
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(h.features.snapshot())
+}
+
+// featureDisabled 在功能关闭时返回503并返回true，用于整体由开关控制的接口
+func (h *Handler) featureDisabled(w http.ResponseWriter, name string) bool {
+	if h.features.enabled(name) {
+		return false
+	}
+	http.Error(w, "Feature "+name+" is disabled", http.StatusServiceUnavailable)
+	return true
+}
@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"sync"
+
+	"gravatar-proxy/internal/cache"
+)
+
+// flightGroup 合并同一个键上并发进行的加载，只执行一次并把结果分给所有等待者
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done     chan struct{}
+	metadata cache.Metadata
+	data     []byte
+	err      error
+}
+
+// do 执行fn，若同一键已有加载在进行则等待其结果；shared表示结果来自其他请求发起的加载
+// 返回的数据在调用方之间共享，只能读取
+func (g *flightGroup) do(key string, fn func() (cache.Metadata, []byte, error)) (metadata cache.Metadata, data []byte, shared bool, err error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		<-call.done
+		return call.metadata, call.data, true, call.err
+	}
+	call := &flightCall{done: make(chan struct{})}
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	call.metadata, call.data, call.err = fn()
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	close(call.done)
+
+	return call.metadata, call.data, false, call.err
+}
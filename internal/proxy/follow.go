@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"gravatar-proxy/internal/cache"
+	"gravatar-proxy/internal/log"
+)
+
+// syncPageSize 是/admin/sync每页返回条目数的默认值和上限
+const syncPageSize = 500
+
+// maxSyncBodyBytes 限制热备从主节点下载的单个条目大小
+const maxSyncBodyBytes = 16 << 20
+
+type syncEntry struct {
+	Key      string         `json:"key"`
+	Metadata cache.Metadata `json:"metadata"`
+}
+
+type syncPage struct {
+	Entries []syncEntry `json:"entries"`
+	Next    string      `json:"next"`
+	More    bool        `json:"more"`
+}
+
+// syncHandler 返回cursor之后新写入或重新验证过的条目元数据（GET /admin/sync?cursor=...&limit=N），供热备节点增量同步
+// 响应中的next作为下一次请求的cursor，more为true时应立即继续请求
+func (h *Handler) syncHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := syncPageSize
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, syncPageSize)
+	}
+
+	entries, next, more := h.cache.ChangedSince(r.URL.Query().Get("cursor"), limit)
+	page := syncPage{Entries: make([]syncEntry, 0, len(entries)), Next: next, More: more}
+	for _, entry := range entries {
+		page.Entries = append(page.Entries, syncEntry{Key: entry.Key, Metadata: entry.Metadata})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(page)
+}
+
+// StartFollower 配置了FOLLOW_PRIMARY时每隔followInterval从主节点同步缓存，直到ctx结束
+// 首次同步从头开始，之后只拉取上次同步以来的变化；失败的页在下一轮重试
+func (h *Handler) StartFollower(ctx context.Context) {
+	if h.followPrimary == "" {
+		return
+	}
+	go func() {
+		var cursor string
+		ticker := time.NewTicker(h.followInterval)
+		defer ticker.Stop()
+		for {
+			cursor = h.syncFromPrimary(ctx, cursor)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// syncFromPrimary 从cursor开始逐页拉取主节点的变化并写入本地缓存，返回下一次同步的起点
+// 主节点重启后旧cursor失效，主节点会从头列出条目，本地已是同一版本的条目被跳过
+func (h *Handler) syncFromPrimary(ctx context.Context, cursor string) string {
+	for {
+		page, err := h.fetchSyncPage(ctx, cursor)
+		if err != nil {
+			log.Warn("failed to sync from primary", "error", err, "primary", h.followPrimary)
+			return cursor
+		}
+		for _, entry := range page.Entries {
+			followerSyncEntries.Inc(h.syncEntry(ctx, entry))
+		}
+		cursor = page.Next
+		if !page.More {
+			break
+		}
+	}
+	followerLastSync.Set(float64(time.Now().Unix()))
+	return cursor
+}
+
+func (h *Handler) fetchSyncPage(ctx context.Context, cursor string) (*syncPage, error) {
+	query := url.Values{"limit": {strconv.Itoa(syncPageSize)}}
+	if cursor != "" {
+		query.Set("cursor", cursor)
+	}
+	resp, err := h.primaryGet(ctx, "/admin/sync?"+query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("primary returned status %d", resp.StatusCode)
+	}
+
+	var page syncPage
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, fmt.Errorf("failed to decode sync page: %w", err)
+	}
+	return &page, nil
+}
+
+// syncEntry 同步一个条目并返回结果：本地已是同一版本时跳过，内容未变只更新元数据，否则从主节点下载数据
+func (h *Handler) syncEntry(ctx context.Context, entry syncEntry) string {
+	// 键须为本地派生方式生成的形式，避免主节点返回的key指向缓存目录之外；两端的KEY_SCHEME不同时条目都被拒绝
+	if !h.cache.ValidKey(entry.Key) {
+		return "failed"
+	}
+	metadata := entry.Metadata
+	metadata.Hits = 0
+	metadata.LastAccessedAt = time.Now()
+
+	if local, err := h.cache.GetMetadata(entry.Key); err == nil {
+		if !local.CreatedAt.Before(metadata.CreatedAt) {
+			return "skipped"
+		}
+		if etag := local.ResponseETag(); etag != "" && etag == metadata.ResponseETag() && local.Size == metadata.Size {
+			if err := h.cache.UpdateMetadata(entry.Key, metadata); err == nil {
+				return "refreshed"
+			}
+		}
+	}
+
+	resp, err := h.primaryGet(ctx, "/admin/cache/"+entry.Key+"/body")
+	if err != nil {
+		log.Warn("failed to fetch entry from primary", "error", err, "key", entry.Key)
+		return "failed"
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		// 列出之后已在主节点上被淘汰或清除
+		return "gone"
+	}
+	if resp.StatusCode != http.StatusOK {
+		log.Warn("primary rejected entry fetch", "status", resp.StatusCode, "key", entry.Key)
+		return "failed"
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSyncBodyBytes+1))
+	if err != nil || len(data) > maxSyncBodyBytes {
+		log.Warn("failed to read entry from primary", "error", err, "key", entry.Key)
+		return "failed"
+	}
+
+	if err := h.cache.Set(entry.Key, data, metadata); err != nil {
+		if errors.Is(err, cache.ErrPurged) {
+			return "skipped"
+		}
+		log.Warn("failed to store synced entry", "error", err, "key", entry.Key)
+		return "failed"
+	}
+	return "fetched"
+}
+
+func (h *Handler) primaryGet(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.followPrimary+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+h.adminToken)
+	return h.peerClient.Do(req)
+}
@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"gravatar-proxy/internal/cache"
+	"gravatar-proxy/internal/rpc"
+)
+
+// grpcService 是api/cacheadmin.proto中定义的服务名
+const grpcService = "gravatarproxy.admin.v1.CacheAdmin"
+
+// GRPCHandler 返回以gRPC提供缓存管理操作（Stats、Purge、Warm、Inspect）的处理器，与/admin/接口使用相同的认证
+// 调用需在元数据中携带authorization: Bearer <ADMIN_TOKEN或管理JWT>；两者都未配置时返回nil
+func (h *Handler) GRPCHandler() http.Handler {
+	if !h.adminEnabled() {
+		return nil
+	}
+
+	s := rpc.NewServer(grpcService)
+	s.Authorize = func(r *http.Request) error {
+		if !h.adminAuthorized(r) {
+			h.auditDenied(r, denyAdminUnauthorized, http.StatusUnauthorized, "")
+			return rpc.Errorf(rpc.Unauthenticated, "missing or invalid admin token")
+		}
+		return nil
+	}
+	s.Handle("Stats", h.grpcStats)
+	s.Handle("Purge", h.grpcPurge)
+	s.Handle("Warm", h.grpcWarm)
+	s.Handle("Inspect", h.grpcInspect)
+
+	mux := http.NewServeMux()
+	mux.Handle(s.Prefix(), s)
+	return mux
+}
+
+// grpcStats 返回与GET /admin/stats相同的缓存统计
+func (h *Handler) grpcStats(ctx context.Context, req []byte) ([]byte, error) {
+	if err := rpc.Decode(req, func(rpc.Field) error { return nil }); err != nil {
+		return nil, rpc.Errorf(rpc.InvalidArgument, "%v", err)
+	}
+
+	stats := h.cache.Stats()
+	var m rpc.Message
+	m.Int(1, int64(stats.Entries))
+	m.Int(2, stats.Bytes)
+	m.Int(3, stats.MaxBytes)
+	m.Int(4, stats.Hits)
+	m.Int(5, stats.Misses)
+	m.Double(6, stats.HitRatio)
+	m.Int(7, stats.Evictions)
+	m.Int(8, int64(stats.MemoryEntries))
+	m.Int(9, stats.MemoryBytes)
+	m.Int(10, int64(stats.Tombstones))
+	m.Int(11, int64(stats.Suspect))
+	m.Int(12, int64(h.negative.Len()))
+	m.String(13, h.instance.Name)
+	m.String(14, h.instance.Zone)
+	m.Int(15, stats.StartedAt.Unix())
+	return m.Bytes(), nil
+}
+
+// grpcPurge 按头像哈希或缓存键清除条目，与POST /admin/purge一样转发给PURGE_PEERS
+func (h *Handler) grpcPurge(ctx context.Context, req []byte) ([]byte, error) {
+	var hash, key string
+	err := rpc.Decode(req, func(f rpc.Field) error {
+		switch f.Num {
+		case 1:
+			hash = normalizeHash(f.String())
+		case 2:
+			key = f.String()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, rpc.Errorf(rpc.InvalidArgument, "%v", err)
+	}
+
+	var m rpc.Message
+	query := url.Values{}
+	switch {
+	case hash != "" && key != "":
+		return nil, rpc.Errorf(rpc.InvalidArgument, "set either hash or key, not both")
+	case hash != "":
+		purged, negativePurged := h.purgeHash(hash)
+		m.Int(1, int64(purged))
+		m.Int(2, int64(negativePurged))
+		query.Set("hash", hash)
+	case key != "":
+		m.Int(1, int64(h.purgeKey(key)))
+		query.Set("key", key)
+	default:
+		return nil, rpc.Errorf(rpc.InvalidArgument, "missing hash or key")
+	}
+
+	if forwarded := h.forwardPurge(query.Encode()); forwarded != nil {
+		m.Strings(3, forwarded)
+	}
+	return m.Bytes(), nil
+}
+
+// grpcWarm 将头像放入预取队列，与POST /prefetch相同
+func (h *Handler) grpcWarm(ctx context.Context, req []byte) ([]byte, error) {
+	var hashes []string
+	params := make(map[string]string)
+	err := rpc.Decode(req, func(f rpc.Field) error {
+		switch f.Num {
+		case 1:
+			hashes = append(hashes, f.String())
+		case 2:
+			k, v, err := rpc.DecodeMapEntry(f.Bytes())
+			if err != nil {
+				return err
+			}
+			params[k] = v
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, rpc.Errorf(rpc.InvalidArgument, "%v", err)
+	}
+	if len(hashes) > maxPrefetchHashes {
+		return nil, rpc.Errorf(rpc.InvalidArgument, "at most %d hashes per call", maxPrefetchHashes)
+	}
+
+	queued, dropped, invalid := h.enqueuePrefetch(hashes, params)
+	var m rpc.Message
+	m.Int(1, int64(queued))
+	m.Int(2, int64(dropped))
+	m.Int(3, int64(invalid))
+	return m.Bytes(), nil
+}
+
+// grpcInspect 返回单个缓存键的条目，或头像哈希的所有缓存变体，不影响LRU顺序和命中次数
+func (h *Handler) grpcInspect(ctx context.Context, req []byte) ([]byte, error) {
+	var key, hash string
+	err := rpc.Decode(req, func(f rpc.Field) error {
+		switch f.Num {
+		case 1:
+			key = f.String()
+		case 2:
+			hash = normalizeHash(f.String())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, rpc.Errorf(rpc.InvalidArgument, "%v", err)
+	}
+
+	var keys []string
+	switch {
+	case key != "" && hash != "":
+		return nil, rpc.Errorf(rpc.InvalidArgument, "set either key or hash, not both")
+	case key != "":
+		keys = []string{key}
+	case hash != "":
+		for _, v := range h.cacheVariants(hash) {
+			keys = append(keys, v.Key)
+		}
+	default:
+		return nil, rpc.Errorf(rpc.InvalidArgument, "missing key or hash")
+	}
+
+	var m rpc.Message
+	for _, k := range keys {
+		entry, valid := h.cache.Peek(k)
+		if entry == nil {
+			continue
+		}
+		m.Message(1, encodeEntry(k, entry.Metadata, valid))
+	}
+	if key != "" && len(m.Bytes()) == 0 {
+		return nil, rpc.Errorf(rpc.NotFound, "cache entry not found")
+	}
+	return m.Bytes(), nil
+}
+
+// encodeEntry 编码一个缓存条目为Entry消息
+func encodeEntry(key string, metadata cache.Metadata, valid bool) *rpc.Message {
+	var e rpc.Message
+	e.String(1, key)
+	e.String(2, metadata.Path)
+	e.Map(3, metadata.Params)
+	e.Int(4, int64(metadata.StatusCode))
+	e.Int(5, metadata.Size)
+	e.Int(6, metadata.CreatedAt.Unix())
+	e.Bool(7, valid)
+	e.String(8, metadata.SourceKey)
+	e.String(9, metadata.Upstream)
+	e.Int(10, metadata.Hits)
+	e.Map(11, metadata.Headers)
+	e.Int(12, int64(metadata.RevalidationFailures))
+	e.Bool(13, metadata.Suspect)
+	return &e
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"time"
+)
+
+// Version 为构建版本，可在构建时以-ldflags "-X gravatar-proxy/internal/proxy.Version=v1.2.3"设置
+// 未设置时使用go build记录的模块版本或VCS修订
+var Version string
+
+// healthDiagnostics 是/healthz?verbose=1返回的诊断信息，供监控只抓取一个JSON文档
+type healthDiagnostics struct {
+	Version             string     `json:"version"`
+	GoVersion           string     `json:"go_version"`
+	StartedAt           time.Time  `json:"started_at"`
+	UptimeSeconds       int64      `json:"uptime_seconds"`
+	CacheEntries        int        `json:"cache_entries"`
+	CacheBytes          int64      `json:"cache_bytes"`
+	CacheMaxBytes       int64      `json:"cache_max_bytes"`
+	LastUpstreamSuccess *time.Time `json:"last_upstream_success,omitempty"`
+}
+
+// wantsDiagnostics 判断健康检查是否应附带诊断信息：需要verbose参数，且调用方位于受信任网络或携带管理接口的凭据
+// 不满足条件时忽略verbose参数，健康检查本身不受影响
+func (h *Handler) wantsDiagnostics(r *http.Request) bool {
+	if verbose, _ := strconv.ParseBool(r.URL.Query().Get("verbose")); !verbose {
+		return false
+	}
+	if h.isTrusted(r) {
+		return true
+	}
+	return h.adminAuthorized(r)
+}
+
+func (h *Handler) diagnostics() *healthDiagnostics {
+	stats := h.cache.Stats()
+	d := &healthDiagnostics{
+		Version:       BuildVersion(),
+		StartedAt:     h.startedAt,
+		UptimeSeconds: int64(time.Since(h.startedAt).Seconds()),
+		CacheEntries:  stats.Entries,
+		CacheBytes:    stats.Bytes,
+		CacheMaxBytes: stats.MaxBytes,
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		d.GoVersion = info.GoVersion
+	}
+	if last := h.lastUpstreamSuccess.Load(); last != 0 {
+		t := time.Unix(0, last)
+		d.LastUpstreamSuccess = &t
+	}
+	return d
+}
+
+// BuildVersion 返回Version，未设置时回退到构建信息中的模块版本或VCS修订
+func BuildVersion() string {
+	if Version != "" {
+		return Version
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if v := info.Main.Version; v != "" && v != "(devel)" {
+		return v
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			return setting.Value
+		}
+	}
+	return "devel"
+}
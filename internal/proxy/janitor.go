@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"context"
+	"time"
+
+	"gravatar-proxy/internal/cache"
+	"gravatar-proxy/internal/log"
+)
+
+// StartCacheJanitor 每隔janitorInterval删除过期超过expiryGrace的缓存条目，直到ctx结束
+// 否则过期条目要等LRU淘汰才释放磁盘空间，缓存未写满时会一直占用
+func (h *Handler) StartCacheJanitor(ctx context.Context) {
+	if h.janitorInterval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(h.janitorInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				h.deleteExpired(time.Now())
+			}
+		}
+	}()
+}
+
+// deleteExpired 删除一轮过期条目，更新指标并记录释放的空间
+func (h *Handler) deleteExpired(now time.Time) cache.ExpireStats {
+	stats := h.cache.DeleteExpired(now, h.expiryGrace)
+	cacheExpiredDeletedEntries.Add(float64(stats.Entries))
+	cacheExpiredDeletedBytes.Add(float64(stats.Bytes))
+
+	args := []any{"entries", stats.Entries, "bytes", stats.Bytes, "duration_ms", time.Since(now).Milliseconds()}
+	if stats.Entries > 0 {
+		log.Info("deleted expired cache entries", args...)
+	} else {
+		log.Debug("no expired cache entries to delete", args...)
+	}
+	return stats
+}
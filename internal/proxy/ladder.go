@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gravatar-proxy/internal/assets"
+	"gravatar-proxy/internal/cache"
+	"gravatar-proxy/internal/log"
+)
+
+// 主上游失败后可依次尝试的降级手段，全部失败时返回502
+const (
+	// ladderStale 返回已过期的缓存条目（不限于stale-while-revalidate窗口）
+	ladderStale = "stale"
+	// ladderSecondary 依次请求UPSTREAM_BASE中的其余上游
+	ladderSecondary = "secondary"
+	// ladderLocal 请求本地风格默认头像时本地生成，不写入缓存
+	ladderLocal = "local"
+	// ladderPlaceholder 返回内置的占位头像
+	ladderPlaceholder = "placeholder"
+	// ladderBadGateway 显式写在末尾的终止步骤
+	ladderBadGateway = "502"
+)
+
+const placeholderAsset = "mp.png"
+
+// parseLadder 校验降级步骤，502只能出现在末尾
+func parseLadder(steps []string) ([]string, error) {
+	seen := make(map[string]bool, len(steps))
+	ladder := make([]string, 0, len(steps))
+	for i, step := range steps {
+		switch step {
+		case ladderStale, ladderSecondary, ladderLocal, ladderPlaceholder:
+		case ladderBadGateway:
+			if i != len(steps)-1 {
+				return nil, fmt.Errorf("fallback ladder step %q must be last", step)
+			}
+			continue
+		default:
+			return nil, fmt.Errorf("unknown fallback ladder step %q", step)
+		}
+		if seen[step] {
+			return nil, fmt.Errorf("duplicate fallback ladder step %q", step)
+		}
+		seen[step] = true
+		ladder = append(ladder, step)
+	}
+	return ladder, nil
+}
+
+func (h *Handler) ladderHas(step string) bool {
+	for _, s := range h.ladder {
+		if s == step {
+			return true
+		}
+	}
+	return false
+}
+
+// upstreamChain 返回后台任务使用的上游列表；未启用secondary时只使用主上游
+func (h *Handler) upstreamChain() []string {
+	upstreams := h.current().upstreams
+	if h.ladderHas(ladderSecondary) {
+		return upstreams
+	}
+	return upstreams[:1]
+}
+
+// degrade 在主上游失败（网络错误或5xx）后按FALLBACK_LADDER依次尝试降级
+// 已写出响应时served为true；secondary成功时返回其响应交给调用方按正常流程处理
+// 全部失败时，若有上游5xx响应则原样交给调用方，否则返回502
+func (h *Handler) degrade(ctx context.Context, w http.ResponseWriter, s *settings, cacheKey, hash string, queryParams map[string]string, entry *cache.CacheEntry, region string, failed *http.Response, err error, requestID string) (*http.Response, string, int, bool) {
+	if err != nil {
+		log.Error("primary upstream failed", "error", err, "error_class", errorClass(err), "upstream", errorUpstream(err), "request_id", requestID)
+	} else {
+		log.Warn("primary upstream returned server error", "status", failed.StatusCode, "error_class", errorClassStatus5xx, "request_id", requestID)
+	}
+	upstreams := s.upstreams
+	failedUpstream := upstreams[0]
+
+	for _, step := range h.ladder {
+		switch step {
+		case ladderStale:
+			if entry == nil {
+				continue
+			}
+			discard(failed)
+			// 过期内容不应被下游缓存
+			if err := h.cache.WriteResponse(w, nil, cacheKey, 0); err != nil {
+				log.Warn("failed to write stale response", "error", err, "request_id", requestID)
+				continue
+			}
+			return h.degraded(ctx, step, entry.Metadata.StatusCode, requestID)
+
+		case ladderSecondary:
+			if len(upstreams) < 2 {
+				continue
+			}
+			start := time.Now()
+			resp, upstream, err := h.fetchUpstream(ctx, upstreams[1:], hash, queryParams, entry, region, requestID)
+			if err != nil {
+				log.Warn("secondary upstreams failed", "error", err, "error_class", errorClass(err), "upstream", errorUpstream(err), "request_id", requestID)
+				continue
+			}
+			if resp.StatusCode >= http.StatusInternalServerError {
+				discard(failed)
+				failed, failedUpstream = resp, upstream
+				continue
+			}
+			discard(failed)
+			degradedResponses.Inc(step)
+			debugFrom(ctx).setFallback(step)
+			debugFrom(ctx).setUpstream(upstream, time.Since(start))
+			return resp, upstream, 0, false
+
+		case ladderLocal:
+			style, ok := localStyle(queryParams)
+			if !ok {
+				continue
+			}
+			metadata, data, err := h.generateLocalDefault(hash, style, queryParams)
+			if err != nil {
+				log.Warn("failed to generate offline local default avatar", "error", err, "request_id", requestID)
+				continue
+			}
+			discard(failed)
+			// 离线生成的头像不缓存，避免遮盖真实头像
+			writeUncached(w, metadata.Headers, metadata.StatusCode, data)
+			return h.degraded(ctx, step, metadata.StatusCode, requestID)
+
+		case ladderPlaceholder:
+			data, contentType, ok := assets.Get(placeholderAsset)
+			if !ok {
+				continue
+			}
+			discard(failed)
+			writeUncached(w, map[string]string{
+				"Content-Type":   contentType,
+				"Content-Length": strconv.Itoa(len(data)),
+			}, http.StatusOK, data)
+			return h.degraded(ctx, step, http.StatusOK, requestID)
+		}
+	}
+
+	if failed != nil {
+		return failed, failedUpstream, 0, false
+	}
+	if errors.Is(err, errCircuitOpen) {
+		h.setRetryAfter(w, retryCircuitOpen)
+	} else {
+		h.setRetryAfter(w, retryUpstream)
+	}
+	http.Error(w, "Failed to fetch from upstream", http.StatusBadGateway)
+	return h.degraded(ctx, ladderBadGateway, http.StatusBadGateway, requestID)
+}
+
+func (h *Handler) degraded(ctx context.Context, step string, status int, requestID string) (*http.Response, string, int, bool) {
+	debugFrom(ctx).setFallback(step)
+	degradedResponses.Inc(step)
+	log.Info("served degraded response", "step", step, "status", status, "request_id", requestID)
+	return nil, "", status, true
+}
+
+func writeUncached(w http.ResponseWriter, headers map[string]string, status int, data []byte) {
+	for k, v := range headers {
+		w.Header().Set(k, v)
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// discard 丢弃不再使用的失败响应，使连接可以复用
+func discard(resp *http.Response) {
+	if resp == nil {
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+)
+
+// requestURILength 返回请求行中URL的长度；RequestURI为空（如直接构造的请求）时按解析后的URL计算
+func requestURILength(r *http.Request) int {
+	if r.RequestURI != "" {
+		return len(r.RequestURI)
+	}
+	return len(r.URL.RequestURI())
+}
+
+// checkRequestLimits 在生成缓存键和上游地址之前拒绝过长的URL（414）和带请求体的头像请求（413）
+// 拒绝时写出错误响应并返回状态码，通过时返回0
+func (h *Handler) checkRequestLimits(w http.ResponseWriter, r *http.Request, requestID string) int {
+	if requestURILength(r) > h.maxURLLength {
+		requestsRejected.Inc("url_too_long")
+		h.auditDenied(r, denyURLTooLong, http.StatusRequestURITooLong, requestID)
+		http.Error(w, "URI too long", http.StatusRequestURITooLong)
+		return http.StatusRequestURITooLong
+	}
+	// 头像接口不读取请求体，ContentLength为-1表示分块传输
+	if r.ContentLength != 0 {
+		requestsRejected.Inc("body_not_allowed")
+		h.auditDenied(r, denyBodyNotAllowed, http.StatusRequestEntityTooLarge, requestID)
+		http.Error(w, "Request body not allowed", http.StatusRequestEntityTooLarge)
+		return http.StatusRequestEntityTooLarge
+	}
+	return 0
+}
+
+// singletonHeaders 是访问控制所依据的请求头，重复出现时不同组件可能取到不同的值，一律拒绝
+var singletonHeaders = []string{"Authorization", apiKeyHeader, "Origin", "Referer", "Content-Type", "Content-Length", regionHeader, upstreamOverrideHeader}
+
+// maxSingletonHeaderBytes 为singletonHeaders中单个值的长度上限，足够容纳较大的JWT
+const maxSingletonHeaderBytes = 8 * 1024
+
+// HardenRequests 在路由之前拒绝可能用于请求走私或绕过访问控制的请求，挂在所有对外监听器上
+// 冲突的Content-Length（不同的值、列表、负数）和不支持的Transfer-Encoding已由标准库拒绝；
+// 同时带Transfer-Encoding和Content-Length时，标准库按Transfer-Encoding处理并删除Content-Length，这里已无法区分
+func (h *Handler) HardenRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reject := func(reason string, status int, message string) {
+			requestsRejected.Inc(reason)
+			h.auditDenied(r, reason, status, "")
+			if r.ProtoMajor == 1 {
+				w.Header().Set("Connection", "close")
+			}
+			http.Error(w, message, status)
+		}
+
+		if r.ProtoMajor == 1 && len(r.TransferEncoding) > 0 {
+			// 按RFC 9112，可能同时带了Content-Length的请求响应后必须关闭连接，
+			// 避免前置代理按Content-Length理解时，剩余的字节被当作下一个请求
+			w.Header().Set("Connection", "close")
+			if r.Method == http.MethodGet || r.Method == http.MethodHead {
+				reject(denyTransferEncoding, http.StatusBadRequest, "Transfer-Encoding not allowed")
+				return
+			}
+		}
+		for _, name := range singletonHeaders {
+			values := r.Header.Values(name)
+			if len(values) > 1 {
+				reject(denyDuplicateHeader, http.StatusBadRequest, "Duplicate "+name+" header")
+				return
+			}
+			if len(values) == 1 && len(values[0]) > maxSingletonHeaderBytes {
+				reject(denyHeaderTooLarge, http.StatusRequestHeaderFieldsTooLarge, name+" header too large")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isBodyTooLarge 判断读取请求体的错误是否由http.MaxBytesReader超限引起
+func isBodyTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gravatar-proxy/internal/avatargen"
+	"gravatar-proxy/internal/cache"
+	"gravatar-proxy/internal/config"
+	"gravatar-proxy/internal/log"
+)
+
+const (
+	localDefaultPrefix = "local:"
+
+	// localUpstream 标记由本地生成而非上游提供的缓存条目
+	localUpstream = "local"
+)
+
+// localStyle 解析 d=local:<style> 参数，返回本地生成风格名
+func localStyle(queryParams map[string]string) (string, bool) {
+	d := queryParams["d"]
+	if !strings.HasPrefix(d, localDefaultPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(d, localDefaultPrefix), true
+}
+
+// applyLocalDefaults 将需要本地渲染的默认头像改写为 d=local:<style>
+// 启用LOCAL_IDENTICON时 d=identicon 在本地渲染
+// d=initials 始终在本地渲染，name参数提供缩写来源
+func (h *Handler) applyLocalDefaults(queryParams map[string]string) {
+	if !h.features.enabled(config.FeatureLocalDefaults) {
+		return
+	}
+	switch queryParams["d"] {
+	case "identicon":
+		if h.localIdenticon {
+			queryParams["d"] = localDefaultPrefix + "identicon"
+		}
+	case "initials":
+		queryParams["d"] = localDefaultPrefix + "initials"
+	}
+
+	// 相同缩写共用一个缓存条目，规范化为以空格分隔的首字母（如 "J D"）
+	if queryParams["d"] == localDefaultPrefix+"initials" && queryParams["name"] != "" {
+		queryParams["name"] = strings.Join(strings.Split(avatargen.Initials(queryParams["name"]), ""), " ")
+	}
+}
+
+// avatarSize 解析s参数，缺省或非法时使用默认尺寸
+func avatarSize(queryParams map[string]string) int {
+	size, err := strconv.Atoi(queryParams["s"])
+	if err != nil {
+		return avatargen.DefaultSize
+	}
+	return avatargen.ClampSize(size)
+}
+
+// renderLocalDefault 本地渲染默认头像并写入缓存
+func (h *Handler) renderLocalDefault(cacheKey, hash, style string, queryParams map[string]string, requestID string) (cache.Metadata, []byte, error) {
+	metadata, data, err := h.generateLocalDefault(hash, style, queryParams)
+	if err != nil {
+		return cache.Metadata{}, nil, err
+	}
+
+	if err := h.cache.Set(cacheKey, data, metadata); err != nil {
+		log.Warn("failed to cache generated avatar", "error", err, "request_id", requestID)
+	}
+	log.Info("generated local default avatar", "request_id", requestID, "key", cacheKey, "style", style)
+	return metadata, data, nil
+}
+
+// generateLocalDefault 本地渲染默认头像，不写入缓存
+func (h *Handler) generateLocalDefault(hash, style string, queryParams map[string]string) (cache.Metadata, []byte, error) {
+	data, err := avatargen.Generate(style, hash, avatarSize(queryParams), avatargen.Options{
+		Text:    queryParams["name"],
+		Palette: h.palette,
+	})
+	if err != nil {
+		return cache.Metadata{}, nil, err
+	}
+
+	metadata := cache.Metadata{
+		CreatedAt:      time.Now(),
+		LastAccessedAt: time.Now(),
+		Headers: map[string]string{
+			"Content-Type":   "image/png",
+			"Content-Length": strconv.Itoa(len(data)),
+		},
+		StatusCode: http.StatusOK,
+		Upstream:   localUpstream,
+		Hash:       hash,
+		Path:       "/avatar/" + hash,
+		Params:     queryParams,
+	}
+	return metadata, data, nil
+}
+
+// handleUpstreamBody 处理上游完整响应：请求了本地默认头像且上游404时本地渲染，否则按原样缓存
+func (h *Handler) handleUpstreamBody(cacheKey, hash, upstream string, queryParams map[string]string, resp *http.Response, data []byte, requestID string) (cache.Metadata, []byte, error) {
+	if style, ok := localStyle(queryParams); ok && resp.StatusCode == http.StatusNotFound {
+		return h.renderLocalDefault(cacheKey, hash, style, queryParams, requestID)
+	}
+	return h.storeUpstreamResponse(cacheKey, hash, upstream, queryParams, resp, data, requestID), data, nil
+}
+
+// writeResponse 写出新获取或新生成的响应
+func (h *Handler) writeResponse(w http.ResponseWriter, s *settings, metadata cache.Metadata, data []byte) {
+	// 缓存写入时才算出内容ETag，调用方手中的元数据可能还没有
+	if metadata.ETag == "" && metadata.StatusCode == http.StatusOK {
+		metadata.ETag = cache.ContentETag(data)
+	}
+	h.writeHeader(w, s, metadata)
+	w.Write(data)
+}
+
+// writeHeader 按元数据写出响应头和状态码；ETag只发送按内容生成的值，不转发因上游而异的上游ETag
+// 流式返回时内容ETag要到读完响应体才知道，这次响应不带ETag
+func (h *Handler) writeHeader(w http.ResponseWriter, s *settings, metadata cache.Metadata) {
+	for k, v := range metadata.Headers {
+		if k != "ETag" {
+			w.Header().Set(k, v)
+		}
+	}
+	if metadata.ETag != "" {
+		w.Header().Set("ETag", metadata.ETag)
+	}
+	h.varyOnEncoding(w, metadata.Headers["Content-Type"])
+	ttlSeconds := int(s.ttl.Seconds())
+	if h.negative.Enabled() && cache.IsNegativeStatus(metadata.StatusCode) {
+		ttlSeconds = int(h.negativeTTL.Seconds())
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", ttlSeconds))
+	if isRetryableStatus(metadata.StatusCode) {
+		h.setRetryAfter(w, retryUpstream)
+	}
+	w.WriteHeader(metadata.StatusCode)
+}
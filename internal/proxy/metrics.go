@@ -0,0 +1,131 @@
+package proxy
+
+import "gravatar-proxy/internal/metrics"
+
+var (
+	upstreamDuration = metrics.NewHistogram("upstream_request_duration_seconds",
+		"Latency of upstream avatar requests.", metrics.DefaultBuckets, "upstream")
+	upstreamResponses = metrics.NewCounter("upstream_responses_total",
+		"Upstream responses by upstream and status code.", "upstream", "status")
+
+	upstreamErrors = metrics.NewCounter("upstream_errors_total",
+		"Upstream failures by upstream and class (dns, connect_timeout, connect_refused, tls, timeout, header_too_large, status_4xx, status_5xx, body_read, body_too_large, bandwidth_cap, circuit_open, content_type, other).", "upstream", "class")
+
+	upstreamRetriesTotal = metrics.NewCounter("upstream_retries_total",
+		"Retries of upstream requests after a transient failure, by upstream and reason (connection_reset, timeout, header_timeout, status_502, status_503).", "upstream", "reason")
+	upstreamRetryBudgetExhausted = metrics.NewCounter("upstream_retry_budget_exhausted_total",
+		"Retries skipped because the shared UPSTREAM_RETRY_BUDGET was used up, by upstream.", "upstream")
+
+	upstreamCircuitState = metrics.NewGauge("upstream_circuit_state",
+		"Circuit breaker state per upstream (0 closed, 1 open, 2 half_open).", "upstream")
+	upstreamCircuitTransitions = metrics.NewCounter("upstream_circuit_transitions_total",
+		"Circuit breaker state changes per upstream, by the state entered (open, half_open, closed).", "upstream", "state")
+
+	upstreamPinMismatches = metrics.NewCounter("upstream_pin_mismatches_total",
+		"Upstream TLS handshakes rejected because no certificate matched UPSTREAM_PIN_SHA256.")
+
+	upstreamDNSLookups = metrics.NewCounter("upstream_dns_lookups_total",
+		"Upstream host name lookups by the configured resolver, by result (static, hit, miss, error).", "result")
+
+	upstreamConnections = metrics.NewCounter("upstream_connections_acquired_total",
+		"Connections acquired for upstream requests, by whether an idle keep-alive connection was reused or a new one dialed.", "result")
+
+	degradedResponses = metrics.NewCounter("degraded_responses_total",
+		"Responses served by a fallback ladder step after the primary upstream failed (stale, secondary, local, placeholder, 502).", "step")
+
+	shardRequests = metrics.NewCounter("shard_requests_total",
+		"Avatar requests by sharding decision (local, forwarded, fallback, received, untrusted).", "result")
+	peersHealthy = metrics.NewGauge("peers_healthy",
+		"Cluster instances, including this one, currently in the sharding ring.")
+	peerDiscoveryErrors = metrics.NewCounter("peer_discovery_errors_total",
+		"Failed DNS SRV lookups for peer discovery.")
+
+	originalFetches = metrics.NewCounter("resize_original_fetches_total",
+		"Original avatar fetches for local resizing, by whether this request fetched it or reused a concurrent fetch (fetched, shared).", "result")
+
+	rateLimitRequests = metrics.NewCounter("rate_limit_requests_total",
+		"Avatar requests checked by the per-client rate limiter, by result (allowed, limited).", "result")
+	rateLimitClients = metrics.NewGauge("rate_limit_clients",
+		"Client IPs currently tracked by the rate limiter.")
+
+	configReloads = metrics.NewCounter("config_reloads_total",
+		"Configuration reloads applied without a restart.")
+	queryParamsDropped = metrics.NewCounter("query_params_dropped_total",
+		"Query parameters stripped from avatar requests because they are not in AVATAR_PARAMS or PASSTHROUGH_PARAMS.")
+	featureEnabled = metrics.NewGauge("feature_enabled",
+		"Whether a runtime feature flag is on (1) or off (0).", "feature")
+
+	cacheReportEntries = metrics.NewGauge("cache_report_entries",
+		"Cache entries by age bucket (le) in the last cache report.", "le")
+	cacheReportBytes = metrics.NewGauge("cache_report_bytes",
+		"Cache bytes by age bucket (le) in the last cache report.", "le")
+	cacheReportExpiredBytes = metrics.NewGauge("cache_report_expired_bytes",
+		"Bytes held by entries past CACHE_TTL in the last cache report.")
+	cacheEvictionHorizon = metrics.NewGauge("cache_eviction_horizon_seconds",
+		"Projected time an unread entry survives LRU eviction at the current write rate, from the last cache report.")
+
+	cacheExpiredDeletedEntries = metrics.NewCounter("cache_expired_deleted_entries_total",
+		"Cache entries deleted by the expiry janitor after CACHE_TTL plus CACHE_EXPIRY_GRACE.")
+	cacheExpiredDeletedBytes = metrics.NewCounter("cache_expired_deleted_bytes_total",
+		"Bytes of cache entries deleted by the expiry janitor.")
+	cacheBackgroundEvictions = metrics.NewCounter("cache_background_evictions_total",
+		"Cache entries evicted in the background because the cache exceeded MAX_CACHE_BYTES, e.g. after the limit was lowered.")
+	cacheOverLimitBytes = metrics.NewGauge("cache_over_limit_bytes",
+		"Bytes by which the cache exceeds MAX_CACHE_BYTES and still has to be evicted in the background.")
+
+	upstreamDownloadBytes = metrics.NewCounter("upstream_download_bytes_total",
+		"Response body bytes downloaded from upstreams, including redirect targets, shadow and readiness requests.")
+	upstreamBandwidthMonthBytes = metrics.NewGauge("upstream_bandwidth_month_bytes",
+		"Upstream response body bytes downloaded in the current calendar month (UTC), counted against UPSTREAM_MONTHLY_CAP_BYTES.")
+	cacheBytesSaved = metrics.NewCounter("cache_bytes_saved_total",
+		"Response body bytes served from the cache that would otherwise have been downloaded from upstream.")
+
+	followerSyncEntries = metrics.NewCounter("follower_sync_entries_total",
+		"Entries processed while syncing from FOLLOW_PRIMARY by result (fetched, refreshed, skipped, gone, failed).", "result")
+	followerLastSync = metrics.NewGauge("follower_last_sync_timestamp_seconds",
+		"Unix time of the last complete sync from FOLLOW_PRIMARY.")
+	requestsRejected = metrics.NewCounter("requests_rejected_total",
+		"Requests rejected before processing by reason (url_too_long, body_not_allowed, body_too_large, conflicting_param, transfer_encoding_not_allowed, duplicate_header, header_too_large).", "reason")
+
+	apiKeyRequests = metrics.NewCounter("api_key_requests_total",
+		"Avatar requests accepted by API key name.", "key")
+	apiKeyRejected = metrics.NewCounter("api_key_rejected_total",
+		"Avatar requests rejected for a missing or invalid API key.", "reason")
+	apiKeyTierRejected = metrics.NewCounter("api_key_tier_rejected_total",
+		"Requests rejected by an API key tier limit, by tier and reason (rate_limited, max_size, batch).", "tier", "reason")
+
+	upstreamVaryStripped = metrics.NewCounter("upstream_vary_stripped_total",
+		"Upstream responses whose Vary header was dropped, by upstream (redirect for followed redirect targets).", "upstream")
+
+	redirectTargets = metrics.NewCounter("redirect_targets_total",
+		"Followed upstream redirects by how the target was served (hit, revalidated, fetched, uncached).", "result")
+
+	prefetchRequests = metrics.NewCounter("prefetch_requests_total",
+		"Prefetch hints by outcome (queued, dropped, cached, in_flight, skipped, fetched, failed, invalid).", "result")
+	warmupEntries = metrics.NewCounter("warmup_entries_total",
+		"Cache warm-up seed entries: queued for prefetching, or invalid lines.", "result")
+
+	shadowDuration = metrics.NewHistogram("shadow_request_duration_seconds",
+		"Latency of mirrored requests to the shadow upstream.", metrics.DefaultBuckets)
+	shadowResults = metrics.NewCounter("shadow_requests_total",
+		"Mirrored requests by comparison result (match, status_mismatch, etag_mismatch, content_mismatch, error, dropped).", "result")
+
+	originDecisionsTotal = metrics.NewCounter("origin_decisions_total",
+		"Access control decisions under ALLOWED_ORIGINS by origin (the matched allowed entry, or the denied domain, capped at 100 before \"other\") and result (allowed, denied).", "origin", "result")
+	originDecisionLookups = metrics.NewCounter("origin_decision_cache_total",
+		"Origin and Referer lookups in the access control decision cache (hit, miss).", "result")
+
+	upstreamOverrideRequests = metrics.NewCounter("upstream_override_requests_total",
+		"Requests served from an UPSTREAM_OVERRIDES alternate upstream, by name and result (hit, fetched, error).", "name", "result")
+)
+
+func init() {
+	metrics.NewGaugeFunc("upstream_connections_active",
+		"Upstream connections currently carrying a request.", func() float64 {
+			return float64(activeConns.Load())
+		})
+	metrics.NewGaugeFunc("upstream_connections_idle",
+		"Upstream keep-alive connections currently idle in the pool.", func() float64 {
+			return float64(max(openConns.Load()-activeConns.Load(), 0))
+		})
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"strings"
+	"sync"
+)
+
+// maxOriginDecisions 为每代配置缓存的来源判断数上限；Origin和Referer由客户端任意填写，达到上限后清空重新累积
+const maxOriginDecisions = 10000
+
+// maxDeniedOriginLabels 为指标中单独列出的被拒绝来源数上限，之后的被拒绝来源计入"other"
+const maxDeniedOriginLabels = 100
+
+// originMatch 是一个Origin或Referer的判断结果；label用作指标的origin标签：
+// 允许时为匹配的ALLOWED_ORIGINS条目，拒绝时为请求中的域名
+type originMatch struct {
+	allowed bool
+	label   string
+}
+
+// originDecisions 缓存来源是否在ALLOWED_ORIGINS中，避免每个请求都解析URL
+// 属于settings，重新加载配置时随之整体替换，旧的判断不会沿用到新的允许列表
+type originDecisions struct {
+	allowed []string
+
+	mu      sync.RWMutex
+	entries map[string]originMatch
+	denied  map[string]struct{}
+}
+
+func newOriginDecisions(allowedOrigins []string) *originDecisions {
+	d := &originDecisions{
+		entries: make(map[string]originMatch),
+		denied:  make(map[string]struct{}),
+	}
+	for _, allowed := range allowedOrigins {
+		if allowed = strings.TrimSpace(strings.ToLower(allowed)); allowed != "" {
+			d.allowed = append(d.allowed, allowed)
+		}
+	}
+	return d
+}
+
+// origin 返回Origin请求头的判断结果
+func (d *originDecisions) origin(origin string) originMatch {
+	return d.lookup("o:"+origin, func() string { return normalizeOrigin(origin) })
+}
+
+// referer 返回Referer请求头的判断结果，只取决于其中的主机，因此按路径之前的部分缓存
+func (d *originDecisions) referer(referer string) originMatch {
+	return d.lookup("r:"+refererPrefix(referer), func() string { return extractDomainFromReferer(referer) })
+}
+
+func (d *originDecisions) lookup(key string, domain func() string) originMatch {
+	d.mu.RLock()
+	m, ok := d.entries[key]
+	d.mu.RUnlock()
+	if ok {
+		originDecisionLookups.Inc("hit")
+		return m
+	}
+	originDecisionLookups.Inc("miss")
+
+	host := domain()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	m = d.matchLocked(host)
+	if len(d.entries) >= maxOriginDecisions {
+		clear(d.entries)
+	}
+	d.entries[key] = m
+	return m
+}
+
+// matchLocked 支持精确匹配和子域名匹配（如允许example.com时，也允许sub.example.com）
+func (d *originDecisions) matchLocked(host string) originMatch {
+	if host == "" {
+		return originMatch{label: "invalid"}
+	}
+	for _, allowed := range d.allowed {
+		if host == allowed || strings.HasSuffix(host, "."+allowed) {
+			return originMatch{allowed: true, label: allowed}
+		}
+	}
+	if _, seen := d.denied[host]; !seen {
+		if len(d.denied) >= maxDeniedOriginLabels {
+			return originMatch{label: "other"}
+		}
+		d.denied[host] = struct{}{}
+	}
+	return originMatch{label: host}
+}
+
+// refererPrefix 返回Referer中路径之前的部分（scheme://host[:port]），不解析URL
+func refererPrefix(referer string) string {
+	_, rest, ok := strings.Cut(referer, "://")
+	if !ok {
+		return referer
+	}
+	if i := strings.IndexAny(rest, "/?#"); i >= 0 {
+		return referer[:len(referer)-len(rest)+i]
+	}
+	return referer
+}
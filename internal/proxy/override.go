@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"gravatar-proxy/internal/cache"
+	"gravatar-proxy/internal/log"
+)
+
+// upstreamOverrideHeader 允许带管理凭据的内部调用方为单个请求选用UPSTREAM_OVERRIDES中的备选上游，
+// 例如用生产流量工具测试镜像；响应头中回显实际使用的名称
+const upstreamOverrideHeader = "X-Upstream-Override"
+
+// overrideKey 返回经备选上游获取的条目的缓存键，路径带有上游名称，与正常流量的条目互不影响
+func (h *Handler) overrideKey(name, hash string, queryParams map[string]string) string {
+	return h.cache.GenerateKey("/override/"+name+"/avatar/"+hash, queryParams)
+}
+
+// serveOverride 处理带X-Upstream-Override的请求：只请求指定的备选上游，结果缓存在单独的键下
+// 不经过分片、负缓存、转码、压缩和降级阶梯；未带该请求头时返回false
+func (h *Handler) serveOverride(w http.ResponseWriter, r *http.Request, s *settings, hash string, queryParams map[string]string, requestID string) (int, bool) {
+	name := strings.ToLower(strings.TrimSpace(r.Header.Get(upstreamOverrideHeader)))
+	if name == "" {
+		return 0, false
+	}
+	if len(h.upstreamOverrides) == 0 || !h.adminAuthorized(r) {
+		h.auditDenied(r, denyOverrideDenied, http.StatusForbidden, requestID)
+		http.Error(w, "Upstream override not allowed", http.StatusForbidden)
+		return http.StatusForbidden, true
+	}
+	base, ok := h.upstreamOverrides[name]
+	if !ok {
+		http.Error(w, "Unknown upstream override", http.StatusBadRequest)
+		return http.StatusBadRequest, true
+	}
+
+	// 备选上游的内容不能被共享缓存当作正常响应保存
+	w = &privateWriter{ResponseWriter: w}
+	w.Header().Set(upstreamOverrideHeader, name)
+	key := h.overrideKey(name, hash, queryParams)
+	ttlSeconds := int(s.ttl.Seconds())
+
+	entry, valid := h.cache.Get(key)
+	if valid {
+		upstreamOverrideRequests.Inc(name, "hit")
+		if err := h.cache.WriteResponse(w, r, key, ttlSeconds); err != nil {
+			log.Error("failed to write cached response", "error", err, "request_id", requestID)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return http.StatusInternalServerError, true
+		}
+		return http.StatusOK, true
+	}
+
+	log.Info("fetching from upstream override", "request_id", requestID, "override", name, "upstream", base)
+	resp, _, err := h.fetchUpstream(r.Context(), []string{base}, hash, queryParams, entry, h.region, requestID)
+	if err != nil {
+		upstreamOverrideRequests.Inc(name, "error")
+		log.Warn("upstream override request failed", "error", err, "error_class", errorClass(err), "request_id", requestID, "override", name)
+		http.Error(w, "Bad gateway", http.StatusBadGateway)
+		return http.StatusBadGateway, true
+	}
+
+	if resp.StatusCode == http.StatusNotModified && entry != nil {
+		resp.Body.Close()
+		metadata := entry.Metadata
+		metadata.Revalidated(time.Now())
+		if err := h.cache.UpdateMetadata(key, metadata); err != nil {
+			log.Warn("failed to update metadata", "error", err, "request_id", requestID)
+		}
+		upstreamOverrideRequests.Inc(name, "hit")
+		if err := h.cache.WriteResponse(w, r, key, ttlSeconds); err != nil {
+			log.Error("failed to write cached response", "error", err, "request_id", requestID)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return http.StatusInternalServerError, true
+		}
+		return http.StatusOK, true
+	}
+
+	data, err := readUpstreamBody(resp, base)
+	if err != nil {
+		upstreamOverrideRequests.Inc(name, "error")
+		log.Warn("failed to read upstream override response", "error", err, "error_class", errorClass(err), "request_id", requestID, "override", name)
+		http.Error(w, "Bad gateway", http.StatusBadGateway)
+		return http.StatusBadGateway, true
+	}
+	upstreamOverrideRequests.Inc(name, "fetched")
+
+	metadata := cache.Metadata{
+		CreatedAt:      time.Now(),
+		LastAccessedAt: time.Now(),
+		Headers:        cache.ExtractHeaders(resp),
+		StatusCode:     resp.StatusCode,
+		Upstream:       base,
+		Hash:           hash,
+		Path:           "/avatar/" + hash,
+		Params:         queryParams,
+	}
+	if resp.StatusCode == http.StatusOK {
+		if err := h.cache.Set(key, data, metadata); err != nil && !errors.Is(err, cache.ErrPurged) {
+			log.Warn("failed to cache upstream override response", "error", err, "request_id", requestID)
+		}
+	}
+	h.writeResponse(w, s, metadata, data)
+	return resp.StatusCode, true
+}
+
+// privateWriter 在写出响应头时把Cache-Control改为private，其余照常转发
+type privateWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (p *privateWriter) WriteHeader(status int) {
+	if !p.wroteHeader {
+		p.wroteHeader = true
+		p.Header().Set("Cache-Control", "private, no-store")
+	}
+	p.ResponseWriter.WriteHeader(status)
+}
+
+func (p *privateWriter) Write(b []byte) (int, error) {
+	if !p.wroteHeader {
+		p.WriteHeader(http.StatusOK)
+	}
+	return p.ResponseWriter.Write(b)
+}
+
+// Unwrap 供http.ResponseController访问底层ResponseWriter
+func (p *privateWriter) Unwrap() http.ResponseWriter {
+	return p.ResponseWriter
+}
@@ -0,0 +1,383 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gravatar-proxy/internal/config"
+	"gravatar-proxy/internal/log"
+)
+
+const (
+	peerHealthTimeout            = 2 * time.Second
+	defaultPeerDiscoveryInterval = 30 * time.Second
+)
+
+// lookupSRV 解析SRV记录，测试中可替换
+var lookupSRV = func(ctx context.Context, name string) ([]*net.SRV, error) {
+	_, addrs, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+	return addrs, err
+}
+
+// lookupIP 解析节点的主机名，测试中可替换
+var lookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
+	return net.DefaultResolver.LookupIP(ctx, "ip", host)
+}
+
+// peerSet 维护集群中的其他节点：静态列表加上可选的DNS SRV发现，定期做健康检查
+// 只有健康的节点参与分片哈希环；本节点总是被视为健康
+type peerSet struct {
+	self     string
+	identity config.Identity
+	static   []string
+	srv      string
+	scheme   string
+	interval time.Duration
+	client   *http.Client
+
+	mu         sync.RWMutex
+	known      []string
+	healthy    map[string]bool
+	identities map[string]config.Identity
+	ring       *hashRing
+	// addrs 为已知节点解析出的IP，只信任来自这些地址的分片转发请求头
+	addrs map[string]bool
+}
+
+// peerStatus 是一个节点的发现和健康状态，用于管理接口
+type peerStatus struct {
+	URL      string `json:"url"`
+	Instance string `json:"instance,omitempty"`
+	Zone     string `json:"zone,omitempty"`
+	Healthy  bool   `json:"healthy"`
+	Self     bool   `json:"self,omitempty"`
+}
+
+// newPeerSet 校验节点配置；static和srv都为空时返回nil
+// 启动时静态节点先视为健康，第一次健康检查后再剔除不可达节点
+func newPeerSet(self string, identity config.Identity, static []string, srv, scheme string, interval time.Duration) (*peerSet, error) {
+	if len(static) == 0 && srv == "" {
+		return nil, nil
+	}
+	self = strings.TrimSuffix(self, "/")
+	if self == "" {
+		return nil, fmt.Errorf("SHARD_SELF is required for peer sharding")
+	}
+	if scheme == "" {
+		scheme = "http"
+	}
+	if interval == 0 {
+		interval = defaultPeerDiscoveryInterval
+	}
+	if scheme != "http" && scheme != "https" {
+		return nil, fmt.Errorf("invalid peer discovery scheme %q, expected http or https", scheme)
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("peer discovery interval must be positive")
+	}
+
+	p := &peerSet{
+		self:     self,
+		identity: identity,
+		srv:      srv,
+		scheme:   scheme,
+		interval: interval,
+		client:   &http.Client{Timeout: peerHealthTimeout},
+	}
+
+	found := false
+	for _, peer := range static {
+		peer = strings.TrimSuffix(peer, "/")
+		if !strings.HasPrefix(peer, "http://") && !strings.HasPrefix(peer, "https://") {
+			return nil, fmt.Errorf("invalid shard peer %q, expected an http(s) base URL", peer)
+		}
+		if peer == self {
+			found = true
+		}
+		p.static = append(p.static, peer)
+	}
+	// 使用SRV发现时本节点不一定出现在静态列表中
+	if !found && srv == "" {
+		return nil, fmt.Errorf("SHARD_SELF %q must be one of SHARD_PEERS", self)
+	}
+
+	known := p.static
+	if !found {
+		known = append([]string{self}, known...)
+	}
+	healthy := make(map[string]bool, len(known))
+	for _, peer := range known {
+		healthy[peer] = true
+	}
+	// 启动时只认IP字面量的节点地址，主机名在第一次刷新时解析
+	p.update(known, healthy, map[string]config.Identity{self: identity}, resolveAddrs(context.Background(), known, false))
+	return p, nil
+}
+
+// Run 按间隔重新发现节点并做健康检查，直到ctx结束
+func (p *peerSet) Run(ctx context.Context) {
+	p.refresh(ctx)
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.refresh(ctx)
+		}
+	}
+}
+
+func (p *peerSet) refresh(ctx context.Context) {
+	known := p.discover(ctx)
+
+	healthy := make(map[string]bool, len(known))
+	identities := make(map[string]config.Identity, len(known))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, peer := range known {
+		if peer == p.self {
+			continue
+		}
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			identity, ok := p.check(ctx, peer)
+			mu.Lock()
+			healthy[peer] = ok
+			if ok {
+				identities[peer] = identity
+			}
+			mu.Unlock()
+		}(peer)
+	}
+	wg.Wait()
+	// 本节点不做健康检查，等检查的goroutine都结束后再写入，避免与其并发写map
+	healthy[p.self] = true
+	identities[p.self] = p.identity
+
+	resolveCtx, cancel := context.WithTimeout(ctx, peerHealthTimeout)
+	defer cancel()
+	p.update(known, healthy, identities, resolveAddrs(resolveCtx, known, true))
+}
+
+// resolveAddrs 返回节点地址中主机的IP；lookup为false时只取IP字面量，解析失败的主机跳过
+func resolveAddrs(ctx context.Context, peers []string, lookup bool) map[string]bool {
+	addrs := make(map[string]bool, len(peers))
+	for _, peer := range peers {
+		u, err := url.Parse(peer)
+		if err != nil {
+			continue
+		}
+		host := u.Hostname()
+		if ip := net.ParseIP(host); ip != nil {
+			addrs[ip.String()] = true
+			continue
+		}
+		if !lookup {
+			continue
+		}
+		ips, err := lookupIP(ctx, host)
+		if err != nil {
+			log.Debug("failed to resolve peer address", "error", err, "peer", peer)
+			continue
+		}
+		for _, ip := range ips {
+			addrs[ip.String()] = true
+		}
+	}
+	return addrs
+}
+
+// discover 合并静态节点和SRV记录解析出的节点；SRV解析失败时沿用上次的结果
+func (p *peerSet) discover(ctx context.Context) []string {
+	seen := make(map[string]bool)
+	var known []string
+	add := func(peer string) {
+		if !seen[peer] {
+			seen[peer] = true
+			known = append(known, peer)
+		}
+	}
+	for _, peer := range p.static {
+		add(peer)
+	}
+
+	if p.srv != "" {
+		addrs, err := lookupSRV(ctx, p.srv)
+		if err != nil {
+			log.Warn("peer discovery failed, keeping known peers", "error", err, "srv", p.srv)
+			peerDiscoveryErrors.Inc()
+			for _, peer := range p.members() {
+				add(peer)
+			}
+		}
+		for _, addr := range addrs {
+			host := strings.TrimSuffix(addr.Target, ".")
+			add(p.scheme + "://" + net.JoinHostPort(host, strconv.Itoa(int(addr.Port))))
+		}
+		add(p.self)
+	}
+
+	sort.Strings(known)
+	return known
+}
+
+// check 请求节点的/healthz，2xx视为健康；响应中带有实例标识时一并返回
+func (p *peerSet) check(ctx context.Context, peer string) (config.Identity, bool) {
+	var identity config.Identity
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, peer+"/healthz", nil)
+	if err != nil {
+		return identity, false
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return identity, false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return identity, false
+	}
+	// 旧版本节点的响应没有实例标识，不影响健康判断
+	json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&identity)
+	return identity, true
+}
+
+func (p *peerSet) update(known []string, healthy map[string]bool, identities map[string]config.Identity, addrs map[string]bool) {
+	var nodes []string
+	for _, peer := range known {
+		if healthy[peer] {
+			nodes = append(nodes, peer)
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// 健康检查失败的节点保留上次得到的标识，便于在日志中辨认
+	for peer, identity := range p.identities {
+		if _, ok := identities[peer]; !ok {
+			identities[peer] = identity
+		}
+	}
+	for _, peer := range known {
+		if was, ok := p.healthy[peer]; ok && was != healthy[peer] {
+			identity := identities[peer]
+			if healthy[peer] {
+				log.Info("peer is healthy", "peer", peer, "peer_instance", identity.Name, "peer_zone", identity.Zone)
+			} else {
+				log.Warn("peer failed health check", "peer", peer, "peer_instance", identity.Name, "peer_zone", identity.Zone)
+			}
+		}
+	}
+	p.known = known
+	p.healthy = healthy
+	p.identities = identities
+	p.addrs = addrs
+	p.ring = newHashRing(nodes)
+	peersHealthy.Set(float64(len(nodes)))
+}
+
+// owner 返回负责该头像哈希的健康节点
+func (p *peerSet) owner(hash string) string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.ring.owner(hash)
+}
+
+// markDown 在转发失败时立即把节点移出哈希环，下一次健康检查通过后恢复
+func (p *peerSet) markDown(peer string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if peer == p.self || !p.healthy[peer] {
+		return
+	}
+	p.healthy[peer] = false
+	log.Warn("peer marked unhealthy", "peer", peer, "peer_instance", p.identities[peer].Name)
+
+	var nodes []string
+	for _, known := range p.known {
+		if p.healthy[known] {
+			nodes = append(nodes, known)
+		}
+	}
+	p.ring = newHashRing(nodes)
+	peersHealthy.Set(float64(len(nodes)))
+}
+
+// isPeer 判断请求的直连地址是否为某个已知节点
+func (p *peerSet) isPeer(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.addrs[ip.String()]
+}
+
+// members 返回除本节点外的所有已知节点，不论健康状态
+func (p *peerSet) members() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	peers := make([]string, 0, len(p.known))
+	for _, peer := range p.known {
+		if peer != p.self {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// instance 返回节点上次健康检查报告的实例名
+func (p *peerSet) instance(peer string) string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.identities[peer].Name
+}
+
+// status 返回所有已知节点（包括本节点）的标识和健康状态
+func (p *peerSet) status() []peerStatus {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	peers := make([]peerStatus, 0, len(p.known))
+	for _, peer := range p.known {
+		identity := p.identities[peer]
+		peers = append(peers, peerStatus{
+			URL:      peer,
+			Instance: identity.Name,
+			Zone:     identity.Zone,
+			Healthy:  p.healthy[peer],
+			Self:     peer == p.self,
+		})
+	}
+	return peers
+}
+
+// StartPeerDiscovery 启动节点发现和健康检查，未配置分片节点时不做任何事
+func (h *Handler) StartPeerDiscovery(ctx context.Context) {
+	if h.peers == nil {
+		return
+	}
+	go h.peers.Run(ctx)
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"gravatar-proxy/internal/log"
+)
+
+// errPinMismatch 表示上游证书链中没有与UPSTREAM_PIN_SHA256匹配的公钥
+var errPinMismatch = errors.New("tls: upstream certificate does not match any pinned public key")
+
+// spkiPin 返回证书公钥（SubjectPublicKeyInfo）SHA-256摘要的base64形式
+func spkiPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// verifyPins 返回在常规证书校验通过后检查公钥固定的回调
+// 已验证证书链中任意一张证书（叶子、中间或根证书）匹配即可，固定CA的公钥时续签叶子证书无需修改配置
+// exempt对握手的服务器名返回true时不检查，用于与HTTPS代理之间的握手
+func verifyPins(pins []string, exempt func(serverName string) bool) func(tls.ConnectionState) error {
+	pinned := make(map[string]bool, len(pins))
+	for _, pin := range pins {
+		pinned[pin] = true
+	}
+	return func(cs tls.ConnectionState) error {
+		if exempt != nil && exempt(cs.ServerName) {
+			return nil
+		}
+		for _, chain := range cs.VerifiedChains {
+			for _, cert := range chain {
+				if pinned[spkiPin(cert)] {
+					return nil
+				}
+			}
+		}
+
+		upstreamPinMismatches.Inc()
+		var leaf string
+		if len(cs.PeerCertificates) > 0 {
+			leaf = spkiPin(cs.PeerCertificates[0])
+		}
+		// 日志带上实际的公钥摘要，证书轮换后可据此核实并更新配置
+		log.Error("upstream certificate does not match any pinned public key", "server_name", cs.ServerName, "leaf_spki_sha256", leaf)
+		return errPinMismatch
+	}
+}
+
+// proxyHosts 记录上游客户端用过的HTTPS代理的主机名
+// Transport与HTTPS代理握手时同样使用TLSClientConfig，代理证书不是上游证书，不应按UPSTREAM_PIN_SHA256检查；
+// 经代理访问的上游在CONNECT隧道内另行握手，仍会检查
+type proxyHosts struct {
+	mu    sync.RWMutex
+	hosts map[string]bool
+}
+
+// track 包装Transport.Proxy，记录选出的HTTPS代理；按HTTPS_PROXY选择代理时也在这里记录
+func (p *proxyHosts) track(proxy func(*http.Request) (*url.URL, error)) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		proxyURL, err := proxy(req)
+		if err == nil && proxyURL != nil && proxyURL.Scheme == "https" {
+			p.mu.Lock()
+			if p.hosts == nil {
+				p.hosts = make(map[string]bool)
+			}
+			p.hosts[proxyURL.Hostname()] = true
+			p.mu.Unlock()
+		}
+		return proxyURL, err
+	}
+}
+
+func (p *proxyHosts) has(host string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.hosts[host]
+}
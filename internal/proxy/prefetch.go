@@ -0,0 +1,318 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"gravatar-proxy/internal/config"
+	"gravatar-proxy/internal/log"
+)
+
+const (
+	// prefetchQueueSize 预取队列长度，队列满时新的提示直接丢弃
+	prefetchQueueSize = 1024
+	// prefetchWorkers 预取并发数，保持较低以免挤占实时请求的上游连接
+	prefetchWorkers = 2
+	// maxPrefetchHashes 单次提示最多接受的头像数
+	maxPrefetchHashes = 100
+	maxPrefetchBody   = 64 * 1024
+	// batchPrefetchWorkers 管理接口批量预取的并发数，每个请求独立计算
+	batchPrefetchWorkers = 8
+)
+
+type prefetchJob struct {
+	hash   string
+	params map[string]string
+}
+
+// prefetchRequest 是POST /prefetch的请求体，params按/avatar/的查询参数应用于每个哈希
+type prefetchRequest struct {
+	Hashes []string          `json:"hashes"`
+	Params map[string]string `json:"params"`
+}
+
+// PrefetchHandler 返回预取提示接口，需携带API密钥或管理令牌
+// API_KEYS和ADMIN_TOKEN都未配置时返回nil，接口不应被挂载
+func (h *Handler) PrefetchHandler() http.Handler {
+	if len(h.apiKeys) == 0 && !h.adminEnabled() {
+		return nil
+	}
+	return http.HandlerFunc(h.prefetchHandler)
+}
+
+// prefetchAuthorized 接受X-API-Key中的有效密钥，或管理接口的凭据（ADMIN_TOKEN或管理JWT）
+// 返回使用的密钥，以管理令牌认证时为nil
+func (h *Handler) prefetchAuthorized(r *http.Request) (*apiKey, bool) {
+	if secret := r.Header.Get(apiKeyHeader); secret != "" {
+		if key := h.lookupAPIKey(secret); key != nil {
+			return key, true
+		}
+	}
+	return nil, h.adminEnabled() && h.adminAuthorized(r)
+}
+
+// prefetchHandler 接收即将被渲染的头像哈希（POST /prefetch），放入后台队列后立即返回202
+// 浏览器直接调用时按ALLOWED_ORIGINS处理预检和跨域响应头，不带Origin的服务端调用不受限制
+func (h *Handler) prefetchHandler(w http.ResponseWriter, r *http.Request) {
+	s := h.current()
+	if r.Method == http.MethodOptions {
+		h.servePreflight(w, r, s, prefetchCORS, "")
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST, OPTIONS")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Header.Get("Origin") != "" && !h.checkAccessControl(w, r, s, prefetchCORS) {
+		h.auditDenied(r, denyOriginDenied, http.StatusForbidden, "")
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if h.featureDisabled(w, config.FeatureBatch) {
+		return
+	}
+	key, ok := h.prefetchAuthorized(r)
+	if !ok {
+		h.auditDenied(r, denyUnauthorized, http.StatusUnauthorized, "")
+		w.Header().Set("WWW-Authenticate", `ApiKey realm="avatar"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !key.allowsBatch() {
+		apiKeyTierRejected.Inc(key.tierName(), "batch")
+		h.auditDenied(r, denyTierBatch, http.StatusForbidden, "")
+		http.Error(w, "Prefetch not allowed for this API key", http.StatusForbidden)
+		return
+	}
+
+	var body prefetchRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPrefetchBody)).Decode(&body); err != nil {
+		if isBodyTooLarge(err) {
+			requestsRejected.Inc("body_too_large")
+			h.auditDenied(r, denyBodyTooLarge, http.StatusRequestEntityTooLarge, "")
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if len(body.Hashes) > maxPrefetchHashes {
+		http.Error(w, "Too many hashes", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if key.exceedsMaxSize(body.Params) {
+		apiKeyTierRejected.Inc(key.tierName(), "max_size")
+		h.auditDenied(r, denyTierMaxSize, http.StatusForbidden, "")
+		http.Error(w, "Avatar size exceeds the API key's limit", http.StatusForbidden)
+		return
+	}
+
+	queued, dropped, invalid := h.enqueuePrefetch(body.Hashes, body.Params)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]int{
+		"queued":  queued,
+		"dropped": dropped,
+		"invalid": invalid,
+	})
+}
+
+// enqueuePrefetch 将头像哈希放入预取队列，队列已满的丢弃，返回入队、丢弃和无效的哈希数
+// rawParams按头像请求的查询参数处理
+func (h *Handler) enqueuePrefetch(hashes []string, rawParams map[string]string) (queued, dropped, invalid int) {
+	query := url.Values{}
+	for k, v := range rawParams {
+		query.Set(k, v)
+	}
+	params := h.requestParams(query)
+
+	for _, hash := range hashes {
+		hash = normalizeHash(hash)
+		if hash == "" {
+			invalid++
+			continue
+		}
+		select {
+		case h.prefetchQueue <- prefetchJob{hash: hash, params: params}:
+			queued++
+			prefetchRequests.Inc("queued")
+		default:
+			dropped++
+			prefetchRequests.Inc("dropped")
+		}
+	}
+	return queued, dropped, invalid
+}
+
+// StartPrefetch 启动预取工作协程，直到ctx结束
+func (h *Handler) StartPrefetch(ctx context.Context) {
+	for i := 0; i < prefetchWorkers; i++ {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case job := <-h.prefetchQueue:
+					h.prefetch(ctx, job)
+				}
+			}
+		}()
+	}
+}
+
+// batchPrefetchItem 是POST /admin/prefetch请求体数组中的一项，params按/avatar/的查询参数处理
+type batchPrefetchItem struct {
+	Hash   string            `json:"hash"`
+	Params map[string]string `json:"params"`
+}
+
+// batchPrefetchResult 是一项的结果，Result在prefetchResult之外还可能是invalid（哈希无效）
+type batchPrefetchResult struct {
+	Hash string `json:"hash"`
+	prefetchResult
+}
+
+// batchPrefetchHandler 同步载入一批头像并逐项返回结果（POST /admin/prefetch）
+// 与/prefetch的后台队列不同，请求在全部头像处理完后才返回，适合渲染页面前确保头像已缓存
+func (h *Handler) batchPrefetchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.featureDisabled(w, config.FeatureBatch) {
+		return
+	}
+
+	var items []batchPrefetchItem
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPrefetchBody)).Decode(&items); err != nil {
+		if isBodyTooLarge(err) {
+			requestsRejected.Inc("body_too_large")
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if len(items) > maxPrefetchHashes {
+		http.Error(w, "Too many hashes", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	results := make([]batchPrefetchResult, len(items))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for range min(batchPrefetchWorkers, len(items)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = h.batchPrefetch(r.Context(), items[i])
+			}
+		}()
+	}
+	for i := range items {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	counts := make(map[string]int)
+	for _, result := range results {
+		counts[result.Result]++
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"results": results,
+		"counts":  counts,
+	})
+}
+
+func (h *Handler) batchPrefetch(ctx context.Context, item batchPrefetchItem) batchPrefetchResult {
+	hash := normalizeHash(item.Hash)
+	if !isAvatarHash(hash) {
+		prefetchRequests.Inc("invalid")
+		return batchPrefetchResult{Hash: item.Hash, prefetchResult: prefetchResult{Result: "invalid"}}
+	}
+	query := url.Values{}
+	for k, v := range item.Params {
+		query.Set(k, v)
+	}
+	result := h.loadAvatar(ctx, prefetchJob{hash: hash, params: h.requestParams(query)})
+	prefetchRequests.Inc(result.Result)
+	return batchPrefetchResult{Hash: hash, prefetchResult: result}
+}
+
+// prefetch 处理预取队列中的一个头像，按结果计数
+func (h *Handler) prefetch(ctx context.Context, job prefetchJob) {
+	prefetchRequests.Inc(h.loadAvatar(ctx, job).Result)
+}
+
+// prefetchResult 是载入一个头像的结果：Result为cached、in_flight、skipped、fetched或failed
+type prefetchResult struct {
+	Key    string `json:"key,omitempty"`
+	Result string `json:"result"`
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// loadAvatar 将一个头像载入缓存：已缓存、由其他分片节点负责或本地生成的头像跳过
+// 与后台重新验证共用去重，同一个key同时只有一个任务
+func (h *Handler) loadAvatar(ctx context.Context, job prefetchJob) prefetchResult {
+	if h.peers != nil && h.peers.owner(job.hash) != h.peers.self {
+		return prefetchResult{Result: "skipped"}
+	}
+	if _, ok := localStyle(job.params); ok && job.params["f"] == "y" {
+		return prefetchResult{Result: "skipped"}
+	}
+
+	cacheKey := h.cache.GenerateKey("/avatar/"+job.hash, job.params)
+	if _, ok := h.negative.Get(cacheKey); ok {
+		return prefetchResult{Key: cacheKey, Result: "cached"}
+	}
+	entry, valid := h.cache.Peek(cacheKey)
+	if valid {
+		return prefetchResult{Key: cacheKey, Result: "cached"}
+	}
+
+	// 其他任务正在载入时还没有可用的缓存条目，不能报告为cached
+	if _, running := h.revalidating.LoadOrStore(cacheKey, struct{}{}); running {
+		return prefetchResult{Key: cacheKey, Result: "in_flight"}
+	}
+	defer h.revalidating.Delete(cacheKey)
+
+	requestID := generateRequestID()
+	if size, ok := h.resizeTarget(job.params); ok {
+		if status, served := h.serveResized(ctx, discardResponse{header: http.Header{}}, h.current(), cacheKey, job.hash, job.params, size, h.region, requestID); served {
+			log.Info("prefetched avatar", "request_id", requestID, "key", cacheKey)
+			return prefetchResult{Key: cacheKey, Result: "fetched", Status: status}
+		}
+	}
+
+	status, err := h.revalidate(ctx, cacheKey, job.hash, job.params, entry, requestID)
+	if err != nil || status >= http.StatusInternalServerError {
+		log.Warn("prefetch failed", "error", err, "status", status, "request_id", requestID, "key", cacheKey)
+		result := prefetchResult{Key: cacheKey, Result: "failed", Status: status}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		return result
+	}
+	log.Info("prefetched avatar", "request_id", requestID, "key", cacheKey, "status", status)
+	return prefetchResult{Key: cacheKey, Result: "fetched", Status: status}
+}
+
+// discardResponse 丢弃预取时生成的响应，只保留写入缓存的副作用
+type discardResponse struct {
+	header http.Header
+}
+
+func (d discardResponse) Header() http.Header         { return d.header }
+func (d discardResponse) Write(b []byte) (int, error) { return len(b), nil }
+func (d discardResponse) WriteHeader(int)             {}
@@ -1,179 +1,715 @@
 package proxy
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"gravatar-proxy/internal/avatargen"
 	"gravatar-proxy/internal/cache"
 	"gravatar-proxy/internal/config"
+	"gravatar-proxy/internal/imaging"
 	"gravatar-proxy/internal/log"
+	"gravatar-proxy/internal/oidc"
+	"gravatar-proxy/internal/tracing"
 )
 
 type Handler struct {
-	cache          *cache.Cache
-	upstreamBase   string
-	client         *http.Client
-	ttl            time.Duration
-	allowedOrigins []string
+	cache    *cache.Cache
+	client   *http.Client
+	settings atomic.Pointer[settings]
+
+	staleWhileRevalidate time.Duration
+	suspectAfter         int
+	revalidating         sync.Map
+
+	negative    *cache.NegativeCache
+	negativeTTL time.Duration
+
+	palette        *avatargen.Palette
+	localIdenticon bool
+
+	shadowUpstream string
+	shadowPercent  float64
+	shadowCompare  bool
+	shadowSlots    chan struct{}
+
+	localResize      bool
+	resizeSourceSize int
+	resizeFilter     imaging.Filter
+
+	region          string
+	trustedNetworks []*net.IPNet
+
+	// avatarParams 为AVATAR_PARAMS，参与缓存键并转发给上游的查询参数
+	avatarParams []string
+
+	transcodeFormats []string
+	transcoders      map[string]imaging.Encoder
+	passthrough      passthroughParams
+	// noTranscodeGain 记录转码或压缩后不比原样更小的变体键，避免每次请求重复尝试
+	noTranscodeGain *keySet
+
+	// compressEncodings 为可压缩响应可协商的Content-Encoding，compressedAssets缓存压缩后的内置资源
+	compressEncodings []string
+	compressedAssets  sync.Map
+
+	adminToken string
+	purgePeers []string
+	peerClient *http.Client
+
+	// followPrimary 非空时定期从该主节点同步缓存条目
+	followPrimary  string
+	followInterval time.Duration
+
+	// bandwidth 累计当月从上游下载的字节数，达到上限后上游客户端不再发出请求
+	bandwidth *bandwidthMeter
+
+	// breaker 在上游连续失败后暂停请求该上游，为nil时不启用
+	breaker *circuitBreaker
+
+	// reportInterval 为定期生成缓存审计报告的间隔，lastReport为最近一次的报告
+	reportInterval time.Duration
+	lastReport     atomic.Pointer[cache.Report]
+
+	// janitorInterval 为删除过期条目的间隔，expiryGrace为条目过期后保留的时间
+	janitorInterval time.Duration
+	expiryGrace     time.Duration
+
+	// evictionRate 为超出MAX_CACHE_BYTES时后台每秒淘汰的条目数，evicting表示正在进行一轮后台淘汰
+	evictionRate int
+	evicting     atomic.Bool
+
+	// adminJWT 非nil时管理接口也接受OIDC签发的JWT，adminRoles非空时adminRoleClaim中须有其中一个角色
+	adminJWT       *oidc.Verifier
+	adminRoleClaim string
+	adminRoles     []string
+
+	// adminBasicUser非空时管理接口接受HTTP基本认证；adminClientCerts为true时接受验证通过的客户端证书
+	adminBasicUser     string
+	adminBasicPassword string
+	adminClientCerts   bool
+
+	instance config.Identity
+	peers    *peerSet
+
+	originals flightGroup
+
+	trustedProxies []*net.IPNet
+	maxURLLength   int
+
+	// requestIDHeader 为携带请求ID的请求头，requestIDTrust决定何时沿用入站的值
+	requestIDHeader string
+	requestIDTrust  string
+
+	apiKeys []*apiKey
+
+	prefetchQueue chan prefetchJob
+
+	// features 为运行时可开关的功能，见config.Features
+	features featureFlags
+
+	// warmupSeed 为WARMUP_SEED（文件路径或URL），warmupRequests为管理接口触发的预热
+	warmupSeed     string
+	warmupRequests chan warmupRequest
+	warmupRunning  atomic.Bool
+
+	followRedirects bool
+	upstreamAccept  string
+
+	// contentCheck 为确认上游成功响应是图片的方式，见config.ContentCheckHeader等
+	contentCheck string
+
+	// maxUpstreamBytes 为上游响应体的大小上限，0表示不限制
+	maxUpstreamBytes int64
+	// upstreamRetries和upstreamRetryBackoff 控制上游瞬时失败的重试，retryBudget限制所有请求的重试总量
+	upstreamRetries      int
+	upstreamRetryBackoff time.Duration
+	retryBudget          *retryBudget
+	retryHeaderTimeouts  bool
+
+	// upstreamOverrides 为按名称配置的备选上游，见upstreamOverrideHeader
+	upstreamOverrides map[string]string
+
+	ladder     []string
+	retryAfter map[string]time.Duration
+
+	readyCheckUpstream bool
+	readyInterval      time.Duration
+	ready              readiness
+
+	// startedAt 和lastUpstreamSuccess（上次上游返回非5xx响应的UnixNano）用于健康检查的诊断信息
+	startedAt           time.Time
+	lastUpstreamSuccess atomic.Int64
+
+	// bytesSaved 为启动以来由缓存返回、无需从上游下载的响应体字节数
+	bytesSaved atomic.Int64
 }
 
 func NewHandler(cfg *config.Config, c *cache.Cache) (*Handler, error) {
-	return &Handler{
-		cache:          c,
-		upstreamBase:   cfg.UpstreamBase,
-		ttl:            cfg.CacheTTL,
-		allowedOrigins: cfg.AllowedOrigins,
-		client: &http.Client{
-			Timeout: 30 * time.Second,
-		},
-	}, nil
+	palette, err := avatargen.ParsePalette(cfg.Avatars.Palette, cfg.Avatars.Background, cfg.Avatars.Foreground)
+	if err != nil {
+		return nil, err
+	}
+
+	resizeFilter, err := imaging.ParseFilter(cfg.ResizeFilter)
+	if err != nil {
+		return nil, err
+	}
+
+	trustedNetworks, err := parseNetworks(cfg.TrustedNetworks)
+	if err != nil {
+		return nil, err
+	}
+
+	transcodeFormats, transcoders, err := parseTranscodeFormats(cfg.TranscodeFormats, cfg.AVIFEncoder)
+	if err != nil {
+		return nil, err
+	}
+	compressEncodings, err := parseCompressEncodings(cfg.CompressEncodings)
+	if err != nil {
+		return nil, err
+	}
+
+	ladderSteps := cfg.FallbackLadder
+	if ladderSteps == nil {
+		ladderSteps = strings.Split(config.DefaultFallbackLadder, ",")
+	}
+	ladder, err := parseLadder(ladderSteps)
+	if err != nil {
+		return nil, err
+	}
+
+	trustedProxies, err := parseNetworks(cfg.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	apiKeys, err := parseAPIKeys(cfg.APIKeys, cfg.APIKeyTiers)
+	if err != nil {
+		return nil, err
+	}
+
+	retryAfter, err := parseRetryAfter(cfg.RetryAfter)
+	if err != nil {
+		return nil, err
+	}
+
+	peers, err := newPeerSet(cfg.ShardSelf, cfg.Instance, cfg.ShardPeers, cfg.PeerDiscoverySRV, cfg.PeerDiscoveryScheme, cfg.PeerDiscoveryInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	upstreamAccept := cfg.UpstreamAccept
+	if upstreamAccept == "" {
+		upstreamAccept = config.DefaultUpstreamAccept
+	}
+	contentCheck := cfg.UpstreamContentCheck
+	if contentCheck == "" {
+		contentCheck = config.ContentCheckHeader
+	}
+	requestIDHeader := cfg.RequestIDHeader
+	if requestIDHeader == "" {
+		requestIDHeader = config.DefaultRequestIDHeader
+	}
+	requestIDTrust := cfg.RequestIDTrust
+	if requestIDTrust == "" {
+		requestIDTrust = config.RequestIDTrustProxies
+	}
+	avatarParams := cfg.AvatarParams
+	if len(avatarParams) == 0 {
+		avatarParams = config.DefaultAvatarParams
+	}
+
+	maxURLLength := cfg.MaxURLLength
+	if maxURLLength <= 0 {
+		maxURLLength = config.DefaultMaxURLLength
+	}
+
+	bandwidth := newBandwidthMeter(cfg.UpstreamMonthlyCap, c.Dir())
+	client, err := newUpstreamClient(cfg, bandwidth)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &Handler{
+		cache: c,
+
+		staleWhileRevalidate: cfg.StaleWhileRevalidate,
+		suspectAfter:         cfg.SuspectAfterFailures,
+		negative:             cache.NewNegativeCache(cfg.NegativeTTL),
+		negativeTTL:          cfg.NegativeTTL,
+		palette:              palette,
+		localIdenticon:       cfg.LocalIdenticon,
+		shadowUpstream:       cfg.ShadowUpstream,
+		shadowPercent:        cfg.ShadowPercent,
+		shadowCompare:        cfg.ShadowMode == config.ShadowModeCompare,
+		shadowSlots:          make(chan struct{}, maxShadowInFlight),
+		localResize:          cfg.LocalResize,
+		resizeSourceSize:     cfg.ResizeSourceSize,
+		resizeFilter:         resizeFilter,
+		region:               cfg.UpstreamRegion,
+		trustedNetworks:      trustedNetworks,
+		transcodeFormats:     transcodeFormats,
+		transcoders:          transcoders,
+		noTranscodeGain:      newKeySet(maxNoGainKeys),
+		compressEncodings:    compressEncodings,
+		avatarParams:         avatarParams,
+		passthrough:          newPassthroughParams(cfg.PassthroughParams),
+		adminToken:           cfg.AdminToken,
+		adminRoleClaim:       cfg.AdminJWTRoleClaim,
+		adminRoles:           cfg.AdminJWTRoles,
+		adminBasicUser:       cfg.AdminBasicUser,
+		adminBasicPassword:   cfg.AdminBasicPassword,
+		adminClientCerts:     cfg.AdminClientCAFile != "",
+		purgePeers:           cfg.PurgePeers,
+		followPrimary:        cfg.FollowPrimary,
+		followInterval:       cfg.FollowInterval,
+		reportInterval:       cfg.CacheReportInterval,
+		janitorInterval:      cfg.CacheJanitorInterval,
+		evictionRate:         cfg.CacheEvictionRate,
+		expiryGrace:          cfg.CacheExpiryGrace,
+		peerClient:           &http.Client{Timeout: 10 * time.Second},
+		instance:             cfg.Instance,
+		peers:                peers,
+		trustedProxies:       trustedProxies,
+		requestIDHeader:      http.CanonicalHeaderKey(requestIDHeader),
+		requestIDTrust:       requestIDTrust,
+		maxURLLength:         maxURLLength,
+		apiKeys:              apiKeys,
+		prefetchQueue:        make(chan prefetchJob, prefetchQueueSize),
+		warmupSeed:           cfg.WarmupSeed,
+		features:             newFeatureFlags(cfg.FeatureFlags),
+		warmupRequests:       make(chan warmupRequest, 1),
+		followRedirects:      cfg.FollowRedirects,
+		upstreamAccept:       upstreamAccept,
+		contentCheck:         contentCheck,
+		maxUpstreamBytes:     cfg.MaxUpstreamBytes,
+		upstreamRetries:      cfg.UpstreamRetries,
+		upstreamRetryBackoff: cfg.UpstreamRetryBackoff,
+		retryBudget:          newRetryBudget(cfg.UpstreamRetryBudget),
+		retryHeaderTimeouts:  cfg.UpstreamRetryHeaderTimeouts,
+		upstreamOverrides:    cfg.UpstreamOverrides,
+		ladder:               ladder,
+		retryAfter:           retryAfter,
+		readyCheckUpstream:   cfg.ReadyCheckUpstream,
+		readyInterval:        readyCacheInterval,
+		startedAt:            time.Now(),
+		client:               client,
+		bandwidth:            bandwidth,
+		breaker:              newCircuitBreaker(cfg.CircuitBreakerThreshold, cfg.CircuitBreakerCooldown),
+	}
+	if cfg.AdminJWTIssuer != "" {
+		h.adminJWT = oidc.NewVerifier(cfg.AdminJWTIssuer, cfg.AdminJWTJWKSURL, cfg.AdminJWTAudience)
+		if h.adminRoleClaim == "" {
+			h.adminRoleClaim = "roles"
+		}
+	}
+	h.settings.Store(newSettings(cfg))
+	return h, nil
 }
 
-func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) serveAvatar(w http.ResponseWriter, r *http.Request) {
 	startTime := time.Now()
-	requestID := generateRequestID()
-
-	// 处理OPTIONS预检请求
-	if r.Method == "OPTIONS" {
-		if h.checkAccessControl(w, r) {
-			w.WriteHeader(http.StatusOK)
-		} else {
-			http.Error(w, "Forbidden", http.StatusForbidden)
-			log.LogRequest(r.Method, r.URL.Path, http.StatusForbidden, time.Since(startTime), requestID)
+	requestID := h.requestID(w, r)
+	// 整个请求使用同一份设置快照，处理中途热加载不会让前后步骤看到不同的设置
+	s := h.current()
+
+	if status := h.checkRequestLimits(w, r, requestID); status != 0 {
+		log.LogRequest(r.Method, r.URL.Path, status, time.Since(startTime), requestID)
+		return
+	}
+
+	// 处理OPTIONS预检请求，只对有效的头像路径响应
+	if r.Method == http.MethodOptions {
+		if normalizeHash(strings.TrimPrefix(r.URL.Path, "/avatar/")) == "" {
+			h.auditDenied(r, denyInvalidHash, http.StatusNotFound, requestID)
+			http.NotFound(w, r)
+			log.LogRequest(r.Method, r.URL.Path, http.StatusNotFound, time.Since(startTime), requestID)
+			return
+		}
+		if status := h.servePreflight(w, r, s, avatarCORS, requestID); status != http.StatusOK {
+			log.LogRequest(r.Method, r.URL.Path, status, time.Since(startTime), requestID)
 		}
 		return
 	}
 
+	if !h.checkRateLimit(w, r, s, requestID) {
+		log.LogRequest(r.Method, r.URL.Path, http.StatusTooManyRequests, time.Since(startTime), requestID)
+		return
+	}
+
+	key, status := h.checkAPIKey(w, r, requestID)
+	if status != http.StatusOK {
+		log.LogRequest(r.Method, r.URL.Path, status, time.Since(startTime), requestID)
+		return
+	}
+
 	// 检查访问控制
-	if !h.checkAccessControl(w, r) {
+	if !h.checkAccessControl(w, r, s, avatarCORS) {
+		h.auditDenied(r, denyOriginDenied, http.StatusForbidden, requestID)
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		log.LogRequest(r.Method, r.URL.Path, http.StatusForbidden, time.Since(startTime), requestID)
 		return
 	}
 
+	// 启用转码时响应内容取决于Accept
+	if len(h.transcodeFormats) > 0 {
+		w.Header().Add("Vary", "Accept")
+	}
+
 	hash := strings.TrimPrefix(r.URL.Path, "/avatar/")
 	hash = normalizeHash(hash)
 
 	if hash == "" {
+		h.auditDenied(r, denyInvalidHash, http.StatusBadRequest, requestID)
 		log.LogRequest(r.Method, r.URL.Path, http.StatusBadRequest, time.Since(startTime), requestID)
 		http.Error(w, "Invalid hash", http.StatusBadRequest)
 		return
 	}
 
-	queryParams := extractQueryParams(r.URL.Query())
+	query := r.URL.Query()
+	if name := conflictingParam(query, h.avatarParams, h.passthrough); name != "" {
+		requestsRejected.Inc("conflicting_param")
+		h.auditDenied(r, denyConflictingParam, http.StatusBadRequest, requestID)
+		log.LogRequest(r.Method, r.URL.Path, http.StatusBadRequest, time.Since(startTime), requestID)
+		http.Error(w, "Conflicting values for query parameter "+name, http.StatusBadRequest)
+		return
+	}
+
+	queryParams := h.requestParams(query)
+	logDroppedParams(query, queryParams, requestID)
+	if key.exceedsMaxSize(queryParams) {
+		apiKeyTierRejected.Inc(key.tierName(), "max_size")
+		h.auditDenied(r, denyTierMaxSize, http.StatusForbidden, requestID)
+		log.LogRequest(r.Method, r.URL.Path, http.StatusForbidden, time.Since(startTime), requestID)
+		http.Error(w, "Avatar size exceeds the API key's limit", http.StatusForbidden)
+		return
+	}
+	if style, ok := localStyle(queryParams); ok {
+		if _, known := avatargen.Lookup(style); !known {
+			log.LogRequest(r.Method, r.URL.Path, http.StatusBadRequest, time.Since(startTime), requestID)
+			http.Error(w, "Unknown local avatar style", http.StatusBadRequest)
+			return
+		}
+	}
+	region, err := h.requestRegion(r)
+	if err != nil {
+		log.LogRequest(r.Method, r.URL.Path, http.StatusBadRequest, time.Since(startTime), requestID)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if region != h.region {
+		queryParams[regionParam] = region
+	}
+	if status, served := h.serveOverride(w, r, s, hash, queryParams, requestID); served {
+		log.LogRequest(r.Method, r.URL.Path, status, time.Since(startTime), requestID)
+		return
+	}
+	if status, served := h.serveSharded(w, r, hash, requestID); served {
+		log.LogRequest(r.Method, r.URL.Path, status, time.Since(startTime), requestID)
+		return
+	}
+
 	cacheKey := h.cache.GenerateKey("/avatar/"+hash, queryParams)
+	debug := debugFrom(r.Context())
+	debug.setKey(cacheKey)
+
+	if negEntry, ok := h.negative.Get(cacheKey); ok {
+		log.Info("negative cache hit", "request_id", requestID, "key", cacheKey, "status", negEntry.StatusCode)
+		debug.setCache("negative")
+		for k, v := range negEntry.Headers {
+			w.Header().Set(k, v)
+		}
+		remaining := int(time.Until(negEntry.ExpiresAt).Seconds())
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", remaining))
+		w.WriteHeader(negEntry.StatusCode)
+		w.Write(negEntry.Body)
+		log.LogRequest(r.Method, r.URL.Path, negEntry.StatusCode, time.Since(startTime), requestID, h.saved(int64(len(negEntry.Body)))...)
+		return
+	}
 
 	if h.cache.CheckConditional(cacheKey, r) {
-		log.LogRequest(r.Method, r.URL.Path, http.StatusNotModified, time.Since(startTime), requestID)
+		debug.setCache("not_modified")
+		// 304须带上200响应会有的ETag
+		var size int64
+		if metadata, err := h.cache.GetMetadata(cacheKey); err == nil {
+			size = metadata.Size
+			if metadata.ResponseETag() != "" {
+				w.Header().Set("ETag", metadata.ResponseETag())
+			}
+		}
 		w.WriteHeader(http.StatusNotModified)
+		log.LogRequest(r.Method, r.URL.Path, http.StatusNotModified, time.Since(startTime), requestID, h.saved(size)...)
 		return
 	}
 
+	_, lookupSpan := tracing.Start(r.Context(), "cache.lookup", tracing.KindInternal)
 	entry, valid := h.cache.Get(cacheKey)
+	lookupSpan.SetAttribute("cache.key", cacheKey)
+	lookupSpan.SetAttribute("cache.result", cacheResult(entry, valid))
+	lookupSpan.End()
+	debug.setCache(cacheResult(entry, valid))
+	if entry != nil {
+		debug.setEntry(h.cacheTier(cacheKey), entry.Metadata.CreatedAt)
+	}
 	if valid {
 		log.Info("cache hit", "request_id", requestID, "key", cacheKey)
-		ttlSeconds := int(h.ttl.Seconds())
-		if err := h.cache.WriteResponse(w, cacheKey, ttlSeconds); err != nil {
+		if format := h.negotiateFormat(r); format != "" && key.allowsTransformations() && h.features.enabled(config.FeatureTransformations) {
+			if h.serveTranscoded(w, r, s, cacheKey, hash, queryParams, format, requestID) {
+				debug.setCache("transcoded")
+				log.LogRequest(r.Method, r.URL.Path, http.StatusOK, time.Since(startTime), requestID, h.saved(entry.Metadata.Size)...)
+				return
+			}
+		}
+		if encoding := h.negotiateEncoding(r); encoding != "" {
+			if h.serveCompressed(w, r, s, cacheKey, hash, queryParams, encoding, requestID) {
+				debug.setCache("compressed")
+				log.LogRequest(r.Method, r.URL.Path, http.StatusOK, time.Since(startTime), requestID, h.saved(entry.Metadata.Size)...)
+				return
+			}
+		}
+		h.varyOnEncoding(w, entry.Metadata.Headers["Content-Type"])
+		ttlSeconds := int(s.ttl.Seconds())
+		if err := h.cache.WriteResponse(w, r, cacheKey, ttlSeconds); err != nil {
 			log.Error("failed to write cached response", "error", err, "request_id", requestID)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			log.LogRequest(r.Method, r.URL.Path, http.StatusInternalServerError, time.Since(startTime), requestID)
 			return
 		}
-		log.LogRequest(r.Method, r.URL.Path, http.StatusOK, time.Since(startTime), requestID)
+		log.LogRequest(r.Method, r.URL.Path, http.StatusOK, time.Since(startTime), requestID, h.saved(entry.Metadata.Size)...)
 		return
 	}
 
-	upstreamURL := h.buildUpstreamURL(hash, queryParams)
-	req, err := http.NewRequest("GET", upstreamURL, nil)
-	if err != nil {
-		log.Error("failed to create upstream request", "error", err, "request_id", requestID)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		log.LogRequest(r.Method, r.URL.Path, http.StatusInternalServerError, time.Since(startTime), requestID)
-		return
+	if size, ok := h.resizeTarget(queryParams); ok {
+		if status, served := h.serveResized(r.Context(), w, s, cacheKey, hash, queryParams, size, region, requestID); served {
+			debug.setCache("resized")
+			log.LogRequest(r.Method, r.URL.Path, status, time.Since(startTime), requestID)
+			return
+		}
 	}
 
-	if entry != nil {
-		if etag := entry.Metadata.Headers["ETag"]; etag != "" {
-			req.Header.Set("If-None-Match", etag)
-		}
-		if lastModified := entry.Metadata.Headers["Last-Modified"]; lastModified != "" {
-			req.Header.Set("If-Modified-Since", lastModified)
+	if entry != nil && h.isServableStale(s, entry) {
+		log.Info("serving stale entry, revalidating in background", "request_id", requestID, "key", cacheKey)
+		h.varyOnEncoding(w, entry.Metadata.Headers["Content-Type"])
+		ttlSeconds := int(s.ttl.Seconds())
+		if err := h.cache.WriteResponse(w, r, cacheKey, ttlSeconds); err != nil {
+			log.Error("failed to write cached response", "error", err, "request_id", requestID)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			log.LogRequest(r.Method, r.URL.Path, http.StatusInternalServerError, time.Since(startTime), requestID)
+			return
 		}
+		// 是否省下下载要等后台重新验证的结果，由revalidateInBackground在上游回答304时记录
+		h.revalidateInBackground(cacheKey, hash, queryParams, entry, requestID)
+		log.LogRequest(r.Method, r.URL.Path, http.StatusOK, time.Since(startTime), requestID)
+		return
 	}
 
-	log.Info("fetching from upstream", "request_id", requestID, "url", upstreamURL)
-	resp, err := h.client.Do(req)
-	if err != nil {
-		log.Error("upstream request failed", "error", err, "request_id", requestID)
-		http.Error(w, "Failed to fetch from upstream", http.StatusBadGateway)
-		log.LogRequest(r.Method, r.URL.Path, http.StatusBadGateway, time.Since(startTime), requestID)
+	if style, ok := localStyle(queryParams); ok && queryParams["f"] == "y" {
+		metadata, data, err := h.renderLocalDefault(cacheKey, hash, style, queryParams, requestID)
+		if err != nil {
+			log.Error("failed to generate local default avatar", "error", err, "request_id", requestID)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			log.LogRequest(r.Method, r.URL.Path, http.StatusInternalServerError, time.Since(startTime), requestID)
+			return
+		}
+		debug.setCache("generated")
+		h.writeResponse(w, s, metadata, data)
+		log.LogRequest(r.Method, r.URL.Path, metadata.StatusCode, time.Since(startTime), requestID)
 		return
 	}
 
+	fetchStart := time.Now()
+	primary := s.upstreams[:1]
+	resp, upstream, err := h.fetchUpstream(r.Context(), primary, hash, queryParams, entry, region, requestID)
+	debug.setUpstream(primary[0], time.Since(fetchStart))
+	if err != nil || resp.StatusCode >= http.StatusInternalServerError {
+		if entry != nil {
+			h.recordRevalidationFailure(cacheKey, requestID)
+		}
+		var status int
+		var served bool
+		resp, upstream, status, served = h.degrade(r.Context(), w, s, cacheKey, hash, queryParams, entry, region, resp, err, requestID)
+		if served {
+			log.LogRequest(r.Method, r.URL.Path, status, time.Since(startTime), requestID)
+			return
+		}
+	}
+	primaryLatency := time.Since(fetchStart)
+
 	if resp.StatusCode == http.StatusNotModified && entry != nil {
 		log.Info("upstream returned 304, refreshing cache", "request_id", requestID)
+		debug.setCache("revalidated")
+		resp.Body.Close()
 		metadata := entry.Metadata
-		metadata.CreatedAt = time.Now()
+		metadata.Revalidated(time.Now())
 		metadata.LastAccessedAt = time.Now()
 		if err := h.cache.UpdateMetadata(cacheKey, metadata); err != nil {
 			log.Warn("failed to update metadata", "error", err, "request_id", requestID)
 		}
 
-		ttlSeconds := int(h.ttl.Seconds())
-		if err := h.cache.WriteResponse(w, cacheKey, ttlSeconds); err != nil {
+		h.varyOnEncoding(w, metadata.Headers["Content-Type"])
+		ttlSeconds := int(s.ttl.Seconds())
+		if err := h.cache.WriteResponse(w, r, cacheKey, ttlSeconds); err != nil {
 			log.Error("failed to write cached response", "error", err, "request_id", requestID)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			log.LogRequest(r.Method, r.URL.Path, http.StatusInternalServerError, time.Since(startTime), requestID)
 			return
 		}
-		log.LogRequest(r.Method, r.URL.Path, http.StatusOK, time.Since(startTime), requestID)
+		log.LogRequest(r.Method, r.URL.Path, http.StatusOK, time.Since(startTime), requestID, h.saved(metadata.Size)...)
+		return
+	}
+
+	// 来自重定向目标缓存的内容已在内存中，不需要流式写入
+	if resp.StatusCode == http.StatusOK && resp.Header.Get(redirectKeyHeader) == "" {
+		h.streamUpstreamResponse(w, s, cacheKey, hash, upstream, queryParams, resp, primaryLatency, requestID)
+		log.LogRequest(r.Method, r.URL.Path, resp.StatusCode, time.Since(startTime), requestID)
 		return
 	}
 
-	data, err := cache.ReadResponseBody(resp)
+	data, err := readUpstreamBody(resp, upstream)
 	if err != nil {
-		log.Error("failed to read response body", "error", err, "request_id", requestID)
+		log.Error("failed to read upstream response body", "error", err, "error_class", errorClass(err), "upstream", upstream, "request_id", requestID)
 		http.Error(w, "Failed to read upstream response", http.StatusInternalServerError)
 		log.LogRequest(r.Method, r.URL.Path, http.StatusInternalServerError, time.Since(startTime), requestID)
 		return
 	}
+	h.shadowRequest(hash, queryParams, resp, h.shadowSum(data), primaryLatency, requestID)
+
+	metadata, data, err := h.handleUpstreamBody(cacheKey, hash, upstream, queryParams, resp, data, requestID)
+	if err != nil {
+		log.Error("failed to generate local default avatar", "error", err, "request_id", requestID)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		log.LogRequest(r.Method, r.URL.Path, http.StatusInternalServerError, time.Since(startTime), requestID)
+		return
+	}
+
+	h.writeResponse(w, s, metadata, data)
+	log.LogRequest(r.Method, r.URL.Path, metadata.StatusCode, time.Since(startTime), requestID)
+}
 
+// isServableStale 判断过期条目是否仍处于stale-while-revalidate窗口内
+// 可疑条目不再先返回过期内容，而是同步向上游重新获取，失败时才按FALLBACK_LADDER降级
+func (h *Handler) isServableStale(s *settings, entry *cache.CacheEntry) bool {
+	if h.staleWhileRevalidate <= 0 || entry.Metadata.Suspect {
+		return false
+	}
+	return time.Since(entry.Metadata.CreatedAt) <= s.ttl+h.staleWhileRevalidate
+}
+
+// revalidateInBackground 在后台向上游重新验证缓存条目，同一个key同时只会有一个验证任务
+func (h *Handler) revalidateInBackground(cacheKey, hash string, queryParams map[string]string, entry *cache.CacheEntry, requestID string) {
+	if _, running := h.revalidating.LoadOrStore(cacheKey, struct{}{}); running {
+		return
+	}
+
+	go func() {
+		defer h.revalidating.Delete(cacheKey)
+
+		status, err := h.revalidate(context.Background(), cacheKey, hash, queryParams, entry, requestID)
+		switch {
+		case err != nil:
+			log.Warn("background revalidation failed", "error", err, "error_class", errorClass(err), "upstream", errorUpstream(err), "request_id", requestID, "key", cacheKey)
+		case status == http.StatusNotModified:
+			log.Info("background revalidation refreshed entry", append([]any{"request_id", requestID, "key", cacheKey}, h.saved(entry.Metadata.Size)...)...)
+		case status >= http.StatusInternalServerError:
+			log.Warn("background revalidation got upstream error, keeping stale entry",
+				"status", status, "request_id", requestID, "key", cacheKey)
+		default:
+			log.Info("background revalidation replaced entry", "request_id", requestID, "key", cacheKey, "status", status)
+		}
+	}()
+}
+
+// revalidate 以条件请求向上游刷新缓存条目，不论是否过期，返回上游状态码
+// 304时只刷新创建时间；上游失败或5xx时保留原条目并记录一次失败；其他响应按正常流程替换条目
+func (h *Handler) revalidate(ctx context.Context, cacheKey, hash string, queryParams map[string]string, entry *cache.CacheEntry, requestID string) (int, error) {
+	resp, upstream, err := h.fetchUpstream(ctx, h.upstreamChain(), hash, queryParams, entry, h.paramsRegion(queryParams), requestID)
+	if err != nil {
+		if entry != nil {
+			h.recordRevalidationFailure(cacheKey, requestID)
+		}
+		return 0, err
+	}
+
+	if resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		metadata := entry.Metadata
+		metadata.Revalidated(time.Now())
+		if err := h.cache.UpdateMetadata(cacheKey, metadata); err != nil {
+			log.Warn("failed to update metadata", "error", err, "request_id", requestID)
+		}
+		return resp.StatusCode, nil
+	}
+
+	data, err := readUpstreamBody(resp, upstream)
+	if err != nil || resp.StatusCode >= http.StatusInternalServerError {
+		if entry != nil {
+			h.recordRevalidationFailure(cacheKey, requestID)
+		}
+		return resp.StatusCode, err
+	}
+
+	if _, _, err := h.handleUpstreamBody(cacheKey, hash, upstream, queryParams, resp, data, requestID); err != nil {
+		return resp.StatusCode, err
+	}
+	return resp.StatusCode, nil
+}
+
+// recordRevalidationFailure 记录条目的一次重新验证失败，达到SUSPECT_AFTER_FAILURES时将其标记为可疑
+func (h *Handler) recordRevalidationFailure(cacheKey, requestID string) {
+	failures, suspect := h.cache.RecordRevalidationFailure(cacheKey, h.suspectAfter)
+	if suspect && failures == h.suspectAfter {
+		log.Warn("cache entry marked suspect after repeated revalidation failures",
+			"failures", failures, "request_id", requestID, "key", cacheKey)
+	}
+}
+
+// storeUpstreamResponse 将上游响应写入缓存，404/403在启用负缓存时只进入负缓存
+func (h *Handler) storeUpstreamResponse(cacheKey, hash, upstream string, queryParams map[string]string, resp *http.Response, data []byte, requestID string) cache.Metadata {
 	metadata := cache.Metadata{
 		CreatedAt:      time.Now(),
 		LastAccessedAt: time.Now(),
 		Headers:        cache.ExtractHeaders(resp),
 		StatusCode:     resp.StatusCode,
+		Upstream:       upstream,
+		Hash:           hash,
+		Path:           "/avatar/" + hash,
+		Params:         queryParams,
 	}
 
-	if err := h.cache.Set(cacheKey, data, metadata); err != nil {
-		log.Warn("failed to cache response", "error", err, "request_id", requestID)
+	if h.negative.Enabled() && cache.IsNegativeStatus(resp.StatusCode) {
+		if h.cache.Tombstoned(cacheKey, hash) {
+			log.Info("skipped negative cache entry for purged avatar", "request_id", requestID, "key", cacheKey)
+			return metadata
+		}
+		h.negative.Set(cacheKey, hash, resp.StatusCode, metadata.Headers, data)
+		log.Info("stored negative cache entry", "request_id", requestID, "key", cacheKey, "status", resp.StatusCode)
+		return metadata
 	}
 
-	for k, v := range metadata.Headers {
-		w.Header().Set(k, v)
+	// 重定向目标的内容与目标条目共用数据文件，指向同一默认图片的头像只存一份
+	if source := resp.Header.Get(redirectKeyHeader); source != "" {
+		metadata.SourceKey = source
+		if err := h.cache.Link(cacheKey, source, metadata); err == nil {
+			return metadata
+		}
+		metadata.SourceKey = ""
 	}
-	ttlSeconds := int(h.ttl.Seconds())
-	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", ttlSeconds))
-	w.WriteHeader(resp.StatusCode)
-	w.Write(data)
 
-	log.LogRequest(r.Method, r.URL.Path, resp.StatusCode, time.Since(startTime), requestID)
-}
-
-func (h *Handler) buildUpstreamURL(hash string, queryParams map[string]string) string {
-	u, _ := url.Parse(h.upstreamBase)
-	u.Path = fmt.Sprintf("/avatar/%s", hash)
-
-	q := u.Query()
-	for k, v := range queryParams {
-		q.Set(k, v)
+	if err := h.cache.Set(cacheKey, data, metadata); err != nil {
+		log.Warn("failed to cache response", "error", err, "request_id", requestID)
 	}
-	u.RawQuery = q.Encode()
-
-	return u.String()
+	return metadata
 }
 
 func normalizeHash(hash string) string {
@@ -182,25 +718,101 @@ func normalizeHash(hash string) string {
 	return hash
 }
 
-func extractQueryParams(query url.Values) map[string]string {
-	allowed := map[string]bool{
-		"s": true,
-		"d": true,
-		"r": true,
-		"f": true,
+// requestParams 返回参与缓存键计算的请求参数，已应用本地默认头像的改写
+func (h *Handler) requestParams(query url.Values) map[string]string {
+	params := extractQueryParams(query, h.avatarParams, h.passthrough)
+	h.applyLocalDefaults(params)
+	return params
+}
+
+// logDroppedParams 记录被丢弃的查询参数；只记录参数名，取值可能含有个人信息
+// api_key由认证使用，不算作丢弃
+func logDroppedParams(query url.Values, params map[string]string, requestID string) {
+	var dropped []string
+	for name := range query {
+		if _, kept := params[name]; !kept && name != apiKeyParam {
+			dropped = append(dropped, name)
+		}
 	}
+	if len(dropped) == 0 {
+		return
+	}
+	slices.Sort(dropped)
+	queryParamsDropped.Add(float64(len(dropped)))
+	log.Debug("dropped query parameters", "params", dropped, "request_id", requestID)
+}
+
+// derivedParams 是转码、压缩变体及覆盖的上游区域在缓存键中附加的参数，不能由客户端透传，否则请求可直接命中变体
+var derivedParams = []string{"fmt", "enc", regionParam}
+
+// passthroughParams 是PASSTHROUGH_PARAMS允许透传的额外查询参数，供支持扩展参数的兼容上游使用
+// 透传的参数与头像参数一样参与缓存键并转发给上游；API key参数始终不透传
+type passthroughParams struct {
+	all   bool
+	names map[string]bool
+}
+
+func newPassthroughParams(names []string) passthroughParams {
+	p := passthroughParams{names: make(map[string]bool, len(names))}
+	for _, name := range names {
+		if name == "*" {
+			p.all = true
+			continue
+		}
+		p.names[name] = true
+	}
+	return p
+}
+
+func (p passthroughParams) allows(name string) bool {
+	if name == apiKeyParam || slices.Contains(derivedParams, name) {
+		return false
+	}
+	return p.all || p.names[name]
+}
 
+func extractQueryParams(query url.Values, avatarParams []string, passthrough passthroughParams) map[string]string {
 	params := make(map[string]string)
+	for _, k := range avatarParams {
+		if v := query[k]; len(v) > 0 {
+			params[k] = v[0]
+		}
+	}
 	for k, v := range query {
-		if allowed[k] && len(v) > 0 {
+		if len(v) > 0 && passthrough.allows(k) {
 			params[k] = v[0]
 		}
 	}
+	// name只对d=initials有意义，其他默认头像下保留会让随机name把同一头像拆成多个缓存条目
+	if params["d"] != "initials" {
+		delete(params, "name")
+	}
 	return params
 }
 
-func generateRequestID() string {
-	return fmt.Sprintf("%d", time.Now().UnixNano())
+// conflictingParam 返回取值不一致的重复头像参数或透传参数名，没有时返回空字符串；取值相同的重复参数视为一个
+// 这类请求（如?s=80&s=512）会被拒绝，避免各层对取哪个值理解不同，导致缓存条目与上游请求不一致
+func conflictingParam(query url.Values, avatarParams []string, passthrough passthroughParams) string {
+	for _, k := range avatarParams {
+		if conflicting(query[k]) {
+			return k
+		}
+	}
+	for k, values := range query {
+		if passthrough.allows(k) && conflicting(values) {
+			return k
+		}
+	}
+	return ""
+}
+
+func conflicting(values []string) bool {
+	for _, v := range values {
+		if v != values[0] {
+			return true
+		}
+	}
+	return false
 }
 
 // normalizeOrigin 规范化Origin格式，提取域名部分
@@ -236,79 +848,102 @@ func extractDomainFromReferer(referer string) string {
 	return strings.ToLower(host)
 }
 
-// isOriginAllowed 检查Origin是否在允许列表中
-// 支持精确匹配和子域名匹配（如允许example.com时，也允许sub.example.com）
-func isOriginAllowed(origin string, allowedOrigins []string) bool {
-	if len(allowedOrigins) == 0 {
-		return true // 未配置允许列表时，允许所有来源（向后兼容）
-	}
-	if origin == "" {
-		return false
+// corsRoute 是一个路由在CORS响应头中声明的方法和请求头
+type corsRoute struct {
+	methods string
+	headers string
+}
+
+var (
+	avatarCORS   = corsRoute{methods: "GET, HEAD, OPTIONS", headers: "Content-Type, Cache-Control, If-None-Match, If-Modified-Since, X-API-Key"}
+	prefetchCORS = corsRoute{methods: "POST, OPTIONS", headers: "Content-Type, Authorization, X-API-Key"}
+)
+
+// servePreflight 响应路由的OPTIONS预检请求，返回写出的状态码
+func (h *Handler) servePreflight(w http.ResponseWriter, r *http.Request, s *settings, route corsRoute, requestID string) int {
+	w.Header().Set("Allow", route.methods)
+	if !h.checkAccessControl(w, r, s, route) {
+		h.auditDenied(r, denyOriginDenied, http.StatusForbidden, requestID)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return http.StatusForbidden
 	}
-	originDomain := normalizeOrigin(origin)
-	if originDomain == "" {
-		return false
+	if s.preflightCacheTTL > 0 && preflightCacheable(s, r) {
+		w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(s.preflightCacheTTL.Seconds())))
 	}
-	for _, allowed := range allowedOrigins {
-		allowed = strings.TrimSpace(strings.ToLower(allowed))
-		if allowed == "" {
-			continue
-		}
-		// 精确匹配
-		if originDomain == allowed {
-			return true
-		}
-		// 子域名匹配：如果允许example.com，则sub.example.com也允许
-		if strings.HasSuffix(originDomain, "."+allowed) {
-			return true
-		}
-	}
-	return false
+	w.WriteHeader(http.StatusOK)
+	return http.StatusOK
 }
 
-// checkAccessControl 检查访问控制并设置CORS响应头
+// preflightCacheable 判断成功的预检响应能否交给共享缓存
+// 响应只按Origin变化（Vary: Origin），仅凭Referer放行的预检不能缓存，否则会把结果交给同一Origin下Referer不同的请求
+func preflightCacheable(s *settings, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	return s.origins == nil || (origin != "" && s.origins.origin(origin).allowed)
+}
+
+// checkAccessControl 检查访问控制并按路由设置CORS响应头
 // 返回true表示允许访问，false表示拒绝访问
-func (h *Handler) checkAccessControl(w http.ResponseWriter, r *http.Request) bool {
+func (h *Handler) checkAccessControl(w http.ResponseWriter, r *http.Request, s *settings, route corsRoute) bool {
 	// 如果未配置允许列表，跳过检查（向后兼容）
-	if len(h.allowedOrigins) == 0 {
+	if s.origins == nil {
 		return true
 	}
 
+	// 响应头和访问结果都取决于Origin，中间缓存须按Origin分别缓存，不能把一个来源的响应交给另一个来源
+	w.Header().Add("Vary", "Origin")
+
 	origin := r.Header.Get("Origin")
 	referer := r.Header.Get("Referer")
 
-	// 检查Origin请求头（用于CORS预检和实际请求）
+	// 检查Origin请求头（用于CORS预检和实际请求）；不匹配时再检查Referer（用于直接请求，防止绕过CORS）
+	match := originMatch{label: "none"}
 	if origin != "" {
-		if isOriginAllowed(origin, h.allowedOrigins) {
-			// 设置CORS响应头
-			w.Header().Set("Access-Control-Allow-Origin", origin)
-			w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Cache-Control, If-None-Match, If-Modified-Since")
-			return true
+		match = s.origins.origin(origin)
+	}
+	if !match.allowed && referer != "" {
+		if m := s.origins.referer(referer); m.allowed || origin == "" {
+			match = m
 		}
 	}
+	if !match.allowed {
+		// 如果既没有Origin也没有Referer，或者都不匹配，拒绝访问
+		originDecisionsTotal.Inc(match.label, "denied")
+		return false
+	}
 
-	// 检查Referer请求头（用于直接请求，防止绕过CORS）
-	if referer != "" {
-		refererDomain := extractDomainFromReferer(referer)
-		if refererDomain != "" && isOriginAllowed(refererDomain, h.allowedOrigins) {
-			// 如果Origin存在但不匹配，但Referer匹配，也允许访问
-			// 设置CORS响应头（如果Origin存在）
-			if origin != "" {
-				w.Header().Set("Access-Control-Allow-Origin", origin)
-			}
-			w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Cache-Control, If-None-Match, If-Modified-Since")
-			return true
-		}
+	originDecisionsTotal.Inc(match.label, "allowed")
+	// 设置CORS响应头（Referer匹配而Origin不匹配时同样回显Origin）
+	if origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
 	}
+	setCORSHeaders(w, r, route, s.corsMaxAge)
+	return true
+}
 
-	// 如果既没有Origin也没有Referer，或者都不匹配，拒绝访问
-	return false
+// setCORSHeaders 设置路由允许的方法和请求头；预检响应还带上Access-Control-Max-Age，使浏览器在此期间不再重复预检
+func setCORSHeaders(w http.ResponseWriter, r *http.Request, route corsRoute, maxAge time.Duration) {
+	w.Header().Set("Access-Control-Allow-Methods", route.methods)
+	w.Header().Set("Access-Control-Allow-Headers", route.headers)
+	if r.Method == http.MethodOptions && maxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(maxAge.Seconds())))
+	}
 }
 
-func HealthHandler(w http.ResponseWriter, r *http.Request) {
+// HealthHandler 返回健康状态和实例标识，分片节点的健康检查据此识别彼此
+// 带verbose=1的受信任或已认证请求还会得到缓存、运行时间和版本等诊断信息
+func (h *Handler) HealthHandler(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	requestID := h.requestID(w, r)
+	var diagnostics *healthDiagnostics
+	if h.wantsDiagnostics(r) {
+		diagnostics = h.diagnostics()
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{"status":"ok"}`))
+	json.NewEncoder(w).Encode(struct {
+		Status string `json:"status"`
+		config.Identity
+		Diagnostics *healthDiagnostics `json:"diagnostics,omitempty"`
+	}{"ok", h.instance, diagnostics})
+	log.LogRequest(r.Method, r.URL.Path, http.StatusOK, time.Since(startTime), requestID)
 }
@@ -0,0 +1,5198 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/png"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gravatar-proxy/internal/assets"
+	"gravatar-proxy/internal/avatargen"
+	"gravatar-proxy/internal/cache"
+	"gravatar-proxy/internal/config"
+	"gravatar-proxy/internal/log"
+	"gravatar-proxy/internal/rpc"
+
+	"github.com/andybalholm/brotli"
+)
+
+func newTestHandler(t *testing.T, cfg *config.Config) *Handler {
+	t.Helper()
+
+	c, err := cache.New(t.TempDir(), cfg.CacheTTL, 1024*1024)
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+
+	h, err := NewHandler(cfg, c)
+	if err != nil {
+		t.Fatalf("failed to create handler: %v", err)
+	}
+	return h
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	var hits int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&hits, 1)
+		w.Header().Set("Content-Type", "image/png")
+		w.WriteHeader(http.StatusOK)
+		if n == 1 {
+			w.Write([]byte("v1"))
+		} else {
+			w.Write([]byte("v2"))
+		}
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:             50 * time.Millisecond,
+		UpstreamBases:        []string{upstream.URL},
+		StaleWhileRevalidate: time.Hour,
+	})
+	t.Cleanup(func() { waitRevalidations(h) })
+
+	get := func() string {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/avatar/abc", nil))
+		return rec.Body.String()
+	}
+
+	if body := get(); body != "v1" {
+		t.Fatalf("expected v1 on first fetch, got %q", body)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if body := get(); body != "v1" {
+		t.Errorf("expected stale v1 to be served immediately, got %q", body)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&hits) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if body := get(); body != "v2" {
+		t.Errorf("expected revalidated v2, got %q", body)
+	}
+}
+
+// waitRevalidations 等待后台重新验证结束，避免其在测试结束后写入已删除的缓存目录
+func waitRevalidations(h *Handler) {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		running := false
+		h.revalidating.Range(func(any, any) bool {
+			running = true
+			return false
+		})
+		if !running {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUpstreamFallback(t *testing.T) {
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer broken.Close()
+
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("mirror"))
+	}))
+	defer mirror.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:      time.Hour,
+		UpstreamBases: []string{broken.URL, mirror.URL},
+	})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/avatar/abc", nil))
+
+	if rec.Code != http.StatusOK || rec.Body.String() != "mirror" {
+		t.Fatalf("expected mirror response, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	key := h.cache.GenerateKey("/avatar/abc", map[string]string{})
+	meta, err := h.cache.GetMetadata(key)
+	if err != nil {
+		t.Fatalf("expected response to be cached: %v", err)
+	}
+	if meta.Upstream != mirror.URL {
+		t.Errorf("expected upstream %s recorded, got %s", mirror.URL, meta.Upstream)
+	}
+}
+
+func TestLocalIdenticon(t *testing.T) {
+	var gotDefault string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotDefault = r.URL.Query().Get("d")
+		w.WriteHeader(http.StatusNotFound)
+	}))
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:       time.Hour,
+		UpstreamBases:  []string{upstream.URL},
+		LocalIdenticon: true,
+	})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/avatar/abc?d=identicon&s=40", nil))
+
+	if gotDefault != "404" {
+		t.Errorf("expected upstream to be asked with d=404, got %q", gotDefault)
+	}
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("expected generated png, got %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	generated := rec.Body.String()
+
+	upstream.Close()
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/avatar/def?d=identicon&s=40", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected offline generated avatar, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/avatar/abc?d=identicon&s=40", nil))
+	if rec.Body.String() != generated {
+		t.Error("expected cached generated avatar to be served while upstream is down")
+	}
+}
+
+func TestInitialsSharesCacheEntry(t *testing.T) {
+	var hits int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:      time.Hour,
+		UpstreamBases: []string{upstream.URL},
+	})
+
+	for _, name := range []string{"John+Doe", "J+D", "jane+dawson"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/avatar/abc?d=initials&name="+name, nil))
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/png" {
+			t.Fatalf("expected generated png for %s, got %d", name, rec.Code)
+		}
+	}
+
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Errorf("expected names with the same initials to share one cache entry, got %d upstream requests", n)
+	}
+}
+
+func TestNameIgnoredWithoutInitials(t *testing.T) {
+	var hits int32
+	var forwarded atomic.Value
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		forwarded.Store(r.URL.RawQuery)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("avatar"))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:      time.Hour,
+		UpstreamBases: []string{upstream.URL},
+	})
+
+	for _, name := range []string{"a", "b", "c"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/avatar/abc?d=mp&name="+name, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200 for name=%s, got %d", name, rec.Code)
+		}
+	}
+
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Errorf("expected name to be ignored without d=initials, got %d upstream requests", n)
+	}
+	if q, _ := forwarded.Load().(string); strings.Contains(q, "name=") {
+		t.Errorf("expected name not to be forwarded upstream, got %q", q)
+	}
+}
+
+func TestRegionOverrideCachedSeparately(t *testing.T) {
+	var hits int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if r.URL.Query().Has("region") {
+			t.Errorf("region cache key parameter must not be forwarded upstream: %s", r.URL.RawQuery)
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte(r.URL.Query().Get("r")))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:        time.Hour,
+		UpstreamBases:   []string{upstream.URL + "/?r={region}"},
+		UpstreamRegion:  "us",
+		TrustedNetworks: []string{"192.0.2.0/24"},
+	})
+
+	get := func(region string) string {
+		req := httptest.NewRequest("GET", "/avatar/abc", nil)
+		if region != "" {
+			req.Header.Set(regionHeader, region)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200 for region %q, got %d", region, rec.Code)
+		}
+		return rec.Body.String()
+	}
+
+	if body := get(""); body != "us" {
+		t.Errorf("expected default region response, got %q", body)
+	}
+	if body := get("eu"); body != "eu" {
+		t.Errorf("expected overridden region to bypass the default region's entry, got %q", body)
+	}
+	if body := get("eu"); body != "eu" {
+		t.Errorf("expected cached overridden region response, got %q", body)
+	}
+	if body := get("us"); body != "us" {
+		t.Errorf("expected an override naming the default region to share its entry, got %q", body)
+	}
+	if n := atomic.LoadInt32(&hits); n != 2 {
+		t.Errorf("expected one upstream request per region, got %d", n)
+	}
+
+	// 不受信任的来源不能覆盖区域，也就不会命中其他区域的条目
+	req := httptest.NewRequest("GET", "/avatar/abc", nil)
+	req.RemoteAddr = "198.51.100.1:1234"
+	req.Header.Set(regionHeader, "eu")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Body.String() != "us" {
+		t.Errorf("expected untrusted override to be ignored, got %q", rec.Body.String())
+	}
+}
+
+func TestShadowCompareDetectsDivergence(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("ETag", `"same"`)
+		w.Write([]byte("primary"))
+	}))
+	defer primary.Close()
+
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"same"`)
+		w.Write([]byte("shadow"))
+	}))
+	defer shadow.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:       time.Hour,
+		UpstreamBases:  []string{primary.URL},
+		ShadowUpstream: shadow.URL,
+		ShadowPercent:  100,
+		ShadowMode:     config.ShadowModeCompare,
+	})
+
+	before := shadowResults.Value("content_mismatch")
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/avatar/abc", nil))
+	if rec.Body.String() != "primary" {
+		t.Fatalf("expected primary response, got %q", rec.Body.String())
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for shadowResults.Value("content_mismatch") == before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if shadowResults.Value("content_mismatch") != before+1 {
+		t.Error("expected content mismatch to be recorded")
+	}
+}
+
+func TestLocalResizeFromOriginal(t *testing.T) {
+	var requestedSizes []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestedSizes = append(requestedSizes, r.URL.Query().Get("s"))
+		var buf bytes.Buffer
+		png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 64, 64)))
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(buf.Bytes())
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:         time.Hour,
+		UpstreamBases:    []string{upstream.URL},
+		LocalResize:      true,
+		ResizeSourceSize: 64,
+	})
+
+	for _, size := range []int{16, 32} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/avatar/abc?s="+strconv.Itoa(size), nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", rec.Code)
+		}
+		img, err := png.Decode(rec.Body)
+		if err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if img.Bounds().Dx() != size {
+			t.Errorf("expected width %d, got %d", size, img.Bounds().Dx())
+		}
+	}
+
+	if len(requestedSizes) != 1 || requestedSizes[0] != "64" {
+		t.Errorf("expected a single upstream fetch of the original, got sizes %v", requestedSizes)
+	}
+}
+
+func TestTranscodeNegotiation(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		encoder := png.Encoder{CompressionLevel: png.NoCompression}
+		encoder.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 64, 64)))
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(buf.Bytes())
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:         time.Hour,
+		UpstreamBases:    []string{upstream.URL},
+		TranscodeFormats: []string{"webp"},
+	})
+
+	get := func(accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/avatar/abc", nil)
+		req.Header.Set("Accept", accept)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", rec.Code)
+		}
+		if rec.Header().Get("Vary") != "Accept" {
+			t.Errorf("expected Vary: Accept, got %q", rec.Header().Get("Vary"))
+		}
+		return rec
+	}
+
+	// 首次请求填充缓存，之后的命中才会转码
+	get("image/webp,*/*")
+
+	rec := get("image/avif,image/webp,*/*")
+	if ct := rec.Header().Get("Content-Type"); ct != "image/webp" {
+		t.Fatalf("expected image/webp, got %q", ct)
+	}
+	if body := rec.Body.Bytes(); len(body) < 12 || string(body[8:12]) != "WEBP" {
+		t.Errorf("expected a WebP body")
+	}
+
+	for _, accept := range []string{"*/*", "image/webp;q=0, image/*"} {
+		if ct := get(accept).Header().Get("Content-Type"); ct != "image/png" {
+			t.Errorf("Accept %q: expected image/png, got %q", accept, ct)
+		}
+	}
+
+	c, _ := cache.New(t.TempDir(), time.Hour, 1024*1024)
+	if _, err := NewHandler(&config.Config{TranscodeFormats: []string{"avif"}}, c); err == nil {
+		t.Error("expected avif to be rejected without an encoder")
+	}
+}
+
+func TestTranscodeAVIF(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake encoder is a shell script")
+	}
+	encoder := filepath.Join(t.TempDir(), "avifenc")
+	script := "#!/bin/sh\nprintf '\\000\\000\\000\\024ftypavif\\000\\000\\000\\000mif1' > \"$2\"\n"
+	if err := os.WriteFile(encoder, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 64, 64)))
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(buf.Bytes())
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:         time.Hour,
+		UpstreamBases:    []string{upstream.URL},
+		TranscodeFormats: []string{"avif", "webp"},
+		AVIFEncoder:      encoder,
+	})
+
+	get := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/avatar/abc", nil)
+		req.Header.Set("Accept", "image/avif,image/webp,*/*")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	get()
+
+	rec := get()
+	if ct := rec.Header().Get("Content-Type"); ct != "image/avif" {
+		t.Fatalf("expected image/avif, got %q", ct)
+	}
+	if body := rec.Body.String(); len(body) != 20 || body[4:12] != "ftypavif" {
+		t.Errorf("expected the external encoder's output, got %q", body)
+	}
+}
+
+func TestKeySetBounded(t *testing.T) {
+	s := newKeySet(2)
+	s.add("a")
+	s.add("b")
+	s.has("a")
+	s.add("c")
+	if !s.has("a") || !s.has("c") || s.has("b") {
+		t.Error("expected the least recently used key to be evicted")
+	}
+	if n := s.len(); n != 2 {
+		t.Errorf("expected 2 keys, got %d", n)
+	}
+	s.clear()
+	if s.has("a") {
+		t.Error("expected clear to forget all keys")
+	}
+}
+
+func TestConnectionPoolMetrics(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("png"))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:      time.Hour,
+		UpstreamBases: []string{upstream.URL},
+	})
+
+	newBefore := upstreamConnections.Value("new")
+	reusedBefore := upstreamConnections.Value("reused")
+
+	for _, hash := range []string{"aaa", "bbb", "ccc"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/avatar/"+hash, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", rec.Code)
+		}
+	}
+
+	if got := upstreamConnections.Value("new") - newBefore; got != 1 {
+		t.Errorf("expected 1 new connection, got %v", got)
+	}
+	if got := upstreamConnections.Value("reused") - reusedBefore; got != 2 {
+		t.Errorf("expected 2 reused connections, got %v", got)
+	}
+	if got := activeConns.Load(); got != 0 {
+		t.Errorf("expected no active connections after responses were read, got %d", got)
+	}
+	if got := openConns.Load(); got < 1 {
+		t.Errorf("expected an idle connection to remain open, got %d", got)
+	}
+}
+
+func TestTraceContextPropagatedUpstream(t *testing.T) {
+	var traceparent string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("png"))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:      time.Hour,
+		UpstreamBases: []string{upstream.URL},
+	})
+
+	req := httptest.NewRequest("GET", "/avatar/abc", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if !strings.HasPrefix(traceparent, "00-4bf92f3577b34da6a3ce929d0e0e4736-") || strings.Contains(traceparent, "00f067aa0ba902b7") {
+		t.Errorf("expected upstream request to continue the trace with a new span, got %q", traceparent)
+	}
+}
+
+func TestClassifyUpstreamErrors(t *testing.T) {
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer tlsServer.Close()
+
+	closed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closedURL := closed.URL
+	closed.Close()
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	cases := []struct {
+		url  string
+		want string
+	}{
+		{tlsServer.URL, errorClassTLS},
+		{closedURL, errorClassConnectRefused},
+		{"http://gravatar-proxy-test.invalid", errorClassDNS},
+	}
+	for _, tc := range cases {
+		_, err := client.Get(tc.url)
+		if err == nil {
+			t.Fatalf("%s: expected an error", tc.url)
+		}
+		if got := classifyError(err); got != tc.want {
+			t.Errorf("%s: expected class %s, got %s (%v)", tc.url, tc.want, got, err)
+		}
+	}
+
+	// 对端在握手中途断开时得到的是没有TLS类型的EOF，由上游客户端根据握手回调归为tls
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	upstreamClient, err := newUpstreamClient(&config.Config{}, newBandwidthMeter(0, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = upstreamClient.Get("https://" + ln.Addr().String())
+	if got := classifyError(err); err == nil || got != errorClassTLS {
+		t.Errorf("expected an interrupted handshake to be classified as tls, got %s (%v)", got, err)
+	}
+
+	if got := statusClass(http.StatusForbidden); got != errorClassStatus4xx {
+		t.Errorf("expected status_4xx for 403, got %q", got)
+	}
+	if got := statusClass(http.StatusOK); got != "" {
+		t.Errorf("expected no class for 200, got %q", got)
+	}
+}
+
+func TestUpstreamErrorMetrics(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte("short"))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:      time.Hour,
+		UpstreamBases: []string{upstream.URL},
+	})
+
+	before := upstreamErrors.Value(upstream.URL, errorClassBodyRead)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/avatar/abc", nil))
+	if got := upstreamErrors.Value(upstream.URL, errorClassBodyRead) - before; got != 1 {
+		t.Errorf("expected a body_read error to be counted, got %v", got)
+	}
+}
+
+func TestAdminPurge(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("png"))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:      time.Hour,
+		UpstreamBases: []string{upstream.URL},
+		AdminToken:    "secret",
+	})
+	for _, path := range []string{"/avatar/abc?s=80", "/avatar/abc?s=200", "/avatar/def"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	admin := h.AdminHandler()
+	purge := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/admin/purge?hash=ABC", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := purge("wrong"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a bad token, got %d", rec.Code)
+	}
+
+	rec := purge("secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), `"purged":2`) {
+		t.Errorf("expected both sizes to be purged, got %s", rec.Body.String())
+	}
+	if keys := h.cache.KeysForHash("def"); len(keys) != 1 {
+		t.Errorf("expected other hashes to stay cached, got %v", keys)
+	}
+
+	disabled := newTestHandler(t, &config.Config{CacheTTL: time.Hour})
+	if disabled.AdminHandler() != nil {
+		t.Error("expected admin API to be disabled without a token")
+	}
+}
+
+func TestFallbackLadder(t *testing.T) {
+	var down atomic.Bool
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("fresh"))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:       50 * time.Millisecond,
+		UpstreamBases:  []string{upstream.URL},
+		FallbackLadder: []string{"stale", "placeholder", "502"},
+	})
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/avatar/abc", nil))
+	time.Sleep(100 * time.Millisecond)
+	down.Store(true)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/avatar/abc", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "fresh" {
+		t.Errorf("expected expired entry to be served, got %d %q", rec.Code, rec.Body.String())
+	}
+	if cc := rec.Header().Get("Cache-Control"); cc != "public, max-age=0" {
+		t.Errorf("expected stale response not to be cached downstream, got %q", cc)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/avatar/def", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("expected placeholder without a cached entry, got %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+
+	for _, ladder := range [][]string{{"502", "stale"}, {"stale", "stale"}, {"cdn"}} {
+		c, _ := cache.New(t.TempDir(), time.Hour, 1024*1024)
+		if _, err := NewHandler(&config.Config{UpstreamBases: []string{upstream.URL}, FallbackLadder: ladder}, c); err == nil {
+			t.Errorf("expected ladder %v to be rejected", ladder)
+		}
+	}
+}
+
+func TestAdminDebugKey(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("png"))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:      time.Hour,
+		UpstreamBases: []string{upstream.URL},
+		AdminToken:    "secret",
+	})
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/avatar/abc?s=80", nil))
+
+	debug := func(query string) map[string]any {
+		req := httptest.NewRequest("GET", "/admin/debug/key?"+query, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		h.AdminHandler().ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", rec.Code)
+		}
+		var info map[string]any
+		if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+			t.Fatalf("invalid JSON: %v", err)
+		}
+		return info
+	}
+
+	info := debug("path=/avatar/ABC&s=80")
+	if info["exists"] != true || info["valid"] != true {
+		t.Errorf("expected cached entry to be found, got %v", info)
+	}
+	if remaining, _ := info["ttl_remaining_seconds"].(float64); remaining <= 3500 {
+		t.Errorf("expected about an hour of TTL remaining, got %v", info["ttl_remaining_seconds"])
+	}
+
+	if info := debug("path=/avatar/abc&s=200"); info["exists"] != false {
+		t.Errorf("expected a different size to map to a missing key, got %v", info)
+	}
+}
+
+func TestAdminCacheEntry(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("png"))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:      time.Hour,
+		UpstreamBases: []string{upstream.URL},
+		AdminToken:    "secret",
+	})
+	for i := 0; i < 3; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/avatar/abc", nil))
+	}
+	key := h.cache.GenerateKey("/avatar/abc", map[string]string{})
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		h.AdminHandler().ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("/admin/cache/" + key)
+	var info struct {
+		Valid    bool           `json:"valid"`
+		Metadata cache.Metadata `json:"metadata"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if !info.Valid || info.Metadata.Hits != 2 || info.Metadata.Size != 3 {
+		t.Errorf("expected a valid entry with 2 cache hits, got %+v", info)
+	}
+
+	rec = get("/admin/cache/" + key + "/body")
+	if rec.Body.String() != "png" || rec.Header().Get("X-Cached-Content-Type") != "image/png" {
+		t.Errorf("expected raw cached bytes, got %q", rec.Body.String())
+	}
+
+	// 查看条目不计入命中
+	rec = get("/admin/cache/" + key)
+	json.Unmarshal(rec.Body.Bytes(), &info)
+	if info.Metadata.Hits != 2 {
+		t.Errorf("expected inspection not to count as a hit, got %d", info.Metadata.Hits)
+	}
+
+	if rec := get("/admin/cache/missing"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown key, got %d", rec.Code)
+	}
+}
+
+func TestAdminCacheSearch(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("png"))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:      time.Hour,
+		UpstreamBases: []string{upstream.URL},
+		AdminToken:    "secret",
+	})
+	for _, path := range []string{"/avatar/abc?s=80", "/avatar/abc?s=200&d=mp", "/avatar/def"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	req := httptest.NewRequest("GET", "/admin/cache?hash=abc", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	h.AdminHandler().ServeHTTP(rec, req)
+
+	var result struct {
+		Variants []cacheVariant `json:"variants"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if len(result.Variants) != 2 {
+		t.Fatalf("expected 2 variants, got %+v", result.Variants)
+	}
+	for _, v := range result.Variants {
+		if v.Path != "/avatar/abc" || v.Key != h.cache.GenerateKey(v.Path, v.Params) {
+			t.Errorf("expected stored path and params to reproduce the key, got %+v", v)
+		}
+	}
+}
+
+func TestAdminPurgeForwardedToPeers(t *testing.T) {
+	forwarded := make(chan *http.Request, 1)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded <- r
+	}))
+	defer peer.Close()
+	rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer rejecting.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:   time.Hour,
+		AdminToken: "secret",
+		PurgePeers: []string{peer.URL, rejecting.URL},
+	})
+
+	purge := func(forwardedHeader string) map[string]any {
+		req := httptest.NewRequest("POST", "/admin/purge?hash=abc", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		if forwardedHeader != "" {
+			req.Header.Set(forwardedPurgeHeader, forwardedHeader)
+		}
+		rec := httptest.NewRecorder()
+		h.AdminHandler().ServeHTTP(rec, req)
+		var result map[string]any
+		json.Unmarshal(rec.Body.Bytes(), &result)
+		return result
+	}
+
+	// 只有接受了清除的节点出现在forwarded_to中
+	result := purge("")
+	if got, _ := result["forwarded_to"].([]any); len(got) != 1 || got[0] != peer.URL {
+		t.Errorf("expected only the accepting peer in forwarded_to, got %v", result["forwarded_to"])
+	}
+	select {
+	case r := <-forwarded:
+		if r.URL.Query().Get("hash") != "abc" || r.Header.Get("Authorization") != "Bearer secret" || r.Header.Get(forwardedPurgeHeader) == "" {
+			t.Errorf("unexpected forwarded request %s %v", r.URL, r.Header)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected purge to be forwarded to the peer")
+	}
+
+	if result := purge("1"); result["forwarded_to"] != nil {
+		t.Errorf("expected no forwarded_to for a forwarded purge, got %v", result["forwarded_to"])
+	}
+	select {
+	case <-forwarded:
+		t.Error("expected a forwarded purge not to be forwarded again")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDebugHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("png"))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:        time.Hour,
+		UpstreamBases:   []string{upstream.URL},
+		TrustedNetworks: []string{"192.0.2.0/24"},
+	})
+
+	get := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/avatar/abc", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Proxy-Debug", "1")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("192.0.2.1:1234")
+	key := h.cache.GenerateKey("/avatar/abc", map[string]string{})
+	if got := rec.Header().Get("X-Proxy-Cache-Key"); got != key {
+		t.Errorf("expected cache key %s, got %q", key, got)
+	}
+	if got := rec.Header().Get("X-Proxy-Cache"); got != "miss" {
+		t.Errorf("expected miss, got %q", got)
+	}
+	if rec.Header().Get("X-Proxy-Upstream-Time") == "" {
+		t.Error("expected upstream time on a miss")
+	}
+	if got := rec.Header().Get("Cache-Control"); got != "no-store" {
+		t.Errorf("expected debug response to be uncacheable, got %q", got)
+	}
+
+	rec = get("192.0.2.1:1234")
+	if got := rec.Header().Get("X-Proxy-Cache"); got != "hit" {
+		t.Errorf("expected hit, got %q", got)
+	}
+	if rec.Header().Get("X-Proxy-Cache-Tier") == "" || rec.Header().Get("X-Proxy-Age") == "" {
+		t.Errorf("expected tier and age on a hit, got %v", rec.Header())
+	}
+
+	rec = get("198.51.100.1:1234")
+	if rec.Header().Get("X-Proxy-Cache-Key") != "" || rec.Header().Get("X-Proxy-Cache") != "" {
+		t.Errorf("expected no debug headers for untrusted clients, got %v", rec.Header())
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	var status atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if code := int(status.Load()); code == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "120")
+			w.WriteHeader(code)
+			return
+		}
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:       time.Hour,
+		UpstreamBases:  []string{upstream.URL},
+		FallbackLadder: []string{"502"},
+		RetryAfter:     []string{"upstream=2500ms"},
+	})
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec
+	}
+
+	status.Store(http.StatusServiceUnavailable)
+	if rec := get("/avatar/abc"); rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "3" {
+		t.Errorf("expected 503 with configured Retry-After, got %d %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	status.Store(http.StatusTooManyRequests)
+	if rec := get("/avatar/def"); rec.Header().Get("Retry-After") != "120" {
+		t.Errorf("expected upstream Retry-After to be kept, got %q", rec.Header().Get("Retry-After"))
+	}
+
+	status.Store(http.StatusNotFound)
+	if rec := get("/avatar/ghi"); rec.Header().Get("Retry-After") != "" {
+		t.Errorf("expected no Retry-After on 404, got %q", rec.Header().Get("Retry-After"))
+	}
+
+	for _, pairs := range [][]string{{"upstream"}, {"breaker=1s"}, {"maintenance=-1s"}} {
+		c, _ := cache.New(t.TempDir(), time.Hour, 1024*1024)
+		if _, err := NewHandler(&config.Config{UpstreamBases: []string{upstream.URL}, RetryAfter: pairs}, c); err == nil {
+			t.Errorf("expected retry-after %v to be rejected", pairs)
+		}
+	}
+}
+
+func TestShardRouting(t *testing.T) {
+	var upstreamHits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHits.Add(1)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("png"))
+	}))
+	defer upstream.Close()
+
+	backendHandler := newTestHandler(t, &config.Config{
+		CacheTTL:      time.Hour,
+		UpstreamBases: []string{upstream.URL},
+	})
+	var backendMethods sync.Map
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendMethods.Store(r.Method, true)
+		backendHandler.ServeHTTP(w, r)
+	}))
+	defer backend.Close()
+
+	const self = "http://front.invalid"
+	front := newTestHandler(t, &config.Config{
+		CacheTTL:      time.Hour,
+		UpstreamBases: []string{upstream.URL},
+		ShardPeers:    []string{self, backend.URL},
+		ShardSelf:     self,
+	})
+
+	var remote, local string
+	for i := 0; remote == "" || local == ""; i++ {
+		hash := strconv.Itoa(i)
+		if front.peers.owner(hash) == self {
+			local = hash
+		} else {
+			remote = hash
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		front.ServeHTTP(rec, httptest.NewRequest("GET", "/avatar/"+remote+"?s=80", nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != "png" {
+			t.Fatalf("expected relayed avatar, got %d %q", rec.Code, rec.Body.String())
+		}
+	}
+	if got := upstreamHits.Load(); got != 1 {
+		t.Errorf("expected the owning node to fetch once and then serve from cache, got %d upstream requests", got)
+	}
+	if keys := front.cache.KeysForHash(remote); len(keys) != 0 {
+		t.Errorf("expected front node not to cache a remote hash, got %v", keys)
+	}
+	if keys := backendHandler.cache.KeysForHash(remote); len(keys) != 1 {
+		t.Errorf("expected owning node to cache the avatar, got %v", keys)
+	}
+
+	front.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/avatar/"+local, nil))
+	if keys := front.cache.KeysForHash(local); len(keys) != 1 {
+		t.Errorf("expected front node to cache its own hash, got %v", keys)
+	}
+
+	rec := httptest.NewRecorder()
+	front.ServeHTTP(rec, httptest.NewRequest("HEAD", "/avatar/"+remote+"?s=80", nil))
+	if _, ok := backendMethods.Load("HEAD"); !ok || rec.Code != http.StatusOK {
+		t.Errorf("expected HEAD to be forwarded as HEAD, got %d", rec.Code)
+	}
+
+	// 客户端自带的转发标记不能绕过分片路由
+	spoofed := httptest.NewRequest("GET", "/avatar/"+remote+"?s=40", nil)
+	spoofed.Header.Set(forwardedShardHeader, "1")
+	front.ServeHTTP(httptest.NewRecorder(), spoofed)
+	if keys := front.cache.KeysForHash(remote); len(keys) != 0 {
+		t.Errorf("expected a client-supplied %s header to be ignored, got cached keys %v", forwardedShardHeader, keys)
+	}
+
+	fromPeer := httptest.NewRequest("GET", "/avatar/"+remote+"?s=40", nil)
+	fromPeer.RemoteAddr = "127.0.0.1:4321"
+	fromPeer.Header.Set(forwardedShardHeader, "backend")
+	front.ServeHTTP(httptest.NewRecorder(), fromPeer)
+	if keys := front.cache.KeysForHash(remote); len(keys) != 1 {
+		t.Errorf("expected a request forwarded from a peer address to be served locally, got %v", keys)
+	}
+
+	backend.Close()
+	rec = httptest.NewRecorder()
+	front.ServeHTTP(rec, httptest.NewRequest("GET", "/avatar/"+remote, nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected local fallback when the owner is down, got %d", rec.Code)
+	}
+
+	c, _ := cache.New(t.TempDir(), time.Hour, 1024*1024)
+	if _, err := NewHandler(&config.Config{ShardPeers: []string{backend.URL}, ShardSelf: self}, c); err == nil {
+		t.Error("expected SHARD_SELF outside SHARD_PEERS to be rejected")
+	}
+}
+
+func TestPeerDiscovery(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":"ok","instance":"proxy-1","zone":"eu-west-1b"}`))
+	}))
+	defer healthy.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	srvRecord := func(rawURL string) *net.SRV {
+		u, _ := url.Parse(rawURL)
+		port, _ := strconv.Atoi(u.Port())
+		return &net.SRV{Target: u.Hostname() + ".", Port: uint16(port)}
+	}
+	defer func(orig func(context.Context, string) ([]*net.SRV, error)) { lookupSRV = orig }(lookupSRV)
+	lookupSRV = func(ctx context.Context, name string) ([]*net.SRV, error) {
+		if name != "_http._tcp.proxy.internal" {
+			t.Errorf("unexpected SRV lookup %q", name)
+		}
+		return []*net.SRV{srvRecord(healthy.URL), srvRecord(failing.URL)}, nil
+	}
+
+	const self = "http://self.invalid"
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:         time.Hour,
+		UpstreamBases:    []string{"http://upstream.invalid"},
+		ShardSelf:        self,
+		PeerDiscoverySRV: "_http._tcp.proxy.internal",
+		AdminToken:       "secret",
+		Instance:         config.Identity{Name: "proxy-0", Zone: "eu-west-1a"},
+	})
+	h.peers.refresh(context.Background())
+
+	for _, peer := range h.peers.status() {
+		switch peer.URL {
+		case self:
+			if peer.Instance != "proxy-0" || !peer.Self {
+				t.Errorf("expected self to report its own identity, got %+v", peer)
+			}
+		case healthy.URL:
+			if peer.Instance != "proxy-1" || peer.Zone != "eu-west-1b" || !peer.Healthy {
+				t.Errorf("expected identity from the peer's health check, got %+v", peer)
+			}
+		}
+	}
+
+	if targets := h.purgeTargets(); len(targets) != 2 {
+		t.Errorf("expected both discovered peers to receive purges, got %v", targets)
+	}
+
+	owners := make(map[string]bool)
+	for i := 0; i < 200; i++ {
+		owners[h.peers.owner(strconv.Itoa(i))] = true
+	}
+	if !owners[self] || !owners[healthy.URL] {
+		t.Errorf("expected hashes to be spread over self and the healthy peer, got %v", owners)
+	}
+	if owners[failing.URL] {
+		t.Error("expected unhealthy peer to be left out of the ring")
+	}
+
+	h.peers.markDown(healthy.URL)
+	if owner := h.peers.owner("0"); owner != self {
+		t.Errorf("expected all hashes on self after the only healthy peer went down, got %s", owner)
+	}
+}
+
+func TestStreamingMiss(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("first"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("-second"))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:      time.Hour,
+		UpstreamBases: []string{upstream.URL},
+	})
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/avatar/abc")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// 上游仍在发送时客户端已经能读到开头
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(resp.Body, buf); err != nil || string(buf) != "first" {
+		t.Fatalf("expected first chunk before upstream finished, got %q, %v", buf, err)
+	}
+	close(release)
+	rest, _ := io.ReadAll(resp.Body)
+	if string(rest) != "-second" {
+		t.Errorf("expected rest of body, got %q", rest)
+	}
+
+	key := h.cache.GenerateKey("/avatar/abc", map[string]string{})
+	deadline := time.Now().Add(time.Second)
+	for {
+		if data, err := h.cache.ReadData(key); err == nil {
+			if string(data) != "first-second" {
+				t.Errorf("expected full body cached, got %q", data)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected streamed response to be cached")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStreamingTruncatedNotCached(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte("short"))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:      time.Hour,
+		UpstreamBases: []string{upstream.URL},
+	})
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/avatar/abc", nil))
+
+	key := h.cache.GenerateKey("/avatar/abc", map[string]string{})
+	if _, err := h.cache.GetMetadata(key); err == nil {
+		t.Error("expected truncated upstream body not to be cached")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("png"))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:       time.Hour,
+		UpstreamBases:  []string{upstream.URL},
+		RateLimitRPS:   0.001,
+		RateLimitBurst: 2,
+		TrustedProxies: []string{"10.0.0.0/8"},
+	})
+
+	get := func(remoteAddr, forwardedFor string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/avatar/abc", nil)
+		req.RemoteAddr = remoteAddr
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	limitedBefore := rateLimitRequests.Value("limited")
+	for i := 0; i < 2; i++ {
+		if rec := get("192.0.2.1:1234", ""); rec.Code != http.StatusOK {
+			t.Fatalf("expected request %d within burst to pass, got %d", i+1, rec.Code)
+		}
+	}
+	rec := get("192.0.2.1:1234", "")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "1" {
+		t.Errorf("expected 429 with Retry-After, got %d %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if got := rateLimitRequests.Value("limited") - limitedBefore; got != 1 {
+		t.Errorf("expected 1 limited request counted, got %v", got)
+	}
+
+	// 不受信任的直连地址不能用X-Forwarded-For冒充其他客户端
+	if rec := get("192.0.2.1:1234", "198.51.100.7"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected spoofed X-Forwarded-For to be ignored, got %d", rec.Code)
+	}
+
+	// 经受信任代理转发时按X-Forwarded-For中最右侧的不受信任地址计数
+	for i := 0; i < 2; i++ {
+		if rec := get("10.0.0.1:1234", "203.0.113.9, 198.51.100.7, 10.0.0.2"); rec.Code != http.StatusOK {
+			t.Fatalf("expected forwarded client within burst to pass, got %d", rec.Code)
+		}
+	}
+	if rec := get("10.0.0.3:1234", "198.51.100.7"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected the same client behind another proxy to share its bucket, got %d", rec.Code)
+	}
+}
+
+func TestConcurrentResizeSharesOriginalFetch(t *testing.T) {
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		<-release
+		var buf bytes.Buffer
+		png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 64, 64)))
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(buf.Bytes())
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:         time.Hour,
+		UpstreamBases:    []string{upstream.URL},
+		LocalResize:      true,
+		ResizeSourceSize: 64,
+	})
+
+	sizes := []int{16, 24, 32, 48}
+	widths := make([]int, len(sizes))
+	done := make(chan struct{})
+	for i, size := range sizes {
+		go func(i, size int) {
+			defer func() { done <- struct{}{} }()
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", "/avatar/abc?s="+strconv.Itoa(size), nil))
+			if img, err := png.Decode(rec.Body); err == nil {
+				widths[i] = img.Bounds().Dx()
+			}
+		}(i, size)
+	}
+
+	// 第一个请求到达上游后稍等，让其他尺寸的请求都加入同一次获取
+	deadline := time.Now().Add(2 * time.Second)
+	for fetches.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	for range sizes {
+		<-done
+	}
+
+	if got := fetches.Load(); got != 1 {
+		t.Errorf("expected one upstream fetch for all sizes, got %d", got)
+	}
+	for i, size := range sizes {
+		if widths[i] != size {
+			t.Errorf("expected width %d, got %d", size, widths[i])
+		}
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	var hits int32
+	var upstreamQuery string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		upstreamQuery = r.URL.RawQuery
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("png"))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:      time.Hour,
+		UpstreamBases: []string{upstream.URL},
+		APIKeys:       []string{"blog=secret-1", "forum=secret-2"},
+	})
+
+	get := func(target, header string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		if header != "" {
+			req.Header.Set("X-API-Key", header)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rejectedBefore := apiKeyRejected.Value("missing")
+	if rec := get("/avatar/abc", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without API key, got %d", rec.Code)
+	}
+	if got := apiKeyRejected.Value("missing") - rejectedBefore; got != 1 {
+		t.Errorf("expected 1 missing key rejection counted, got %v", got)
+	}
+	if rec := get("/avatar/abc", "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 with an unknown API key, got %d", rec.Code)
+	}
+
+	if rec := get("/avatar/abc", "secret-1"); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 with API key header, got %d", rec.Code)
+	}
+	if rec := get("/avatar/abc?api_key=secret-1", ""); rec.Code != http.StatusOK || atomic.LoadInt32(&hits) != 1 {
+		t.Errorf("expected api_key parameter to be accepted without changing the cache key, got %d after %d upstream hits", rec.Code, hits)
+	}
+	if rec := get("/avatar/def?s=80&api_key=secret-2", ""); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 with API key parameter, got %d", rec.Code)
+	}
+	if strings.Contains(upstreamQuery, "secret") {
+		t.Errorf("expected API key not to be sent upstream, got query %q", upstreamQuery)
+	}
+
+	stats := h.apiKeyStats()
+	if stats["blog"] != 2 || stats["forum"] != 1 {
+		t.Errorf("expected per-key counts blog=2 forum=1, got %v", stats)
+	}
+
+	if _, err := parseAPIKeys([]string{"secret-without-name"}, nil); err == nil || strings.Contains(err.Error(), "secret") {
+		t.Errorf("expected malformed entry to be rejected without echoing it, got %v", err)
+	}
+}
+
+func TestAdminRevalidate(t *testing.T) {
+	var version atomic.Int32
+	version.Store(1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		etag := `"v` + strconv.Itoa(int(version.Load())) + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(etag))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:      time.Hour,
+		UpstreamBases: []string{upstream.URL},
+		AdminToken:    "secret",
+	})
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/avatar/abc", nil))
+	key := h.cache.GenerateKey("/avatar/abc", map[string]string{})
+
+	revalidate := func(method, key string) (*httptest.ResponseRecorder, map[string]any) {
+		req := httptest.NewRequest(method, "/admin/cache/"+key+"/revalidate", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		h.AdminHandler().ServeHTTP(rec, req)
+		var result map[string]any
+		json.Unmarshal(rec.Body.Bytes(), &result)
+		return rec, result
+	}
+
+	if rec, _ := revalidate("GET", key); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 for GET, got %d", rec.Code)
+	}
+
+	rec, result := revalidate("POST", key)
+	if rec.Code != http.StatusOK || result["result"] != "not_modified" {
+		t.Errorf("expected unchanged avatar to be not_modified, got %d %v", rec.Code, result)
+	}
+
+	// 条目仍在TTL内，刷新后立即返回新头像
+	version.Store(2)
+	rec, result = revalidate("POST", key)
+	if rec.Code != http.StatusOK || result["result"] != "replaced" {
+		t.Errorf("expected changed avatar to be replaced, got %d %v", rec.Code, result)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/avatar/abc", nil))
+	if rec.Body.String() != `"v2"` {
+		t.Errorf("expected the refreshed avatar to be served, got %q", rec.Body.String())
+	}
+
+	if rec, _ := revalidate("POST", "missing"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown key, got %d", rec.Code)
+	}
+
+	// 刷新变体时删除的变体可以立即由新原图重新生成，不留墓碑
+	variantKey := h.cache.GenerateKey("/avatar/abc", map[string]string{"fmt": "image/webp"})
+	variant := cache.Metadata{CreatedAt: time.Now(), StatusCode: http.StatusOK, SourceKey: key, Hash: "abc", Params: map[string]string{"fmt": "image/webp"}}
+	h.cache.Set(variantKey, []byte("webp"), variant)
+	rec, result = revalidate("POST", variantKey)
+	if rec.Code != http.StatusOK || result["source_key"] != key {
+		t.Fatalf("expected the variant's original to be revalidated, got %d %v", rec.Code, result)
+	}
+	if _, exists := h.cache.Peek(variantKey); exists {
+		t.Error("expected the revalidated variant to be removed")
+	}
+	if err := h.cache.Set(variantKey, []byte("webp"), variant); err != nil {
+		t.Errorf("expected the variant to be cacheable again right away, got %v", err)
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	var hits int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("png"))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:      time.Hour,
+		UpstreamBases: []string{upstream.URL},
+		APIKeys:       []string{"blog=secret-1"},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h.StartPrefetch(ctx)
+
+	post := func(apiKey, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/prefetch", strings.NewReader(body))
+		if apiKey != "" {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+		rec := httptest.NewRecorder()
+		h.PrefetchHandler().ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := post("", `{"hashes":["abc"]}`); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without credentials, got %d", rec.Code)
+	}
+
+	rec := post("secret-1", `{"hashes":["abc","DEF",""],"params":{"s":"64"}}`)
+	if rec.Code != http.StatusAccepted || !strings.Contains(rec.Body.String(), `"queued":2`) {
+		t.Fatalf("expected 2 hashes queued, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	key := h.cache.GenerateKey("/avatar/def", map[string]string{"s": "64"})
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, valid := h.cache.Peek(key); valid && atomic.LoadInt32(&hits) == 2 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, valid := h.cache.Peek(key); !valid {
+		t.Fatal("expected prefetched avatar to be cached")
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/avatar/def?s=64&api_key=secret-1", nil))
+	if rec.Code != http.StatusOK || atomic.LoadInt32(&hits) != 2 {
+		t.Errorf("expected a cache hit after prefetch, got %d with %d upstream hits", rec.Code, hits)
+	}
+}
+
+func TestRedirectTargetCache(t *testing.T) {
+	var targetHits int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&targetHits, 1)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("default"))
+	}))
+	defer target.Close()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, r.URL.Query().Get("d"), http.StatusFound)
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:        time.Hour,
+		UpstreamBases:   []string{upstream.URL},
+		FollowRedirects: true,
+	})
+
+	d := url.QueryEscape(target.URL + "/default.png")
+	for _, hash := range []string{"aaa", "bbb", "ccc"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/avatar/"+hash+"?d="+d, nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != "default" {
+			t.Fatalf("expected redirect to be followed for %s, got %d %q", hash, rec.Code, rec.Body.String())
+		}
+		if rec.Header().Get(redirectKeyHeader) != "" {
+			t.Errorf("expected internal redirect header not to reach the client")
+		}
+	}
+	if got := atomic.LoadInt32(&targetHits); got != 1 {
+		t.Errorf("expected the redirect target to be fetched once for all hashes, got %d", got)
+	}
+
+	targetKey := h.redirectKey(target.URL + "/default.png")
+	key := h.cache.GenerateKey("/avatar/bbb", map[string]string{"d": target.URL + "/default.png"})
+	metadata, err := h.cache.GetMetadata(key)
+	if err != nil || metadata.SourceKey != targetKey {
+		t.Errorf("expected avatar entry to point at the redirect target, got %+v, %v", metadata, err)
+	}
+
+	// 关闭跟随时原样返回重定向
+	h = newTestHandler(t, &config.Config{
+		CacheTTL:      time.Hour,
+		UpstreamBases: []string{upstream.URL},
+	})
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/avatar/aaa?d="+d, nil))
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != target.URL+"/default.png" {
+		t.Errorf("expected redirect to be passed through when following is disabled, got %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+}
+
+func TestReload(t *testing.T) {
+	newUpstream := func(body string, hits *atomic.Int32) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits.Add(1)
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte(body))
+		}))
+	}
+	var oldHits, newHits atomic.Int32
+	oldUpstream := newUpstream("old", &oldHits)
+	defer oldUpstream.Close()
+	newUpstreamServer := newUpstream("new", &newHits)
+	defer newUpstreamServer.Close()
+
+	cfg := &config.Config{
+		CacheTTL:       time.Hour,
+		UpstreamBases:  []string{oldUpstream.URL},
+		AllowedOrigins: []string{"a.example"},
+	}
+	h := newTestHandler(t, cfg)
+
+	get := func(path, origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Origin", origin)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := get("/avatar/abc", "https://a.example"); rec.Code != http.StatusOK || rec.Body.String() != "old" {
+		t.Fatalf("expected avatar from the old upstream, got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := get("/avatar/abc", "https://b.example"); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected origin outside the allowed list to be rejected, got %d", rec.Code)
+	}
+
+	reloadsBefore := configReloads.Value()
+	h.Reload(&config.Config{
+		CacheTTL:       time.Nanosecond,
+		UpstreamBases:  []string{newUpstreamServer.URL},
+		AllowedOrigins: []string{"b.example"},
+		RateLimitRPS:   0.001,
+		RateLimitBurst: 2,
+	})
+	if got := configReloads.Value() - reloadsBefore; got != 1 {
+		t.Errorf("expected 1 reload counted, got %v", got)
+	}
+
+	if rec := get("/avatar/abc", "https://a.example"); rec.Code != http.StatusForbidden {
+		t.Errorf("expected removed origin to be rejected after reload, got %d", rec.Code)
+	}
+
+	// 缓存索引保留，但新的有效期使条目过期，应从新的上游重新获取
+	if _, ok := h.cache.Peek(h.cache.GenerateKey("/avatar/abc", h.requestParams(url.Values{}))); ok {
+		t.Error("expected cached entry to expire under the reloaded TTL")
+	}
+	rec := get("/avatar/abc", "https://b.example")
+	if rec.Code != http.StatusOK || rec.Body.String() != "new" || newHits.Load() != 1 {
+		t.Fatalf("expected avatar from the reloaded upstream, got %d %q (%d hits)", rec.Code, rec.Body.String(), newHits.Load())
+	}
+	if rec := get("/avatar/abc", "https://b.example"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected reloaded rate limit to apply, got %d", rec.Code)
+	}
+}
+
+func TestRequestLimits(t *testing.T) {
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("png"))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:      time.Hour,
+		UpstreamBases: []string{upstream.URL},
+		MaxURLLength:  64,
+	})
+
+	urlBefore := requestsRejected.Value("url_too_long")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/avatar/abc?d="+strings.Repeat("x", 64), nil))
+	if rec.Code != http.StatusRequestURITooLong {
+		t.Errorf("expected 414 for a long URL, got %d", rec.Code)
+	}
+	if got := requestsRejected.Value("url_too_long") - urlBefore; got != 1 {
+		t.Errorf("expected 1 url_too_long reject counted, got %v", got)
+	}
+
+	bodyBefore := requestsRejected.Value("body_not_allowed")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/avatar/abc", strings.NewReader("payload")))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413 for a request body, got %d", rec.Code)
+	}
+	if got := requestsRejected.Value("body_not_allowed") - bodyBefore; got != 1 {
+		t.Errorf("expected 1 body_not_allowed reject counted, got %v", got)
+	}
+	if hits.Load() != 0 {
+		t.Errorf("expected rejected requests not to reach upstream, got %d hits", hits.Load())
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/avatar/abc?s=80", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected a short URL to pass, got %d", rec.Code)
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:       time.Hour,
+		UpstreamBases:  []string{"http://127.0.0.1:0"},
+		AllowedOrigins: []string{"example.com"},
+		CORSMaxAge:     10 * time.Minute,
+		APIKeys:        []string{"app=secret"},
+	})
+
+	preflight := func(handler http.HandlerFunc, path, origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodOptions, path, nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "GET")
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+
+	rec := preflight(h.ServeHTTP, "/avatar/abc", "https://www.example.com")
+	if rec.Code != http.StatusOK || rec.Header().Get("Access-Control-Allow-Methods") != avatarCORS.methods {
+		t.Errorf("expected avatar preflight to succeed with avatar methods, got %d %q", rec.Code, rec.Header().Get("Access-Control-Allow-Methods"))
+	}
+	if rec.Header().Get("Access-Control-Max-Age") != "600" || rec.Header().Get("Vary") != "Origin" {
+		t.Errorf("expected cacheable preflight varying on Origin, got max-age %q, vary %q", rec.Header().Get("Access-Control-Max-Age"), rec.Header().Get("Vary"))
+	}
+	if rec := preflight(h.ServeHTTP, "/avatar/", "https://www.example.com"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected preflight without a hash to return 404, got %d", rec.Code)
+	}
+	rec = preflight(h.ServeHTTP, "/avatar/abc", "https://evil.test")
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected preflight from a foreign origin to be rejected, got %d", rec.Code)
+	}
+	// 拒绝的响应同样取决于Origin
+	if rec.Header().Get("Vary") != "Origin" {
+		t.Errorf("expected rejected preflight to vary on Origin, got %q", rec.Header().Get("Vary"))
+	}
+
+	prefetch := h.PrefetchHandler().ServeHTTP
+	rec = preflight(prefetch, "/prefetch", "https://example.com")
+	if rec.Code != http.StatusOK || rec.Header().Get("Access-Control-Allow-Methods") != prefetchCORS.methods {
+		t.Errorf("expected prefetch preflight to succeed with prefetch methods, got %d %q", rec.Code, rec.Header().Get("Access-Control-Allow-Methods"))
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/prefetch", strings.NewReader(`{"hashes":[]}`))
+	req.Header.Set(apiKeyHeader, "secret")
+	req.Header.Set("Origin", "https://evil.test")
+	rec = httptest.NewRecorder()
+	prefetch(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected prefetch from a foreign origin to be rejected, got %d", rec.Code)
+	}
+
+	// Access-Control-Max-Age只对预检响应有意义
+	req = httptest.NewRequest(http.MethodPost, "/prefetch", strings.NewReader(`{"hashes":[]}`))
+	req.Header.Set(apiKeyHeader, "secret")
+	req.Header.Set("Origin", "https://example.com")
+	rec = httptest.NewRecorder()
+	prefetch(rec, req)
+	if rec.Header().Get("Access-Control-Allow-Origin") != "https://example.com" || rec.Header().Get("Access-Control-Max-Age") != "" {
+		t.Errorf("expected CORS headers without max-age on a non-preflight request, got %v", rec.Header())
+	}
+}
+
+func TestStreamingOverHTTP2(t *testing.T) {
+	// 大于HTTP/2默认流控窗口（64KB），流式写出必须等待客户端的WINDOW_UPDATE
+	body := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(body)
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:      time.Hour,
+		UpstreamBases: []string{upstream.URL},
+	})
+
+	tlsServer := httptest.NewUnstartedServer(h)
+	tlsServer.EnableHTTP2 = true
+	tlsServer.StartTLS()
+	defer tlsServer.Close()
+
+	h2cProtocols := new(http.Protocols)
+	h2cProtocols.SetUnencryptedHTTP2(true)
+	h2cServer := httptest.NewUnstartedServer(h)
+	h2cServer.Config.Protocols = h2cProtocols
+	h2cServer.Start()
+	defer h2cServer.Close()
+
+	tests := []struct {
+		name   string
+		client *http.Client
+		url    string
+		hash   string
+	}{
+		{"tls", tlsServer.Client(), tlsServer.URL, "aaa"},
+		{"h2c", &http.Client{Transport: &http.Transport{Protocols: h2cProtocols}}, h2cServer.URL, "bbb"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 第一次请求走上游流式写出，第二次从缓存读取
+			for i := 0; i < 2; i++ {
+				resp, err := tt.client.Get(tt.url + "/avatar/" + tt.hash)
+				if err != nil {
+					t.Fatalf("request failed: %v", err)
+				}
+				got, err := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if err != nil {
+					t.Fatalf("failed to read body: %v", err)
+				}
+				if resp.ProtoMajor != 2 {
+					t.Fatalf("expected HTTP/2, got %s", resp.Proto)
+				}
+				if !bytes.Equal(got, body) {
+					t.Fatalf("request %d: expected %d bytes intact, got %d", i+1, len(body), len(got))
+				}
+			}
+		})
+	}
+}
+
+func TestConflictingQueryParams(t *testing.T) {
+	var requested []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.URL.RawQuery)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("png"))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:      time.Hour,
+		UpstreamBases: []string{upstream.URL},
+	})
+
+	get := func(query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/avatar/abc?"+query, nil))
+		return rec
+	}
+
+	before := requestsRejected.Value("conflicting_param")
+	rec := get("s=80&s=512")
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "parameter s") {
+		t.Errorf("expected 400 naming s for conflicting sizes, got %d %q", rec.Code, rec.Body.String())
+	}
+	if got := requestsRejected.Value("conflicting_param") - before; got != 1 {
+		t.Errorf("expected 1 conflicting_param reject counted, got %v", got)
+	}
+	if len(requested) != 0 {
+		t.Errorf("expected rejected request not to reach upstream, got %v", requested)
+	}
+
+	// 取值相同的重复参数与单个参数共用同一个缓存条目
+	if rec := get("s=80&s=80"); rec.Code != http.StatusOK {
+		t.Fatalf("expected identical duplicates to be accepted, got %d", rec.Code)
+	}
+	if rec := get("s=80"); rec.Code != http.StatusOK {
+		t.Fatalf("expected single parameter to be accepted, got %d", rec.Code)
+	}
+	if len(requested) != 1 || requested[0] != "s=80" {
+		t.Errorf("expected one upstream fetch with s=80, got %v", requested)
+	}
+
+	// 不参与缓存键的参数可以重复
+	if rec := get("s=80&utm=a&utm=b"); rec.Code != http.StatusOK {
+		t.Errorf("expected repeated unrelated parameters to be ignored, got %d", rec.Code)
+	}
+}
+
+func TestUpstreamAccept(t *testing.T) {
+	var accepts []string
+	var mu sync.Mutex
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		accepts = append(accepts, r.URL.Path+" "+r.Header.Get("Accept"))
+		mu.Unlock()
+		if r.URL.Path == "/avatar/bbb" {
+			http.Redirect(w, r, "/default.png", http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("png"))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:        time.Hour,
+		UpstreamBases:   []string{upstream.URL},
+		FollowRedirects: true,
+	})
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/avatar/aaa", nil))
+
+	custom := newTestHandler(t, &config.Config{
+		CacheTTL:        time.Hour,
+		UpstreamBases:   []string{upstream.URL},
+		FollowRedirects: true,
+		UpstreamAccept:  "image/webp, image/png;q=0.5",
+	})
+	custom.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/avatar/bbb", nil))
+
+	want := []string{
+		"/avatar/aaa " + config.DefaultUpstreamAccept,
+		"/avatar/bbb image/webp, image/png;q=0.5",
+		"/default.png image/webp, image/png;q=0.5",
+	}
+	if strings.Join(accepts, "\n") != strings.Join(want, "\n") {
+		t.Errorf("unexpected upstream Accept headers:\n%s\nwant:\n%s", strings.Join(accepts, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestUpstreamTimeouts(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		if r.URL.Path == "/avatar/slowheader" {
+			<-release
+			return
+		}
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:              time.Hour,
+		UpstreamBases:         []string{upstream.URL},
+		UpstreamHeaderTimeout: 50 * time.Millisecond,
+		UpstreamBodyTimeout:   100 * time.Millisecond,
+	})
+
+	timeoutsBefore := upstreamErrors.Value(upstream.URL, errorClassTimeout)
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/avatar/slowheader", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("expected 502 when response headers time out, got %d", rec.Code)
+	}
+	if got := upstreamErrors.Value(upstream.URL, errorClassTimeout) - timeoutsBefore; got != 1 {
+		t.Errorf("expected 1 timeout counted, got %v", got)
+	}
+
+	// 响应头及时到达后，响应体按单独的超时读取
+	bodyBefore := upstreamErrors.Value(upstream.URL, errorClassBodyRead)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/avatar/slowbody", nil))
+	if got := upstreamErrors.Value(upstream.URL, errorClassBodyRead) - bodyBefore; got != 1 {
+		t.Errorf("expected 1 body_read error counted, got %v", got)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected timeouts to cut requests short, took %v", elapsed)
+	}
+
+	resp, err := h.client.Get(upstream.URL + "/avatar/slowbody")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	_, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !errors.Is(err, errBodyTimeout) || classifyError(err) != errorClassTimeout {
+		t.Errorf("expected body read to fail with a timeout, got %v", err)
+	}
+
+	// UPSTREAM_TIMEOUT限制整个请求，即使分阶段的超时都还没有到
+	h = newTestHandler(t, &config.Config{
+		CacheTTL:        time.Hour,
+		UpstreamBases:   []string{upstream.URL},
+		UpstreamTimeout: 50 * time.Millisecond,
+	})
+	timeoutsBefore = upstreamErrors.Value(upstream.URL, errorClassTimeout)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/avatar/slowheader", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("expected 502 when the overall upstream timeout passes, got %d", rec.Code)
+	}
+	if got := upstreamErrors.Value(upstream.URL, errorClassTimeout) - timeoutsBefore; got != 1 {
+		t.Errorf("expected 1 timeout counted for the overall timeout, got %v", got)
+	}
+}
+
+func TestUpstreamHeaderLimit(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("X-Padding", strings.Repeat("x", 2048))
+		w.Write([]byte("png"))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:               time.Hour,
+		UpstreamBases:          []string{upstream.URL},
+		UpstreamMaxHeaderBytes: 1024,
+	})
+
+	before := upstreamErrors.Value(upstream.URL, errorClassHeaderTooLarge)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/avatar/abc", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("expected 502 for oversized upstream headers, got %d", rec.Code)
+	}
+	if got := upstreamErrors.Value(upstream.URL, errorClassHeaderTooLarge) - before; got != 1 {
+		t.Errorf("expected 1 header_too_large error counted, got %v", got)
+	}
+	if _, err := h.cache.GetMetadata(h.cache.GenerateKey("/avatar/abc", map[string]string{})); err == nil {
+		t.Error("expected response with oversized headers not to be cached")
+	}
+}
+
+func TestSuspectEntry(t *testing.T) {
+	var hits, failing atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := hits.Add(1)
+		if failing.Load() == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("v" + strconv.Itoa(int(n))))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:             50 * time.Millisecond,
+		UpstreamBases:        []string{upstream.URL},
+		StaleWhileRevalidate: time.Hour,
+		SuspectAfterFailures: 2,
+		FallbackLadder:       []string{"stale"},
+	})
+	key := h.cache.GenerateKey("/avatar/abc", map[string]string{})
+
+	get := func() string {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/avatar/abc", nil))
+		return rec.Body.String()
+	}
+	waitFailures := func(n int) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			_, running := h.revalidating.Load(key)
+			if meta, err := h.cache.GetMetadata(key); err == nil && meta.RevalidationFailures == n && !running {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("expected %d recorded revalidation failures", n)
+	}
+
+	if body := get(); body != "v1" {
+		t.Fatalf("expected v1 on first fetch, got %q", body)
+	}
+	time.Sleep(100 * time.Millisecond)
+	failing.Store(1)
+
+	// 未达到阈值前照常先返回过期内容，失败的后台验证被计数
+	for i := 1; i <= 2; i++ {
+		if body := get(); body != "v1" {
+			t.Fatalf("expected stale v1 while revalidating, got %q", body)
+		}
+		waitFailures(i)
+	}
+	if stats := h.cache.Stats(); stats.Suspect != 1 {
+		t.Errorf("expected 1 suspect entry in stats, got %d", stats.Suspect)
+	}
+
+	// 可疑条目同步重新获取，上游仍失败时才按降级返回过期内容
+	before := hits.Load()
+	if body := get(); body != "v1" {
+		t.Errorf("expected stale v1 from the fallback ladder, got %q", body)
+	}
+	if hits.Load() != before+1 {
+		t.Error("expected suspect entry to be refetched before responding")
+	}
+
+	failing.Store(0)
+	if body := get(); body != "v"+strconv.Itoa(int(before+2)) {
+		t.Errorf("expected fresh response once upstream recovers, got %q", body)
+	}
+	if stats := h.cache.Stats(); stats.Suspect != 0 {
+		t.Errorf("expected no suspect entries after refresh, got %d", stats.Suspect)
+	}
+}
+
+func TestUpstreamVaryStripped(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Add("Vary", "Accept-Encoding")
+		w.Header().Add("Vary", "User-Agent")
+		w.Write([]byte("png"))
+	}))
+	defer upstream.Close()
+
+	for _, tc := range []struct {
+		name      string
+		transcode []string
+		want      []string
+	}{
+		{"plain", nil, nil},
+		{"transcoding", []string{"webp"}, []string{"Accept"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestHandler(t, &config.Config{
+				CacheTTL:         time.Hour,
+				UpstreamBases:    []string{upstream.URL},
+				TranscodeFormats: tc.transcode,
+			})
+			before := upstreamVaryStripped.Value(upstream.URL)
+
+			// 未命中时流式返回，命中时从缓存返回，两者都不带上游的Vary
+			for _, result := range []string{"miss", "hit"} {
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, httptest.NewRequest("GET", "/avatar/abc", nil))
+				if rec.Code != http.StatusOK {
+					t.Fatalf("%s: expected 200, got %d", result, rec.Code)
+				}
+				if got := rec.Header().Values("Vary"); strings.Join(got, ",") != strings.Join(tc.want, ",") {
+					t.Errorf("%s: expected Vary %v, got %v", result, tc.want, got)
+				}
+			}
+			if got := upstreamVaryStripped.Value(upstream.URL); got != before+1 {
+				t.Errorf("expected one stripped Vary header, got %v", got-before)
+			}
+		})
+	}
+}
+
+func TestPassthroughParams(t *testing.T) {
+	var mu sync.Mutex
+	var queries []url.Values
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		queries = append(queries, r.URL.Query())
+		mu.Unlock()
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("png"))
+	}))
+	defer upstream.Close()
+
+	get := func(h *Handler, query string) int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/avatar/abc?"+query, nil))
+		return rec.Code
+	}
+	last := func() url.Values {
+		mu.Lock()
+		defer mu.Unlock()
+		return queries[len(queries)-1]
+	}
+
+	h := newTestHandler(t, &config.Config{CacheTTL: time.Hour, UpstreamBases: []string{upstream.URL}})
+	get(h, "s=80&x=1")
+	if q := last(); q.Has("x") || q.Get("s") != "80" {
+		t.Errorf("expected unknown params to be dropped by default, upstream got %v", q)
+	}
+
+	h = newTestHandler(t, &config.Config{
+		CacheTTL:          time.Hour,
+		UpstreamBases:     []string{upstream.URL},
+		PassthroughParams: []string{"x"},
+	})
+	get(h, "s=80&x=1&y=2")
+	if q := last(); q.Get("x") != "1" || q.Has("y") {
+		t.Errorf("expected only x to be passed through, upstream got %v", q)
+	}
+	before := len(queries)
+	get(h, "s=80&x=1&y=3")
+	get(h, "s=80&x=2")
+	if got := len(queries) - before; got != 1 {
+		t.Errorf("expected passed-through params to be part of the cache key, got %d upstream requests", got)
+	}
+	if code := get(h, "x=1&x=2"); code != http.StatusBadRequest {
+		t.Errorf("expected conflicting passed-through param to be rejected, got %d", code)
+	}
+
+	h = newTestHandler(t, &config.Config{
+		CacheTTL:          time.Hour,
+		UpstreamBases:     []string{upstream.URL},
+		PassthroughParams: []string{"*"},
+	})
+	get(h, "y=2&api_key=secret")
+	if q := last(); q.Get("y") != "2" || q.Has("api_key") {
+		t.Errorf("expected all unknown params except api_key to be passed through, upstream got %v", q)
+	}
+}
+
+// lockedBuffer 是可并发写入的bytes.Buffer
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func TestAuditLog(t *testing.T) {
+	var audit lockedBuffer
+	log.Configure(log.Options{Format: log.FormatJSON, AuditLog: &audit})
+	defer log.Configure(log.Options{Format: log.FormatJSON})
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("png"))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:       time.Hour,
+		UpstreamBases:  []string{upstream.URL},
+		AllowedOrigins: []string{"good.example"},
+		RateLimitRPS:   0.001,
+		RateLimitBurst: 3,
+	})
+
+	send := func(path, origin string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = "192.0.2.7:1234"
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Referer", origin+"/page")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := send("/avatar/abc", "https://good.example"); code != http.StatusOK {
+		t.Fatalf("expected allowed request to succeed, got %d", code)
+	}
+	if code := send("/avatar/abc?api_key=secret", "https://evil.example"); code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a foreign origin, got %d", code)
+	}
+	if code := send("/avatar/", "https://good.example"); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an empty hash, got %d", code)
+	}
+	if code := send("/avatar/abc", "https://good.example"); code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 once the burst is used, got %d", code)
+	}
+
+	audit.mu.Lock()
+	lines := strings.Split(strings.TrimSpace(audit.buf.String()), "\n")
+	audit.mu.Unlock()
+	if strings.Contains(strings.Join(lines, ""), "secret") {
+		t.Error("expected query strings to be left out of the audit log")
+	}
+	wantReasons := []string{"origin_denied", "invalid_hash", "rate_limited"}
+	if len(lines) != len(wantReasons) {
+		t.Fatalf("expected %d audit records, got %d: %q", len(wantReasons), len(lines), lines)
+	}
+	for i, line := range lines {
+		var rec map[string]any
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("expected JSON audit record, got %q", line)
+		}
+		if rec["log"] != "audit" || rec["reason"] != wantReasons[i] {
+			t.Errorf("expected audit record with reason %s, got %v", wantReasons[i], rec)
+		}
+		if rec["client_ip"] != "192.0.2.7" || rec["origin"] == "" || rec["referer"] == "" {
+			t.Errorf("expected client IP, origin and referer in audit record, got %v", rec)
+		}
+	}
+}
+
+func TestGRPCAdmin(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("png"))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:      time.Hour,
+		UpstreamBases: []string{upstream.URL},
+		AdminToken:    "secret",
+	})
+	for _, path := range []string{"/avatar/abc?s=80", "/avatar/abc?s=200", "/avatar/def"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h.StartPrefetch(ctx)
+
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	srv := httptest.NewUnstartedServer(h.GRPCHandler())
+	srv.Config.Protocols = protocols
+	srv.Start()
+	defer srv.Close()
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+
+	call := func(method, token string, msg *rpc.Message) (string, []byte) {
+		t.Helper()
+		frame := make([]byte, 5, 5+len(msg.Bytes()))
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(msg.Bytes())))
+		req, _ := http.NewRequest("POST", srv.URL+"/"+grpcService+"/"+method, bytes.NewReader(append(frame, msg.Bytes()...)))
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s failed: %v", method, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if status := resp.Header.Get("Grpc-Status"); status != "" {
+			return status, nil
+		}
+		if len(body) < 5 {
+			t.Fatalf("%s returned no message", method)
+		}
+		return resp.Trailer.Get("Grpc-Status"), body[5:]
+	}
+	ints := func(msg []byte) map[int]int64 {
+		fields := make(map[int]int64)
+		rpc.Decode(msg, func(f rpc.Field) error {
+			fields[f.Num] = f.Int()
+			return nil
+		})
+		return fields
+	}
+
+	if status, _ := call("Stats", "wrong", &rpc.Message{}); status != "16" {
+		t.Fatalf("expected UNAUTHENTICATED for a bad token, got %q", status)
+	}
+
+	status, resp := call("Stats", "secret", &rpc.Message{})
+	if status != "0" || ints(resp)[1] != 3 {
+		t.Errorf("expected 3 entries in stats, got status %q, %v", status, ints(resp))
+	}
+
+	var inspect rpc.Message
+	inspect.String(2, "ABC")
+	status, resp = call("Inspect", "secret", &inspect)
+	var sizes []string
+	rpc.Decode(resp, func(f rpc.Field) error {
+		return rpc.Decode(f.Bytes(), func(f rpc.Field) error {
+			if f.Num == 3 {
+				_, v, err := rpc.DecodeMapEntry(f.Bytes())
+				sizes = append(sizes, v)
+				return err
+			}
+			return nil
+		})
+	})
+	if status != "0" || len(sizes) != 2 {
+		t.Errorf("expected both cached sizes of abc, got status %q, %v", status, sizes)
+	}
+
+	var missing rpc.Message
+	missing.String(1, "no-such-key")
+	if status, _ := call("Inspect", "secret", &missing); status != "5" {
+		t.Errorf("expected NOT_FOUND for a missing key, got %q", status)
+	}
+
+	var purge rpc.Message
+	purge.String(1, "abc")
+	status, resp = call("Purge", "secret", &purge)
+	if status != "0" || ints(resp)[1] != 2 {
+		t.Errorf("expected 2 entries purged, got status %q, %v", status, ints(resp))
+	}
+	if keys := h.cache.KeysForHash("def"); len(keys) != 1 {
+		t.Errorf("expected other hashes to stay cached, got %v", keys)
+	}
+
+	var warm rpc.Message
+	warm.Strings(1, []string{"ghi", ""})
+	warm.Map(2, map[string]string{"s": "64"})
+	status, resp = call("Warm", "secret", &warm)
+	if status != "0" || ints(resp)[1] != 1 || ints(resp)[3] != 1 {
+		t.Errorf("expected 1 queued and 1 invalid, got status %q, %v", status, ints(resp))
+	}
+	key := h.cache.GenerateKey("/avatar/ghi", map[string]string{"s": "64"})
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, valid := h.cache.Peek(key); valid {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, valid := h.cache.Peek(key); !valid {
+		t.Error("expected warmed avatar to be cached")
+	}
+
+	if disabled := newTestHandler(t, &config.Config{CacheTTL: time.Hour}); disabled.GRPCHandler() != nil {
+		t.Error("expected no gRPC handler without ADMIN_TOKEN")
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	var upstreamStatus atomic.Int32
+	var probes atomic.Int32
+	upstreamStatus.Store(http.StatusServiceUnavailable)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probes.Add(1)
+		if r.Method != http.MethodHead || r.URL.Query().Get("d") != "404" {
+			t.Errorf("expected a HEAD probe with d=404, got %s %s", r.Method, r.URL)
+		}
+		w.WriteHeader(int(upstreamStatus.Load()))
+	}))
+	defer upstream.Close()
+
+	dir := t.TempDir()
+	c, err := cache.New(dir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	h, err := NewHandler(&config.Config{
+		CacheTTL:           time.Hour,
+		UpstreamBases:      []string{upstream.URL},
+		ReadyCheckUpstream: true,
+	}, c)
+	if err != nil {
+		t.Fatalf("failed to create handler: %v", err)
+	}
+	h.readyInterval = 0
+
+	ready := func() (int, map[string]string) {
+		rec := httptest.NewRecorder()
+		h.ReadyHandler(rec, httptest.NewRequest("GET", "/readyz", nil))
+		var body struct {
+			Checks map[string]string `json:"checks"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		return rec.Code, body.Checks
+	}
+
+	if code, checks := ready(); code != http.StatusServiceUnavailable || checks["cache"] != "ok" || checks["upstream"] == "ok" {
+		t.Errorf("expected 503 while upstream fails, got %d %v", code, checks)
+	}
+
+	upstreamStatus.Store(http.StatusNotFound)
+	if code, checks := ready(); code != http.StatusOK || checks["upstream"] != "ok" {
+		t.Errorf("expected 200 once upstream answers, got %d %v", code, checks)
+	}
+
+	// 复用间隔内的探测共用上一次的结果，不再探测上游
+	h.readyInterval = time.Hour
+	before := probes.Load()
+	upstreamStatus.Store(http.StatusServiceUnavailable)
+	for range 3 {
+		if code, _ := ready(); code != http.StatusOK {
+			t.Errorf("expected the cached result within the interval, got %d", code)
+		}
+	}
+	if n := probes.Load() - before; n != 0 {
+		t.Errorf("expected no upstream probes within the interval, got %d", n)
+	}
+	h.readyInterval = 0
+	upstreamStatus.Store(http.StatusNotFound)
+
+	os.RemoveAll(dir)
+	if code, checks := ready(); code != http.StatusServiceUnavailable || checks["cache"] == "ok" {
+		t.Errorf("expected 503 with an unwritable cache directory, got %d %v", code, checks)
+	}
+
+	rec := httptest.NewRecorder()
+	h.HealthHandler(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected liveness to stay 200, got %d", rec.Code)
+	}
+}
+
+func TestHealthDiagnostics(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("png"))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:        time.Hour,
+		UpstreamBases:   []string{upstream.URL},
+		AdminToken:      "secret",
+		TrustedNetworks: []string{"10.0.0.0/8"},
+	})
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/avatar/abc", nil))
+
+	health := func(query, remoteAddr, token string) map[string]any {
+		req := httptest.NewRequest("GET", "/healthz"+query, nil)
+		req.RemoteAddr = remoteAddr
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		h.HealthHandler(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", rec.Code)
+		}
+		var body map[string]any
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		return body
+	}
+
+	for _, tc := range []struct{ query, remoteAddr, token string }{
+		{"", "10.0.0.1:1234", "secret"},
+		{"?verbose=1", "192.0.2.1:1234", ""},
+		{"?verbose=1", "192.0.2.1:1234", "wrong"},
+	} {
+		if body := health(tc.query, tc.remoteAddr, tc.token); body["diagnostics"] != nil {
+			t.Errorf("expected no diagnostics for %+v, got %v", tc, body["diagnostics"])
+		}
+	}
+
+	for _, tc := range []struct{ remoteAddr, token string }{
+		{"10.0.0.1:1234", ""},
+		{"192.0.2.1:1234", "secret"},
+	} {
+		body := health("?verbose=1", tc.remoteAddr, tc.token)
+		diagnostics, ok := body["diagnostics"].(map[string]any)
+		if !ok || body["status"] != "ok" {
+			t.Fatalf("expected diagnostics for %+v, got %v", tc, body)
+		}
+		if diagnostics["cache_entries"] != float64(1) || diagnostics["cache_bytes"] != float64(3) {
+			t.Errorf("expected one 3-byte cache entry, got %v", diagnostics)
+		}
+		if diagnostics["version"] == "" || diagnostics["go_version"] == "" || diagnostics["last_upstream_success"] == nil {
+			t.Errorf("expected version, Go version and last upstream success, got %v", diagnostics)
+		}
+	}
+}
+
+func TestAPIKeyTiers(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 16, 16)))
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(buf.Bytes())
+	}))
+	defer upstream.Close()
+
+	no := false
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:         time.Hour,
+		UpstreamBases:    []string{upstream.URL},
+		TranscodeFormats: []string{"webp"},
+		APIKeys:          []string{"blog=free-key", "partner=partner-key"},
+		APIKeyTiers: map[string]config.APIKeyTier{
+			"free": {
+				Keys:            []string{"blog"},
+				RateLimitRPS:    0.001,
+				RateLimitBurst:  2,
+				MaxSize:         200,
+				Batch:           &no,
+				Transformations: &no,
+			},
+		},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h.StartPrefetch(ctx)
+
+	get := func(path, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("X-API-Key", key)
+		req.Header.Set("Accept", "image/webp,*/*")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := get("/avatar/abc?s=512", "free-key"); rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403 above the tier's max size, got %d", rec.Code)
+	}
+	get("/avatar/abc?s=64", "partner-key")
+	if rec := get("/avatar/abc?s=64", "partner-key"); rec.Header().Get("Content-Type") != "image/webp" {
+		t.Errorf("expected untiered key to get transcoded avatar, got %q", rec.Header().Get("Content-Type"))
+	}
+	if rec := get("/avatar/abc?s=64", "free-key"); rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("expected tier without transformations to get the original, got %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if rec := get("/avatar/abc?s=64", "free-key"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected 429 once the tier's burst is used up, got %d", rec.Code)
+	}
+	if rec := get("/avatar/abc?s=64", "partner-key"); rec.Code != http.StatusOK {
+		t.Errorf("expected other keys to be unaffected by the tier limit, got %d", rec.Code)
+	}
+
+	prefetch := func(key string) int {
+		req := httptest.NewRequest("POST", "/prefetch", strings.NewReader(`{"hashes":["def"]}`))
+		req.Header.Set("X-API-Key", key)
+		rec := httptest.NewRecorder()
+		h.PrefetchHandler().ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := prefetch("free-key"); code != http.StatusForbidden {
+		t.Errorf("expected tier without batch to be refused prefetch, got %d", code)
+	}
+	if code := prefetch("partner-key"); code != http.StatusAccepted {
+		t.Errorf("expected untiered key to prefetch, got %d", code)
+	}
+
+	if got := apiKeyTierRejected.Value("free", "rate_limited"); got < 1 {
+		t.Errorf("expected rate-limited tier rejection to be counted, got %v", got)
+	}
+
+	_, err := parseAPIKeys([]string{"blog=k"}, map[string]config.APIKeyTier{"free": {Keys: []string{"unknown"}}})
+	if err == nil {
+		t.Error("expected tier listing an unknown key name to be rejected")
+	}
+}
+
+func TestAdminJWT(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	b64 := base64.RawURLEncoding.EncodeToString
+	var issuer *httptest.Server
+	issuer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"issuer": issuer.URL, "jwks_uri": issuer.URL + "/keys"})
+		case "/keys":
+			json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{"kty": "OKP", "crv": "Ed25519", "kid": "k1", "x": b64(pub)}}})
+		}
+	}))
+	defer issuer.Close()
+
+	token := func(roles ...string) string {
+		header, _ := json.Marshal(map[string]string{"alg": "EdDSA", "kid": "k1"})
+		payload, _ := json.Marshal(map[string]any{
+			"iss":          issuer.URL,
+			"aud":          "gravatar-proxy",
+			"sub":          "ops@example.com",
+			"exp":          time.Now().Add(time.Hour).Unix(),
+			"realm_access": map[string]any{"roles": roles},
+		})
+		signed := b64(header) + "." + b64(payload)
+		return signed + "." + b64(ed25519.Sign(priv, []byte(signed)))
+	}
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:          time.Hour,
+		AdminJWTIssuer:    issuer.URL,
+		AdminJWTAudience:  "gravatar-proxy",
+		AdminJWTRoleClaim: "realm_access.roles",
+		AdminJWTRoles:     []string{"cache-admin"},
+	})
+	admin := h.AdminHandler()
+	if admin == nil {
+		t.Fatal("expected admin API to be enabled with only ADMIN_JWT_ISSUER")
+	}
+	stats := func(bearer string) int {
+		req := httptest.NewRequest("GET", "/admin/stats", nil)
+		req.Header.Set("Authorization", "Bearer "+bearer)
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := stats(token("viewer", "cache-admin")); code != http.StatusOK {
+		t.Errorf("expected 200 for a token with the required role, got %d", code)
+	}
+	if code := stats(token("viewer")); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a token without the required role, got %d", code)
+	}
+	if code := stats(token("cache-admin") + "x"); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a token with a bad signature, got %d", code)
+	}
+
+	// 同时配置ADMIN_TOKEN时两种凭据都可用
+	h.adminToken = "secret"
+	if code := stats("secret"); code != http.StatusOK {
+		t.Errorf("expected static token to keep working, got %d", code)
+	}
+	if code := stats(token("cache-admin")); code != http.StatusOK {
+		t.Errorf("expected JWT to keep working alongside the static token, got %d", code)
+	}
+}
+
+func TestAdminBasicAuthAndClientCerts(t *testing.T) {
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:           time.Hour,
+		AdminBasicUser:     "ops",
+		AdminBasicPassword: "hunter2",
+		AdminClientCAFile:  "ca.pem",
+	})
+	admin := h.AdminHandler()
+	if admin == nil {
+		t.Fatal("expected admin API to be enabled with only basic auth and client certificates")
+	}
+	stats := func(setup func(*http.Request)) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/admin/stats", nil)
+		setup(req)
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := stats(func(r *http.Request) { r.SetBasicAuth("ops", "hunter2") }); rec.Code != http.StatusOK {
+		t.Errorf("expected 200 with basic auth, got %d", rec.Code)
+	}
+	rec := stats(func(r *http.Request) { r.SetBasicAuth("ops", "wrong") })
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a wrong password, got %d", rec.Code)
+	}
+	if challenges := rec.Header().Values("WWW-Authenticate"); len(challenges) != 2 || challenges[1] != `Basic realm="admin"` {
+		t.Errorf("expected a basic auth challenge, got %v", challenges)
+	}
+
+	// 只有TLS握手中验证通过的证书才算数
+	if rec := stats(func(r *http.Request) {
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "ops"}}}}}
+	}); rec.Code != http.StatusOK {
+		t.Errorf("expected 200 with a verified client certificate, got %d", rec.Code)
+	}
+	if rec := stats(func(r *http.Request) {
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{}}}
+	}); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for an unverified client certificate, got %d", rec.Code)
+	}
+
+	disabled := newTestHandler(t, &config.Config{CacheTTL: time.Hour, AdminToken: "secret"})
+	req := httptest.NewRequest("GET", "/admin/stats", nil)
+	req.SetBasicAuth("ops", "hunter2")
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}
+	rec = httptest.NewRecorder()
+	disabled.AdminHandler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected basic auth and certificates to be ignored when not configured, got %d", rec.Code)
+	}
+}
+
+func TestGeneratedETag(t *testing.T) {
+	var requests atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.Header.Get("If-None-Match") != "" {
+			t.Errorf("expected the generated ETag not to be sent upstream, got %q", r.Header.Get("If-None-Match"))
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("png without etag"))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:      time.Hour,
+		UpstreamBases: []string{upstream.URL},
+	})
+	get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/avatar/abc?s=80", nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	get("")
+	rec := get("")
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || etag == "" || strings.HasPrefix(etag, "W/") {
+		t.Fatalf("expected a strong ETag on the cached response, got %d %q", rec.Code, etag)
+	}
+
+	rec = get(etag)
+	if rec.Code != http.StatusNotModified || rec.Header().Get("ETag") != etag {
+		t.Errorf("expected 304 carrying the ETag, got %d %q", rec.Code, rec.Header().Get("ETag"))
+	}
+	if rec := get(`"other"`); rec.Code != http.StatusOK {
+		t.Errorf("expected a different ETag to get the full response, got %d", rec.Code)
+	}
+
+	// 过期条目向上游重新验证时不带生成的ETag
+	h.cache.SetTTL(0)
+	get("")
+	if n := requests.Load(); n != 2 {
+		t.Errorf("expected one fetch and one revalidation, got %d upstream requests", n)
+	}
+}
+
+func TestRequestHardening(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("png"))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:      time.Hour,
+		UpstreamBases: []string{upstream.URL},
+		AdminToken:    "secret",
+	})
+	mux := http.NewServeMux()
+	mux.Handle("/avatar/", h)
+	mux.HandleFunc("/healthz", h.HealthHandler)
+	mux.Handle("/prefetch", h.PrefetchHandler())
+	srv := httptest.NewUnstartedServer(h.HardenRequests(mux))
+	srv.Config.MaxHeaderBytes = config.DefaultMaxHeaderBytes
+	srv.Start()
+	defer srv.Close()
+
+	// send 在一个连接上写入原始请求，返回读到的所有响应
+	send := func(raw string) string {
+		t.Helper()
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatalf("dial failed: %v", err)
+		}
+		defer conn.Close()
+		conn.Write([]byte(raw))
+		conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		resp, _ := io.ReadAll(conn)
+		return string(resp)
+	}
+	status := func(resp string) string {
+		line, _, _ := strings.Cut(resp, "\r\n")
+		return line
+	}
+	const healthz = "GET /healthz HTTP/1.1\r\nHost: proxy\r\n\r\n"
+
+	// 同时带Content-Length和Transfer-Encoding：响应后关闭连接，夹带的第二个请求不会被处理
+	resp := send("POST /prefetch HTTP/1.1\r\nHost: proxy\r\nContent-Length: 4\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n" + healthz)
+	if strings.Count(resp, "HTTP/1.1 ") != 1 || !strings.Contains(resp, "Connection: close") {
+		t.Errorf("expected one response closing the connection, got %q", resp)
+	}
+	// 普通请求保持连接，流水线中的请求都得到响应
+	if resp := send(healthz + healthz); strings.Count(resp, "HTTP/1.1 200") != 2 {
+		t.Errorf("expected both pipelined requests to be served, got %q", resp)
+	}
+
+	for name, tc := range map[string]struct {
+		raw    string
+		status string
+	}{
+		"chunked GET":              {"GET /avatar/abc HTTP/1.1\r\nHost: proxy\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", "HTTP/1.1 400"},
+		"duplicate Authorization":  {"GET /avatar/abc HTTP/1.1\r\nHost: proxy\r\nAuthorization: Bearer a\r\nAuthorization: Bearer b\r\n\r\n", "HTTP/1.1 400"},
+		"duplicate API key":        {"GET /avatar/abc HTTP/1.1\r\nHost: proxy\r\nX-API-Key: a\r\nx-api-key: b\r\n\r\n", "HTTP/1.1 400"},
+		"duplicate Origin":         {"GET /avatar/abc HTTP/1.1\r\nHost: proxy\r\nOrigin: https://a.test\r\nOrigin: https://b.test\r\n\r\n", "HTTP/1.1 400"},
+		"oversized Authorization":  {"GET /avatar/abc HTTP/1.1\r\nHost: proxy\r\nAuthorization: Bearer " + strings.Repeat("a", 9000) + "\r\n\r\n", "HTTP/1.1 431"},
+		"oversized headers":        {"GET /avatar/abc HTTP/1.1\r\nHost: proxy\r\nX-Padding: " + strings.Repeat("a", 24*1024) + "\r\n\r\n", "HTTP/1.1 431"},
+		"differing Content-Length": {"POST /prefetch HTTP/1.1\r\nHost: proxy\r\nContent-Length: 1\r\nContent-Length: 2\r\n\r\nab", "HTTP/1.1 400"},
+		"Content-Length list":      {"POST /prefetch HTTP/1.1\r\nHost: proxy\r\nContent-Length: 1, 2\r\n\r\nab", "HTTP/1.1 400"},
+		"obfuscated chunked":       {"POST /prefetch HTTP/1.1\r\nHost: proxy\r\nTransfer-Encoding: xchunked\r\n\r\n0\r\n\r\n", "HTTP/1.1 501"},
+		"space before colon":       {"POST /prefetch HTTP/1.1\r\nHost: proxy\r\nTransfer-Encoding : chunked\r\n\r\n0\r\n\r\n", "HTTP/1.1 400"},
+		"duplicate Host":           {"GET /avatar/abc HTTP/1.1\r\nHost: proxy\r\nHost: other\r\n\r\n", "HTTP/1.1 400"},
+		"valid avatar request":     {"GET /avatar/abc HTTP/1.1\r\nHost: proxy\r\nAuthorization: Bearer a\r\n\r\n", "HTTP/1.1 200"},
+	} {
+		if got := status(send(tc.raw)); !strings.HasPrefix(got, tc.status) {
+			t.Errorf("%s: expected %s, got %q", name, tc.status, got)
+		}
+	}
+
+	if n := requestsRejected.Value(denyDuplicateHeader); n < 3 {
+		t.Errorf("expected duplicate headers to be counted, got %v", n)
+	}
+}
+
+func TestRangeRequests(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("0123456789"))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:      time.Hour,
+		UpstreamBases: []string{upstream.URL},
+	})
+	get := func(headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/avatar/abc", nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// 未命中时流式返回完整内容，之后的范围请求由缓存满足
+	if rec := get(map[string]string{"Range": "bytes=0-3"}); rec.Code != http.StatusOK || rec.Body.String() != "0123456789" {
+		t.Fatalf("expected the miss to return the full body, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	rec := get(map[string]string{"Range": "bytes=2-5"})
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "2345" {
+		t.Fatalf("expected 206 with the requested bytes, got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("Content-Range") != "bytes 2-5/10" || rec.Header().Get("Content-Length") != "4" {
+		t.Errorf("unexpected Content-Range %q or Content-Length %q", rec.Header().Get("Content-Range"), rec.Header().Get("Content-Length"))
+	}
+	etag := cache.ContentETag([]byte("0123456789"))
+	if rec.Header().Get("Cache-Control") == "" || rec.Header().Get("ETag") != etag || rec.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("expected cached headers on the partial response, got %v", rec.Header())
+	}
+
+	if rec := get(map[string]string{"Range": "bytes=-3", "If-Range": etag}); rec.Code != http.StatusPartialContent || rec.Body.String() != "789" {
+		t.Errorf("expected a matching If-Range to return the suffix range, got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := get(map[string]string{"Range": "bytes=0-1", "If-Range": `"v1"`}); rec.Code != http.StatusOK || rec.Body.String() != "0123456789" {
+		t.Errorf("expected a stale If-Range to return the full body, got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := get(map[string]string{"Range": "bytes=20-30"}); rec.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("expected 416 for an unsatisfiable range, got %d", rec.Code)
+	}
+	if rec := get(nil); rec.Code != http.StatusOK || rec.Header().Get("Accept-Ranges") != "bytes" || rec.Header().Get("Content-Length") != "10" {
+		t.Errorf("expected a full cached response advertising ranges, got %d %v", rec.Code, rec.Header())
+	}
+}
+
+func TestFollower(t *testing.T) {
+	var requests atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("avatar " + r.URL.Path))
+	}))
+	defer upstream.Close()
+
+	primary := newTestHandler(t, &config.Config{
+		CacheTTL:      time.Hour,
+		UpstreamBases: []string{upstream.URL},
+		AdminToken:    "secret",
+	})
+	primaryAdmin := httptest.NewServer(primary.AdminHandler())
+	defer primaryAdmin.Close()
+	follower := newTestHandler(t, &config.Config{
+		CacheTTL:       time.Hour,
+		UpstreamBases:  []string{upstream.URL},
+		AdminToken:     "secret",
+		FollowPrimary:  primaryAdmin.URL,
+		FollowInterval: time.Minute,
+	})
+	get := func(h *Handler, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec
+	}
+
+	get(primary, "/avatar/abc?s=80")
+	get(primary, "/avatar/def?s=80")
+	before := followerSyncEntries.Value("fetched")
+	cursor := follower.syncFromPrimary(context.Background(), "")
+	if n := followerSyncEntries.Value("fetched") - before; n != 2 {
+		t.Fatalf("expected 2 entries fetched from the primary, got %v", n)
+	}
+	key := primary.cache.GenerateKey("/avatar/abc", map[string]string{"s": "80"})
+	want, _ := primary.cache.ReadData(key)
+	if got, err := follower.cache.ReadData(key); err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("expected the follower to hold the primary's data, got %q (%v)", got, err)
+	}
+
+	// 没有变化时不再下载
+	before = followerSyncEntries.Value("fetched")
+	cursor = follower.syncFromPrimary(context.Background(), cursor)
+	if n := followerSyncEntries.Value("fetched") - before; n != 0 {
+		t.Errorf("expected an unchanged primary to fetch nothing, got %v", n)
+	}
+	get(primary, "/avatar/ghi?s=80")
+	follower.syncFromPrimary(context.Background(), cursor)
+	if n := followerSyncEntries.Value("fetched") - before; n != 1 {
+		t.Errorf("expected only the new entry to be fetched, got %v", n)
+	}
+
+	upstreamBefore := requests.Load()
+	if rec := get(follower, "/avatar/ghi?s=80"); rec.Code != http.StatusOK || rec.Body.String() != "avatar /avatar/ghi" {
+		t.Errorf("expected the follower to serve the synced entry, got %d %q", rec.Code, rec.Body.String())
+	}
+	if requests.Load() != upstreamBefore {
+		t.Error("expected the follower to serve synced entries without contacting upstream")
+	}
+
+	// 同步接口需要管理凭据
+	resp, err := http.Get(primaryAdmin.URL + "/admin/sync")
+	if err != nil {
+		t.Fatalf("sync request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected unauthenticated sync to be rejected, got %d", resp.StatusCode)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	svg := `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 80 80">` +
+		strings.Repeat(`<rect width="10" height="10" fill="#cccccc"/>`, 20) + `</svg>`
+	var requests atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if strings.HasSuffix(r.URL.Path, "/png") {
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(bytes.Repeat([]byte("png "), 200))
+			return
+		}
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write([]byte(svg))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:          time.Hour,
+		UpstreamBases:     []string{upstream.URL},
+		CompressEncodings: []string{"gzip"},
+	})
+	get := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	gunzip := func(rec *httptest.ResponseRecorder) string {
+		t.Helper()
+		zr, err := gzip.NewReader(rec.Body)
+		if err != nil {
+			t.Fatalf("expected a gzip body: %v", err)
+		}
+		data, _ := io.ReadAll(zr)
+		return string(data)
+	}
+
+	// 首次请求从上游流式返回，不压缩，但已声明Vary
+	rec := get("/avatar/svg", "gzip, br")
+	if rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != svg {
+		t.Fatalf("expected the miss to be served as is, got encoding %q", rec.Header().Get("Content-Encoding"))
+	}
+	if rec.Header().Get("Vary") != "Accept-Encoding" {
+		t.Errorf("expected Vary: Accept-Encoding on an SVG response, got %q", rec.Header().Get("Vary"))
+	}
+
+	for i := 0; i < 2; i++ {
+		rec = get("/avatar/svg", "gzip, br")
+		if rec.Header().Get("Content-Encoding") != "gzip" || rec.Header().Get("Vary") != "Accept-Encoding" {
+			t.Fatalf("expected a gzip response varying on Accept-Encoding, got %q / %q",
+				rec.Header().Get("Content-Encoding"), rec.Header().Get("Vary"))
+		}
+		if rec.Body.Len() >= len(svg) || gunzip(rec) != svg {
+			t.Fatalf("expected a smaller body decompressing to the SVG, got %d bytes", rec.Body.Len())
+		}
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("expected the compressed variant to come from cache, got %d upstream requests", n)
+	}
+
+	for _, acceptEncoding := range []string{"", "identity", "gzip;q=0", "*, gzip;q=0"} {
+		rec := get("/avatar/svg", acceptEncoding)
+		if rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != svg {
+			t.Errorf("expected Accept-Encoding %q to get the plain SVG, got %q", acceptEncoding, rec.Header().Get("Content-Encoding"))
+		}
+	}
+	if rec := get("/avatar/svg", "*"); rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Errorf("expected a wildcard to accept gzip, got %q", rec.Header().Get("Content-Encoding"))
+	}
+
+	// 已压缩的图片格式原样返回
+	get("/avatar/png", "gzip")
+	rec = get("/avatar/png", "gzip")
+	if rec.Header().Get("Content-Encoding") != "" || rec.Header().Get("Vary") != "" {
+		t.Errorf("expected PNG to be served uncompressed without Vary, got %q / %q",
+			rec.Header().Get("Content-Encoding"), rec.Header().Get("Vary"))
+	}
+
+	// 客户端不能通过透传参数直接请求压缩变体
+	h.passthrough = newPassthroughParams([]string{"*"})
+	if rec := get("/avatar/svg?enc=gzip", ""); rec.Header().Get("Content-Encoding") != "" {
+		t.Errorf("expected enc not to be passed through, got %q", rec.Header().Get("Content-Encoding"))
+	}
+
+	// 精简构建（assets_minimal）不含mp.svg，跳过内置SVG的检查
+	want, _, hasSVG := assets.Get("mp.svg")
+	if hasSVG {
+		req := httptest.NewRequest("GET", "/defaults/mp.svg", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rec = httptest.NewRecorder()
+		h.DefaultsHandler(rec, req)
+		if rec.Header().Get("Content-Encoding") != "gzip" || gunzip(rec) != string(want) {
+			t.Errorf("expected the built-in SVG to be served gzipped, got %q", rec.Header().Get("Content-Encoding"))
+		}
+	}
+	req := httptest.NewRequest("GET", "/defaults/mp.png", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec = httptest.NewRecorder()
+	h.DefaultsHandler(rec, req)
+	if rec.Header().Get("Content-Encoding") != "" || rec.Header().Get("Vary") != "" {
+		t.Errorf("expected the built-in PNG to be served as is, got %q", rec.Header().Get("Content-Encoding"))
+	}
+
+	// 按配置顺序优先使用br，两种编码的变体分别缓存
+	h = newTestHandler(t, &config.Config{
+		CacheTTL:          time.Hour,
+		UpstreamBases:     []string{upstream.URL},
+		CompressEncodings: []string{"br", "gzip"},
+	})
+	unbrotli := func(rec *httptest.ResponseRecorder) string {
+		t.Helper()
+		data, err := io.ReadAll(brotli.NewReader(rec.Body))
+		if err != nil {
+			t.Fatalf("expected a brotli body: %v", err)
+		}
+		return string(data)
+	}
+	get("/avatar/svg", "")
+	if rec := get("/avatar/svg", "gzip, br"); rec.Header().Get("Content-Encoding") != "br" || unbrotli(rec) != svg {
+		t.Errorf("expected the preferred br encoding, got %q", rec.Header().Get("Content-Encoding"))
+	}
+	if rec := get("/avatar/svg", "gzip"); rec.Header().Get("Content-Encoding") != "gzip" || gunzip(rec) != svg {
+		t.Errorf("expected gzip for a client without br, got %q", rec.Header().Get("Content-Encoding"))
+	}
+	for _, encoding := range []string{"br", "gzip"} {
+		if !hasSVG {
+			break
+		}
+		req := httptest.NewRequest("GET", "/defaults/mp.svg", nil)
+		req.Header.Set("Accept-Encoding", encoding)
+		rec := httptest.NewRecorder()
+		h.DefaultsHandler(rec, req)
+		if rec.Header().Get("Content-Encoding") != encoding {
+			t.Errorf("expected the built-in SVG to be served with %s, got %q", encoding, rec.Header().Get("Content-Encoding"))
+		}
+	}
+
+	if _, err := parseCompressEncodings([]string{"zstd"}); err == nil {
+		t.Error("expected an encoding without an encoder to be rejected")
+	}
+}
+
+func TestCacheReport(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("png data"))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:      time.Hour,
+		UpstreamBases: []string{upstream.URL},
+		AdminToken:    "secret",
+	})
+	admin := h.AdminHandler()
+	report := func(query string) cache.Report {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/admin/cache/report"+query, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200 from the report endpoint, got %d", rec.Code)
+		}
+		var r cache.Report
+		if err := json.Unmarshal(rec.Body.Bytes(), &r); err != nil {
+			t.Fatalf("failed to decode report: %v", err)
+		}
+		return r
+	}
+
+	for _, size := range []string{"80", "80", "200"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/avatar/abc?s="+size, nil))
+	}
+	r := report("")
+	if r.Entries != 2 || r.ByParam["s"]["80"].Entries != 1 || r.ByParam["s"]["200"].Entries != 1 {
+		t.Fatalf("unexpected report: %+v", r)
+	}
+	if cacheReportEntries.Value("1h") != 2 || cacheEvictionHorizon.Value() <= 0 {
+		t.Errorf("expected the report to update metrics, got %v entries and horizon %v",
+			cacheReportEntries.Value("1h"), cacheEvictionHorizon.Value())
+	}
+
+	// 之后返回保存的报告，refresh=1时重新生成
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/avatar/def?s=80", nil))
+	if r := report(""); r.Entries != 2 {
+		t.Errorf("expected the stored report, got %d entries", r.Entries)
+	}
+	if r := report("?refresh=1"); r.Entries != 3 {
+		t.Errorf("expected a fresh report, got %d entries", r.Entries)
+	}
+}
+
+func TestUpstreamBandwidthCap(t *testing.T) {
+	var requests atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(bytes.Repeat([]byte("x"), 100))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:           time.Hour,
+		UpstreamBases:      []string{upstream.URL},
+		FallbackLadder:     []string{"stale", "placeholder", "502"},
+		UpstreamMonthlyCap: 250,
+	})
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec
+	}
+
+	for _, hash := range []string{"a", "b", "c"} {
+		if rec := get("/avatar/" + hash); rec.Code != http.StatusOK || rec.Body.Len() != 100 {
+			t.Fatalf("expected avatar %s from upstream, got %d", hash, rec.Code)
+		}
+	}
+	if _, used := h.bandwidth.usage(); used != 300 {
+		t.Fatalf("expected 300 bytes counted, got %d", used)
+	}
+
+	// 超出上限后不再请求上游，按降级阶梯返回过期条目或占位图
+	before := requests.Load()
+	placeholder, _, _ := assets.Get(placeholderAsset)
+	if rec := get("/avatar/d"); rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), placeholder) {
+		t.Errorf("expected the placeholder once the cap is reached, got %d", rec.Code)
+	}
+	h.cache.SetTTL(0)
+	if rec := get("/avatar/a"); rec.Code != http.StatusOK || rec.Body.Len() != 100 {
+		t.Errorf("expected the stale entry once the cap is reached, got %d", rec.Code)
+	}
+	if n := requests.Load() - before; n != 0 {
+		t.Errorf("expected no upstream requests over the cap, got %d", n)
+	}
+	if errorClass(errBandwidthCap) != errorClassBandwidthCap {
+		t.Errorf("expected the cap error to be classified as %s", errorClassBandwidthCap)
+	}
+
+	// 用量保存在缓存目录中，重启后继续累计，下个月清零
+	if err := h.SaveBandwidthUsage(); err != nil {
+		t.Fatalf("failed to save usage: %v", err)
+	}
+	meter := newBandwidthMeter(250, h.cache.Dir())
+	if month, used := meter.usage(); used != 300 || !meter.exhausted() {
+		t.Errorf("expected the saved usage to be restored, got %d bytes for %s", used, month)
+	}
+	meter.now = func() time.Time { return time.Now().AddDate(0, 1, 0) }
+	if _, used := meter.usage(); used != 0 || meter.exhausted() {
+		t.Errorf("expected usage to reset in a new month, got %d", used)
+	}
+}
+
+func TestUpstreamContentCheck(t *testing.T) {
+	pngData := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 600)...)
+	svg := `<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg"/>`
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/avatar/html", "/target":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html><body>Service unavailable</body></html>"))
+		case "/avatar/mislabeled":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("<html><body>Service unavailable</body></html>"))
+		case "/avatar/svg":
+			w.Header().Set("Content-Type", "image/svg+xml")
+			w.Write([]byte(svg))
+		case "/avatar/redirect":
+			http.Redirect(w, r, "/target", http.StatusFound)
+		default:
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(pngData)
+		}
+	}))
+	defer upstream.Close()
+
+	newHandler := func(check string) *Handler {
+		return newTestHandler(t, &config.Config{
+			CacheTTL:             time.Hour,
+			UpstreamBases:        []string{upstream.URL},
+			FallbackLadder:       []string{"502"},
+			FollowRedirects:      true,
+			UpstreamContentCheck: check,
+		})
+	}
+	get := func(h *Handler, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec
+	}
+
+	h := newHandler(config.ContentCheckHeader)
+	before := upstreamErrors.Value(upstream.URL, errorClassContentType)
+	for _, path := range []string{"/avatar/html", "/avatar/redirect"} {
+		if rec := get(h, path); rec.Code != http.StatusBadGateway {
+			t.Errorf("expected %s to be rejected, got %d", path, rec.Code)
+		}
+	}
+	if n := upstreamErrors.Value(upstream.URL, errorClassContentType) - before; n != 2 {
+		t.Errorf("expected 2 content_type errors, got %v", n)
+	}
+	if entries := h.cache.Stats().Entries; entries != 0 {
+		t.Errorf("expected rejected responses not to be cached, got %d entries", entries)
+	}
+	if rec := get(h, "/avatar/mislabeled"); rec.Code != http.StatusOK {
+		t.Errorf("expected the header check to accept an image Content-Type, got %d", rec.Code)
+	}
+
+	h = newHandler(config.ContentCheckSniff)
+	if rec := get(h, "/avatar/mislabeled"); rec.Code != http.StatusBadGateway {
+		t.Errorf("expected sniffing to reject HTML labelled as PNG, got %d", rec.Code)
+	}
+	if rec := get(h, "/avatar/png"); rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), pngData) {
+		t.Errorf("expected the PNG to pass intact, got %d with %d bytes", rec.Code, rec.Body.Len())
+	}
+	if rec := get(h, "/avatar/svg"); rec.Code != http.StatusOK || rec.Body.String() != svg {
+		t.Errorf("expected the SVG to pass, got %d", rec.Code)
+	}
+
+	h = newHandler(config.ContentCheckOff)
+	if rec := get(h, "/avatar/html"); rec.Code != http.StatusOK {
+		t.Errorf("expected no check with off, got %d", rec.Code)
+	}
+}
+
+func TestMaxUpstreamBytes(t *testing.T) {
+	const limit = 1024
+	small := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 100)...)
+	large := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 4*limit)...)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		switch r.URL.Path {
+		case "/avatar/declared":
+			w.Header().Set("Content-Length", strconv.Itoa(len(large)))
+			w.Write(large)
+		case "/avatar/chunked":
+			// 不声明Content-Length，只能在读取时发现超出上限
+			for i := 0; i < len(large); i += 256 {
+				w.Write(large[i : i+256])
+				w.(http.Flusher).Flush()
+			}
+		default:
+			w.Write(small)
+		}
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:         time.Hour,
+		UpstreamBases:    []string{upstream.URL},
+		FallbackLadder:   []string{"502"},
+		MaxUpstreamBytes: limit,
+	})
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec
+	}
+
+	before := upstreamErrors.Value(upstream.URL, errorClassBodyTooLarge)
+	if rec := get("/avatar/declared"); rec.Code != http.StatusBadGateway {
+		t.Errorf("expected an oversized Content-Length to be rejected, got %d", rec.Code)
+	}
+	if rec := get("/avatar/chunked"); rec.Body.Len() > limit {
+		t.Errorf("expected the streamed body to stop at %d bytes, got %d", limit, rec.Body.Len())
+	}
+	if n := upstreamErrors.Value(upstream.URL, errorClassBodyTooLarge) - before; n != 2 {
+		t.Errorf("expected 2 body_too_large errors, got %v", n)
+	}
+	if entries := h.cache.Stats().Entries; entries != 0 {
+		t.Errorf("expected oversized responses not to be cached, got %d entries", entries)
+	}
+
+	if rec := get("/avatar/small"); rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), small) {
+		t.Errorf("expected a response under the limit to pass, got %d with %d bytes", rec.Code, rec.Body.Len())
+	}
+	if entries := h.cache.Stats().Entries; entries != 1 {
+		t.Errorf("expected the small response to be cached, got %d entries", entries)
+	}
+}
+
+func TestUpstreamOverride(t *testing.T) {
+	newUpstream := func(body string, hits *atomic.Int32) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits.Add(1)
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte(body))
+		}))
+	}
+	var primaryHits, mirrorHits atomic.Int32
+	primary := newUpstream("primary", &primaryHits)
+	defer primary.Close()
+	mirror := newUpstream("mirror", &mirrorHits)
+	defer mirror.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:          time.Hour,
+		UpstreamBases:     []string{primary.URL},
+		AdminToken:        "secret",
+		UpstreamOverrides: map[string]string{"mirror": mirror.URL},
+	})
+	get := func(override, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/avatar/205e460b479e2e5b48aec07710c08d50?s=80", nil)
+		if override != "" {
+			req.Header.Set(upstreamOverrideHeader, override)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := get("mirror", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("expected an unauthenticated override to be rejected, got %d", rec.Code)
+	}
+	if rec := get("mirror", "wrong"); rec.Code != http.StatusForbidden {
+		t.Errorf("expected a wrong token to be rejected, got %d", rec.Code)
+	}
+	if rec := get("unknown", "secret"); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected an unknown override to be rejected, got %d", rec.Code)
+	}
+
+	for i := 0; i < 2; i++ {
+		rec := get("mirror", "secret")
+		if rec.Code != http.StatusOK || rec.Body.String() != "mirror" {
+			t.Fatalf("expected the mirror's avatar, got %d %q", rec.Code, rec.Body.String())
+		}
+		if cc := rec.Header().Get("Cache-Control"); cc != "private, no-store" {
+			t.Errorf("expected override responses to be private, got %q", cc)
+		}
+		if got := rec.Header().Get(upstreamOverrideHeader); got != "mirror" {
+			t.Errorf("expected the override name to be echoed, got %q", got)
+		}
+	}
+	if n := mirrorHits.Load(); n != 1 {
+		t.Errorf("expected the second override request to be served from cache, mirror got %d requests", n)
+	}
+
+	// 正常流量不受备选上游的条目影响
+	rec := get("", "")
+	if rec.Body.String() != "primary" || primaryHits.Load() != 1 {
+		t.Errorf("expected normal traffic to use the primary upstream, got %q", rec.Body.String())
+	}
+	if cc := rec.Header().Get("Cache-Control"); !strings.HasPrefix(cc, "public") {
+		t.Errorf("expected normal responses to stay public, got %q", cc)
+	}
+}
+
+func TestResponseDeterminism(t *testing.T) {
+	svg := `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 80 80">` +
+		strings.Repeat(`<rect width="10" height="10" fill="#cccccc"/>`, 20) + `</svg>`
+	// 两个镜像节点返回相同的内容，但ETag和Last-Modified按各自的文件生成
+	newMirror := func(node string, modified time.Time) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "image/svg+xml")
+			w.Header().Set("ETag", `"`+node+`"`)
+			w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+			w.Write([]byte(svg))
+		}))
+	}
+	mirrorA := newMirror("a", time.Now().Add(-time.Hour))
+	defer mirrorA.Close()
+	mirrorB := newMirror("b", time.Now().Add(-2*time.Hour))
+	defer mirrorB.Close()
+
+	replicas := []*Handler{
+		newTestHandler(t, &config.Config{CacheTTL: time.Hour, UpstreamBases: []string{mirrorA.URL}, CompressEncodings: []string{"gzip"}}),
+		newTestHandler(t, &config.Config{CacheTTL: time.Hour, UpstreamBases: []string{mirrorB.URL}, CompressEncodings: []string{"gzip"}}),
+	}
+	get := func(h *Handler, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/avatar/abc?s=80", nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	want := cache.ContentETag([]byte(svg))
+	for i, h := range replicas {
+		// 未命中时流式返回，内容ETag还没有算出，也不转发镜像自己的ETag
+		if etag := get(h, nil).Header().Get("ETag"); etag != "" {
+			t.Errorf("replica %d: expected no ETag on the streamed miss, got %q", i, etag)
+		}
+		if etag := get(h, nil).Header().Get("ETag"); etag != want {
+			t.Errorf("replica %d: expected the content ETag %q, got %q", i, want, etag)
+		}
+	}
+
+	// 任一副本给出的ETag在另一个副本上同样有效，即使Last-Modified不同
+	other := map[string]string{"If-None-Match": want, "If-Modified-Since": time.Now().Add(-3 * time.Hour).UTC().Format(http.TimeFormat)}
+	for i, h := range replicas {
+		if rec := get(h, other); rec.Code != http.StatusNotModified {
+			t.Errorf("replica %d: expected 304 for the shared ETag, got %d", i, rec.Code)
+		}
+		if rec := get(h, map[string]string{"If-None-Match": `"a"`}); rec.Code != http.StatusOK {
+			t.Errorf("replica %d: expected a mirror's ETag not to validate, got %d", i, rec.Code)
+		}
+	}
+
+	// 压缩版本在每个副本上独立生成，ETag和内容仍然相同
+	var etags, bodies []string
+	for _, h := range replicas {
+		get(h, map[string]string{"Accept-Encoding": "gzip"})
+		rec := get(h, map[string]string{"Accept-Encoding": "gzip"})
+		if rec.Header().Get("Content-Encoding") != "gzip" {
+			t.Fatalf("expected a compressed response, got %v", rec.Header())
+		}
+		etags = append(etags, rec.Header().Get("ETag"))
+		bodies = append(bodies, rec.Body.String())
+	}
+	if etags[0] == "" || etags[0] != etags[1] || etags[0] == want || bodies[0] != bodies[1] {
+		t.Errorf("expected identical compressed responses with their own ETag, got %q and %q", etags[0], etags[1])
+	}
+
+	// 内置默认头像同样按内容生成ETag
+	var assetETags []string
+	for _, h := range replicas {
+		rec := httptest.NewRecorder()
+		h.DefaultsHandler(rec, httptest.NewRequest("GET", "/defaults/mp.png", nil))
+		assetETags = append(assetETags, rec.Header().Get("ETag"))
+	}
+	if assetETags[0] == "" || assetETags[0] != assetETags[1] {
+		t.Errorf("expected identical ETags for built-in defaults, got %q and %q", assetETags[0], assetETags[1])
+	}
+	req := httptest.NewRequest("GET", "/defaults/mp.png", nil)
+	req.Header.Set("If-None-Match", assetETags[0])
+	rec := httptest.NewRecorder()
+	replicas[1].DefaultsHandler(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("expected 304 for a built-in default with a matching ETag, got %d", rec.Code)
+	}
+}
+
+func TestDefaultsListing(t *testing.T) {
+	h := newTestHandler(t, &config.Config{CacheTTL: time.Hour})
+
+	rec := httptest.NewRecorder()
+	h.DefaultsHandler(rec, httptest.NewRequest("GET", "/defaults", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected application/json, got %q", ct)
+	}
+	var listing struct {
+		Defaults []struct {
+			Name        string `json:"name"`
+			File        string `json:"file"`
+			ContentType string `json:"content_type"`
+			Size        int64  `json:"size"`
+			URL         string `json:"url"`
+		} `json:"defaults"`
+		LocalStyles []string `json:"local_styles"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&listing); err != nil {
+		t.Fatal(err)
+	}
+
+	// 列表与当前构建的资源一致（精简构建同样适用），每个url都能取到对应的资源
+	want := assets.List()
+	if len(listing.Defaults) != len(want) || len(want) == 0 {
+		t.Fatalf("expected %d defaults, got %d", len(want), len(listing.Defaults))
+	}
+	for i, d := range listing.Defaults {
+		if d.Name != want[i].Name || d.File != want[i].File || d.ContentType != want[i].ContentType || d.Size != want[i].Size {
+			t.Errorf("expected %+v, got %+v", want[i], d)
+		}
+		if d.URL != "/defaults/"+d.File {
+			t.Errorf("expected url /defaults/%s, got %q", d.File, d.URL)
+		}
+		rec := httptest.NewRecorder()
+		h.DefaultsHandler(rec, httptest.NewRequest("GET", d.URL, nil))
+		if rec.Code != http.StatusOK || int64(rec.Body.Len()) != d.Size || rec.Header().Get("Content-Type") != d.ContentType {
+			t.Errorf("expected %s to serve %d bytes of %s, got %d with %d bytes of %q",
+				d.URL, d.Size, d.ContentType, rec.Code, rec.Body.Len(), rec.Header().Get("Content-Type"))
+		}
+	}
+	if !slices.Equal(listing.LocalStyles, avatargen.Styles()) || len(listing.LocalStyles) == 0 {
+		t.Errorf("expected local_styles %v, got %v", avatargen.Styles(), listing.LocalStyles)
+	}
+}
+
+func TestOriginDecisions(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("png"))
+	}))
+	defer upstream.Close()
+
+	cfg := &config.Config{
+		CacheTTL:       time.Hour,
+		UpstreamBases:  []string{upstream.URL},
+		AllowedOrigins: []string{"good.example"},
+	}
+	h := newTestHandler(t, cfg)
+	send := func(origin, referer string) int {
+		req := httptest.NewRequest("GET", "/avatar/abc", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		if referer != "" {
+			req.Header.Set("Referer", referer)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	allowedBefore := originDecisionsTotal.Value("good.example", "allowed")
+	hitsBefore := originDecisionLookups.Value("hit")
+	for _, origin := range []string{"https://good.example", "https://good.example", "https://cdn.good.example"} {
+		if code := send(origin, ""); code != http.StatusOK {
+			t.Errorf("expected %s to be allowed, got %d", origin, code)
+		}
+	}
+	// 只带Referer的直接请求按其中的主机判断，不同路径共用一个判断
+	for _, page := range []string{"/a", "/b?x=1"} {
+		if code := send("", "https://good.example"+page); code != http.StatusOK {
+			t.Errorf("expected a referer from the allowed origin to be allowed, got %d", code)
+		}
+	}
+	if n := originDecisionsTotal.Value("good.example", "allowed") - allowedBefore; n != 5 {
+		t.Errorf("expected 5 allowed decisions for good.example, got %v", n)
+	}
+	if n := originDecisionLookups.Value("hit") - hitsBefore; n != 2 {
+		t.Errorf("expected repeated origins and referers to hit the decision cache twice, got %v", n)
+	}
+	if n := len(h.current().origins.entries); n != 3 {
+		t.Errorf("expected 3 cached decisions, got %d", n)
+	}
+
+	deniedBefore := originDecisionsTotal.Value("evil.example", "denied")
+	noneBefore := originDecisionsTotal.Value("none", "denied")
+	if code := send("https://evil.example", "https://evil.example/page"); code != http.StatusForbidden {
+		t.Errorf("expected a foreign origin to be denied, got %d", code)
+	}
+	if code := send("", ""); code != http.StatusForbidden {
+		t.Errorf("expected a request without Origin or Referer to be denied, got %d", code)
+	}
+	if n := originDecisionsTotal.Value("evil.example", "denied") - deniedBefore; n != 1 {
+		t.Errorf("expected 1 denied decision for evil.example, got %v", n)
+	}
+	if n := originDecisionsTotal.Value("none", "denied") - noneBefore; n != 1 {
+		t.Errorf("expected 1 denied decision without an origin, got %v", n)
+	}
+
+	// 重新加载后按新的允许列表判断，不沿用旧的结果
+	reloaded := *cfg
+	reloaded.AllowedOrigins = []string{"evil.example"}
+	h.Reload(&reloaded)
+	if code := send("https://good.example", ""); code != http.StatusForbidden {
+		t.Errorf("expected good.example to be denied after reload, got %d", code)
+	}
+	if code := send("https://evil.example", ""); code != http.StatusOK {
+		t.Errorf("expected evil.example to be allowed after reload, got %d", code)
+	}
+
+	// 被拒绝来源的指标标签数有上限
+	d := newOriginDecisions([]string{"good.example"})
+	for i := 0; i < maxDeniedOriginLabels; i++ {
+		d.origin("https://host" + strconv.Itoa(i) + ".example")
+	}
+	if m := d.origin("https://one-too-many.example"); m.allowed || m.label != "other" {
+		t.Errorf("expected denied origins past the cap to be labelled other, got %+v", m)
+	}
+	if m := d.origin("https://host0.example"); m.label != "host0.example" {
+		t.Errorf("expected an already labelled origin to keep its label, got %+v", m)
+	}
+}
+
+func TestUpstreamRetries(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n")
+	var mu sync.Mutex
+	hits := map[string]int{}
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.URL.Path]++
+		n := hits[r.URL.Path]
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/avatar/flaky":
+			if n <= 2 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		case "/avatar/reset":
+			// 第一次请求不返回任何响应就断开连接
+			if n == 1 {
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+				return
+			}
+		case "/avatar/down", "/avatar/budget":
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		case "/avatar/later":
+			w.Header().Set("Retry-After", "30")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		case "/avatar/slow":
+			time.Sleep(100 * time.Millisecond)
+		case "/avatar/missing":
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(png)
+	}))
+	// Transport会自行重发复用连接上被断开的请求，每个请求使用新连接才能观察到代理的重试
+	upstream.Config.SetKeepAlivesEnabled(false)
+	upstream.Start()
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:              time.Hour,
+		UpstreamBases:         []string{upstream.URL},
+		FallbackLadder:        []string{"502"},
+		UpstreamRetries:       2,
+		UpstreamRetryBackoff:  time.Millisecond,
+		UpstreamHeaderTimeout: 20 * time.Millisecond,
+	})
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec
+	}
+	hitsOf := func(path string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return hits[path]
+	}
+
+	before := upstreamRetriesTotal.Value(upstream.URL, "status_503")
+	if rec := get("/avatar/flaky"); rec.Code != http.StatusOK {
+		t.Errorf("expected two 503s to be retried, got %d", rec.Code)
+	}
+	if n := hitsOf("/avatar/flaky"); n != 3 {
+		t.Errorf("expected 3 upstream attempts, got %d", n)
+	}
+	if n := upstreamRetriesTotal.Value(upstream.URL, "status_503") - before; n != 2 {
+		t.Errorf("expected 2 retries counted, got %v", n)
+	}
+
+	before = upstreamRetriesTotal.Value(upstream.URL, "connection_reset")
+	if rec := get("/avatar/reset"); rec.Code != http.StatusOK {
+		t.Errorf("expected a reset connection to be retried, got %d", rec.Code)
+	}
+	if n := upstreamRetriesTotal.Value(upstream.URL, "connection_reset") - before; n != 1 {
+		t.Errorf("expected 1 connection_reset retry, got %v", n)
+	}
+
+	if rec := get("/avatar/down"); rec.Code != http.StatusBadGateway {
+		t.Errorf("expected the failure to surface once retries run out, got %d", rec.Code)
+	}
+	if n := hitsOf("/avatar/down"); n != 3 {
+		t.Errorf("expected retries to stop after 2, got %d attempts", n)
+	}
+
+	get("/avatar/missing")
+	if n := hitsOf("/avatar/missing"); n != 1 {
+		t.Errorf("expected a 404 not to be retried, got %d attempts", n)
+	}
+
+	get("/avatar/later")
+	if n := hitsOf("/avatar/later"); n != 1 {
+		t.Errorf("expected a 503 with Retry-After not to be retried, got %d attempts", n)
+	}
+
+	// 等待响应头超时的请求已到达上游，默认不重试
+	before = upstreamRetriesTotal.Value(upstream.URL, "header_timeout")
+	timeouts := upstreamErrors.Value(upstream.URL, errorClassTimeout)
+	get("/avatar/slow")
+	if n := hitsOf("/avatar/slow"); n != 1 {
+		t.Errorf("expected a header timeout not to be retried by default, got %d attempts", n)
+	}
+	if n := upstreamErrors.Value(upstream.URL, errorClassTimeout) - timeouts; n != 1 {
+		t.Errorf("expected the header timeout to be classified as a timeout, got %v", n)
+	}
+	h.retryHeaderTimeouts = true
+	get("/avatar/slow")
+	if n := hitsOf("/avatar/slow"); n != 4 {
+		t.Errorf("expected header timeouts to be retried when enabled, got %d attempts", n-1)
+	}
+	if n := upstreamRetriesTotal.Value(upstream.URL, "header_timeout") - before; n != 2 {
+		t.Errorf("expected 2 header_timeout retries, got %v", n)
+	}
+
+	// 重试预算由所有请求共享，用尽后不再重试
+	h.retryBudget = newRetryBudget(1)
+	before = upstreamRetryBudgetExhausted.Value(upstream.URL)
+	get("/avatar/budget")
+	if n := hitsOf("/avatar/budget"); n != 2 {
+		t.Errorf("expected one retry within the budget, got %d attempts", n)
+	}
+	if n := upstreamRetryBudgetExhausted.Value(upstream.URL) - before; n != 1 {
+		t.Errorf("expected the skipped retry to be counted, got %v", n)
+	}
+
+	for attempt := 1; attempt <= 10; attempt++ {
+		d := retryBackoff(100*time.Millisecond, attempt)
+		limit := min(100*time.Millisecond<<(attempt-1), maxRetryBackoff)
+		if d < limit/2 || d > limit {
+			t.Errorf("attempt %d: expected a backoff between %v and %v, got %v", attempt, limit/2, limit, d)
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var healthy atomic.Bool
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("\x89PNG\r\n\x1a\n"))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:                time.Hour,
+		UpstreamBases:           []string{upstream.URL},
+		FallbackLadder:          []string{"placeholder"},
+		AdminToken:              "secret",
+		CircuitBreakerThreshold: 2,
+		CircuitBreakerCooldown:  time.Minute,
+	})
+	now := time.Now()
+	h.breaker.now = func() time.Time { return now }
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec
+	}
+	state := func() string {
+		req := httptest.NewRequest("GET", "/admin/stats", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		h.AdminHandler().ServeHTTP(rec, req)
+		var stats struct {
+			CircuitBreakers []breakerStatus `json:"circuit_breakers"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil || len(stats.CircuitBreakers) != 1 {
+			t.Fatalf("expected one circuit breaker in stats, got %s", rec.Body.String())
+		}
+		return stats.CircuitBreakers[0].State
+	}
+
+	// 5xx响应经降级阶梯返回占位头像，连续两次后熔断
+	for _, hash := range []string{"a", "b"} {
+		if rec := get("/avatar/" + hash); rec.Code != http.StatusOK {
+			t.Fatalf("expected the placeholder while upstream fails, got %d", rec.Code)
+		}
+	}
+	if s := state(); s != breakerOpen {
+		t.Fatalf("expected the breaker to open after 2 failures, got %s", s)
+	}
+	if v := upstreamCircuitState.Value(upstream.URL); v != 1 {
+		t.Errorf("expected upstream_circuit_state 1, got %v", v)
+	}
+
+	// 熔断期间不请求上游，直接降级
+	healthy.Store(true)
+	if rec := get("/avatar/c"); rec.Code != http.StatusOK || hits.Load() != 2 {
+		t.Errorf("expected an open breaker to skip upstream, got %d with %d upstream hits", rec.Code, hits.Load())
+	}
+	if v := upstreamErrors.Value(upstream.URL, errorClassCircuitOpen); v < 1 {
+		t.Errorf("expected skipped requests to be counted as circuit_open, got %v", v)
+	}
+
+	// 冷却时间过后放行一个探测请求，成功后恢复
+	now = now.Add(time.Minute)
+	if rec := get("/avatar/d"); rec.Code != http.StatusOK || hits.Load() != 3 {
+		t.Errorf("expected the probe to reach upstream, got %d with %d upstream hits", rec.Code, hits.Load())
+	}
+	if s := state(); s != breakerClosed {
+		t.Errorf("expected a successful probe to close the breaker, got %s", s)
+	}
+
+	// 探测失败时立即重新熔断，不需要再累计到阈值
+	healthy.Store(false)
+	get("/avatar/e")
+	get("/avatar/f")
+	now = now.Add(time.Minute)
+	get("/avatar/g")
+	if s := state(); s != breakerOpen {
+		t.Errorf("expected a failed probe to reopen the breaker, got %s", s)
+	}
+	if hits.Load() != 6 {
+		t.Errorf("expected 6 upstream hits, got %d", hits.Load())
+	}
+}
+
+func TestCircuitBreakerRetryAfter(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:                time.Hour,
+		UpstreamBases:           []string{upstream.URL},
+		FallbackLadder:          []string{"502"},
+		CircuitBreakerThreshold: 1,
+		CircuitBreakerCooldown:  time.Minute,
+	})
+	get := func(hash string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/avatar/"+hash, nil))
+		return rec
+	}
+	if rec := get("a"); rec.Header().Get("Retry-After") != "10" {
+		t.Errorf("expected the upstream Retry-After for an upstream 503, got %q", rec.Header().Get("Retry-After"))
+	}
+	rec := get("b")
+	if rec.Code != http.StatusBadGateway || rec.Header().Get("Retry-After") != "30" {
+		t.Errorf("expected 502 with the circuit_open Retry-After, got %d with %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+}
+
+func TestRequestIDHeader(t *testing.T) {
+	var mu sync.Mutex
+	var upstreamIDs []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		upstreamIDs = append(upstreamIDs, r.Header.Get("X-Request-ID")+"|"+r.Header.Get("Cf-Ray"))
+		mu.Unlock()
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("\x89PNG\r\n\x1a\n"))
+	}))
+	defer upstream.Close()
+
+	lastUpstreamID := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return upstreamIDs[len(upstreamIDs)-1]
+	}
+
+	// httptest.NewRequest的RemoteAddr为192.0.2.1
+	cases := []struct {
+		name    string
+		cfg     config.Config
+		header  string
+		inbound string
+		reused  bool
+	}{
+		{"untrusted caller", config.Config{}, "X-Request-ID", "abc-123", false},
+		{"trusted proxy", config.Config{TrustedProxies: []string{"192.0.2.1"}}, "X-Request-ID", "abc-123", true},
+		{"trusted network", config.Config{TrustedNetworks: []string{"192.0.2.0/24"}}, "X-Request-ID", "abc-123", true},
+		{"trust disabled", config.Config{TrustedProxies: []string{"192.0.2.1"}, RequestIDTrust: config.RequestIDTrustNone}, "X-Request-ID", "abc-123", false},
+		{"custom header", config.Config{RequestIDHeader: "CF-Ray", RequestIDTrust: config.RequestIDTrustAll}, "Cf-Ray", "8d2f1a3b4c5d6e7f-AMS", true},
+		{"malformed", config.Config{RequestIDTrust: config.RequestIDTrustAll}, "X-Request-ID", "abc 123\r\nforged: 1", false},
+	}
+	for i, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := tc.cfg
+			cfg.CacheTTL = time.Hour
+			cfg.UpstreamBases = []string{upstream.URL}
+			h := newTestHandler(t, &cfg)
+
+			req := httptest.NewRequest("GET", "/avatar/"+strings.Repeat(strconv.Itoa(i), 32), nil)
+			req.Header.Set(tc.header, tc.inbound)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			id := rec.Header().Get(tc.header)
+			if id == "" {
+				t.Fatalf("expected the request ID in %s, got headers %v", tc.header, rec.Header())
+			}
+			if (id == tc.inbound) != tc.reused {
+				t.Errorf("expected reused=%v, got request ID %q", tc.reused, id)
+			}
+			want := id + "|"
+			if tc.header == "Cf-Ray" {
+				want = "|" + id
+			}
+			if got := lastUpstreamID(); got != want {
+				t.Errorf("expected upstream to receive the request ID %q, got %q", want, got)
+			}
+		})
+	}
+}
+
+func TestUpstreamProxy(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n")
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(png)
+	}))
+	defer upstream.Close()
+
+	// HTTP代理收到的是完整的目标URL，这里直接代为响应
+	var proxied atomic.Value
+	httpProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied.Store(r.URL.Host)
+		if r.Header.Get("Proxy-Authorization") == "" {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(png)
+	}))
+	defer httpProxy.Close()
+
+	// 最小的SOCKS5服务器：不要求认证，记录目标地址后把连接转到upstream
+	socksListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socksListener.Close()
+	var socksTarget atomic.Value
+	go func() {
+		for {
+			conn, err := socksListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 262)
+				if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+					return
+				}
+				if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+					return
+				}
+				conn.Write([]byte{5, 0})
+				if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+					return
+				}
+				var host string
+				switch buf[3] {
+				case 1:
+					io.ReadFull(conn, buf[:4])
+					host = net.IP(buf[:4]).String()
+				case 3:
+					io.ReadFull(conn, buf[:1])
+					n := int(buf[0])
+					io.ReadFull(conn, buf[:n])
+					host = string(buf[:n])
+				default:
+					return
+				}
+				io.ReadFull(conn, buf[:2])
+				socksTarget.Store(net.JoinHostPort(host, strconv.Itoa(int(buf[0])<<8|int(buf[1]))))
+
+				backend, err := net.Dial("tcp", upstream.Listener.Addr().String())
+				if err != nil {
+					return
+				}
+				defer backend.Close()
+				conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				go io.Copy(backend, conn)
+				io.Copy(conn, backend)
+			}()
+		}
+	}()
+
+	get := func(proxyURL string) *httptest.ResponseRecorder {
+		h := newTestHandler(t, &config.Config{
+			CacheTTL:      time.Hour,
+			UpstreamBases: []string{"http://avatars.invalid"},
+			UpstreamProxy: proxyURL,
+		})
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/avatar/"+strings.Repeat("a", 32), nil))
+		return rec
+	}
+
+	u, _ := url.Parse(httpProxy.URL)
+	u.User = url.UserPassword("proxy", "secret")
+	if rec := get(u.String()); rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), png) {
+		t.Errorf("expected the avatar through the HTTP proxy, got %d", rec.Code)
+	}
+	if host, _ := proxied.Load().(string); host != "avatars.invalid" {
+		t.Errorf("expected the HTTP proxy to be asked for avatars.invalid, got %q", host)
+	}
+
+	if rec := get("socks5h://" + socksListener.Addr().String()); rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), png) {
+		t.Errorf("expected the avatar through the SOCKS5 proxy, got %d", rec.Code)
+	}
+	if target, _ := socksTarget.Load().(string); target != "avatars.invalid:80" {
+		t.Errorf("expected the SOCKS5 proxy to connect to avatars.invalid:80, got %q", target)
+	}
+}
+
+func TestPreflightCacheControl(t *testing.T) {
+	cfg := &config.Config{
+		CacheTTL:          time.Hour,
+		UpstreamBases:     []string{"http://127.0.0.1:0"},
+		AllowedOrigins:    []string{"example.com"},
+		PreflightCacheTTL: time.Hour,
+	}
+	h := newTestHandler(t, cfg)
+	preflight := func(origin, referer string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodOptions, "/avatar/abc", nil)
+		req.Header.Set("Origin", origin)
+		if referer != "" {
+			req.Header.Set("Referer", referer)
+		}
+		req.Header.Set("Access-Control-Request-Method", "GET")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := preflight("https://example.com", "")
+	if rec.Code != http.StatusOK || rec.Header().Get("Cache-Control") != "public, max-age=3600" || rec.Header().Get("Vary") != "Origin" {
+		t.Errorf("expected a shared-cacheable preflight varying on Origin, got %d, cache-control %q, vary %q", rec.Code, rec.Header().Get("Cache-Control"), rec.Header().Get("Vary"))
+	}
+	// 仅凭Referer放行时响应取决于Vary之外的请求头
+	rec = preflight("https://other.test", "https://example.com/page")
+	if rec.Code != http.StatusOK || rec.Header().Get("Cache-Control") != "" {
+		t.Errorf("expected a preflight allowed by Referer not to be cacheable, got %d, cache-control %q", rec.Code, rec.Header().Get("Cache-Control"))
+	}
+	if rec := preflight("https://evil.test", ""); rec.Code != http.StatusForbidden || strings.Contains(rec.Header().Get("Cache-Control"), "public") {
+		t.Errorf("expected a rejected preflight not to be cacheable, got %d, cache-control %q", rec.Code, rec.Header().Get("Cache-Control"))
+	}
+
+	reloaded := *cfg
+	reloaded.PreflightCacheTTL = 0
+	h.Reload(&reloaded)
+	if rec := preflight("https://example.com", ""); rec.Header().Get("Cache-Control") != "" {
+		t.Errorf("expected no Cache-Control after reloading with PREFLIGHT_CACHE_TTL=0, got %q", rec.Header().Get("Cache-Control"))
+	}
+}
+
+func TestUpstreamResolver(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n")
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(png)
+	}))
+	// 每个请求都重新建连，才能观察到每次建连时的解析
+	upstream.Config.SetKeepAlivesEnabled(false)
+	upstream.Start()
+	defer upstream.Close()
+	_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+
+	// 最小的DNS服务器：A查询一律回答127.0.0.1，其余类型回答空结果
+	dnsConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dnsConn.Close()
+	var queries atomic.Int32
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := dnsConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			queries.Add(1)
+			end := 12
+			for end < n && buf[end] != 0 {
+				end += int(buf[end]) + 1
+			}
+			end += 5
+			if end > n {
+				continue
+			}
+			resp := append([]byte{}, buf[:end]...)
+			resp[2], resp[3] = 0x81, 0x80
+			resp[6], resp[7], resp[8], resp[9], resp[10], resp[11] = 0, 0, 0, 0, 0, 0
+			if qtype := int(buf[end-4])<<8 | int(buf[end-3]); qtype == 1 {
+				resp[7] = 1
+				resp = append(resp, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 127, 0, 0, 1)
+			}
+			dnsConn.WriteTo(resp, addr)
+		}
+	}()
+
+	get := func(h *Handler, hash string) int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/avatar/"+strings.Repeat(hash, 32), nil))
+		return rec.Code
+	}
+
+	static := newTestHandler(t, &config.Config{
+		CacheTTL:      time.Hour,
+		UpstreamBases: []string{"http://avatars.invalid:" + port},
+		UpstreamHosts: map[string][]string{"avatars.invalid": {"127.0.0.1"}},
+	})
+	before := upstreamDNSLookups.Value("static")
+	if code := get(static, "a"); code != http.StatusOK {
+		t.Errorf("expected the static mapping to reach upstream, got %d", code)
+	}
+	if n := upstreamDNSLookups.Value("static") - before; n != 1 {
+		t.Errorf("expected 1 static lookup, got %v", n)
+	}
+
+	resolved := newTestHandler(t, &config.Config{
+		CacheTTL:            time.Hour,
+		UpstreamBases:       []string{"http://avatars.invalid:" + port},
+		UpstreamDNSServer:   dnsConn.LocalAddr().String(),
+		UpstreamDNSCacheTTL: time.Hour,
+	})
+	if code := get(resolved, "b"); code != http.StatusOK {
+		t.Fatalf("expected the configured DNS server to resolve upstream, got %d", code)
+	}
+	sent := queries.Load()
+	if sent == 0 {
+		t.Fatal("expected the configured DNS server to be queried")
+	}
+	before = upstreamDNSLookups.Value("hit")
+	if code := get(resolved, "c"); code != http.StatusOK {
+		t.Errorf("expected a cached lookup to reach upstream, got %d", code)
+	}
+	if queries.Load() != sent || upstreamDNSLookups.Value("hit")-before != 1 {
+		t.Errorf("expected the second connection to use the cached lookup, got %d more queries", queries.Load()-sent)
+	}
+}
+
+func TestUpstreamIPFamily(t *testing.T) {
+	addrs := []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2"}
+	for family, want := range map[string]string{
+		config.IPFamilyAuto:       "2001:db8::1 192.0.2.1 2001:db8::2 192.0.2.2",
+		config.IPFamilyIPv4:       "192.0.2.1 192.0.2.2",
+		config.IPFamilyIPv6:       "2001:db8::1 2001:db8::2",
+		config.IPFamilyPreferIPv4: "192.0.2.1 192.0.2.2 2001:db8::1 2001:db8::2",
+		config.IPFamilyPreferIPv6: "2001:db8::1 2001:db8::2 192.0.2.1 192.0.2.2",
+	} {
+		if got := strings.Join(orderAddrs(addrs, family), " "); got != want {
+			t.Errorf("%s: expected %q, got %q", family, want, got)
+		}
+	}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("\x89PNG\r\n\x1a\n"))
+	}))
+	defer upstream.Close()
+	_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+
+	// 上游只在IPv4上监听，IPv6地址无法连接
+	get := func(family string) int {
+		h := newTestHandler(t, &config.Config{
+			CacheTTL:         time.Hour,
+			UpstreamBases:    []string{"http://avatars.invalid:" + port},
+			UpstreamHosts:    map[string][]string{"avatars.invalid": {"::1", "127.0.0.1"}},
+			UpstreamIPFamily: family,
+			FallbackLadder:   []string{"502"},
+		})
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/avatar/"+strings.Repeat("a", 32), nil))
+		return rec.Code
+	}
+	for _, family := range []string{config.IPFamilyIPv4, config.IPFamilyPreferIPv4, config.IPFamilyAuto} {
+		if code := get(family); code != http.StatusOK {
+			t.Errorf("%s: expected the IPv4 address to be reached, got %d", family, code)
+		}
+	}
+	if code := get(config.IPFamilyIPv6); code != http.StatusBadGateway {
+		t.Errorf("ipv6: expected only the unreachable IPv6 address to be tried, got %d", code)
+	}
+}
+
+func TestUpstreamDialRace(t *testing.T) {
+	r := newUpstreamResolver(&config.Config{
+		UpstreamHosts: map[string][]string{
+			"dual.invalid": {"2001:db8::1", "2001:db8::2", "192.0.2.1"},
+			"v4.invalid":   {"192.0.2.1", "192.0.2.2", "192.0.2.3"},
+		},
+		UpstreamDialTimeout: 9 * time.Second,
+	})
+
+	// IPv6地址不响应，直到建连被取消；IPv4地址立即连接成功
+	var mu sync.Mutex
+	var dialed []string
+	canceled := make(chan string, 2)
+	dial := r.dialContext(func(ctx context.Context, network, address string) (net.Conn, error) {
+		mu.Lock()
+		dialed = append(dialed, address)
+		mu.Unlock()
+		if strings.HasPrefix(address, "[") {
+			<-ctx.Done()
+			canceled <- address
+			return nil, ctx.Err()
+		}
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	})
+	start := time.Now()
+	conn, err := dial(context.Background(), "tcp", "dual.invalid:443")
+	if err != nil {
+		t.Fatalf("expected the IPv4 address to connect while IPv6 hangs: %v", err)
+	}
+	conn.Close()
+	if elapsed := time.Since(start); elapsed < fallbackDelay || elapsed > 2*time.Second {
+		t.Errorf("expected IPv4 to start after the fallback delay, took %v", elapsed)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Error("expected the losing IPv6 dial to be canceled")
+	}
+	mu.Lock()
+	if got := strings.Join(dialed, " "); got != "[2001:db8::1]:443 192.0.2.1:443" {
+		t.Errorf("expected the second IPv6 address to wait for the first, got %q", got)
+	}
+	mu.Unlock()
+
+	// 同一族的地址依次尝试，建连时间平分给尚未尝试的地址
+	var timeouts []time.Duration
+	dial = r.dialContext(func(ctx context.Context, network, address string) (net.Conn, error) {
+		deadline, _ := ctx.Deadline()
+		timeouts = append(timeouts, time.Until(deadline))
+		return nil, errors.New("refused")
+	})
+	if _, err := dial(context.Background(), "tcp", "v4.invalid:443"); err == nil {
+		t.Fatal("expected the dial to fail when every address fails")
+	}
+	if len(timeouts) != 3 || timeouts[0] > 3*time.Second || timeouts[0] < 2*time.Second {
+		t.Errorf("expected each of 3 addresses to get a third of the dial timeout, got %v", timeouts)
+	}
+}
+
+func TestCacheJanitor(t *testing.T) {
+	h := newTestHandler(t, &config.Config{
+		UpstreamBases:    []string{"http://127.0.0.1:1"},
+		CacheTTL:         time.Hour,
+		CacheExpiryGrace: time.Hour,
+	})
+	now := time.Now()
+	for key, age := range map[string]time.Duration{"fresh": time.Minute, "grace": 90 * time.Minute, "old": 3 * time.Hour} {
+		if err := h.cache.Set(key, make([]byte, 100), cache.Metadata{CreatedAt: now.Add(-age), StatusCode: http.StatusOK}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, bytes := cacheExpiredDeletedEntries.Value(), cacheExpiredDeletedBytes.Value()
+	if stats := h.deleteExpired(now); stats != (cache.ExpireStats{Entries: 1, Bytes: 100}) {
+		t.Fatalf("expected only the entry past TTL plus grace to be deleted, got %+v", stats)
+	}
+	if got := cacheExpiredDeletedEntries.Value() - entries; got != 1 {
+		t.Errorf("expected 1 deleted entry counted, got %v", got)
+	}
+	if got := cacheExpiredDeletedBytes.Value() - bytes; got != 100 {
+		t.Errorf("expected 100 deleted bytes counted, got %v", got)
+	}
+	if entry, _ := h.cache.Peek("grace"); entry == nil {
+		t.Error("expected the entry within the grace period to be kept for stale responses")
+	}
+}
+
+func TestCacheWarmup(t *testing.T) {
+	var mu sync.Mutex
+	fetched := map[string]bool{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched[r.URL.Path+"?s="+r.URL.Query().Get("s")] = true
+		mu.Unlock()
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("png"))
+	}))
+	defer upstream.Close()
+
+	hashA, hashB, hashC := strings.Repeat("a", 32), strings.Repeat("b", 64), strings.Repeat("c", 32)
+	seedFile := t.TempDir() + "/seed.txt"
+	seed := "# hashes to warm\n" + strings.ToUpper(hashA) + " 80,200\n" + hashB + "\nnot-a-hash\n" + hashC + " 0\n"
+	if err := os.WriteFile(seedFile, []byte(seed), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:      time.Hour,
+		UpstreamBases: []string{upstream.URL},
+		AdminToken:    "secret",
+		WarmupSeed:    seedFile,
+	})
+
+	jobs, invalid := h.parseWarmupSeed([]byte(seed))
+	if len(jobs) != 3 || invalid != 2 {
+		t.Fatalf("expected 3 avatars and 2 invalid lines, got %d and %d", len(jobs), invalid)
+	}
+
+	waitFetched := func(keys ...string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			mu.Lock()
+			missing := []string{}
+			for _, key := range keys {
+				if !fetched[key] {
+					missing = append(missing, key)
+				}
+			}
+			mu.Unlock()
+			if len(missing) == 0 {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected warm-up to fetch %v", missing)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h.StartPrefetch(ctx)
+	h.StartWarmup(ctx)
+	waitFetched("/avatar/"+hashA+"?s=80", "/avatar/"+hashA+"?s=200", "/avatar/"+hashB+"?s=")
+
+	// 管理接口触发：请求体中的列表优先于WARMUP_SEED
+	req := httptest.NewRequest(http.MethodPost, "/admin/warmup", strings.NewReader(hashC+" 40\n"))
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	h.AdminHandler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", rec.Code, rec.Body.String())
+	}
+	waitFetched("/avatar/" + hashC + "?s=40")
+
+	req = httptest.NewRequest(http.MethodGet, "/admin/warmup", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	h.AdminHandler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 for GET, got %d", rec.Code)
+	}
+}
+
+func TestCacheListPagination(t *testing.T) {
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:      time.Hour,
+		UpstreamBases: []string{"http://127.0.0.1:1"},
+		AdminToken:    "secret",
+	})
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		key := strings.Repeat(strconv.Itoa(i), 64)
+		if err := h.cache.Set(key, make([]byte, 10*(i+1)), cache.Metadata{CreatedAt: now, StatusCode: http.StatusOK, Path: "/avatar/x"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	get := func(query string) (int, cacheListPage) {
+		req := httptest.NewRequest(http.MethodGet, "/admin/cache?"+query, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		h.AdminHandler().ServeHTTP(rec, req)
+		var page cacheListPage
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rec.Code, page
+	}
+
+	var sizes []int64
+	cursor := ""
+	for pages := 0; ; pages++ {
+		code, page := get("sort=size&limit=2&cursor=" + cursor)
+		if code != http.StatusOK || page.Total != 5 || pages > 3 {
+			t.Fatalf("unexpected page %d: status %d, %+v", pages, code, page)
+		}
+		for _, e := range page.Entries {
+			sizes = append(sizes, e.Size)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	if len(sizes) != 5 || sizes[0] != 50 || sizes[4] != 10 {
+		t.Errorf("expected 5 entries from largest to smallest, got %v", sizes)
+	}
+
+	_, first := get("sort=size&limit=2")
+	if code, _ := get("sort=age&cursor=" + first.NextCursor); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a cursor from another sort order, got %d", code)
+	}
+	if code, _ := get("sort=name"); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown sort order, got %d", code)
+	}
+}
+
+func TestBatchPrefetch(t *testing.T) {
+	var requests atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if strings.Contains(r.URL.Path, strings.Repeat("f", 32)) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("png"))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:      time.Hour,
+		UpstreamBases: []string{upstream.URL},
+		AdminToken:    "secret",
+	})
+
+	post := func(body string) (int, map[string]any) {
+		req := httptest.NewRequest(http.MethodPost, "/admin/prefetch", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		h.AdminHandler().ServeHTTP(rec, req)
+		var resp map[string]any
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec.Code, resp
+	}
+
+	hashA, hashF := strings.Repeat("a", 32), strings.Repeat("f", 32)
+	body := `[{"hash":"` + hashA + `","params":{"s":"80"}},{"hash":"` + hashF + `"},{"hash":"nope"}]`
+	code, resp := post(body)
+	if code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	results := resp["results"].([]any)
+	want := []string{"fetched", "failed", "invalid"}
+	for i, r := range results {
+		if got := r.(map[string]any)["result"]; got != want[i] {
+			t.Errorf("item %d: expected %s, got %v", i, want[i], got)
+		}
+	}
+	if key := results[0].(map[string]any)["key"]; key != h.cache.GenerateKey("/avatar/"+hashA, map[string]string{"s": "80"}) {
+		t.Errorf("expected the cache key of the fetched avatar, got %v", key)
+	}
+	if entry, valid := h.cache.Peek(results[0].(map[string]any)["key"].(string)); entry == nil || !valid {
+		t.Error("expected the fetched avatar to be cached")
+	}
+
+	// 已缓存的头像不再请求上游
+	before := requests.Load()
+	_, resp = post(`[{"hash":"` + hashA + `","params":{"s":"80"}}]`)
+	if got := resp["results"].([]any)[0].(map[string]any)["result"]; got != "cached" || requests.Load() != before {
+		t.Errorf("expected a cached result without an upstream request, got %v", got)
+	}
+
+	// 正在由其他任务载入的头像还没有缓存条目
+	hashB := strings.Repeat("b", 32)
+	h.revalidating.Store(h.cache.GenerateKey("/avatar/"+hashB, map[string]string{}), struct{}{})
+	_, resp = post(`[{"hash":"` + hashB + `"}]`)
+	if got := resp["results"].([]any)[0].(map[string]any)["result"]; got != "in_flight" {
+		t.Errorf("expected an avatar being fetched elsewhere to be reported as in_flight, got %v", got)
+	}
+
+	if code, _ := post(`{"hash":"x"}`); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a non-array body, got %d", code)
+	}
+}
+
+func TestClusterOverview(t *testing.T) {
+	peer := newTestHandler(t, &config.Config{
+		CacheTTL:      time.Hour,
+		UpstreamBases: []string{"http://127.0.0.1:1"},
+		AdminToken:    "secret",
+		Instance:      config.Identity{Name: "proxy-b", Zone: "zone-b"},
+	})
+	peerServer := httptest.NewServer(peer.AdminHandler())
+	defer peerServer.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:      time.Hour,
+		UpstreamBases: []string{"http://127.0.0.1:1"},
+		AdminToken:    "secret",
+		Instance:      config.Identity{Name: "proxy-a"},
+		PurgePeers:    []string{peerServer.URL + "/", "http://127.0.0.1:1"},
+	})
+	now := time.Now()
+	h.cache.Set("a", make([]byte, 100), cache.Metadata{CreatedAt: now, StatusCode: http.StatusOK})
+	peer.cache.Set("b1", make([]byte, 10), cache.Metadata{CreatedAt: now, StatusCode: http.StatusOK})
+	peer.cache.Set("b2", make([]byte, 20), cache.Metadata{CreatedAt: now, StatusCode: http.StatusOK})
+	h.cache.Get("a")
+	peer.cache.Get("b1")
+	peer.cache.Get("missing")
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/cluster", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	h.AdminHandler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	var resp struct {
+		Members []clusterMember `json:"members"`
+		Totals  clusterTotals   `json:"totals"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	want := clusterTotals{Members: 3, Reachable: 2, Entries: 3, Bytes: 130, MaxBytes: 2 * 1024 * 1024, Hits: 2, Misses: 1, HitRatio: 2.0 / 3}
+	if resp.Totals != want {
+		t.Errorf("expected totals %+v, got %+v", want, resp.Totals)
+	}
+	if len(resp.Members) != 3 || !resp.Members[0].Self || resp.Members[0].Instance != "proxy-a" {
+		t.Fatalf("expected this instance first, got %+v", resp.Members)
+	}
+	down, up := resp.Members[1], resp.Members[2]
+	if down.URL != "http://127.0.0.1:1" || down.Reachable || down.Error == "" {
+		t.Errorf("expected the unreachable peer to carry an error, got %+v", down)
+	}
+	if up.URL != peerServer.URL || !up.Reachable || up.Instance != "proxy-b" || up.Zone != "zone-b" || up.Cache.Entries != 2 || len(up.Roles) != 1 || up.Roles[0] != "purge" {
+		t.Errorf("unexpected peer entry %+v", up)
+	}
+}
+
+func TestFeatureFlags(t *testing.T) {
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:      time.Hour,
+		UpstreamBases: []string{"http://127.0.0.1:1"},
+		AdminToken:    "secret",
+		FeatureFlags:  map[string]bool{config.FeatureBatch: false},
+	})
+
+	admin := func(method, target, body string) (int, string) {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		h.AdminHandler().ServeHTTP(rec, req)
+		return rec.Code, rec.Body.String()
+	}
+
+	if code, _ := admin(http.MethodPost, "/admin/prefetch", "[]"); code != http.StatusServiceUnavailable {
+		t.Fatalf("batch prefetch with batch disabled: status %d, want 503", code)
+	}
+	code, body := admin(http.MethodGet, "/admin/features", "")
+	if code != http.StatusOK {
+		t.Fatalf("GET /admin/features: status %d", code)
+	}
+	var flags map[string]bool
+	if err := json.Unmarshal([]byte(body), &flags); err != nil {
+		t.Fatalf("decode features: %v", err)
+	}
+	if flags[config.FeatureBatch] || !flags[config.FeatureTransformations] || !flags[config.FeatureLocalDefaults] {
+		t.Errorf("features = %v, want only batch disabled", flags)
+	}
+
+	if code, _ := admin(http.MethodPost, "/admin/features?name=batch&enabled=true", ""); code != http.StatusOK {
+		t.Fatalf("enable batch: status %d", code)
+	}
+	if code, _ := admin(http.MethodPost, "/admin/prefetch", "[]"); code == http.StatusServiceUnavailable {
+		t.Error("batch prefetch still disabled after enabling it at runtime")
+	}
+
+	if code, _ := admin(http.MethodPost, "/admin/features?name=profiles&enabled=true", ""); code != http.StatusBadRequest {
+		t.Errorf("unknown feature: status %d, want 400", code)
+	}
+	if code, _ := admin(http.MethodPost, "/admin/features?name=batch&enabled=maybe", ""); code != http.StatusBadRequest {
+		t.Errorf("invalid enabled value: status %d, want 400", code)
+	}
+
+	if code, _ := admin(http.MethodPost, "/admin/features?name=local_defaults&enabled=false", ""); code != http.StatusOK {
+		t.Fatalf("disable local_defaults: status %d", code)
+	}
+	params := map[string]string{"d": "initials", "name": "Jane Doe"}
+	h.applyLocalDefaults(params)
+	if params["d"] != "initials" {
+		t.Errorf("d = %q with local_defaults disabled, want initials", params["d"])
+	}
+}
+
+func TestAdminPurgePrefixAndAll(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("png"))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:      time.Hour,
+		UpstreamBases: []string{upstream.URL},
+		AdminToken:    "secret",
+	})
+	for _, path := range []string{"/avatar/ab12?s=80", "/avatar/ab34", "/avatar/cd56"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	purge := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/admin/purge?"+query, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		h.AdminHandler().ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, query := range []string{"prefix=xyz", "all=false", "all=yes"} {
+		if rec := purge(query); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, rec.Code)
+		}
+	}
+
+	rec := purge("prefix=AB")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"purged":2`) {
+		t.Fatalf("expected both ab* hashes to be purged, got %d %s", rec.Code, rec.Body.String())
+	}
+	if keys := h.cache.KeysForHash("cd56"); len(keys) != 1 {
+		t.Errorf("expected other prefixes to stay cached, got %v", keys)
+	}
+
+	rec = purge("all=true")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"purged":1`) {
+		t.Fatalf("expected the remaining entry to be purged, got %d %s", rec.Code, rec.Body.String())
+	}
+	if stats := h.cache.Stats(); stats.Entries != 0 || stats.Bytes != 0 {
+		t.Errorf("expected an empty cache, got %+v", stats)
+	}
+}
+
+func TestCacheEvictionBackground(t *testing.T) {
+	dir := t.TempDir()
+	c, err := cache.New(dir, time.Hour, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 5 {
+		if err := c.Set("k"+strconv.Itoa(i), make([]byte, 100), cache.Metadata{CreatedAt: time.Now(), StatusCode: http.StatusOK}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.Close()
+
+	c, err = cache.New(dir, time.Hour, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewHandler(&config.Config{
+		UpstreamBases:     []string{"http://127.0.0.1:1"},
+		CacheTTL:          time.Hour,
+		CacheEvictionRate: 10,
+	}, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := cacheBackgroundEvictions.Value()
+	// 每秒10个，每100ms一批淘汰1个
+	for want := 4; want >= 2; want-- {
+		h.evictOverLimit()
+		if entries := c.Stats().Entries; entries != want {
+			t.Fatalf("expected one entry evicted per tick, %d left, want %d", entries, want)
+		}
+	}
+	if c.Overage() != 0 || h.evicting.Load() {
+		t.Errorf("expected eviction to finish at the limit, overage %d", c.Overage())
+	}
+	if got := cacheBackgroundEvictions.Value() - before; got != 3 {
+		t.Errorf("expected 3 background evictions counted, got %v", got)
+	}
+	h.evictOverLimit()
+	if entries := c.Stats().Entries; entries != 2 {
+		t.Errorf("expected no eviction within the limit, %d entries left", entries)
+	}
+}
+
+func TestUpstreamPinning(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("png"))
+	}))
+	defer upstream.Close()
+
+	// HTTPS代理使用另一张自签名证书，其公钥不在固定列表中；按localhost访问，与上游的127.0.0.1区分
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "proxy"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, pub, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tunnels atomic.Int32
+	proxy := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		tunnels.Add(1)
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+		go func() {
+			io.Copy(target, conn)
+			target.Close()
+		}()
+		io.Copy(conn, target)
+		conn.Close()
+	}))
+	proxy.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: priv}}}
+	proxy.StartTLS()
+	defer proxy.Close()
+	proxyURL := strings.Replace(proxy.URL, "127.0.0.1", "localhost", 1)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(upstream.Certificate())
+	roots.AddCert(proxy.Certificate())
+
+	fetch := func(upstreamProxy string, pins []string) error {
+		t.Helper()
+		client, err := newUpstreamClient(&config.Config{UpstreamProxy: upstreamProxy, UpstreamPins: pins}, newBandwidthMeter(0, ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 测试证书不在系统根证书中，在实际构造的Transport上补充信任
+		transport := client.Transport.(*bandwidthTransport).base.(*bodyTimeoutTransport).base.(*poolTransport).base.(*http.Transport)
+		transport.TLSClientConfig.RootCAs = roots
+		defer transport.CloseIdleConnections()
+		resp, err := client.Get(upstream.URL + "/avatar/abc")
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	unknownPin := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	if err := fetch(config.UpstreamProxyDirect, []string{unknownPin, spkiPin(upstream.Certificate())}); err != nil {
+		t.Fatalf("expected a matching pin to be accepted, got %v", err)
+	}
+
+	before := upstreamPinMismatches.Value()
+	err = fetch(config.UpstreamProxyDirect, []string{unknownPin})
+	if !errors.Is(err, errPinMismatch) {
+		t.Fatalf("expected a pin mismatch, got %v", err)
+	}
+	if class := classifyError(err); class != errorClassTLS {
+		t.Errorf("expected a pin mismatch to be classified as tls, got %s", class)
+	}
+	if got := upstreamPinMismatches.Value() - before; got != 1 {
+		t.Errorf("expected 1 pin mismatch counted, got %v", got)
+	}
+
+	// 经HTTPS代理时，与代理的握手不按固定公钥检查，隧道内与上游的握手仍然检查
+	before = upstreamPinMismatches.Value()
+	if err := fetch(proxyURL, []string{spkiPin(upstream.Certificate())}); err != nil {
+		t.Fatalf("expected the proxy's own certificate not to be pinned, got %v", err)
+	}
+	if tunnels.Load() != 1 {
+		t.Fatalf("expected the request to go through the proxy, %d tunnels", tunnels.Load())
+	}
+	err = fetch(proxyURL, []string{unknownPin})
+	if !errors.Is(err, errPinMismatch) {
+		t.Fatalf("expected a pin mismatch through the proxy, got %v", err)
+	}
+	if tunnels.Load() != 2 {
+		t.Errorf("expected the mismatch to come from the tunneled handshake, %d tunnels", tunnels.Load())
+	}
+	if got := upstreamPinMismatches.Value() - before; got != 1 {
+		t.Errorf("expected only the upstream mismatch counted, got %v", got)
+	}
+}
+
+func TestAvatarParams(t *testing.T) {
+	var mu sync.Mutex
+	var upstreamQuery url.Values
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		upstreamQuery = r.URL.Query()
+		mu.Unlock()
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("png"))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{
+		CacheTTL:      time.Hour,
+		UpstreamBases: []string{upstream.URL},
+		AvatarParams:  []string{"s", "d", "initials"},
+	})
+
+	before := queryParamsDropped.Value()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/avatar/abc?s=80&initials=JD&r=pg&foo=1", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	mu.Lock()
+	got := upstreamQuery
+	mu.Unlock()
+	if got.Get("s") != "80" || got.Get("initials") != "JD" {
+		t.Errorf("expected configured params to be forwarded, got %v", got)
+	}
+	if got.Has("r") || got.Has("foo") {
+		t.Errorf("expected params outside AVATAR_PARAMS to be stripped, got %v", got)
+	}
+	if dropped := queryParamsDropped.Value() - before; dropped != 2 {
+		t.Errorf("expected 2 dropped params counted, got %v", dropped)
+	}
+
+	// 去掉的参数不参与缓存键，与不带这些参数的请求共用条目
+	key := h.cache.GenerateKey("/avatar/abc", h.requestParams(url.Values{"s": {"80"}, "initials": {"JD"}, "r": {"g"}}))
+	if other := h.cache.GenerateKey("/avatar/abc", map[string]string{"s": "80", "initials": "JD"}); key != other {
+		t.Errorf("expected stripped params not to change the cache key")
+	}
+}
+
+func TestBytesSaved(t *testing.T) {
+	body := bytes.Repeat([]byte("x"), 100)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(body)
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, &config.Config{CacheTTL: time.Hour, UpstreamBases: []string{upstream.URL}, AdminToken: "secret"})
+	before := cacheBytesSaved.Value()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/avatar/abc?s=80", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if saved := h.bytesSaved.Load(); saved != 0 {
+		t.Errorf("expected a miss to save nothing, got %d", saved)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/avatar/abc?s=80", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if saved := h.bytesSaved.Load(); saved != 100 {
+		t.Errorf("expected a hit to save 100 bytes, got %d", saved)
+	}
+
+	// 客户端的条件请求由缓存回答304，同样省去了一次上游下载
+	req := httptest.NewRequest("GET", "/avatar/abc?s=80", nil)
+	req.Header.Set("If-None-Match", rec.Header().Get("ETag"))
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Fatalf("expected 304, got %d", rec.Code)
+	}
+	if saved := h.bytesSaved.Load(); saved != 200 {
+		t.Errorf("expected 200 bytes saved after a conditional hit, got %d", saved)
+	}
+	if delta := cacheBytesSaved.Value() - before; delta != 200 {
+		t.Errorf("expected metric to grow by 200, got %v", delta)
+	}
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/admin/stats", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	h.AdminHandler().ServeHTTP(rec, req)
+	var stats struct {
+		BytesSaved int64 `json:"bytes_saved"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.BytesSaved != 200 {
+		t.Errorf("expected bytes_saved 200 in stats, got %d", stats.BytesSaved)
+	}
+
+	// 过期条目先原样返回再在后台重新验证：上游回答304时才算省下，上游返回新内容时下载了响应体，不算
+	var changed atomic.Bool
+	revalidating := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		etag := `"v1"`
+		if changed.Load() {
+			etag = `"v2"`
+		}
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(body)
+	}))
+	defer revalidating.Close()
+
+	stale := newTestHandler(t, &config.Config{
+		CacheTTL:             50 * time.Millisecond,
+		UpstreamBases:        []string{revalidating.URL},
+		StaleWhileRevalidate: time.Hour,
+	})
+	t.Cleanup(func() { waitRevalidations(stale) })
+	serveStale := func() {
+		t.Helper()
+		time.Sleep(100 * time.Millisecond)
+		rec := httptest.NewRecorder()
+		stale.ServeHTTP(rec, httptest.NewRequest("GET", "/avatar/abc", nil))
+		if rec.Code != http.StatusOK || rec.Body.Len() != len(body) {
+			t.Fatalf("expected the stale entry to be served, got %d with %d bytes", rec.Code, rec.Body.Len())
+		}
+		waitRevalidations(stale)
+	}
+
+	stale.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/avatar/abc", nil))
+	serveStale()
+	if saved := stale.bytesSaved.Load(); saved != 100 {
+		t.Errorf("expected a background revalidation answered with 304 to save 100 bytes, got %d", saved)
+	}
+	changed.Store(true)
+	serveStale()
+	if saved := stale.bytesSaved.Load(); saved != 100 {
+		t.Errorf("expected a background revalidation that downloaded the body to save nothing, got %d", saved)
+	}
+}
+
+func TestTestAvatarDeterministic(t *testing.T) {
+	h := newTestHandler(t, &config.Config{CacheTTL: time.Hour})
+	get := func(path string) []byte {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.TestAvatarHandler(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200 for %s, got %d", path, rec.Code)
+		}
+		return rec.Body.Bytes()
+	}
+
+	for _, style := range []string{"identicon", "initials"} {
+		first := get("/testavatar/alice?style=" + style)
+		if again := get("/testavatar/alice?style=" + style); !bytes.Equal(first, again) {
+			t.Errorf("expected %s to be byte-identical for the same seed", style)
+		}
+		if other := get("/testavatar/bob?style=" + style); bytes.Equal(first, other) {
+			t.Errorf("expected %s to differ between seeds", style)
+		}
+	}
+}
+
+func TestTestAvatarConditional(t *testing.T) {
+	h := newTestHandler(t, &config.Config{CacheTTL: time.Hour})
+
+	rec := httptest.NewRecorder()
+	h.TestAvatarHandler(rec, httptest.NewRequest("GET", "/testavatar/alice", nil))
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || etag == "" {
+		t.Fatalf("expected 200 with an ETag, got %d and %q", rec.Code, etag)
+	}
+
+	req := httptest.NewRequest("GET", "/testavatar/alice", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	h.TestAvatarHandler(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Fatalf("expected 304 for a matching If-None-Match, got %d", rec.Code)
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("expected no body on 304, got %d bytes", rec.Body.Len())
+	}
+}
+
+func TestTestAvatarCacheControl(t *testing.T) {
+	h := newTestHandler(t, &config.Config{CacheTTL: time.Hour})
+
+	rec := httptest.NewRecorder()
+	h.TestAvatarHandler(rec, httptest.NewRequest("GET", "/testavatar/alice?s=64", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if cc := rec.Header().Get("Cache-Control"); cc != "public, max-age=31536000, immutable" {
+		t.Errorf("expected an immutable Cache-Control, got %q", cc)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "image/png" {
+		t.Errorf("expected image/png, got %q", ct)
+	}
+}
+
+func TestTestAvatarBadRequest(t *testing.T) {
+	h := newTestHandler(t, &config.Config{CacheTTL: time.Hour})
+
+	for _, path := range []string{"/testavatar/", "/testavatar/alice?style=nope"} {
+		rec := httptest.NewRecorder()
+		h.TestAvatarHandler(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("expected 400 for %s, got %d", path, rec.Code)
+		}
+	}
+}
+
+func TestTestAvatarNotCached(t *testing.T) {
+	h := newTestHandler(t, &config.Config{CacheTTL: time.Hour})
+
+	for _, path := range []string{"/testavatar/alice", "/testavatar/bob?style=initials&s=128"} {
+		rec := httptest.NewRecorder()
+		h.TestAvatarHandler(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200 for %s, got %d", path, rec.Code)
+		}
+	}
+	if entries := h.cache.Stats().Entries; entries != 0 {
+		t.Errorf("expected test avatars not to be cached, got %d entries", entries)
+	}
+	files, _ := os.ReadDir(h.cache.Dir())
+	for _, f := range files {
+		if !strings.HasPrefix(f.Name(), "index") {
+			t.Errorf("expected no avatar files in the cache directory, found %s", f.Name())
+		}
+	}
+}
+
+func TestSourceAddress(t *testing.T) {
+	var loopback string
+	ifaces, _ := net.Interfaces()
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagLoopback != 0 {
+			loopback = ifi.Name
+			break
+		}
+	}
+
+	type sourceCase struct {
+		name    string
+		addr    string
+		iface   string
+		want    string
+		wantErr bool
+	}
+	tests := []sourceCase{
+		{name: "unset"},
+		{name: "invalid address", addr: "not-an-ip", wantErr: true},
+		{name: "ipv4 address", addr: "192.0.2.10", want: "192.0.2.10"},
+		{name: "ipv6 address", addr: "2001:db8::10", want: "2001:db8::10"},
+		{name: "address wins over interface", addr: "192.0.2.10", iface: "no-such-iface0", want: "192.0.2.10"},
+		{name: "unknown interface", iface: "no-such-iface0", wantErr: true},
+	}
+	if loopback != "" {
+		// 回环网卡同时有127.0.0.1和::1时取IPv4地址
+		tests = append(tests, sourceCase{name: "loopback interface", iface: loopback, want: "127.0.0.1"})
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip, err := sourceAddress(tt.addr, tt.iface)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if got := ip.String(); tt.want != "" && got != tt.want || tt.want == "" && ip != nil {
+				t.Errorf("expected %q, got %v", tt.want, ip)
+			}
+		})
+	}
+
+	ipnet := func(s string) net.Addr { return &net.IPNet{IP: net.ParseIP(s), Mask: net.CIDRMask(64, 128)} }
+	picks := []struct {
+		name  string
+		addrs []net.Addr
+		want  string
+	}{
+		{"ipv4 preferred over earlier ipv6", []net.Addr{ipnet("2001:db8::1"), ipnet("192.0.2.1")}, "192.0.2.1"},
+		{"link-local skipped", []net.Addr{ipnet("fe80::1"), ipnet("169.254.0.1"), ipnet("2001:db8::1")}, "2001:db8::1"},
+		{"first ipv6 without ipv4", []net.Addr{ipnet("2001:db8::1"), ipnet("2001:db8::2")}, "2001:db8::1"},
+		{"only link-local", []net.Addr{ipnet("fe80::1")}, "<nil>"},
+		{"non-IPNet skipped", []net.Addr{&net.TCPAddr{IP: net.ParseIP("192.0.2.9")}}, "<nil>"},
+	}
+	for _, tt := range picks {
+		if got := interfaceSourceIP(tt.addrs).String(); got != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestUpstreamSourceAddr(t *testing.T) {
+	var mu sync.Mutex
+	var remote string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		remote = r.RemoteAddr
+		mu.Unlock()
+	}))
+	defer upstream.Close()
+
+	if _, err := newUpstreamClient(&config.Config{UpstreamSourceAddr: "bogus"}, newBandwidthMeter(0, "")); err == nil {
+		t.Error("expected an invalid source address to fail client construction")
+	}
+
+	// 127.0.0.0/8内的任意地址在Linux上都可以绑定，其他系统上可能不行
+	client, err := newUpstreamClient(&config.Config{UpstreamSourceAddr: "127.0.0.2", UpstreamProxy: config.UpstreamProxyDirect}, newBandwidthMeter(0, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(upstream.URL)
+	if err != nil {
+		t.Skipf("cannot bind to 127.0.0.2 here: %v", err)
+	}
+	resp.Body.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	if host, _, _ := net.SplitHostPort(remote); host != "127.0.0.2" {
+		t.Errorf("expected upstream connections from 127.0.0.2, got %s", remote)
+	}
+}
@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimitSweepInterval 清理空闲令牌桶的间隔，桶已回满的客户端不需要继续记录
+const rateLimitSweepInterval = time.Minute
+
+// rateLimiter 按客户端IP的令牌桶限流：每秒补充rate个令牌，最多积累burst个
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter 在rate不大于0时返回nil，表示不限流
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// allow 消耗客户端的一个令牌，令牌不足时返回false
+func (l *rateLimiter) allow(client string) bool {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) >= rateLimitSweepInterval {
+		l.sweepLocked(now)
+	}
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+		rateLimitClients.Set(float64(len(l.buckets)))
+	} else {
+		b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+		b.last = now
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweepLocked 删除已回满的令牌桶，重新出现的客户端会得到一个满桶，结果相同
+func (l *rateLimiter) sweepLocked(now time.Time) {
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+	l.lastSweep = now
+	rateLimitClients.Set(float64(len(l.buckets)))
+}
+
+// clientIP 返回请求的客户端地址
+// 直连地址属于TRUSTED_PROXIES时，从右向左跳过受信任代理，取X-Forwarded-For中第一个不受信任的地址
+func (h *Handler) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !containsIP(h.trustedProxies, host) {
+		return host
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		host = hop
+		if !containsIP(h.trustedProxies, hop) {
+			break
+		}
+	}
+	return host
+}
+
+func containsIP(networks []*net.IPNet, host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRateLimit 超出限流时写出429并返回false
+func (h *Handler) checkRateLimit(w http.ResponseWriter, r *http.Request, s *settings, requestID string) bool {
+	limiter := s.limiter
+	if limiter == nil {
+		return true
+	}
+	if limiter.allow(h.clientIP(r)) {
+		rateLimitRequests.Inc("allowed")
+		return true
+	}
+	rateLimitRequests.Inc("limited")
+	h.auditDenied(r, denyRateLimited, http.StatusTooManyRequests, requestID)
+	h.setRetryAfter(w, retryRateLimit)
+	http.Error(w, "Too many requests", http.StatusTooManyRequests)
+	return false
+}
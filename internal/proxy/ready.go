@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"gravatar-proxy/internal/config"
+	"gravatar-proxy/internal/log"
+)
+
+const (
+	// readyProbeTimeout 为就绪检查中每个上游探测请求的超时
+	readyProbeTimeout = 2 * time.Second
+	// readyProbeHash 是探测上游时请求的头像哈希（空字符串的MD5），配合d=404只返回很小的响应
+	readyProbeHash = "d41d8cd98f00b204e9800998ecf8427e"
+	// readyCacheInterval 为就绪检查结果的复用时长，负载均衡频繁探测时缓存目录写入和上游探测最多每个间隔执行一次
+	readyCacheInterval = time.Second
+)
+
+// readiness 保存最近一次就绪检查的结果；检查进行中到达的探测等待并共用这次结果
+type readiness struct {
+	mu        sync.Mutex
+	checkedAt time.Time
+	status    int
+	checks    map[string]string
+}
+
+// ReadyHandler 返回就绪状态：缓存索引已加载且缓存目录可写，启用READY_CHECK_UPSTREAM时还要求上游能响应
+// 与只表示进程存活的/healthz不同，任一检查失败时返回503，负载均衡据此停止向本实例转发流量
+func (h *Handler) ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	requestID := h.requestID(w, r)
+
+	status, checks := h.checkReadiness(r.Context())
+	result := "ok"
+	if status != http.StatusOK {
+		result = "unavailable"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+		config.Identity
+	}{result, checks, h.instance})
+	log.LogRequest(r.Method, r.URL.Path, status, time.Since(startTime), requestID)
+}
+
+// checkReadiness 返回就绪检查的状态码和各项结果，距上次检查不足readyInterval时直接复用上次的结果
+// 检查不随发起探测的请求取消，结果会被其他探测复用
+func (h *Handler) checkReadiness(ctx context.Context) (int, map[string]string) {
+	h.ready.mu.Lock()
+	defer h.ready.mu.Unlock()
+	if !h.ready.checkedAt.IsZero() && time.Since(h.ready.checkedAt) < h.readyInterval {
+		return h.ready.status, h.ready.checks
+	}
+
+	ctx = context.WithoutCancel(ctx)
+	status := http.StatusOK
+	checks := make(map[string]string)
+	check := func(name string, err error) {
+		if err == nil {
+			checks[name] = "ok"
+			return
+		}
+		status = http.StatusServiceUnavailable
+		checks[name] = err.Error()
+		log.Warn("readiness check failed", "check", name, "error", err)
+	}
+	check("cache", h.cache.Ready())
+	if h.readyCheckUpstream {
+		check("upstream", h.probeUpstream(ctx))
+	}
+
+	h.ready.checkedAt, h.ready.status, h.ready.checks = time.Now(), status, checks
+	return status, checks
+}
+
+// probeUpstream 依次向上游链发送HEAD探测，任一上游返回非5xx响应即视为可用
+func (h *Handler) probeUpstream(ctx context.Context) error {
+	var lastErr error
+	for _, template := range h.upstreamChain() {
+		base := expandUpstream(template, h.region)
+		if lastErr = h.probe(ctx, base); lastErr == nil {
+			return nil
+		}
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no upstream configured")
+	}
+	return lastErr
+}
+
+func (h *Handler) probe(ctx context.Context, base string) error {
+	ctx, cancel := context.WithTimeout(ctx, readyProbeTimeout)
+	defer cancel()
+
+	probeURL, err := buildUpstreamURL(base, readyProbeHash, map[string]string{"d": "404"})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, probeURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("upstream %s unreachable: %w", base, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("upstream %s returned %d", base, resp.StatusCode)
+	}
+	return nil
+}
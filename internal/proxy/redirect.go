@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gravatar-proxy/internal/cache"
+	"gravatar-proxy/internal/log"
+	"gravatar-proxy/internal/tracing"
+)
+
+// maxRedirects 跟随重定向的最大跳数
+const maxRedirects = 10
+
+// redirectKeyHeader 内部标记：响应内容来自重定向目标的缓存条目，值为该条目的缓存键
+// 只存在于上游响应对象上，不会写入缓存元数据或发给客户端
+const redirectKeyHeader = "X-Proxy-Redirect-Key"
+
+func isRedirect(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// redirectKey 返回重定向目标地址的缓存键，与头像哈希无关，所有指向同一地址的头像共用
+func (h *Handler) redirectKey(target string) string {
+	return h.cache.GenerateKey("/redirect", map[string]string{"url": target})
+}
+
+// followRedirect 跟随上游的重定向（通常是d=指定的默认图片地址），目标的内容按目标地址单独缓存
+// 目标条目有效时不再请求目标；返回的响应带有redirectKeyHeader，头像条目据此与目标条目共用数据文件
+func (h *Handler) followRedirect(ctx context.Context, resp *http.Response, requestID string) (*http.Response, error) {
+	location, err := resp.Location()
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("invalid redirect from upstream: %w", err)
+	}
+	target := location.String()
+	key := h.redirectKey(target)
+
+	entry, valid := h.cache.Peek(key)
+	if valid {
+		redirectTargets.Inc("hit")
+		log.Info("redirect target cache hit", "request_id", requestID, "target", target, "key", key)
+		return h.cachedRedirectResponse(key)
+	}
+
+	targetResp, err := h.fetchRedirectTarget(ctx, target, entry, requestID)
+	if err != nil {
+		return nil, err
+	}
+
+	if targetResp.StatusCode == http.StatusNotModified && entry != nil {
+		targetResp.Body.Close()
+		metadata := entry.Metadata
+		metadata.Revalidated(time.Now())
+		if err := h.cache.UpdateMetadata(key, metadata); err != nil {
+			log.Warn("failed to update metadata", "error", err, "request_id", requestID)
+		}
+		redirectTargets.Inc("revalidated")
+		return h.cachedRedirectResponse(key)
+	}
+
+	// 目标的错误响应按原样交给调用方，不单独缓存
+	if targetResp.StatusCode != http.StatusOK {
+		redirectTargets.Inc("uncached")
+		return targetResp, nil
+	}
+
+	if err := h.limitBody(targetResp); err != nil {
+		targetResp.Body.Close()
+		return nil, err
+	}
+	if err := h.checkContent(targetResp); err != nil {
+		discard(targetResp)
+		return nil, err
+	}
+	data, err := cache.ReadResponseBody(targetResp)
+	if err != nil {
+		return nil, err
+	}
+	metadata := cache.Metadata{
+		CreatedAt:      time.Now(),
+		LastAccessedAt: time.Now(),
+		Headers:        cache.ExtractHeaders(targetResp),
+		StatusCode:     http.StatusOK,
+		Upstream:       location.Scheme + "://" + location.Host,
+		Path:           target,
+	}
+	redirectTargets.Inc("fetched")
+	if err := h.cache.Set(key, data, metadata); err != nil {
+		log.Warn("failed to cache redirect target", "error", err, "request_id", requestID, "target", target)
+		return syntheticResponse(metadata, data, ""), nil
+	}
+	log.Info("cached redirect target", "request_id", requestID, "target", target, "key", key)
+	return syntheticResponse(metadata, data, key), nil
+}
+
+// fetchRedirectTarget 请求重定向目标，目标继续重定向时依次跟随；有过期的目标条目时发送条件请求
+func (h *Handler) fetchRedirectTarget(ctx context.Context, target string, entry *cache.CacheEntry, requestID string) (*http.Response, error) {
+	for i := 0; i < maxRedirects; i++ {
+		spanCtx, span := tracing.Start(ctx, "redirect.fetch", tracing.KindClient)
+		span.SetAttribute("url.full", target)
+		req, err := http.NewRequestWithContext(spanCtx, http.MethodGet, target, nil)
+		if err != nil {
+			span.SetError(err)
+			span.End()
+			return nil, err
+		}
+		tracing.Inject(spanCtx, req.Header)
+		req.Header.Set("Accept", h.upstreamAccept)
+		req.Header.Set(h.requestIDHeader, requestID)
+		if entry != nil {
+			if etag := entry.Metadata.Headers["ETag"]; etag != "" {
+				req.Header.Set("If-None-Match", etag)
+			}
+			if lastModified := entry.Metadata.Headers["Last-Modified"]; lastModified != "" {
+				req.Header.Set("If-Modified-Since", lastModified)
+			}
+		}
+
+		log.Info("following upstream redirect", "request_id", requestID, "url", target)
+		resp, err := h.client.Do(req)
+		if err != nil {
+			span.SetError(err)
+			span.End()
+			return nil, err
+		}
+		span.SetAttribute("http.response.status_code", resp.StatusCode)
+		span.End()
+		stripVary(resp, "redirect", requestID)
+		if !isRedirect(resp.StatusCode) {
+			return resp, nil
+		}
+
+		location, err := resp.Location()
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid redirect from %s: %w", target, err)
+		}
+		target = location.String()
+	}
+	return nil, fmt.Errorf("stopped after %d redirects", maxRedirects)
+}
+
+func (h *Handler) cachedRedirectResponse(key string) (*http.Response, error) {
+	metadata, data, err := h.readCached(key)
+	if err != nil {
+		return nil, err
+	}
+	return syntheticResponse(metadata, data, key), nil
+}
+
+// syntheticResponse 用缓存的内容构造上游响应；key非空时标记内容来自该重定向目标条目
+func syntheticResponse(metadata cache.Metadata, data []byte, key string) *http.Response {
+	header := make(http.Header, len(metadata.Headers)+1)
+	for k, v := range metadata.Headers {
+		header.Set(k, v)
+	}
+	if key != "" {
+		header.Set(redirectKeyHeader, key)
+	}
+	return &http.Response{
+		Status:        strconv.Itoa(metadata.StatusCode) + " " + http.StatusText(metadata.StatusCode),
+		StatusCode:    metadata.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(data)),
+		ContentLength: int64(len(data)),
+	}
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"slices"
+	"time"
+
+	"gravatar-proxy/internal/config"
+	"gravatar-proxy/internal/log"
+)
+
+// settings 是可以热加载的设置，加载后不再修改，重新加载时整体替换
+// 处理请求时先取一次快照，保证同一个请求看到的设置一致
+type settings struct {
+	upstreams      []string
+	ttl            time.Duration
+	allowedOrigins []string
+	corsMaxAge     time.Duration
+	// preflightCacheTTL 为成功的预检响应在共享缓存中的有效期，0表示不标记为可缓存
+	preflightCacheTTL time.Duration
+	// origins 缓存这一代允许列表下的来源判断，未配置ALLOWED_ORIGINS时为nil
+	origins *originDecisions
+
+	rateLimitRPS   float64
+	rateLimitBurst int
+	limiter        *rateLimiter
+}
+
+func newSettings(cfg *config.Config) *settings {
+	s := &settings{
+		upstreams:         cfg.UpstreamBases,
+		ttl:               cfg.CacheTTL,
+		allowedOrigins:    cfg.AllowedOrigins,
+		corsMaxAge:        cfg.CORSMaxAge,
+		preflightCacheTTL: cfg.PreflightCacheTTL,
+		rateLimitRPS:      cfg.RateLimitRPS,
+		rateLimitBurst:    cfg.RateLimitBurst,
+		limiter:           newRateLimiter(cfg.RateLimitRPS, cfg.RateLimitBurst),
+	}
+	if len(cfg.AllowedOrigins) > 0 {
+		s.origins = newOriginDecisions(cfg.AllowedOrigins)
+	}
+	return s
+}
+
+// current 返回当前生效的设置快照
+func (h *Handler) current() *settings {
+	return h.settings.Load()
+}
+
+// Reload 应用重新加载的配置中的允许来源、预检缓存时间（浏览器和共享缓存）、缓存有效期、限流和上游列表，不影响缓存索引和进行中的请求
+// 限流参数不变时保留已有的令牌桶；其余配置项仍需重启才能生效
+func (h *Handler) Reload(cfg *config.Config) {
+	old := h.current()
+	next := newSettings(cfg)
+	if next.rateLimitRPS == old.rateLimitRPS && next.rateLimitBurst == old.rateLimitBurst {
+		next.limiter = old.limiter
+	} else if next.limiter == nil {
+		rateLimitClients.Set(0)
+	}
+
+	h.settings.Store(next)
+	h.cache.SetTTL(cfg.CacheTTL)
+	configReloads.Inc()
+
+	log.Info("configuration reloaded",
+		"cache_ttl", next.ttl,
+		"upstream_bases", next.upstreams,
+		"allowed_origins", next.allowedOrigins,
+		"cors_max_age", next.corsMaxAge,
+		"preflight_cache_ttl", next.preflightCacheTTL,
+		"rate_limit_rps", next.rateLimitRPS,
+		"rate_limit_burst", next.rateLimitBurst,
+		"upstreams_changed", !slices.Equal(old.upstreams, next.upstreams),
+	)
+}
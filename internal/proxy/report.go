@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"gravatar-proxy/internal/cache"
+	"gravatar-proxy/internal/log"
+)
+
+// StartCacheReport 每隔reportInterval生成一次缓存审计报告，写入日志和指标，直到ctx结束
+// 报告需要遍历全部条目，间隔为0时只在管理接口请求时生成
+func (h *Handler) StartCacheReport(ctx context.Context) {
+	if h.reportInterval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(h.reportInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				h.publishReport(h.cache.Report(time.Now()))
+			}
+		}
+	}()
+}
+
+// publishReport 保存报告供管理接口返回，并更新指标；条目通常在过期前就被淘汰时记录警告
+func (h *Handler) publishReport(report cache.Report) {
+	h.lastReport.Store(&report)
+
+	for _, b := range report.Age {
+		cacheReportEntries.Set(float64(b.Entries), b.Le)
+		cacheReportBytes.Set(float64(b.Bytes), b.Le)
+	}
+	cacheReportExpiredBytes.Set(float64(report.Expired.Bytes))
+
+	args := []any{"entries", report.Entries, "bytes", report.Bytes, "max_bytes", report.MaxBytes,
+		"expired_entries", report.Expired.Entries, "expired_bytes", report.Expired.Bytes,
+		"write_bytes_per_second", report.WriteBytesPerSecond}
+	if report.EvictionHorizonSeconds != nil {
+		horizon := *report.EvictionHorizonSeconds
+		cacheEvictionHorizon.Set(horizon)
+		args = append(args, "eviction_horizon_seconds", horizon)
+		if horizon < report.TTLSeconds {
+			log.Warn("cache entries are likely evicted before CACHE_TTL expires, consider a larger MAX_CACHE_BYTES",
+				"eviction_horizon_seconds", horizon, "ttl_seconds", report.TTLSeconds)
+		}
+	}
+	log.Info("cache report", args...)
+}
+
+// cacheReportHandler 返回最近一次缓存审计报告（GET /admin/cache/report）
+// 还没有报告或带?refresh=1时立即生成一份
+func (h *Handler) cacheReportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	report := h.lastReport.Load()
+	if report == nil || r.URL.Query().Get("refresh") == "1" {
+		fresh := h.cache.Report(time.Now())
+		h.publishReport(fresh)
+		report = &fresh
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(report)
+}
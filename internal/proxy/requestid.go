@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"gravatar-proxy/internal/config"
+	"gravatar-proxy/internal/log"
+)
+
+// maxRequestIDLength 为沿用的入站请求ID的最大长度，足够容纳X-Amzn-Trace-Id的完整值
+const maxRequestIDLength = 200
+
+// requestID 返回本次请求的ID并写入响应头
+// 调用方符合REQUEST_ID_TRUST时沿用其请求头中的ID，否则生成新ID；该ID同时随上游和分片转发请求发出，便于跨系统关联日志
+func (h *Handler) requestID(w http.ResponseWriter, r *http.Request) string {
+	var id string
+	if inbound := r.Header.Get(h.requestIDHeader); inbound != "" && h.trustsRequestID(r) {
+		if validRequestID(inbound) {
+			id = inbound
+		} else {
+			log.Debug("ignored malformed inbound request ID", "header", h.requestIDHeader, "length", len(inbound))
+		}
+	}
+	if id == "" {
+		id = generateRequestID()
+	}
+	w.Header().Set(h.requestIDHeader, id)
+	return id
+}
+
+// trustsRequestID 判断是否沿用调用方提供的请求ID
+func (h *Handler) trustsRequestID(r *http.Request) bool {
+	switch h.requestIDTrust {
+	case config.RequestIDTrustAll:
+		return true
+	case config.RequestIDTrustProxies:
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		return containsIP(h.trustedProxies, host) || h.isTrusted(r)
+	default:
+		return false
+	}
+}
+
+// validRequestID 只接受长度有限的可见ASCII字符，避免日志注入和超长的日志字段
+func validRequestID(id string) bool {
+	if len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func generateRequestID() string {
+	return fmt.Sprintf("%d", time.Now().UnixNano())
+}
@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gravatar-proxy/internal/cache"
+	"gravatar-proxy/internal/config"
+	"gravatar-proxy/internal/imaging"
+	"gravatar-proxy/internal/log"
+)
+
+// resizeTarget 判断请求是否可以从本地缓存的原图缩放得到，返回目标尺寸
+func (h *Handler) resizeTarget(queryParams map[string]string) (int, bool) {
+	if !h.localResize || !h.features.enabled(config.FeatureTransformations) {
+		return 0, false
+	}
+	if _, ok := localStyle(queryParams); ok {
+		return 0, false
+	}
+
+	size := 80
+	if s, present := queryParams["s"]; present {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return 0, false
+		}
+		size = n
+	}
+	return size, size < h.resizeSourceSize
+}
+
+// originalParams 返回请求原图时使用的参数：与原请求相同，只是尺寸为RESIZE_SOURCE_SIZE
+func (h *Handler) originalParams(queryParams map[string]string) map[string]string {
+	return withParam(queryParams, "s", strconv.Itoa(h.resizeSourceSize))
+}
+
+// serveResized 从原图缩放出请求的尺寸并缓存为独立条目
+// 原图获取或解码失败时返回false，由调用方回退到直接请求上游
+func (h *Handler) serveResized(ctx context.Context, w http.ResponseWriter, s *settings, cacheKey, hash string, queryParams map[string]string, size int, region, requestID string) (int, bool) {
+	origParams := h.originalParams(queryParams)
+	origKey := h.cache.GenerateKey("/avatar/"+hash, origParams)
+
+	original, data, err := h.loadOriginal(ctx, origKey, hash, origParams, region, requestID)
+	if err != nil {
+		log.Warn("failed to load original for resizing", "error", err, "error_class", errorClass(err), "request_id", requestID, "key", origKey)
+		return 0, false
+	}
+
+	// 404等非图片响应与尺寸无关，直接返回
+	if original.StatusCode != http.StatusOK {
+		h.writeResponse(w, s, original, data)
+		return original.StatusCode, true
+	}
+
+	resized, contentType, err := imaging.ResizeBytes(data, size, h.resizeFilter)
+	if err != nil {
+		log.Warn("failed to resize original", "error", err, "request_id", requestID, "key", origKey)
+		return 0, false
+	}
+
+	headers := make(map[string]string, len(original.Headers))
+	for k, v := range original.Headers {
+		if k == "ETag" {
+			continue
+		}
+		headers[k] = v
+	}
+	headers["Content-Type"] = contentType
+	headers["Content-Length"] = strconv.Itoa(len(resized))
+
+	metadata := cache.Metadata{
+		CreatedAt:      time.Now(),
+		LastAccessedAt: time.Now(),
+		Headers:        headers,
+		StatusCode:     http.StatusOK,
+		Upstream:       original.Upstream,
+		SourceKey:      origKey,
+		Hash:           hash,
+		Path:           "/avatar/" + hash,
+		Params:         queryParams,
+	}
+	if err := h.cache.Set(cacheKey, resized, metadata); err != nil {
+		log.Warn("failed to cache resized variant", "error", err, "request_id", requestID)
+	}
+
+	log.Info("served resized variant", "request_id", requestID, "key", cacheKey, "source_key", origKey, "size", size)
+	h.writeResponse(w, s, metadata, resized)
+	return http.StatusOK, true
+}
+
+// loadOriginal 从缓存或上游取得原图，与普通请求共享同一套缓存和负缓存
+// 同一头像的多个尺寸同时未命中时，只向上游请求一次原图，所有尺寸都由这一次响应缩放得到
+func (h *Handler) loadOriginal(ctx context.Context, origKey, hash string, params map[string]string, region, requestID string) (cache.Metadata, []byte, error) {
+	if neg, ok := h.negative.Get(origKey); ok {
+		return cache.Metadata{StatusCode: neg.StatusCode, Headers: neg.Headers}, neg.Body, nil
+	}
+	if _, valid := h.cache.Peek(origKey); valid {
+		return h.readCached(origKey)
+	}
+
+	// 共享的获取不随发起请求的客户端断开而取消
+	fetchCtx := context.WithoutCancel(ctx)
+	metadata, data, shared, err := h.originals.do(origKey, func() (cache.Metadata, []byte, error) {
+		originalFetches.Inc("fetched")
+		return h.fetchOriginal(fetchCtx, origKey, hash, params, region, requestID)
+	})
+	if shared {
+		originalFetches.Inc("shared")
+		log.Info("reused in-flight original fetch", "request_id", requestID, "key", origKey)
+	}
+	return metadata, data, err
+}
+
+// fetchOriginal 向上游请求原图并写入缓存；等待加载期间其他请求可能已经填充了缓存，先再检查一次
+func (h *Handler) fetchOriginal(ctx context.Context, origKey, hash string, params map[string]string, region, requestID string) (cache.Metadata, []byte, error) {
+	if neg, ok := h.negative.Get(origKey); ok {
+		return cache.Metadata{StatusCode: neg.StatusCode, Headers: neg.Headers}, neg.Body, nil
+	}
+	entry, valid := h.cache.Peek(origKey)
+	if valid {
+		return h.readCached(origKey)
+	}
+
+	resp, upstream, err := h.fetchUpstream(ctx, h.upstreamChain(), hash, params, entry, region, requestID)
+	if err != nil {
+		return cache.Metadata{}, nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotModified && entry != nil {
+		resp.Body.Close()
+		metadata := entry.Metadata
+		metadata.Revalidated(time.Now())
+		metadata.LastAccessedAt = time.Now()
+		if err := h.cache.UpdateMetadata(origKey, metadata); err != nil {
+			log.Warn("failed to update metadata", "error", err, "request_id", requestID)
+		}
+		return h.readCached(origKey)
+	}
+
+	data, err := readUpstreamBody(resp, upstream)
+	if err != nil {
+		return cache.Metadata{}, nil, err
+	}
+	return h.handleUpstreamBody(origKey, hash, upstream, params, resp, data, requestID)
+}
+
+func (h *Handler) readCached(key string) (cache.Metadata, []byte, error) {
+	data, err := h.cache.ReadData(key)
+	if err != nil {
+		return cache.Metadata{}, nil, err
+	}
+	metadata, err := h.cache.GetMetadata(key)
+	if err != nil {
+		return cache.Metadata{}, nil, err
+	}
+	return *metadata, data, nil
+}
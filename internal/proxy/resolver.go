@@ -0,0 +1,280 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"gravatar-proxy/internal/config"
+)
+
+// maxResolvedHosts 为解析结果缓存的主机数上限，达到后清空重新累积；上游和重定向目标的主机通常只有几个
+const maxResolvedHosts = 1000
+
+// fallbackDelay 为Happy Eyeballs中首选地址族先行的时间，之后另一族的地址并行建连，与net.Dialer的默认值相同
+const fallbackDelay = 300 * time.Millisecond
+
+// minAddrDialTimeout 为建连时间分摊到各个地址时每个地址至少得到的时间，与net.Dialer相同
+const minAddrDialTimeout = 2 * time.Second
+
+// upstreamResolver 按UPSTREAM_HOSTS、UPSTREAM_DNS_SERVER和UPSTREAM_DNS_CACHE_TTL解析上游主机名，按UPSTREAM_IP_FAMILY筛选和排序地址
+// 只替换建连时的地址解析，TLS仍按URL中的主机名校验证书，适合DNS被污染、解析缓慢或IPv6路由不通的网络
+type upstreamResolver struct {
+	hosts    map[string][]string
+	resolver *net.Resolver
+	ttl      time.Duration
+	family   string
+	now      func() time.Time
+	// dialTimeout 为一次建连尝试所有地址的总时间
+	dialTimeout time.Duration
+
+	mu    sync.Mutex
+	cache map[string]resolvedHost
+}
+
+type resolvedHost struct {
+	addrs   []string
+	expires time.Time
+}
+
+// newUpstreamResolver 创建解析器，各项配置都未设置时返回nil，由Dialer自行解析
+func newUpstreamResolver(cfg *config.Config) *upstreamResolver {
+	family := cfg.UpstreamIPFamily
+	if family == "" {
+		family = config.IPFamilyAuto
+	}
+	if cfg.UpstreamDNSServer == "" && len(cfg.UpstreamHosts) == 0 && cfg.UpstreamDNSCacheTTL <= 0 && family == config.IPFamilyAuto {
+		return nil
+	}
+	r := &upstreamResolver{
+		hosts:    cfg.UpstreamHosts,
+		resolver: net.DefaultResolver,
+		ttl:      cfg.UpstreamDNSCacheTTL,
+		family:   family,
+		now:      time.Now,
+		cache:    make(map[string]resolvedHost),
+
+		dialTimeout: timeoutOr(cfg.UpstreamDialTimeout, config.DefaultUpstreamDialTimeout),
+	}
+	if server := cfg.UpstreamDNSServer; server != "" {
+		r.resolver = &net.Resolver{
+			PreferGo: true,
+			// 忽略系统配置的服务器，所有查询都发往指定的服务器，协议（UDP或TCP）沿用解析器的选择
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+	return r
+}
+
+// lookup 返回主机名对应的地址：静态映射优先，其次是未过期的缓存，最后查询DNS
+// 查询失败的结果不缓存，下一次请求重新查询
+func (r *upstreamResolver) lookup(ctx context.Context, host string) ([]string, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if addrs, ok := r.hosts[host]; ok {
+		upstreamDNSLookups.Inc("static")
+		return addrs, nil
+	}
+
+	if r.ttl > 0 {
+		r.mu.Lock()
+		entry, ok := r.cache[host]
+		r.mu.Unlock()
+		if ok && r.now().Before(entry.expires) {
+			upstreamDNSLookups.Inc("hit")
+			return entry.addrs, nil
+		}
+	}
+
+	addrs, err := r.resolver.LookupHost(ctx, host)
+	if err != nil {
+		upstreamDNSLookups.Inc("error")
+		return nil, err
+	}
+	upstreamDNSLookups.Inc("miss")
+
+	if r.ttl > 0 {
+		r.mu.Lock()
+		if len(r.cache) >= maxResolvedHosts {
+			clear(r.cache)
+		}
+		r.cache[host] = resolvedHost{addrs: addrs, expires: r.now().Add(r.ttl)}
+		r.mu.Unlock()
+	}
+	return addrs, nil
+}
+
+// dialContext 包装dial：先用解析器解析主机名，按地址族筛选和排序后建连
+// 两个地址族都有地址时按Happy Eyeballs（RFC 8305）先尝试首选族，fallbackDelay后或首选族全部失败时另一族并行建连，先成功的连接胜出
+// 同一族内依次尝试各个地址，UPSTREAM_DIAL_TIMEOUT分摊到尚未尝试的地址上，一个不响应的地址不会耗尽整个建连时间
+func (r *upstreamResolver) dialContext(dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		// 限定地址族时，IP字面量也交给tcp4或tcp6，由Dialer拒绝另一族的地址
+		switch r.family {
+		case config.IPFamilyIPv4:
+			network = "tcp4"
+		case config.IPFamilyIPv6:
+			network = "tcp6"
+		}
+		host, port, err := net.SplitHostPort(address)
+		if err != nil || net.ParseIP(host) != nil {
+			return dial(ctx, network, address)
+		}
+
+		addrs, err := r.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		addrs = orderAddrs(addrs, r.family)
+		if len(addrs) == 0 {
+			return nil, &net.DNSError{Err: "no addresses of the configured family", Name: host, IsNotFound: true}
+		}
+
+		if r.dialTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, r.dialTimeout)
+			defer cancel()
+		}
+		primaries, fallbacks := splitFamilies(addrs)
+		if len(fallbacks) == 0 {
+			return dialSerial(ctx, dial, network, port, primaries)
+		}
+		return dialParallel(ctx, dial, network, port, primaries, fallbacks)
+	}
+}
+
+// splitFamilies 把地址分成与第一个地址同族的首选地址和另一族的备选地址
+func splitFamilies(addrs []string) (primaries, fallbacks []string) {
+	isIPv4 := func(addr string) bool {
+		ip := net.ParseIP(addr)
+		return ip != nil && ip.To4() != nil
+	}
+	first := isIPv4(addrs[0])
+	for _, addr := range addrs {
+		if isIPv4(addr) == first {
+			primaries = append(primaries, addr)
+		} else {
+			fallbacks = append(fallbacks, addr)
+		}
+	}
+	return primaries, fallbacks
+}
+
+// dialParallel 先对首选地址建连，fallbackDelay后或首选地址全部失败时并行对备选地址建连
+// 返回先成功的连接，另一路随后成功的连接被关闭；两路都失败时返回两路的错误
+func dialParallel(ctx context.Context, dial func(ctx context.Context, network, address string) (net.Conn, error), network, port string, primaries, fallbacks []string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	returned := make(chan struct{})
+	defer close(returned)
+
+	type dialResult struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+	results := make(chan dialResult)
+	race := func(addrs []string, primary bool) {
+		go func() {
+			conn, err := dialSerial(ctx, dial, network, port, addrs)
+			select {
+			case results <- dialResult{conn: conn, err: err, primary: primary}:
+			case <-returned:
+				if conn != nil {
+					conn.Close()
+				}
+			}
+		}()
+	}
+
+	race(primaries, true)
+	timer := time.NewTimer(fallbackDelay)
+	defer timer.Stop()
+
+	var primaryErr, fallbackErr error
+	for {
+		select {
+		case <-timer.C:
+			race(fallbacks, false)
+		case res := <-results:
+			if res.err == nil {
+				return res.conn, nil
+			}
+			if res.primary {
+				primaryErr = res.err
+				// 首选地址在fallbackDelay之前全部失败，立即尝试备选地址
+				if timer.Stop() {
+					race(fallbacks, false)
+				}
+			} else {
+				fallbackErr = res.err
+			}
+			if primaryErr != nil && fallbackErr != nil {
+				return nil, errors.Join(primaryErr, fallbackErr)
+			}
+		}
+	}
+}
+
+// dialSerial 依次对各个地址建连，直到有一个连接成功；ctx带截止时间时把剩余时间平分给尚未尝试的地址
+func dialSerial(ctx context.Context, dial func(ctx context.Context, network, address string) (net.Conn, error), network, port string, addrs []string) (net.Conn, error) {
+	var errs []error
+	for i, addr := range addrs {
+		if ctx.Err() != nil {
+			break
+		}
+		dialCtx, cancel := ctx, context.CancelFunc(func() {})
+		if deadline, ok := ctx.Deadline(); ok {
+			dialCtx, cancel = context.WithDeadline(ctx, partialDeadline(time.Now(), deadline, len(addrs)-i))
+		}
+		conn, err := dial(dialCtx, network, net.JoinHostPort(addr, port))
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return nil, ctx.Err()
+	}
+	return nil, errors.Join(errs...)
+}
+
+// partialDeadline 返回当前地址的建连截止时间：剩余时间平分给remaining个地址，但至少minAddrDialTimeout
+func partialDeadline(now, deadline time.Time, remaining int) time.Time {
+	left := deadline.Sub(now)
+	timeout := left / time.Duration(remaining)
+	if timeout < minAddrDialTimeout {
+		timeout = min(left, minAddrDialTimeout)
+	}
+	return now.Add(timeout)
+}
+
+// orderAddrs 按地址族筛选或排序地址，同一族内保持解析结果的顺序
+func orderAddrs(addrs []string, family string) []string {
+	var v4, v6 []string
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil && ip.To4() != nil {
+			v4 = append(v4, addr)
+		} else {
+			v6 = append(v6, addr)
+		}
+	}
+	switch family {
+	case config.IPFamilyIPv4:
+		return v4
+	case config.IPFamilyIPv6:
+		return v6
+	case config.IPFamilyPreferIPv4:
+		return append(v4, v6...)
+	case config.IPFamilyPreferIPv6:
+		return append(v6, v4...)
+	default:
+		return addrs
+	}
+}
@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+
+	"gravatar-proxy/internal/log"
+)
+
+// maxRetryBackoff 为单次重试前等待时间的上限
+const maxRetryBackoff = 2 * time.Second
+
+// doUpstream 发出上游请求，连接被重置、超时或上游返回502/503时在同一上游上重试
+// 重试前按指数退避等待并加入随机抖动，最多重试UPSTREAM_RETRIES次；客户端断开或重试预算用尽后不再重试
+// 只用于不带请求体的GET，同一个请求可以重复发送
+func (h *Handler) doUpstream(req *http.Request, upstream, requestID string) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := h.client.Do(req)
+		reason := retryReason(resp, err)
+		if reason == retryReasonHeaderTimeout && !h.retryHeaderTimeouts {
+			reason = ""
+		}
+		if reason == "" || attempt > h.upstreamRetries || req.Context().Err() != nil {
+			return resp, err
+		}
+		if !h.retryBudget.take() {
+			upstreamRetryBudgetExhausted.Inc(upstream)
+			log.Warn("retry budget exhausted, not retrying", "reason", reason, "attempt", attempt, "request_id", requestID, "upstream", upstream)
+			return resp, err
+		}
+
+		delay := retryBackoff(h.upstreamRetryBackoff, attempt)
+		upstreamRetriesTotal.Inc(upstream, reason)
+		if err != nil {
+			log.Warn("transient upstream failure, retrying", "error", err, "reason", reason, "attempt", attempt, "delay_ms", delay.Milliseconds(), "request_id", requestID, "upstream", upstream)
+		} else {
+			log.Warn("transient upstream failure, retrying", "status", resp.StatusCode, "reason", reason, "attempt", attempt, "delay_ms", delay.Milliseconds(), "request_id", requestID, "upstream", upstream)
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// retryReasonHeaderTimeout 为等待响应头超时的重试原因；请求已到达上游，重试会加重上游负担，默认不重试
+const retryReasonHeaderTimeout = "header_timeout"
+
+// retryReason 返回值得重试的失败原因，其余结果返回空字符串
+// 建连被拒、DNS和TLS失败通常不会在几百毫秒内恢复，直接交给下一个上游
+// 带Retry-After的503表示上游要求稍后再来，同样不在同一上游上立即重试
+func retryReason(resp *http.Response, err error) string {
+	if err != nil {
+		if errors.Is(err, errBandwidthCap) {
+			return ""
+		}
+		if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return "connection_reset"
+		}
+		var headerTimeout *headerTimeoutError
+		if errors.As(err, &headerTimeout) {
+			return retryReasonHeaderTimeout
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return "timeout"
+		}
+		return ""
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway:
+		return "status_502"
+	case http.StatusServiceUnavailable:
+		if resp.Header.Get("Retry-After") != "" {
+			return ""
+		}
+		return "status_503"
+	}
+	return ""
+}
+
+// retryBudget 是所有请求共享的重试令牌桶：每秒补充rate个令牌，最多积累一秒的量
+// 上游大面积故障时重试总量受预算限制，不会把上游请求量放大到UPSTREAM_RETRIES+1倍
+type retryBudget struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	bucket tokenBucket
+}
+
+// newRetryBudget 在rate不大于0时返回nil，表示不限制重试总量
+func newRetryBudget(rate float64) *retryBudget {
+	if rate <= 0 {
+		return nil
+	}
+	burst := max(1, rate)
+	return &retryBudget{rate: rate, burst: burst, bucket: tokenBucket{tokens: burst, last: time.Now()}}
+}
+
+// take 消耗一个重试令牌，预算用尽时返回false
+func (b *retryBudget) take() bool {
+	if b == nil {
+		return true
+	}
+	now := time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.bucket.tokens = min(b.burst, b.bucket.tokens+now.Sub(b.bucket.last).Seconds()*b.rate)
+	b.bucket.last = now
+	if b.bucket.tokens < 1 {
+		return false
+	}
+	b.bucket.tokens--
+	return true
+}
+
+// retryBackoff 返回第attempt次重试前的等待时间：基础时间按次数翻倍，取其一半到全部之间的随机值
+func retryBackoff(base time.Duration, attempt int) time.Duration {
+	d := base << (attempt - 1)
+	if d <= 0 || d > maxRetryBackoff {
+		d = maxRetryBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
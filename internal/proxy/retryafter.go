@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 返回429/503时附带Retry-After的原因，各自的等待时间可通过RETRY_AFTER配置
+const (
+	// retryRateLimit 客户端超出限流
+	retryRateLimit = "rate_limit"
+	// retryCircuitOpen 上游熔断器处于打开状态
+	retryCircuitOpen = "circuit_open"
+	// retryMaintenance 实例处于维护模式
+	retryMaintenance = "maintenance"
+	// retryUpstream 上游失败且降级阶梯没有产生响应，或上游自身返回429/503
+	retryUpstream = "upstream"
+)
+
+var defaultRetryAfter = map[string]time.Duration{
+	retryRateLimit:   time.Second,
+	retryCircuitOpen: 30 * time.Second,
+	retryMaintenance: 5 * time.Minute,
+	retryUpstream:    10 * time.Second,
+}
+
+// parseRetryAfter 解析cause=duration列表并覆盖默认值，0表示不发送Retry-After
+func parseRetryAfter(pairs []string) (map[string]time.Duration, error) {
+	values := make(map[string]time.Duration, len(defaultRetryAfter))
+	for cause, d := range defaultRetryAfter {
+		values[cause] = d
+	}
+	for _, pair := range pairs {
+		cause, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid retry-after %q, expected cause=duration", pair)
+		}
+		cause = strings.TrimSpace(cause)
+		if _, known := defaultRetryAfter[cause]; !known {
+			return nil, fmt.Errorf("unknown retry-after cause %q", cause)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid retry-after duration for %q: %q", cause, value)
+		}
+		values[cause] = d
+	}
+	return values, nil
+}
+
+// setRetryAfter 按原因设置Retry-After，秒数向上取整；已有Retry-After（如上游提供）时保留原值
+func (h *Handler) setRetryAfter(w http.ResponseWriter, cause string) {
+	d := h.retryAfter[cause]
+	if d <= 0 || w.Header().Get("Retry-After") != "" {
+		return
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+}
+
+// isRetryableStatus 判断响应状态是否应提示客户端稍后重试
+func isRetryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable
+}
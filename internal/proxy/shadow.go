@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"gravatar-proxy/internal/log"
+)
+
+const maxShadowInFlight = 16
+
+// shadowRequest 按配置比例将未命中流量异步镜像到影子上游，并记录与主上游的差异
+// mirror模式只比较状态码和延迟；compare模式还会比较ETag和内容哈希
+// 镜像请求不影响用户响应，并发已满时直接丢弃
+// primarySum为主上游响应体的SHA-256，只在compare模式下使用
+func (h *Handler) shadowRequest(hash string, queryParams map[string]string, primary *http.Response, primarySum [sha256.Size]byte, primaryLatency time.Duration, requestID string) {
+	if h.shadowUpstream == "" || h.shadowPercent <= 0 {
+		return
+	}
+	// 条件请求的304无法与影子上游的完整响应比较
+	if primary.StatusCode == http.StatusNotModified {
+		return
+	}
+	if rand.Float64()*100 >= h.shadowPercent {
+		return
+	}
+
+	select {
+	case h.shadowSlots <- struct{}{}:
+	default:
+		shadowResults.Inc("dropped")
+		return
+	}
+
+	primaryStatus := primary.StatusCode
+	primaryETag := primary.Header.Get("ETag")
+
+	go func() {
+		defer func() { <-h.shadowSlots }()
+
+		req, err := h.newUpstreamRequest(context.Background(), h.shadowUpstream, hash, queryParams, nil, requestID)
+		if err != nil {
+			shadowResults.Inc("error")
+			return
+		}
+
+		start := time.Now()
+		resp, err := h.client.Do(req)
+		if err != nil {
+			shadowResults.Inc("error")
+			log.Warn("shadow request failed", "error", err, "request_id", requestID, "upstream", h.shadowUpstream)
+			return
+		}
+		defer resp.Body.Close()
+		if err := h.limitBody(resp); err != nil {
+			shadowResults.Inc("error")
+			log.Warn("shadow response too large", "error", err, "request_id", requestID, "upstream", h.shadowUpstream)
+			return
+		}
+
+		var shadowSum [sha256.Size]byte
+		if h.shadowCompare {
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				shadowResults.Inc("error")
+				log.Warn("failed to read shadow response body", "error", err, "request_id", requestID)
+				return
+			}
+			shadowSum = sha256.Sum256(body)
+		} else {
+			io.Copy(io.Discard, resp.Body)
+		}
+		latency := time.Since(start)
+		shadowDuration.Observe(latency.Seconds())
+
+		shadowETag := resp.Header.Get("ETag")
+		result := "match"
+		switch {
+		case resp.StatusCode != primaryStatus:
+			result = "status_mismatch"
+		case h.shadowCompare && primaryETag != shadowETag:
+			result = "etag_mismatch"
+		case h.shadowCompare && !bytes.Equal(primarySum[:], shadowSum[:]):
+			result = "content_mismatch"
+		}
+		shadowResults.Inc(result)
+
+		args := []any{
+			"request_id", requestID,
+			"hash", hash,
+			"result", result,
+			"primary_status", primaryStatus,
+			"shadow_status", resp.StatusCode,
+			"primary_ms", primaryLatency.Milliseconds(),
+			"shadow_ms", latency.Milliseconds(),
+		}
+		if !h.shadowCompare {
+			log.Debug("shadow request completed", args...)
+			return
+		}
+
+		args = append(args, "primary_etag", primaryETag, "shadow_etag", shadowETag)
+		if result == "match" {
+			log.Debug("shadow comparison matched", args...)
+		} else {
+			log.Warn("shadow response diverged from primary", args...)
+		}
+	}()
+}
+
+// shadowSum 在compare模式下计算响应体的SHA-256，其他模式返回零值
+func (h *Handler) shadowSum(body []byte) (sum [sha256.Size]byte) {
+	if h.shadowCompare {
+		sum = sha256.Sum256(body)
+	}
+	return sum
+}
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"hash/crc32"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"gravatar-proxy/internal/log"
+	"gravatar-proxy/internal/tracing"
+)
+
+// forwardedShardHeader 标记由前端节点路由过来的请求，收到的节点直接本地处理，不再转发
+// 只在请求来自已知节点的地址时生效，客户端自带的该请求头被忽略，不能借此绕过分片路由
+const forwardedShardHeader = "X-Shard-Forwarded"
+
+// shardVirtualNodes 每个节点在哈希环上的虚拟节点数，使头像哈希均匀分布
+const shardVirtualNodes = 160
+
+// shardForwardHeaders 转发给分片节点的请求头，影响访问控制、条件请求和格式协商
+var shardForwardHeaders = []string{"Accept", "Origin", "Referer", "If-None-Match", "If-Modified-Since", apiKeyHeader}
+
+// hashRing 一致性哈希环，节点增减时只有相邻区间的头像哈希会换节点
+type hashRing struct {
+	points []ringPoint
+}
+
+type ringPoint struct {
+	hash uint32
+	node string
+}
+
+func newHashRing(nodes []string) *hashRing {
+	r := &hashRing{points: make([]ringPoint, 0, len(nodes)*shardVirtualNodes)}
+	for _, node := range nodes {
+		for i := 0; i < shardVirtualNodes; i++ {
+			r.points = append(r.points, ringPoint{
+				hash: crc32.ChecksumIEEE([]byte(node + "#" + strconv.Itoa(i))),
+				node: node,
+			})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		return r.points[i].hash < r.points[j].hash
+	})
+	return r
+}
+
+// owner 返回负责该头像哈希的节点
+func (r *hashRing) owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].node
+}
+
+// serveSharded 将不属于本节点的头像请求转发给负责的节点，返回是否已写出响应
+// 节点不可达时返回false，由本节点按正常流程处理
+func (h *Handler) serveSharded(w http.ResponseWriter, r *http.Request, hash, requestID string) (int, bool) {
+	if h.peers == nil {
+		return 0, false
+	}
+	if from := r.Header.Get(forwardedShardHeader); from != "" {
+		if h.peers.isPeer(r.RemoteAddr) {
+			shardRequests.Inc("received")
+			log.Debug("serving request forwarded by shard peer", "from", from, "hash", hash, "request_id", requestID)
+			return 0, false
+		}
+		shardRequests.Inc("untrusted")
+		log.Debug("ignoring shard forwarding header from a non-peer address", "remote_addr", r.RemoteAddr, "request_id", requestID)
+	}
+	owner := h.peers.owner(hash)
+	if owner == h.peers.self {
+		shardRequests.Inc("local")
+		return 0, false
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, owner+r.URL.RequestURI(), nil)
+	if err != nil {
+		log.Warn("failed to create shard request", "error", err, "peer", owner, "request_id", requestID)
+		shardRequests.Inc("fallback")
+		return 0, false
+	}
+	for _, name := range shardForwardHeaders {
+		if value := r.Header.Get(name); value != "" {
+			req.Header.Set(name, value)
+		}
+	}
+	// 值为转发节点的实例名，便于在负责节点的日志中追溯来源
+	req.Header.Set(forwardedShardHeader, h.forwardedBy())
+	// 负责的节点将本节点列入TRUSTED_PROXIES后，可按真实客户端限流
+	req.Header.Set("X-Forwarded-For", h.clientIP(r))
+	req.Header.Set(h.requestIDHeader, requestID)
+	tracing.Inject(r.Context(), req.Header)
+
+	resp, err := h.peerClient.Do(req)
+	if err != nil {
+		log.Warn("shard peer unavailable, serving locally", "error", err, "peer", owner, "request_id", requestID)
+		h.peers.markDown(owner)
+		shardRequests.Inc("fallback")
+		return 0, false
+	}
+	defer resp.Body.Close()
+
+	for k, values := range resp.Header {
+		// 负责的节点未沿用本节点的请求ID时，客户端仍收到本节点日志中的ID
+		if isHopHeader(k) || k == h.requestIDHeader {
+			continue
+		}
+		w.Header()[k] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		log.Warn("failed to relay shard response", "error", err, "peer", owner, "request_id", requestID)
+	}
+	shardRequests.Inc("forwarded")
+	log.Info("forwarded request to shard peer", "peer", owner, "peer_instance", h.peers.instance(owner), "hash", hash, "status", resp.StatusCode, "request_id", requestID)
+	return resp.StatusCode, true
+}
+
+func (h *Handler) forwardedBy() string {
+	if h.instance.Name == "" {
+		return "1"
+	}
+	return h.instance.Name
+}
+
+func isHopHeader(name string) bool {
+	switch http.CanonicalHeaderKey(name) {
+	case "Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade", "Te", "Trailer":
+		return true
+	}
+	return false
+}
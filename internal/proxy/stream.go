@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"time"
+
+	"gravatar-proxy/internal/cache"
+	"gravatar-proxy/internal/log"
+)
+
+// clientWriter 每次写入后立即flush，使客户端尽早收到数据
+// 并记录写客户端时的错误，用于区分客户端断开和上游响应体读取失败
+type clientWriter struct {
+	w   http.ResponseWriter
+	rc  *http.ResponseController
+	err error
+}
+
+func newClientWriter(w http.ResponseWriter) *clientWriter {
+	return &clientWriter{w: w, rc: http.NewResponseController(w)}
+}
+
+func (c *clientWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if err == nil {
+		// 不支持Flush的ResponseWriter照常缓冲
+		if ferr := c.rc.Flush(); ferr != nil && !errors.Is(ferr, http.ErrNotSupported) {
+			err = ferr
+		}
+	}
+	if err != nil {
+		c.err = err
+	}
+	return n, err
+}
+
+// streamUpstreamResponse 将200响应边读边写给客户端，同时通过TeeReader写入缓存临时文件
+// 内存占用与头像大小无关；响应体完整读完后才提交缓存条目，中途失败或超出MAX_UPSTREAM_BYTES时丢弃
+func (h *Handler) streamUpstreamResponse(w http.ResponseWriter, s *settings, cacheKey, avatarHash, upstream string, queryParams map[string]string, resp *http.Response, primaryLatency time.Duration, requestID string) {
+	defer resp.Body.Close()
+
+	metadata := cache.Metadata{
+		CreatedAt:      time.Now(),
+		LastAccessedAt: time.Now(),
+		Headers:        cache.ExtractHeaders(resp),
+		StatusCode:     resp.StatusCode,
+		Upstream:       upstream,
+		Hash:           avatarHash,
+		Path:           "/avatar/" + avatarHash,
+		Params:         queryParams,
+	}
+
+	var body io.Reader = resp.Body
+	cw, err := h.cache.Create(cacheKey, avatarHash)
+	switch {
+	case errors.Is(err, cache.ErrPurged):
+		log.Info("skipped caching purged avatar", "request_id", requestID, "key", cacheKey)
+	case err != nil:
+		log.Warn("failed to cache response", "error", err, "request_id", requestID)
+	default:
+		body = io.TeeReader(body, cw)
+	}
+	var sum hash.Hash
+	if h.shadowCompare {
+		sum = sha256.New()
+		body = io.TeeReader(body, sum)
+	}
+
+	h.writeHeader(w, s, metadata)
+	client := newClientWriter(w)
+	if _, err := io.Copy(client, body); err != nil {
+		if cw != nil {
+			cw.Abort()
+		}
+		if client.err != nil {
+			log.Warn("client went away while streaming response", "error", client.err, "request_id", requestID)
+			return
+		}
+		class := bodyErrorClass(err)
+		upstreamErrors.Inc(upstream, class)
+		log.Error("failed to read upstream response body", "error", err, "error_class", class, "upstream", upstream, "request_id", requestID)
+		return
+	}
+
+	if cw != nil {
+		if err := cw.Commit(metadata); errors.Is(err, cache.ErrPurged) {
+			log.Info("skipped caching purged avatar", "request_id", requestID, "key", cacheKey)
+		} else if err != nil {
+			log.Warn("failed to cache response", "error", err, "request_id", requestID)
+		}
+	}
+
+	var primarySum [sha256.Size]byte
+	if sum != nil {
+		sum.Sum(primarySum[:0])
+	}
+	h.shadowRequest(avatarHash, queryParams, resp, primarySum, primaryLatency, requestID)
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gravatar-proxy/internal/avatargen"
+	"gravatar-proxy/internal/cache"
+	"gravatar-proxy/internal/log"
+)
+
+// TestAvatarHandler 为任意种子生成确定性的测试头像（GET /testavatar/{seed}）
+// 不访问上游，也不写入主缓存，适合演示和压测
+func (h *Handler) TestAvatarHandler(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	requestID := h.requestID(w, r)
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	seed := strings.TrimPrefix(r.URL.Path, "/testavatar/")
+	if seed == "" {
+		log.LogRequest(r.Method, r.URL.Path, http.StatusBadRequest, time.Since(startTime), requestID)
+		http.Error(w, "Missing seed", http.StatusBadRequest)
+		return
+	}
+
+	style := r.URL.Query().Get("style")
+	if style == "" {
+		style = "identicon"
+	}
+	size := avatargen.DefaultSize
+	if s, err := strconv.Atoi(r.URL.Query().Get("s")); err == nil {
+		size = avatargen.ClampSize(s)
+	}
+
+	data, err := avatargen.Generate(style, seed, size, avatargen.Options{
+		Text:    r.URL.Query().Get("name"),
+		Palette: h.palette,
+	})
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, avatargen.ErrUnknownStyle) {
+			status = http.StatusBadRequest
+		}
+		log.LogRequest(r.Method, r.URL.Path, status, time.Since(startTime), requestID)
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	etag := cache.ContentETag(data)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		log.LogRequest(r.Method, r.URL.Path, http.StatusNotModified, time.Since(startTime), requestID)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+	log.LogRequest(r.Method, r.URL.Path, http.StatusOK, time.Since(startTime), requestID)
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"gravatar-proxy/internal/cache"
+	"gravatar-proxy/internal/tracing"
+)
+
+// ServeHTTP 为每个头像请求创建服务端span，继承客户端traceparent
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracing.Start(tracing.Extract(r.Context(), r.Header), "avatar.request", tracing.KindServer)
+	span.SetAttribute("http.request.method", r.Method)
+	span.SetAttribute("url.path", r.URL.Path)
+
+	ctx, debug := h.withDebug(ctx, r)
+
+	sw := &tracedWriter{ResponseWriter: w, ctx: ctx, status: http.StatusOK, debug: debug}
+	h.serveAvatar(sw, r.WithContext(ctx))
+	sw.endWrite()
+
+	span.SetAttribute("http.response.status_code", sw.status)
+	if sw.status >= http.StatusInternalServerError {
+		span.SetError(errServerStatus)
+	}
+	span.End()
+}
+
+var errServerStatus = errors.New("server error")
+
+// tracedWriter 记录响应状态码，并用response.write span覆盖从写出响应头到处理结束的时间
+// 请求了调试信息时，在写出响应头前附加调试头
+type tracedWriter struct {
+	http.ResponseWriter
+	ctx       context.Context
+	status    int
+	writeSpan *tracing.Span
+	started   bool
+	debug     *debugInfo
+}
+
+func (w *tracedWriter) startWrite() {
+	if w.started {
+		return
+	}
+	w.started = true
+	w.debug.writeHeaders(w.Header())
+	_, w.writeSpan = tracing.Start(w.ctx, "response.write", tracing.KindInternal)
+}
+
+func (w *tracedWriter) endWrite() {
+	w.writeSpan.End()
+}
+
+func (w *tracedWriter) WriteHeader(status int) {
+	w.startWrite()
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *tracedWriter) Write(b []byte) (int, error) {
+	w.startWrite()
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap 供http.ResponseController访问底层ResponseWriter（如Flush）
+func (w *tracedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// cacheResult 描述缓存查找结果：hit、stale或miss
+func cacheResult(entry *cache.CacheEntry, valid bool) string {
+	switch {
+	case valid:
+		return "hit"
+	case entry != nil:
+		return "stale"
+	default:
+		return "miss"
+	}
+}
@@ -0,0 +1,228 @@
+package proxy
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gravatar-proxy/internal/cache"
+	"gravatar-proxy/internal/imaging"
+	"gravatar-proxy/internal/log"
+)
+
+// parseTranscodeFormats 将配置的格式名（如webp）转换为MIME类型，并找到对应的编码器
+// avif没有内置编码器，需要AVIF_ENCODER指定外部命令
+func parseTranscodeFormats(formats []string, avifEncoder string) ([]string, map[string]imaging.Encoder, error) {
+	mimeTypes := make([]string, 0, len(formats))
+	transcoders := make(map[string]imaging.Encoder, len(formats))
+	for _, f := range formats {
+		mimeType := "image/" + strings.ToLower(strings.TrimSpace(f))
+		encode, ok := imaging.BuiltinEncoder(mimeType)
+		if !ok && mimeType == "image/avif" {
+			if avifEncoder == "" {
+				return nil, nil, fmt.Errorf("transcoding to image/avif requires AVIF_ENCODER")
+			}
+			var err error
+			if encode, err = imaging.AVIFEncoder(avifEncoder); err != nil {
+				return nil, nil, err
+			}
+			ok = true
+		}
+		if !ok {
+			return nil, nil, fmt.Errorf("transcoding to %s is not supported by this build", mimeType)
+		}
+		mimeTypes = append(mimeTypes, mimeType)
+		transcoders[mimeType] = encode
+	}
+	return mimeTypes, transcoders, nil
+}
+
+// negotiateFormat 按配置顺序返回客户端Accept中明确接受的第一个转码格式
+func (h *Handler) negotiateFormat(r *http.Request) string {
+	if len(h.transcodeFormats) == 0 {
+		return ""
+	}
+
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		fields := strings.Split(part, ";")
+		mimeType := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if q > 0 {
+			accepted[mimeType] = true
+		}
+	}
+
+	for _, mimeType := range h.transcodeFormats {
+		if accepted[mimeType] {
+			return mimeType
+		}
+	}
+	return ""
+}
+
+// isTranscodable 只转码成功响应的JPEG和PNG
+func isTranscodable(metadata *cache.Metadata) bool {
+	if metadata.StatusCode != http.StatusOK {
+		return false
+	}
+	contentType := metadata.Headers["Content-Type"]
+	return strings.HasPrefix(contentType, "image/jpeg") || strings.HasPrefix(contentType, "image/png")
+}
+
+// serveTranscoded 尝试返回缓存原图的转码版本；转码版本作为独立缓存条目保存
+// 转码结果不比原图小时记住该结论并返回false，由调用方返回原图
+func (h *Handler) serveTranscoded(w http.ResponseWriter, r *http.Request, s *settings, cacheKey, hash string, queryParams map[string]string, mimeType, requestID string) bool {
+	original, err := h.cache.GetMetadata(cacheKey)
+	if err != nil || !isTranscodable(original) {
+		return false
+	}
+
+	variantParams := withParam(queryParams, "fmt", mimeType)
+	variantKey := h.cache.GenerateKey("/avatar/"+hash, variantParams)
+	if h.noTranscodeGain.has(variantKey) {
+		return false
+	}
+
+	// 原图刷新后，早于原图的转码版本视为过期
+	if variant, valid := h.cache.Peek(variantKey); valid && !variant.Metadata.CreatedAt.Before(original.CreatedAt) {
+		if err := h.cache.WriteResponse(w, r, variantKey, int(s.ttl.Seconds())); err != nil {
+			log.Warn("failed to write transcoded response", "error", err, "request_id", requestID)
+			return false
+		}
+		return true
+	}
+
+	data, err := h.cache.ReadData(cacheKey)
+	if err != nil {
+		return false
+	}
+
+	transcoded, err := imaging.Transcode(data, h.transcoders[mimeType])
+	if err != nil {
+		log.Warn("failed to transcode cached image", "error", err, "request_id", requestID, "key", cacheKey)
+		h.noTranscodeGain.add(variantKey)
+		return false
+	}
+	if len(transcoded) >= len(data) {
+		log.Debug("transcoded image not smaller, keeping original", "request_id", requestID, "key", cacheKey,
+			"format", mimeType, "original_bytes", len(data), "transcoded_bytes", len(transcoded))
+		h.noTranscodeGain.add(variantKey)
+		return false
+	}
+
+	headers := make(map[string]string, len(original.Headers))
+	for k, v := range original.Headers {
+		if k == "ETag" {
+			continue
+		}
+		headers[k] = v
+	}
+	headers["Content-Type"] = mimeType
+	headers["Content-Length"] = strconv.Itoa(len(transcoded))
+
+	metadata := cache.Metadata{
+		CreatedAt:      time.Now(),
+		LastAccessedAt: time.Now(),
+		Headers:        headers,
+		StatusCode:     http.StatusOK,
+		Upstream:       original.Upstream,
+		SourceKey:      cacheKey,
+		Hash:           hash,
+		Path:           "/avatar/" + hash,
+		Params:         variantParams,
+	}
+	if err := h.cache.Set(variantKey, transcoded, metadata); err != nil {
+		log.Warn("failed to cache transcoded variant", "error", err, "request_id", requestID)
+	}
+
+	log.Info("served transcoded variant", "request_id", requestID, "key", variantKey, "format", mimeType,
+		"original_bytes", len(data), "transcoded_bytes", len(transcoded))
+	h.writeResponse(w, s, metadata, transcoded)
+	return true
+}
+
+// forgetTranscodeResults 清除"转码无收益"的记录，清除缓存后头像可能已变化
+func (h *Handler) forgetTranscodeResults() {
+	h.noTranscodeGain.clear()
+}
+
+// maxNoGainKeys 是"转码无收益"记录的上限，超出时忘记最久未用的记录，下次请求重新尝试转码
+const maxNoGainKeys = 10000
+
+// keySet 是有容量上限的键集合，超出容量时淘汰最久未用的键
+type keySet struct {
+	mu    sync.Mutex
+	max   int
+	order *list.List
+	items map[string]*list.Element
+}
+
+func newKeySet(max int) *keySet {
+	return &keySet{
+		max:   max,
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+func (s *keySet) has(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, ok := s.items[key]
+	if ok {
+		s.order.MoveToFront(elem)
+	}
+	return ok
+}
+
+func (s *keySet) add(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.items[key]; ok {
+		s.order.MoveToFront(elem)
+		return
+	}
+	s.items[key] = s.order.PushFront(key)
+	for s.order.Len() > s.max {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.items, oldest.Value.(string))
+	}
+}
+
+func (s *keySet) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.order.Len()
+}
+
+func (s *keySet) clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.order.Init()
+	clear(s.items)
+}
+
+// withParam 返回增加了一个参数的参数副本，用于派生变体的缓存键
+func withParam(queryParams map[string]string, key, value string) map[string]string {
+	params := make(map[string]string, len(queryParams)+1)
+	for k, v := range queryParams {
+		params[k] = v
+	}
+	params[key] = value
+	return params
+}
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// regionHeader 允许受信任的内部调用方为单个请求指定上游区域
+const regionHeader = "X-Upstream-Region"
+
+// regionParam 是覆盖的上游区域在缓存键中附加的参数，不同区域的响应分别缓存；不转发给上游
+const regionParam = "region"
+
+var regionPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// parseNetworks 解析CIDR或单个IP列表
+func parseNetworks(entries []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted network %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted network %q: %w", entry, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// isTrusted 判断请求的直连地址是否位于受信任网络内
+func (h *Handler) isTrusted(r *http.Request) bool {
+	if len(h.trustedNetworks) == 0 {
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return containsIP(h.trustedNetworks, host)
+}
+
+// requestRegion 返回本次请求使用的上游区域，受信任调用方可通过请求头覆盖
+// 非受信任来源的覆盖请求头会被忽略
+func (h *Handler) requestRegion(r *http.Request) (string, error) {
+	override := strings.ToLower(strings.TrimSpace(r.Header.Get(regionHeader)))
+	if override == "" || !h.isTrusted(r) {
+		return h.region, nil
+	}
+	if !regionPattern.MatchString(override) {
+		return "", fmt.Errorf("invalid %s header", regionHeader)
+	}
+	return override, nil
+}
+
+// paramsRegion 返回缓存键参数记录的上游区域，未覆盖时为默认区域
+func (h *Handler) paramsRegion(queryParams map[string]string) string {
+	if region := queryParams[regionParam]; region != "" {
+		return region
+	}
+	return h.region
+}
@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gravatar-proxy/internal/cache"
+	"gravatar-proxy/internal/log"
+	"gravatar-proxy/internal/tracing"
+)
+
+const regionPlaceholder = "{region}"
+
+// stripVary 删除上游响应的Vary头
+// 代理发往上游的请求头是固定的（Accept取自UPSTREAM_ACCEPT，不转发客户端的请求头），同一URL只有一个变体，
+// 上游的Vary描述的是代理自己的请求，对客户端没有意义；代理响应的Vary只反映自己的内容协商（启用转码时为Accept）
+func stripVary(resp *http.Response, upstream, requestID string) {
+	vary := resp.Header.Values("Vary")
+	if len(vary) == 0 {
+		return
+	}
+	resp.Header.Del("Vary")
+	upstreamVaryStripped.Inc(upstream)
+	log.Debug("dropped upstream Vary header", "vary", strings.Join(vary, ", "), "request_id", requestID, "upstream", upstream)
+}
+
+// fetchUpstream 按顺序依次请求给定的上游，网络错误或5xx时回退到下一个
+// 上游地址中的{region}占位符替换为region；返回实际提供响应的上游地址
+func (h *Handler) fetchUpstream(ctx context.Context, upstreams []string, hash string, queryParams map[string]string, entry *cache.CacheEntry, region, requestID string) (*http.Response, string, error) {
+	var lastErr error
+	for i, template := range upstreams {
+		base := expandUpstream(template, region)
+		if !h.breaker.allow(base) {
+			upstreamErrors.Inc(base, errorClassCircuitOpen)
+			log.Debug("upstream circuit breaker is open, skipping", "error_class", errorClassCircuitOpen, "request_id", requestID, "upstream", base)
+			lastErr = &upstreamError{upstream: base, class: errorClassCircuitOpen, err: errCircuitOpen}
+			continue
+		}
+		spanCtx, span := tracing.Start(ctx, "upstream.fetch", tracing.KindClient)
+		span.SetAttribute("upstream", base)
+		req, err := h.newUpstreamRequest(spanCtx, base, hash, queryParams, entry, requestID)
+		if err != nil {
+			log.Error("failed to create upstream request", "error", err, "request_id", requestID, "upstream", base)
+			span.SetError(err)
+			span.End()
+			lastErr = err
+			continue
+		}
+
+		log.Info("fetching from upstream", "request_id", requestID, "url", req.URL.String())
+		span.SetAttribute("url.full", req.URL.String())
+		start := time.Now()
+		resp, err := h.doUpstream(req, base, requestID)
+		upstreamDuration.Observe(time.Since(start).Seconds(), base)
+		h.recordBreaker(ctx, base, resp, err)
+		if err != nil {
+			class := classifyError(err)
+			upstreamResponses.Inc(base, "error")
+			upstreamErrors.Inc(base, class)
+			log.Warn("upstream request failed, trying next", "error", err, "error_class", class, "request_id", requestID, "upstream", base)
+			span.SetAttribute("error.type", class)
+			span.SetError(err)
+			span.End()
+			lastErr = &upstreamError{upstream: base, class: class, err: err}
+			continue
+		}
+
+		upstreamResponses.Inc(base, strconv.Itoa(resp.StatusCode))
+		if class := statusClass(resp.StatusCode); class != "" {
+			upstreamErrors.Inc(base, class)
+		}
+		span.SetAttribute("http.response.status_code", resp.StatusCode)
+		if resp.StatusCode >= http.StatusInternalServerError {
+			span.SetError(fmt.Errorf("upstream returned status %d", resp.StatusCode))
+		}
+		span.End()
+		stripVary(resp, base, requestID)
+
+		if resp.StatusCode < http.StatusInternalServerError {
+			h.lastUpstreamSuccess.Store(time.Now().UnixNano())
+		}
+
+		isLast := i == len(upstreams)-1
+		if resp.StatusCode >= http.StatusInternalServerError && !isLast {
+			log.Warn("upstream returned server error, trying next", "status", resp.StatusCode, "error_class", errorClassStatus5xx, "request_id", requestID, "upstream", base)
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			continue
+		}
+
+		if h.followRedirects && isRedirect(resp.StatusCode) {
+			resp, err = h.followRedirect(ctx, resp, requestID)
+			if err != nil {
+				class := classifyError(err)
+				upstreamErrors.Inc(base, class)
+				log.Warn("failed to follow upstream redirect", "error", err, "error_class", class, "request_id", requestID, "upstream", base)
+				return nil, "", &upstreamError{upstream: base, class: class, err: err}
+			}
+		}
+
+		// 声明的大小超出上限的响应不读取；其余响应读取时超出上限即中止
+		if err := h.limitBody(resp); err != nil {
+			discardInvalid(resp, base, errorClassBodyTooLarge, err, requestID)
+			lastErr = &upstreamError{upstream: base, class: errorClassBodyTooLarge, err: err}
+			continue
+		}
+
+		// 声称成功却不是图片的响应（如HTML错误页）按上游失败处理，不缓存
+		if err := h.checkContent(resp); err != nil {
+			discardInvalid(resp, base, errorClassContentType, err, requestID)
+			lastErr = &upstreamError{upstream: base, class: errorClassContentType, err: err}
+			continue
+		}
+
+		return resp, base, nil
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no upstream configured")
+	}
+	return nil, "", lastErr
+}
+
+// newUpstreamRequest 构造上游请求，附带请求ID，存在旧缓存时附带条件请求头
+func (h *Handler) newUpstreamRequest(ctx context.Context, base, hash string, queryParams map[string]string, entry *cache.CacheEntry, requestID string) (*http.Request, error) {
+	upstreamURL, err := buildUpstreamURL(base, hash, queryParams)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", upstreamURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	tracing.Inject(ctx, req.Header)
+	req.Header.Set("Accept", h.upstreamAccept)
+	req.Header.Set(h.requestIDHeader, requestID)
+
+	// 条件请求头只对产生该缓存的上游有意义
+	if entry != nil && (entry.Metadata.Upstream == "" || entry.Metadata.Upstream == base) {
+		if etag := entry.Metadata.Headers["ETag"]; etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if lastModified := entry.Metadata.Headers["Last-Modified"]; lastModified != "" {
+			req.Header.Set("If-Modified-Since", lastModified)
+		}
+	}
+	return req, nil
+}
+
+// expandUpstream 替换上游地址模板中的{region}占位符
+func expandUpstream(template, region string) string {
+	return strings.ReplaceAll(template, regionPlaceholder, region)
+}
+
+func buildUpstreamURL(base, hash string, queryParams map[string]string) (string, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	u.Path = fmt.Sprintf("/avatar/%s", hash)
+
+	q := u.Query()
+	for k, v := range queryParams {
+		if k != regionParam {
+			q.Set(k, v)
+		}
+	}
+	// 本地生成的默认头像需要上游在头像不存在时返回404
+	if _, ok := localStyle(queryParams); ok {
+		q.Set("d", "404")
+	}
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
@@ -0,0 +1,214 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gravatar-proxy/internal/log"
+)
+
+const (
+	// maxWarmupSeedBytes 预热列表的大小上限，文件、URL和管理接口请求体都适用
+	maxWarmupSeedBytes = 16 << 20
+	// maxWarmupEntries 单次预热最多处理的头像数（每个尺寸算一个），超出的行忽略
+	maxWarmupEntries = 100000
+)
+
+// warmupRequest 是一次预热：seed为nil时读取WARMUP_SEED
+type warmupRequest struct {
+	seed []byte
+}
+
+// StartWarmup 启动预热协程：配置了WARMUP_SEED时先预热一次，之后处理管理接口触发的预热，直到ctx结束
+// 预热复用预取队列和工作协程，队列满时等待而不丢弃，因此不会比实时请求更多地占用上游连接
+func (h *Handler) StartWarmup(ctx context.Context) {
+	go func() {
+		if h.warmupSeed != "" {
+			h.warmup(ctx, nil)
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case req := <-h.warmupRequests:
+				h.warmup(ctx, req.seed)
+			}
+		}
+	}()
+}
+
+// warmup 读取并解析预热列表，将其中的头像逐个放入预取队列
+func (h *Handler) warmup(ctx context.Context, seed []byte) {
+	h.warmupRunning.Store(true)
+	defer h.warmupRunning.Store(false)
+
+	start := time.Now()
+	source := "request"
+	if seed == nil {
+		source = h.warmupSeed
+		var err error
+		if seed, err = h.readWarmupSeed(ctx); err != nil {
+			log.Error("failed to read warm-up seed list", "error", err, "source", source)
+			return
+		}
+	}
+
+	jobs, invalid := h.parseWarmupSeed(seed)
+	warmupEntries.Add(float64(invalid), "invalid")
+	log.Info("cache warm-up started", "source", source, "avatars", len(jobs), "invalid", invalid)
+
+	queued := 0
+	for _, job := range jobs {
+		select {
+		case <-ctx.Done():
+			log.Info("cache warm-up interrupted", "queued", queued, "remaining", len(jobs)-queued)
+			return
+		case h.prefetchQueue <- job:
+			queued++
+			warmupEntries.Inc("queued")
+			prefetchRequests.Inc("queued")
+		}
+	}
+	log.Info("cache warm-up queued", "source", source, "queued", queued, "duration_ms", time.Since(start).Milliseconds())
+}
+
+// readWarmupSeed 读取WARMUP_SEED：http(s) URL用GET获取，否则作为本地文件路径
+func (h *Handler) readWarmupSeed(ctx context.Context) ([]byte, error) {
+	var r io.Reader
+	if strings.HasPrefix(h.warmupSeed, "http://") || strings.HasPrefix(h.warmupSeed, "https://") {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.warmupSeed, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := h.peerClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("seed endpoint returned status %d", resp.StatusCode)
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(h.warmupSeed)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r, maxWarmupSeedBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxWarmupSeedBytes {
+		return nil, fmt.Errorf("seed list is larger than %d bytes", maxWarmupSeedBytes)
+	}
+	return data, nil
+}
+
+// parseWarmupSeed 解析预热列表：每行一个头像哈希，可在空白后跟逗号分隔的尺寸，如"<hash> 80,200"
+// 未列出尺寸的按不带s的默认请求载入；空行和#开头的注释忽略，哈希或尺寸无效的行计入invalid
+func (h *Handler) parseWarmupSeed(data []byte) (jobs []prefetchJob, invalid int) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() && len(jobs) < maxWarmupEntries {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		hash := normalizeHash(fields[0])
+		if !isAvatarHash(hash) || len(fields) > 2 {
+			invalid++
+			continue
+		}
+
+		sizes := []string{""}
+		if len(fields) == 2 {
+			sizes = strings.Split(fields[1], ",")
+			if !validSizes(sizes) {
+				invalid++
+				continue
+			}
+		}
+		for _, size := range sizes {
+			query := url.Values{}
+			if size != "" {
+				query.Set("s", size)
+			}
+			jobs = append(jobs, prefetchJob{hash: hash, params: h.requestParams(query)})
+		}
+	}
+	return jobs, invalid
+}
+
+func validSizes(sizes []string) bool {
+	for _, size := range sizes {
+		if n, err := strconv.Atoi(size); err != nil || n <= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// isAvatarHash 检查hash是否为MD5或SHA-256的小写十六进制形式
+func isAvatarHash(hash string) bool {
+	return (len(hash) == 32 || len(hash) == 64) && isLowerHex(hash)
+}
+
+// isLowerHex 检查s是否只包含小写十六进制字符
+func isLowerHex(s string) bool {
+	return strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && (r < 'a' || r > 'f')
+	}) < 0
+}
+
+// warmupHandler 触发一次预热（POST /admin/warmup），立即返回202
+// 请求体非空时作为预热列表，格式与WARMUP_SEED相同；否则重新读取WARMUP_SEED。已有预热在进行时返回409
+func (h *Handler) warmupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	seed, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWarmupSeedBytes))
+	if err != nil {
+		if isBodyTooLarge(err) {
+			requestsRejected.Inc("body_too_large")
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	req := warmupRequest{}
+	if len(bytes.TrimSpace(seed)) > 0 {
+		req.seed = seed
+	} else if h.warmupSeed == "" {
+		http.Error(w, "No seed list in the request body and WARMUP_SEED is not set", http.StatusBadRequest)
+		return
+	}
+
+	if h.warmupRunning.Load() {
+		http.Error(w, "Warm-up already running", http.StatusConflict)
+		return
+	}
+	select {
+	case h.warmupRequests <- req:
+	default:
+		http.Error(w, "Warm-up already running", http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
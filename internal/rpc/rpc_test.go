@@ -0,0 +1,163 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWireRoundTrip(t *testing.T) {
+	var inner Message
+	inner.String(1, "nested")
+
+	var m Message
+	m.Int(1, 42)
+	m.Int(2, -7)
+	m.Double(3, 0.25)
+	m.Bool(4, true)
+	m.String(5, "héllo")
+	m.Strings(6, []string{"a", ""})
+	m.Message(7, &inner)
+	m.Map(8, map[string]string{"s": "80", "d": "mp"})
+	m.Int(9, 0) // 零值省略
+
+	var ints []int64
+	var strs []string
+	params := map[string]string{}
+	var double float64
+	var flag bool
+	var nested string
+	err := Decode(m.Bytes(), func(f Field) error {
+		switch f.Num {
+		case 1, 2:
+			ints = append(ints, f.Int())
+		case 3:
+			double = f.Double()
+		case 4:
+			flag = f.Bool()
+		case 5, 6:
+			strs = append(strs, f.String())
+		case 7:
+			return Decode(f.Bytes(), func(f Field) error {
+				nested = f.String()
+				return nil
+			})
+		case 8:
+			k, v, err := DecodeMapEntry(f.Bytes())
+			params[k] = v
+			return err
+		case 9:
+			t.Error("expected zero value to be omitted")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if len(ints) != 2 || ints[0] != 42 || ints[1] != -7 {
+		t.Errorf("unexpected ints %v", ints)
+	}
+	if double != 0.25 || !flag || nested != "nested" {
+		t.Errorf("unexpected double %v, bool %v or nested %q", double, flag, nested)
+	}
+	if len(strs) != 3 || strs[0] != "héllo" || strs[1] != "a" || strs[2] != "" {
+		t.Errorf("unexpected strings %q", strs)
+	}
+	if len(params) != 2 || params["s"] != "80" || params["d"] != "mp" {
+		t.Errorf("unexpected map %v", params)
+	}
+
+	// 截断的消息返回错误而不是越界
+	b := m.Bytes()
+	for i := 1; i < len(b); i++ {
+		Decode(b[:i], func(Field) error { return nil })
+	}
+	if err := Decode([]byte{0x2a, 0x05, 'a'}, func(Field) error { return nil }); err == nil {
+		t.Error("expected truncated length-delimited field to fail")
+	}
+}
+
+func TestServer(t *testing.T) {
+	s := NewServer("test.v1.Echo")
+	s.Authorize = func(r *http.Request) error {
+		if r.Header.Get("Authorization") != "Bearer ok" {
+			return Errorf(Unauthenticated, "bad token")
+		}
+		return nil
+	}
+	s.Handle("Echo", func(ctx context.Context, req []byte) ([]byte, error) {
+		if len(req) == 0 {
+			return nil, Errorf(InvalidArgument, "empty %s", "100%")
+		}
+		if _, ok := ctx.Deadline(); !ok {
+			return nil, Errorf(Internal, "expected deadline from grpc-timeout")
+		}
+		return req, nil
+	})
+
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	srv := httptest.NewUnstartedServer(s)
+	srv.Config.Protocols = protocols
+	srv.Start()
+	defer srv.Close()
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+
+	call := func(method, token string, msg []byte) (http.Header, []byte) {
+		t.Helper()
+		frame := make([]byte, 5, 5+len(msg))
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+		req, _ := http.NewRequest("POST", srv.URL+"/test.v1.Echo/"+method, bytes.NewReader(append(frame, msg...)))
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("Grpc-Timeout", "5S")
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("call failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		status := resp.Header.Clone()
+		for k, v := range resp.Trailer {
+			status[k] = v
+		}
+		return status, body
+	}
+
+	status, body := call("Echo", "ok", []byte("ping"))
+	if status.Get("Grpc-Status") != "0" || len(body) != 9 || string(body[5:]) != "ping" {
+		t.Errorf("expected echoed frame with status 0, got %q, %q", status.Get("Grpc-Status"), body)
+	}
+	status, _ = call("Echo", "ok", nil)
+	if status.Get("Grpc-Status") != "3" || status.Get("Grpc-Message") != "empty 100%25" {
+		t.Errorf("expected INVALID_ARGUMENT with encoded message, got %v", status)
+	}
+	if status, _ = call("Echo", "bad", []byte("x")); status.Get("Grpc-Status") != "16" {
+		t.Errorf("expected UNAUTHENTICATED, got %v", status)
+	}
+	if status, _ = call("Missing", "ok", []byte("x")); status.Get("Grpc-Status") != "12" {
+		t.Errorf("expected UNIMPLEMENTED, got %v", status)
+	}
+}
+
+func TestParseTimeout(t *testing.T) {
+	for value, want := range map[string]time.Duration{
+		"5S":   5 * time.Second,
+		"100m": 100 * time.Millisecond,
+		"2H":   2 * time.Hour,
+	} {
+		if got, ok := parseTimeout(value); !ok || got != want {
+			t.Errorf("parseTimeout(%q) = %v, %v; want %v", value, got, ok, want)
+		}
+	}
+	for _, value := range []string{"", "5", "5s", "-1S", "1234567890S"} {
+		if _, ok := parseTimeout(value); ok {
+			t.Errorf("expected %q to be rejected", value)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package rpc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gravatar-proxy/internal/log"
+	"gravatar-proxy/internal/metrics"
+)
+
+// 一个最小的gRPC服务端：只支持HTTP/2上的一元调用，不支持压缩和流式调用
+// 客户端可以用任何gRPC实现按.proto文件生成的代码调用
+
+// maxMessageSize 是请求消息的大小上限，与gRPC的默认接收上限相同
+const maxMessageSize = 4 << 20
+
+var requests = metrics.NewCounter("grpc_requests_total",
+	"gRPC calls by method and status code.", "method", "code")
+
+// Code 是gRPC状态码
+type Code int
+
+const (
+	OK                Code = 0
+	InvalidArgument   Code = 3
+	NotFound          Code = 5
+	ResourceExhausted Code = 8
+	Unimplemented     Code = 12
+	Internal          Code = 13
+	Unavailable       Code = 14
+	Unauthenticated   Code = 16
+)
+
+var codeNames = map[Code]string{
+	OK:                "OK",
+	InvalidArgument:   "INVALID_ARGUMENT",
+	NotFound:          "NOT_FOUND",
+	ResourceExhausted: "RESOURCE_EXHAUSTED",
+	Unimplemented:     "UNIMPLEMENTED",
+	Internal:          "INTERNAL",
+	Unavailable:       "UNAVAILABLE",
+	Unauthenticated:   "UNAUTHENTICATED",
+}
+
+func (c Code) String() string {
+	if name, ok := codeNames[c]; ok {
+		return name
+	}
+	return "CODE(" + strconv.Itoa(int(c)) + ")"
+}
+
+// Status 是带状态码的调用错误，作为grpc-status和grpc-message返回给客户端
+type Status struct {
+	Code    Code
+	Message string
+}
+
+func (s *Status) Error() string {
+	return fmt.Sprintf("rpc error: code = %s desc = %s", s.Code, s.Message)
+}
+
+// Errorf 构造一个调用错误
+func Errorf(code Code, format string, args ...any) error {
+	return &Status{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// statusOf 返回错误对应的状态，非Status错误按Internal处理且不向客户端暴露细节
+func statusOf(err error) *Status {
+	if err == nil {
+		return &Status{Code: OK}
+	}
+	var s *Status
+	if errors.As(err, &s) {
+		return s
+	}
+	return &Status{Code: Internal, Message: "internal error"}
+}
+
+// Method 处理一次一元调用：req为请求消息的protobuf编码，返回响应消息的编码
+type Method func(ctx context.Context, req []byte) ([]byte, error)
+
+// Server 将/<service>/<method>形式的gRPC调用分发给注册的方法
+type Server struct {
+	service string
+	methods map[string]Method
+
+	// Authorize 非nil时在调用方法前检查请求，返回的错误作为调用结果
+	Authorize func(r *http.Request) error
+}
+
+// NewServer 创建服务名为service（如pkg.v1.Service）的服务端
+func NewServer(service string) *Server {
+	return &Server{service: service, methods: make(map[string]Method)}
+}
+
+// Handle 注册方法name
+func (s *Server) Handle(name string, m Method) {
+	s.methods[name] = m
+}
+
+// Prefix 返回服务的路由前缀，供挂载到ServeMux
+func (s *Server) Prefix() string {
+	return "/" + s.service + "/"
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isGRPCContentType(r.Header.Get("Content-Type")) {
+		http.Error(w, "Unsupported content type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	start := time.Now()
+	name := strings.TrimPrefix(r.URL.Path, s.Prefix())
+	resp, err := s.call(r, name)
+	st := statusOf(err)
+	if _, known := s.methods[name]; !known {
+		name = "unknown"
+	}
+	requests.Inc(name, st.Code.String())
+	if st.Code == OK {
+		log.Info("grpc call", "method", name, "code", st.Code.String(), "duration_ms", time.Since(start).Milliseconds())
+	} else {
+		log.Warn("grpc call failed", "method", name, "code", st.Code.String(), "error", err, "duration_ms", time.Since(start).Milliseconds())
+	}
+
+	w.Header().Set("Content-Type", "application/grpc")
+	if st.Code != OK {
+		// 只有头部的响应：状态直接放在响应头中
+		w.Header().Set("Grpc-Status", strconv.Itoa(int(st.Code)))
+		if st.Message != "" {
+			w.Header().Set("Grpc-Message", encodeGRPCMessage(st.Message))
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+	frame := make([]byte, 5, 5+len(resp))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(resp)))
+	w.Write(append(frame, resp...))
+	w.Header().Set("Grpc-Status", "0")
+}
+
+// call 检查调用并读取请求消息后执行方法
+func (s *Server) call(r *http.Request, name string) ([]byte, error) {
+	method, ok := s.methods[name]
+	if !ok {
+		return nil, Errorf(Unimplemented, "unknown method %s", strings.TrimPrefix(r.URL.Path, "/"))
+	}
+	if r.ProtoMajor != 2 {
+		return nil, Errorf(Unimplemented, "gRPC requires HTTP/2")
+	}
+	if s.Authorize != nil {
+		if err := s.Authorize(r); err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := readMessage(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := r.Context()
+	if timeout, ok := parseTimeout(r.Header.Get("Grpc-Timeout")); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return method(ctx, req)
+}
+
+// readMessage 读取一元调用的唯一一条长度前缀消息
+func readMessage(body io.Reader) ([]byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(body, header[:]); err != nil {
+		return nil, Errorf(InvalidArgument, "missing request message")
+	}
+	if header[0] != 0 {
+		return nil, Errorf(Unimplemented, "compressed messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxMessageSize {
+		return nil, Errorf(ResourceExhausted, "request message of %d bytes exceeds %d", size, maxMessageSize)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(body, msg); err != nil {
+		return nil, Errorf(InvalidArgument, "truncated request message")
+	}
+	return msg, nil
+}
+
+func isGRPCContentType(contentType string) bool {
+	return contentType == "application/grpc" ||
+		strings.HasPrefix(contentType, "application/grpc+proto") ||
+		strings.HasPrefix(contentType, "application/grpc;")
+}
+
+// parseTimeout 解析grpc-timeout请求头，如100m、5S
+func parseTimeout(value string) (time.Duration, bool) {
+	if len(value) < 2 || len(value) > 9 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	units := map[byte]time.Duration{
+		'H': time.Hour,
+		'M': time.Minute,
+		'S': time.Second,
+		'm': time.Millisecond,
+		'u': time.Microsecond,
+		'n': time.Nanosecond,
+	}
+	unit, ok := units[value[len(value)-1]]
+	if !ok {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+// encodeGRPCMessage 按gRPC规范对grpc-message做百分号编码
+func encodeGRPCMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c >= 0x20 && c <= 0x7e && c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
@@ -0,0 +1,207 @@
+package rpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// 一个最小的protobuf（proto3）编解码实现，只覆盖管理接口用到的标量、字符串、嵌套消息和map<string, string>
+
+// protobuf的线路类型
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errTruncated = errors.New("rpc: truncated protobuf message")
+
+// Message 按字段号追加编码一条消息；标量字段为零值时按proto3的规则省略
+type Message struct {
+	b []byte
+}
+
+func (m *Message) tag(num, wireType int) {
+	m.b = binary.AppendUvarint(m.b, uint64(num)<<3|uint64(wireType))
+}
+
+// Uint 编码uint32/uint64字段
+func (m *Message) Uint(num int, v uint64) {
+	if v == 0 {
+		return
+	}
+	m.tag(num, wireVarint)
+	m.b = binary.AppendUvarint(m.b, v)
+}
+
+// Int 编码int32/int64字段（负数按补码占10字节，与protobuf一致）
+func (m *Message) Int(num int, v int64) {
+	m.Uint(num, uint64(v))
+}
+
+func (m *Message) Bool(num int, v bool) {
+	if v {
+		m.Uint(num, 1)
+	}
+}
+
+func (m *Message) Double(num int, v float64) {
+	if v == 0 {
+		return
+	}
+	m.tag(num, wireFixed64)
+	m.b = binary.LittleEndian.AppendUint64(m.b, math.Float64bits(v))
+}
+
+func (m *Message) String(num int, v string) {
+	if v == "" {
+		return
+	}
+	m.bytes(num, []byte(v))
+}
+
+// Strings 编码repeated string字段，空字符串也保留
+func (m *Message) Strings(num int, vs []string) {
+	for _, v := range vs {
+		m.bytes(num, []byte(v))
+	}
+}
+
+// Message 编码嵌套消息字段；repeated字段对每个元素调用一次
+func (m *Message) Message(num int, sub *Message) {
+	m.bytes(num, sub.b)
+}
+
+// Map 编码map<string, string>字段，按键排序使输出稳定
+func (m *Message) Map(num int, kv map[string]string) {
+	keys := make([]string, 0, len(kv))
+	for k := range kv {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var entry Message
+		entry.String(1, k)
+		entry.String(2, kv[k])
+		m.Message(num, &entry)
+	}
+}
+
+func (m *Message) bytes(num int, v []byte) {
+	m.tag(num, wireBytes)
+	m.b = binary.AppendUvarint(m.b, uint64(len(v)))
+	m.b = append(m.b, v...)
+}
+
+// Bytes 返回编码后的消息
+func (m *Message) Bytes() []byte {
+	return m.b
+}
+
+// Field 是解码出的一个字段；按声明的类型取值，线路类型不符时取到零值
+type Field struct {
+	Num      int
+	wireType int
+	varint   uint64
+	raw      []byte
+}
+
+func (f Field) Uint() uint64 {
+	if f.wireType != wireVarint {
+		return 0
+	}
+	return f.varint
+}
+
+func (f Field) Int() int64 {
+	return int64(f.Uint())
+}
+
+func (f Field) Bool() bool {
+	return f.Uint() != 0
+}
+
+func (f Field) Double() float64 {
+	if f.wireType != wireFixed64 {
+		return 0
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(f.raw))
+}
+
+func (f Field) String() string {
+	return string(f.Bytes())
+}
+
+// Bytes 返回字符串、bytes或嵌套消息字段的内容
+func (f Field) Bytes() []byte {
+	if f.wireType != wireBytes {
+		return nil
+	}
+	return f.raw
+}
+
+// Decode 依次对消息中的每个字段调用fn，未知字段由调用方忽略即可
+func Decode(b []byte, fn func(Field) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errTruncated
+		}
+		b = b[n:]
+		f := Field{Num: int(key >> 3), wireType: int(key & 7)}
+		if f.Num == 0 {
+			return fmt.Errorf("rpc: invalid protobuf field number 0")
+		}
+
+		switch f.wireType {
+		case wireVarint:
+			f.varint, n = binary.Uvarint(b)
+			if n <= 0 {
+				return errTruncated
+			}
+			b = b[n:]
+		case wireFixed64:
+			if len(b) < 8 {
+				return errTruncated
+			}
+			f.raw, b = b[:8], b[8:]
+		case wireFixed32:
+			if len(b) < 4 {
+				return errTruncated
+			}
+			f.raw, b = b[:4], b[4:]
+		case wireBytes:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || size > uint64(len(b)-n) {
+				return errTruncated
+			}
+			b = b[n:]
+			f.raw, b = b[:size], b[size:]
+		default:
+			return fmt.Errorf("rpc: unsupported protobuf wire type %d", f.wireType)
+		}
+
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DecodeMapEntry 解码map<string, string>字段的一个条目
+func DecodeMapEntry(b []byte) (key, value string, err error) {
+	err = Decode(b, func(f Field) error {
+		switch f.Num {
+		case 1:
+			key = f.String()
+		case 2:
+			value = f.String()
+		}
+		return nil
+	})
+	return key, value, err
+}
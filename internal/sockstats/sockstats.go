@@ -0,0 +1,149 @@
+// Package sockstats 导出服务器连接数和内核监听队列的指标
+// 连接数在所有平台上按http.Server的连接状态统计；监听队列长度和溢出次数只在Linux上从/proc读取
+// 用于排查"代理慢而上游快"的问题是否出在内核的accept队列积压
+package sockstats
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gravatar-proxy/internal/log"
+	"gravatar-proxy/internal/metrics"
+)
+
+var (
+	connections = metrics.NewGauge("server_connections",
+		"Open client connections on the main port by state (new, active, idle).", "state")
+	accepted = metrics.NewCounter("server_connections_accepted_total",
+		"Client connections accepted on the main port.")
+)
+
+// tracker 记录每个连接的当前状态，状态变化时调整对应的计数
+type tracker struct {
+	mu     sync.Mutex
+	states map[net.Conn]http.ConnState
+}
+
+func (t *tracker) connState(conn net.Conn, state http.ConnState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if prev, ok := t.states[conn]; ok {
+		connections.Add(-1, prev.String())
+	}
+	switch state {
+	case http.StateNew, http.StateActive, http.StateIdle:
+		if state == http.StateNew {
+			accepted.Inc()
+		}
+		t.states[conn] = state
+		connections.Add(1, state.String())
+	default:
+		// 关闭或被接管（如WebSocket、h2c升级）的连接不再由服务器管理
+		delete(t.states, conn)
+	}
+}
+
+// Register 为服务器统计连接数，并在支持的平台上注册port端口的监听队列指标
+// 服务器已有的ConnState回调保留并继续调用
+func Register(server *http.Server, port string) error {
+	listenPort, err := strconv.Atoi(port)
+	if err != nil {
+		return fmt.Errorf("invalid listen port %q", port)
+	}
+
+	t := &tracker{states: make(map[net.Conn]http.ConnState)}
+	next := server.ConnState
+	server.ConnState = func(conn net.Conn, state http.ConnState) {
+		t.connState(conn, state)
+		if next != nil {
+			next(conn, state)
+		}
+	}
+
+	if !supported {
+		log.Info("listen queue statistics are not available on this platform, only counting connections")
+		return nil
+	}
+	metrics.NewGaugeFunc("listen_queue_length",
+		"Connections waiting in the kernel accept queue of the main port.", func() float64 {
+			queued, err := readListenQueue(listenPort)
+			if err != nil {
+				log.Debug("failed to read listen queue", "error", err)
+			}
+			return float64(queued)
+		})
+	metrics.NewGaugeFunc("listen_queue_max",
+		"Kernel limit of the accept queue (net.core.somaxconn, which Go uses as the listen backlog).", func() float64 {
+			limit, _ := readSomaxconn()
+			return float64(limit)
+		})
+	metrics.NewGaugeFunc("tcp_listen_overflows",
+		"Times an accept queue was full since boot, for the whole network namespace (TcpExt ListenOverflows).", func() float64 {
+			return float64(readTCPExt("ListenOverflows"))
+		})
+	metrics.NewGaugeFunc("tcp_listen_drops",
+		"Incoming connections dropped by listening sockets since boot, for the whole network namespace (TcpExt ListenDrops).", func() float64 {
+			return float64(readTCPExt("ListenDrops"))
+		})
+	return nil
+}
+
+// parseListenQueue 从/proc/net/tcp格式的内容中累加监听port端口的套接字的accept队列长度
+// 监听状态（0A）的套接字在rx_queue一栏报告accept队列中的连接数；启用SO_REUSEPORT时可能有多个
+func parseListenQueue(data []byte, port int) (uint64, bool) {
+	var total uint64
+	found := false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || fields[3] != "0A" {
+			continue
+		}
+		_, localPort, ok := strings.Cut(fields[1], ":")
+		if !ok {
+			continue
+		}
+		if p, err := strconv.ParseUint(localPort, 16, 16); err != nil || int(p) != port {
+			continue
+		}
+		_, rxQueue, ok := strings.Cut(fields[4], ":")
+		if !ok {
+			continue
+		}
+		queued, err := strconv.ParseUint(rxQueue, 16, 64)
+		if err != nil {
+			continue
+		}
+		total += queued
+		found = true
+	}
+	return total, found
+}
+
+// parseNetstat 解析/proc/net/netstat格式的内容：每组两行，第一行为字段名，第二行为对应的值
+func parseNetstat(data []byte, group string) map[string]uint64 {
+	values := make(map[string]uint64)
+	lines := strings.Split(string(data), "\n")
+	prefix := group + ":"
+	for i := 0; i+1 < len(lines); i++ {
+		if !strings.HasPrefix(lines[i], prefix) || !strings.HasPrefix(lines[i+1], prefix) {
+			continue
+		}
+		names := strings.Fields(lines[i])[1:]
+		counts := strings.Fields(lines[i+1])[1:]
+		for j := 0; j < len(names) && j < len(counts); j++ {
+			if n, err := strconv.ParseUint(counts[j], 10, 64); err == nil {
+				values[names[j]] = n
+			}
+		}
+		break
+	}
+	return values
+}
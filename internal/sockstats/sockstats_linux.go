@@ -0,0 +1,48 @@
+package sockstats
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const supported = true
+
+// readListenQueue 返回监听port端口的IPv4和IPv6套接字的accept队列长度之和
+func readListenQueue(port int) (uint64, error) {
+	var total uint64
+	found := false
+	for _, path := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		if queued, ok := parseListenQueue(data, port); ok {
+			total += queued
+			found = true
+		}
+	}
+	if !found {
+		return 0, errors.New("no listening socket found for port " + strconv.Itoa(port))
+	}
+	return total, nil
+}
+
+// readSomaxconn 返回net.core.somaxconn，Go以它作为listen的backlog
+func readSomaxconn() (uint64, error) {
+	data, err := os.ReadFile("/proc/sys/net/core/somaxconn")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// readTCPExt 返回/proc/net/netstat中TcpExt组的计数，读取失败时返回0
+func readTCPExt(name string) uint64 {
+	data, err := os.ReadFile("/proc/net/netstat")
+	if err != nil {
+		return 0
+	}
+	return parseNetstat(data, "TcpExt")[name]
+}
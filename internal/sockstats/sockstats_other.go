@@ -0,0 +1,15 @@
+//go:build !linux
+
+package sockstats
+
+import "errors"
+
+const supported = false
+
+var errUnsupported = errors.New("listen queue statistics are only available on Linux")
+
+func readListenQueue(int) (uint64, error) { return 0, errUnsupported }
+
+func readSomaxconn() (uint64, error) { return 0, errUnsupported }
+
+func readTCPExt(string) uint64 { return 0 }
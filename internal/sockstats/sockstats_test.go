@@ -0,0 +1,78 @@
+package sockstats
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestParseListenQueue(t *testing.T) {
+	// 8080端口（0x1F90）有两个监听套接字（SO_REUSEPORT），另有一个已建立的连接和其他端口的监听套接字
+	data := []byte(`  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:1F90 00000000:0000 0A 00000000:00000003 00:00000000 00000000  1000        0 1 1 0000000000000000 100 0 0 10 0
+   1: 00000000:1F90 00000000:0000 0A 00000000:00000002 00:00000000 00000000  1000        0 2 1 0000000000000000 100 0 0 10 0
+   2: 0100007F:1F90 0100007F:D431 01 00000000:00000040 00:00000000 00000000  1000        0 3 1 0000000000000000 20 4 30 10 -1
+   3: 00000000:0050 00000000:0000 0A 00000000:00000009 00:00000000 00000000     0        0 4 1 0000000000000000 100 0 0 10 0
+`)
+	if got, ok := parseListenQueue(data, 8080); !ok || got != 5 {
+		t.Errorf("expected queue 5 for port 8080, got %d (found %v)", got, ok)
+	}
+	if _, ok := parseListenQueue(data, 9090); ok {
+		t.Error("expected no listening socket for port 9090")
+	}
+}
+
+func TestParseNetstat(t *testing.T) {
+	data := []byte(`TcpExt: SyncookiesSent ListenOverflows ListenDrops
+TcpExt: 0 12 15
+IpExt: InNoRoutes InTruncatedPkts
+IpExt: 0 0
+`)
+	values := parseNetstat(data, "TcpExt")
+	if values["ListenOverflows"] != 12 || values["ListenDrops"] != 15 {
+		t.Errorf("unexpected TcpExt values: %v", values)
+	}
+	if len(parseNetstat(data, "MPTcpExt")) != 0 {
+		t.Error("expected no values for a missing group")
+	}
+}
+
+func TestConnState(t *testing.T) {
+	if err := Register(&http.Server{}, "x"); err == nil {
+		t.Fatal("expected an error for an invalid port")
+	}
+
+	// 服务器已有的ConnState回调仍然被调用
+	var calls int
+	server := &http.Server{ConnState: func(net.Conn, http.ConnState) { calls++ }}
+	if err := Register(server, "8080"); err != nil {
+		t.Fatal(err)
+	}
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	defer conn.Close()
+
+	before := accepted.Value()
+	server.ConnState(conn, http.StateNew)
+	server.ConnState(conn, http.StateActive)
+	if got := connections.Value("active"); got != 1 {
+		t.Errorf("expected 1 active connection, got %v", got)
+	}
+	if got := connections.Value("new"); got != 0 {
+		t.Errorf("expected 0 new connections, got %v", got)
+	}
+	server.ConnState(conn, http.StateIdle)
+	server.ConnState(conn, http.StateClosed)
+	for _, state := range []string{"new", "active", "idle"} {
+		if got := connections.Value(state); got != 0 {
+			t.Errorf("expected 0 %s connections after close, got %v", state, got)
+		}
+	}
+	if got := accepted.Value() - before; got != 1 {
+		t.Errorf("expected 1 accepted connection, got %v", got)
+	}
+	if calls != 4 {
+		t.Errorf("expected the existing ConnState hook to be called 4 times, got %d", calls)
+	}
+}
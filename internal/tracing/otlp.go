@@ -0,0 +1,255 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"gravatar-proxy/internal/log"
+	"gravatar-proxy/internal/metrics"
+)
+
+const (
+	queueSize     = 2048
+	maxBatchSize  = 512
+	flushInterval = 5 * time.Second
+	exportTimeout = 10 * time.Second
+)
+
+var spansExported = metrics.NewCounter("trace_spans_total",
+	"Finished spans by export result (exported, dropped, failed).", "result")
+
+// exporter 在后台批量发送span到OTLP/HTTP端点
+type exporter struct {
+	endpoint    string
+	headers     map[string]string
+	serviceName string
+	client      *http.Client
+
+	queue chan *Span
+	done  chan struct{}
+}
+
+var active atomic.Pointer[exporter]
+
+func current() *exporter {
+	return active.Load()
+}
+
+// Init 启动导出器；endpoint为空时追踪保持关闭，Start不产生span
+func Init(endpoint string, headers map[string]string, serviceName string) {
+	if endpoint == "" {
+		return
+	}
+	e := &exporter{
+		endpoint:    endpoint,
+		headers:     headers,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: exportTimeout},
+		queue:       make(chan *Span, queueSize),
+		done:        make(chan struct{}),
+	}
+	active.Store(e)
+	go e.run()
+}
+
+// Shutdown 停止接收新span并发送队列中剩余的span
+func Shutdown(ctx context.Context) error {
+	e := active.Swap(nil)
+	if e == nil {
+		return nil
+	}
+	close(e.queue)
+	select {
+	case <-e.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *exporter) enqueue(s *Span) {
+	// Shutdown关闭队列后，仍在结束的span直接丢弃
+	defer func() {
+		if recover() != nil {
+			spansExported.Inc("dropped")
+		}
+	}()
+	select {
+	case e.queue <- s:
+	default:
+		spansExported.Inc("dropped")
+	}
+}
+
+func (e *exporter) run() {
+	defer close(e.done)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, maxBatchSize)
+	for {
+		select {
+		case s, ok := <-e.queue:
+			if !ok {
+				e.export(batch)
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) >= maxBatchSize {
+				e.export(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			e.export(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+func (e *exporter) export(batch []*Span) {
+	if len(batch) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(e.encode(batch))
+	if err != nil {
+		log.Warn("failed to encode spans", "error", err)
+		spansExported.Add(float64(len(batch)), "failed")
+		return
+	}
+
+	req, err := http.NewRequest("POST", e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		log.Warn("failed to create span export request", "error", err)
+		spansExported.Add(float64(len(batch)), "failed")
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := e.client.Do(req)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			err = fmt.Errorf("collector returned status %d", resp.StatusCode)
+		}
+	}
+	if err != nil {
+		log.Warn("failed to export spans", "error", err, "spans", len(batch))
+		spansExported.Add(float64(len(batch)), "failed")
+		return
+	}
+	spansExported.Add(float64(len(batch)), "exported")
+}
+
+// 以下类型对应OTLP的JSON编码（ExportTraceServiceRequest）
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              Kind           `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            *otlpStatus    `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+func (e *exporter) encode(batch []*Span) otlpRequest {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		s.mu.Lock()
+		span := otlpSpan{
+			TraceID:           hex.EncodeToString(s.sc.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.sc.SpanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parentID != [8]byte{} {
+			span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		for _, a := range s.attributes {
+			span.Attributes = append(span.Attributes, keyValue(a.key, a.value))
+		}
+		if s.errMsg != "" {
+			span.Status = &otlpStatus{Code: 2, Message: s.errMsg}
+		}
+		s.mu.Unlock()
+		spans = append(spans, span)
+	}
+
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpKeyValue{
+			keyValue("service.name", e.serviceName),
+		}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "gravatar-proxy"},
+			Spans: spans,
+		}},
+	}}}
+}
+
+// keyValue 按OTLP JSON的AnyValue编码属性值，64位整数编码为字符串
+func keyValue(key string, value any) otlpKeyValue {
+	var v map[string]any
+	switch value := value.(type) {
+	case string:
+		v = map[string]any{"stringValue": value}
+	case bool:
+		v = map[string]any{"boolValue": value}
+	case int:
+		v = map[string]any{"intValue": strconv.Itoa(value)}
+	case int64:
+		v = map[string]any{"intValue": strconv.FormatInt(value, 10)}
+	case float64:
+		v = map[string]any{"doubleValue": value}
+	default:
+		v = map[string]any{"stringValue": fmt.Sprint(value)}
+	}
+	return otlpKeyValue{Key: key, Value: v}
+}
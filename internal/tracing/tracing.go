@@ -0,0 +1,202 @@
+// Package tracing 实现了一个精简的OpenTelemetry兼容追踪：
+// W3C traceparent传播，span以OTLP/HTTP JSON格式批量导出
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kind 对应OTLP的SpanKind
+type Kind int
+
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+	KindClient   Kind = 3
+)
+
+const traceparentHeader = "traceparent"
+
+// SpanContext 标识一个span，可跨进程传播
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+
+	// propagate 为true时Inject才写出traceparent：启用了导出，或追踪上下文来自传入的traceparent
+	propagate bool
+}
+
+// IsValid 判断trace ID和span ID是否都非零
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// Span 记录一次操作的耗时和属性；nil Span的所有方法都是空操作
+type Span struct {
+	sc       SpanContext
+	parentID [8]byte
+	name     string
+	kind     Kind
+	start    time.Time
+	end      time.Time
+
+	mu         sync.Mutex
+	attributes []attribute
+	errMsg     string
+	ended      bool
+}
+
+type attribute struct {
+	key   string
+	value any
+}
+
+type spanContextKey struct{}
+
+// Start 以ctx中的span（或传入的远程父span）为父创建子span
+// 未启用导出或父span未采样时返回nil，但仍会返回携带追踪上下文的ctx以便继续传播
+func Start(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	parent := spanContextFrom(ctx)
+
+	sc := SpanContext{Sampled: true, propagate: current() != nil}
+	if parent.IsValid() {
+		sc.TraceID = parent.TraceID
+		sc.Sampled = parent.Sampled
+		sc.propagate = sc.propagate || parent.propagate
+	} else {
+		rand.Read(sc.TraceID[:])
+	}
+	rand.Read(sc.SpanID[:])
+
+	ctx = context.WithValue(ctx, spanContextKey{}, sc)
+	if !sc.Sampled || current() == nil {
+		return ctx, nil
+	}
+
+	return ctx, &Span{
+		sc:       sc,
+		parentID: parent.SpanID,
+		name:     name,
+		kind:     kind,
+		start:    time.Now(),
+	}
+}
+
+// SetAttribute 设置属性，支持string、bool、int、int64和float64
+func (s *Span) SetAttribute(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attributes = append(s.attributes, attribute{key: key, value: value})
+	s.mu.Unlock()
+}
+
+// SetError 将span标记为失败
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.errMsg = err.Error()
+	s.mu.Unlock()
+}
+
+// End 结束span并提交导出；重复调用无效
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	if e := current(); e != nil {
+		e.enqueue(s)
+	}
+}
+
+func spanContextFrom(ctx context.Context) SpanContext {
+	sc, _ := ctx.Value(spanContextKey{}).(SpanContext)
+	return sc
+}
+
+// Extract 从请求头的traceparent中恢复远程父span
+func Extract(ctx context.Context, header http.Header) context.Context {
+	sc, ok := parseTraceparent(header.Get(traceparentHeader))
+	if !ok {
+		return ctx
+	}
+	sc.propagate = true
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// Inject 将ctx中的追踪上下文写入请求头的traceparent
+// 未启用追踪且请求没有带traceparent时不写出，本地生成的trace ID只用于日志关联
+func Inject(ctx context.Context, header http.Header) {
+	sc := spanContextFrom(ctx)
+	if !sc.IsValid() || !sc.propagate {
+		return
+	}
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	header.Set(traceparentHeader, fmt.Sprintf("00-%s-%s-%s",
+		hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]), flags))
+}
+
+// TraceID 返回ctx中的trace ID，不存在时返回空字符串，用于日志关联
+func TraceID(ctx context.Context) string {
+	sc := spanContextFrom(ctx)
+	if !sc.IsValid() {
+		return ""
+	}
+	return hex.EncodeToString(sc.TraceID[:])
+}
+
+// parseTraceparent 解析version-traceid-spanid-flags格式的traceparent
+func parseTraceparent(value string) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return SpanContext{}, false
+	}
+	// 版本00必须恰好4段，未来版本允许追加字段
+	if parts[0] == "00" && len(parts) != 4 {
+		return SpanContext{}, false
+	}
+
+	var sc SpanContext
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return SpanContext{}, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return SpanContext{}, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return SpanContext{}, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return SpanContext{}, false
+	}
+	sc.Sampled = flags[0]&0x01 == 1
+
+	if !sc.IsValid() {
+		return SpanContext{}, false
+	}
+	return sc, true
+}
@@ -0,0 +1,98 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTraceparentPropagation(t *testing.T) {
+	incoming := http.Header{}
+	incoming.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	ctx := Extract(context.Background(), incoming)
+	ctx, _ = Start(ctx, "child", KindInternal)
+
+	outgoing := http.Header{}
+	Inject(ctx, outgoing)
+	sc, ok := parseTraceparent(outgoing.Get("traceparent"))
+	if !ok {
+		t.Fatalf("failed to parse injected traceparent %q", outgoing.Get("traceparent"))
+	}
+	if got := TraceID(ctx); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("expected trace ID to be inherited, got %s", got)
+	}
+	if !sc.Sampled {
+		t.Error("expected sampled flag to be propagated")
+	}
+
+	// 未启用导出时，本地开始的追踪不向外传播
+	local, _ := Start(context.Background(), "local", KindServer)
+	outgoing = http.Header{}
+	Inject(local, outgoing)
+	if v := outgoing.Get("traceparent"); v != "" {
+		t.Errorf("expected no traceparent without tracing or an incoming one, got %q", v)
+	}
+	if TraceID(local) == "" {
+		t.Error("expected a local trace ID for log correlation")
+	}
+
+	for _, invalid := range []string{
+		"",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-xyz-00f067aa0ba902b7-01",
+	} {
+		if _, ok := parseTraceparent(invalid); ok {
+			t.Errorf("expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestExportOTLPJSON(t *testing.T) {
+	received := make(chan otlpRequest, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("expected configured header, got %q", r.Header.Get("Authorization"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		var req otlpRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			t.Errorf("invalid OTLP JSON: %v", err)
+		}
+		received <- req
+	}))
+	defer collector.Close()
+
+	Init(collector.URL+"/v1/traces", map[string]string{"Authorization": "Bearer token"}, "test-service")
+
+	ctx, parent := Start(context.Background(), "parent", KindServer)
+	_, child := Start(ctx, "child", KindClient)
+	child.SetAttribute("http.response.status_code", 200)
+	child.End()
+	parent.End()
+
+	if err := Shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+
+	req := <-received
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	if spans[0].Name != "child" || spans[0].ParentSpanID != spans[1].SpanID || spans[0].TraceID != spans[1].TraceID {
+		t.Errorf("expected child span to reference its parent, got %+v", spans)
+	}
+	if v := spans[0].Attributes[0].Value["intValue"]; v != "200" {
+		t.Errorf("expected int attribute encoded as string, got %v", v)
+	}
+
+	if _, span := Start(context.Background(), "after-shutdown", KindInternal); span != nil {
+		t.Error("expected no span once the exporter is shut down")
+	}
+}